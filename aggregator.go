@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// AggregatorSource is a source of the events merged by an Aggregator, such as
+// an Eventer of each backend or host.
+type AggregatorSource struct {
+	// Label identifies the source of each event. Labels should be unique.
+	Label string
+	// Eventer is the source of events. If it is also an event.EventerCloser,
+	// it is closed with the Aggregator.
+	Eventer event.Eventer
+}
+
+// LabelledEvent is an event merged by an Aggregator, labelled with its source.
+type LabelledEvent struct {
+	*event.Event
+	// Source is the label of the source of the event.
+	Source string
+}
+
+// AggregatorResult is the outcome of reading an event from a source.
+type aggregatorResult struct {
+	arrived time.Time
+	event   *LabelledEvent
+	err     error
+	ended   bool // Whether the source returns no more events
+}
+
+// Time returns the time by which the result is ordered, which for errors,
+// which have no event, is their arrival.
+func (r *aggregatorResult) time() time.Time {
+	if r.event != nil {
+		return r.event.Time
+	}
+
+	return r.arrived
+}
+
+// AggregatorResultHeap is a min-heap of aggregator results, ordered by time.
+type aggregatorResultHeap []*aggregatorResult
+
+func (h aggregatorResultHeap) Len() int           { return len(h) }
+func (h aggregatorResultHeap) Less(i, j int) bool { return h[i].time().Before(h[j].time()) }
+func (h aggregatorResultHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *aggregatorResultHeap) Push(x interface{}) {
+	*h = append(*h, x.(*aggregatorResult))
+}
+
+func (h *aggregatorResultHeap) Pop() interface{} {
+	old := *h
+	result := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return result
+}
+
+// Aggregator merges the events of several sources, such as Eventers of the
+// tracefs and sock-diag backends, into a single stream ordered by event time,
+// each labelled with its source. Each source is read in its own goroutine. As
+// a source may be idle indefinitely, the merge cannot wait for an event from
+// every source, so instead holds each event for the reorder window, as for
+// per-CPU readers. A source ends once it returns io.EOF, io.ErrUnexpectedEOF
+// or ErrEventerClosed, and once all have ended, the Aggregator returns io.EOF.
+// Other errors of a source are returned labelled with its source, which is
+// then read again.
+type Aggregator struct {
+	sources []AggregatorSource
+	window  time.Duration
+	results chan *aggregatorResult
+	pending aggregatorResultHeap // Only accessed by the reader of events
+	active  int                  // Only accessed by the reader of events, the number of sources not ended
+
+	done     chan struct{}
+	doneOnce *sync.Once
+}
+
+// NewAggregator returns an Aggregator of the sources, which holds each event
+// for the reorder window before releasing it. At least one source is required.
+func NewAggregator(window time.Duration, sources ...AggregatorSource) (*Aggregator, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no sources to aggregate")
+	}
+
+	if window < 0 {
+		return nil, errors.New("negative reorder window")
+	}
+
+	a := &Aggregator{
+		sources:  sources,
+		window:   window,
+		results:  make(chan *aggregatorResult, 64*len(sources)),
+		active:   len(sources),
+		done:     make(chan struct{}),
+		doneOnce: new(sync.Once),
+	}
+
+	for _, source := range sources {
+		go a.readSource(source)
+	}
+
+	return a, nil
+}
+
+// ReadSource reads the events of the source until it ends, or the Aggregator
+// is closed.
+func (a *Aggregator) readSource(source AggregatorSource) {
+	for {
+		event, err := source.Eventer.Event()
+		result := &aggregatorResult{arrived: time.Now()}
+		switch {
+		case err == nil:
+			result.event = &LabelledEvent{Event: event, Source: source.Label}
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, ErrEventerClosed):
+			result.ended = true
+		default:
+			result.err = fmt.Errorf("reading from source %q: %w", source.Label, err)
+		}
+
+		select {
+		case a.results <- result:
+		case <-a.done:
+			return
+		}
+
+		if result.ended {
+			return
+		}
+	}
+}
+
+// Event returns the next event of any source, without its label.
+func (a *Aggregator) Event() (*event.Event, error) {
+	labelledEvent, err := a.LabelledEvent()
+	if err != nil {
+		return nil, err
+	}
+
+	return labelledEvent.Event, nil
+}
+
+// LabelledEvent returns the earliest pending event of any source, once it has
+// been held for the reorder window.
+func (a *Aggregator) LabelledEvent() (*LabelledEvent, error) {
+	for {
+		var timer *time.Timer
+		var release <-chan time.Time
+		if len(a.pending) > 0 {
+			wait := time.Until(a.pending[0].arrived.Add(a.window))
+			if wait <= 0 {
+				result := heap.Pop(&a.pending).(*aggregatorResult)
+				if result.err != nil {
+					return nil, result.err
+				}
+
+				return result.event, nil
+			}
+
+			timer = time.NewTimer(wait)
+			release = timer.C
+		} else if a.active == 0 {
+			return nil, io.EOF
+		}
+
+		var closed bool
+		select {
+		case result := <-a.results:
+			if result.ended {
+				a.active--
+			} else {
+				heap.Push(&a.pending, result)
+			}
+		case <-release:
+		case <-a.done:
+			closed = true
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if closed {
+			return nil, ErrEventerClosed
+		}
+	}
+}
+
+// Close stops the reading of the sources, and closes those which are
+// event.EventerClosers, returning the first error of closing any.
+func (a *Aggregator) Close() error {
+	a.doneOnce.Do(func() { close(a.done) })
+
+	var firstErr error
+	for _, source := range a.sources {
+		closer, ok := source.Eventer.(event.EventerCloser)
+		if !ok {
+			continue
+		}
+
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("closing source %q: %w", source.Label, err)
+		}
+	}
+
+	return firstErr
+}
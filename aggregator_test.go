@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// MockSourceEventer returns its events, or errors where the event is nil, and
+// then io.EOF.
+type mockSourceEventer struct {
+	events []*event.Event
+	err    error
+	closed bool
+}
+
+func (e *mockSourceEventer) Event() (*event.Event, error) {
+	if len(e.events) == 0 {
+		return nil, io.EOF
+	}
+
+	next := e.events[0]
+	e.events = e.events[1:]
+	if next == nil {
+		return nil, e.err
+	}
+
+	return next, nil
+}
+
+func (e *mockSourceEventer) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestAggregatorMergesByTime(t *testing.T) {
+	start := time.Now()
+	tracefs := &mockSourceEventer{events: []*event.Event{
+		{Time: start, SourcePort: 1},
+		{Time: start.Add(2 * time.Millisecond), SourcePort: 3},
+	}}
+	sockDiag := &mockSourceEventer{events: []*event.Event{
+		{Time: start.Add(time.Millisecond), SourcePort: 2},
+	}}
+
+	aggregator, err := NewAggregator(20*time.Millisecond,
+		AggregatorSource{Label: "tracefs", Eventer: tracefs},
+		AggregatorSource{Label: "sock-diag", Eventer: sockDiag})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer aggregator.Close()
+
+	for _, expected := range []struct {
+		port   uint16
+		source string
+	}{
+		{1, "tracefs"},
+		{2, "sock-diag"},
+		{3, "tracefs"},
+	} {
+		labelledEvent, err := aggregator.LabelledEvent()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if labelledEvent.SourcePort != expected.port || labelledEvent.Source != expected.source {
+			t.Errorf("expected event %d of %q, got %d of %q",
+				expected.port,
+				expected.source,
+				labelledEvent.SourcePort,
+				labelledEvent.Source)
+		}
+	}
+
+	if _, err := aggregator.Event(); err != io.EOF {
+		t.Errorf("expected io.EOF once all sources ended, got %q (of type %T)", err, err)
+	}
+}
+
+func TestAggregatorSourceError(t *testing.T) {
+	mockError := errors.New("mock source error")
+	source := &mockSourceEventer{events: []*event.Event{nil, {Time: time.Now()}}, err: mockError}
+
+	aggregator, err := NewAggregator(0, AggregatorSource{Label: "mock", Eventer: source})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer aggregator.Close()
+
+	_, err = aggregator.Event()
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not: %q", mockError, err)
+	}
+
+	// The source is read again after an error
+	if _, err := aggregator.Event(); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestAggregatorCloseClosesSources(t *testing.T) {
+	source := new(mockSourceEventer)
+	aggregator, err := NewAggregator(0, AggregatorSource{Label: "mock", Eventer: source})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	if err := aggregator.Close(); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !source.closed {
+		t.Error("expected source to be closed, but was not")
+	}
+}
+
+func TestNewAggregatorNoSourcesError(t *testing.T) {
+	_, err := NewAggregator(0)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
@@ -0,0 +1,1146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envPrefix = "TCP_AUDIT_TRACEFS_"
+
+// The methods by which a tracepoint can be enabled in a tracing instance.
+const (
+	enableMethodEnableFile = "enable"    // Write to each tracepoint's own enable file
+	enableMethodSetEvent   = "set_event" // Write all tracepoints to the instance set_event file
+)
+
+// The modes in which events can be read from a tracing instance.
+const (
+	readModePipe = "pipe" // Consume the trace_pipe file
+	readModePoll = "poll" // Periodically poll the non-consuming trace file
+)
+
+// The modes in which events are parsed.
+const (
+	parseModeStrict     = "strict"      // Fail events missing any field
+	parseModeBestEffort = "best-effort" // Return events missing non-critical fields
+	parseModePartial    = "partial"     // Also return events of damaged lines with either their states or 4-tuple
+)
+
+// The backends from which events are sourced.
+const (
+	backendInstance  = "instance"  // Read the events of a tracefs instance
+	backendPerf      = "perf"      // Sample the tracepoint with perf_event_open(2)
+	backendSockDiag  = "sock-diag" // Synthesize state changes from periodic dumps of sockets
+	backendConntrack = "conntrack" // Map the events of connections tracked by conntrack to state changes
+	backendReplay    = "replay"    // Replay a capture of trace_pipe
+	backendGenerator = "generator" // Generate synthetic connections, for load testing
+	backendRelay     = "relay"     // Read the trace_pipe of a remote host streamed by a relay
+	backendPacket    = "packet"    // Infer state changes from captured segments
+	backendModule    = "module"    // Read the relay channel of a companion kernel module
+)
+
+// The orders in which the events parsed by a pool of parser workers are returned.
+const (
+	parserOrderingOrdered   = "ordered"   // In the order in which their lines were read
+	parserOrderingUnordered = "unordered" // As soon as each is parsed
+)
+
+// The modes in which the PIDs and ports of events are parsed.
+const (
+	numberParsingStrict  = "strict"  // Accept only decimal integers
+	numberParsingLenient = "lenient" // Also accept 0x-prefixed hexadecimal integers
+)
+
+const defaultPollInterval = time.Second
+
+// MaxReadBufferSizeKB is the size, in KiB, of the largest read buffer, which
+// bounds the memory of each line reader.
+const maxReadBufferSizeKB = 1024 * 1024
+
+const defaultExistingOverlapWindow = time.Second
+
+// The defaults of the TTL of the hostnames of addresses, and of the rate, in
+// lookups per second, at which they are looked up by reverse DNS.
+const (
+	defaultReverseDNSTTL  = 5 * time.Minute
+	defaultReverseDNSRate = 10
+)
+
+// The defaults of the rate, in connections per second, and lifetime of the
+// connections of the generator backend.
+const (
+	defaultGeneratorRate     = 100
+	defaultGeneratorLifetime = time.Second
+)
+
+// Config holds the user-facing configuration of the eventer. As the eventer is
+// loaded as a plugin with a parameterless constructor, the configuration is
+// sourced from environment variables prefixed with TCP_AUDIT_TRACEFS_.
+// The zero value represents the default configuration, other than where noted.
+type config struct {
+	// CPUMask is the hex CPU mask written to the instance tracing_cpumask file.
+	// If empty, the instance traces all CPUs.
+	cpuMask string
+
+	// EnableMethod is the method by which tracepoints are enabled in the instance.
+	// If empty, each tracepoint's own enable file is written.
+	enableMethod string
+
+	// Filter is an ftrace filter expression (e.g. "dport==443 || dport==80")
+	// written to the tracepoint filter file, so that events not matching it are
+	// discarded by the kernel. If empty, no filter is applied.
+	filter string
+
+	// InstanceName is a fixed name for the tracing instance, which is adopted
+	// if it already exists. If empty, a unique instance name is generated.
+	instanceName string
+
+	// InstancePath is the path of a tracing instance prepared by a privileged
+	// third party (e.g. an init container), to which the eventer only attaches,
+	// so needs only read access. If empty, the eventer prepares its own instance.
+	instancePath string
+
+	// InstanceFormat is the format of generated instance names. It must contain
+	// a {uuid} or {short-uuid} placeholder for uniqueness, and may contain
+	// {hostname} and {pid} placeholders. If empty, the default format is used.
+	instanceFormat string
+
+	// TraceOptions are the trace options (e.g. "noirq-info" or "print-tgid")
+	// set in the instance, in addition to those required by the parser.
+	traceOptions []string
+
+	// ReportLostEvents causes the eventer to return a *LostEventsError when the
+	// kernel reports events were lost, rather than only counting them.
+	reportLostEvents bool
+
+	// ReadMode is the mode in which events are read from the instance. If empty,
+	// the trace_pipe file is read.
+	readMode string
+
+	// PollInterval is the interval at which the trace file is polled, if
+	// polling. It has no zero value default.
+	pollInterval time.Duration
+
+	// WatchInterval is the interval at which the presence of the instance is
+	// checked, so that it can be recovered if lost. If zero, it is not checked.
+	watchInterval time.Duration
+
+	// EventPIDs are the PIDs written to the instance set_event_pid file, so that
+	// only events in the context of those tasks are traced. Backends without
+	// one filter the events by their PID on CPU when read.
+	eventPIDs []int
+
+	// EventPIDCgroup is the path of a cgroup directory, the tasks of which are
+	// added to the instance set_event_pid file, as for eventPIDs.
+	eventPIDCgroup string
+
+	// Commands are the shell patterns of the commands on CPU of the events
+	// returned, others being skipped. If empty, commands are not filtered.
+	commands []string
+
+	// NetNSTagging causes events to be tagged with the network namespace of
+	// their task on CPU.
+	netNSTagging bool
+
+	// NetNSFilter are the network namespaces, by inode or the path of a file of
+	// one, of the events returned, others being skipped. It implies tagging.
+	netNSFilter []string
+
+	// EventFork causes the children of the filtered PIDs to be added to the
+	// instance set_event_pid file when they are forked. It requires PID filtering.
+	eventFork bool
+
+	// StartupTimeout is the time for which retrieval of the tracefs mountpoint
+	// and deduction of the tracepoint are retried, for example while tracefs is
+	// not yet mounted early in boot. If zero, they are not retried.
+	startupTimeout time.Duration
+
+	// PerCPUReaders causes the trace_pipe of each CPU to be read and parsed
+	// concurrently, rather than the single trace_pipe of the instance, so that
+	// parsing scales beyond a single core.
+	perCPUReaders bool
+
+	// Backfill causes the events already in the instance trace file to be read
+	// before those of trace_pipe, so that none since the instance was enabled
+	// are missed, even if consumed from trace_pipe by another reader.
+	backfill bool
+
+	// BufferSizeKB is the size, in KiB, of the ring buffer of each CPU. If zero,
+	// the size inherited by the instance is left unchanged.
+	bufferSizeKB uint64
+
+	// StallTimeout is the time after which, if no lines have been read, the
+	// instance is checked for tracing having been disabled, and re-enabled. If
+	// zero, it is not checked.
+	stallTimeout time.Duration
+
+	// Resets causes the tracepoints of RSTs sent and received by the host to be
+	// enabled, where available, alongside that of state changes.
+	resets bool
+
+	// DestroySock causes the tracepoint of the destruction of sockets to be
+	// enabled, where available, alongside that of state changes.
+	destroySock bool
+
+	// Retransmits causes the tracepoint of segments retransmitted by the host to
+	// be enabled, where available, alongside that of state changes.
+	retransmits bool
+
+	// ExistingConnections causes the TCP sockets of the network namespace when
+	// the eventer attaches to be returned, as events of the KindExisting kind,
+	// before those traced.
+	existingConnections bool
+
+	// ExistingOverlapWindow is the window after the existing connections are
+	// listed within which traced state changes into their listed states are
+	// suppressed, as the listing already reflects them.
+	existingOverlapWindow time.Duration
+
+	// ParseMode is the mode in which events are parsed. If empty, events missing
+	// any field are failed.
+	parseMode string
+
+	// Backend is the backend from which events are sourced. If empty, they are
+	// read from a tracefs instance.
+	backend string
+
+	// ReplayFile is the path of the capture of trace_pipe replayed by the replay
+	// backend, which requires it.
+	replayFile string
+
+	// ReplayPaced causes a capture to be replayed at the pace at which its
+	// events were traced, rather than as fast as they are read.
+	replayPaced bool
+
+	// RelayAddress is the host and port of the relay from which the relay
+	// backend, which requires it, reads the lines of a remote trace_pipe.
+	relayAddress string
+
+	// PacketInterface is the name of the interface whose segments the packet
+	// backend captures. If empty, those of all interfaces are captured.
+	packetInterface string
+
+	// ModuleChannel is the base path of the relay files of the channel from
+	// which the module backend, which requires it, reads the lines written by
+	// a companion kernel module.
+	moduleChannel string
+
+	// GeneratorRate is the rate, in connections per second, at which the
+	// generator backend opens synthetic connections. It has no zero value
+	// default.
+	generatorRate float64
+
+	// GeneratorLifetime is the time for which each synthetic connection is
+	// established, between its handshake and teardown.
+	generatorLifetime time.Duration
+
+	// NumberParsing is the mode in which the PIDs and ports of events are parsed.
+	// If empty, only decimal integers are accepted.
+	numberParsing string
+
+	// DedupeWindow is the window within which a state transition of a socket
+	// reported more than once is suppressed. If zero, none are suppressed.
+	dedupeWindow time.Duration
+
+	// DebounceWindow is the window within which the state changes of a flow
+	// which repeat or reverse the last are collapsed into one, or zero if they
+	// are not debounced.
+	debounceWindow time.Duration
+
+	// MaxLineLength is the length, in bytes, of the longest line read from the
+	// instance, longer lines being skipped. If zero, bufio.MaxScanTokenSize is used.
+	maxLineLength int
+
+	// LineReader is the reader of the lines of the instance. If empty, they are
+	// read in blocks by a blockLineReader.
+	lineReader string
+
+	// ReadBufferSize is the size, in bytes, of the buffer into which the lines
+	// of the instance are read, and so the most read at a time. If zero, the
+	// default of the line reader is used.
+	readBufferSize int
+
+	// ParserWorkers is the number of workers which parse the lines read from
+	// the instance, so that parsing scales beyond the core of the reader. If
+	// zero, lines are parsed by the reader of events.
+	parserWorkers int
+
+	// ParserOrdering is the order in which the events parsed by the workers are
+	// returned. If empty, they are returned in the order in which their lines
+	// were read.
+	parserOrdering string
+
+	// ReverseDNS causes the addresses of events to be annotated with their
+	// hostnames, looked up by reverse DNS in the background.
+	reverseDNS bool
+
+	// ReverseDNSTTL is the time for which the hostname of an address, or its
+	// absence, is cached. It has no zero value default.
+	reverseDNSTTL time.Duration
+
+	// ReverseDNSRate is the rate, in lookups per second, at which addresses are
+	// looked up. It has no zero value default.
+	reverseDNSRate float64
+
+	// GeoIPDatabases are the paths of the MaxMind-format databases from which
+	// the remote addresses of events are enriched with their country and
+	// autonomous system. If empty, events are not enriched.
+	geoIPDatabases []string
+
+	// ExcludeLocalTraffic causes the events of loopback, link-local or
+	// unspecified addresses to be skipped.
+	excludeLocalTraffic bool
+
+	// FilterExpression is the compiled filter expression which events must
+	// satisfy, or nil if they are not filtered by an expression.
+	filterExpression *filterExpression
+
+	// HostTags are the static tags with which every event is tagged.
+	hostTags map[string]string
+
+	// HostTagHostname causes every event to be tagged with the hostname of the
+	// host.
+	hostTagHostname bool
+
+	// CloudMetadata is the cloud provider from whose metadata service the ID of
+	// the instance of the host is fetched, to tag every event with, or empty if
+	// it is not.
+	cloudMetadata string
+
+	// MPTCP causes the state changes of MPTCP sockets to be returned, and, if
+	// traced from the kernel of the host, the events of MPTCP connections to be
+	// tagged with their tokens.
+	mptcp bool
+
+	// Direction causes the direction of the connection of each event, and the
+	// role of its local socket, to be classified.
+	direction bool
+
+	// Flows causes events to be grouped into flows, by socket.
+	flows bool
+
+	// FlowSummaries causes a summary of each flow to be returned as it ends.
+	flowSummaries bool
+
+	// FlowTimeout is the time after the last event of a flow at which it ends,
+	// if not closed. If zero, flows only end when closed.
+	flowTimeout time.Duration
+
+	// MinFlowDuration is the duration below which flows with no data transfer
+	// seen are suppressed, or zero if none are.
+	minFlowDuration time.Duration
+
+	// SummaryInterval is the interval over which events are summarised, in
+	// place of returning them, or zero if they are not summarised.
+	summaryInterval time.Duration
+
+	// EventPooling causes the events read to be allocated from a pool, to which
+	// those skipped, and those released, are returned for reuse.
+	eventPooling bool
+
+	// ReloadOnSIGHUP causes the options of filters and enrichment to be
+	// reloaded whenever the process receives SIGHUP.
+	reloadOnSIGHUP bool
+}
+
+// LoadConfig builds a config from the environment, using getenv (usually
+// os.Getenv) to look up each variable.
+func loadConfig(getenv func(string) string) (*config, error) {
+	cfg := &config{
+		pollInterval:          defaultPollInterval,
+		existingOverlapWindow: defaultExistingOverlapWindow,
+		generatorRate:         defaultGeneratorRate,
+		generatorLifetime:     defaultGeneratorLifetime,
+		reverseDNSTTL:         defaultReverseDNSTTL,
+		reverseDNSRate:        defaultReverseDNSRate,
+	}
+
+	if cpuMask := getenv(envPrefix + "CPUMASK"); cpuMask != "" {
+		if err := validateCPUMask(cpuMask); err != nil {
+			return nil, fmt.Errorf("validating %sCPUMASK: %w", envPrefix, err)
+		}
+		cfg.cpuMask = cpuMask
+	}
+
+	if enableMethod := getenv(envPrefix + "ENABLE_METHOD"); enableMethod != "" {
+		switch enableMethod {
+		case enableMethodEnableFile, enableMethodSetEvent:
+			cfg.enableMethod = enableMethod
+		default:
+			return nil, fmt.Errorf("unknown %sENABLE_METHOD %q", envPrefix, enableMethod)
+		}
+	}
+
+	cfg.filter = strings.TrimSpace(getenv(envPrefix + "FILTER"))
+
+	if instanceName := getenv(envPrefix + "INSTANCE"); instanceName != "" {
+		if instanceName == "." || instanceName == ".." || strings.ContainsRune(instanceName, '/') {
+			return nil, fmt.Errorf("invalid %sINSTANCE %q", envPrefix, instanceName)
+		}
+		cfg.instanceName = instanceName
+	}
+
+	if instancePath := getenv(envPrefix + "INSTANCE_PATH"); instancePath != "" {
+		if !filepath.IsAbs(instancePath) {
+			return nil, fmt.Errorf("%sINSTANCE_PATH %q is not absolute", envPrefix, instancePath)
+		}
+
+		if cfg.instanceName != "" {
+			return nil, fmt.Errorf("%sINSTANCE_PATH and %sINSTANCE are mutually exclusive",
+				envPrefix,
+				envPrefix)
+		}
+		cfg.instancePath = filepath.Clean(instancePath)
+	}
+
+	if instanceFormat := getenv(envPrefix + "INSTANCE_FORMAT"); instanceFormat != "" {
+		if !strings.Contains(instanceFormat, uidFormatUUID) &&
+			!strings.Contains(instanceFormat, uidFormatShortUUID) {
+			return nil, fmt.Errorf("%sINSTANCE_FORMAT %q contains neither %s nor %s placeholder",
+				envPrefix,
+				instanceFormat,
+				uidFormatUUID,
+				uidFormatShortUUID)
+		}
+
+		if strings.ContainsRune(instanceFormat, '/') {
+			return nil, fmt.Errorf("invalid %sINSTANCE_FORMAT %q", envPrefix, instanceFormat)
+		}
+		cfg.instanceFormat = instanceFormat
+	}
+
+	if traceOptions := getenv(envPrefix + "TRACE_OPTIONS"); traceOptions != "" {
+		for _, option := range strings.Split(traceOptions, ",") {
+			option = strings.TrimSpace(option)
+			if option == "" {
+				return nil, fmt.Errorf("empty option in %sTRACE_OPTIONS %q", envPrefix, traceOptions)
+			}
+			cfg.traceOptions = append(cfg.traceOptions, option)
+		}
+	}
+
+	reportLostEvents, err := getenvBool(getenv, envPrefix+"REPORT_LOST_EVENTS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.reportLostEvents = reportLostEvents
+
+	if readMode := getenv(envPrefix + "READ_MODE"); readMode != "" {
+		switch readMode {
+		case readModePipe, readModePoll:
+			cfg.readMode = readMode
+		default:
+			return nil, fmt.Errorf("unknown %sREAD_MODE %q", envPrefix, readMode)
+		}
+	}
+
+	if pollInterval := getenv(envPrefix + "POLL_INTERVAL"); pollInterval != "" {
+		interval, err := time.ParseDuration(pollInterval)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sPOLL_INTERVAL: %w", envPrefix, err)
+		}
+
+		if interval <= 0 {
+			return nil, fmt.Errorf("%sPOLL_INTERVAL must be positive", envPrefix)
+		}
+		cfg.pollInterval = interval
+	}
+
+	if watchInterval := getenv(envPrefix + "WATCH_INTERVAL"); watchInterval != "" {
+		interval, err := time.ParseDuration(watchInterval)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sWATCH_INTERVAL: %w", envPrefix, err)
+		}
+
+		if interval < 0 {
+			return nil, fmt.Errorf("%sWATCH_INTERVAL must not be negative", envPrefix)
+		}
+		cfg.watchInterval = interval
+	}
+
+	if pids := getenv(envPrefix + "PIDS"); pids != "" {
+		for _, pid := range strings.Split(pids, ",") {
+			p, err := strconv.Atoi(strings.TrimSpace(pid))
+			if err != nil || p <= 0 {
+				return nil, fmt.Errorf("invalid PID %q in %sPIDS", pid, envPrefix)
+			}
+			cfg.eventPIDs = append(cfg.eventPIDs, p)
+		}
+	}
+
+	cfg.eventPIDCgroup = strings.TrimSpace(getenv(envPrefix + "PID_CGROUP"))
+
+	if commands := getenv(envPrefix + "COMMANDS"); commands != "" {
+		for _, command := range strings.Split(commands, ",") {
+			command = strings.TrimSpace(command)
+			if _, err := path.Match(command, ""); err != nil || command == "" {
+				return nil, fmt.Errorf("invalid command pattern %q in %sCOMMANDS", command, envPrefix)
+			}
+			cfg.commands = append(cfg.commands, command)
+		}
+	}
+
+	netNSTagging, err := getenvBool(getenv, envPrefix+"NETNS_TAGGING")
+	if err != nil {
+		return nil, err
+	}
+	cfg.netNSTagging = netNSTagging
+
+	if netNSFilter := getenv(envPrefix + "NETNS"); netNSFilter != "" {
+		for _, netNS := range strings.Split(netNSFilter, ",") {
+			netNS = strings.TrimSpace(netNS)
+			if netNS == "" {
+				return nil, fmt.Errorf("empty network namespace in %sNETNS", envPrefix)
+			}
+			cfg.netNSFilter = append(cfg.netNSFilter, netNS)
+		}
+		cfg.netNSTagging = true
+	}
+
+	eventFork, err := getenvBool(getenv, envPrefix+"EVENT_FORK")
+	if err != nil {
+		return nil, err
+	}
+
+	if eventFork && len(cfg.eventPIDs) == 0 && cfg.eventPIDCgroup == "" {
+		return nil, fmt.Errorf("%sEVENT_FORK requires %sPIDS or %sPID_CGROUP",
+			envPrefix,
+			envPrefix,
+			envPrefix)
+	}
+	cfg.eventFork = eventFork
+
+	if startupTimeout := getenv(envPrefix + "STARTUP_TIMEOUT"); startupTimeout != "" {
+		timeout, err := time.ParseDuration(startupTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sSTARTUP_TIMEOUT: %w", envPrefix, err)
+		}
+
+		if timeout < 0 {
+			return nil, fmt.Errorf("%sSTARTUP_TIMEOUT must not be negative", envPrefix)
+		}
+		cfg.startupTimeout = timeout
+	}
+
+	perCPUReaders, err := getenvBool(getenv, envPrefix+"PER_CPU_READERS")
+	if err != nil {
+		return nil, err
+	}
+
+	if perCPUReaders && cfg.readMode == readModePoll {
+		return nil, fmt.Errorf("%sPER_CPU_READERS is not supported with %sREAD_MODE %q",
+			envPrefix,
+			envPrefix,
+			readModePoll)
+	}
+
+	if perCPUReaders && cfg.watchInterval > 0 {
+		return nil, fmt.Errorf("%sPER_CPU_READERS is not supported with %sWATCH_INTERVAL",
+			envPrefix,
+			envPrefix)
+	}
+	cfg.perCPUReaders = perCPUReaders
+
+	backfill, err := getenvBool(getenv, envPrefix+"BACKFILL")
+	if err != nil {
+		return nil, err
+	}
+
+	if backfill && (cfg.readMode == readModePoll || cfg.perCPUReaders) {
+		return nil, fmt.Errorf("%sBACKFILL is not supported with %sREAD_MODE %q or %sPER_CPU_READERS",
+			envPrefix,
+			envPrefix,
+			readModePoll,
+			envPrefix)
+	}
+	cfg.backfill = backfill
+
+	if bufferSizeKB := getenv(envPrefix + "BUFFER_SIZE_KB"); bufferSizeKB != "" {
+		size, err := strconv.ParseUint(bufferSizeKB, 10, 64)
+		if err != nil || size == 0 {
+			return nil, fmt.Errorf("invalid %sBUFFER_SIZE_KB %q", envPrefix, bufferSizeKB)
+		}
+		cfg.bufferSizeKB = size
+	}
+
+	if dedupeWindow := getenv(envPrefix + "DEDUPE_WINDOW"); dedupeWindow != "" {
+		window, err := time.ParseDuration(dedupeWindow)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sDEDUPE_WINDOW: %w", envPrefix, err)
+		}
+
+		if window < 0 {
+			return nil, fmt.Errorf("%sDEDUPE_WINDOW must not be negative", envPrefix)
+		}
+		cfg.dedupeWindow = window
+	}
+
+	if debounceWindow := getenv(envPrefix + "DEBOUNCE_WINDOW"); debounceWindow != "" {
+		window, err := time.ParseDuration(debounceWindow)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sDEBOUNCE_WINDOW: %w", envPrefix, err)
+		}
+
+		if window < 0 {
+			return nil, fmt.Errorf("%sDEBOUNCE_WINDOW must not be negative", envPrefix)
+		}
+		cfg.debounceWindow = window
+	}
+
+	if maxLineLength := getenv(envPrefix + "MAX_LINE_LENGTH"); maxLineLength != "" {
+		length, err := strconv.Atoi(maxLineLength)
+		if err != nil || length <= 0 {
+			return nil, fmt.Errorf("invalid %sMAX_LINE_LENGTH %q", envPrefix, maxLineLength)
+		}
+		cfg.maxLineLength = length
+	}
+
+	if lineReader := getenv(envPrefix + "LINE_READER"); lineReader != "" {
+		switch lineReader {
+		case lineReaderBlock, lineReaderScanner:
+			cfg.lineReader = lineReader
+		default:
+			return nil, fmt.Errorf("unknown %sLINE_READER %q", envPrefix, lineReader)
+		}
+	}
+
+	if readBufferSizeKB := getenv(envPrefix + "READ_BUFFER_SIZE_KB"); readBufferSizeKB != "" {
+		size, err := strconv.Atoi(readBufferSizeKB)
+		if err != nil || size <= 0 || size > maxReadBufferSizeKB {
+			return nil, fmt.Errorf("invalid %sREAD_BUFFER_SIZE_KB %q", envPrefix, readBufferSizeKB)
+		}
+		cfg.readBufferSize = size * 1024
+	}
+
+	if parserWorkers := getenv(envPrefix + "PARSER_WORKERS"); parserWorkers != "" {
+		workers, err := strconv.Atoi(parserWorkers)
+		if err != nil || workers < 0 {
+			return nil, fmt.Errorf("invalid %sPARSER_WORKERS %q", envPrefix, parserWorkers)
+		}
+
+		// The lines of each CPU are already parsed concurrently
+		if workers > 0 && cfg.perCPUReaders {
+			return nil, fmt.Errorf("%sPARSER_WORKERS is not supported with %sPER_CPU_READERS",
+				envPrefix,
+				envPrefix)
+		}
+		cfg.parserWorkers = workers
+	}
+
+	if parserOrdering := getenv(envPrefix + "PARSER_ORDERING"); parserOrdering != "" {
+		switch parserOrdering {
+		case parserOrderingOrdered, parserOrderingUnordered:
+			cfg.parserOrdering = parserOrdering
+		default:
+			return nil, fmt.Errorf("unknown %sPARSER_ORDERING %q", envPrefix, parserOrdering)
+		}
+	}
+
+	if stallTimeout := getenv(envPrefix + "STALL_TIMEOUT"); stallTimeout != "" {
+		timeout, err := time.ParseDuration(stallTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sSTALL_TIMEOUT: %w", envPrefix, err)
+		}
+
+		if timeout < 0 {
+			return nil, fmt.Errorf("%sSTALL_TIMEOUT must not be negative", envPrefix)
+		}
+		cfg.stallTimeout = timeout
+	}
+
+	resets, err := getenvBool(getenv, envPrefix+"RESETS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.resets = resets
+
+	destroySock, err := getenvBool(getenv, envPrefix+"DESTROY_SOCK")
+	if err != nil {
+		return nil, err
+	}
+	cfg.destroySock = destroySock
+
+	retransmits, err := getenvBool(getenv, envPrefix+"RETRANSMITS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.retransmits = retransmits
+
+	existingConnections, err := getenvBool(getenv, envPrefix+"EXISTING_CONNECTIONS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.existingConnections = existingConnections
+
+	if existingOverlapWindow := getenv(envPrefix + "EXISTING_OVERLAP_WINDOW"); existingOverlapWindow != "" {
+		window, err := time.ParseDuration(existingOverlapWindow)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sEXISTING_OVERLAP_WINDOW: %w", envPrefix, err)
+		}
+
+		if window < 0 {
+			return nil, fmt.Errorf("%sEXISTING_OVERLAP_WINDOW must not be negative", envPrefix)
+		}
+		cfg.existingOverlapWindow = window
+	}
+
+	if parseMode := getenv(envPrefix + "PARSE_MODE"); parseMode != "" {
+		switch parseMode {
+		case parseModeStrict, parseModeBestEffort, parseModePartial:
+			cfg.parseMode = parseMode
+		default:
+			return nil, fmt.Errorf("unknown %sPARSE_MODE %q", envPrefix, parseMode)
+		}
+	}
+
+	cfg.replayFile = getenv(envPrefix + "REPLAY_FILE")
+	cfg.relayAddress = getenv(envPrefix + "RELAY_ADDRESS")
+	cfg.packetInterface = getenv(envPrefix + "PACKET_INTERFACE")
+	cfg.moduleChannel = getenv(envPrefix + "MODULE_CHANNEL")
+
+	replayPaced, err := getenvBool(getenv, envPrefix+"REPLAY_PACED")
+	if err != nil {
+		return nil, err
+	}
+	cfg.replayPaced = replayPaced
+
+	if generatorRate := getenv(envPrefix + "GENERATOR_RATE"); generatorRate != "" {
+		rate, err := strconv.ParseFloat(generatorRate, 64)
+		if err != nil || !(rate > 0) || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("invalid %sGENERATOR_RATE %q", envPrefix, generatorRate)
+		}
+		cfg.generatorRate = rate
+	}
+
+	if generatorLifetime := getenv(envPrefix + "GENERATOR_LIFETIME"); generatorLifetime != "" {
+		lifetime, err := time.ParseDuration(generatorLifetime)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sGENERATOR_LIFETIME: %w", envPrefix, err)
+		}
+
+		if lifetime < 0 {
+			return nil, fmt.Errorf("%sGENERATOR_LIFETIME must not be negative", envPrefix)
+		}
+		cfg.generatorLifetime = lifetime
+	}
+
+	reverseDNS, err := getenvBool(getenv, envPrefix+"REVERSE_DNS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.reverseDNS = reverseDNS
+
+	if reverseDNSTTL := getenv(envPrefix + "REVERSE_DNS_TTL"); reverseDNSTTL != "" {
+		ttl, err := time.ParseDuration(reverseDNSTTL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sREVERSE_DNS_TTL: %w", envPrefix, err)
+		}
+
+		if ttl <= 0 {
+			return nil, fmt.Errorf("%sREVERSE_DNS_TTL must be positive", envPrefix)
+		}
+		cfg.reverseDNSTTL = ttl
+	}
+
+	if reverseDNSRate := getenv(envPrefix + "REVERSE_DNS_RATE"); reverseDNSRate != "" {
+		rate, err := strconv.ParseFloat(reverseDNSRate, 64)
+		if err != nil || !(rate > 0) || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("invalid %sREVERSE_DNS_RATE %q", envPrefix, reverseDNSRate)
+		}
+		cfg.reverseDNSRate = rate
+	}
+
+	if geoIPDatabases := getenv(envPrefix + "GEOIP_DATABASES"); geoIPDatabases != "" {
+		for _, path := range strings.Split(geoIPDatabases, ",") {
+			path = strings.TrimSpace(path)
+			if path == "" {
+				return nil, fmt.Errorf("empty path in %sGEOIP_DATABASES", envPrefix)
+			}
+			cfg.geoIPDatabases = append(cfg.geoIPDatabases, path)
+		}
+	}
+
+	if hostTags := getenv(envPrefix + "HOST_TAGS"); hostTags != "" {
+		cfg.hostTags = make(map[string]string)
+		for _, tag := range strings.Split(hostTags, ",") {
+			key, value := tag, ""
+			if i := strings.IndexByte(tag, '='); i >= 0 {
+				key, value = tag[:i], tag[i+1:]
+			}
+
+			key = strings.TrimSpace(key)
+			if key == "" || !strings.ContainsRune(tag, '=') {
+				return nil, fmt.Errorf("invalid tag %q in %sHOST_TAGS", tag, envPrefix)
+			}
+
+			if _, ok := cfg.hostTags[key]; ok {
+				return nil, fmt.Errorf("duplicate tag %q in %sHOST_TAGS", key, envPrefix)
+			}
+			cfg.hostTags[key] = strings.TrimSpace(value)
+		}
+	}
+
+	hostTagHostname, err := getenvBool(getenv, envPrefix+"HOST_TAG_HOSTNAME")
+	if err != nil {
+		return nil, err
+	}
+	cfg.hostTagHostname = hostTagHostname
+
+	if cloudMetadata := getenv(envPrefix + "CLOUD_METADATA"); cloudMetadata != "" {
+		if _, ok := cloudMetadataBaseURLs[cloudMetadata]; !ok {
+			return nil, fmt.Errorf("unknown %sCLOUD_METADATA %q", envPrefix, cloudMetadata)
+		}
+		cfg.cloudMetadata = cloudMetadata
+	}
+
+	if expression := getenv(envPrefix + "FILTER_EXPRESSION"); expression != "" {
+		filterExpression, err := compileFilterExpression(expression)
+		if err != nil {
+			return nil, fmt.Errorf("compiling %sFILTER_EXPRESSION: %w", envPrefix, err)
+		}
+		cfg.filterExpression = filterExpression
+	}
+
+	excludeLocalTraffic, err := getenvBool(getenv, envPrefix+"EXCLUDE_LOCAL_TRAFFIC")
+	if err != nil {
+		return nil, err
+	}
+	cfg.excludeLocalTraffic = excludeLocalTraffic
+
+	mptcp, err := getenvBool(getenv, envPrefix+"MPTCP")
+	if err != nil {
+		return nil, err
+	}
+	cfg.mptcp = mptcp
+
+	direction, err := getenvBool(getenv, envPrefix+"DIRECTION")
+	if err != nil {
+		return nil, err
+	}
+	cfg.direction = direction
+
+	flows, err := getenvBool(getenv, envPrefix+"FLOWS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.flows = flows
+
+	flowSummaries, err := getenvBool(getenv, envPrefix+"FLOW_SUMMARIES")
+	if err != nil {
+		return nil, err
+	}
+	cfg.flowSummaries = flowSummaries
+	cfg.flows = cfg.flows || flowSummaries
+
+	if flowTimeout := getenv(envPrefix + "FLOW_TIMEOUT"); flowTimeout != "" {
+		timeout, err := time.ParseDuration(flowTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sFLOW_TIMEOUT: %w", envPrefix, err)
+		}
+
+		if timeout < 0 {
+			return nil, fmt.Errorf("%sFLOW_TIMEOUT must not be negative", envPrefix)
+		}
+		cfg.flowTimeout = timeout
+	}
+
+	if minFlowDuration := getenv(envPrefix + "MIN_FLOW_DURATION"); minFlowDuration != "" {
+		duration, err := time.ParseDuration(minFlowDuration)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sMIN_FLOW_DURATION: %w", envPrefix, err)
+		}
+
+		if duration < 0 {
+			return nil, fmt.Errorf("%sMIN_FLOW_DURATION must not be negative", envPrefix)
+		}
+		cfg.minFlowDuration = duration
+		cfg.flows = cfg.flows || duration > 0
+	}
+
+	if summaryInterval := getenv(envPrefix + "SUMMARY_INTERVAL"); summaryInterval != "" {
+		interval, err := time.ParseDuration(summaryInterval)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %sSUMMARY_INTERVAL: %w", envPrefix, err)
+		}
+
+		if interval < 0 {
+			return nil, fmt.Errorf("%sSUMMARY_INTERVAL must not be negative", envPrefix)
+		}
+		cfg.summaryInterval = interval
+	}
+
+	// Flows would be summarised, and then their summaries returned unsummarised
+	if cfg.summaryInterval > 0 && cfg.flowSummaries {
+		return nil, fmt.Errorf("%sSUMMARY_INTERVAL and %sFLOW_SUMMARIES are mutually exclusive",
+			envPrefix,
+			envPrefix)
+	}
+
+	// The state changes held, and the summaries of intervals, are released by
+	// bounding reads by a deadline, which the trace file poller does not support
+	if cfg.readMode == readModePoll && cfg.parserWorkers == 0 {
+		for _, option := range []struct {
+			variable string
+			set      bool
+		}{
+			{"DEBOUNCE_WINDOW", cfg.debounceWindow > 0},
+			{"SUMMARY_INTERVAL", cfg.summaryInterval > 0},
+		} {
+			if option.set {
+				return nil, fmt.Errorf("%s%s is not supported with %sREAD_MODE %q, unless with %sPARSER_WORKERS",
+					envPrefix,
+					option.variable,
+					envPrefix,
+					readModePoll,
+					envPrefix)
+			}
+		}
+	}
+
+	eventPooling, err := getenvBool(getenv, envPrefix+"EVENT_POOLING")
+	if err != nil {
+		return nil, err
+	}
+	cfg.eventPooling = eventPooling
+
+	// Flows remember the last event of each, which would be reused once released
+	if cfg.eventPooling && cfg.flows {
+		return nil, fmt.Errorf("%sEVENT_POOLING and %sFLOWS are mutually exclusive",
+			envPrefix,
+			envPrefix)
+	}
+
+	if backend := getenv(envPrefix + "BACKEND"); backend != "" {
+		switch backend {
+		case backendInstance:
+		case backendPerf,
+			backendSockDiag,
+			backendConntrack,
+			backendReplay,
+			backendGenerator,
+			backendRelay,
+			backendPacket,
+			backendModule:
+			if err := validateBackend(cfg, backend); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown %sBACKEND %q", envPrefix, backend)
+		}
+		cfg.backend = backend
+	}
+
+	if (cfg.backend == backendReplay) != (cfg.replayFile != "") {
+		return nil, fmt.Errorf("%sREPLAY_FILE is required by, and only by, %sBACKEND %q",
+			envPrefix,
+			envPrefix,
+			backendReplay)
+	}
+
+	if cfg.packetInterface != "" && cfg.backend != backendPacket {
+		return nil, fmt.Errorf("%sPACKET_INTERFACE is supported only with %sBACKEND %q",
+			envPrefix,
+			envPrefix,
+			backendPacket)
+	}
+
+	if (cfg.backend == backendRelay) != (cfg.relayAddress != "") {
+		return nil, fmt.Errorf("%sRELAY_ADDRESS is required by, and only by, %sBACKEND %q",
+			envPrefix,
+			envPrefix,
+			backendRelay)
+	}
+
+	if (cfg.backend == backendModule) != (cfg.moduleChannel != "") {
+		return nil, fmt.Errorf("%sMODULE_CHANNEL is required by, and only by, %sBACKEND %q",
+			envPrefix,
+			envPrefix,
+			backendModule)
+	}
+
+	if numberParsing := getenv(envPrefix + "NUMBER_PARSING"); numberParsing != "" {
+		switch numberParsing {
+		case numberParsingStrict, numberParsingLenient:
+			cfg.numberParsing = numberParsing
+		default:
+			return nil, fmt.Errorf("unknown %sNUMBER_PARSING %q", envPrefix, numberParsing)
+		}
+	}
+
+	reloadOnSIGHUP, err := getenvBool(getenv, envPrefix+"RELOAD_ON_SIGHUP")
+	if err != nil {
+		return nil, err
+	}
+	cfg.reloadOnSIGHUP = reloadOnSIGHUP
+
+	return cfg, nil
+}
+
+// BestEffortParsing returns whether events are parsed, or decoded by an event
+// source, best-effort, as they are if parsed partially.
+func bestEffortParsing(cfg *config) bool {
+	return cfg.parseMode == parseModeBestEffort || cfg.parseMode == parseModePartial
+}
+
+// ValidateBackend checks that the configuration uses none of the options of
+// tracefs instances, which are not supported by the perf, sock-diag, conntrack,
+// replay, generator, relay, packet and module backends, nor, for all but perf,
+// those of tracepoints. The buffer size of the conntrack and packet backends
+// is that of their socket.
+// The connections of the host are not those of a replay, generation or relay.
+// The events of the conntrack and packet backends are of no task, so cannot
+// be filtered by PID, nor tagged with a network namespace, nor can those of a
+// replay, generation or relay, whose tasks are not of the host. Event sources
+// return events rather than lines, so neither stall nor parse them, and line
+// sources, such as replays and relays, do not stall. Neither is read per CPU.
+func validateBackend(cfg *config, backend string) error {
+	options := []struct {
+		variable string
+		set      bool
+	}{
+		{"CPUMASK", cfg.cpuMask != ""},
+		{"ENABLE_METHOD", cfg.enableMethod != ""},
+		{"INSTANCE", cfg.instanceName != ""},
+		{"INSTANCE_PATH", cfg.instancePath != ""},
+		{"INSTANCE_FORMAT", cfg.instanceFormat != ""},
+		{"TRACE_OPTIONS", len(cfg.traceOptions) > 0},
+		{"READ_MODE", cfg.readMode == readModePoll},
+		{"WATCH_INTERVAL", cfg.watchInterval > 0},
+		{"PIDS", len(cfg.eventPIDs) > 0 && (backend == backendConntrack || backend == backendPacket)},
+		{"PID_CGROUP", cfg.eventPIDCgroup != ""},
+		{"EVENT_FORK", cfg.eventFork},
+		{"BACKFILL", cfg.backfill},
+		{"RESETS", cfg.resets},
+		{"DESTROY_SOCK", cfg.destroySock},
+		{"RETRANSMITS", cfg.retransmits},
+		{"MPTCP", cfg.mptcp && backend != backendPerf && backend != backendReplay},
+		{"STALL_TIMEOUT", cfg.stallTimeout > 0},
+		{"PARSER_WORKERS", cfg.parserWorkers > 0 && backend != backendReplay && backend != backendRelay},
+		{"PER_CPU_READERS", cfg.perCPUReaders},
+	}
+
+	if backend != backendPerf {
+		options = append(options, []struct {
+			variable string
+			set      bool
+		}{
+			{"FILTER", cfg.filter != ""},
+			{"BUFFER_SIZE_KB", cfg.bufferSizeKB > 0 && backend != backendConntrack && backend != backendPacket},
+		}...)
+	}
+
+	if backend == backendReplay || backend == backendGenerator || backend == backendRelay {
+		options = append(options, []struct {
+			variable string
+			set      bool
+		}{
+			{"EXISTING_CONNECTIONS", cfg.existingConnections},
+			{"NETNS_TAGGING", cfg.netNSTagging && len(cfg.netNSFilter) == 0},
+			{"NETNS", len(cfg.netNSFilter) > 0},
+		}...)
+	}
+
+	if backend == backendConntrack || backend == backendPacket {
+		options = append(options, []struct {
+			variable string
+			set      bool
+		}{
+			{"NETNS_TAGGING", cfg.netNSTagging && len(cfg.netNSFilter) == 0},
+			{"NETNS", len(cfg.netNSFilter) > 0},
+		}...)
+	}
+
+	for _, option := range options {
+		if option.set {
+			return fmt.Errorf("%s%s is not supported with %sBACKEND %q",
+				envPrefix,
+				option.variable,
+				envPrefix,
+				backend)
+		}
+	}
+
+	return nil
+}
+
+// ConfigFileGetenv returns a lookup of the variables of the config file named
+// by the CONFIG_FILE variable of getenv, if any, which take precedence over
+// those of getenv, so that options can be changed while the process runs.
+// Each line of the file is a <variable>=<value> pair, or blank, or a comment
+// starting with #.
+func configFileGetenv(getenv func(string) string) (func(string) string, error) {
+	path := getenv(envPrefix + "CONFIG_FILE")
+	if path == "" {
+		return getenv, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %sCONFIG_FILE: %w", envPrefix, err)
+	}
+
+	variables := make(map[string]string)
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pair := strings.SplitN(line, "=", 2)
+		if len(pair) != 2 || !strings.HasPrefix(pair[0], envPrefix) {
+			return nil, fmt.Errorf("line %d of %sCONFIG_FILE is not a %s<variable>=<value> pair",
+				i+1,
+				envPrefix,
+				envPrefix)
+		}
+		variables[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	}
+
+	return func(key string) string {
+		if value, ok := variables[key]; ok {
+			return value
+		}
+
+		return getenv(key)
+	}, nil
+}
+
+// GetenvBool looks up a boolean environment variable, which is false if unset.
+func getenvBool(getenv func(string) string, key string) (bool, error) {
+	value := getenv(key)
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("parsing %s: %w", key, err)
+	}
+
+	return b, nil
+}
+
+// ValidateCPUMask checks the mask is in the format accepted by tracing_cpumask,
+// that is, comma-separated groups of hex digits (e.g. "f" or "ffffffff,0000000f").
+func validateCPUMask(mask string) error {
+	for _, group := range strings.Split(mask, ",") {
+		if group == "" {
+			return errors.New("empty CPU mask group")
+		}
+
+		for _, c := range group {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return fmt.Errorf("invalid hex digit %q in CPU mask", c)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,1449 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newMockGetenv(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(nil))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.cpuMask != "" {
+		t.Errorf("expected empty CPU mask, got %q", cfg.cpuMask)
+	}
+}
+
+func TestLoadConfigCPUMask(t *testing.T) {
+	mockCPUMask := "ffffffff,0000000f"
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_CPUMASK": mockCPUMask,
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.cpuMask != mockCPUMask {
+		t.Errorf("expected CPU mask %q, got %q", mockCPUMask, cfg.cpuMask)
+	}
+}
+
+func TestLoadConfigInvalidCPUMaskError(t *testing.T) {
+	for _, mockCPUMask := range []string{"0xf", "f,,f", "fg"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_CPUMASK": mockCPUMask,
+		}))
+		if err == nil {
+			t.Errorf("expected error for CPU mask %q, got nil", mockCPUMask)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigEnableMethod(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_ENABLE_METHOD": "set_event",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.enableMethod != enableMethodSetEvent {
+		t.Errorf("expected enable method %q, got %q", enableMethodSetEvent, cfg.enableMethod)
+	}
+}
+
+func TestLoadConfigUnknownEnableMethodError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_ENABLE_METHOD": "foo",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigFilter(t *testing.T) {
+	mockFilter := "dport==443 || dport==80"
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_FILTER": " " + mockFilter + "\n",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.filter != mockFilter {
+		t.Errorf("expected filter %q, got %q", mockFilter, cfg.filter)
+	}
+}
+
+func TestLoadConfigInstanceName(t *testing.T) {
+	mockInstanceName := "tcp-audit"
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_INSTANCE": mockInstanceName,
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.instanceName != mockInstanceName {
+		t.Errorf("expected instance name %q, got %q", mockInstanceName, cfg.instanceName)
+	}
+}
+
+func TestLoadConfigInvalidInstanceNameError(t *testing.T) {
+	for _, mockInstanceName := range []string{".", "..", "../foo"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_INSTANCE": mockInstanceName,
+		}))
+		if err == nil {
+			t.Errorf("expected error for instance name %q, got nil", mockInstanceName)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigInstancePath(t *testing.T) {
+	mockInstancePath := "/sys/kernel/tracing/instances/tcp-audit"
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_INSTANCE_PATH": mockInstancePath + "/",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.instancePath != mockInstancePath {
+		t.Errorf("expected instance path %q, got %q", mockInstancePath, cfg.instancePath)
+	}
+}
+
+func TestLoadConfigInvalidInstancePathError(t *testing.T) {
+	for _, mockEnv := range []map[string]string{
+		{"TCP_AUDIT_TRACEFS_INSTANCE_PATH": "instances/tcp-audit"},
+		{
+			"TCP_AUDIT_TRACEFS_INSTANCE_PATH": "/sys/kernel/tracing/instances/tcp-audit",
+			"TCP_AUDIT_TRACEFS_INSTANCE":      "tcp-audit",
+		},
+	} {
+		_, err := loadConfig(newMockGetenv(mockEnv))
+		if err == nil {
+			t.Errorf("expected error for environment %v, got nil", mockEnv)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigInstanceFormat(t *testing.T) {
+	mockInstanceFormat := "tcp-audit-{hostname}-{pid}-{short-uuid}"
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_INSTANCE_FORMAT": mockInstanceFormat,
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.instanceFormat != mockInstanceFormat {
+		t.Errorf("expected instance format %q, got %q", mockInstanceFormat, cfg.instanceFormat)
+	}
+}
+
+func TestLoadConfigInvalidInstanceFormatError(t *testing.T) {
+	for _, mockInstanceFormat := range []string{"tcp-audit-{hostname}", "../{uuid}"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_INSTANCE_FORMAT": mockInstanceFormat,
+		}))
+		if err == nil {
+			t.Errorf("expected error for instance format %q, got nil", mockInstanceFormat)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigTraceOptions(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_TRACE_OPTIONS": "noirq-info, print-tgid",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(cfg.traceOptions) != 2 ||
+		cfg.traceOptions[0] != "noirq-info" ||
+		cfg.traceOptions[1] != "print-tgid" {
+		t.Errorf("expected trace options %q, got %q", []string{"noirq-info", "print-tgid"}, cfg.traceOptions)
+	}
+}
+
+func TestLoadConfigEmptyTraceOptionError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_TRACE_OPTIONS": "noirq-info,,print-tgid",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigReportLostEvents(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_REPORT_LOST_EVENTS": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.reportLostEvents {
+		t.Error("expected lost events to be reported, but were not")
+	}
+}
+
+func TestLoadConfigInvalidBoolError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_REPORT_LOST_EVENTS": "foo",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigReadMode(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_READ_MODE":     "poll",
+		"TCP_AUDIT_TRACEFS_POLL_INTERVAL": "250ms",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.readMode != readModePoll {
+		t.Errorf("expected read mode %q, got %q", readModePoll, cfg.readMode)
+	}
+
+	if cfg.pollInterval != 250*time.Millisecond {
+		t.Errorf("expected poll interval %v, got %v", 250*time.Millisecond, cfg.pollInterval)
+	}
+}
+
+func TestLoadConfigDefaultPollInterval(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(nil))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.pollInterval != defaultPollInterval {
+		t.Errorf("expected poll interval %v, got %v", defaultPollInterval, cfg.pollInterval)
+	}
+}
+
+func TestLoadConfigInvalidReadModeError(t *testing.T) {
+	for _, mockEnv := range []map[string]string{
+		{"TCP_AUDIT_TRACEFS_READ_MODE": "foo"},
+		{"TCP_AUDIT_TRACEFS_POLL_INTERVAL": "foo"},
+		{"TCP_AUDIT_TRACEFS_POLL_INTERVAL": "-1s"},
+	} {
+		_, err := loadConfig(newMockGetenv(mockEnv))
+		if err == nil {
+			t.Errorf("expected error for %v, got nil", mockEnv)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigWatchInterval(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_WATCH_INTERVAL": "5s",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.watchInterval != 5*time.Second {
+		t.Errorf("expected watch interval %v, got %v", 5*time.Second, cfg.watchInterval)
+	}
+}
+
+func TestLoadConfigInvalidWatchIntervalError(t *testing.T) {
+	for _, mockWatchInterval := range []string{"foo", "-1s"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_WATCH_INTERVAL": mockWatchInterval,
+		}))
+		if err == nil {
+			t.Errorf("expected error for watch interval %q, got nil", mockWatchInterval)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigPIDs(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_PIDS":       "1, 42",
+		"TCP_AUDIT_TRACEFS_PID_CGROUP": "/sys/fs/cgroup/mock.slice",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(cfg.eventPIDs) != 2 || cfg.eventPIDs[0] != 1 || cfg.eventPIDs[1] != 42 {
+		t.Errorf("expected event PIDs %v, got %v", []int{1, 42}, cfg.eventPIDs)
+	}
+
+	if cfg.eventPIDCgroup != "/sys/fs/cgroup/mock.slice" {
+		t.Errorf("expected event PID cgroup %q, got %q", "/sys/fs/cgroup/mock.slice", cfg.eventPIDCgroup)
+	}
+}
+
+func TestLoadConfigInvalidPIDError(t *testing.T) {
+	for _, mockPIDs := range []string{"1,foo", "1,,2", "0", "-1"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_PIDS": mockPIDs,
+		}))
+		if err == nil {
+			t.Errorf("expected error for PIDs %q, got nil", mockPIDs)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigEventFork(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_PIDS":       "42",
+		"TCP_AUDIT_TRACEFS_EVENT_FORK": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.eventFork {
+		t.Error("expected event fork to be set, but was not")
+	}
+}
+
+func TestLoadConfigEventForkWithoutPIDsError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_EVENT_FORK": "true",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigStartupTimeout(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_STARTUP_TIMEOUT": "2m",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.startupTimeout != 2*time.Minute {
+		t.Errorf("expected startup timeout %v, got %v", 2*time.Minute, cfg.startupTimeout)
+	}
+}
+
+func TestLoadConfigInvalidStartupTimeoutError(t *testing.T) {
+	for _, mockStartupTimeout := range []string{"foo", "-1s"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_STARTUP_TIMEOUT": mockStartupTimeout,
+		}))
+		if err == nil {
+			t.Errorf("expected error for startup timeout %q, got nil", mockStartupTimeout)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigPerCPUReaders(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_PER_CPU_READERS": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.perCPUReaders {
+		t.Error("expected per-CPU readers to be set, but was not")
+	}
+}
+
+func TestLoadConfigPerCPUReadersIncompatibleError(t *testing.T) {
+	for _, mockEnv := range []map[string]string{
+		{
+			"TCP_AUDIT_TRACEFS_PER_CPU_READERS": "true",
+			"TCP_AUDIT_TRACEFS_READ_MODE":       "poll",
+		},
+		{
+			"TCP_AUDIT_TRACEFS_PER_CPU_READERS": "true",
+			"TCP_AUDIT_TRACEFS_WATCH_INTERVAL":  "1s",
+		},
+	} {
+		_, err := loadConfig(newMockGetenv(mockEnv))
+		if err == nil {
+			t.Errorf("expected error for environment %v, got nil", mockEnv)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigBackfill(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKFILL": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.backfill {
+		t.Error("expected backfill to be set, but was not")
+	}
+}
+
+func TestLoadConfigBackfillIncompatibleError(t *testing.T) {
+	for _, mockEnv := range []map[string]string{
+		{
+			"TCP_AUDIT_TRACEFS_BACKFILL":  "true",
+			"TCP_AUDIT_TRACEFS_READ_MODE": "poll",
+		},
+		{
+			"TCP_AUDIT_TRACEFS_BACKFILL":        "true",
+			"TCP_AUDIT_TRACEFS_PER_CPU_READERS": "true",
+		},
+	} {
+		_, err := loadConfig(newMockGetenv(mockEnv))
+		if err == nil {
+			t.Errorf("expected error for environment %v, got nil", mockEnv)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigBufferSizeKB(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BUFFER_SIZE_KB": "4096",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.bufferSizeKB != 4096 {
+		t.Errorf("expected buffer size %d, got %d", 4096, cfg.bufferSizeKB)
+	}
+}
+
+func TestLoadConfigInvalidBufferSizeKBError(t *testing.T) {
+	for _, mockBufferSizeKB := range []string{"foo", "0", "-1"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_BUFFER_SIZE_KB": mockBufferSizeKB,
+		}))
+		if err == nil {
+			t.Errorf("expected error for buffer size %q, got nil", mockBufferSizeKB)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigStallTimeout(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_STALL_TIMEOUT": "5m",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.stallTimeout != 5*time.Minute {
+		t.Errorf("expected stall timeout %v, got %v", 5*time.Minute, cfg.stallTimeout)
+	}
+}
+
+func TestLoadConfigInvalidStallTimeoutError(t *testing.T) {
+	for _, mockStallTimeout := range []string{"foo", "-1s"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_STALL_TIMEOUT": mockStallTimeout,
+		}))
+		if err == nil {
+			t.Errorf("expected error for stall timeout %q, got nil", mockStallTimeout)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigResets(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_RESETS": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.resets {
+		t.Error("expected resets to be set, but was not")
+	}
+}
+
+func TestLoadConfigRetransmits(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_RETRANSMITS": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.retransmits {
+		t.Error("expected retransmits to be set, but was not")
+	}
+}
+
+func TestLoadConfigDestroySock(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_DESTROY_SOCK": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.destroySock {
+		t.Error("expected destroy sock to be set, but was not")
+	}
+}
+
+func TestLoadConfigParseMode(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_PARSE_MODE": "best-effort",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.parseMode != parseModeBestEffort {
+		t.Errorf("expected parse mode %q, got %q", parseModeBestEffort, cfg.parseMode)
+	}
+}
+
+func TestLoadConfigUnknownParseModeError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_PARSE_MODE": "lenient",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigMaxLineLength(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_MAX_LINE_LENGTH": "1048576",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.maxLineLength != 1048576 {
+		t.Errorf("expected maximum line length %d, got %d", 1048576, cfg.maxLineLength)
+	}
+}
+
+func TestLoadConfigInvalidMaxLineLengthError(t *testing.T) {
+	for _, mockMaxLineLength := range []string{"foo", "0", "-1"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_MAX_LINE_LENGTH": mockMaxLineLength,
+		}))
+		if err == nil {
+			t.Errorf("expected error for maximum line length %q, got nil", mockMaxLineLength)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigDedupeWindow(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_DEDUPE_WINDOW": "50ms",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.dedupeWindow != 50*time.Millisecond {
+		t.Errorf("expected dedupe window %v, got %v", 50*time.Millisecond, cfg.dedupeWindow)
+	}
+}
+
+func TestLoadConfigInvalidDedupeWindowError(t *testing.T) {
+	for _, mockDedupeWindow := range []string{"foo", "-1s"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_DEDUPE_WINDOW": mockDedupeWindow,
+		}))
+		if err == nil {
+			t.Errorf("expected error for dedupe window %q, got nil", mockDedupeWindow)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigNumberParsing(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_NUMBER_PARSING": "lenient",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.numberParsing != numberParsingLenient {
+		t.Errorf("expected number parsing %q, got %q", numberParsingLenient, cfg.numberParsing)
+	}
+}
+
+func TestLoadConfigUnknownNumberParsingError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_NUMBER_PARSING": "best-effort",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigPartialParseMode(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_PARSE_MODE": "partial",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.parseMode != parseModePartial {
+		t.Errorf("expected parse mode %q, got %q", parseModePartial, cfg.parseMode)
+	}
+}
+
+func TestLoadConfigPerfBackend(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND": "perf",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.backend != backendPerf {
+		t.Errorf("expected backend %q, got %q", backendPerf, cfg.backend)
+	}
+}
+
+func TestLoadConfigUnknownBackendError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND": "ebpf",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigPerfBackendUnsupportedOptionError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND":  "perf",
+		"TCP_AUDIT_TRACEFS_BACKFILL": "true",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigSockDiagBackendUnsupportedOptionError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND": "sock-diag",
+		"TCP_AUDIT_TRACEFS_FILTER":  "dport==443",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigSourceBackendStallTimeoutError(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"TCP_AUDIT_TRACEFS_BACKEND": "perf"},
+		{"TCP_AUDIT_TRACEFS_BACKEND": "sock-diag"},
+		{"TCP_AUDIT_TRACEFS_BACKEND": "conntrack"},
+		{"TCP_AUDIT_TRACEFS_BACKEND": "generator"},
+		{"TCP_AUDIT_TRACEFS_BACKEND": "packet"},
+		{"TCP_AUDIT_TRACEFS_BACKEND": "module", "TCP_AUDIT_TRACEFS_MODULE_CHANNEL": "/sys/kernel/debug/tcp_audit/events"},
+		{"TCP_AUDIT_TRACEFS_BACKEND": "replay", "TCP_AUDIT_TRACEFS_REPLAY_FILE": "capture"},
+		{"TCP_AUDIT_TRACEFS_BACKEND": "relay", "TCP_AUDIT_TRACEFS_RELAY_ADDRESS": "relay:7878"},
+	} {
+		env["TCP_AUDIT_TRACEFS_STALL_TIMEOUT"] = "1m"
+		_, err := loadConfig(newMockGetenv(env))
+		if err == nil {
+			t.Errorf("expected error for %v, got nil", env)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigSourceBackendPerCPUReadersError(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"TCP_AUDIT_TRACEFS_BACKEND": "perf"},
+		{"TCP_AUDIT_TRACEFS_BACKEND": "module", "TCP_AUDIT_TRACEFS_MODULE_CHANNEL": "/sys/kernel/debug/tcp_audit/events"},
+	} {
+		env["TCP_AUDIT_TRACEFS_PER_CPU_READERS"] = "true"
+		_, err := loadConfig(newMockGetenv(env))
+		if err == nil {
+			t.Errorf("expected error for %v, got nil", env)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigConntrackBackendBufferSize(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND":        "conntrack",
+		"TCP_AUDIT_TRACEFS_BUFFER_SIZE_KB": "4096",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.backend != backendConntrack || cfg.bufferSizeKB != 4096 {
+		t.Errorf("expected backend %q with buffer size 4096, got %q with %d", backendConntrack, cfg.backend, cfg.bufferSizeKB)
+	}
+}
+
+func TestLoadConfigReplayBackend(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND":      "replay",
+		"TCP_AUDIT_TRACEFS_REPLAY_FILE":  "/tmp/capture",
+		"TCP_AUDIT_TRACEFS_REPLAY_PACED": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.backend != backendReplay || cfg.replayFile != "/tmp/capture" || !cfg.replayPaced {
+		t.Errorf("expected paced backend %q of /tmp/capture, got %q of %q (paced %t)",
+			backendReplay,
+			cfg.backend,
+			cfg.replayFile,
+			cfg.replayPaced)
+	}
+}
+
+func TestLoadConfigReplayBackendMissingFileError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND": "replay",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigReplayFileWithoutReplayBackendError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_REPLAY_FILE": "/tmp/capture",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigGeneratorBackend(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND":            "generator",
+		"TCP_AUDIT_TRACEFS_GENERATOR_RATE":     "2500.5",
+		"TCP_AUDIT_TRACEFS_GENERATOR_LIFETIME": "250ms",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.backend != backendGenerator || cfg.generatorRate != 2500.5 || cfg.generatorLifetime != 250*time.Millisecond {
+		t.Errorf("expected backend %q at 2500.5/s for 250ms, got %q at %v/s for %v",
+			backendGenerator,
+			cfg.backend,
+			cfg.generatorRate,
+			cfg.generatorLifetime)
+	}
+}
+
+func TestLoadConfigGeneratorRateInvalidError(t *testing.T) {
+	for _, rate := range []string{"0", "-1", "NaN", "+Inf", "fast"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_GENERATOR_RATE": rate,
+		}))
+		if err == nil {
+			t.Errorf("expected error for rate %q, got nil", rate)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigExistingConnections(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_EXISTING_CONNECTIONS": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.existingConnections {
+		t.Error("expected existing connections, but were not")
+	}
+}
+
+func TestLoadConfigReplayBackendExistingConnectionsError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND":              "replay",
+		"TCP_AUDIT_TRACEFS_REPLAY_FILE":          "/tmp/capture",
+		"TCP_AUDIT_TRACEFS_EXISTING_CONNECTIONS": "true",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigExistingOverlapWindow(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_EXISTING_OVERLAP_WINDOW": "250ms",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.existingOverlapWindow != 250*time.Millisecond {
+		t.Errorf("expected existing overlap window of 250ms, got %v", cfg.existingOverlapWindow)
+	}
+}
+
+func TestLoadConfigExistingOverlapWindowNegativeError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_EXISTING_OVERLAP_WINDOW": "-1s",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigRelayBackend(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND":       "relay",
+		"TCP_AUDIT_TRACEFS_RELAY_ADDRESS": "relay.example.com:7878",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.backend != backendRelay || cfg.relayAddress != "relay.example.com:7878" {
+		t.Errorf("expected backend %q of relay.example.com:7878, got %q of %q", backendRelay, cfg.backend, cfg.relayAddress)
+	}
+}
+
+func TestLoadConfigRelayBackendMissingAddressError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND": "relay",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigPacketBackend(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND":          "packet",
+		"TCP_AUDIT_TRACEFS_PACKET_INTERFACE": "eth0",
+		"TCP_AUDIT_TRACEFS_BUFFER_SIZE_KB":   "4096",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.backend != backendPacket || cfg.packetInterface != "eth0" || cfg.bufferSizeKB != 4096 {
+		t.Errorf("expected backend %q of eth0 with buffer size 4096, got %q of %q with %d",
+			backendPacket,
+			cfg.backend,
+			cfg.packetInterface,
+			cfg.bufferSizeKB)
+	}
+}
+
+func TestLoadConfigPacketInterfaceWithoutPacketBackendError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_PACKET_INTERFACE": "eth0",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigModuleBackend(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND":        "module",
+		"TCP_AUDIT_TRACEFS_MODULE_CHANNEL": "/sys/kernel/debug/tcp_audit/events",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.backend != backendModule || cfg.moduleChannel != "/sys/kernel/debug/tcp_audit/events" {
+		t.Errorf("expected backend %q of /sys/kernel/debug/tcp_audit/events, got %q of %q",
+			backendModule,
+			cfg.backend,
+			cfg.moduleChannel)
+	}
+}
+
+func TestLoadConfigModuleBackendMissingChannelError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND": "module",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigCommands(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_COMMANDS": "nginx*, curl",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(cfg.commands) != 2 || cfg.commands[0] != "nginx*" || cfg.commands[1] != "curl" {
+		t.Errorf("expected commands nginx* and curl, got %q", cfg.commands)
+	}
+}
+
+func TestLoadConfigCommandsBadPatternError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_COMMANDS": "nginx[",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigPIDsWithPerfBackend(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND": "perf",
+		"TCP_AUDIT_TRACEFS_PIDS":    "1234",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(cfg.eventPIDs) != 1 || cfg.eventPIDs[0] != 1234 {
+		t.Errorf("expected PID 1234, got %v", cfg.eventPIDs)
+	}
+}
+
+func TestLoadConfigPIDsWithConntrackBackendError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND": "conntrack",
+		"TCP_AUDIT_TRACEFS_PIDS":    "1234",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigNetNS(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_NETNS": "4026531993, /run/netns/blue",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(cfg.netNSFilter) != 2 || cfg.netNSFilter[0] != "4026531993" || cfg.netNSFilter[1] != "/run/netns/blue" {
+		t.Errorf("expected network namespaces 4026531993 and /run/netns/blue, got %q", cfg.netNSFilter)
+	}
+
+	if !cfg.netNSTagging {
+		t.Error("expected network namespace tagging, but was not")
+	}
+}
+
+func TestLoadConfigNetNSTaggingWithReplayBackendError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_BACKEND":       "replay",
+		"TCP_AUDIT_TRACEFS_REPLAY_FILE":   "capture",
+		"TCP_AUDIT_TRACEFS_NETNS_TAGGING": "true",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigReverseDNS(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_REVERSE_DNS":      "true",
+		"TCP_AUDIT_TRACEFS_REVERSE_DNS_TTL":  "1h",
+		"TCP_AUDIT_TRACEFS_REVERSE_DNS_RATE": "2.5",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.reverseDNS || cfg.reverseDNSTTL != time.Hour || cfg.reverseDNSRate != 2.5 {
+		t.Errorf("expected reverse DNS with TTL of 1h at 2.5/s, got %t with %v at %v/s",
+			cfg.reverseDNS,
+			cfg.reverseDNSTTL,
+			cfg.reverseDNSRate)
+	}
+}
+
+func TestLoadConfigReverseDNSRateError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_REVERSE_DNS_RATE": "0",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigGeoIPDatabases(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_GEOIP_DATABASES": "/var/lib/GeoIP/GeoLite2-Country.mmdb, /var/lib/GeoIP/GeoLite2-ASN.mmdb",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(cfg.geoIPDatabases) != 2 ||
+		cfg.geoIPDatabases[0] != "/var/lib/GeoIP/GeoLite2-Country.mmdb" ||
+		cfg.geoIPDatabases[1] != "/var/lib/GeoIP/GeoLite2-ASN.mmdb" {
+		t.Errorf("expected 2 GeoIP databases, got %q", cfg.geoIPDatabases)
+	}
+}
+
+func TestLoadConfigGeoIPDatabasesEmptyError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_GEOIP_DATABASES": "/var/lib/GeoIP/GeoLite2-Country.mmdb,",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigFlowSummariesImplyFlows(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_FLOW_SUMMARIES": "true",
+		"TCP_AUDIT_TRACEFS_FLOW_TIMEOUT":   "24h",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.flows || !cfg.flowSummaries || cfg.flowTimeout != 24*time.Hour {
+		t.Errorf("expected summarised flows timed out after 24h, got %t, %t, %v",
+			cfg.flows,
+			cfg.flowSummaries,
+			cfg.flowTimeout)
+	}
+}
+
+func TestLoadConfigFlowTimeoutNegativeError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_FLOW_TIMEOUT": "-1s",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigDirection(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_DIRECTION": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.direction {
+		t.Error("expected direction to be classified, but was not")
+	}
+}
+
+func TestLoadConfigFilterExpressionError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_FILTER_EXPRESSION": `dest_port == "443"`,
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigSummaryInterval(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_SUMMARY_INTERVAL": "5m",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.summaryInterval != 5*time.Minute {
+		t.Errorf("expected summary interval of 5m, got %v", cfg.summaryInterval)
+	}
+}
+
+func TestLoadConfigSummaryIntervalFlowSummariesError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_SUMMARY_INTERVAL": "5m",
+		"TCP_AUDIT_TRACEFS_FLOW_SUMMARIES":   "true",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigMinFlowDurationImpliesFlows(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_MIN_FLOW_DURATION": "500ms",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.flows || cfg.minFlowDuration != 500*time.Millisecond {
+		t.Errorf("expected flows of at least 500ms, got %t, %v", cfg.flows, cfg.minFlowDuration)
+	}
+}
+
+func TestLoadConfigHostTags(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_HOST_TAGS":         "env=prod, rack = r12,empty=",
+		"TCP_AUDIT_TRACEFS_HOST_TAG_HOSTNAME": "true",
+		"TCP_AUDIT_TRACEFS_CLOUD_METADATA":    "aws",
+	}))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(cfg.hostTags) != 3 ||
+		cfg.hostTags["env"] != "prod" ||
+		cfg.hostTags["rack"] != "r12" ||
+		cfg.hostTags["empty"] != "" {
+		t.Errorf("expected tags env=prod, rack=r12 and empty=, got %v", cfg.hostTags)
+	}
+
+	if !cfg.hostTagHostname || cfg.cloudMetadata != cloudMetadataAWS {
+		t.Errorf("expected hostname and AWS instance ID tags, got %t, %q", cfg.hostTagHostname, cfg.cloudMetadata)
+	}
+}
+
+func TestLoadConfigHostTagsError(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"TCP_AUDIT_TRACEFS_HOST_TAGS": "env"},
+		{"TCP_AUDIT_TRACEFS_HOST_TAGS": "=prod"},
+		{"TCP_AUDIT_TRACEFS_HOST_TAGS": "env=prod,env=dev"},
+		{"TCP_AUDIT_TRACEFS_CLOUD_METADATA": "oracle"},
+	} {
+		_, err := loadConfig(newMockGetenv(env))
+		if err == nil {
+			t.Errorf("%v: expected error, got nil", env)
+			continue
+		}
+
+		t.Logf("%v: got error %q (of type %T)", env, err, err)
+	}
+}
+
+func TestLoadConfigDebounceWindowNegativeError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_DEBOUNCE_WINDOW": "-10ms",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigDebounceWindowPollError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_DEBOUNCE_WINDOW": "100ms",
+		"TCP_AUDIT_TRACEFS_READ_MODE":       "poll",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigSummaryIntervalPollError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_SUMMARY_INTERVAL": "1m",
+		"TCP_AUDIT_TRACEFS_READ_MODE":        "poll",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigMPTCPUnsupportedBackendError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_MPTCP":   "true",
+		"TCP_AUDIT_TRACEFS_BACKEND": "sock-diag",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigReloadOnSIGHUP(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_RELOAD_ON_SIGHUP": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.reloadOnSIGHUP {
+		t.Error("expected reload on SIGHUP, got none")
+	}
+}
+
+func TestConfigFileGetenv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "eventer.conf")
+	contents := "" +
+		"# Only HTTPS\n" +
+		"\n" +
+		"TCP_AUDIT_TRACEFS_FILTER_EXPRESSION = dest_port == 443\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+
+	getenv, err := configFileGetenv(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_CONFIG_FILE":       path,
+		"TCP_AUDIT_TRACEFS_FILTER_EXPRESSION": "dest_port == 80",
+		"TCP_AUDIT_TRACEFS_COMMANDS":          "nginx",
+	}))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if expression := getenv("TCP_AUDIT_TRACEFS_FILTER_EXPRESSION"); expression != "dest_port == 443" {
+		t.Errorf("expected filter expression of config file, got %q", expression)
+	}
+
+	if commands := getenv("TCP_AUDIT_TRACEFS_COMMANDS"); commands != "nginx" {
+		t.Errorf("expected commands of environment, got %q", commands)
+	}
+}
+
+func TestConfigFileGetenvError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "eventer.conf")
+	if err := ioutil.WriteFile(path, []byte("FILTER_EXPRESSION=dest_port == 443\n"), 0644); err != nil {
+		t.Fatalf("writing config file: %v", err)
+	}
+
+	for _, path := range []string{path, filepath.Join(dir, "does-not-exist")} {
+		_, err := configFileGetenv(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_CONFIG_FILE": path,
+		}))
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", path)
+			continue
+		}
+
+		t.Logf("%s: got error %q (of type %T)", path, err, err)
+	}
+}
+
+func TestLoadConfigLineReader(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_LINE_READER": "scanner",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.lineReader != lineReaderScanner {
+		t.Errorf("expected line reader %q, got %q", lineReaderScanner, cfg.lineReader)
+	}
+}
+
+func TestLoadConfigUnknownLineReaderError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_LINE_READER": "foo",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestLoadConfigReadBufferSize(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_READ_BUFFER_SIZE_KB": "4096",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.readBufferSize != 4*1024*1024 {
+		t.Errorf("expected read buffer size of 4 MiB, got %d", cfg.readBufferSize)
+	}
+}
+
+func TestLoadConfigInvalidReadBufferSizeError(t *testing.T) {
+	for _, size := range []string{"0", "-1", "foo", "2097152"} {
+		_, err := loadConfig(newMockGetenv(map[string]string{
+			"TCP_AUDIT_TRACEFS_READ_BUFFER_SIZE_KB": size,
+		}))
+		if err == nil {
+			t.Errorf("expected error for %q, got nil", size)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigParserWorkers(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_PARSER_WORKERS":  "4",
+		"TCP_AUDIT_TRACEFS_PARSER_ORDERING": "unordered",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if cfg.parserWorkers != 4 {
+		t.Errorf("expected 4 parser workers, got %d", cfg.parserWorkers)
+	}
+
+	if cfg.parserOrdering != parserOrderingUnordered {
+		t.Errorf("expected parser ordering %q, got %q", parserOrderingUnordered, cfg.parserOrdering)
+	}
+}
+
+func TestLoadConfigParserWorkersErrors(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"TCP_AUDIT_TRACEFS_PARSER_WORKERS": "-1"},
+		{"TCP_AUDIT_TRACEFS_PARSER_WORKERS": "foo"},
+		{"TCP_AUDIT_TRACEFS_PARSER_WORKERS": "4", "TCP_AUDIT_TRACEFS_PER_CPU_READERS": "true"},
+		{"TCP_AUDIT_TRACEFS_PARSER_ORDERING": "foo"},
+	} {
+		_, err := loadConfig(newMockGetenv(env))
+		if err == nil {
+			t.Errorf("expected error for %v, got nil", env)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestLoadConfigEventPooling(t *testing.T) {
+	cfg, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_EVENT_POOLING": "true",
+	}))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !cfg.eventPooling {
+		t.Error("expected event pooling, got none")
+	}
+}
+
+func TestLoadConfigEventPoolingFlowsError(t *testing.T) {
+	_, err := loadConfig(newMockGetenv(map[string]string{
+		"TCP_AUDIT_TRACEFS_EVENT_POOLING":  "true",
+		"TCP_AUDIT_TRACEFS_FLOW_SUMMARIES": "true",
+	}))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// The parts of the ctnetlink ABI of nfnetlink needed to receive the events of
+// TCP connections tracked by conntrack.
+const (
+	netlinkNetfilter = 12
+
+	// The multicast groups of the events of new, updated and destroyed
+	// connections.
+	nfnlGroupConntrackNew     = 1
+	nfnlGroupConntrackUpdate  = 2
+	nfnlGroupConntrackDestroy = 3
+
+	nfnlSubsysCTNetlink = 1
+	ipctnlMsgCTNew      = 0
+	ipctnlMsgCTDelete   = 2
+
+	// NfgenmsgSize is the size of the struct nfgenmsg which begins the payload
+	// of each message.
+	nfgenmsgSize = 4
+
+	// The attributes of a connection, and the attributes nested within them.
+	ctaTupleOrig         = 1
+	ctaProtoinfo         = 4
+	ctaTupleIP           = 1
+	ctaTupleProto        = 2
+	ctaIPV4Src           = 1
+	ctaIPV4Dst           = 2
+	ctaProtoNum          = 1
+	ctaProtoSrcPort      = 2
+	ctaProtoDstPort      = 3
+	ctaProtoinfoTCP      = 1
+	ctaProtoinfoTCPState = 1
+
+	nlaTypeMask = 0x3fff // Less the nested and byte order flags
+)
+
+// ConntrackTCPStates maps the states of TCP connections tracked by conntrack to
+// the TCP states of sockets. Conntrack tracks connections from the perspective
+// of the host forwarding them, so these are those of the endpoint which
+// initiated the connection, other than in SYN_RECV. Conntrack does not
+// distinguish FIN_WAIT2 from FIN_WAIT, and its NONE state has no equivalent.
+var conntrackTCPStates = map[uint8]uint8{
+	1: 2, // SYN_SENT to TCP_SYN_SENT
+	2: 3, // SYN_RECV to TCP_SYN_RECV
+	3: 1, // ESTABLISHED to TCP_ESTABLISHED
+	4: 4, // FIN_WAIT to TCP_FIN_WAIT1
+	5: 8, // CLOSE_WAIT to TCP_CLOSE_WAIT
+	6: 9, // LAST_ACK to TCP_LAST_ACK
+	7: 6, // TIME_WAIT to TCP_TIME_WAIT
+	8: 7, // CLOSE to TCP_CLOSE
+	9: 2, // SYN_SENT2, of a simultaneous open, to TCP_SYN_SENT
+}
+
+// ConntrackEvent is the event of a TCPv4 connection tracked by conntrack.
+type conntrackEvent struct {
+	destroy bool
+	tuple   sockDiagKey // The original tuple of the connection
+	state   uint8       // The conntrack TCP state, or zero if not reported
+}
+
+// ConntrackConn is a netlink socket subscribed to the conntrack events.
+type conntrackConn struct {
+	fd int
+}
+
+// NewConntrackConn subscribes to the events of new, updated and destroyed
+// connections, with a receive buffer of the size in bytes, or the default if
+// zero. Requires CAP_NET_ADMIN.
+func newConntrackConn(rcvbuf int) (*conntrackConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		netlinkNetfilter)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if rcvbuf > 0 {
+		// Beyond rmem_max only if privileged
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, rcvbuf); err != nil {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf); err != nil {
+				syscall.Close(fd)
+				return nil, os.NewSyscallError("setsockopt", err)
+			}
+		}
+	}
+
+	groups := uint32(1<<(nfnlGroupConntrackNew-1) |
+		1<<(nfnlGroupConntrackUpdate-1) |
+		1<<(nfnlGroupConntrackDestroy-1))
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	return &conntrackConn{fd: fd}, nil
+}
+
+// SetReceiveTimeout sets the longest a receive blocks.
+func (c *conntrackConn) setReceiveTimeout(timeout int64) error {
+	tv := syscall.NsecToTimeval(timeout)
+	if err := syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+
+	return nil
+}
+
+// Receive reads the next datagram of events into buf, returning its length.
+func (c *conntrackConn) receive(buf []byte) (int, error) {
+	n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (c *conntrackConn) close() error {
+	if err := syscall.Close(c.fd); err != nil {
+		return os.NewSyscallError("close", err)
+	}
+
+	return nil
+}
+
+// DecodeConntrackEvents returns the events of the TCPv4 connections of a
+// datagram of netlink messages. The events of other connections are skipped.
+func decodeConntrackEvents(datagram []byte) ([]*conntrackEvent, error) {
+	messages, err := syscall.ParseNetlinkMessage(datagram)
+	if err != nil {
+		return nil, fmt.Errorf("parsing netlink messages: %w", err)
+	}
+
+	var events []*conntrackEvent
+	for _, message := range messages {
+		if message.Header.Type>>8 != nfnlSubsysCTNetlink {
+			continue
+		}
+
+		msgType := message.Header.Type & 0xff
+		if msgType != ipctnlMsgCTNew && msgType != ipctnlMsgCTDelete {
+			continue
+		}
+
+		if len(message.Data) < nfgenmsgSize || message.Data[0] != syscall.AF_INET {
+			continue
+		}
+
+		event, ok, err := decodeConntrackAttrs(message.Data[nfgenmsgSize:])
+		if err != nil {
+			return nil, fmt.Errorf("decoding conntrack event: %w", err)
+		}
+
+		if ok {
+			event.destroy = msgType == ipctnlMsgCTDelete
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// DecodeConntrackAttrs decodes the tuple and TCP state of a connection from its
+// attributes. If it is not a TCP connection, ok is false.
+func decodeConntrackAttrs(attrs []byte) (event *conntrackEvent, ok bool, err error) {
+	event = new(conntrackEvent)
+	isTCP := false
+	err = walkNetlinkAttrs(attrs, func(attrType uint16, value []byte) error {
+		switch attrType {
+		case ctaTupleOrig:
+			return walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+				switch attrType {
+				case ctaTupleIP:
+					return walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+						if len(value) != net.IPv4len {
+							return nil
+						}
+
+						switch attrType {
+						case ctaIPV4Src:
+							copy(event.tuple.saddr[:], value)
+						case ctaIPV4Dst:
+							copy(event.tuple.daddr[:], value)
+						}
+						return nil
+					})
+				case ctaTupleProto:
+					return walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+						switch {
+						case attrType == ctaProtoNum && len(value) == 1:
+							isTCP = value[0] == syscall.IPPROTO_TCP
+						case attrType == ctaProtoSrcPort && len(value) == 2:
+							event.tuple.sport = binary.BigEndian.Uint16(value)
+						case attrType == ctaProtoDstPort && len(value) == 2:
+							event.tuple.dport = binary.BigEndian.Uint16(value)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		case ctaProtoinfo:
+			return walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+				if attrType != ctaProtoinfoTCP {
+					return nil
+				}
+
+				return walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+					if attrType == ctaProtoinfoTCPState && len(value) == 1 {
+						event.state = value[0]
+					}
+					return nil
+				})
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return event, isTCP, nil
+}
+
+// WalkNetlinkAttrs calls fn with the type, less its flags, and value of each of
+// a sequence of netlink attributes.
+func walkNetlinkAttrs(attrs []byte, fn func(attrType uint16, value []byte) error) error {
+	for len(attrs) >= syscall.NLA_HDRLEN {
+		length := int(hostByteOrder.Uint16(attrs[0:]))
+		if length < syscall.NLA_HDRLEN || length > len(attrs) {
+			return fmt.Errorf("invalid attribute length %d", length)
+		}
+
+		if err := fn(hostByteOrder.Uint16(attrs[2:])&nlaTypeMask, attrs[syscall.NLA_HDRLEN:length]); err != nil {
+			return err
+		}
+
+		aligned := (length + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+		if aligned > len(attrs) {
+			break
+		}
+		attrs = attrs[aligned:]
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ConntrackSource receives the events of the TCPv4 connections tracked by
+// conntrack, and maps them to state changes. On gateway and NAT hosts, through
+// which connections are forwarded, rather than terminated, conntrack is the
+// authoritative record of the connections. As conntrack tracks connections,
+// rather than sockets, each transition is reported once, as that of the
+// endpoint which initiated the connection, by its original tuple, and is of no
+// task.
+type conntrackSource struct {
+	read     uint64 // Accessed atomically, the number of state changes read
+	overrun  uint64 // Accessed atomically, the number of times events were lost
+	closed   int32  // Accessed atomically, non-zero once closed
+	deadline sourceDeadline
+
+	config *config
+
+	conn        *conntrackConn
+	receiveLock *sync.Mutex // Serialises receives with the closing of the netlink socket
+	buf         []byte      // The datagram received
+
+	// States are the last states of the connections, by their original tuple,
+	// from which the old state of each transition is taken.
+	states map[sockDiagKey]uint8
+
+	pending []*ContextEvent // The state changes of the last datagram not yet read
+
+	osReleasePath string
+}
+
+func newConntrackSource(config *config) *conntrackSource {
+	return &conntrackSource{
+		config:        config,
+		receiveLock:   new(sync.Mutex),
+		states:        make(map[sockDiagKey]uint8),
+		osReleasePath: osReleasePath,
+	}
+}
+
+// Open subscribes to the conntrack events, with a receive buffer of the buffer
+// size, if configured.
+func (cs *conntrackSource) open() error {
+	conn, err := newConntrackConn(int(cs.config.bufferSizeKB * 1024))
+	if err != nil {
+		return fmt.Errorf("subscribing to conntrack events: %w", err)
+	}
+
+	if err := conn.setReceiveTimeout(int64(perfPollInterval)); err != nil {
+		conn.close()
+		return fmt.Errorf("setting conntrack receive timeout: %w", err)
+	}
+	cs.conn = conn
+	cs.buf = make([]byte, os.Getpagesize()*8)
+
+	return nil
+}
+
+// Event returns the next state change, receiving events until any change
+// state. A receive blocks for at most perfPollInterval, so that closure and
+// deadlines are noticed.
+func (cs *conntrackSource) event() (*ContextEvent, error) {
+	for len(cs.pending) == 0 {
+		if atomic.LoadInt32(&cs.closed) != 0 {
+			return nil, os.ErrClosed
+		}
+
+		if _, err := cs.deadline.wait(perfPollInterval); err != nil {
+			return nil, err
+		}
+
+		n, err := cs.receive()
+		switch err {
+		case nil:
+		case syscall.EAGAIN, syscall.EINTR:
+			continue
+		case syscall.ENOBUFS:
+			atomic.AddUint64(&cs.overrun, 1)
+			log.Printf("WARNING: conntrack events lost as the receive buffer overran")
+			continue
+		case os.ErrClosed:
+			return nil, err
+		default:
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+
+		if err := cs.decode(cs.buf[:n]); err != nil {
+			return nil, err
+		}
+	}
+
+	event := cs.pending[0]
+	cs.pending = cs.pending[1:]
+
+	return event, nil
+}
+
+// Receive receives a datagram, unless the netlink socket has been closed.
+func (cs *conntrackSource) receive() (int, error) {
+	cs.receiveLock.Lock()
+	defer cs.receiveLock.Unlock()
+	if cs.conn == nil {
+		return 0, os.ErrClosed
+	}
+
+	return cs.conn.receive(cs.buf)
+}
+
+// Decode queues the state changes of the events of the datagram.
+func (cs *conntrackSource) decode(datagram []byte) error {
+	events, err := decodeConntrackEvents(datagram)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		transition, ok := cs.transition(event)
+		if !ok {
+			continue
+		}
+
+		contextEvent, err := newTransitionEvent(transition, nil, bestEffortParsing(cs.config))
+		if err != nil {
+			return err
+		}
+		cs.pending = append(cs.pending, contextEvent)
+		atomic.AddUint64(&cs.read, 1)
+	}
+
+	return nil
+}
+
+func (cs *conntrackSource) setReadDeadline(t time.Time) error {
+	cs.deadline.set(t)
+	return nil
+}
+
+func (cs *conntrackSource) kernelInfo() (*KernelInfo, error) {
+	return releaseKernelInfo(cs.osReleasePath)
+}
+
+// BufferStats returns the number of state changes read, and the number of
+// times the receive buffer overran, each of which lost at least one event.
+func (cs *conntrackSource) bufferStats() (*BufferStats, error) {
+	return &BufferStats{
+		Overrun:    atomic.LoadUint64(&cs.overrun),
+		ReadEvents: atomic.LoadUint64(&cs.read),
+	}, nil
+}
+
+// Close stops receiving, and closes the netlink socket, if it was opened, once
+// any receive in progress is done.
+func (cs *conntrackSource) close() error {
+	log.Printf("Closing conntrack netlink socket")
+	atomic.StoreInt32(&cs.closed, 1)
+
+	cs.receiveLock.Lock()
+	defer cs.receiveLock.Unlock()
+	if cs.conn == nil {
+		return nil
+	}
+
+	err := cs.conn.close()
+	cs.conn = nil
+	if err != nil {
+		return fmt.Errorf("closing conntrack netlink socket: %w", err)
+	}
+
+	return nil
+}
+
+// Transition returns the state change of the connection of the event, and
+// records its new state. Events which do not change the state, or with no
+// equivalent state, have no transition.
+func (cs *conntrackSource) transition(event *conntrackEvent) (*sockDiagTransition, bool) {
+	socket := &inetDiagSocket{
+		saddr: event.tuple.saddr,
+		daddr: event.tuple.daddr,
+		sport: event.tuple.sport,
+		dport: event.tuple.dport,
+	}
+
+	oldState, known := cs.states[event.tuple]
+	newState, mapped := conntrackTCPStates[event.state]
+	if event.destroy {
+		delete(cs.states, event.tuple)
+		if !known {
+			// Connections tracked before the eventer subscribed are destroyed from
+			// their last state, if reported
+			oldState, known = newState, mapped
+		}
+
+		if !known || oldState == tcpStateClose {
+			return nil, false
+		}
+
+		return &sockDiagTransition{socket, oldState, tcpStateClose}, true
+	}
+
+	if !mapped {
+		return nil, false
+	}
+
+	if !known {
+		oldState = tcpStateClose
+	}
+	cs.states[event.tuple] = newState
+
+	if oldState == newState {
+		return nil, false
+	}
+
+	return &sockDiagTransition{socket, oldState, newState}, true
+}
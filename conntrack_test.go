@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// NewMockNetlinkAttr returns a netlink attribute of the type and value, padded
+// to alignment.
+func newMockNetlinkAttr(attrType uint16, value []byte) []byte {
+	attr := make([]byte, syscall.NLA_HDRLEN, syscall.NLA_HDRLEN+len(value)+syscall.NLA_ALIGNTO)
+	hostByteOrder.PutUint16(attr[0:], uint16(syscall.NLA_HDRLEN+len(value)))
+	hostByteOrder.PutUint16(attr[2:], attrType)
+	attr = append(attr, value...)
+	for len(attr)%syscall.NLA_ALIGNTO != 0 {
+		attr = append(attr, 0)
+	}
+
+	return attr
+}
+
+func concatBytes(slices ...[]byte) []byte {
+	var concatenated []byte
+	for _, slice := range slices {
+		concatenated = append(concatenated, slice...)
+	}
+
+	return concatenated
+}
+
+// NewMockConntrackMsg returns a ctnetlink message of the type, of a TCPv4
+// connection of the tuple in the conntrack TCP state.
+func newMockConntrackMsg(msgType uint16, protocol byte, tuple sockDiagKey, state uint8) []byte {
+	const nlaFNested = 1 << 15
+	ports := make([]byte, 2)
+
+	binary.BigEndian.PutUint16(ports, tuple.sport)
+	sport := newMockNetlinkAttr(ctaProtoSrcPort, ports)
+	binary.BigEndian.PutUint16(ports, tuple.dport)
+	dport := newMockNetlinkAttr(ctaProtoDstPort, ports)
+
+	attrs := concatBytes(
+		newMockNetlinkAttr(ctaTupleOrig|nlaFNested, concatBytes(
+			newMockNetlinkAttr(ctaTupleIP|nlaFNested, concatBytes(
+				newMockNetlinkAttr(ctaIPV4Src, tuple.saddr[:]),
+				newMockNetlinkAttr(ctaIPV4Dst, tuple.daddr[:]))),
+			newMockNetlinkAttr(ctaTupleProto|nlaFNested, concatBytes(
+				newMockNetlinkAttr(ctaProtoNum, []byte{protocol}),
+				sport,
+				dport)))),
+		newMockNetlinkAttr(ctaProtoinfo|nlaFNested,
+			newMockNetlinkAttr(ctaProtoinfoTCP|nlaFNested,
+				newMockNetlinkAttr(ctaProtoinfoTCPState, []byte{state}))))
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN+nfgenmsgSize, syscall.NLMSG_HDRLEN+nfgenmsgSize+len(attrs))
+	msg = append(msg, attrs...)
+	hostByteOrder.PutUint32(msg[0:], uint32(len(msg)))
+	hostByteOrder.PutUint16(msg[4:], nfnlSubsysCTNetlink<<8|msgType)
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET
+
+	return msg
+}
+
+var mockConntrackTuple = sockDiagKey{
+	saddr: [4]byte{192, 168, 122, 38},
+	daddr: [4]byte{172, 217, 169, 4},
+	sport: 44406,
+	dport: 80,
+}
+
+func TestDecodeConntrackEvents(t *testing.T) {
+	datagram := concatBytes(
+		newMockConntrackMsg(ipctnlMsgCTNew, syscall.IPPROTO_TCP, mockConntrackTuple, 3),
+		newMockConntrackMsg(ipctnlMsgCTNew, syscall.IPPROTO_UDP, mockConntrackTuple, 0),
+		newMockConntrackMsg(ipctnlMsgCTDelete, syscall.IPPROTO_TCP, mockConntrackTuple, 7))
+
+	events, err := decodeConntrackEvents(datagram)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 TCP events, got %d", len(events))
+	}
+
+	if events[0].destroy || events[0].tuple != mockConntrackTuple || events[0].state != 3 {
+		t.Errorf("expected new established event of %+v, got %+v", mockConntrackTuple, events[0])
+	}
+
+	if !events[1].destroy || events[1].state != 7 {
+		t.Errorf("expected destroy event in TIME_WAIT, got %+v", events[1])
+	}
+}
+
+func TestDecodeConntrackEventsInvalidAttrError(t *testing.T) {
+	msg := newMockConntrackMsg(ipctnlMsgCTNew, syscall.IPPROTO_TCP, mockConntrackTuple, 3)
+	hostByteOrder.PutUint16(msg[syscall.NLMSG_HDRLEN+nfgenmsgSize:], 0xfff) // Beyond the message
+
+	_, err := decodeConntrackEvents(msg)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestConntrackTransitions(t *testing.T) {
+	source := newConntrackSource(new(config))
+
+	for _, step := range []struct {
+		event              *conntrackEvent
+		ok                 bool
+		oldState, newState uint8
+	}{
+		{&conntrackEvent{tuple: mockConntrackTuple, state: 1}, true, tcpStateClose, 2},                // SYN_SENT
+		{&conntrackEvent{tuple: mockConntrackTuple, state: 1}, false, 0, 0},                           // Unchanged
+		{&conntrackEvent{tuple: mockConntrackTuple, state: 3}, true, 2, 1},                            // ESTABLISHED
+		{&conntrackEvent{tuple: mockConntrackTuple, state: 0}, false, 0, 0},                           // NONE
+		{&conntrackEvent{tuple: mockConntrackTuple, state: 7}, true, 1, 6},                            // TIME_WAIT
+		{&conntrackEvent{tuple: mockConntrackTuple, destroy: true}, true, 6, tcpStateClose},           // Destroyed
+		{&conntrackEvent{tuple: mockConntrackTuple, destroy: true, state: 8}, false, 0, 0},            // Destroyed closed
+		{&conntrackEvent{tuple: mockConntrackTuple, destroy: true, state: 3}, true, 1, tcpStateClose}, // Untracked
+	} {
+		transition, ok := source.transition(step.event)
+		if ok != step.ok {
+			t.Errorf("expected transition %t for %+v, got %t", step.ok, step.event, ok)
+			continue
+		}
+
+		if ok && (transition.oldState != step.oldState || transition.newState != step.newState) {
+			t.Errorf("expected transition from %d to %d for %+v, got from %d to %d",
+				step.oldState,
+				step.newState,
+				step.event,
+				transition.oldState,
+				transition.newState)
+		}
+	}
+}
+
+func TestConntrackSourceDecode(t *testing.T) {
+	source := newConntrackSource(new(config))
+
+	if err := source.decode(newMockConntrackMsg(ipctnlMsgCTNew, syscall.IPPROTO_TCP, mockConntrackTuple, 3)); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(source.pending) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(source.pending))
+	}
+
+	event := source.pending[0]
+	if event.SourcePort != 44406 || event.DestPort != 80 ||
+		!event.SourceIP.Equal(net.IPv4(192, 168, 122, 38)) || !event.DestIP.Equal(net.IPv4(172, 217, 169, 4)) {
+		t.Errorf("expected connection from 192.168.122.38:44406 to 172.217.169.4:80, got %+v", event.Event)
+	}
+
+	if event.OldState != tcpstate.StateClosed || event.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected connection created established, got from %v to %v", event.OldState, event.NewState)
+	}
+
+	if event.CommandOnCPU != "<...>" || !event.Idle {
+		t.Errorf("expected event of no task, got %s-%d", event.CommandOnCPU, event.PIDOnCPU)
+	}
+
+	if stats, _ := source.bufferStats(); stats.ReadEvents != 1 {
+		t.Errorf("expected 1 read event, got %d", stats.ReadEvents)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// DebouncedEvent is a state change held for the debounce window, and the last
+// transition collapsed into it.
+type debouncedEvent struct {
+	event              *ContextEvent
+	oldState, newState tcpstate.State
+}
+
+// HeldDebouncedEvent is a held state change, by the key of its flow, and its
+// time, as the event may be returned, and so released, before it is dequeued.
+// Its window also expires once as long has passed since it was held, so that
+// it is released even if no later event is read.
+type heldDebouncedEvent struct {
+	key     flowKey
+	time    time.Time
+	expires time.Time
+	pending *debouncedEvent
+}
+
+// Debouncer collapses the rapid oscillations of the state of a socket, such
+// as the same transition reported again, or reversed, during a storm of
+// retransmissions, into a single event. Each state change is held for the
+// window, within which each later state change of its flow which repeats or
+// reverses the last is collapsed into it, so that it transitions from the
+// first old state to the last new state, and counts those collapsed. A state
+// change which progresses beyond the last releases the event held before it
+// is itself held. Events held are released once an event is read after their
+// window, their window has expired since they were held, or events are
+// exhausted, and events of other kinds are returned behind those released. It
+// is only accessed by the reader of events, so is not safe for concurrent use.
+type debouncer struct {
+	window    time.Duration
+	collapsed *uint64 // Accessed atomically, the number of state changes collapsed
+
+	held     map[flowKey]*debouncedEvent
+	order    []heldDebouncedEvent // In the order of their times
+	released []*ContextEvent      // Awaiting return
+}
+
+// NewDebouncer returns a debouncer of the state changes of each flow within
+// the window, which counts in collapsed those collapsed.
+func newDebouncer(window time.Duration, collapsed *uint64) *debouncer {
+	return &debouncer{
+		window:    window,
+		collapsed: collapsed,
+		held:      make(map[flowKey]*debouncedEvent),
+	}
+}
+
+// Debounce returns whether the event is held, or collapsed, rather than
+// returned. Those held are later returned by next.
+func (d *debouncer) debounce(event *ContextEvent) bool {
+	d.release(event.Time)
+
+	if event.Kind != KindStateChange {
+		if len(d.released) == 0 {
+			return false
+		}
+
+		d.released = append(d.released, event)
+		return true
+	}
+
+	key := newFlowKey(event)
+	if pending, ok := d.held[key]; ok {
+		repeated := event.OldState == pending.oldState && event.NewState == pending.newState
+		reversed := event.OldState == pending.newState && event.NewState == pending.oldState
+		if repeated || reversed {
+			pending.oldState, pending.newState = event.OldState, event.NewState
+			pending.event.NewState = event.NewState
+			pending.event.Collapsed++
+			atomic.AddUint64(d.collapsed, 1)
+
+			return true
+		}
+
+		delete(d.held, key)
+		d.released = append(d.released, pending.event)
+	}
+
+	pending := &debouncedEvent{event: event, oldState: event.OldState, newState: event.NewState}
+	d.held[key] = pending
+	d.order = append(d.order, heldDebouncedEvent{
+		key:     key,
+		time:    event.Time,
+		expires: time.Now().Add(d.window),
+		pending: pending,
+	})
+
+	return true
+}
+
+// Next returns the next event released, if any.
+func (d *debouncer) next() (*ContextEvent, bool) {
+	if len(d.released) == 0 {
+		return nil, false
+	}
+
+	event := d.released[0]
+	d.released[0] = nil
+	d.released = d.released[1:]
+
+	return event, true
+}
+
+// Release releases the events held whose window has passed by now.
+func (d *debouncer) release(now time.Time) {
+	for len(d.order) > 0 {
+		held := d.order[0]
+		if now.Sub(held.time) < d.window {
+			return
+		}
+		d.order[0] = heldDebouncedEvent{}
+		d.order = d.order[1:]
+
+		// The event may already have been released by a later state change
+		if d.held[held.key] == held.pending {
+			delete(d.held, held.key)
+			d.released = append(d.released, held.pending.event)
+		}
+	}
+}
+
+// Expiry returns when the window of the earliest event still held expires, by
+// the time it was held, or false if none are held, so that reads can be bounded
+// by it.
+func (d *debouncer) expiry() (time.Time, bool) {
+	for len(d.order) > 0 {
+		held := d.order[0]
+		if d.held[held.key] == held.pending {
+			return held.expires, true
+		}
+
+		// The event was already released by a later state change
+		d.order[0] = heldDebouncedEvent{}
+		d.order = d.order[1:]
+	}
+
+	return time.Time{}, false
+}
+
+// Expire releases the events held whose window has expired by now, by the time
+// they were held, as no later event was read to release them, and returns
+// whether there are any to return.
+func (d *debouncer) expire(now time.Time) bool {
+	for len(d.order) > 0 {
+		held := d.order[0]
+		if now.Before(held.expires) {
+			break
+		}
+		d.order[0] = heldDebouncedEvent{}
+		d.order = d.order[1:]
+
+		if d.held[held.key] == held.pending {
+			delete(d.held, held.key)
+			d.released = append(d.released, held.pending.event)
+		}
+	}
+
+	return len(d.released) > 0
+}
+
+// Flush releases all events held, as no more events are to be read, and
+// returns whether there are any to return.
+func (d *debouncer) flush() bool {
+	for _, held := range d.order {
+		if d.held[held.key] == held.pending {
+			delete(d.held, held.key)
+			d.released = append(d.released, held.pending.event)
+		}
+	}
+	d.order = nil
+
+	return len(d.released) > 0
+}
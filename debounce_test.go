@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func TestDebouncerCollapsesOscillations(t *testing.T) {
+	now := time.Now()
+	collapsed := new(uint64)
+	debouncer := newDebouncer(time.Second, collapsed)
+	socket := &SocketID{Cookie: 1}
+
+	synSent := newMockTransition(now, socket, tcpstate.StateSynSent)
+	synSent.OldState = tcpstate.StateClosed
+	repeated := newMockTransition(now.Add(time.Millisecond), socket, tcpstate.StateSynSent)
+	repeated.OldState = tcpstate.StateClosed
+	reversed := newMockTransition(now.Add(2*time.Millisecond), socket, tcpstate.StateClosed)
+	reversed.OldState = tcpstate.StateSynSent
+	again := newMockTransition(now.Add(3*time.Millisecond), socket, tcpstate.StateSynSent)
+	again.OldState = tcpstate.StateClosed
+
+	for _, event := range []*ContextEvent{synSent, repeated, reversed, again} {
+		if !debouncer.debounce(event) {
+			t.Error("expected state change to be held, but was not")
+		}
+	}
+
+	if _, ok := debouncer.next(); ok {
+		t.Fatal("expected no event released within window, got one")
+	}
+
+	// An event after the window releases the event held
+	later := newMockTransition(now.Add(2*time.Second), &SocketID{Cookie: 2}, tcpstate.StateEstablished)
+	debouncer.debounce(later)
+
+	event, ok := debouncer.next()
+	if !ok || event != synSent {
+		t.Fatalf("expected first state change to be released, got %+v", event)
+	}
+
+	if event.OldState != tcpstate.StateClosed || event.NewState != tcpstate.StateSynSent || event.Collapsed != 3 {
+		t.Errorf("expected transition from CLOSED to SYN-SENT with 3 collapsed, got from %v to %v with %d",
+			event.OldState,
+			event.NewState,
+			event.Collapsed)
+	}
+
+	if *collapsed != 3 {
+		t.Errorf("expected 3 state changes collapsed, got %d", *collapsed)
+	}
+}
+
+func TestDebouncerReleasesProgressions(t *testing.T) {
+	now := time.Now()
+	debouncer := newDebouncer(time.Second, new(uint64))
+	socket := &SocketID{Cookie: 1}
+
+	synSent := newMockTransition(now, socket, tcpstate.StateSynSent)
+	synSent.OldState = tcpstate.StateClosed
+	established := newMockTransition(now.Add(time.Millisecond), socket, tcpstate.StateEstablished)
+	debouncer.debounce(synSent)
+	debouncer.debounce(established)
+
+	if event, ok := debouncer.next(); !ok || event != synSent || event.Collapsed != 0 {
+		t.Fatalf("expected first state change to be released uncollapsed, got %+v", event)
+	}
+
+	if _, ok := debouncer.next(); ok {
+		t.Fatal("expected last state change to remain held, but was released")
+	}
+
+	// Events of other kinds are returned behind those released
+	if debouncer.debounce(&ContextEvent{Event: established.Event, Kind: KindRetransmit}) {
+		t.Error("expected retransmit not to be held, but was")
+	}
+
+	if !debouncer.flush() {
+		t.Fatal("expected held state change to be flushed, but was not")
+	}
+
+	if event, ok := debouncer.next(); !ok || event != established {
+		t.Errorf("expected last state change to be released, got %+v", event)
+	}
+}
+
+func TestDebouncerExpires(t *testing.T) {
+	debouncer := newDebouncer(time.Second, new(uint64))
+	first := newMockTransition(time.Now(), &SocketID{Cookie: 1}, tcpstate.StateSynSent)
+	second := newMockTransition(time.Now(), &SocketID{Cookie: 2}, tcpstate.StateSynSent)
+	debouncer.debounce(first)
+	debouncer.debounce(second)
+
+	expiry, ok := debouncer.expiry()
+	if !ok {
+		t.Fatal("expected expiry of the event held, got none")
+	}
+
+	if debouncer.expire(expiry.Add(-time.Millisecond)) {
+		t.Error("expected no event released before expiry, got one")
+	}
+
+	if !debouncer.expire(expiry) {
+		t.Fatal("expected event released at expiry, got none")
+	}
+
+	if event, ok := debouncer.next(); !ok || event != first {
+		t.Errorf("expected first state change to be released, got %+v", event)
+	}
+}
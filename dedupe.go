@@ -0,0 +1,160 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// TransitionKey identifies a state transition of a socket, so that the same
+// transition reported twice, for example by two tracepoints, can be detected.
+type transitionKey struct {
+	socket               uint64 // The socket address, or zero if unknown
+	sourceIP, destIP     string // As bytes, so that the 4- and 16-byte forms differ only if the addresses do
+	sourcePort, destPort uint16
+	oldState, newState   tcpstate.State
+}
+
+// Deduplicator suppresses state transitions reported more than once within a
+// window of each other. Transitions are identified by the socket address, if
+// the tracepoint reports it, and the 4-tuple and states of the event. It is
+// only accessed by the reader of events, so is not safe for concurrent use.
+type deduplicator struct {
+	window     time.Duration
+	seen       map[transitionKey]time.Time
+	lastPruned time.Time
+}
+
+func newDeduplicator(window time.Duration) *deduplicator {
+	return &deduplicator{
+		window: window,
+		seen:   make(map[transitionKey]time.Time),
+	}
+}
+
+// Duplicate returns whether the event is a state change already seen within
+// the window. Events of other kinds are never duplicates.
+func (d *deduplicator) duplicate(event *ContextEvent) bool {
+	if event.Kind != KindStateChange {
+		return false
+	}
+
+	key := transitionKey{
+		sourceIP:   string(event.SourceIP.To16()),
+		destIP:     string(event.DestIP.To16()),
+		sourcePort: event.SourcePort,
+		destPort:   event.DestPort,
+		oldState:   event.OldState,
+		newState:   event.NewState,
+	}
+	if event.Socket != nil {
+		key.socket = event.Socket.Address
+	}
+
+	d.prune(event.Time)
+
+	if seen, ok := d.seen[key]; ok && absDuration(event.Time.Sub(seen)) <= d.window {
+		return true
+	}
+	d.seen[key] = event.Time
+
+	return false
+}
+
+// Prune forgets the transitions seen longer than the window before now, at
+// most once per window, so that the seen transitions do not grow unbounded.
+func (d *deduplicator) prune(now time.Time) {
+	if now.Sub(d.lastPruned) < d.window {
+		return
+	}
+	d.lastPruned = now
+
+	for key, seen := range d.seen {
+		if now.Sub(seen) > d.window {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// ConnectionKey identifies a connection by its 4-tuple.
+type connectionKey struct {
+	sourceIP, destIP     string // As for transitionKey
+	sourcePort, destPort uint16
+}
+
+func newConnectionKey(event *ContextEvent) connectionKey {
+	return connectionKey{
+		sourceIP:   string(event.SourceIP.To16()),
+		destIP:     string(event.DestIP.To16()),
+		sourcePort: event.SourcePort,
+		destPort:   event.DestPort,
+	}
+}
+
+// ExistingReconciler suppresses the traced state changes of the connections
+// listed when the eventer attached which the listing already reflects, as the
+// trace is opened before the listing, so that the two overlap. These are the
+// state changes traced before the listing, and those into the listed state
+// traced within the overlap window after it, such as those timestamped when
+// read. Once any other state change of a connection is traced, or the window
+// has passed, the trace alone is trusted. It is only accessed by the reader
+// of events, so is not safe for concurrent use.
+type existingReconciler struct {
+	listedAt time.Time
+	window   time.Duration
+	states   map[connectionKey]tcpstate.State // The listed states, until trusted
+}
+
+// NewExistingReconciler returns a reconciler of the listed connections, or nil
+// if there are none.
+func newExistingReconciler(existing []*ContextEvent, window time.Duration) *existingReconciler {
+	if len(existing) == 0 {
+		return nil
+	}
+
+	states := make(map[connectionKey]tcpstate.State, len(existing))
+	for _, event := range existing {
+		states[newConnectionKey(event)] = event.NewState
+	}
+
+	return &existingReconciler{
+		listedAt: existing[0].Time,
+		window:   window,
+		states:   states,
+	}
+}
+
+// Reflected returns whether the event is a state change already reflected by
+// the listing. Events of other kinds are never reflected.
+func (r *existingReconciler) reflected(event *ContextEvent) bool {
+	if event.Kind != KindStateChange || r.states == nil {
+		return false
+	}
+
+	sinceListed := event.Time.Sub(r.listedAt)
+	if sinceListed > r.window {
+		r.states = nil // Forget the listing
+		return false
+	}
+
+	key := newConnectionKey(event)
+	state, ok := r.states[key]
+	if !ok {
+		return false
+	}
+
+	if sinceListed <= 0 || event.NewState == state {
+		return true
+	}
+	delete(r.states, key)
+
+	return false
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func newMockTransition(at time.Time, socket *SocketID, newState tcpstate.State) *ContextEvent {
+	return &ContextEvent{
+		Event: &event.Event{
+			Time:       at,
+			SourceIP:   net.ParseIP("192.168.122.38"),
+			DestIP:     net.ParseIP("172.217.169.4"),
+			SourcePort: 44406,
+			DestPort:   80,
+			OldState:   tcpstate.StateSynSent,
+			NewState:   newState,
+		},
+		Socket: socket,
+	}
+}
+
+func TestDeduplicatorSuppressesDuplicateWithinWindow(t *testing.T) {
+	now := time.Now()
+	deduplicator := newDeduplicator(time.Second)
+
+	if deduplicator.duplicate(newMockTransition(now, nil, tcpstate.StateEstablished)) {
+		t.Error("expected first transition not to be a duplicate, but was")
+	}
+
+	// The IPv4 address of the other tracepoint may be of the 4-byte form
+	duplicate := newMockTransition(now.Add(time.Millisecond), nil, tcpstate.StateEstablished)
+	duplicate.SourceIP = duplicate.SourceIP.To4()
+	if !deduplicator.duplicate(duplicate) {
+		t.Error("expected repeated transition to be a duplicate, but was not")
+	}
+}
+
+func TestDeduplicatorDistinguishesTransitions(t *testing.T) {
+	now := time.Now()
+	deduplicator := newDeduplicator(time.Second)
+	deduplicator.duplicate(newMockTransition(now, &SocketID{Address: 0xffff8880a1b2c3d4}, tcpstate.StateEstablished))
+
+	for name, transition := range map[string]*ContextEvent{
+		"other state":        newMockTransition(now, &SocketID{Address: 0xffff8880a1b2c3d4}, tcpstate.StateClosed),
+		"other socket":       newMockTransition(now, &SocketID{Address: 0xffff8880a1b2c3e0}, tcpstate.StateEstablished),
+		"outside the window": newMockTransition(now.Add(2*time.Second), &SocketID{Address: 0xffff8880a1b2c3d4}, tcpstate.StateEstablished),
+	} {
+		if deduplicator.duplicate(transition) {
+			t.Errorf("expected transition with %s not to be a duplicate, but was", name)
+		}
+	}
+}
+
+func TestDeduplicatorIgnoresOtherKinds(t *testing.T) {
+	now := time.Now()
+	deduplicator := newDeduplicator(time.Second)
+
+	for i := 0; i < 2; i++ {
+		reset := newMockTransition(now, nil, tcpstate.StateEstablished)
+		reset.Kind = KindSendReset
+		if deduplicator.duplicate(reset) {
+			t.Error("expected reset not to be a duplicate, but was")
+		}
+	}
+}
+
+func TestDeduplicatorPrunes(t *testing.T) {
+	now := time.Now()
+	deduplicator := newDeduplicator(time.Second)
+	deduplicator.duplicate(newMockTransition(now, nil, tcpstate.StateEstablished))
+	deduplicator.duplicate(newMockTransition(now.Add(5*time.Second), nil, tcpstate.StateClosed))
+
+	if len(deduplicator.seen) != 1 {
+		t.Errorf("expected 1 transition to be remembered, got %d", len(deduplicator.seen))
+	}
+}
+
+func newMockExisting(at time.Time, state tcpstate.State) *ContextEvent {
+	existing := newMockTransition(at, nil, state)
+	existing.OldState = state
+	existing.Kind = KindExisting
+
+	return existing
+}
+
+func TestExistingReconcilerSuppressesTransitionsBeforeListing(t *testing.T) {
+	listedAt := time.Now()
+	reconciler := newExistingReconciler([]*ContextEvent{newMockExisting(listedAt, tcpstate.StateEstablished)}, time.Second)
+
+	if !reconciler.reflected(newMockTransition(listedAt.Add(-time.Millisecond), nil, tcpstate.StateSynSent)) {
+		t.Error("expected transition before listing to be reflected, but was not")
+	}
+}
+
+func TestExistingReconcilerSuppressesTransitionIntoListedStateWithinWindow(t *testing.T) {
+	listedAt := time.Now()
+	reconciler := newExistingReconciler([]*ContextEvent{newMockExisting(listedAt, tcpstate.StateEstablished)}, time.Second)
+
+	if !reconciler.reflected(newMockTransition(listedAt.Add(time.Millisecond), nil, tcpstate.StateEstablished)) {
+		t.Error("expected transition into listed state to be reflected, but was not")
+	}
+
+	// A later transition is trusted, as are those after it
+	closing := newMockTransition(listedAt.Add(2*time.Millisecond), nil, tcpstate.StateFinWait1)
+	closing.OldState = tcpstate.StateEstablished
+	if reconciler.reflected(closing) {
+		t.Error("expected transition from listed state not to be reflected, but was")
+	}
+
+	if reconciler.reflected(newMockTransition(listedAt.Add(3*time.Millisecond), nil, tcpstate.StateEstablished)) {
+		t.Error("expected transition after trusted transition not to be reflected, but was")
+	}
+}
+
+func TestExistingReconcilerTrustsTransitionsAfterWindow(t *testing.T) {
+	listedAt := time.Now()
+	reconciler := newExistingReconciler([]*ContextEvent{newMockExisting(listedAt, tcpstate.StateEstablished)}, time.Second)
+
+	if reconciler.reflected(newMockTransition(listedAt.Add(2*time.Second), nil, tcpstate.StateEstablished)) {
+		t.Error("expected transition after window not to be reflected, but was")
+	}
+}
+
+func TestExistingReconcilerIgnoresUnlistedConnections(t *testing.T) {
+	listedAt := time.Now()
+	reconciler := newExistingReconciler([]*ContextEvent{newMockExisting(listedAt, tcpstate.StateEstablished)}, time.Second)
+
+	unlisted := newMockTransition(listedAt.Add(-time.Millisecond), nil, tcpstate.StateEstablished)
+	unlisted.SourcePort = 44407
+	if reconciler.reflected(unlisted) {
+		t.Error("expected transition of unlisted connection not to be reflected, but was")
+	}
+}
+
+func TestNewExistingReconcilerNoConnections(t *testing.T) {
+	if reconciler := newExistingReconciler(nil, time.Second); reconciler != nil {
+		t.Errorf("expected nil reconciler, got %+v", reconciler)
+	}
+}
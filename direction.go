@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+const (
+	// LocalAddrsLifetime is the lifetime of the cache of the local addresses of
+	// the host, which bounds how long an address added or removed is missed.
+	localAddrsLifetime = 10 * time.Second
+
+	// DirectionMaxConnections is the most connections whose roles are
+	// remembered, beyond which they are forgotten.
+	directionMaxConnections = 65536
+)
+
+// The default ephemeral port range of Linux, used if that of the host cannot
+// be read.
+const (
+	defaultEphemeralPortFirst = 32768
+	defaultEphemeralPortLast  = 60999
+)
+
+// Direction is the direction of the connection of an event, relative to the
+// host.
+type Direction int
+
+const (
+	// DirectionUnknown is the direction of a connection which could not be
+	// classified.
+	DirectionUnknown Direction = iota
+
+	// DirectionInbound is the direction of a connection opened by a remote
+	// client to a local server, including a listening socket.
+	DirectionInbound
+
+	// DirectionOutbound is the direction of a connection opened by a local
+	// client.
+	DirectionOutbound
+
+	// DirectionForwarded is the direction of a connection of which neither end
+	// is local, such as those tracked by conntrack as the host routes them.
+	DirectionForwarded
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionInbound:
+		return "inbound"
+	case DirectionOutbound:
+		return "outbound"
+	case DirectionForwarded:
+		return "forwarded"
+	default:
+		return "unknown"
+	}
+}
+
+// Role is the role of the local socket of an event in its connection.
+type Role int
+
+const (
+	// RoleUnknown is the role of a socket which could not be classified.
+	RoleUnknown Role = iota
+
+	// RoleClient is the role of a socket which opened its connection.
+	RoleClient
+
+	// RoleServer is the role of a listening socket, or of a socket accepted by
+	// one.
+	RoleServer
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleClient:
+		return "client"
+	case RoleServer:
+		return "server"
+	default:
+		return "unknown"
+	}
+}
+
+// DirectionClassifier classifies the direction of the connection of each
+// event, and the role of its local socket. The source of a traced socket is
+// always local, and its role is that shown by its states, if any, such as
+// SYN-SENT for a client, or LISTEN and SYN-RECEIVED for a server, which is
+// remembered for its later events. Otherwise, a socket of a local port seen
+// listening is a server, and failing that, one of an ephemeral local port to a
+// remote port which is not is a client, and vice versa. The source of a flow
+// tracked by conntrack is instead its originator, so its role is that of
+// whichever end is a local address of the host, if any. It is only accessed by
+// the reader of events, so is not safe for concurrent use.
+type directionClassifier struct {
+	originatorIsSource bool
+	interfaceAddrs     func() ([]net.Addr, error)
+
+	localAddrs        map[string]bool // As for connectionKey
+	localAddrsExpired time.Time
+
+	ephemeralFirst, ephemeralLast uint16
+	listeningPorts                map[uint16]bool
+	roles                         map[connectionKey]Role
+}
+
+// NewDirectionClassifier returns a classifier of the events of traced sockets,
+// or, if the originator is the source, of flows, of the host of the proc
+// filesystem, whose local addresses are listed by interfaceAddrs (usually
+// net.InterfaceAddrs).
+func newDirectionClassifier(procPath string,
+	originatorIsSource bool,
+	interfaceAddrs func() ([]net.Addr, error)) *directionClassifier {
+	classifier := &directionClassifier{
+		originatorIsSource: originatorIsSource,
+		interfaceAddrs:     interfaceAddrs,
+		ephemeralFirst:     defaultEphemeralPortFirst,
+		ephemeralLast:      defaultEphemeralPortLast,
+		listeningPorts:     make(map[uint16]bool),
+		roles:              make(map[connectionKey]Role),
+	}
+
+	if contents, err := ioutil.ReadFile(procPath + "/sys/net/ipv4/ip_local_port_range"); err == nil {
+		var first, last uint16
+		if _, err := fmt.Sscan(strings.TrimSpace(string(contents)), &first, &last); err == nil && first <= last {
+			classifier.ephemeralFirst, classifier.ephemeralLast = first, last
+		}
+	}
+
+	return classifier
+}
+
+// Classify sets the direction and role of the event. Markers of lost events
+// have neither.
+func (c *directionClassifier) classify(event *ContextEvent) {
+	if event.Kind == KindLostEvents {
+		return
+	}
+
+	if c.originatorIsSource {
+		switch {
+		case c.local(event.SourceIP):
+			event.Direction, event.Role = DirectionOutbound, RoleClient
+		case c.local(event.DestIP):
+			event.Direction, event.Role = DirectionInbound, RoleServer
+		default:
+			event.Direction = DirectionForwarded
+		}
+
+		return
+	}
+
+	event.Role = c.role(event)
+	switch event.Role {
+	case RoleClient:
+		event.Direction = DirectionOutbound
+	case RoleServer:
+		event.Direction = DirectionInbound
+	}
+}
+
+// Role returns the role of the local socket of the event, remembering it until
+// the socket closes.
+func (c *directionClassifier) role(event *ContextEvent) Role {
+	key := newConnectionKey(event)
+	role, known := c.roles[key]
+
+	switch {
+	case event.OldState == tcpstate.StateListen || event.NewState == tcpstate.StateListen:
+		role, known = RoleServer, true
+		if event.NewState == tcpstate.StateListen {
+			c.listeningPorts[event.SourcePort] = true
+		} else if event.NewState == tcpstate.StateClosed {
+			delete(c.listeningPorts, event.SourcePort)
+		}
+	case event.OldState == tcpstate.StateSynSent || event.NewState == tcpstate.StateSynSent:
+		role, known = RoleClient, true
+	case event.OldState == tcpstate.StateSynReceived || event.NewState == tcpstate.StateSynReceived:
+		role, known = RoleServer, true
+	case !known:
+		return c.guessRole(event)
+	}
+
+	if event.NewState == tcpstate.StateClosed {
+		delete(c.roles, key)
+		return role
+	}
+
+	if len(c.roles) >= directionMaxConnections {
+		c.roles = make(map[connectionKey]Role, len(c.roles))
+	}
+	c.roles[key] = role
+
+	return role
+}
+
+// GuessRole returns the role of the local socket of an event whose states do
+// not show it, from its ports.
+func (c *directionClassifier) guessRole(event *ContextEvent) Role {
+	if c.listeningPorts[event.SourcePort] {
+		return RoleServer
+	}
+
+	localEphemeral := c.ephemeral(event.SourcePort)
+	remoteEphemeral := c.ephemeral(event.DestPort)
+	switch {
+	case localEphemeral && !remoteEphemeral:
+		return RoleClient
+	case remoteEphemeral && !localEphemeral:
+		return RoleServer
+	default:
+		return RoleUnknown
+	}
+}
+
+func (c *directionClassifier) ephemeral(port uint16) bool {
+	return port >= c.ephemeralFirst && port <= c.ephemeralLast
+}
+
+// Local returns whether the address is a local address of the host.
+func (c *directionClassifier) local(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	if ip.IsLoopback() {
+		return true
+	}
+
+	if now := time.Now(); now.After(c.localAddrsExpired) {
+		c.localAddrsExpired = now.Add(localAddrsLifetime)
+
+		// The previous addresses are kept if they cannot be listed
+		if addrs, err := c.interfaceAddrs(); err == nil {
+			c.localAddrs = make(map[string]bool, len(addrs))
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok {
+					c.localAddrs[string(ipNet.IP.To16())] = true
+				}
+			}
+		}
+	}
+
+	return c.localAddrs[string(ip.To16())]
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func mockInterfaceAddrs() ([]net.Addr, error) {
+	return []net.Addr{
+		&net.IPNet{IP: net.ParseIP("192.168.122.38"), Mask: net.CIDRMask(24, 32)},
+	}, nil
+}
+
+func newMockDirectionEvent(sourcePort, destPort uint16, oldState, newState tcpstate.State) *ContextEvent {
+	event := newMockTransition(time.Now(), nil, newState)
+	event.SourcePort, event.DestPort, event.OldState = sourcePort, destPort, oldState
+
+	return event
+}
+
+func TestDirectionClassifierClassifyByStates(t *testing.T) {
+	classifier := newDirectionClassifier("/non/existent", false, mockInterfaceAddrs)
+
+	tests := []struct {
+		name              string
+		event             *ContextEvent
+		expectedDirection Direction
+		expectedRole      Role
+	}{
+		{
+			"connect",
+			newMockDirectionEvent(80, 80, tcpstate.StateClosed, tcpstate.StateSynSent),
+			DirectionOutbound,
+			RoleClient,
+		},
+		{
+			"listen",
+			newMockDirectionEvent(8080, 0, tcpstate.StateClosed, tcpstate.StateListen),
+			DirectionInbound,
+			RoleServer,
+		},
+		{
+			"accept",
+			newMockDirectionEvent(443, 443, tcpstate.StateSynReceived, tcpstate.StateEstablished),
+			DirectionInbound,
+			RoleServer,
+		},
+		{
+			"remembered client",
+			newMockDirectionEvent(80, 80, tcpstate.StateEstablished, tcpstate.StateFinWait1),
+			DirectionOutbound,
+			RoleClient,
+		},
+		{
+			"listening port",
+			newMockDirectionEvent(8080, 8080, tcpstate.StateEstablished, tcpstate.StateCloseWait),
+			DirectionInbound,
+			RoleServer,
+		},
+		{
+			"ephemeral local port",
+			newMockDirectionEvent(44406, 22, tcpstate.StateEstablished, tcpstate.StateFinWait1),
+			DirectionOutbound,
+			RoleClient,
+		},
+		{
+			"ephemeral remote port",
+			newMockDirectionEvent(22, 44406, tcpstate.StateEstablished, tcpstate.StateCloseWait),
+			DirectionInbound,
+			RoleServer,
+		},
+		{
+			"no evidence",
+			newMockDirectionEvent(22, 22, tcpstate.StateEstablished, tcpstate.StateCloseWait),
+			DirectionUnknown,
+			RoleUnknown,
+		},
+	}
+
+	for _, test := range tests {
+		classifier.classify(test.event)
+
+		if test.event.Direction != test.expectedDirection || test.event.Role != test.expectedRole {
+			t.Errorf("%s: expected %v %v, got %v %v",
+				test.name,
+				test.expectedDirection,
+				test.expectedRole,
+				test.event.Direction,
+				test.event.Role)
+		}
+	}
+}
+
+func TestDirectionClassifierForgetsClosed(t *testing.T) {
+	classifier := newDirectionClassifier("/non/existent", false, mockInterfaceAddrs)
+
+	classifier.classify(newMockDirectionEvent(22, 22, tcpstate.StateSynSent, tcpstate.StateEstablished))
+	classifier.classify(newMockDirectionEvent(22, 22, tcpstate.StateLastAck, tcpstate.StateClosed))
+
+	event := newMockDirectionEvent(22, 22, tcpstate.StateEstablished, tcpstate.StateCloseWait)
+	classifier.classify(event)
+	if event.Role != RoleUnknown {
+		t.Errorf("expected unknown role, got %v", event.Role)
+	}
+}
+
+func TestDirectionClassifierEphemeralPortRange(t *testing.T) {
+	procPath, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(procPath)
+
+	if err := os.MkdirAll(procPath+"/sys/net/ipv4", 0755); err != nil {
+		t.Fatalf("creating mock proc directory: %v", err)
+	}
+	if err := ioutil.WriteFile(procPath+"/sys/net/ipv4/ip_local_port_range", []byte("1024\t2047\n"), 0644); err != nil {
+		t.Fatalf("writing mock port range: %v", err)
+	}
+
+	classifier := newDirectionClassifier(procPath, false, mockInterfaceAddrs)
+	event := newMockDirectionEvent(1500, 44406, tcpstate.StateEstablished, tcpstate.StateFinWait1)
+	classifier.classify(event)
+	if event.Role != RoleClient {
+		t.Errorf("expected client role, got %v", event.Role)
+	}
+}
+
+func TestDirectionClassifierClassifyOriginator(t *testing.T) {
+	classifier := newDirectionClassifier("/non/existent", true, mockInterfaceAddrs)
+
+	tests := []struct {
+		sourceIP, destIP  string
+		expectedDirection Direction
+		expectedRole      Role
+	}{
+		{"192.168.122.38", "172.217.169.4", DirectionOutbound, RoleClient},
+		{"172.217.169.4", "192.168.122.38", DirectionInbound, RoleServer},
+		{"127.0.0.1", "127.0.0.1", DirectionOutbound, RoleClient},
+		{"10.0.0.1", "172.217.169.4", DirectionForwarded, RoleUnknown},
+	}
+
+	for _, test := range tests {
+		event := newMockTransition(time.Now(), nil, tcpstate.StateEstablished)
+		event.SourceIP, event.DestIP = net.ParseIP(test.sourceIP), net.ParseIP(test.destIP)
+		classifier.classify(event)
+
+		if event.Direction != test.expectedDirection || event.Role != test.expectedRole {
+			t.Errorf("%s to %s: expected %v %v, got %v %v",
+				test.sourceIP,
+				test.destIP,
+				test.expectedDirection,
+				test.expectedRole,
+				event.Direction,
+				event.Role)
+		}
+	}
+}
+
+func TestDirectionClassifierInterfaceAddrsError(t *testing.T) {
+	classifier := newDirectionClassifier("/non/existent", true, func() ([]net.Addr, error) {
+		return nil, errors.New("mock interface addresses error")
+	})
+
+	event := newMockTransition(time.Now(), nil, tcpstate.StateEstablished)
+	classifier.classify(event)
+	if event.Direction != DirectionForwarded {
+		t.Errorf("expected forwarded direction, got %v", event.Direction)
+	}
+}
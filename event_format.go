@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TagPattern matches a tagged field in a print fmt, e.g. `sport=%hu`.
+var tagPattern = regexp.MustCompile(`(\w+)=(%[^ ]+)`)
+
+// FieldPattern matches the declaration of a field stored in the ring buffer,
+// e.g. `field:__u8 saddr[4];	offset:32;	size:4;	signed:0;`.
+var fieldPattern = regexp.MustCompile(`^\s*field:(.+?);\s*offset:(\d+);\s*size:(\d+);(?:\s*signed:(\d);)?`)
+
+// EventFormat describes the events of a tracepoint, as declared by its format
+// file in tracefs.
+type eventFormat struct {
+	name string            // The event name, as it appears in the trace
+	tags map[string]string // The printf conversion of each tagged field printed, e.g. "sport" to "%hu"
+
+	// Fields are the fields of the raw records of the events, by name, and
+	// printFmt is the print fmt by which the kernel renders them as text.
+	fields   map[string]*formatField
+	printFmt string
+}
+
+// FormatField is a field of the raw records of the events of a tracepoint.
+type formatField struct {
+	offset, size int
+	signed       bool
+	dataLoc      bool // Whether the field locates dynamic data, such as a string, within the record
+}
+
+// ParseEventFormat parses the contents of an events/<tracepoint>/format file.
+// The tagged fields printed are taken from the print fmt, as they are not
+// always named as the fields stored in the ring buffer.
+func parseEventFormat(reader io.Reader) (*eventFormat, error) {
+	format := &eventFormat{
+		tags:   make(map[string]string, 16),
+		fields: make(map[string]*formatField, 16),
+	}
+
+	scanner := bufio.NewScanner(reader)
+	printFmtFound := false
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "name: ") {
+			format.name = strings.TrimSpace(strings.TrimPrefix(line, "name: "))
+			continue
+		}
+
+		if match := fieldPattern.FindStringSubmatch(line); match != nil {
+			name, field := parseFormatField(match)
+			format.fields[name] = field
+			continue
+		}
+
+		if strings.HasPrefix(line, "print fmt: ") {
+			format.printFmt = strings.TrimPrefix(line, "print fmt: ")
+			printFmt, err := unquotePrintFmt(format.printFmt)
+			if err != nil {
+				return nil, fmt.Errorf("parsing print fmt: %w", err)
+			}
+
+			for _, match := range tagPattern.FindAllStringSubmatch(printFmt, -1) {
+				format.tags[match[1]] = match[2]
+			}
+			printFmtFound = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanning event format: %w", err)
+	}
+
+	if format.name == "" {
+		return nil, errors.New("event name not present in format")
+	}
+
+	if !printFmtFound {
+		return nil, errors.New("print fmt not present in format")
+	}
+
+	return format, nil
+}
+
+// ParseFormatField returns the name and layout of the field matched by the
+// fieldPattern. The name is the last word of its declaration, less any array
+// dimension, e.g. `saddr` of `__u8 saddr[4]`.
+func parseFormatField(match []string) (string, *formatField) {
+	declaration := strings.TrimSpace(match[1])
+	if idx := strings.IndexByte(declaration, '['); idx != -1 && strings.HasSuffix(declaration, "]") &&
+		idx > strings.LastIndexAny(declaration, " *") {
+		declaration = declaration[:idx]
+	}
+	name := declaration[strings.LastIndexAny(declaration, " *")+1:]
+
+	// The patterns match only digits, so these cannot fail
+	offset, _ := strconv.Atoi(match[2])
+	size, _ := strconv.Atoi(match[3])
+
+	return name, &formatField{
+		offset:  offset,
+		size:    size,
+		signed:  match[4] == "1",
+		dataLoc: strings.HasPrefix(declaration, "__data_loc "),
+	}
+}
+
+// UnquotePrintFmt returns the quoted format string at the start of a print fmt,
+// which is followed by the arguments to be formatted.
+func unquotePrintFmt(printFmt string) (string, error) {
+	if !strings.HasPrefix(printFmt, `"`) {
+		return "", errors.New("format string not quoted")
+	}
+
+	for i := 1; i < len(printFmt); i++ {
+		switch printFmt[i] {
+		case '\\':
+			i++ // Skip the escaped character
+		case '"':
+			return printFmt[1:i], nil
+		}
+	}
+
+	return "", errors.New("format string not terminated")
+}
+
+// IsIntegerConversion returns whether the printf conversion formats an integer
+// in decimal, e.g. "%u", "%hu" or "%lld".
+func isIntegerConversion(conversion string) bool {
+	if !strings.HasPrefix(conversion, "%") || len(conversion) < 2 {
+		return false
+	}
+
+	verb := conversion[len(conversion)-1]
+	modifiers := strings.Trim(conversion[1:len(conversion)-1], "hlz")
+
+	return (verb == 'u' || verb == 'd' || verb == 'i') && modifiers == ""
+}
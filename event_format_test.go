@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEventFormat(t *testing.T) {
+	format, err := parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if format.name != "inet_sock_set_state" {
+		t.Errorf("expected name %q, got %q", "inet_sock_set_state", format.name)
+	}
+
+	expectedTags := map[string]string{
+		"family":   "%s",
+		"protocol": "%s",
+		"sport":    "%hu",
+		"dport":    "%hu",
+		"saddr":    "%pI4",
+		"daddr":    "%pI4",
+		"saddrv6":  "%pI6c",
+		"daddrv6":  "%pI6c",
+		"oldstate": "%s",
+		"newstate": "%s",
+	}
+	if len(format.tags) != len(expectedTags) {
+		t.Errorf("expected tags %v, got %v", expectedTags, format.tags)
+	}
+
+	for tag, conversion := range expectedTags {
+		if format.tags[tag] != conversion {
+			t.Errorf("expected tag %s conversion %q, got %q", tag, conversion, format.tags[tag])
+		}
+	}
+}
+
+func TestParseEventFormatKprobe(t *testing.T) {
+	mockFormat := "name: tcp_audit_set_state\nID: 2001\nformat:\n" +
+		"\tfield:unsigned long __probe_ip;\toffset:8;\tsize:8;\tsigned:0;\n\n" +
+		`print fmt: "(%lx) family=%u sport=%u newstate=%d", REC->__probe_ip, REC->family, REC->sport, REC->newstate` + "\n"
+
+	format, err := parseEventFormat(strings.NewReader(mockFormat))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(format.tags) != 3 || format.tags["family"] != "%u" || format.tags["newstate"] != "%d" {
+		t.Errorf("expected tags family, sport and newstate, got %v", format.tags)
+	}
+}
+
+func TestParseEventFormatNoPrintFmtError(t *testing.T) {
+	_, err := parseEventFormat(strings.NewReader("name: inet_sock_set_state\nID: 1385\n"))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestParseEventFormatUnterminatedPrintFmtError(t *testing.T) {
+	_, err := parseEventFormat(strings.NewReader("name: inet_sock_set_state\nprint fmt: \"family=%s\n"))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestIsIntegerConversion(t *testing.T) {
+	for conversion, expected := range map[string]bool{
+		"%u":   true,
+		"%hu":  true,
+		"%lld": true,
+		"%s":   false,
+		"%pI4": false,
+		"%lx":  false,
+		"u":    false,
+	} {
+		if isIntegerConversion(conversion) != expected {
+			t.Errorf("expected integer conversion of %q to be %t, but was not", conversion, expected)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+// EventKind is the kind of an event, according to the tracepoint which
+// emitted it.
+type EventKind int
+
+const (
+	// KindStateChange is a TCP state change. Only events of this kind are
+	// returned by Event, as they are all that event.Event can describe.
+	KindStateChange EventKind = iota
+
+	// KindSendReset is a RST sent by the host from the source of the event to
+	// its destination, forcibly terminating the connection. The old and new
+	// states are both the state of the socket, if known.
+	KindSendReset
+
+	// KindReceiveReset is a RST received by the host from the destination of
+	// the event, forcibly terminating the connection. The old and new states
+	// are both the state of the socket, if known.
+	KindReceiveReset
+
+	// KindDestroySock is the destruction of the socket by the kernel, which
+	// definitively ends its lifecycle, even if its final state change was
+	// lost. The old and new states are empty.
+	KindDestroySock
+
+	// KindLostEvents is a gap in the stream of events, as the kernel reported
+	// that events were lost on the CPU of the event context, so that the record
+	// documents its own blind spots. It is returned only if lost events are
+	// reported, and by Event as a *LostEventsError. Its time is that at which
+	// the loss was read, and the number lost is carried in LostEvents.
+	KindLostEvents
+
+	// KindRetransmit is the retransmission of a segment by the host from the
+	// source of the event to its destination. The old and new states are both
+	// the state of the socket.
+	KindRetransmit
+
+	// KindExisting is a connection which existed when the eventer attached, as
+	// listed by /proc/net/tcp and /proc/net/tcp6, returned before any traced
+	// events if existing connections are configured. The old and new states
+	// are both the state of the socket when listed, and the time is that at
+	// which it was listed. The command and PID are those of the task owning
+	// the socket, if found. Event() returns it as a state change from CLOSED
+	// to the state of the socket.
+	KindExisting
+
+	// KindFlowClosed is the summary of a flow which has ended, returned after
+	// its last event if flows are summarised. The 4-tuple, task and states are
+	// those of the last event of the flow, the time is that at which it ended,
+	// and the flow, with its start, end and duration, is carried in Flow.
+	KindFlowClosed
+
+	// KindSummary is the summary of the connections between a host address and
+	// a peer address on a port over an interval, returned in place of their
+	// events if events are summarised. The source and destination are the
+	// host and peer, of which only the port of the service is set, the time is
+	// the end of the interval, and the counts are carried in Summary.
+	KindSummary
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case KindStateChange:
+		return "state-change"
+	case KindSendReset:
+		return "send-reset"
+	case KindReceiveReset:
+		return "receive-reset"
+	case KindDestroySock:
+		return "destroy-sock"
+	case KindLostEvents:
+		return "lost-events"
+	case KindRetransmit:
+		return "retransmit"
+	case KindExisting:
+		return "existing"
+	case KindFlowClosed:
+		return "flow-closed"
+	case KindSummary:
+		return "summary"
+	default:
+		return "unknown"
+	}
+}
+
+// ResetTracepoints are the tracepoints of RSTs sent and received by the host,
+// enabled alongside that of state changes if configured.
+var resetTracepoints = []*tracepointCandidate{
+	{
+		tracepoint: "tcp/tcp_send_reset",
+		profile:    &eventProfile{kind: KindSendReset},
+	},
+	{
+		tracepoint: "tcp/tcp_receive_reset",
+		profile:    &eventProfile{kind: KindReceiveReset},
+	},
+}
+
+// DestroySockTracepoint is the tracepoint of the destruction of sockets,
+// enabled alongside that of state changes if configured.
+var destroySockTracepoint = &tracepointCandidate{
+	tracepoint: "tcp/tcp_destroy_sock",
+	profile:    &eventProfile{kind: KindDestroySock},
+}
+
+// RetransmitTracepoint is the tracepoint of segments retransmitted by the host,
+// enabled alongside that of state changes if configured.
+var retransmitTracepoint = &tracepointCandidate{
+	tracepoint: "tcp/tcp_retransmit_skb",
+	profile:    &eventProfile{kind: KindRetransmit},
+}
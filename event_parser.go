@@ -5,9 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
-	"strconv"
-	"strings"
+	"path"
+	"sync"
 	"time"
 
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
@@ -15,195 +16,802 @@ import (
 )
 
 const (
-	familyInet  = "AF_INET"
-	protocolTCP = "IPPROTO_TCP"
+	familyInet    = "AF_INET"
+	protocolTCP   = "IPPROTO_TCP"
+	protocolMPTCP = "IPPROTO_MPTCP"
 )
 
+// LinePadding are the characters which may trail a line relayed through a PTY,
+// or of a capture file originating on Windows, which are not part of its last
+// tagged value.
+const linePadding = " \t\r"
+
+// IdlePID is the PID of the idle task of each CPU, shown as `<idle>-0`, in the
+// context of which events in interrupt context on an idle CPU are emitted.
+const idlePID = 0
+
+// MaxInternedCommands is the number of commands interned by each parse context,
+// beyond which they are dropped, so that the commands of short-lived tasks
+// cannot grow it without bound.
+const maxInternedCommands = 1024
+
 // ErrIrrelevantEvent is an error returned if the event read from
-// the provided byte stream is not a TCPv4 event.
-var errIrrelevantEvent error = errors.New("irrelevant event")
+// the provided byte stream is not a TCPv4 event. It is wrapped by errors
+// describing why, so that skipped events can be counted by reason.
+var ErrIrrelevantEvent error = errors.New("irrelevant event")
+
+var (
+	errNonInetEvent = fmt.Errorf("%w: not of the INET family", ErrIrrelevantEvent)
+	errNonTCPEvent  = fmt.Errorf("%w: not of the TCP protocol", ErrIrrelevantEvent)
+
+	errUnknownTracepointEvent = fmt.Errorf("%w: of an unknown tracepoint", ErrIrrelevantEvent)
+)
 
 // EventParser is an interface which describes objects which convert a byte
 // slice/"stream" containing a TCP state-change event into an event object.
 type eventParser interface {
-	toEvent(str []byte) (*event.Event, error)
+	toEvent(str []byte) (*ContextEvent, error)
+	configure(format *eventFormat) error
+	useClock(clock *traceClock)
+}
+
+// EventProfile describes how the events of a particular tracepoint differ from
+// the format of the sock/inet_sock_set_state tracepoint, which the parser
+// otherwise expects.
+type eventProfile struct {
+	// Kind is the kind of the events of the tracepoint.
+	kind EventKind
+
+	// Location is whether the tagged fields are preceded by the probed location,
+	// as for kprobe events, e.g. "(tcp_set_state+0x0/0x240)".
+	location bool
+
+	// NormaliseTags converts the tagged fields, in place, to the form of those
+	// of the sock/inet_sock_set_state tracepoint. It may be nil.
+	normaliseTags func(tags *taggedFields) error
+
+	// Layout is the order in which the tracepoint prints its tagged fields, by
+	// which they are extracted by position, rather than through a map, if it
+	// matches. It may be nil.
+	layout []string
 }
 
 // TraceFSEventParser is a parser of tracefs TCP state-change events.
 type traceFSEventParser struct {
 	fieldParser fieldParser
+	profiles    map[string]*eventProfile // By event name, as it appears in the trace
+
+	// DeclaredTags are the tags declared by the format of the tracepoint in use,
+	// the events of which are named eventName. If nil, the parser has not been
+	// configured, and makes no assumptions.
+	declaredTags map[string]string
+	eventName    string
+
+	// Clock converts the trace timestamps of events to their time. If nil, the
+	// time at which events are parsed is used.
+	clock *traceClock
+
+	// ParseContexts holds the scratch state of parsing events for reuse, so
+	// that steady-state parsing allocates only the events themselves. The pool
+	// is safe for use by the concurrent per-CPU readers.
+	parseContexts *sync.Pool
+
+	// BestEffort causes events missing non-critical fields to be returned,
+	// annotated with the missing fields, rather than failed.
+	bestEffort bool
+
+	// LenientNumbers causes PIDs and ports printed in hexadecimal, prefixed by
+	// `0x`, to be accepted, rather than failed.
+	lenientNumbers bool
+
+	// MPTCP causes the state changes of MPTCP sockets to be returned, marked
+	// as such, rather than skipped as not of the TCP protocol.
+	mptcp bool
+
+	// Partial causes events of damaged lines from which either the states or the
+	// 4-tuple can be recovered to be returned, annotated with the fields which
+	// could not be, rather than failed.
+	partial bool
+
+	// Pooled causes events to be allocated from the pool of events, to which
+	// they are returned once released.
+	pooled bool
 }
 
-func newTraceFSEventParser(fieldParser fieldParser) *traceFSEventParser {
-	return &traceFSEventParser{fieldParser}
+func newTraceFSEventParser(fieldParser fieldParser,
+	candidates []*tracepointCandidate) *traceFSEventParser {
+	profiles := make(map[string]*eventProfile, len(candidates))
+	for _, candidate := range candidates {
+		profiles[path.Base(candidate.tracepoint)] = candidate.profile
+	}
+
+	return &traceFSEventParser{
+		fieldParser: fieldParser,
+		profiles:    profiles,
+		parseContexts: &sync.Pool{
+			New: func() interface{} {
+				return &parseContext{tags: make(taggedFields, 0, 20)}
+			},
+		},
+	}
 }
 
-// ToEvent creates a TCP state-change event object from the supplied byte
-// slice/"stream"
-func (ep *traceFSEventParser) toEvent(str []byte) (*event.Event, error) {
-	time := time.Now().UTC()
+// ParseContext is the scratch state of parsing an event, which is discarded
+// once the event is parsed, so is reused.
+type parseContext struct {
+	// Str is the remainder of the line yet to be parsed. As it is advanced by
+	// the field parser through a pointer, it would otherwise escape.
+	str []byte
+
+	// Tags are the tagged fields of the event. Their tags and values are slices
+	// of the line, so must be copied if they are to be retained.
+	tags taggedFields
+
+	// Commands are those of the events parsed, by themselves, so that the
+	// command of each event is not allocated once seen.
+	commands map[string]string
+}
+
+// Intern returns the command as a string, that of an earlier event of the
+// same command, if any. Once maxInternedCommands are held, they are dropped.
+func (pc *parseContext) intern(command []byte) string {
+	if interned, ok := pc.commands[string(command)]; ok {
+		return interned
+	}
+
+	if pc.commands == nil || len(pc.commands) >= maxInternedCommands {
+		pc.commands = make(map[string]string)
+	}
+	interned := string(command)
+	pc.commands[interned] = interned
+
+	return interned
+}
+
+// ReleaseParseContext clears the scratch state of a parsed event and returns
+// it to the pool, so it must no longer be referenced.
+func (ep *traceFSEventParser) releaseParseContext(pc *parseContext) {
+	pc.str = nil
+	for i := range pc.tags {
+		pc.tags[i] = taggedField{} // The line is not retained by the pool
+	}
+	pc.tags = pc.tags[:0]
+	ep.parseContexts.Put(pc)
+}
+
+// RequiredTags are the tagged fields which the parser requires, and whether
+// their printf conversion must be an integer, or else the conversion it must be.
+var requiredTags = map[string]string{
+	"sport":    "", // Any integer
+	"dport":    "",
+	"saddr":    "%pI4",
+	"daddr":    "%pI4",
+	"oldstate": "%s",
+	"newstate": "%s",
+}
+
+// AlternativeTags are the tags from which a required tag can be derived if the
+// tracepoint does not declare it, and the conversion they must have. Some
+// tracepoint variants carry only the v4-mapped IPv6 addresses of IPv4
+// connections.
+var alternativeTags = map[string]struct{ tag, conversion string }{
+	"saddr": {"saddrv6", "%pI6c"},
+	"daddr": {"daddrv6", "%pI6c"},
+}
+
+// V4MappedPrefixBytes prefixes the v4-mapped IPv6 address of an IPv4
+// connection, as printed by the %pI6c conversion.
+var v4MappedPrefixBytes = []byte("::ffff:")
+
+// CriticalTags are the required tags without which a state change event is
+// meaningless, so are required even when parsing best-effort.
+var criticalTags = map[string]bool{
+	"oldstate": true,
+	"newstate": true,
+}
+
+// Configure adapts the parser to the tagged fields declared by the format of
+// the tracepoint in use, so that an incompatible tracepoint is detected before
+// any events are read, and fields such as family which some tracepoints lack
+// are required only when declared. When parsing best-effort, only the critical
+// tags must be declared. The tags of events whose profile normalises
+// them are checked only for presence, as their conversions are expected to differ.
+func (ep *traceFSEventParser) configure(format *eventFormat) error {
+	// If the format is not known, as of a replayed capture or relayed stream,
+	// no assumptions are made about the tagged fields of the events
+	if format == nil {
+		return nil
+	}
+
+	profile, ok := ep.profiles[format.name]
+	if !ok {
+		profile = new(eventProfile)
+	}
+
+	for tag, requiredConversion := range requiredTags {
+		conversion, ok := format.tags[tag]
+		if !ok {
+			if alternative, ok := alternativeTags[tag]; ok &&
+				format.tags[alternative.tag] == alternative.conversion {
+				continue
+			}
+
+			if ep.bestEffort && !criticalTags[tag] {
+				continue
+			}
+
+			return fmt.Errorf("event %s does not declare required field %s", format.name, tag)
+		}
+
+		if profile.normaliseTags != nil {
+			continue
+		}
+
+		if requiredConversion == "" && !isIntegerConversion(conversion) ||
+			requiredConversion != "" && conversion != requiredConversion {
+			return fmt.Errorf("event %s declares field %s with unsupported format %s",
+				format.name,
+				tag,
+				conversion)
+		}
+	}
+
+	ep.declaredTags = format.tags
+	ep.eventName = format.name
+	return nil
+}
+
+// UseClock sets the clock used to convert the trace timestamps of events to
+// their time. If nil, the time at which events are parsed is used instead,
+// which lags the event time under backlog.
+func (ep *traceFSEventParser) useClock(clock *traceClock) {
+	ep.clock = clock
+}
+
+// Declares returns whether the tag is declared by the format of the tracepoint
+// in use, which is only known for events of that tracepoint.
+func (ep *traceFSEventParser) declares(eventName []byte, tag string) bool {
+	if string(eventName) != ep.eventName {
+		return false
+	}
+
+	_, ok := ep.declaredTags[tag]
+	return ok
+}
+
+// Profile returns the profile with which to decode the events of the named
+// tracepoint. The tracepoint in use is decoded as a state change if it has no
+// profile, for example if it is a custom tracepoint, but the events of other
+// unknown tracepoints are irrelevant, as their kind is not known.
+func (ep *traceFSEventParser) profile(eventName []byte) (*eventProfile, error) {
+	if profile, ok := ep.profiles[string(eventName)]; ok {
+		return profile, nil
+	}
+
+	if string(eventName) == ep.eventName {
+		return new(eventProfile), nil
+	}
 
-	command, err := parseCommand(&str)
+	return nil, errUnknownTracepointEvent
+}
+
+// ToEvent creates a TCP state-change event object from the supplied byte
+// slice/"stream", along with its context and socket identity. If the line
+// cannot be parsed, a *ParseError is returned.
+func (ep *traceFSEventParser) toEvent(line []byte) (*ContextEvent, error) {
+	pc := ep.parseContexts.Get().(*parseContext)
+	defer ep.releaseParseContext(pc)
+	pc.str = line
+
+	time, err := ep.eventTime(line)
 	if err != nil {
-		return nil, fmt.Errorf("parsing command from event: %w", err)
+		return nil, newParseError(line, "timestamp", err)
 	}
 
-	pidStr, err := ep.fieldParser.nextField(&str, spaceBytes, true)
+	commandBytes, err := parseCommandBytes(&pc.str)
 	if err != nil {
-		return nil, fmt.Errorf("parsing PID from event: %w", err)
+		return nil, newParseError(line, "command", fmt.Errorf("parsing command from event: %w", err))
 	}
-	pid, err := strconv.ParseInt(pidStr, 10, 64)
+	command := pc.intern(commandBytes)
+
+	// Fields are skipped, then sliced from the line, so are not allocated
+	pidField := pc.str
+	if err := ep.fieldParser.skipField(&pc.str, spaceBytes); err != nil {
+		return nil, newParseError(line, "pid", fmt.Errorf("parsing PID from event: %w", err))
+	}
+	pid, err := parsePID(skippedField(pidField, pc.str, spaceBytes), ep.lenientNumbers)
 	if err != nil {
-		return nil, fmt.Errorf("converting PID to integer: %w", err)
+		return nil, newParseError(line, "pid", err)
 	}
 
-	if _, err := ep.fieldParser.nextField(&str, colonSpaceBytes, true); err != nil {
-		return nil, fmt.Errorf("skipping metadata from event: %w", err)
+	// The number of metadata columns varies with the trace options, so skip to
+	// the end of the timestamp column, which precedes the tracepoint name
+	if err := skipMetadata(&pc.str); err != nil {
+		return nil, newParseError(line, "metadata", fmt.Errorf("skipping metadata from event: %w", err))
 	}
 
-	if _, err := ep.fieldParser.nextField(&str, colonSpaceBytes, true); err != nil {
-		return nil, fmt.Errorf("skipping tracepoint from event: %w", err)
+	eventName := pc.str
+	if err := ep.fieldParser.skipField(&pc.str, colonSpaceBytes); err != nil {
+		return nil, newParseError(line, "tracepoint", fmt.Errorf("parsing tracepoint from event: %w", err))
 	}
+	eventName = tracepointName(skippedField(eventName, pc.str, colonSpaceBytes))
 
-	// Begin tagged data
-	tags, err := ep.fieldParser.getTaggedFields(&str)
+	profile, err := ep.profile(eventName)
 	if err != nil {
-		return nil, fmt.Errorf("parsing tagged fields: %w", err)
+		return nil, err
+	}
+
+	if profile.location {
+		if err := ep.fieldParser.skipField(&pc.str, spaceBytes); err != nil {
+			return nil, newParseError(line, "location", fmt.Errorf("skipping probed location from event: %w", err))
+		}
+	}
+
+	// Begin tagged data, any trailing padding of which would be taken as part
+	// of the last tagged value
+	pc.str = trimLinePadding(pc.str)
+
+	// The fields are extracted by position if the tracepoint prints them in its
+	// known layout, which avoids building the map of tagged fields, and their
+	// addresses stored in the event, if pooled
+	contextEvent := ep.newContextEvent(line)
+	fields, ok := decodeLayoutFields(pc.str, profile.layout, pooledEventAddresses(contextEvent))
+	if !ok {
+		if fields, err = ep.decodeTaggedFields(pc, line, eventName, profile); err != nil {
+			releaseContextEvent(contextEvent)
+			return nil, err
+		}
+	}
+
+	*contextEvent.Event = event.Event{
+		Time:         time,
+		CommandOnCPU: command,
+		PIDOnCPU:     int(pid),
+		SourceIP:     fields.sourceIP,
+		DestIP:       fields.destIP,
+		SourcePort:   fields.sourcePort,
+		DestPort:     fields.destPort,
+		OldState:     fields.oldState,
+		NewState:     fields.newState,
+	}
+	contextEvent.Kind = profile.kind
+	contextEvent.Idle = pid == idlePID
+	contextEvent.Socket = fields.socket
+	contextEvent.MissingFields = fields.missingFields
+	contextEvent.IncompleteFields = fields.incompleteFields
+	contextEvent.UnknownStates = fields.unknownStates
+	contextEvent.MPTCP = fields.mptcp
+
+	return contextEvent, nil
+}
+
+// NewContextEvent returns an event, with the context of the line, if any,
+// from the pool of events, if pooled.
+func (ep *traceFSEventParser) newContextEvent(line []byte) *ContextEvent {
+	if ep.pooled {
+		return newPooledContextEvent(line)
+	}
+
+	return &ContextEvent{Event: new(event.Event), Context: parseTraceContext(line)}
+}
+
+// DecodedFields are the fields of an event decoded from its tagged fields.
+type decodedFields struct {
+	sourceIP, destIP     net.IP
+	sourcePort, destPort uint16
+	oldState, newState   tcpstate.State
+	socket               *SocketID
+	missingFields        []string
+	incompleteFields     []string
+	unknownStates        []string
+	mptcp                bool
+}
+
+// DecodeTaggedFields decodes the fields of an event from its tagged fields, the
+// remainder of the line in the parse context, which is used when they are not
+// printed in the known layout of the tracepoint. The tagged fields are sliced
+// from the line, and their values parsed in place, so that only the addresses,
+// socket identity and annotations of the event are allocated.
+func (ep *traceFSEventParser) decodeTaggedFields(pc *parseContext,
+	line []byte,
+	eventName []byte,
+	profile *eventProfile) (fields decodedFields, err error) {
+	// If parsing partially, the fields of a damaged line, such as one truncated
+	// by a lossy relay, which cannot be recovered are incomplete, rather than
+	// failing the event. Damage is the first such failure, which fails the
+	// event if neither its states nor its 4-tuple can be recovered.
+	var damage error
+	incomplete := func(field string, err error) error {
+		if !ep.partial {
+			return err
+		}
+
+		if damage == nil {
+			damage = err
+		}
+		fields.incompleteFields = append(fields.incompleteFields, field)
+		return nil
+	}
+
+	// The tagged fields before any damage to the line are filled
+	if err := ep.fieldParser.fillTaggedFields(&pc.str, &pc.tags); err != nil {
+		damage = newParseError(line, "tags", fmt.Errorf("parsing tagged fields: %w", err))
+		if !ep.partial {
+			return fields, damage
+		}
+	}
+	truncated := damage != nil
+
+	if profile.normaliseTags != nil {
+		if err := profile.normaliseTags(&pc.tags); err != nil {
+			return fields, newParseError(line, "tags", fmt.Errorf("normalising %s fields: %w", eventName, err))
+		}
+	}
+	tags := pc.tags
+
+	// A missing non-critical field fails the event, unless parsing best-effort,
+	// or it was lost to the truncation of the line
+	missing := func(tag, description string) error {
+		if truncated {
+			return incomplete(tag, newParseError(line, tag, fmt.Errorf("%s %w", description, errFieldNotPresent)))
+		}
+
+		if !ep.bestEffort {
+			return newParseError(line, tag, fmt.Errorf("%s %w", description, errFieldNotPresent))
+		}
+
+		fields.missingFields = append(fields.missingFields, tag)
+		return nil
 	}
 
-	family, ok := tags["family"]
+	family, ok := tags.get("family")
 	if ok { // Family will not be present if using tcp_set_state
-		if family != familyInet {
-			return nil, errIrrelevantEvent
+		if string(family) != familyInet {
+			return fields, errNonInetEvent
+		}
+	} else if ep.declares(eventName, "family") {
+		if err := missing("family", "family"); err != nil {
+			return fields, err
 		}
 	}
 
-	protocol, ok := tags["protocol"]
+	protocol, ok := tags.get("protocol")
 	if ok { // Protocol will not be present if using tcp_set_state
-		if protocol != protocolTCP {
-			return nil, errIrrelevantEvent
+		if string(protocol) == protocolMPTCP && ep.mptcp {
+			fields.mptcp = true
+		} else if string(protocol) != protocolTCP {
+			return fields, errNonTCPEvent
+		}
+	} else if ep.declares(eventName, "protocol") {
+		if err := missing("protocol", "protocol"); err != nil {
+			return fields, err
+		}
+	}
+
+	if sPort, ok := tags.get("sport"); ok {
+		if fields.sourcePort, err = parsePort(sPort, ep.lenientNumbers); err != nil {
+			if err := incomplete("sport", newParseError(line, "sport", fmt.Errorf("parsing source port: %w", err))); err != nil {
+				return fields, err
+			}
+		}
+	} else if err := missing("sport", "source port"); err != nil {
+		return fields, err
+	}
+
+	if dPort, ok := tags.get("dport"); ok {
+		if fields.destPort, err = parsePort(dPort, ep.lenientNumbers); err != nil {
+			if err := incomplete("dport", newParseError(line, "dport", fmt.Errorf("parsing destination port: %w", err))); err != nil {
+				return fields, err
+			}
+		}
+	} else if err := missing("dport", "destination port"); err != nil {
+		return fields, err
+	}
+
+	if fields.sourceIP, err = parseIPv4(tags, "saddr"); err != nil {
+		if err == ErrIrrelevantEvent {
+			return fields, errNonInetEvent
+		}
+
+		if err := incomplete("saddr", newParseError(line, "saddr", fmt.Errorf("parsing source address: %w", err))); err != nil {
+			return fields, err
+		}
+	} else if fields.sourceIP == nil {
+		if err := missing("saddr", "source address"); err != nil {
+			return fields, err
+		}
+	}
+
+	if fields.destIP, err = parseIPv4(tags, "daddr"); err != nil {
+		if err == ErrIrrelevantEvent {
+			return fields, errNonInetEvent
+		}
+
+		if err := incomplete("daddr", newParseError(line, "daddr", fmt.Errorf("parsing destination address: %w", err))); err != nil {
+			return fields, err
+		}
+	} else if fields.destIP == nil {
+		if err := missing("daddr", "destination address"); err != nil {
+			return fields, err
+		}
+	}
+
+	// Resets are not state changes, so both states are the state of the socket,
+	// if the tracepoint declares it, or empty otherwise
+	if profile.kind == KindStateChange {
+		if fields.oldState, err = parseState(line, tags, "oldstate", "old state", ep.bestEffort, &fields.unknownStates); err != nil {
+			if err := incomplete("oldstate", err); err != nil {
+				return fields, err
+			}
+		}
+
+		if fields.newState, err = parseState(line, tags, "newstate", "new state", ep.bestEffort, &fields.unknownStates); err != nil {
+			if err := incomplete("newstate", err); err != nil {
+				return fields, err
+			}
+		}
+	} else if _, ok := tags.get("state"); ok {
+		if fields.oldState, err = parseState(line, tags, "state", "state", ep.bestEffort, &fields.unknownStates); err != nil {
+			return fields, err
+		}
+		fields.newState = fields.oldState
+	}
+
+	if fields.socket, err = parseSocketID(tags); err != nil {
+		if err := incomplete("socket", newParseError(line, "socket", fmt.Errorf("parsing socket identity: %w", err))); err != nil {
+			return fields, err
+		}
+	}
+
+	if len(fields.incompleteFields) != 0 && !fields.recovered(profile.kind) {
+		return fields, damage
+	}
+
+	return fields, nil
+}
+
+// Recovered returns whether either the states or the 4-tuple of an event of
+// the kind were decoded, despite some of its fields being incomplete.
+func (fields *decodedFields) recovered(kind EventKind) bool {
+	tupleRecovered, statesRecovered := true, kind == KindStateChange
+	for _, field := range fields.incompleteFields {
+		switch field {
+		case "sport", "dport", "saddr", "daddr":
+			tupleRecovered = false
+		case "oldstate", "newstate":
+			statesRecovered = false
 		}
 	}
 
-	sPort, ok := tags["sport"]
+	return tupleRecovered || statesRecovered
+}
+
+// ParseState returns the state of the tag. A state which has no mapping is
+// StateUnknown if parsed best-effort, unless a fallback is set, and its kernel
+// name is appended to unknown. If the state cannot be parsed, a *ParseError for
+// the line is returned.
+func parseState(line []byte,
+	tags taggedFields,
+	tag string,
+	description string,
+	bestEffort bool,
+	unknown *[]string) (tcpstate.State, error) {
+	state, ok := tags.get(tag)
 	if !ok {
-		return nil, errors.New("source port not present in event")
+		return "", newParseError(line, tag, fmt.Errorf("%s %w", description, errFieldNotPresent))
 	}
-	sourcePort, err := strconv.ParseUint(sPort, 10, 16)
+
+	canonicalState, isUnknown, err := canonicaliseStateBytes(state)
 	if err != nil {
-		return nil, fmt.Errorf("converting source port to integer: %w", err)
+		if !bestEffort {
+			return "", newParseError(line, tag, fmt.Errorf("canonicalising %s: %w", description, err))
+		}
+		canonicalState, isUnknown = StateUnknown, true
 	}
 
-	dPort, ok := tags["dport"]
-	if !ok {
-		return nil, errors.New("destination port not present in event")
+	if isUnknown {
+		*unknown = append(*unknown, string(state))
+	}
+
+	return canonicalState, nil
+}
+
+func (ep *traceFSEventParser) eventTime(str []byte) (time.Time, error) {
+	if ep.clock == nil {
+		return time.Now().UTC(), nil
 	}
-	destPort, err := strconv.ParseUint(dPort, 10, 16)
+
+	timestamp, err := lineTraceTimestamp(str)
 	if err != nil {
-		return nil, fmt.Errorf("converting destination port to integer: %w", err)
+		return time.Time{}, fmt.Errorf("parsing timestamp from event: %w", err)
 	}
 
-	sAddr, ok := tags["saddr"]
-	if !ok {
-		return nil, errors.New("source address not present in event")
+	eventTime, err := ep.clock.toTime(timestamp)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("converting timestamp to time: %w", err)
 	}
-	sourceIP := net.ParseIP(sAddr)
-	if sourceIP == nil {
-		return nil, errors.New("could not parse source address")
+
+	return eventTime.UTC(), nil
+}
+
+// ParseIPv4 returns the IPv4 address of the tag, or, if the tag is not present,
+// that derived from its v4-mapped IPv6 alternative. If neither is present, nil
+// is returned. If the alternative is not v4-mapped, the connection is of IPv6,
+// so ErrIrrelevantEvent is returned. Dotted-decimal addresses are parsed in
+// place, and others as by net.ParseIP.
+func parseIPv4(tags taggedFields, tag string) (net.IP, error) {
+	if addr, ok := tags.get(tag); ok {
+		if ip, ok := parseIPv4Bytes(addr); ok {
+			return ip, nil
+		}
+
+		ip := net.ParseIP(string(addr))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", addr)
+		}
+
+		return ip, nil
 	}
 
-	dAddr, ok := tags["daddr"]
+	addr, ok := tags.get(alternativeTags[tag].tag)
 	if !ok {
-		return nil, errors.New("destination address not present in event")
+		return nil, nil
+	}
+
+	if bytes.HasPrefix(addr, v4MappedPrefixBytes) {
+		if ip, ok := parseIPv4Bytes(addr[len(v4MappedPrefixBytes):]); ok {
+			return ip.To4(), nil
+		}
 	}
-	destIP := net.ParseIP(dAddr)
-	if destIP == nil {
-		return nil, errors.New("could not parse destination address")
+
+	ip := net.ParseIP(string(addr))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv6 address %q", addr)
 	}
 
-	/* 	sAddrV6, ok := tags["saddrv6"]
-	   	if !ok {
-	   		return nil, errors.New("source IPv6 address not present in event")
-	   	}
+	if ip.To4() == nil {
+		return nil, ErrIrrelevantEvent
+	}
 
-	   	dAddrV6, ok := tags["daddrv6"]
-	   	if !ok {
-	   		return nil, errors.New("destination IPv6 address not present in event")
-	   	} */
+	return ip.To4(), nil
+}
 
-	oldState, ok := tags["oldstate"]
-	if !ok {
-		return nil, errors.New("old state not present in event")
+// ParsePID parses a PID, which, as a pid_t, is a signed 32-bit integer, but
+// never negative. PIDs are those of the host PID namespace, so may be large,
+// up to a pid_max of 2^22.
+// It is parsed from the bytes of the line, so that it is not allocated.
+func parsePID(pidBytes []byte, lenient bool) (int32, error) {
+	if len(pidBytes) == 0 {
+		return 0, errors.New("empty PID")
 	}
-	canonicalOldState, err := canonicaliseState(oldState)
+
+	pid, err := parseUintBytes(pidBytes, math.MaxInt32, lenient)
 	if err != nil {
-		return nil, fmt.Errorf("canonicalising old state: %w", err)
+		return 0, fmt.Errorf("converting PID %q to integer: %w", pidBytes, err)
 	}
 
-	newState, ok := tags["newstate"]
-	if !ok {
-		return nil, errors.New("new state not present in event")
-	}
-	canonicalNewState, err := canonicaliseState(newState)
+	return int32(pid), nil
+}
+
+// ParsePort parses a port of the tagged fields of an event, without allocating.
+func parsePort(port []byte, lenient bool) (uint16, error) {
+	value, err := parseUintBytes(port, math.MaxUint16, lenient)
 	if err != nil {
-		return nil, fmt.Errorf("canonicalising new state: %w", err)
+		return 0, fmt.Errorf("converting port %q to integer: %w", port, err)
 	}
 
-	return &event.Event{
-		Time:         time,
-		CommandOnCPU: command,
-		PIDOnCPU:     int(pid),
-		SourceIP:     sourceIP,
-		DestIP:       destIP,
-		SourcePort:   uint16(sourcePort),
-		DestPort:     uint16(destPort),
-		OldState:     canonicalOldState,
-		NewState:     canonicalNewState,
-	}, nil
+	return uint16(value), nil
 }
 
-func canonicaliseState(state string) (tcpstate.State, error) {
-	switch state {
-	case "TCP_CLOSE":
-		state = "CLOSED"
-	case "TCP_FIN_WAIT1":
-		state = "FIN-WAIT-1"
-	case "TCP_FIN_WAIT2":
-		state = "FIN-WAIT-2"
-	case "TCP_SYN_RECV":
-		state = "SYN-RECEIVED"
-	default:
-		state = strings.TrimPrefix(state, "TCP_")
-		state = strings.ReplaceAll(state, "_", "-")
+// ParseUintBytes parses a decimal integer of at most max, which may have leading
+// zeros, without allocating. If lenient, it may instead be a hexadecimal integer
+// prefixed by `0x`, as printed by the custom formats of some vendor-patched
+// kernels.
+func parseUintBytes(digits []byte, max uint64, lenient bool) (uint64, error) {
+	base := uint64(10)
+	if lenient && len(digits) > 2 && digits[0] == '0' && (digits[1] == 'x' || digits[1] == 'X') {
+		base = 16
+		digits = digits[2:]
+	}
+
+	if len(digits) == 0 {
+		return 0, errors.New("no digits")
+	}
+
+	var value uint64
+	for _, digit := range digits {
+		var digitValue uint64
+		switch {
+		case digit >= '0' && digit <= '9':
+			digitValue = uint64(digit - '0')
+		case base == 16 && digit >= 'a' && digit <= 'f':
+			digitValue = uint64(digit-'a') + 10
+		case base == 16 && digit >= 'A' && digit <= 'F':
+			digitValue = uint64(digit-'A') + 10
+		default:
+			return 0, fmt.Errorf("invalid digit %q", digit)
+		}
+
+		value = value*base + digitValue
+		if value > max {
+			return 0, errors.New("out of range")
+		}
 	}
 
-	return tcpstate.FromString(state)
+	return value, nil
+}
+
+// SkippedField returns the field skipped from the stream before, given the
+// stream after it was skipped, and the separator which ended the field.
+func skippedField(before, after, sep []byte) []byte {
+	return before[:len(before)-len(after)-len(sep)]
+}
+
+// TracepointName returns the name of the tracepoint from the tracepoint column,
+// which some tracers, such as perf, render qualified by its system, as in
+// `sock:inet_sock_set_state`.
+func tracepointName(column []byte) []byte {
+	return column[bytes.LastIndexByte(column, ':')+1:]
 }
 
-func parseCommand(str *[]byte) (command string, err error) {
-	defer panicToErr("parsing next field", &err) // Catch any unexpected slicing errors without panicking
+// TrimLinePadding returns the line without any trailing padding characters.
+func trimLinePadding(line []byte) []byte {
+	return bytes.TrimRight(line, linePadding)
+}
+
+// SkipMetadata advances the stream past the metadata columns, such as the CPU,
+// latency flags and timestamp, to the tracepoint name.
+func skipMetadata(str *[]byte) error {
+	idx := timestampColumnEnd(*str)
+	if idx == -1 { // No timestamp column present
+		return io.ErrUnexpectedEOF
+	}
+	*str = (*str)[idx+len(colonSpaceBytes):]
 
-	// Get index of colon, then work backwards to the last dash.
-	// This is needed as the command is delimited by a dash, but may contain a dash itself!
-	idx := bytes.Index(*str, colonSpaceBytes)
-	if idx == -1 { // No ': ' present
-		return "", io.ErrUnexpectedEOF
+	return nil
+}
+
+func parseCommand(str *[]byte) (string, error) {
+	command, err := parseCommandBytes(str)
+	if err != nil {
+		return "", err
 	}
 
-	for ; (*str)[idx] != byte('-') && idx > 0; idx-- {
+	return string(command), nil
+}
+
+// ParseCommandBytes is as parseCommand, but slices the command from the line,
+// rather than allocating it.
+func parseCommandBytes(str *[]byte) ([]byte, error) {
+	// The command is delimited from the PID by a dash, but may itself contain
+	// dashes, spaces and even `: `, so work backwards to the last dash from
+	// the column following the PID. This is the TGID column, if present, which
+	// contains dashes if the TGID is unknown, or else the CPU column.
+	end := timestampColumnEnd(*str)
+	if end == -1 {
+		end = bytes.Index(*str, colonSpaceBytes)
+	}
+	if end == -1 { // No ': ' present
+		return nil, io.ErrUnexpectedEOF
 	}
 
-	if idx == 0 { // No command present
-		return "", io.ErrUnexpectedEOF
+	if start, _ := findTGIDColumn(*str, end); start != -1 {
+		end = start
+	} else if cpuIdx := bytes.LastIndex((*str)[:end], cpuColumnPrefixBytes); cpuIdx != -1 {
+		end = cpuIdx
 	}
 
-	cmd := (*str)[:idx]
-	*str = (*str)[idx+1:]
+	idx := bytes.LastIndexByte((*str)[:end], '-')
+	if idx == -1 { // No command present
+		return nil, io.ErrUnexpectedEOF
+	}
 
 	// Strip leading padding spaces
-	for idx = 0; cmd[idx] == byte(' '); idx++ {
+	command := bytes.TrimLeft((*str)[:idx], " ")
+	if len(command) == 0 {
+		return nil, io.ErrUnexpectedEOF
 	}
-	command = string(cmd[idx:])
+	*str = (*str)[idx+1:]
 
 	return command, nil
 }
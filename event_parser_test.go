@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"net"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
 )
 
 func TestParse(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err != nil {
 		t.Errorf("expected nil error, got %v (of type %T)", err, err)
@@ -22,7 +28,7 @@ func TestParse(t *testing.T) {
 func TestParseIrrelevantEventErrorOnNonInetAddressFamily(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_UNIX")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -30,15 +36,19 @@ func TestParseIrrelevantEventErrorOnNonInetAddressFamily(t *testing.T) {
 
 	t.Logf("got error %q (of type %T)", err, err)
 
-	if err != errIrrelevantEvent {
-		t.Errorf("expected error to be %q, but was %q", errIrrelevantEvent, err)
+	if err != errNonInetEvent {
+		t.Errorf("expected error to be %q, but was %q", errNonInetEvent, err)
+	}
+
+	if !errors.Is(err, ErrIrrelevantEvent) {
+		t.Errorf("expected error chain to include %q, but did not", ErrIrrelevantEvent)
 	}
 }
 
 func TestParseIrrelevantEventErrorOnNonTCPProtocol(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_FOO")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -46,15 +56,34 @@ func TestParseIrrelevantEventErrorOnNonTCPProtocol(t *testing.T) {
 
 	t.Logf("got error %q (of type %T)", err, err)
 
-	if err != errIrrelevantEvent {
-		t.Errorf("expected error to be %q, but was %q", errIrrelevantEvent, err)
+	if err != errNonTCPEvent {
+		t.Errorf("expected error to be %q, but was %q", errNonTCPEvent, err)
+	}
+
+	if !errors.Is(err, ErrIrrelevantEvent) {
+		t.Errorf("expected error chain to include %q, but did not", ErrIrrelevantEvent)
+	}
+}
+
+func TestParseMPTCP(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_MPTCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	eventParser.mptcp = true
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if !event.MPTCP || event.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected MPTCP event into ESTABLISHED, got MPTCP %t into %v", event.MPTCP, event.NewState)
 	}
 }
 
 func TestParseErrorNoCommandSeparator(t *testing.T) {
 	mockEventTrace := []byte("<idle>0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -70,7 +99,7 @@ func TestParseErrorNoCommandSeparator(t *testing.T) {
 func TestParseErrorNoColonSpaceSeparator(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985 inet_sock_set_state family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -86,7 +115,7 @@ func TestParseErrorNoColonSpaceSeparator(t *testing.T) {
 func TestParseErrorNoPIDSeparator(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0: ")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -102,7 +131,7 @@ func TestParseErrorNoPIDSeparator(t *testing.T) {
 func TestParseErrorNonIntegerPID(t *testing.T) {
 	mockEventTrace := []byte("<idle>-foo       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -118,7 +147,7 @@ func TestParseErrorNonIntegerPID(t *testing.T) {
 func TestParseErrorNoSrcPortTag(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -134,7 +163,7 @@ func TestParseErrorNoSrcPortTag(t *testing.T) {
 func TestParseErrorNoDstPortTag(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -148,9 +177,9 @@ func TestParseErrorNoDstPortTag(t *testing.T) {
 }
 
 func TestParseErrorNoSrcAddrTag(t *testing.T) {
-	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 daddr=172.217.169.4 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -164,9 +193,9 @@ func TestParseErrorNoSrcAddrTag(t *testing.T) {
 }
 
 func TestParseErrorNoDstAddrTag(t *testing.T) {
-	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 saddrv6=::ffff:192.168.122.38 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -182,7 +211,7 @@ func TestParseErrorNoDstAddrTag(t *testing.T) {
 func TestParseErrorNoOldStateAddrTag(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -198,7 +227,7 @@ func TestParseErrorNoOldStateAddrTag(t *testing.T) {
 func TestParseErrorNoNewStateAddrTag(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -214,7 +243,7 @@ func TestParseErrorNoNewStateAddrTag(t *testing.T) {
 func TestParseErrorNonIntegerSrcPort(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=foo dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -230,7 +259,7 @@ func TestParseErrorNonIntegerSrcPort(t *testing.T) {
 func TestParseErrorNonIntegerDstPort(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=1234 dport=foo saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -246,7 +275,7 @@ func TestParseErrorNonIntegerDstPort(t *testing.T) {
 func TestParseErrorInvalidSrcAddr(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=1234 dport=80 saddr=foo daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -262,7 +291,7 @@ func TestParseErrorInvalidSrcAddr(t *testing.T) {
 func TestParseErrorInvalidDstAddr(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=1234 dport=80 saddr=172.217.169.4 daddr=foo saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -278,7 +307,7 @@ func TestParseErrorInvalidDstAddr(t *testing.T) {
 func TestParseErrorInvalidOldState(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=FOO_BAR newstate=TCP_ESTABLISHED")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -294,7 +323,7 @@ func TestParseErrorInvalidOldState(t *testing.T) {
 func TestParseErrorInvalidNewState(t *testing.T) {
 	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_ESTABLISHED newstate=FOO_BAR")
 	fieldParser := new(slicingFieldParser)
-	eventParser := newTraceFSEventParser(fieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
 	_, err := eventParser.toEvent(mockEventTrace)
 	if err == nil {
 		t.Error("expected error, got nil")
@@ -306,3 +335,902 @@ func TestParseErrorInvalidNewState(t *testing.T) {
 		t.Errorf("expected error string to contain %q, but did not", "new state")
 	}
 }
+
+func TestParseUsesEventProfile(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: mock_event: (mock_location) family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=SYN_SENT newstate=ESTABLISHED")
+	mockCandidates := []*tracepointCandidate{
+		{
+			tracepoint: "mock/mock_event",
+			profile: &eventProfile{
+				location: true,
+				normaliseTags: func(tags *taggedFields) error {
+					for _, tag := range []string{"oldstate", "newstate"} {
+						state, _ := tags.get(tag)
+						tags.set(tag, append([]byte("TCP_"), state...))
+					}
+					return nil
+				},
+			},
+		},
+	}
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, mockCandidates)
+	_, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+}
+
+func TestParseConfigure(t *testing.T) {
+	format, err := parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock format: %v", err)
+	}
+
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	if err := eventParser.configure(format); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	// The format declares the family, so it is now required
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	_, err = eventParser.toEvent(mockEventTrace)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestParseConfigureMissingRequiredFieldError(t *testing.T) {
+	format := &eventFormat{
+		name: "inet_sock_set_state",
+		tags: map[string]string{"sport": "%hu", "dport": "%hu"},
+	}
+
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	err := eventParser.configure(format)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestParseConfigureUnsupportedConversionError(t *testing.T) {
+	format := &eventFormat{
+		name: "inet_sock_set_state",
+		tags: map[string]string{
+			"sport":    "%hu",
+			"dport":    "%hu",
+			"saddr":    "%pI4",
+			"daddr":    "%pI4",
+			"oldstate": "%d",
+			"newstate": "%d",
+		},
+	}
+
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	err := eventParser.configure(format)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestParseConfigureNormalisedConversions(t *testing.T) {
+	format := &eventFormat{
+		name: kprobeEventName,
+		tags: map[string]string{
+			"family":   "%u",
+			"sport":    "%u",
+			"dport":    "%u",
+			"saddr":    "%u",
+			"daddr":    "%u",
+			"oldstate": "%u",
+			"newstate": "%d",
+		},
+	}
+
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	if err := eventParser.configure(format); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestParseEventTimeFromTraceClock(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   " +
+		mockBootTimeAgo(t, 5*time.Second) +
+		": inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	eventParser.useClock(newTraceClock("boot"))
+
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedTime := time.Now().Add(-5 * time.Second)
+	if difference := expectedTime.Sub(event.Time); difference < -time.Second || difference > time.Second {
+		t.Errorf("expected event time of about %v, got %v", expectedTime, event.Time)
+	}
+}
+
+func TestParseWithTGIDColumn(t *testing.T) {
+	for line, expectedCommand := range map[string]string{
+		"curl-4242  (   4200) [012] ..s.   995.318985: inet_sock_set_state: ":    "curl",
+		"my-curl-4242  (-------) [012] ..s.   995.318985: inet_sock_set_state: ": "my-curl",
+	} {
+		mockEventTrace := []byte(line + "family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+		fieldParser := new(slicingFieldParser)
+		eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+		event, err := eventParser.toEvent(mockEventTrace)
+		if err != nil {
+			t.Errorf("expected nil error, got %q (of type %T)", err, err)
+			continue
+		}
+
+		if event.CommandOnCPU != expectedCommand {
+			t.Errorf("expected command %q, got %q", expectedCommand, event.CommandOnCPU)
+		}
+
+		if event.PIDOnCPU != 4242 {
+			t.Errorf("expected PID 4242, got %d", event.PIDOnCPU)
+		}
+	}
+}
+
+func TestParseSocketAddress(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED skaddr=000000009a7e2b8d")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.Socket == nil || event.Socket.Address != 0x9a7e2b8d {
+		t.Errorf("expected socket address 0x9a7e2b8d, got %+v", event.Socket)
+	}
+
+	if event.Context == nil || event.Context.CPU != 0 || !event.Context.SoftIRQ {
+		t.Errorf("expected context of CPU 0 in soft interrupt, got %+v", event.Context)
+	}
+}
+
+func TestParseResets(t *testing.T) {
+	for line, expectedKind := range map[string]EventKind{
+		// Since Linux 5.5, the send reset tracepoint declares the family and state
+		"<idle>-0       [000] ..s.   995.318985: tcp_send_reset: family=AF_INET sport=80 dport=44406 saddr=172.217.169.4 daddr=192.168.122.38 saddrv6=::ffff:172.217.169.4 daddrv6=::ffff:192.168.122.38 state=TCP_ESTABLISHED": KindSendReset,
+		// The receive reset tracepoint declares no state
+		"<idle>-0       [000] ..s.   995.318985: tcp_receive_reset: family=AF_INET sport=80 dport=44406 saddr=172.217.169.4 daddr=192.168.122.38 saddrv6=::ffff:172.217.169.4 daddrv6=::ffff:192.168.122.38 sock_cookie=1f4": KindReceiveReset,
+	} {
+		fieldParser := new(slicingFieldParser)
+		eventParser := newTraceFSEventParser(fieldParser, resetTracepoints)
+		format, err := parseEventFormat(strings.NewReader(mockEventFormat))
+		if err != nil {
+			t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+		}
+
+		// The configured format is that of the state change tracepoint, which
+		// declares fields the reset tracepoints do not
+		if err := eventParser.configure(format); err != nil {
+			t.Fatalf("test bootstrapping: unable to configure parser: %v", err)
+		}
+
+		event, err := eventParser.toEvent([]byte(line))
+		if err != nil {
+			t.Errorf("expected nil error, got %q (of type %T)", err, err)
+			continue
+		}
+
+		if event.Kind != expectedKind {
+			t.Errorf("expected event of kind %v, got %v", expectedKind, event.Kind)
+		}
+
+		if event.SourcePort != 80 || event.DestPort != 44406 {
+			t.Errorf("expected ports 80 and 44406, got %d and %d", event.SourcePort, event.DestPort)
+		}
+
+		if expectedKind == KindSendReset && event.OldState != tcpstate.StateEstablished {
+			t.Errorf("expected state %v, got %v", tcpstate.StateEstablished, event.OldState)
+		}
+	}
+}
+
+func TestParseDestroySock(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: tcp_destroy_sock: family=AF_INET sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 sock_cookie=1f4")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, []*tracepointCandidate{destroySockTracepoint})
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.Kind != KindDestroySock {
+		t.Errorf("expected event of kind %v, got %v", KindDestroySock, event.Kind)
+	}
+
+	if event.OldState != "" || event.NewState != "" {
+		t.Errorf("expected empty states, got %q and %q", event.OldState, event.NewState)
+	}
+
+	if event.Socket == nil || event.Socket.Cookie != 500 {
+		t.Errorf("expected socket cookie 500, got %+v", event.Socket)
+	}
+}
+
+func TestParseBestEffortMissingFields(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 saddr=192.168.122.38 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	eventParser.bestEffort = true
+
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(event.MissingFields) != 2 || event.MissingFields[0] != "dport" || event.MissingFields[1] != "daddr" {
+		t.Errorf("expected missing fields %q, got %q", []string{"dport", "daddr"}, event.MissingFields)
+	}
+
+	if event.SourcePort != 44406 || event.DestPort != 0 || event.DestIP != nil {
+		t.Errorf("expected source port 44406 and zero-valued destination, got %d, %d and %v",
+			event.SourcePort,
+			event.DestPort,
+			event.DestIP)
+	}
+}
+
+func TestParseBestEffortMissingCriticalFieldError(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	eventParser.bestEffort = true
+
+	_, err := eventParser.toEvent(mockEventTrace)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestParsePartialEvents(t *testing.T) {
+	for name, test := range map[string]struct {
+		mockEventTrace     string
+		expectedIncomplete []string
+	}{
+		"truncated states": {
+			"family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT news",
+			[]string{"newstate"},
+		},
+		"damaged 4-tuple": {
+			"family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=8x saddr=192.168.122 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+			[]string{"dport", "saddr"},
+		},
+	} {
+		fieldParser := new(slicingFieldParser)
+		eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+		eventParser.bestEffort = true
+		eventParser.partial = true
+
+		event, err := eventParser.toEvent([]byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: " + test.mockEventTrace))
+		if err != nil {
+			t.Errorf("expected nil error for %s, got %q (of type %T)", name, err, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(event.IncompleteFields, test.expectedIncomplete) {
+			t.Errorf("expected incomplete fields %q for %s, got %q", test.expectedIncomplete, name, event.IncompleteFields)
+		}
+
+		if len(event.MissingFields) != 0 {
+			t.Errorf("expected no missing fields for %s, got %q", name, event.MissingFields)
+		}
+
+		if event.OldState != tcpstate.StateSynSent {
+			t.Errorf("expected old state %v for %s, got %v", tcpstate.StateSynSent, name, event.OldState)
+		}
+	}
+}
+
+func TestParsePartialEventUnrecoverableError(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT news")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	eventParser.bestEffort = true
+	eventParser.partial = true
+
+	if _, err := eventParser.toEvent(mockEventTrace); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	// Neither the states nor the 4-tuple can be recovered
+	mockEventTrace = []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dp")
+	_, err := eventParser.toEvent(mockEventTrace)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	parseErr := new(ParseError)
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("expected error chain to include %T, but did not", parseErr)
+	}
+
+	if parseErr.Failure != FailureTruncated {
+		t.Errorf("expected failure %v, got %v", FailureTruncated, parseErr.Failure)
+	}
+}
+
+func TestParseStrictDamagedLineError(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT news")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	eventParser.bestEffort = true
+
+	_, err := eventParser.toEvent(mockEventTrace)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestParseConfigureBestEffort(t *testing.T) {
+	format := &eventFormat{
+		name: "inet_sock_set_state",
+		tags: map[string]string{"sport": "%hu", "oldstate": "%s", "newstate": "%s"},
+	}
+
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	eventParser.bestEffort = true
+	if err := eventParser.configure(format); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestParseErrorCarriesLineAndField(t *testing.T) {
+	for line, expectedField := range map[string]string{
+		"<idle>-foo       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET":                                                                                 "pid",
+		"<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=foo":                                                    "sport",
+		"<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=1 dport=2 saddr=1.1.1.1 daddr=2.2.2.2 oldstate=TCP_FOO": "oldstate",
+	} {
+		mockEventTrace := []byte(line)
+		fieldParser := new(slicingFieldParser)
+		eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+		_, err := eventParser.toEvent(mockEventTrace)
+
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("expected error chain to include *ParseError, got %q (of type %T)", err, err)
+			continue
+		}
+
+		if parseErr.Field != expectedField {
+			t.Errorf("expected field %q, got %q", expectedField, parseErr.Field)
+		}
+
+		// The line is copied, so is unaffected by reuse of the buffer
+		mockEventTrace[0] = 'X'
+		if string(parseErr.Line) != line {
+			t.Errorf("expected line %q, got %q", line, parseErr.Line)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestParseErrorClassifiesFailure(t *testing.T) {
+	const prefix = "<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP "
+	for line, expectedFailure := range map[string]ParseFailure{
+		"<idle>-foo       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET": FailureBadInteger,
+		prefix + "sport=foo": FailureBadInteger,
+		prefix + "sport=1 dport=2 saddr=1.1.1 daddr=2.2.2.2 oldstate=TCP_CLOSE newstate=TCP_LISTEN": FailureBadAddress,
+		prefix + "sport=1 dport=2 saddr=1.1.1.1 daddr=2.2.2.2 oldstate=TCP_FOO newstate=TCP_LISTEN": FailureBadState,
+		prefix + "sport=1 dport=2 saddr=1.1.1.1 daddr=2.2.2.2 oldstate=TCP_CLOSE":                   FailureMissingField,
+		prefix + "sport=1 dport=2 saddr=1.1.1.1 daddr=2.2.2.2 oldstate=TCP_CLOSE newstate=":         FailureTruncated,
+		"<idle>-0       [000] ..s.   995.318985: inet_sock_set_state":                               FailureTruncated,
+	} {
+		fieldParser := new(slicingFieldParser)
+		eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+		_, err := eventParser.toEvent([]byte(line))
+
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("expected error chain to include *ParseError, got %q (of type %T)", err, err)
+			continue
+		}
+
+		if parseErr.Failure != expectedFailure {
+			t.Errorf("expected failure %v for %q, got %v", expectedFailure, line, parseErr.Failure)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestParseVaryingMetadataColumns(t *testing.T) {
+	for _, mockColumns := range []string{
+		// The irq-info trace option is disabled
+		"curl-4242     [001]   995.318985: ",
+		// The print-tgid trace option is enabled
+		"curl-4242  (   4200) [012] ..s.   995.318985: ",
+		// Both
+		"curl-4242  (   4200) [012]   995.318985: ",
+	} {
+		mockEventTrace := []byte(mockColumns + "inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+		fieldParser := new(slicingFieldParser)
+		eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+		event, err := eventParser.toEvent(mockEventTrace)
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %q (of type %T)", mockColumns, err, err)
+			continue
+		}
+
+		if event.PIDOnCPU != 4242 || event.SourcePort != 44406 {
+			t.Errorf("expected PID 4242 and source port 44406 for %q, got %d and %d",
+				mockColumns,
+				event.PIDOnCPU,
+				event.SourcePort)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	for line, expectedCommand := range map[string]string{
+		"          <idle>-0       [000] ..s.   995.318985: inet_sock_set_state: ":        "<idle>",
+		"kworker/u8:1-flush-8:0-123 [000] ..s.   995.318985: inet_sock_set_state: ":      "kworker/u8:1-flush-8:0",
+		"     Web Content-4242    [002] ....   995.318985: inet_sock_set_state: ":        "Web Content",
+		"         foo: bar-4242    [002] ....   995.318985: inet_sock_set_state: ":       "foo: bar",
+		"   foo [1] -bar-4242  (   4200) [002] ....   995.318985: inet_sock_set_state: ": "foo [1] -bar",
+	} {
+		str := []byte(line)
+		command, err := parseCommand(&str)
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %q (of type %T)", line, err, err)
+			continue
+		}
+
+		if command != expectedCommand {
+			t.Errorf("expected command %q, got %q", expectedCommand, command)
+		}
+
+		if !bytes.HasPrefix(str, []byte("123 ")) && !bytes.HasPrefix(str, []byte("0 ")) &&
+			!bytes.HasPrefix(str, []byte("4242 ")) {
+			t.Errorf("expected stream to be advanced to the PID for %q, but was %q", line, str)
+		}
+	}
+}
+
+func TestParsePID(t *testing.T) {
+	for pidStr, expected := range map[string]int32{
+		"0":          0,
+		"4242":       4242,
+		"4194304":    4194304, // pid_max of 2^22
+		"2147483647": 2147483647,
+	} {
+		pid, err := parsePID([]byte(pidStr), false)
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %q (of type %T)", pidStr, err, err)
+		}
+
+		if pid != expected {
+			t.Errorf("expected PID %d, got %d", expected, pid)
+		}
+	}
+}
+
+func TestParsePIDError(t *testing.T) {
+	for _, pidStr := range []string{"foo", "-1", "2147483648"} {
+		_, err := parsePID([]byte(pidStr), false)
+		if err == nil {
+			t.Errorf("expected error for %q, got nil", pidStr)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestParsePIDLenient(t *testing.T) {
+	for pidStr, expected := range map[string]int32{
+		"004242":     4242,
+		"0x1092":     4242,
+		"0X7fffffff": 2147483647,
+	} {
+		pid, err := parsePID([]byte(pidStr), true)
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %q (of type %T)", pidStr, err, err)
+		}
+
+		if pid != expected {
+			t.Errorf("expected PID %d, got %d", expected, pid)
+		}
+	}
+}
+
+func TestParsePIDLenientError(t *testing.T) {
+	for _, pidStr := range []string{"0x", "0xg", "0x80000000", "1092a"} {
+		_, err := parsePID([]byte(pidStr), true)
+		if err == nil {
+			t.Errorf("expected error for %q, got nil", pidStr)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestParsePIDStrictHexError(t *testing.T) {
+	_, err := parsePID([]byte("0x1092"), false)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestParseLenientPorts(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=0xad76 dport=00080 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	if _, err := eventParser.toEvent(mockEventTrace); err == nil {
+		t.Error("expected error parsing hexadecimal port strictly, got nil")
+	}
+
+	eventParser.lenientNumbers = true
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.SourcePort != 44406 || event.DestPort != 80 {
+		t.Errorf("expected ports 44406 and 80, got %d and %d", event.SourcePort, event.DestPort)
+	}
+}
+
+func TestParseIdle(t *testing.T) {
+	for line, expectedIdle := range map[string]bool{
+		"<idle>-0       [000] ..s.   995.318985: ": true,
+		"curl-4242      [000] ..s.   995.318985: ": false,
+	} {
+		mockEventTrace := []byte(line + "inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+		fieldParser := new(slicingFieldParser)
+		eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+		event, err := eventParser.toEvent(mockEventTrace)
+		if err != nil {
+			t.Errorf("expected nil error, got %q (of type %T)", err, err)
+			continue
+		}
+
+		if event.Idle != expectedIdle {
+			t.Errorf("expected idle %t for %q, got %t", expectedIdle, line, event.Idle)
+		}
+	}
+}
+
+func TestParseDerivesIPv4FromV4MappedIPv6(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !event.SourceIP.Equal(net.IPv4(192, 168, 122, 38)) || len(event.SourceIP) != net.IPv4len {
+		t.Errorf("expected 4-byte source address 192.168.122.38, got %v", event.SourceIP)
+	}
+
+	if !event.DestIP.Equal(net.IPv4(172, 217, 169, 4)) || len(event.DestIP) != net.IPv4len {
+		t.Errorf("expected 4-byte destination address 172.217.169.4, got %v", event.DestIP)
+	}
+}
+
+func TestParseIrrelevantEventErrorOnIPv6WithoutIPv4Addresses(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: sport=44406 dport=80 saddrv6=2001:db8::1 daddrv6=2001:db8::2 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	_, err := eventParser.toEvent(mockEventTrace)
+	if err != errNonInetEvent {
+		t.Errorf("expected error to be %q, but was %q", errNonInetEvent, err)
+	}
+}
+
+func TestParseConfigureV4MappedIPv6Alternatives(t *testing.T) {
+	format := &eventFormat{
+		name: "inet_sock_set_state",
+		tags: map[string]string{
+			"sport":    "%hu",
+			"dport":    "%hu",
+			"saddrv6":  "%pI6c",
+			"daddrv6":  "%pI6c",
+			"oldstate": "%s",
+			"newstate": "%s",
+		},
+	}
+
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	if err := eventParser.configure(format); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestParseTrailingPadding(t *testing.T) {
+	mockEventTrace := "<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED"
+	paddings := map[string]string{
+		"CR":      "\r",
+		"tab":     "\t",
+		"spaces":  "   ",
+		"mixture": " \t \r",
+	}
+
+	for name, padding := range paddings {
+		fieldParser := new(slicingFieldParser)
+		eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+		event, err := eventParser.toEvent([]byte(mockEventTrace + padding))
+		if err != nil {
+			t.Errorf("expected nil error for %s padding, got %q (of type %T)", name, err, err)
+			continue
+		}
+
+		if event.NewState != tcpstate.StateEstablished {
+			t.Errorf("expected new state %v for %s padding, got %v", tcpstate.StateEstablished, name, event.NewState)
+		}
+	}
+}
+
+func TestParseSystemQualifiedTracepoint(t *testing.T) {
+	for unqualified, qualified := range map[string]string{
+		"inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED": "sock:",
+		"tcp_set_state: sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED":                                                                                                      "tcp:",
+	} {
+		qualified += unqualified
+		events := make([]*ContextEvent, 0, 2)
+		for _, mockEventTrace := range []string{unqualified, qualified} {
+			fieldParser := new(slicingFieldParser)
+			eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+			event, err := eventParser.toEvent([]byte("<idle>-0       [000] ..s.   995.318985: " + mockEventTrace))
+			if err != nil {
+				t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+			}
+			events = append(events, event)
+		}
+
+		if !events[0].SourceIP.Equal(events[1].SourceIP) ||
+			events[0].SourcePort != events[1].SourcePort ||
+			events[0].DestPort != events[1].DestPort ||
+			events[0].OldState != events[1].OldState ||
+			events[0].NewState != events[1].NewState ||
+			events[0].Kind != events[1].Kind {
+			t.Errorf("expected event of %q to equal that of %q, but did not", qualified, unqualified)
+		}
+	}
+}
+
+func TestParseDispatchesByTracepoint(t *testing.T) {
+	for line, expectedKind := range map[string]EventKind{
+		"<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED":       KindStateChange,
+		"<idle>-0       [000] ..s.   995.318985: tcp_set_state: sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED":                                                                                                            KindStateChange,
+		"<idle>-0       [000] ..s.   995.318985: tcp_retransmit_skb: skbaddr=0xffff8880a1b2c3d4 skaddr=0xffff8880a1b2c3d4 family=AF_INET sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 state=TCP_ESTABLISHED": KindRetransmit,
+	} {
+		fieldParser := new(slicingFieldParser)
+		eventParser := newTraceFSEventParser(fieldParser, parserTracepointCandidates())
+		event, err := eventParser.toEvent([]byte(line))
+		if err != nil {
+			t.Errorf("expected nil error, got %q (of type %T)", err, err)
+			continue
+		}
+
+		if event.Kind != expectedKind {
+			t.Errorf("expected event of kind %v, got %v", expectedKind, event.Kind)
+		}
+
+		if expectedKind == KindRetransmit && event.OldState != tcpstate.StateEstablished {
+			t.Errorf("expected state %v, got %v", tcpstate.StateEstablished, event.OldState)
+		}
+	}
+}
+
+func TestParseIrrelevantEventErrorOnUnknownTracepoint(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: mock_tracepoint: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	_, err := eventParser.toEvent(mockEventTrace)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if err != errUnknownTracepointEvent {
+		t.Errorf("expected error to be %q, but was %q", errUnknownTracepointEvent, err)
+	}
+
+	if !errors.Is(err, ErrIrrelevantEvent) {
+		t.Errorf("expected error chain to include %q, but did not", ErrIrrelevantEvent)
+	}
+}
+
+func TestParseConfiguredUnknownTracepointAsStateChange(t *testing.T) {
+	format := &eventFormat{
+		name: "mock_tracepoint",
+		tags: map[string]string{
+			"sport":    "%hu",
+			"dport":    "%hu",
+			"saddr":    "%pI4",
+			"daddr":    "%pI4",
+			"oldstate": "%s",
+			"newstate": "%s",
+		},
+	}
+
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: mock_tracepoint: sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	if err := eventParser.configure(format); err != nil {
+		t.Fatalf("test bootstrapping: unable to configure parser: %v", err)
+	}
+
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.Kind != KindStateChange {
+		t.Errorf("expected event of kind %v, got %v", KindStateChange, event.Kind)
+	}
+}
+
+// BenchmarkToEvent reports the allocations of parsing an event. In the steady
+// state, these are only of the returned event, its context and addresses, as
+// its tagged fields are in the known layout, and its command is interned.
+func BenchmarkToEvent(b *testing.B) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := eventParser.toEvent(mockEventTrace); err != nil {
+			b.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+	}
+}
+
+// BenchmarkDecodeTaggedFields reports the allocations of decoding the tagged
+// fields of an event not in the known layout, which must be only of its
+// addresses, as the tags are compared, and their values parsed, in place.
+func BenchmarkDecodeTaggedFields(b *testing.B) {
+	mockLine := []byte("<idle>-0       [000] ..s.   995.318985: tcp_set_state: sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	mockTags := mockLine[bytes.Index(mockLine, []byte("sport")):]
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), defaultTracepointCandidates)
+	eventName, profile := []byte("tcp_set_state"), new(eventProfile)
+	decode := func() {
+		pc := eventParser.parseContexts.Get().(*parseContext)
+		defer eventParser.releaseParseContext(pc)
+		pc.str = mockTags
+
+		if _, err := eventParser.decodeTaggedFields(pc, mockLine, eventName, profile); err != nil {
+			b.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+	}
+
+	if allocs := testing.AllocsPerRun(100, decode); allocs > 2 {
+		b.Fatalf("expected at most 2 allocs/op, of the addresses, got %v", allocs)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decode()
+	}
+}
+
+// BenchmarkToEventPooled reports the allocations of parsing an event from the
+// pool of events, which must be none, once the pool is warm, as its addresses
+// are stored in the event.
+func BenchmarkToEventPooled(b *testing.B) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), defaultTracepointCandidates)
+	eventParser.pooled = true
+	parse := func() {
+		event, err := eventParser.toEvent(mockEventTrace)
+		if err != nil {
+			b.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+		releaseContextEvent(event)
+	}
+
+	if allocs := testing.AllocsPerRun(100, parse); allocs != 0 {
+		b.Fatalf("expected no allocs/op, got %v", allocs)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		parse()
+	}
+}
+
+func TestToEventPooledDoesNotAllocate(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), defaultTracepointCandidates)
+	eventParser.pooled = true
+
+	sourceIP := net.ParseIP("192.168.122.38")
+	allocs := testing.AllocsPerRun(100, func() {
+		event, err := eventParser.toEvent(mockEventTrace)
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.CommandOnCPU != "<idle>" || !event.SourceIP.Equal(sourceIP) {
+			t.Fatalf("expected event of <idle> from %v, got %+v", sourceIP, event.Event)
+		}
+		releaseContextEvent(event)
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocs/op, got %v", allocs)
+	}
+}
+
+func BenchmarkToEventParallel(b *testing.B) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := eventParser.toEvent(mockEventTrace); err != nil {
+				b.Errorf("expected nil error, got %q (of type %T)", err, err)
+				return
+			}
+		}
+	})
+}
+
+func TestParseReusesParseContext(t *testing.T) {
+	mockEventTraces := []string{
+		"<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+		// The tags of the previous event must not leak into this one
+		"<idle>-0       [000] ..s.   995.318990: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44407 dport=443 saddr=192.168.122.39 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+	}
+
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	eventParser.bestEffort = true
+
+	first, err := eventParser.toEvent([]byte(mockEventTraces[0]))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	second, err := eventParser.toEvent([]byte(mockEventTraces[1]))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if first.DestPort != 80 || first.DestIP.String() != "172.217.169.4" {
+		t.Errorf("expected first event unchanged by parsing of second, got %+v", first.Event)
+	}
+
+	if second.DestIP != nil || len(second.MissingFields) != 1 || second.MissingFields[0] != "daddr" {
+		t.Errorf("expected second event missing destination address, got %v and missing fields %q",
+			second.DestIP,
+			second.MissingFields)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// PooledContextEvent is an event allocated together with its Event,
+// TraceContext and the storage of its addresses, so that all are reused once
+// released.
+type pooledContextEvent struct {
+	ContextEvent
+	event     event.Event
+	context   TraceContext
+	addresses eventAddresses
+}
+
+// EventAddresses is the storage of the source and destination addresses of an
+// event, of the 16-byte form.
+type eventAddresses struct {
+	source, dest [net.IPv6len]byte
+}
+
+// ContextEventPool holds the events released for reuse. It is safe for use by
+// the readers of the trace_pipe of each CPU, which parse concurrently.
+var contextEventPool = &sync.Pool{
+	New: func() interface{} {
+		return new(pooledContextEvent)
+	},
+}
+
+// NewPooledContextEvent returns an event from the pool, with the context of
+// the line, if any.
+func newPooledContextEvent(line []byte) *ContextEvent {
+	pooled := contextEventPool.Get().(*pooledContextEvent)
+	pooled.pooled = pooled
+	pooled.Event = &pooled.event
+	if fillTraceContext(line, &pooled.context) {
+		pooled.Context = &pooled.context
+	}
+
+	return &pooled.ContextEvent
+}
+
+// PooledEventAddresses returns the storage of the addresses of the event, if it
+// is from the pool, or else nil, for them to be allocated.
+func pooledEventAddresses(event *ContextEvent) *eventAddresses {
+	pooled := event.pooled
+	if pooled == nil || &pooled.ContextEvent != event {
+		return nil
+	}
+
+	return &pooled.addresses
+}
+
+// ReleaseContextEvent returns the event to the pool, if it is from the pool,
+// rather than a copy of one, or an event of another origin, such as a marker
+// of lost events. Neither it, nor its Event or Context, may be used after.
+func releaseContextEvent(event *ContextEvent) {
+	pooled := event.pooled
+	if pooled == nil || &pooled.ContextEvent != event {
+		return
+	}
+
+	*pooled = pooledContextEvent{}
+	contextEventPool.Put(pooled)
+}
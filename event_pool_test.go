@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func TestReleaseContextEvent(t *testing.T) {
+	line := strings.SplitN(mockReplayCapture, "\n", 2)[0]
+	event := newPooledContextEvent([]byte(line))
+	if event.Context == nil || event.Event == nil {
+		t.Fatalf("expected event with context, got %+v", event)
+	}
+	event.SourcePort = 44406
+
+	// A copy is not from the pool, so is not released
+	copied := *event
+	releaseContextEvent(&copied)
+	if event.SourcePort != 44406 {
+		t.Errorf("expected copy not to be released, got source port %d", event.SourcePort)
+	}
+
+	releaseContextEvent(event)
+	if event.pooled != nil || event.Event != nil || event.Context != nil {
+		t.Errorf("expected released event to be cleared, got %+v", event)
+	}
+
+	// Releasing again, or releasing an event not from the pool, does nothing
+	releaseContextEvent(event)
+	releaseContextEvent(new(ContextEvent))
+}
+
+func TestEventerEventPooling(t *testing.T) {
+	source := newReplaySource(strings.NewReader(mockReplayCapture), "", false)
+	eventer, err := newReplayEventer(source, &config{eventPooling: true})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	// Events returned by Event are copies, which outlive later events
+	first, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	second, err := eventer.EventWithContext()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if first.SourcePort != 44406 || first.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected first event to be intact, got %+v", first)
+	}
+
+	if second.OldState != tcpstate.StateEstablished {
+		t.Errorf("expected old state %q, got %q", tcpstate.StateEstablished, second.OldState)
+	}
+
+	eventer.Release(second)
+	if second.Event != nil {
+		t.Errorf("expected released event to be cleared, got %+v", second.Event)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// EventSource is a backend which observes the state changes of connections
+// other than through a tracefs instance, such as by polling sock_diag, and
+// returns them as events, decoded directly from what it observes. Only the
+// tracefs backend is a tracingInstance, which the Eventer enables, configures,
+// reads the lines of and recovers; every other backend is an event source, or,
+// if its input is already the lines of trace_pipe, a lineSource, which need
+// nothing of the Eventer but to be read.
+type eventSource interface {
+	// Open starts observing state changes, after which events are read.
+	open() error
+
+	// Event returns the next event, blocking until one is observed, the read
+	// deadline passes, in which case the error has os.ErrDeadlineExceeded in
+	// its chain, or the source is closed. Events lost by the source are
+	// returned as a *LostEventsError, and events of no interest as an error
+	// wrapping ErrIrrelevantEvent, after both of which events are read on.
+	event() (*ContextEvent, error)
+
+	sourceControl
+}
+
+// LineSource is a backend whose input is already the lines of trace_pipe,
+// captured or streamed elsewhere, such as a replayed capture, so the Eventer
+// parses them as it does those of a tracefs instance.
+type lineSource interface {
+	// Open returns the reader of the lines, which, as trace_pipe, returns only
+	// whole lines, so none are split when a read deadline passes.
+	open() (io.Reader, error)
+
+	// End returns the error with which reading fails once the lines are
+	// exhausted.
+	end() error
+
+	sourceControl
+}
+
+// SourceControl is what the Eventer needs of an event source or line source,
+// other than to read it.
+type sourceControl interface {
+	// SetReadDeadline sets the deadline of reads, which may be set while they
+	// wait. A zero value for t means they do not time out.
+	setReadDeadline(t time.Time) error
+
+	// KernelInfo describes the kernel, and whatever the source is attached to.
+	kernelInfo() (*KernelInfo, error)
+
+	// BufferStats returns the number of events read, and those lost.
+	bufferStats() (*BufferStats, error)
+
+	// Close stops reading, unblocking any read in progress.
+	close() error
+}
+
+// SourceDeadline is the read deadline of an event source, which may be set
+// while the source waits for events.
+type sourceDeadline struct {
+	deadline int64 // Accessed atomically, in Unix nanoseconds, or zero if none
+}
+
+func (d *sourceDeadline) set(t time.Time) {
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	atomic.StoreInt64(&d.deadline, deadline)
+}
+
+// Wait returns how long to wait for events, which is the timeout, unless the
+// deadline is sooner, or os.ErrDeadlineExceeded if the deadline has passed.
+func (d *sourceDeadline) wait(timeout time.Duration) (time.Duration, error) {
+	deadline := atomic.LoadInt64(&d.deadline)
+	if deadline == 0 {
+		return timeout, nil
+	}
+
+	untilDeadline := time.Until(time.Unix(0, deadline))
+	if untilDeadline <= 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if untilDeadline < timeout {
+		return untilDeadline, nil
+	}
+
+	return timeout, nil
+}
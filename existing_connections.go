@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// The columns of /proc/net/tcp and /proc/net/tcp6 which describe a socket.
+const (
+	procNetTCPLocalAddressColumn  = 1
+	procNetTCPRemoteAddressColumn = 2
+	procNetTCPStateColumn         = 3
+	procNetTCPInodeColumn         = 9
+)
+
+// ProcNetTCPSocket is a socket listed by /proc/net/tcp or /proc/net/tcp6.
+type procNetTCPSocket struct {
+	saddr, daddr net.IP
+	sport, dport uint16
+	state        uint8
+	inode        uint32
+}
+
+// ReadExistingConnections returns the TCP sockets of the network namespace in
+// proc when called, as events of the KindExisting kind, so that connections
+// established before the eventer attached are known. The task owning each
+// socket is found among the file descriptors in proc, if it can be. Sockets in
+// states with no mapping, such as TCP_NEW_SYN_RECV, are skipped. A missing
+// /proc/net/tcp6, as where IPv6 is disabled, is not an error.
+func readExistingConnections(procPath string) ([]*ContextEvent, error) {
+	now := time.Now().UTC()
+
+	var sockets []*procNetTCPSocket
+	for _, table := range []struct {
+		name string
+		ipv6 bool
+	}{
+		{"tcp", false},
+		{"tcp6", true},
+	} {
+		file, err := os.Open(procPath + "/net/" + table.name)
+		if err != nil {
+			if table.ipv6 && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, fmt.Errorf("opening %s socket table: %w", table.name, err)
+		}
+
+		tableSockets, err := parseProcNetTCP(file, table.ipv6)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s socket table: %w", table.name, err)
+		}
+		sockets = append(sockets, tableSockets...)
+	}
+
+	inodes := make([]uint32, 0, len(sockets))
+	for _, socket := range sockets {
+		inodes = append(inodes, socket.inode)
+	}
+	owners := findSocketOwners(procPath, inodes)
+
+	events := make([]*ContextEvent, 0, len(sockets))
+	for _, socket := range sockets {
+		state, _, err := canonicaliseState(kernelTCPState(socket.state))
+		if err != nil {
+			continue
+		}
+
+		existing := &event.Event{
+			Time:       now,
+			SourceIP:   socket.saddr,
+			DestIP:     socket.daddr,
+			SourcePort: socket.sport,
+			DestPort:   socket.dport,
+			OldState:   state,
+			NewState:   state,
+		}
+		if owner, ok := owners[socket.inode]; ok {
+			existing.PIDOnCPU, existing.CommandOnCPU = owner.pid, owner.comm
+		}
+
+		events = append(events, &ContextEvent{Event: existing, Kind: KindExisting})
+	}
+
+	return events, nil
+}
+
+// ParseProcNetTCP parses the sockets of the table of /proc/net/tcp, or of
+// /proc/net/tcp6 if ipv6, following its header line.
+func parseProcNetTCP(reader io.Reader, ipv6 bool) ([]*procNetTCPSocket, error) {
+	scanner := bufio.NewScanner(reader)
+	if !scanner.Scan() { // Skip the header
+		return nil, scanner.Err()
+	}
+
+	var sockets []*procNetTCPSocket
+	for scanner.Scan() {
+		columns := strings.Fields(scanner.Text())
+		if len(columns) <= procNetTCPInodeColumn {
+			return nil, fmt.Errorf("truncated socket line %q", scanner.Text())
+		}
+
+		saddr, sport, err := parseProcNetTCPAddress(columns[procNetTCPLocalAddressColumn], ipv6)
+		if err != nil {
+			return nil, fmt.Errorf("parsing local address: %w", err)
+		}
+
+		daddr, dport, err := parseProcNetTCPAddress(columns[procNetTCPRemoteAddressColumn], ipv6)
+		if err != nil {
+			return nil, fmt.Errorf("parsing remote address: %w", err)
+		}
+
+		state, err := strconv.ParseUint(columns[procNetTCPStateColumn], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("parsing state: %w", err)
+		}
+
+		inode, err := strconv.ParseUint(columns[procNetTCPInodeColumn], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing inode: %w", err)
+		}
+
+		sockets = append(sockets, &procNetTCPSocket{
+			saddr: saddr,
+			daddr: daddr,
+			sport: sport,
+			dport: dport,
+			state: uint8(state),
+			inode: uint32(inode),
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sockets, nil
+}
+
+// ParseProcNetTCPAddress parses an address and port of the form
+// `0100007F:0035`. The address is printed as a sequence of 32-bit words in
+// host byte order, each of which holds four bytes of the address in network
+// byte order.
+func parseProcNetTCPAddress(field string, ipv6 bool) (net.IP, uint16, error) {
+	colon := strings.IndexByte(field, ':')
+	if colon == -1 {
+		return nil, 0, fmt.Errorf("no port in address %q", field)
+	}
+
+	length := net.IPv4len
+	if ipv6 {
+		length = net.IPv6len
+	}
+
+	words, err := hex.DecodeString(field[:colon])
+	if err != nil || len(words) != length {
+		return nil, 0, fmt.Errorf("invalid address %q", field)
+	}
+
+	ip := make(net.IP, length)
+	for i := 0; i < length; i += 4 {
+		hostByteOrder.PutUint32(ip[i:], binary.BigEndian.Uint32(words[i:]))
+	}
+
+	port, err := strconv.ParseUint(field[colon+1:], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port in address %q: %w", field, err)
+	}
+
+	return ip, uint16(port), nil
+}
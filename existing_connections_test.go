@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// NewMockProcNetTCPAddress returns the address and port as printed by
+// /proc/net/tcp and /proc/net/tcp6, in words of host byte order.
+func newMockProcNetTCPAddress(ip net.IP, port uint16) string {
+	var words strings.Builder
+	for i := 0; i < len(ip); i += 4 {
+		fmt.Fprintf(&words, "%08X", hostByteOrder.Uint32(ip[i:]))
+	}
+
+	return fmt.Sprintf("%s:%04X", words.String(), port)
+}
+
+func newMockProcNetTCP(ipv6 bool, state uint8, inode uint32) string {
+	saddr, daddr := net.IP(net.IPv4(192, 168, 122, 38).To4()), net.IP(net.IPv4(172, 217, 169, 4).To4())
+	if ipv6 {
+		saddr, daddr = net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	}
+
+	return "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n" +
+		fmt.Sprintf("   0: %s %s %02X 00000000:00000000 00:00000000 00000000     0        0 %d 1 0000000000000000 20 4 30 10 -1\n",
+			newMockProcNetTCPAddress(saddr, 44406),
+			newMockProcNetTCPAddress(daddr, 80),
+			state,
+			inode)
+}
+
+func TestParseProcNetTCPAddress(t *testing.T) {
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1).To4(), net.ParseIP("2001:db8::1")} {
+		ipv6 := len(ip) == net.IPv6len
+		parsedIP, port, err := parseProcNetTCPAddress(newMockProcNetTCPAddress(ip, 53), ipv6)
+		if err != nil {
+			t.Errorf("expected nil error, got %q (of type %T)", err, err)
+			continue
+		}
+
+		if !parsedIP.Equal(ip) || port != 53 {
+			t.Errorf("expected %v:53, got %v:%d", ip, parsedIP, port)
+		}
+	}
+}
+
+func TestParseProcNetTCPAddressInvalidError(t *testing.T) {
+	for _, field := range []string{"0100007F", "0100007:0035", "0100007F:XYZ", "0100007F0100007F:0035"} {
+		_, _, err := parseProcNetTCPAddress(field, false)
+		if err == nil {
+			t.Errorf("expected error for %q, got nil", field)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestParseProcNetTCP(t *testing.T) {
+	sockets, err := parseProcNetTCP(strings.NewReader(newMockProcNetTCP(true, 1, 12345)), true)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(sockets) != 1 {
+		t.Fatalf("expected 1 socket, got %d", len(sockets))
+	}
+
+	socket := sockets[0]
+	if !socket.saddr.Equal(net.ParseIP("2001:db8::1")) || socket.sport != 44406 ||
+		!socket.daddr.Equal(net.ParseIP("2001:db8::2")) || socket.dport != 80 ||
+		socket.state != 1 || socket.inode != 12345 {
+		t.Errorf("expected established socket 12345 of [2001:db8::1]:44406 to [2001:db8::2]:80, got %+v", socket)
+	}
+}
+
+func TestParseProcNetTCPTruncatedError(t *testing.T) {
+	_, err := parseProcNetTCP(strings.NewReader("header\n   0: 0100007F:0035 00000000:0000 0A\n"), false)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestReadExistingConnections(t *testing.T) {
+	procPath, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer os.RemoveAll(procPath)
+
+	if err := os.Mkdir(filepath.Join(procPath, "net"), 0755); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	// No tcp6 table, as where IPv6 is disabled
+	if err := ioutil.WriteFile(filepath.Join(procPath, "net", "tcp"), []byte(newMockProcNetTCP(false, 1, 12345)), 0644); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	events, err := readExistingConnections(procPath)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+
+	existing := events[0]
+	if existing.Kind != KindExisting {
+		t.Errorf("expected kind %v, got %v", KindExisting, existing.Kind)
+	}
+
+	if existing.OldState != tcpstate.StateEstablished || existing.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected established, got from %v to %v", existing.OldState, existing.NewState)
+	}
+
+	if existing.SourcePort != 44406 || existing.DestPort != 80 {
+		t.Errorf("expected ports 44406 and 80, got %d and %d", existing.SourcePort, existing.DestPort)
+	}
+}
+
+func TestReadExistingConnectionsMissingTableError(t *testing.T) {
+	_, err := readExistingConnections("/non/existent/proc")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
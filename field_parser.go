@@ -21,69 +21,139 @@ var errEmptyField = errors.New("empty field")
 // into their component fields, advancing the position of the provided stream in the
 // provided stream to after the returned field(s).
 type fieldParser interface {
-	nextField(str *[]byte, sep []byte, expectMoreFields bool) (string, error)
-	getTaggedFields(str *[]byte) (map[string]string, error)
+	nextField(str *[]byte, sep []byte, expectMoreFields bool) ([]byte, error)
+	skipField(str *[]byte, sep []byte) error
+	getTaggedFields(str *[]byte) (taggedFields, error)
+	fillTaggedFields(str *[]byte, fields *taggedFields) error
+}
+
+// TaggedField is a field of the form `tag=value`, of which the tag and value are
+// slices of the stream from which it was parsed.
+type taggedField struct {
+	tag, value []byte
+}
+
+// TaggedFields are the tagged fields of a stream, in the order in which they
+// appear. Events have few tagged fields, so they are looked up by comparing
+// their tags with the name of the tag sought, rather than through a map, so
+// that neither they nor their tags and values are allocated. As their tags and
+// values are slices of the stream, they are only valid while the stream is.
+type taggedFields []taggedField
+
+// Get returns the value of the tag, and whether it is present. If the tag is
+// repeated, its last value is returned.
+func (tf taggedFields) get(tag string) ([]byte, bool) {
+	for i := len(tf) - 1; i >= 0; i-- {
+		if string(tf[i].tag) == tag {
+			return tf[i].value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Set replaces the value of the tag, if present, or otherwise adds it.
+func (tf *taggedFields) set(tag string, value []byte) {
+	for i := len(*tf) - 1; i >= 0; i-- {
+		if string((*tf)[i].tag) == tag {
+			(*tf)[i].value = value
+			return
+		}
+	}
+
+	*tf = append(*tf, taggedField{tag: []byte(tag), value: value})
 }
 
 // SlicingFieldParser parses byte slices/"streams" into their component fields, advancing
 // the position of the provided stream in the provided stream to after the returned field(s).
-// Fields are extracted using byte-slicing techniques.
+// Fields are extracted using byte-slicing techniques, so are slices of the stream, and are
+// not allocated.
 type slicingFieldParser struct{}
 
 // NextField returns the next field in the stream, the end of the field being delimited by the
 // bytes supplied in sep. If sep is not found, then the field is assumed to continue to the end
 // of the stream, unless expectMoreFields is true, in which case io.ErrUnexpectedEOF is returned.
-func (*slicingFieldParser) nextField(str *[]byte, sep []byte, expectMoreFields bool) (field string, err error) {
-	defer panicToErr("parsing next field", &err) // Catch any unexpected slicing errors without panicking
-
+// The field is a slice of the stream, so must be copied if it is to outlive it.
+func (*slicingFieldParser) nextField(str *[]byte, sep []byte, expectMoreFields bool) ([]byte, error) {
 	if len(*str) == 0 { // There can't be a field if there is no more data!
-		return "", io.ErrUnexpectedEOF
+		return nil, io.ErrUnexpectedEOF
 	}
 
 	idx := bytes.Index(*str, sep)
 	if idx == -1 {
 		if expectMoreFields {
-			return "", io.ErrUnexpectedEOF
+			return nil, io.ErrUnexpectedEOF
 		}
 
 		// If the next seperator is not found, assume that the next token is the last in the str
-		field = string((*str)[:len(*str)])
+		field := *str
 		*str = (*str)[len(*str):] // Consume the bytes from the stream just for parity with the other case
 		return field, io.EOF
 	}
 
-	field = string((*str)[:idx])
+	field := (*str)[:idx]
 	*str = (*str)[idx+len(sep):] // Consume the bytes from the stream so the next read begins after this field
 
 	if len(field) == 0 {
-		return "", errEmptyField
+		return nil, errEmptyField
 	}
 
 	return field, nil
 }
 
-// GetTaggedFields returns a map representing a set of tagged fields, the definition of a tagged
+// SkipField advances the stream past the next field, the end of the field being delimited by
+// the bytes supplied in sep, without allocating it. As more fields are expected to follow,
+// io.ErrUnexpectedEOF is returned if sep is not found.
+func (*slicingFieldParser) skipField(str *[]byte, sep []byte) error {
+	if len(*str) == 0 { // There can't be a field if there is no more data!
+		return io.ErrUnexpectedEOF
+	}
+
+	idx := bytes.Index(*str, sep)
+	if idx == -1 {
+		return io.ErrUnexpectedEOF
+	}
+	*str = (*str)[idx+len(sep):] // Consume the bytes from the stream so the next read begins after this field
+
+	if idx == 0 {
+		return errEmptyField
+	}
+
+	return nil
+}
+
+// GetTaggedFields returns the set of tagged fields of the stream, the definition of a tagged
 // field being one in the form of `key=value`. The stream is expected to consist entirely of space-
 // separated tagged fields, otherwise an error is returned.
-func (fp *slicingFieldParser) getTaggedFields(str *[]byte) (map[string]string, error) {
-	fields := make(map[string]string, 20)
+func (fp *slicingFieldParser) getTaggedFields(str *[]byte) (taggedFields, error) {
+	var fields taggedFields
+	if err := fp.fillTaggedFields(str, &fields); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+// FillTaggedFields is as getTaggedFields, but appends the tagged fields to those supplied, so
+// that their storage can be reused between streams. The tags and values are slices of the
+// stream, so nothing is allocated once the storage has grown to the number of tagged fields.
+// If the stream is damaged, the tagged fields before the damage are appended.
+func (fp *slicingFieldParser) fillTaggedFields(str *[]byte, fields *taggedFields) error {
 	for {
 		nextTag, err := fp.nextField(str, equalsBytes, true) // Expect at least a value after the tag
 		if err != nil {
-			return nil, fmt.Errorf("parsing next tag: %w", err)
+			return fmt.Errorf("parsing next tag: %w", err)
 		}
 
 		nextValue, err := fp.nextField(str, spaceBytes, false) // We cannot expect any more fields as this may be the last
 		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("parsing next tagged value: %w", err)
+			return fmt.Errorf("parsing next tagged value: %w", err)
 		}
 
-		fields[nextTag] = nextValue
+		*fields = append(*fields, taggedField{tag: nextTag, value: nextValue})
 
 		if err == io.EOF { // No more fields in stream
-			break
+			return nil
 		}
 	}
-
-	return fields, nil
 }
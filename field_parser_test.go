@@ -14,27 +14,27 @@ func TestGetTaggedFields(t *testing.T) {
 		t.Errorf("expected nil error, got %v (of type %T)", err, err)
 	}
 
-	foo, ok := fields["foo"]
+	foo, ok := fields.get("foo")
 	if !ok {
 		t.Errorf("expected %q to be present in map, but was not", "foo")
 	}
-	if foo != "hello" {
+	if string(foo) != "hello" {
 		t.Errorf("expected %q key to have %q value in map, but was %q", "foo", "hello", foo)
 	}
 
-	bar, ok := fields["bar"]
+	bar, ok := fields.get("bar")
 	if !ok {
 		t.Errorf("expected %q to be present in map, but was not", "bar")
 	}
-	if bar != "world" {
+	if string(bar) != "world" {
 		t.Errorf("expected %q key to have %q value in map, but was %q", "bar", "world", bar)
 	}
 
-	baz, ok := fields["baz"]
+	baz, ok := fields.get("baz")
 	if !ok {
 		t.Errorf("expected %q to be present in map, but was not", "baz")
 	}
-	if baz != "123" {
+	if string(baz) != "123" {
 		t.Errorf("expected %q key to have %q value in map, but was %q", "baz", "123", baz)
 	}
 
@@ -101,7 +101,7 @@ func TestGetSeperatedFields(t *testing.T) {
 		t.Errorf("expected nil error, got %v (of type %T)", err, err)
 	}
 
-	if field != "foo" {
+	if string(field) != "foo" {
 		t.Errorf("expected %q field, but got %q", "foo", field)
 	}
 
@@ -110,7 +110,7 @@ func TestGetSeperatedFields(t *testing.T) {
 		t.Errorf("expected nil error, got %v (of type %T)", err, err)
 	}
 
-	if field != "bar" {
+	if string(field) != "bar" {
 		t.Errorf("expected %q field, but got %q", "bar", field)
 	}
 
@@ -124,7 +124,7 @@ func TestGetSeperatedFields(t *testing.T) {
 		t.Errorf("expected EOF error, got %v (of type %T)", err, err)
 	}
 
-	if field != "baz" {
+	if string(field) != "baz" {
 		t.Errorf("expected %q field, but got %q", "baz", field)
 	}
 }
@@ -159,7 +159,129 @@ func TestSkipSeperatedField(t *testing.T) {
 		t.Errorf("expected EOF error, got %v (of type %T)", err, err)
 	}
 
-	if field != "bar" {
+	if string(field) != "bar" {
 		t.Errorf("expected %q field, but got %q", "bar", field)
 	}
 }
+
+func TestSkipField(t *testing.T) {
+	mockStream := []byte("foo bar")
+
+	fieldParser := new(slicingFieldParser)
+	if err := fieldParser.skipField(&mockStream, []byte(" ")); err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if string(mockStream) != "bar" {
+		t.Errorf("expected remaining stream %q, but got %q", "bar", mockStream)
+	}
+}
+
+func TestSkipFieldNoFieldFollowsError(t *testing.T) {
+	mockStream := []byte("foo")
+
+	fieldParser := new(slicingFieldParser)
+	err := fieldParser.skipField(&mockStream, []byte(" "))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %q error, got %v (of type %T)", io.ErrUnexpectedEOF, err, err)
+	}
+}
+
+func TestSkipFieldEmptyFieldError(t *testing.T) {
+	mockStream := []byte(" foo")
+
+	fieldParser := new(slicingFieldParser)
+	err := fieldParser.skipField(&mockStream, []byte(" "))
+	if err != errEmptyField {
+		t.Errorf("expected %q error, got %v (of type %T)", errEmptyField, err, err)
+	}
+}
+
+func TestSkipFieldDoesNotAllocate(t *testing.T) {
+	mockLine := []byte("(tcp_set_state+0x0/0x240) family=2")
+	fieldParser := new(slicingFieldParser)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		mockStream := mockLine
+		fieldParser.skipField(&mockStream, spaceBytes)
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestFillTaggedFieldsReusedDoesNotAllocate(t *testing.T) {
+	mockTags := []byte("family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	fields := make(taggedFields, 0, 20)
+
+	// The tags and values are slices of the stream, so nothing is allocated
+	allocs := testing.AllocsPerRun(100, func() {
+		mockStream := mockTags
+		fields = fields[:0]
+		if err := fieldParser.fillTaggedFields(&mockStream, &fields); err != nil {
+			t.Errorf("expected nil error, got %v (of type %T)", err, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+
+	if newState, _ := fields.get("newstate"); string(newState) != "TCP_ESTABLISHED" {
+		t.Errorf("expected %q key to have %q value, but was %q", "newstate", "TCP_ESTABLISHED", newState)
+	}
+}
+
+func TestTaggedFieldsSet(t *testing.T) {
+	mockTags := []byte("foo=hello foo=world")
+
+	fieldParser := new(slicingFieldParser)
+	fields, err := fieldParser.getTaggedFields(&mockTags)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	// The last value of a repeated tag is that of the tag
+	if foo, _ := fields.get("foo"); string(foo) != "world" {
+		t.Errorf("expected %q key to have %q value, but was %q", "foo", "world", foo)
+	}
+
+	fields.set("foo", []byte("there"))
+	fields.set("bar", []byte("baz"))
+	if foo, _ := fields.get("foo"); string(foo) != "there" {
+		t.Errorf("expected %q key to have %q value, but was %q", "foo", "there", foo)
+	}
+
+	if bar, ok := fields.get("bar"); !ok || string(bar) != "baz" {
+		t.Errorf("expected %q key to have %q value, but was %q", "bar", "baz", bar)
+	}
+
+	if _, ok := fields.get("baz"); ok {
+		t.Errorf("expected %q not to be present, but was", "baz")
+	}
+}
+
+// BenchmarkFillTaggedFields reports the allocations of extracting the tagged
+// fields of an event into reused storage, of which there must be none.
+func BenchmarkFillTaggedFields(b *testing.B) {
+	mockTags := []byte("family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	fields := make(taggedFields, 0, 20)
+	fill := func() {
+		mockStream := mockTags
+		fields = fields[:0]
+		if err := fieldParser.fillTaggedFields(&mockStream, &fields); err != nil {
+			b.Fatalf("expected nil error, got %v (of type %T)", err, err)
+		}
+	}
+
+	if allocs := testing.AllocsPerRun(100, fill); allocs != 0 {
+		b.Fatalf("expected 0 allocs/op, got %v", allocs)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fill()
+	}
+}
@@ -0,0 +1,856 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExprType is the type of the value of an expression.
+type exprType int
+
+const (
+	exprTypeBool exprType = iota
+	exprTypeInt
+	exprTypeString
+	exprTypeIntList
+	exprTypeStringList
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprTypeBool:
+		return "bool"
+	case exprTypeInt:
+		return "int"
+	case exprTypeString:
+		return "string"
+	case exprTypeIntList:
+		return "list(int)"
+	default:
+		return "list(string)"
+	}
+}
+
+// ListOf returns the type of a list of the type, if it can be listed.
+func (t exprType) listOf() (exprType, bool) {
+	switch t {
+	case exprTypeInt:
+		return exprTypeIntList, true
+	case exprTypeString:
+		return exprTypeStringList, true
+	default:
+		return 0, false
+	}
+}
+
+// ExprNode is a compiled expression, which evaluates to a bool, int64, string
+// or, for lists, a set of either, of its type. If constant, its value is the
+// same for every event.
+type exprNode struct {
+	typ      exprType
+	eval     func(event *ContextEvent) interface{}
+	constant bool
+
+	field     string      // The name of the field, if a reference to one
+	conjuncts []*exprNode // The operands of a chain of &&, if one
+	ftrace    string      // The equivalent ftrace filter of the event tracepoint, if any
+}
+
+// ExprField is a field of an event which may be referenced in an expression.
+type exprField struct {
+	typ exprType
+	get func(event *ContextEvent) interface{}
+}
+
+// ExprFields are the fields of events, by name.
+var exprFields = map[string]*exprField{
+	"kind":        {exprTypeString, func(e *ContextEvent) interface{} { return e.Kind.String() }},
+	"pid":         {exprTypeInt, func(e *ContextEvent) interface{} { return int64(e.PIDOnCPU) }},
+	"command":     {exprTypeString, func(e *ContextEvent) interface{} { return e.CommandOnCPU }},
+	"source_ip":   {exprTypeString, func(e *ContextEvent) interface{} { return exprIP(e.SourceIP) }},
+	"dest_ip":     {exprTypeString, func(e *ContextEvent) interface{} { return exprIP(e.DestIP) }},
+	"source_port": {exprTypeInt, func(e *ContextEvent) interface{} { return int64(e.SourcePort) }},
+	"dest_port":   {exprTypeInt, func(e *ContextEvent) interface{} { return int64(e.DestPort) }},
+	"old_state":   {exprTypeString, func(e *ContextEvent) interface{} { return string(e.OldState) }},
+	"new_state":   {exprTypeString, func(e *ContextEvent) interface{} { return string(e.NewState) }},
+	"idle":        {exprTypeBool, func(e *ContextEvent) interface{} { return e.Idle }},
+	"inferred":    {exprTypeBool, func(e *ContextEvent) interface{} { return e.Inferred }},
+	"netns":       {exprTypeInt, func(e *ContextEvent) interface{} { return int64(e.NetNS) }},
+	"direction":   {exprTypeString, func(e *ContextEvent) interface{} { return e.Direction.String() }},
+	"role":        {exprTypeString, func(e *ContextEvent) interface{} { return e.Role.String() }},
+	"source_host": {exprTypeString, func(e *ContextEvent) interface{} { return e.SourceHost }},
+	"dest_host":   {exprTypeString, func(e *ContextEvent) interface{} { return e.DestHost }},
+	"country":     {exprTypeString, func(e *ContextEvent) interface{} { return e.RemoteCountry }},
+	"asn":         {exprTypeInt, func(e *ContextEvent) interface{} { return int64(e.RemoteASN) }},
+	"as_org":      {exprTypeString, func(e *ContextEvent) interface{} { return e.RemoteASOrg }},
+	"cpu": {exprTypeInt, func(e *ContextEvent) interface{} {
+		if e.Context == nil {
+			return int64(-1)
+		}
+		return int64(e.Context.CPU)
+	}},
+}
+
+// ExprIP returns the address as a string, or empty if it is not known.
+func exprIP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	return ip.String()
+}
+
+// FilterExpression is a compiled filter expression, in a subset of the Common
+// Expression Language (CEL), such as
+//
+//	dest_port in [443, 8443] && new_state == "ESTABLISHED" && !cidr(dest_ip, "10.0.0.0/8")
+//
+// of the fields of exprFields, int, string and bool literals, lists of int or
+// string literals, the operators ||, &&, !, -, ==, !=, <, <=, >, >= and in,
+// the cidr(ip, "<cidr>") function, and the contains, startsWith, endsWith and
+// matches string methods. Expressions are type-checked when compiled. It is
+// not modified once compiled, so is safe for concurrent use.
+type filterExpression struct {
+	root      *exprNode
+	conjuncts []*exprNode // The operands of the top-level &&, or the root
+
+	// If offloaded, the events of the event tracepoint, which the kernel has
+	// already filtered by the offloaded conjuncts, need only satisfy the rest
+	offloaded bool
+	residual  []*exprNode
+}
+
+// CompileFilterExpression compiles the expression, which must be of type bool.
+func compileFilterExpression(src string) (*filterExpression, error) {
+	tokens, err := tokenizeExpression(src)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &exprParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := parser.peek(); token.kind != exprTokenEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", token.text, token.pos)
+	}
+
+	if root.typ != exprTypeBool {
+		return nil, fmt.Errorf("expression of type %v, not bool", root.typ)
+	}
+
+	conjuncts := root.conjuncts
+	if conjuncts == nil {
+		conjuncts = []*exprNode{root}
+	}
+
+	return &filterExpression{root: root, conjuncts: conjuncts}, nil
+}
+
+// Passes returns whether the expression is true of the event. Markers of lost
+// events always pass.
+func (f *filterExpression) passes(event *ContextEvent) bool {
+	if event.Kind == KindLostEvents {
+		return true
+	}
+
+	if !f.offloaded || event.Kind != KindStateChange {
+		return f.root.eval(event).(bool)
+	}
+
+	for _, conjunct := range f.residual {
+		if !conjunct.eval(event).(bool) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Offload returns the ftrace filter of the event tracepoint equivalent to the
+// top-level conjuncts of the expression which it can express, if any, and the
+// expression to evaluate once the kernel filters state changes by it. The
+// ftrace filter can express comparisons of the ports and PID with ints, and
+// of the states for equality, by the kernel values of those mapped to them,
+// including membership of lists of literals.
+func (f *filterExpression) offload() (string, *filterExpression) {
+	var filters []string
+	residual := &filterExpression{root: f.root, conjuncts: f.conjuncts, offloaded: true}
+	for _, conjunct := range f.conjuncts {
+		if conjunct.ftrace == "" {
+			residual.residual = append(residual.residual, conjunct)
+			continue
+		}
+		filters = append(filters, conjunct.ftrace)
+	}
+
+	if len(filters) == 0 {
+		return "", f
+	}
+
+	return strings.Join(filters, " && "), residual
+}
+
+// FtraceFields are the fields of the event tracepoint, by the fields of
+// expressions which can be offloaded to them.
+var ftraceFields = map[string]string{
+	"source_port": "sport",
+	"dest_port":   "dport",
+	"pid":         "common_pid",
+	"old_state":   "oldstate",
+	"new_state":   "newstate",
+}
+
+// FtraceComparison returns the ftrace filter of the comparison of the field
+// and the constant, if it can express it.
+func ftraceComparison(op string, field, constant *exprNode) string {
+	ftraceField, ok := ftraceFields[field.field]
+	if !ok || !constant.constant {
+		return ""
+	}
+
+	switch value := constant.eval(nil).(type) {
+	case int64:
+		if value < 0 {
+			return ""
+		}
+		return fmt.Sprintf("%s %s %d", ftraceField, op, value)
+	case string:
+		// States are printed by the tracepoint from their kernel values
+		if op != "==" && op != "!=" {
+			return ""
+		}
+		return ftraceStateMembership(ftraceField, map[interface{}]bool{value: true}, op == "!=")
+	default:
+		return ""
+	}
+}
+
+// FtraceMembership returns the ftrace filter of whether the field is in the
+// set, if it can express it.
+func ftraceMembership(field *exprNode, set map[interface{}]bool) string {
+	ftraceField, ok := ftraceFields[field.field]
+	if !ok || len(set) == 0 {
+		return ""
+	}
+
+	if field.typ == exprTypeString {
+		return ftraceStateMembership(ftraceField, set, false)
+	}
+
+	values := make([]int64, 0, len(set))
+	for value := range set {
+		if value.(int64) < 0 {
+			return ""
+		}
+		values = append(values, value.(int64))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	terms := make([]string, 0, len(values))
+	for _, value := range values {
+		terms = append(terms, fmt.Sprintf("%s == %d", ftraceField, value))
+	}
+
+	return ftraceJoin(terms, " || ")
+}
+
+// FtraceStateMembership returns the ftrace filter of whether the state field
+// is, or, if negated, is not, of the kernel values of the states of the set,
+// as currently mapped, or empty if none are.
+func ftraceStateMembership(ftraceField string, set map[interface{}]bool, negated bool) string {
+	var values []int
+	for value, kernelState := range kernelTCPStates {
+		if state, unknown, err := canonicaliseState(kernelState); err == nil && !unknown && set[string(state)] {
+			values = append(values, int(value))
+		}
+	}
+
+	if len(values) == 0 {
+		return ""
+	}
+	sort.Ints(values)
+
+	op, join := "==", " || "
+	if negated {
+		op, join = "!=", " && "
+	}
+
+	terms := make([]string, 0, len(values))
+	for _, value := range values {
+		terms = append(terms, fmt.Sprintf("%s %s %d", ftraceField, op, value))
+	}
+
+	return ftraceJoin(terms, join)
+}
+
+// FtraceJoin joins the terms of an ftrace filter by the operator, in
+// parentheses if more than one, so that the filter can be a conjunct.
+func ftraceJoin(terms []string, join string) string {
+	if len(terms) == 1 {
+		return terms[0]
+	}
+
+	return "(" + strings.Join(terms, join) + ")"
+}
+
+// ExprTokenKind is the kind of a token of an expression.
+type exprTokenKind int
+
+const (
+	exprTokenEOF exprTokenKind = iota
+	exprTokenIdent
+	exprTokenInt
+	exprTokenString
+	exprTokenPunct
+)
+
+// ExprToken is a token of an expression, at its byte offset. The text of a
+// string token is its unquoted value.
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	pos  int
+}
+
+// ExprPuncts are the punctuation tokens, longest first.
+var exprPuncts = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "-", "(", ")", "[", "]", ",", "."}
+
+func tokenizeExpression(src string) ([]exprToken, error) {
+	var tokens []exprToken
+
+	for pos := 0; pos < len(src); {
+		c := src[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			end := pos + 1
+			for end < len(src) && (src[end] == '_' ||
+				src[end] >= 'a' && src[end] <= 'z' ||
+				src[end] >= 'A' && src[end] <= 'Z' ||
+				src[end] >= '0' && src[end] <= '9') {
+				end++
+			}
+			tokens = append(tokens, exprToken{exprTokenIdent, src[pos:end], pos})
+			pos = end
+		case c >= '0' && c <= '9':
+			end := pos + 1
+			for end < len(src) && src[end] >= '0' && src[end] <= '9' {
+				end++
+			}
+			tokens = append(tokens, exprToken{exprTokenInt, src[pos:end], pos})
+			pos = end
+		case c == '"' || c == '\'':
+			value, end, err := unquoteExpressionString(src, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, exprToken{exprTokenString, value, pos})
+			pos = end
+		default:
+			punct := ""
+			for _, p := range exprPuncts {
+				if strings.HasPrefix(src[pos:], p) {
+					punct = p
+					break
+				}
+			}
+
+			if punct == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, pos)
+			}
+			tokens = append(tokens, exprToken{exprTokenPunct, punct, pos})
+			pos += len(punct)
+		}
+	}
+
+	return append(tokens, exprToken{exprTokenEOF, "end of expression", len(src)}), nil
+}
+
+// UnquoteExpressionString returns the value of the string literal at the
+// offset, and the offset after its closing quote.
+func unquoteExpressionString(src string, start int) (string, int, error) {
+	quote := src[start]
+	var value strings.Builder
+
+	for pos := start + 1; pos < len(src); pos++ {
+		c := src[pos]
+		switch {
+		case c == quote:
+			return value.String(), pos + 1, nil
+		case c == '\\':
+			if pos++; pos == len(src) {
+				break
+			}
+
+			switch src[pos] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case '\\', '"', '\'':
+				value.WriteByte(src[pos])
+			default:
+				return "", 0, fmt.Errorf("invalid escape \\%c at %d", src[pos], pos-1)
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated string at %d", start)
+}
+
+// ExprParser compiles the tokens of an expression by recursive descent, the
+// precedence of its operators being that of CEL.
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != exprTokenEOF {
+		p.pos++
+	}
+
+	return token
+}
+
+// Accept consumes the next token if it is the punctuation.
+func (p *exprParser) accept(punct string) bool {
+	if token := p.peek(); token.kind == exprTokenPunct && token.text == punct {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *exprParser) expect(punct string) error {
+	if token := p.peek(); !p.accept(punct) {
+		return fmt.Errorf("expected %q at %d, got %q", punct, token.pos, token.text)
+	}
+
+	return nil
+}
+
+func (p *exprParser) parseOr() (*exprNode, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *exprParser) parseAnd() (*exprNode, error) {
+	return p.parseLogical("&&", p.parseRelation)
+}
+
+// ParseLogical parses a chain of the short-circuiting operator of operands
+// parsed by parseOperand.
+func (p *exprParser) parseLogical(op string, parseOperand func() (*exprNode, error)) (*exprNode, error) {
+	left, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		token := p.peek()
+		if !p.accept(op) {
+			return left, nil
+		}
+
+		right, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		if left.typ != exprTypeBool || right.typ != exprTypeBool {
+			return nil, fmt.Errorf("%s of %v and %v at %d", op, left.typ, right.typ, token.pos)
+		}
+
+		l, r := left.eval, right.eval
+		if op == "&&" {
+			conjuncts := left.conjuncts
+			if conjuncts == nil {
+				conjuncts = []*exprNode{left}
+			}
+
+			left = &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+				return l(e).(bool) && r(e).(bool)
+			}, conjuncts: append(conjuncts, right)}
+		} else {
+			left = &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+				return l(e).(bool) || r(e).(bool)
+			}}
+		}
+	}
+}
+
+func (p *exprParser) parseRelation() (*exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	token := p.peek()
+	op := token.text
+	switch {
+	case token.kind == exprTokenIdent && op == "in":
+	case token.kind == exprTokenPunct &&
+		(op == "==" || op == "!=" || op == "<" || op == "<=" || op == ">" || op == ">="):
+	default:
+		return left, nil
+	}
+	p.next()
+
+	right, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if op == "in" {
+		return newInNode(left, right, token.pos)
+	}
+
+	return newComparisonNode(op, left, right, token.pos)
+}
+
+// NewInNode returns the node of whether the left is in the right list.
+func newInNode(left, right *exprNode, pos int) (*exprNode, error) {
+	// An empty list literal contains nothing of any type
+	listType, ok := left.typ.listOf()
+	empty := right.constant && (right.typ == exprTypeIntList || right.typ == exprTypeStringList) &&
+		len(right.eval(nil).(map[interface{}]bool)) == 0
+	if !ok || (right.typ != listType && !empty) {
+		return nil, fmt.Errorf("in of %v and %v at %d", left.typ, right.typ, pos)
+	}
+
+	l := left.eval
+	if right.constant {
+		set := right.eval(nil).(map[interface{}]bool)
+		return &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+			return set[l(e)]
+		}, ftrace: ftraceMembership(left, set)}, nil
+	}
+
+	r := right.eval
+	return &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+		return r(e).(map[interface{}]bool)[l(e)]
+	}}, nil
+}
+
+// MirroredOps are the comparison operators of which the operands are swapped.
+var mirroredOps = map[string]string{"==": "==", "!=": "!=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// NewComparisonNode returns the node of the comparison of the left and right,
+// which must be of the same type, and, unless compared for equality, ints or
+// strings.
+func newComparisonNode(op string, left, right *exprNode, pos int) (*exprNode, error) {
+	if left.typ != right.typ ||
+		left.typ == exprTypeIntList || left.typ == exprTypeStringList ||
+		(left.typ == exprTypeBool && op != "==" && op != "!=") {
+		return nil, fmt.Errorf("%s of %v and %v at %d", op, left.typ, right.typ, pos)
+	}
+
+	// A constant on the left is compared by the mirror of the operator
+	ftrace := ftraceComparison(op, left, right)
+	if ftrace == "" {
+		ftrace = ftraceComparison(mirroredOps[op], right, left)
+	}
+
+	l, r := left.eval, right.eval
+	if op == "==" || op == "!=" {
+		equal := op == "=="
+		return &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+			return (l(e) == r(e)) == equal
+		}, ftrace: ftrace}, nil
+	}
+
+	// Ordering is by the sign of the comparison
+	var compare func(e *ContextEvent) int
+	if left.typ == exprTypeInt {
+		compare = func(e *ContextEvent) int {
+			a, b := l(e).(int64), r(e).(int64)
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			default:
+				return 0
+			}
+		}
+	} else {
+		compare = func(e *ContextEvent) int { return strings.Compare(l(e).(string), r(e).(string)) }
+	}
+
+	var holds func(c int) bool
+	switch op {
+	case "<":
+		holds = func(c int) bool { return c < 0 }
+	case "<=":
+		holds = func(c int) bool { return c <= 0 }
+	case ">":
+		holds = func(c int) bool { return c > 0 }
+	default:
+		holds = func(c int) bool { return c >= 0 }
+	}
+
+	return &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+		return holds(compare(e))
+	}, ftrace: ftrace}, nil
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	token := p.peek()
+	switch {
+	case p.accept("!"):
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		if operand.typ != exprTypeBool {
+			return nil, fmt.Errorf("! of %v at %d", operand.typ, token.pos)
+		}
+
+		o := operand.eval
+		return &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+			return !o(e).(bool)
+		}, constant: operand.constant}, nil
+	case p.accept("-"):
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		if operand.typ != exprTypeInt {
+			return nil, fmt.Errorf("- of %v at %d", operand.typ, token.pos)
+		}
+
+		o := operand.eval
+		return &exprNode{typ: exprTypeInt, eval: func(e *ContextEvent) interface{} {
+			return -o(e).(int64)
+		}, constant: operand.constant}, nil
+	default:
+		return p.parseMember()
+	}
+}
+
+// ParseMember parses a primary expression, and any string methods called on
+// it.
+func (p *exprParser) parseMember() (*exprNode, error) {
+	receiver, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept(".") {
+		token := p.next()
+		if token.kind != exprTokenIdent {
+			return nil, fmt.Errorf("expected method at %d, got %q", token.pos, token.text)
+		}
+
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+
+		if receiver, err = newMethodNode(token.text, receiver, args, token.pos); err != nil {
+			return nil, err
+		}
+	}
+
+	return receiver, nil
+}
+
+// NewMethodNode returns the node of the string method called on the receiver.
+func newMethodNode(method string, receiver *exprNode, args []*exprNode, pos int) (*exprNode, error) {
+	var test func(s, arg string) bool
+	switch method {
+	case "contains":
+		test = strings.Contains
+	case "startsWith":
+		test = strings.HasPrefix
+	case "endsWith":
+		test = strings.HasSuffix
+	case "matches":
+	default:
+		return nil, fmt.Errorf("unknown method %s at %d", method, pos)
+	}
+
+	if receiver.typ != exprTypeString || len(args) != 1 || args[0].typ != exprTypeString {
+		return nil, fmt.Errorf("%s must be called on a string with a string at %d", method, pos)
+	}
+
+	recv, arg := receiver.eval, args[0].eval
+	if method == "matches" {
+		if !args[0].constant {
+			return nil, fmt.Errorf("matches must be called with a literal at %d", pos)
+		}
+
+		re, err := regexp.Compile(arg(nil).(string))
+		if err != nil {
+			return nil, fmt.Errorf("compiling pattern of matches at %d: %w", pos, err)
+		}
+
+		return &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+			return re.MatchString(recv(e).(string))
+		}}, nil
+	}
+
+	return &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+		return test(recv(e).(string), arg(e).(string))
+	}}, nil
+}
+
+// ParseArgs parses the parenthesised arguments of a call.
+func (p *exprParser) parseArgs() ([]*exprNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	var args []*exprNode
+	if p.accept(")") {
+		return args, nil
+	}
+
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if p.accept(")") {
+			return args, nil
+		}
+
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	token := p.next()
+
+	switch token.kind {
+	case exprTokenInt:
+		value, err := strconv.ParseInt(token.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int %s at %d", token.text, token.pos)
+		}
+		return newConstantNode(exprTypeInt, value), nil
+	case exprTokenString:
+		return newConstantNode(exprTypeString, token.text), nil
+	case exprTokenIdent:
+		switch token.text {
+		case "true", "false":
+			return newConstantNode(exprTypeBool, token.text == "true"), nil
+		case "cidr":
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			return newCIDRNode(args, token.pos)
+		}
+
+		field, ok := exprFields[token.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %s at %d", token.text, token.pos)
+		}
+		return &exprNode{typ: field.typ, eval: field.get, field: token.text}, nil
+	case exprTokenPunct:
+		switch token.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		case "[":
+			return p.parseList(token.pos)
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %q at %d", token.text, token.pos)
+}
+
+// ParseList parses the elements of a list literal, which must be constants of
+// the same type, following its opening bracket.
+func (p *exprParser) parseList(pos int) (*exprNode, error) {
+	set := make(map[interface{}]bool)
+	elemType := exprType(-1)
+
+	for !p.accept("]") {
+		if elemType != -1 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		token := p.peek()
+		elem, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		if !elem.constant || (elemType != -1 && elem.typ != elemType) {
+			return nil, fmt.Errorf("list elements must be literals of the same type at %d", token.pos)
+		}
+		elemType = elem.typ
+		set[elem.eval(nil)] = true
+	}
+
+	if elemType == -1 {
+		elemType = exprTypeInt // Of any type, for in
+	}
+
+	listType, ok := elemType.listOf()
+	if !ok {
+		return nil, fmt.Errorf("list of %v at %d", elemType, pos)
+	}
+
+	return newConstantNode(listType, set), nil
+}
+
+// NewCIDRNode returns the node of whether the address of the first argument is
+// in the CIDR of the second, which must be a literal.
+func newCIDRNode(args []*exprNode, pos int) (*exprNode, error) {
+	if len(args) != 2 || args[0].typ != exprTypeString || args[1].typ != exprTypeString || !args[1].constant {
+		return nil, fmt.Errorf("cidr must be called with an address and a literal CIDR at %d", pos)
+	}
+
+	_, network, err := net.ParseCIDR(args[1].eval(nil).(string))
+	if err != nil {
+		return nil, fmt.Errorf("parsing CIDR of cidr at %d: %w", pos, err)
+	}
+
+	ip := args[0].eval
+	return &exprNode{typ: exprTypeBool, eval: func(e *ContextEvent) interface{} {
+		addr := net.ParseIP(ip(e).(string))
+		return addr != nil && network.Contains(addr)
+	}}, nil
+}
+
+func newConstantNode(typ exprType, value interface{}) *exprNode {
+	return &exprNode{
+		typ:      typ,
+		eval:     func(*ContextEvent) interface{} { return value },
+		constant: true,
+	}
+}
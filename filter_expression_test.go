@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func newMockExpressionEvent() *ContextEvent {
+	return &ContextEvent{
+		Event: &event.Event{
+			PIDOnCPU:     1234,
+			CommandOnCPU: "nginx: worker",
+			SourceIP:     net.ParseIP("192.168.122.38"),
+			DestIP:       net.ParseIP("172.217.169.4"),
+			SourcePort:   44406,
+			DestPort:     443,
+			OldState:     tcpstate.StateSynSent,
+			NewState:     tcpstate.StateEstablished,
+		},
+		Context:       &TraceContext{CPU: 3},
+		Direction:     DirectionOutbound,
+		RemoteCountry: "US",
+	}
+}
+
+func TestFilterExpressionPasses(t *testing.T) {
+	tests := []struct {
+		expression string
+		passes     bool
+	}{
+		{`dest_port in [443, 8443] && new_state == "ESTABLISHED" && !cidr(dest_ip, "10.0.0.0/8")`, true},
+		{`dest_port in [80, 8080]`, false},
+		{`cidr(dest_ip, "172.217.0.0/16")`, true},
+		{`cidr(source_ip, "::ffff:192.168.0.0/112")`, true},
+		{`source_port >= 32768 && source_port <= 60999`, true},
+		{`dest_port < 443 || dest_port > 443`, false},
+		{`command.startsWith("nginx") && command.contains("work") && !command.endsWith("master")`, true},
+		{`command.matches('^nginx: (worker|master)$')`, true},
+		{`kind == "state-change" && direction == "outbound" && role == "unknown"`, true},
+		{`country in ["CN", "RU"]`, false},
+		{`cpu == 3 && pid != -1 && idle == false`, true},
+		{`old_state < new_state`, false},
+		{`(true || false) && !(false)`, true},
+		{`new_state in []`, false},
+	}
+
+	for _, test := range tests {
+		expression, err := compileFilterExpression(test.expression)
+		if err != nil {
+			t.Errorf("%s: expected nil error, got %q (of type %T)", test.expression, err, err)
+			continue
+		}
+
+		if passes := expression.passes(newMockExpressionEvent()); passes != test.passes {
+			t.Errorf("%s: expected to pass %t, got %t", test.expression, test.passes, passes)
+		}
+	}
+}
+
+func TestFilterExpressionPassesLostEvents(t *testing.T) {
+	expression, err := compileFilterExpression(`false`)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !expression.passes(&ContextEvent{Event: new(event.Event), Kind: KindLostEvents}) {
+		t.Error("expected marker of lost events to pass, but did not")
+	}
+}
+
+func TestCompileFilterExpressionError(t *testing.T) {
+	for _, expression := range []string{
+		``,
+		`dest_port`,
+		`dest_port == "443"`,
+		`dest_port in ["443"]`,
+		`dest_port in [443, "8443"]`,
+		`dest_port in [source_port]`,
+		`unknown_field == 1`,
+		`!dest_port`,
+		`true < false`,
+		`cidr(dest_ip, "10.0.0.0/33")`,
+		`cidr(dest_ip, source_ip)`,
+		`command.matches(source_ip)`,
+		`command.matches("(")`,
+		`command.length()`,
+		`dest_port == 443 dest_port`,
+		`(dest_port == 443`,
+		`command == "nginx`,
+		`command == "\q"`,
+		`dest_port == 443 # comment`,
+		`dest_port == 99999999999999999999`,
+	} {
+		_, err := compileFilterExpression(expression)
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", expression)
+			continue
+		}
+
+		t.Logf("%s: got error %q (of type %T)", expression, err, err)
+	}
+}
+
+func TestReplayEventerEventFilteredByExpression(t *testing.T) {
+	capture := "" +
+		"            curl-1234    [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n" +
+		"            curl-1234    [000] ..s.   995.368985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44408 dport=443 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n"
+
+	expression, err := compileFilterExpression(`dest_port == 443`)
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to compile expression: %v", err)
+	}
+
+	eventer, err := newReplayEventer(newReplaySource(strings.NewReader(capture), "", false),
+		&config{filterExpression: expression})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.DestPort != 443 {
+		t.Errorf("expected event of port 443, got %d", event.DestPort)
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if stats.Skipped.Filtered != 1 {
+		t.Errorf("expected 1 event filtered, got %d", stats.Skipped.Filtered)
+	}
+}
+
+func TestFilterExpressionOffload(t *testing.T) {
+	tests := []struct {
+		expression   string
+		kernelFilter string
+		residual     int
+	}{
+		{`dest_port in [443, 8443] && new_state == "ESTABLISHED"`, `(dport == 443 || dport == 8443) && newstate == 1`, 0},
+		{`443 == dest_port && !cidr(dest_ip, "10.0.0.0/8")`, `dport == 443`, 1},
+		{`new_state == "SYN-RECEIVED"`, `(newstate == 3 || newstate == 12)`, 0},
+		{`new_state != "CLOSED" && dest_port in [443]`, `(newstate != 7 && newstate != 13) && dport == 443`, 0},
+		{`source_port < 1024 || dest_port < 1024`, ``, 0},
+		{`command.startsWith("curl")`, ``, 0},
+	}
+
+	for _, test := range tests {
+		expression, err := compileFilterExpression(test.expression)
+		if err != nil {
+			t.Errorf("%s: expected nil error, got %q (of type %T)", test.expression, err, err)
+			continue
+		}
+
+		kernelFilter, residual := expression.offload()
+		if kernelFilter != test.kernelFilter {
+			t.Errorf("%s: expected kernel filter %q, got %q", test.expression, test.kernelFilter, kernelFilter)
+		}
+
+		if kernelFilter == "" {
+			if residual != expression {
+				t.Errorf("%s: expected expression itself when nothing offloaded, got %p", test.expression, residual)
+			}
+			continue
+		}
+
+		if len(residual.residual) != test.residual {
+			t.Errorf("%s: expected %d residual conjuncts, got %d",
+				test.expression, test.residual, len(residual.residual))
+		}
+	}
+}
+
+func TestFilterExpressionOffloadPassesOtherKinds(t *testing.T) {
+	expression, err := compileFilterExpression(`dest_port == 80 && command == "nginx: worker"`)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	_, residual := expression.offload()
+
+	// The kernel filtered state changes by the offloaded conjunct
+	stateChange := newMockExpressionEvent()
+	if !residual.passes(stateChange) {
+		t.Error("expected state change to pass residual expression, but did not")
+	}
+
+	// Existing connections are not filtered by the kernel
+	existing := newMockExpressionEvent()
+	existing.Kind = KindExisting
+	if residual.passes(existing) {
+		t.Error("expected existing connection to be filtered by whole expression, but was not")
+	}
+}
+
+func TestOffloadingFilter(t *testing.T) {
+	expression, err := compileFilterExpression(`dest_port == 443`)
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to compile expression: %v", err)
+	}
+
+	filter := offloadingFilter(&config{filter: "sport != 22", filterExpression: expression})
+	if expected := "(sport != 22) && dport == 443"; filter != expected {
+		t.Errorf("expected filter %q, got %q", expected, filter)
+	}
+
+	if filter := offloadingFilter(&config{filter: "sport != 22"}); filter != "" {
+		t.Errorf("expected empty filter, got %q", filter)
+	}
+}
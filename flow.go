@@ -0,0 +1,277 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// Flow is the lifecycle of a connection, or listening socket, from its first
+// state change seen to its close.
+type Flow struct {
+	// ID identifies the flow, and is the same for all of its events. It is
+	// unique, even if the 4-tuple or socket of the flow is later reused.
+	ID string
+	// Start is the time of the first event of the flow seen. If the flow began
+	// before the eventer attached, and was not listed as an existing
+	// connection, it is the time its first state change was seen.
+	Start time.Time
+	// End is the time of the close of the flow, or of its last event if it
+	// timed out. It is zero while the flow is open.
+	End time.Time
+	// Duration is the time from the start to the end of the flow, if ended.
+	Duration time.Duration
+	// Transitions is the number of state changes of the flow seen.
+	Transitions int
+	// TimedOut is whether the flow ended because no event of it was seen for
+	// the flow timeout, such as when its close was lost, rather than closing.
+	TimedOut bool
+}
+
+// FlowKey identifies the socket of a flow by its cookie, which is never
+// reused, or otherwise by its address, if known, and 4-tuple.
+type flowKey struct {
+	cookie  uint64
+	address uint64
+	connectionKey
+}
+
+func newFlowKey(event *ContextEvent) flowKey {
+	if event.Socket != nil && event.Socket.Cookie != 0 {
+		return flowKey{cookie: event.Socket.Cookie}
+	}
+
+	key := flowKey{connectionKey: newConnectionKey(event)}
+	if event.Socket != nil {
+		key.address = event.Socket.Address
+	}
+
+	return key
+}
+
+// TrackedFlow is an open flow, and the last of its events seen.
+type trackedFlow struct {
+	flow *Flow
+	last *ContextEvent
+
+	// Until a flow is known not to be short-lived, its events are held
+	confirmed bool
+	held      []*ContextEvent
+}
+
+// UnconfirmedFlow is a flow whose events are held until it has lasted the
+// minimum duration.
+type unconfirmedFlow struct {
+	key     flowKey
+	tracked *trackedFlow
+}
+
+// FlowTracker groups the events of each socket into flows, tagging each with a
+// copy of its flow as of the event. A flow begins with the first state change
+// of a socket seen, or its listing as an existing connection, and ends with
+// its close, or its destruction. If timing out, flows of which no event is
+// seen for the timeout, such as those whose close was lost, end then. If
+// summarising, a KindFlowClosed event is returned as each flow ends. If a
+// minimum duration is configured, the events of each flow are held until it
+// has lasted that long, or a segment of it is retransmitted, the only evidence
+// of data transfer traced, and are suppressed if it ends first, so that the
+// noise of health checks and the like is not returned. Flows listed as
+// existing connections are not held, as they predate the eventer. Events are
+// otherwise returned in the order read. It is only accessed by the reader of
+// events, so is not safe for concurrent use.
+type flowTracker struct {
+	timeout     time.Duration
+	summarise   bool
+	minDuration time.Duration
+	suppressed  *uint64 // Accessed atomically, the number of events suppressed
+
+	flows       map[flowKey]*trackedFlow
+	lastPruned  time.Time
+	unconfirmed []unconfirmedFlow // In the order of their starts
+	pending     []*ContextEvent   // The summaries and events released, awaiting return
+}
+
+// NewFlowTracker returns a tracker of flows which times them out after the
+// timeout, unless zero, summarising each ended flow if configured, and
+// suppressing, and counting in suppressed, the events of those shorter than
+// the minimum duration, unless zero.
+func newFlowTracker(timeout time.Duration,
+	summarise bool,
+	minDuration time.Duration,
+	suppressed *uint64) *flowTracker {
+	return &flowTracker{
+		timeout:     timeout,
+		summarise:   summarise,
+		minDuration: minDuration,
+		suppressed:  suppressed,
+		flows:       make(map[flowKey]*trackedFlow),
+	}
+}
+
+// Track tags the event with its flow, if any, starting, or ending, the flow
+// as the event does, and returns whether the event is held, rather than
+// returned, after which it is returned by next, unless suppressed. Markers of
+// lost events are of no flow.
+func (t *flowTracker) track(event *ContextEvent) bool {
+	if event.Kind == KindLostEvents {
+		return false
+	}
+
+	t.release(event.Time)
+	t.prune(event.Time)
+
+	key := newFlowKey(event)
+	tracked, ok := t.flows[key]
+	if !ok {
+		if event.Kind != KindStateChange && event.Kind != KindExisting {
+			return t.queue(event)
+		}
+
+		tracked = &trackedFlow{
+			flow:      &Flow{ID: uuid.NewString(), Start: event.Time},
+			confirmed: t.minDuration == 0 || event.Kind == KindExisting,
+		}
+		t.flows[key] = tracked
+		if !tracked.confirmed {
+			t.unconfirmed = append(t.unconfirmed, unconfirmedFlow{key: key, tracked: tracked})
+		}
+	}
+	tracked.last = event
+
+	if event.Kind == KindStateChange {
+		tracked.flow.Transitions++
+	}
+
+	flow := *tracked.flow
+	event.Flow = &flow
+
+	held := !tracked.confirmed
+	if held {
+		tracked.held = append(tracked.held, event)
+		if event.Kind == KindRetransmit {
+			t.confirm(tracked)
+		}
+	} else {
+		held = t.queue(event)
+	}
+
+	if (event.Kind == KindStateChange && event.NewState == tcpstate.StateClosed) ||
+		event.Kind == KindDestroySock {
+		event.Flow = t.end(key, tracked, event.Time, false)
+	}
+
+	return held
+}
+
+// Queue queues the event behind the summaries and events already released, if
+// any, so that it is not returned before them, and returns whether it did.
+func (t *flowTracker) queue(event *ContextEvent) bool {
+	if len(t.pending) == 0 {
+		return false
+	}
+
+	t.pending = append(t.pending, event)
+	return true
+}
+
+// Next returns the next summary of an ended flow, or event released, if any.
+func (t *flowTracker) next() (*ContextEvent, bool) {
+	if len(t.pending) == 0 {
+		return nil, false
+	}
+
+	event := t.pending[0]
+	t.pending[0] = nil
+	t.pending = t.pending[1:]
+
+	return event, true
+}
+
+// Confirm releases the events held of the flow, which is not short-lived.
+func (t *flowTracker) confirm(tracked *trackedFlow) {
+	tracked.confirmed = true
+	t.pending = append(t.pending, tracked.held...)
+	tracked.held = nil
+}
+
+// Release confirms the open flows which have lasted the minimum duration by
+// now.
+func (t *flowTracker) release(now time.Time) {
+	for len(t.unconfirmed) > 0 {
+		unconfirmed := t.unconfirmed[0]
+		if now.Sub(unconfirmed.tracked.flow.Start) < t.minDuration {
+			return
+		}
+		t.unconfirmed[0] = unconfirmedFlow{}
+		t.unconfirmed = t.unconfirmed[1:]
+
+		if !unconfirmed.tracked.confirmed && t.flows[unconfirmed.key] == unconfirmed.tracked {
+			t.confirm(unconfirmed.tracked)
+		}
+	}
+}
+
+// Flush releases the events held of all open flows, as no more events are to
+// be read, and returns whether there are any summaries or events to return.
+func (t *flowTracker) flush() bool {
+	for _, unconfirmed := range t.unconfirmed {
+		if !unconfirmed.tracked.confirmed && t.flows[unconfirmed.key] == unconfirmed.tracked {
+			t.confirm(unconfirmed.tracked)
+		}
+	}
+	t.unconfirmed = nil
+
+	return len(t.pending) > 0
+}
+
+// End ends the flow at the time, summarising it if configured, and returns
+// the ended flow. The events of a flow shorter than the minimum duration, if
+// held, are suppressed, along with its summary.
+func (t *flowTracker) end(key flowKey, tracked *trackedFlow, end time.Time, timedOut bool) *Flow {
+	delete(t.flows, key)
+
+	flow := tracked.flow
+	flow.End, flow.Duration, flow.TimedOut = end, end.Sub(flow.Start), timedOut
+
+	if !tracked.confirmed {
+		if flow.Duration < t.minDuration {
+			atomic.AddUint64(t.suppressed, uint64(len(tracked.held)))
+			tracked.held = nil
+			return flow
+		}
+		t.confirm(tracked)
+	}
+
+	if !t.summarise {
+		return flow
+	}
+
+	// The summary is of the 4-tuple, task and states of the last event
+	baseEvent := *tracked.last.Event
+	baseEvent.Time = end
+	summary := *tracked.last
+	summary.Event = &baseEvent
+	summary.Kind = KindFlowClosed
+	summary.Flow = flow
+	t.pending = append(t.pending, &summary)
+
+	return flow
+}
+
+// Prune ends the flows of which no event has been seen for the timeout before
+// now, at most once per timeout, so that flows whose close was lost do not
+// grow unbounded.
+func (t *flowTracker) prune(now time.Time) {
+	if t.timeout == 0 || now.Sub(t.lastPruned) < t.timeout {
+		return
+	}
+	t.lastPruned = now
+
+	for key, tracked := range t.flows {
+		if now.Sub(tracked.last.Time) > t.timeout {
+			t.end(key, tracked, tracked.last.Time, true)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func TestFlowTrackerTrack(t *testing.T) {
+	now := time.Now()
+	tracker := newFlowTracker(0, true, 0, new(uint64))
+	socket := &SocketID{Address: 0xffff8880a1b2c3d4}
+
+	established := newMockTransition(now, socket, tcpstate.StateEstablished)
+	tracker.track(established)
+	if established.Flow == nil || established.Flow.ID == "" {
+		t.Fatalf("expected event of flow, got %+v", established.Flow)
+	}
+
+	closed := newMockTransition(now.Add(time.Second), socket, tcpstate.StateClosed)
+	tracker.track(closed)
+	if closed.Flow == nil || closed.Flow.ID != established.Flow.ID {
+		t.Fatalf("expected event of flow %+v, got %+v", established.Flow, closed.Flow)
+	}
+
+	if closed.Flow.Transitions != 2 || closed.Flow.Duration != time.Second || !closed.Flow.End.Equal(closed.Time) {
+		t.Errorf("expected flow of 2 transitions ended after 1s, got %+v", closed.Flow)
+	}
+
+	// The flow of the events already returned is not changed
+	if established.Flow.Transitions != 1 || !established.Flow.End.IsZero() {
+		t.Errorf("expected open flow of 1 transition, got %+v", established.Flow)
+	}
+
+	summary, ok := tracker.next()
+	if !ok {
+		t.Fatal("expected flow summary, got none")
+	}
+
+	if summary.Kind != KindFlowClosed || summary.Flow != closed.Flow {
+		t.Errorf("expected summary of flow %+v, got %v of %+v", closed.Flow, summary.Kind, summary.Flow)
+	}
+
+	if _, ok := tracker.next(); ok {
+		t.Error("expected no further summary, got one")
+	}
+
+	// The 4-tuple of the closed flow is then of a new flow
+	reused := newMockTransition(now.Add(2*time.Second), socket, tcpstate.StateSynSent)
+	tracker.track(reused)
+	if reused.Flow == nil || reused.Flow.ID == established.Flow.ID {
+		t.Errorf("expected event of new flow, got %+v", reused.Flow)
+	}
+}
+
+func TestFlowTrackerTrackDistinguishesSockets(t *testing.T) {
+	now := time.Now()
+	tracker := newFlowTracker(0, false, 0, new(uint64))
+
+	first := newMockTransition(now, &SocketID{Cookie: 1}, tcpstate.StateEstablished)
+	second := newMockTransition(now, &SocketID{Cookie: 2}, tcpstate.StateEstablished)
+	tracker.track(first)
+	tracker.track(second)
+
+	if first.Flow.ID == second.Flow.ID {
+		t.Error("expected events of sockets of different cookies to be of different flows")
+	}
+}
+
+func TestFlowTrackerTrackOtherKinds(t *testing.T) {
+	now := time.Now()
+	tracker := newFlowTracker(0, true, 0, new(uint64))
+
+	// Events of other kinds do not start flows
+	reset := newMockTransition(now, nil, tcpstate.StateEstablished)
+	reset.Kind = KindReceiveReset
+	tracker.track(reset)
+	if reset.Flow != nil {
+		t.Errorf("expected reset of no flow, got %+v", reset.Flow)
+	}
+
+	existing := newMockTransition(now, nil, tcpstate.StateEstablished)
+	existing.Kind = KindExisting
+	tracker.track(existing)
+
+	destroy := newMockTransition(now.Add(time.Second), nil, "")
+	destroy.Kind = KindDestroySock
+	tracker.track(destroy)
+	if destroy.Flow == nil || destroy.Flow.ID != existing.Flow.ID || destroy.Flow.End.IsZero() {
+		t.Errorf("expected destruction to end flow %+v, got %+v", existing.Flow, destroy.Flow)
+	}
+
+	if destroy.Flow.Transitions != 0 {
+		t.Errorf("expected flow of no transitions, got %d", destroy.Flow.Transitions)
+	}
+}
+
+func TestFlowTrackerTrackTimeout(t *testing.T) {
+	now := time.Now()
+	tracker := newFlowTracker(time.Minute, true, 0, new(uint64))
+
+	stale := newMockTransition(now, &SocketID{Cookie: 1}, tcpstate.StateEstablished)
+	tracker.track(stale)
+	tracker.track(newMockTransition(now.Add(2*time.Minute), &SocketID{Cookie: 2}, tcpstate.StateEstablished))
+
+	summary, ok := tracker.next()
+	if !ok {
+		t.Fatal("expected flow summary, got none")
+	}
+
+	if summary.Flow.ID != stale.Flow.ID || !summary.Flow.TimedOut || !summary.Flow.End.Equal(now) {
+		t.Errorf("expected timed out flow %s ended at its last event, got %+v", stale.Flow.ID, summary.Flow)
+	}
+
+	if len(tracker.flows) != 1 {
+		t.Errorf("expected 1 open flow, got %d", len(tracker.flows))
+	}
+}
+
+func TestFlowTrackerTrackSuppressesShortFlows(t *testing.T) {
+	now := time.Now()
+	suppressed := new(uint64)
+	tracker := newFlowTracker(0, true, time.Second, suppressed)
+	socket := &SocketID{Cookie: 1}
+
+	for _, event := range []*ContextEvent{
+		newMockTransition(now, socket, tcpstate.StateEstablished),
+		newMockTransition(now.Add(10*time.Millisecond), socket, tcpstate.StateClosed),
+	} {
+		if !tracker.track(event) {
+			t.Errorf("expected event to be held, but was not")
+		}
+	}
+
+	if event, ok := tracker.next(); ok {
+		t.Errorf("expected events and summary of short flow to be suppressed, got %v", event.Kind)
+	}
+
+	if *suppressed != 2 {
+		t.Errorf("expected 2 events suppressed, got %d", *suppressed)
+	}
+}
+
+func TestFlowTrackerTrackReleasesLongFlows(t *testing.T) {
+	now := time.Now()
+	tracker := newFlowTracker(0, false, time.Second, new(uint64))
+
+	established := newMockTransition(now, &SocketID{Cookie: 1}, tcpstate.StateEstablished)
+	tracker.track(established)
+
+	// The flow has lasted the minimum duration by the time of another event
+	other := newMockTransition(now.Add(2*time.Second), &SocketID{Cookie: 2}, tcpstate.StateEstablished)
+	if !tracker.track(other) {
+		t.Error("expected event to be held, but was not")
+	}
+
+	if event, ok := tracker.next(); !ok || event != established {
+		t.Fatalf("expected event of long flow to be released, got %+v", event)
+	}
+
+	if _, ok := tracker.next(); ok {
+		t.Error("expected event of new flow to remain held, but was released")
+	}
+
+	if !tracker.flush() {
+		t.Fatal("expected held event to be flushed, but was not")
+	}
+
+	if event, ok := tracker.next(); !ok || event != other {
+		t.Errorf("expected event of new flow to be released, got %+v", event)
+	}
+}
+
+func TestFlowTrackerTrackReleasesFlowsRetransmitting(t *testing.T) {
+	now := time.Now()
+	tracker := newFlowTracker(0, false, time.Minute, new(uint64))
+	socket := &SocketID{Cookie: 1}
+
+	established := newMockTransition(now, socket, tcpstate.StateEstablished)
+	tracker.track(established)
+
+	retransmit := newMockTransition(now.Add(time.Second), socket, tcpstate.StateEstablished)
+	retransmit.Kind = KindRetransmit
+	tracker.track(retransmit)
+
+	for _, expected := range []*ContextEvent{established, retransmit} {
+		if event, ok := tracker.next(); !ok || event != expected {
+			t.Errorf("expected %v event to be released, got %+v", expected.Kind, event)
+		}
+	}
+
+	closed := newMockTransition(now.Add(2*time.Second), socket, tcpstate.StateClosed)
+	if tracker.track(closed) {
+		t.Error("expected event of flow retransmitting not to be held, but was")
+	}
+}
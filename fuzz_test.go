@@ -0,0 +1,117 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var mockFuzzSeedLines = []string{
+	"<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+	"curl-4242    (   4242) [003] d.s1 12345.678901: tcp_set_state: sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+	"<idle>-0       [000] ..s.   995.318985: tcp_audit_set_state: (tcp_set_state+0x0/0x240) skaddr=0xffff8880a1b2c3d4 family=2 sport=44406 dport=20480 saddr=0 daddr=0 oldstate=2 newstate=1",
+	"<idle>-0       [000] ..s.   995.318985: tcp_send_reset: family=AF_INET sport=80 dport=44406 saddr=172.217.169.4 daddr=192.168.122.38 state=TCP_ESTABLISHED",
+	"my-cmd: x-1 [000] 995.318985: inet_sock_set_state: family=AF_INET",
+	"CPU:3 [LOST 1234 EVENTS]",
+	"<idle>-0: ",
+	"",
+}
+
+// The fuzz targets check only that malformed input is reported as an error,
+// rather than panicking, and that errors are of the documented types.
+
+func FuzzToEvent(f *testing.F) {
+	for _, line := range mockFuzzSeedLines {
+		f.Add([]byte(line))
+	}
+
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), parserTracepointCandidates())
+	f.Fuzz(func(t *testing.T, line []byte) {
+		event, err := eventParser.toEvent(line)
+		if err != nil {
+			parseErr := new(ParseError)
+			if !errors.As(err, &parseErr) && !errors.Is(err, ErrIrrelevantEvent) {
+				t.Errorf("expected *ParseError or irrelevant event error, got %q (of type %T)", err, err)
+			}
+
+			return
+		}
+
+		if event.Event == nil {
+			t.Error("expected event, got nil")
+		}
+	})
+}
+
+func FuzzParseCommand(f *testing.F) {
+	for _, line := range mockFuzzSeedLines {
+		f.Add([]byte(line))
+	}
+
+	f.Fuzz(func(t *testing.T, line []byte) {
+		str := line
+		command, err := parseCommand(&str)
+		if err != nil {
+			return
+		}
+
+		if command == "" {
+			t.Error("expected non-empty command, got empty")
+		}
+
+		if len(str) >= len(line) {
+			t.Errorf("expected stream to be advanced, but was not")
+		}
+	})
+}
+
+func FuzzGetTaggedFields(f *testing.F) {
+	for _, tags := range []string{
+		"family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80",
+		"a=b",
+		"a=",
+		"=b",
+		"a",
+		"a=b  c=d",
+	} {
+		f.Add([]byte(tags))
+	}
+
+	fieldParser := new(slicingFieldParser)
+	f.Fuzz(func(t *testing.T, tags []byte) {
+		str := tags
+		fields, err := fieldParser.getTaggedFields(&str)
+		if err != nil {
+			return
+		}
+
+		if len(fields) == 0 {
+			t.Error("expected tagged fields, got none")
+		}
+	})
+}
+
+func FuzzDecodeLayoutFields(f *testing.F) {
+	f.Add([]byte(mockLayoutTags))
+	f.Add([]byte("family=AF_INET protocol=IPPROTO_TCP sport=1 dport=2 saddr=0.0.0.0 daddr=255.255.255.255 saddrv6=:: daddrv6=:: oldstate=TCP_CLOSE newstate=TCP_NEW_SYN_RECV"))
+
+	f.Fuzz(func(t *testing.T, tags []byte) {
+		fields, ok := decodeLayoutFields(tags, inetSockSetStateLayout, nil)
+		if !ok {
+			return
+		}
+
+		// The fields decoded by position must be those decoded from the map
+		expectedFields, err := decodeGenericFields(t, string(tags))
+		if err != nil {
+			t.Fatalf("expected nil error decoding tagged fields, got %q (of type %T)", err, err)
+		}
+
+		if !reflect.DeepEqual(fields, expectedFields) {
+			t.Errorf("expected fields %+v, got %+v", expectedFields, fields)
+		}
+	})
+}
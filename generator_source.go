@@ -0,0 +1,258 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// The parameters of the synthetic connections of the generator backend.
+const (
+	generatorRTT = time.Millisecond // The time between the steps of handshakes and teardowns
+
+	// GeneratorBurst is the most connections opened at once, so that a source
+	// which falls behind its rate catches up over several events.
+	generatorBurst = 1000
+
+	generatorEphemeralPortMin = 32768
+	generatorEphemeralPortMax = 60999
+
+	generatorComm = "loadgen"
+)
+
+// The addresses of the synthetic connections, which are of the documentation
+// networks TEST-NET-2 (198.51.100.0/24) and TEST-NET-3 (203.0.113.0/24), so
+// cannot be mistaken for those of real connections.
+var (
+	generatorClientNet = [3]byte{198, 51, 100}
+	generatorServerNet = [3]byte{203, 0, 113}
+	generatorPorts     = []uint16{22, 80, 443, 5432, 6379, 8080}
+)
+
+// GeneratorSequences are the sequences of states through which the synthetic
+// connections pass: that of a client, which opens and closes the connection,
+// and that of the accepted socket of a server, which is closed by the client.
+// Each is established for the generator lifetime, after its state at
+// establishedStep. The transitions of inTask are made in the context of the
+// task owning the socket, and the others in softirq context.
+var generatorSequences = []struct {
+	active          bool
+	states          []uint8
+	inTask          []bool
+	establishedStep int
+}{
+	{ // SYN_SENT, ESTABLISHED, FIN_WAIT1, FIN_WAIT2
+		active:          true,
+		states:          []uint8{tcpStateClose, 2, 1, 4, 5, tcpStateClose},
+		inTask:          []bool{true, false, true, false, false},
+		establishedStep: 2,
+	},
+	{ // SYN_RECV, ESTABLISHED, CLOSE_WAIT, LAST_ACK
+		states:          []uint8{3, 1, 8, 9, tcpStateClose},
+		inTask:          []bool{false, false, true, false},
+		establishedStep: 1,
+	},
+}
+
+// GeneratorSource generates the state changes of synthetic connections at a
+// configured rate, so that the sinks of events, and the pipeline in front of
+// them, can be load tested without real traffic.
+type generatorSource struct {
+	read     uint64 // Accessed atomically, the number of state changes generated
+	closed   int32  // Accessed atomically, non-zero once closed
+	deadline sourceDeadline
+
+	config *config
+
+	rand     *rand.Rand
+	interval time.Duration // The interval between the opening of connections
+	lifetime time.Duration
+
+	schedule generatorSchedule
+	nextOpen time.Time       // The time at which the next connection is opened
+	nextPort uint16          // The next ephemeral port of a client
+	pending  []*ContextEvent // The state changes generated not yet read
+}
+
+func newGeneratorSource(config *config) *generatorSource {
+	return &generatorSource{config: config}
+}
+
+// Open starts generating connections, the first of which is opened at once.
+func (gs *generatorSource) open() error {
+	now := time.Now()
+	gs.rand = rand.New(rand.NewSource(now.UnixNano()))
+	gs.interval = time.Duration(float64(time.Second) / gs.config.generatorRate)
+	gs.lifetime = gs.config.generatorLifetime
+	gs.nextOpen = now
+	gs.nextPort = generatorEphemeralPortMin
+
+	return nil
+}
+
+// Event returns the next state change, waiting until one is due. A wait is for
+// at most perfPollInterval, so that closure is noticed.
+func (gs *generatorSource) event() (*ContextEvent, error) {
+	for len(gs.pending) == 0 {
+		if atomic.LoadInt32(&gs.closed) != 0 {
+			return nil, os.ErrClosed
+		}
+
+		now := time.Now()
+		for opened := 0; !gs.nextOpen.After(now) && opened < generatorBurst; opened++ {
+			gs.openConnection(gs.nextOpen)
+			gs.nextOpen = gs.nextOpen.Add(gs.interval)
+		}
+
+		if err := gs.generate(now); err != nil {
+			return nil, err
+		}
+
+		if len(gs.pending) > 0 {
+			break
+		}
+
+		wait := gs.nextOpen.Sub(now)
+		if len(gs.schedule) > 0 && gs.schedule[0].due.Sub(now) < wait {
+			wait = gs.schedule[0].due.Sub(now)
+		}
+
+		if wait > perfPollInterval {
+			wait = perfPollInterval
+		}
+
+		wait, err := gs.deadline.wait(wait)
+		if err != nil {
+			return nil, err
+		}
+		time.Sleep(wait)
+	}
+
+	event := gs.pending[0]
+	gs.pending = gs.pending[1:]
+
+	return event, nil
+}
+
+func (gs *generatorSource) setReadDeadline(t time.Time) error {
+	gs.deadline.set(t)
+	return nil
+}
+
+// KernelInfo returns no information, as nothing is traced.
+func (gs *generatorSource) kernelInfo() (*KernelInfo, error) {
+	return new(KernelInfo), nil
+}
+
+// BufferStats returns the number of state changes generated as the events read.
+func (gs *generatorSource) bufferStats() (*BufferStats, error) {
+	return &BufferStats{ReadEvents: atomic.LoadUint64(&gs.read)}, nil
+}
+
+// Close stops generating.
+func (gs *generatorSource) close() error {
+	log.Printf("Closing generator")
+	atomic.StoreInt32(&gs.closed, 1)
+
+	return nil
+}
+
+// GeneratorStep is the next state change of a synthetic connection, due at a
+// time.
+type generatorStep struct {
+	due        time.Time
+	socket     *inetDiagSocket
+	owner      *sockDiagOwner
+	sequence   int // The index of the sequence of states of the connection
+	transition int // The index of the state from which the connection changes
+}
+
+// GeneratorSchedule is a min-heap of the steps of the open synthetic
+// connections, by their due time.
+type generatorSchedule []*generatorStep
+
+func (s generatorSchedule) Len() int           { return len(s) }
+func (s generatorSchedule) Less(i, j int) bool { return s[i].due.Before(s[j].due) }
+func (s generatorSchedule) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (s *generatorSchedule) Push(x interface{}) {
+	*s = append(*s, x.(*generatorStep))
+}
+
+func (s *generatorSchedule) Pop() interface{} {
+	old := *s
+	step := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return step
+}
+
+// OpenConnection schedules the first state change of a new synthetic
+// connection, of a randomly chosen sequence, at the time.
+func (gs *generatorSource) openConnection(at time.Time) {
+	sequenceIndex := gs.rand.Intn(len(generatorSequences))
+	client := [4]byte{generatorClientNet[0], generatorClientNet[1], generatorClientNet[2], byte(1 + gs.rand.Intn(254))}
+	server := [4]byte{generatorServerNet[0], generatorServerNet[1], generatorServerNet[2], byte(1 + gs.rand.Intn(254))}
+	serverPort := generatorPorts[gs.rand.Intn(len(generatorPorts))]
+	clientPort := gs.nextPort
+
+	gs.nextPort++
+	if gs.nextPort > generatorEphemeralPortMax {
+		gs.nextPort = generatorEphemeralPortMin
+	}
+
+	// The addresses are those of the local end of the socket, so of the client
+	// or server, by the sequence
+	socket := &inetDiagSocket{saddr: client, daddr: server, sport: clientPort, dport: serverPort}
+	if !generatorSequences[sequenceIndex].active {
+		socket = &inetDiagSocket{saddr: server, daddr: client, sport: serverPort, dport: clientPort}
+	}
+
+	heap.Push(&gs.schedule, &generatorStep{
+		due:      at,
+		socket:   socket,
+		owner:    &sockDiagOwner{comm: generatorComm, pid: 1000 + gs.rand.Intn(31000)},
+		sequence: sequenceIndex,
+	})
+}
+
+// Generate queues the state changes due by now, scheduling the next state
+// change of each connection, if any.
+func (gs *generatorSource) generate(now time.Time) error {
+	for len(gs.schedule) > 0 && !gs.schedule[0].due.After(now) {
+		step := heap.Pop(&gs.schedule).(*generatorStep)
+		sequence := generatorSequences[step.sequence]
+
+		owner := &sockDiagOwner{comm: "<idle>", pid: idlePID}
+		if sequence.inTask[step.transition] {
+			owner = step.owner
+		}
+
+		transition := &sockDiagTransition{
+			socket:   step.socket,
+			oldState: sequence.states[step.transition],
+			newState: sequence.states[step.transition+1],
+		}
+		event, err := newTransitionEvent(transition, owner, false)
+		if err != nil {
+			return err
+		}
+		gs.pending = append(gs.pending, event)
+		atomic.AddUint64(&gs.read, 1)
+
+		step.transition++
+		if step.transition+1 < len(sequence.states) {
+			delay := generatorRTT
+			if step.transition == sequence.establishedStep {
+				delay = gs.lifetime
+			}
+
+			step.due = step.due.Add(delay)
+			heap.Push(&gs.schedule, step)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func TestGeneratorSourceGenerateSequence(t *testing.T) {
+	source := &generatorSource{
+		rand:     rand.New(rand.NewSource(1)),
+		lifetime: time.Second,
+		nextPort: generatorEphemeralPortMin,
+	}
+
+	source.openConnection(time.Now())
+
+	// Generate each step as it falls due
+	for len(source.schedule) > 0 {
+		if err := source.generate(source.schedule[0].due); err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+	}
+	events := source.pending
+
+	sequence := generatorSequences[0]
+	if len(events) > 0 && events[0].OldState != mustDecodeState(t, tcpStateClose) {
+		sequence = generatorSequences[1]
+	}
+
+	if len(events) != len(sequence.states)-1 {
+		t.Fatalf("expected %d state changes, got %d", len(sequence.states)-1, len(events))
+	}
+
+	for i, event := range events {
+		oldState, newState := mustDecodeState(t, sequence.states[i]), mustDecodeState(t, sequence.states[i+1])
+		if event.OldState != oldState || event.NewState != newState {
+			t.Errorf("expected state change %d from %v to %v, got from %v to %v",
+				i,
+				oldState,
+				newState,
+				event.OldState,
+				event.NewState)
+		}
+
+		if inTask := event.CommandOnCPU == generatorComm; inTask != sequence.inTask[i] {
+			t.Errorf("expected state change %d in task %t, got %s-%d",
+				i,
+				sequence.inTask[i],
+				event.CommandOnCPU,
+				event.PIDOnCPU)
+		}
+	}
+
+	if stats, _ := source.bufferStats(); stats.ReadEvents != uint64(len(events)) {
+		t.Errorf("expected %d read events, got %d", len(events), stats.ReadEvents)
+	}
+}
+
+// MustDecodeState returns the decoded kernel TCP state, failing the test if it
+// cannot be decoded.
+func mustDecodeState(t *testing.T, state uint8) tcpstate.State {
+	decoded, err := decodeState(state, false, new([]string))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	return decoded
+}
+
+func TestGeneratorEventerEvent(t *testing.T) {
+	cfg := &config{backend: backendGenerator, generatorRate: 1000}
+	eventer, err := newSourceEventer(newGeneratorSource(cfg), newTraceFSEventParser(new(slicingFieldParser), parserTracepointCandidates()), cfg)
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	for i := 0; i < 10; i++ {
+		event, err := eventer.Event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.SourcePort == 0 || event.DestPort == 0 {
+			t.Errorf("expected ports, got %d and %d", event.SourcePort, event.DestPort)
+		}
+	}
+}
+
+func TestGeneratorSourceDeadlineExceeded(t *testing.T) {
+	source := newGeneratorSource(&config{generatorRate: 0.001})
+	if err := source.open(); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	// The first connection is opened at once, the next not for 1000s
+	if _, err := source.event(); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	source.setReadDeadline(time.Now().Add(10 * time.Millisecond))
+	for {
+		if _, err := source.event(); err != nil {
+			t.Logf("got error %q (of type %T)", err, err)
+			break
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+const (
+	// MMDBDataSectionSeparatorLength is the length of the zeros between the
+	// search tree and the data section of a MaxMind DB.
+	mmdbDataSectionSeparatorLength = 16
+
+	// MMDBMaxDepth is the deepest nesting of maps, arrays and pointers decoded,
+	// so that a corrupt database cannot recurse without bound.
+	mmdbMaxDepth = 32
+
+	// GeoIPCacheSize is the most records of a database cached, beyond which the
+	// cache is emptied.
+	geoIPCacheSize = 65536
+)
+
+// MMDBMetadataMarker precedes the metadata at the end of a MaxMind DB.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// The types of the fields of a MaxMind DB.
+const (
+	mmdbTypeExtended = iota
+	mmdbTypePointer
+	mmdbTypeString
+	mmdbTypeDouble
+	mmdbTypeBytes
+	mmdbTypeUint16
+	mmdbTypeUint32
+	mmdbTypeMap
+	mmdbTypeInt32
+	mmdbTypeUint64
+	mmdbTypeUint128
+	mmdbTypeArray
+	mmdbTypeContainer
+	mmdbTypeEndMarker
+	mmdbTypeBool
+	mmdbTypeFloat
+)
+
+// GeoIPInfo is the geography and network of an address.
+type geoIPInfo struct {
+	country string // ISO 3166-1 code
+	asn     uint32
+	asOrg   string
+}
+
+// GeoIPEnricher sets the country and autonomous system of the remote addresses
+// of events from local MaxMind-format databases, such as GeoLite2-Country and
+// GeoLite2-ASN, the fields of each found being merged. It is only accessed by
+// the reader of events, so is not safe for concurrent use.
+type geoIPEnricher struct {
+	databases []*mmdb
+}
+
+// NewGeoIPEnricher returns an enricher from the databases at the paths, which
+// are read whole now.
+func newGeoIPEnricher(paths []string) (*geoIPEnricher, error) {
+	enricher := new(geoIPEnricher)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading GeoIP database: %w", err)
+		}
+
+		database, err := newMMDB(data)
+		if err != nil {
+			return nil, fmt.Errorf("opening GeoIP database %s: %w", path, err)
+		}
+		enricher.databases = append(enricher.databases, database)
+	}
+
+	return enricher, nil
+}
+
+// Enrich sets the country and autonomous system of the destination address of
+// the event, which, for the socket of a state change, is its remote address.
+// Addresses not in the databases, such as private addresses, are left without.
+// Markers of lost events have no addresses.
+func (g *geoIPEnricher) enrich(event *ContextEvent) {
+	if event.Kind == KindLostEvents || event.DestIP == nil {
+		return
+	}
+
+	for _, database := range g.databases {
+		info := database.info(event.DestIP)
+		if info == nil {
+			continue
+		}
+
+		if event.RemoteCountry == "" {
+			event.RemoteCountry = info.country
+		}
+
+		if event.RemoteASN == 0 {
+			event.RemoteASN, event.RemoteASOrg = info.asn, info.asOrg
+		}
+	}
+}
+
+// MMDB is a MaxMind DB, a binary search tree of the bits of addresses whose
+// leaves are records of a data section, as specified at
+// https://maxmind.github.io/MaxMind-DB/.
+type mmdb struct {
+	tree       []byte
+	nodeCount  uint
+	recordSize uint // In bits
+	ipVersion  uint
+	ipv4Start  uint // The node of ::/96, where IPv4 addresses of an IPv6 tree start
+	data       mmdbDecoder
+
+	cache map[uint]*geoIPInfo // Nil if the record has no fields of interest, by offset
+}
+
+// NewMMDB returns the database of its whole content.
+func newMMDB(content []byte) (*mmdb, error) {
+	markerIdx := bytes.LastIndex(content, mmdbMetadataMarker)
+	if markerIdx == -1 {
+		return nil, errors.New("no metadata marker")
+	}
+
+	metadataDecoder := mmdbDecoder(content[markerIdx+len(mmdbMetadataMarker):])
+	value, _, err := metadataDecoder.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+
+	nodeCount, ok1 := metadata["node_count"].(uint64)
+	recordSize, ok2 := metadata["record_size"].(uint64)
+	ipVersion, ok3 := metadata["ip_version"].(uint64)
+	if !ok1 || !ok2 || !ok3 {
+		return nil, errors.New("metadata missing node_count, record_size or ip_version")
+	}
+
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", recordSize)
+	}
+
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", ipVersion)
+	}
+
+	if nodeCount > uint64(markerIdx) ||
+		nodeCount*recordSize/4+mmdbDataSectionSeparatorLength > uint64(markerIdx) {
+		return nil, fmt.Errorf("search tree of %d nodes exceeds database", nodeCount)
+	}
+
+	treeSize := nodeCount * recordSize / 4
+	database := &mmdb{
+		tree:       content[:treeSize],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+		data:       mmdbDecoder(content[treeSize+mmdbDataSectionSeparatorLength : markerIdx]),
+		cache:      make(map[uint]*geoIPInfo),
+	}
+
+	if ipVersion == 6 {
+		for i := 0; i < 96 && database.ipv4Start < database.nodeCount; i++ {
+			database.ipv4Start = database.record(database.ipv4Start, 0)
+		}
+	}
+
+	return database, nil
+}
+
+// Info returns the geography and network of the address, or nil if it is not
+// in the database, or its record has neither.
+func (m *mmdb) info(ip net.IP) *geoIPInfo {
+	offset, ok := m.lookup(ip)
+	if !ok {
+		return nil
+	}
+
+	if info, ok := m.cache[offset]; ok {
+		return info
+	}
+
+	var info *geoIPInfo
+	if value, _, err := m.data.decode(offset, 0); err == nil {
+		info = newGeoIPInfo(value)
+	}
+
+	if len(m.cache) >= geoIPCacheSize {
+		m.cache = make(map[uint]*geoIPInfo, len(m.cache))
+	}
+	m.cache[offset] = info
+
+	return info
+}
+
+// Lookup returns the offset in the data section of the record of the address,
+// if it is in the database.
+func (m *mmdb) lookup(ip net.IP) (uint, bool) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node = ip4, m.ipv4Start
+	} else if m.ipVersion == 4 {
+		return 0, false
+	}
+
+	for i := 0; i < len(ip)*8 && node < m.nodeCount; i++ {
+		node = m.record(node, uint(ip[i/8]>>(7-uint(i%8)))&1)
+	}
+
+	// Records past the node count point into the data section, beyond the
+	// separator, while a record of the node count is empty
+	if node <= m.nodeCount || node-m.nodeCount < mmdbDataSectionSeparatorLength {
+		return 0, false
+	}
+
+	return node - m.nodeCount - mmdbDataSectionSeparatorLength, true
+}
+
+// Record returns the left (0) or right (1) record of the node.
+func (m *mmdb) record(node, bit uint) uint {
+	b := m.tree[node*m.recordSize/4:]
+
+	switch m.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		// The middle byte holds the high nibble of each record
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// NewGeoIPInfo returns the geography and network of the decoded record, or nil
+// if it has neither. The country is that in which the address is located, or
+// else that in which it is registered, such as for anycast addresses.
+func newGeoIPInfo(value interface{}) *geoIPInfo {
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	info := new(geoIPInfo)
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := record[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				info.country = code
+				break
+			}
+		}
+	}
+
+	if asn, ok := record["autonomous_system_number"].(uint64); ok && asn <= math.MaxUint32 {
+		info.asn = uint32(asn)
+		info.asOrg, _ = record["autonomous_system_organization"].(string)
+	}
+
+	if info.country == "" && info.asn == 0 {
+		return nil
+	}
+
+	return info
+}
+
+// MMDBDecoder decodes the fields of a data section of a MaxMind DB, whose
+// pointers are relative to its start.
+type mmdbDecoder []byte
+
+// Decode returns the field at the offset, as a string, []byte, float64, uint64,
+// int32, bool, map[string]interface{} or []interface{}, and the offset of the
+// next. Unsigned 128-bit integers are returned as their big-endian bytes.
+func (d mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("fields nested too deeply")
+	}
+
+	ctrl, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	fieldType := uint(ctrl[0] >> 5)
+
+	if fieldType == mmdbTypePointer {
+		pointerSize := uint(ctrl[0]>>3&0x3) + 1
+		b, err := d.bytes(offset, pointerSize)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Pointers of each size start where those of the smaller size end
+		pointer := uint(ctrl[0] & 0x7)
+		if pointerSize == 4 {
+			pointer = 0
+		}
+		for _, c := range b {
+			pointer = pointer<<8 | uint(c)
+		}
+		pointer += [...]uint{0, 2048, 526336, 0}[pointerSize-1]
+
+		value, _, err := d.decode(pointer, depth+1)
+		return value, offset + pointerSize, err
+	}
+
+	if fieldType == mmdbTypeExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		fieldType = uint(b[0]) + 7
+	}
+
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+
+		size = 0
+		for _, c := range b {
+			size = size<<8 | uint(c)
+		}
+		size += [...]uint{29, 285, 65821}[n-1]
+	}
+
+	switch fieldType {
+	case mmdbTypeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key of type %T", key)
+			}
+
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	case mmdbTypeContainer, mmdbTypeEndMarker:
+		return nil, 0, fmt.Errorf("unexpected field of type %d", fieldType)
+	}
+
+	b, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+
+	switch fieldType {
+	case mmdbTypeString:
+		return string(b), offset, nil
+	case mmdbTypeBytes, mmdbTypeUint128:
+		return b, offset, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64, mmdbTypeInt32:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("integer of size %d", size)
+		}
+
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+
+		if fieldType == mmdbTypeInt32 {
+			return int32(uint32(u)), offset, nil
+		}
+		return u, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown field type %d", fieldType)
+	}
+}
+
+// Bytes returns the n bytes at the offset.
+func (d mmdbDecoder) bytes(offset, n uint) ([]byte, error) {
+	if offset > uint(len(d)) || n > uint(len(d))-offset {
+		return nil, fmt.Errorf("field at %d of size %d exceeds section of size %d",
+			offset,
+			n,
+			len(d))
+	}
+
+	return d[offset : offset+n], nil
+}
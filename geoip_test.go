@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// MockMMDBNode is a node of the search tree of a mock MaxMind DB, whose
+// records are either a child, or a field of the data section.
+type mockMMDBNode struct {
+	index    uint
+	children [2]*mockMMDBNode
+	data     [2]interface{}
+}
+
+// NewMockMMDB returns a MaxMind DB of the networks, by CIDR, and their records,
+// with a search tree of the IP version and record size.
+func newMockMMDB(t *testing.T, ipVersion, recordSize uint, networks map[string]interface{}) []byte {
+	cidrs := make([]string, 0, len(networks))
+	for cidr := range networks {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+
+	nodes := []*mockMMDBNode{new(mockMMDBNode)}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("parsing CIDR %q: %v", cidr, err)
+		}
+
+		ones, bits := network.Mask.Size()
+		ip := network.IP
+		if ipVersion == 6 && bits == 32 {
+			ip, ones = network.IP.To16(), ones+96
+			for i := 10; i < 12; i++ {
+				ip[i] = 0
+			}
+		}
+
+		node := nodes[0]
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if i == ones-1 {
+				node.data[bit] = networks[cidr]
+				break
+			}
+
+			if node.children[bit] == nil {
+				node.children[bit] = &mockMMDBNode{index: uint(len(nodes))}
+				nodes = append(nodes, node.children[bit])
+			}
+			node = node.children[bit]
+		}
+	}
+
+	nodeCount := uint(len(nodes))
+	var data []byte
+	var tree []byte
+	for _, node := range nodes {
+		var records [2]uint
+		for bit := range records {
+			switch {
+			case node.children[bit] != nil:
+				records[bit] = node.children[bit].index
+			case node.data[bit] != nil:
+				records[bit] = nodeCount + mmdbDataSectionSeparatorLength + uint(len(data))
+				data = append(data, encodeMockMMDBField(node.data[bit])...)
+			default:
+				records[bit] = nodeCount
+			}
+		}
+
+		switch recordSize {
+		case 24:
+			for _, record := range records {
+				tree = append(tree, byte(record>>16), byte(record>>8), byte(record))
+			}
+		case 28:
+			tree = append(tree,
+				byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte(records[0]>>24<<4|records[1]>>24),
+				byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		case 32:
+			for _, record := range records {
+				b := make([]byte, 4)
+				binary.BigEndian.PutUint32(b, uint32(record))
+				tree = append(tree, b...)
+			}
+		}
+	}
+
+	content := append(tree, make([]byte, mmdbDataSectionSeparatorLength)...)
+	content = append(content, data...)
+	content = append(content, mmdbMetadataMarker...)
+	content = append(content, encodeMockMMDBField(map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(recordSize),
+		"ip_version":    uint16(ipVersion),
+		"database_type": "Mock",
+	})...)
+
+	return content
+}
+
+// EncodeMockMMDBField encodes a string, uint16, uint32, uint64 or map of them,
+// of fewer than 285 bytes or pairs, as a field of a MaxMind DB.
+func encodeMockMMDBField(value interface{}) []byte {
+	header := func(fieldType uint, size int) []byte {
+		var extended []byte
+		if size >= 29 {
+			size, extended = 29, []byte{byte(size - 29)}
+		}
+
+		b := []byte{byte(fieldType<<5) | byte(size)}
+		if fieldType > 7 {
+			b = []byte{byte(size), byte(fieldType - 7)}
+		}
+		return append(b, extended...)
+	}
+
+	integer := func(fieldType uint, u uint64) []byte {
+		var b []byte
+		for ; u > 0; u >>= 8 {
+			b = append([]byte{byte(u)}, b...)
+		}
+		return append(header(fieldType, len(b)), b...)
+	}
+
+	switch v := value.(type) {
+	case string:
+		return append(header(mmdbTypeString, len(v)), v...)
+	case uint16:
+		return integer(mmdbTypeUint16, uint64(v))
+	case uint32:
+		return integer(mmdbTypeUint32, uint64(v))
+	case uint64:
+		return integer(mmdbTypeUint64, v)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		b := header(mmdbTypeMap, len(v))
+		for _, key := range keys {
+			b = append(b, encodeMockMMDBField(key)...)
+			b = append(b, encodeMockMMDBField(v[key])...)
+		}
+		return b
+	default:
+		panic("unsupported mock field type")
+	}
+}
+
+var mockGeoIPCountryNetworks = map[string]interface{}{
+	"8.8.8.0/24": map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "US"},
+	},
+	"1.1.1.0/24": map[string]interface{}{
+		"registered_country": map[string]interface{}{"iso_code": "AU"},
+	},
+}
+
+var mockGeoIPASNNetworks = map[string]interface{}{
+	"8.8.8.0/24": map[string]interface{}{
+		"autonomous_system_number":       uint32(15169),
+		"autonomous_system_organization": "GOOGLE",
+	},
+	"2001:4860::/32": map[string]interface{}{
+		"autonomous_system_number":       uint64(15169),
+		"autonomous_system_organization": "GOOGLE",
+	},
+}
+
+func TestMMDBInfo(t *testing.T) {
+	for _, recordSize := range []uint{24, 28, 32} {
+		for _, ipVersion := range []uint{4, 6} {
+			database, err := newMMDB(newMockMMDB(t, ipVersion, recordSize, mockGeoIPCountryNetworks))
+			if err != nil {
+				t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+			}
+
+			tests := []struct {
+				ip      string
+				country string
+			}{
+				{"8.8.8.8", "US"},
+				{"1.1.1.1", "AU"},
+				{"8.8.4.4", ""},
+				{"192.168.1.1", ""},
+				{"::ffff:8.8.8.8", "US"},
+			}
+
+			for _, test := range tests {
+				var country string
+				if info := database.info(net.ParseIP(test.ip)); info != nil {
+					country = info.country
+				}
+
+				if country != test.country {
+					t.Errorf("IPv%d, %d-bit records: expected country %q of %s, got %q",
+						ipVersion,
+						recordSize,
+						test.country,
+						test.ip,
+						country)
+				}
+			}
+		}
+	}
+}
+
+func TestMMDBInfoIPv6(t *testing.T) {
+	database, err := newMMDB(newMockMMDB(t, 6, 28, mockGeoIPASNNetworks))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	info := database.info(net.ParseIP("2001:4860:4860::8888"))
+	if info == nil || info.asn != 15169 || info.asOrg != "GOOGLE" {
+		t.Errorf("expected AS15169 GOOGLE, got %+v", info)
+	}
+
+	if info := database.info(net.ParseIP("2001:db8::1")); info != nil {
+		t.Errorf("expected no info, got %+v", info)
+	}
+}
+
+func TestMMDBInfoIPv6OfIPv4Database(t *testing.T) {
+	database, err := newMMDB(newMockMMDB(t, 4, 24, mockGeoIPCountryNetworks))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if info := database.info(net.ParseIP("2001:4860:4860::8888")); info != nil {
+		t.Errorf("expected no info, got %+v", info)
+	}
+}
+
+func TestNewMMDBNoMetadataError(t *testing.T) {
+	_, err := newMMDB([]byte("not a MaxMind DB"))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestNewMMDBTreeSizeError(t *testing.T) {
+	content := append([]byte{}, mmdbMetadataMarker...)
+	content = append(content, encodeMockMMDBField(map[string]interface{}{
+		"node_count":  uint32(1000),
+		"record_size": uint16(24),
+		"ip_version":  uint16(4),
+	})...)
+
+	_, err := newMMDB(content)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestMMDBDecoderPointer(t *testing.T) {
+	// "US", then a pointer to it
+	decoder := mmdbDecoder{0x42, 'U', 'S', 0x20, 0x00}
+
+	value, next, err := decoder.decode(3, 0)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if value != "US" {
+		t.Errorf("expected %q, got %v", "US", value)
+	}
+
+	if next != 5 {
+		t.Errorf("expected next offset 5, got %d", next)
+	}
+}
+
+func TestMMDBDecoderTruncatedError(t *testing.T) {
+	decoder := mmdbDecoder{0x44, 'U', 'S'}
+
+	_, _, err := decoder.decode(0, 0)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestGeoIPEnricherEnrich(t *testing.T) {
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	countryPath := filepath.Join(dir, "country.mmdb")
+	asnPath := filepath.Join(dir, "asn.mmdb")
+	if err := ioutil.WriteFile(countryPath, newMockMMDB(t, 6, 24, mockGeoIPCountryNetworks), 0644); err != nil {
+		t.Fatalf("writing country database: %v", err)
+	}
+	if err := ioutil.WriteFile(asnPath, newMockMMDB(t, 6, 24, mockGeoIPASNNetworks), 0644); err != nil {
+		t.Fatalf("writing ASN database: %v", err)
+	}
+
+	enricher, err := newGeoIPEnricher([]string{countryPath, asnPath})
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	contextEvent := &ContextEvent{Event: &event.Event{
+		SourceIP: net.ParseIP("192.168.1.2"),
+		DestIP:   net.ParseIP("8.8.8.8"),
+	}}
+	enricher.enrich(contextEvent)
+
+	if contextEvent.RemoteCountry != "US" ||
+		contextEvent.RemoteASN != 15169 ||
+		contextEvent.RemoteASOrg != "GOOGLE" {
+		t.Errorf("expected US, AS15169 GOOGLE, got %s, AS%d %s",
+			contextEvent.RemoteCountry,
+			contextEvent.RemoteASN,
+			contextEvent.RemoteASOrg)
+	}
+}
+
+func TestNewGeoIPEnricherReadError(t *testing.T) {
+	_, err := newGeoIPEnricher([]string{"/non/existent.mmdb"})
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The cloud providers from whose metadata service the ID of the instance of
+// the host can be fetched.
+const (
+	cloudMetadataAWS   = "aws"
+	cloudMetadataGCP   = "gcp"
+	cloudMetadataAzure = "azure"
+)
+
+// The keys of the host tags which are looked up, rather than configured.
+const (
+	hostTagHostname   = "hostname"
+	hostTagInstanceID = "instance_id"
+)
+
+const (
+	// CloudMetadataTimeout bounds the fetch of the instance ID, so that the
+	// eventer does not hang if the host is not of the cloud provider.
+	cloudMetadataTimeout = 2 * time.Second
+
+	// CloudMetadataMaxLength is the longest instance ID read.
+	cloudMetadataMaxLength = 256
+)
+
+// The base URLs of the metadata services of the cloud providers.
+var cloudMetadataBaseURLs = map[string]string{
+	cloudMetadataAWS:   "http://169.254.169.254",
+	cloudMetadataGCP:   "http://metadata.google.internal",
+	cloudMetadataAzure: "http://169.254.169.254",
+}
+
+// NewHostTags returns the tags with which every event is tagged: the
+// configured tags, and, if configured, the hostname of the host, and the ID
+// of its instance, fetched from the metadata service of the cloud provider at
+// the base URL. Configured tags take precedence over those looked up.
+func newHostTags(tags map[string]string,
+	hostname bool,
+	cloudMetadata string,
+	baseURL string,
+	client *http.Client) (map[string]string, error) {
+	hostTags := make(map[string]string, len(tags)+2)
+
+	if hostname {
+		name, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("getting hostname: %w", err)
+		}
+		hostTags[hostTagHostname] = name
+	}
+
+	if cloudMetadata != "" {
+		instanceID, err := fetchInstanceID(cloudMetadata, baseURL, client)
+		if err != nil {
+			return nil, fmt.Errorf("fetching instance ID from %s metadata service: %w", cloudMetadata, err)
+		}
+		hostTags[hostTagInstanceID] = instanceID
+	}
+
+	for key, value := range tags {
+		hostTags[key] = value
+	}
+
+	return hostTags, nil
+}
+
+// FetchInstanceID returns the ID of the instance of the host, from the
+// metadata service of the cloud provider at the base URL.
+func fetchInstanceID(cloudMetadata, baseURL string, client *http.Client) (string, error) {
+	var request *http.Request
+	var err error
+	switch cloudMetadata {
+	case cloudMetadataAWS:
+		// IMDSv2 requires a session token, but IMDSv1 may be all there is
+		token, err := fetchAWSMetadataToken(baseURL, client)
+		if err != nil {
+			return "", err
+		}
+
+		request, err = http.NewRequest(http.MethodGet, baseURL+"/latest/meta-data/instance-id", nil)
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			request.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+	case cloudMetadataGCP:
+		request, err = http.NewRequest(http.MethodGet, baseURL+"/computeMetadata/v1/instance/id", nil)
+		if err != nil {
+			return "", err
+		}
+		request.Header.Set("Metadata-Flavor", "Google")
+	case cloudMetadataAzure:
+		request, err = http.NewRequest(http.MethodGet,
+			baseURL+"/metadata/instance/compute/vmId?api-version=2021-02-01&format=text",
+			nil)
+		if err != nil {
+			return "", err
+		}
+		request.Header.Set("Metadata", "true")
+	default:
+		return "", fmt.Errorf("unknown cloud provider %q", cloudMetadata)
+	}
+
+	instanceID, err := doCloudMetadataRequest(request, client)
+	if err != nil {
+		return "", err
+	}
+
+	if instanceID == "" {
+		return "", errors.New("empty instance ID")
+	}
+
+	return instanceID, nil
+}
+
+// FetchAWSMetadataToken returns an IMDSv2 session token, or empty if the
+// metadata service supports only IMDSv1.
+func fetchAWSMetadataToken(baseURL string, client *http.Client) (string, error) {
+	request, err := http.NewRequest(http.MethodPut, baseURL+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+
+	token, err := doCloudMetadataRequest(request, client)
+	var statusErr *cloudMetadataStatusError
+	if errors.As(err, &statusErr) {
+		return "", nil
+	}
+
+	return token, err
+}
+
+// CloudMetadataStatusError is the unsuccessful status of a response of a
+// metadata service.
+type cloudMetadataStatusError struct {
+	status string
+}
+
+func (e *cloudMetadataStatusError) Error() string {
+	return "metadata service responded " + e.status
+}
+
+// DoCloudMetadataRequest returns the body of the response to the request to a
+// metadata service, trimmed of whitespace.
+func doCloudMetadataRequest(request *http.Request, client *http.Client) (string, error) {
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("requesting %s: %w", request.URL.Path, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", &cloudMetadataStatusError{status: response.Status}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, cloudMetadataMaxLength))
+	if err != nil {
+		return "", fmt.Errorf("reading response to %s: %w", request.URL.Path, err)
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewHostTags(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to get hostname: %v", err)
+	}
+
+	hostTags, err := newHostTags(map[string]string{"env": "prod", "rack": "r12"}, true, "", "", nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expected := map[string]string{"env": "prod", "rack": "r12", "hostname": hostname}
+	if len(hostTags) != len(expected) {
+		t.Errorf("expected tags %v, got %v", expected, hostTags)
+	}
+
+	for key, value := range expected {
+		if hostTags[key] != value {
+			t.Errorf("expected tag %s=%q, got %q", key, value, hostTags[key])
+		}
+	}
+}
+
+func TestNewHostTagsConfiguredTakePrecedence(t *testing.T) {
+	hostTags, err := newHostTags(map[string]string{"hostname": "web-1"}, true, "", "", nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if hostTags["hostname"] != "web-1" {
+		t.Errorf("expected configured hostname tag, got %q", hostTags["hostname"])
+	}
+}
+
+func TestFetchInstanceID(t *testing.T) {
+	tests := []struct {
+		cloudMetadata string
+		path          string
+		header        string
+		headerValue   string
+	}{
+		{cloudMetadataAWS, "/latest/meta-data/instance-id", "X-aws-ec2-metadata-token", "mock-token"},
+		{cloudMetadataGCP, "/computeMetadata/v1/instance/id", "Metadata-Flavor", "Google"},
+		{cloudMetadataAzure, "/metadata/instance/compute/vmId", "Metadata", "true"},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+				w.Write([]byte("mock-token"))
+			case r.Method == http.MethodGet && r.URL.Path == test.path && r.Header.Get(test.header) == test.headerValue:
+				w.Write([]byte("i-0123456789abcdef0\n"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+
+		instanceID, err := fetchInstanceID(test.cloudMetadata, server.URL, server.Client())
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: expected nil error, got %q (of type %T)", test.cloudMetadata, err, err)
+			continue
+		}
+
+		if instanceID != "i-0123456789abcdef0" {
+			t.Errorf("%s: expected instance ID %q, got %q", test.cloudMetadata, "i-0123456789abcdef0", instanceID)
+		}
+	}
+}
+
+func TestFetchInstanceIDAWSWithoutToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/latest/meta-data/instance-id" {
+			w.Write([]byte("i-0123456789abcdef0"))
+			return
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	instanceID, err := fetchInstanceID(cloudMetadataAWS, server.URL, server.Client())
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if instanceID != "i-0123456789abcdef0" {
+		t.Errorf("expected instance ID %q, got %q", "i-0123456789abcdef0", instanceID)
+	}
+}
+
+func TestFetchInstanceIDError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	_, err := fetchInstanceID(cloudMetadataGCP, server.URL, server.Client())
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestReplayEventerTagsEvents(t *testing.T) {
+	capture := "            curl-1234    [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=443 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n"
+
+	eventer, err := newReplayEventer(newReplaySource(strings.NewReader(capture), "", false),
+		&config{hostTags: map[string]string{"env": "prod"}})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	event, err := eventer.EventWithContext()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.HostTags["env"] != "prod" {
+		t.Errorf("expected event tagged env=prod, got %v", event.HostTags)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const osReleasePath = "/proc/sys/kernel/osrelease"
+
+// KernelInfo describes the kernel and tracefs environment which an Eventer is
+// attached to.
+type KernelInfo struct {
+	// KernelRelease is the release of the running kernel, e.g. "5.15.0-91-generic".
+	KernelRelease string
+	// Tracepoint is the tracepoint selected, e.g. "sock/inet_sock_set_state".
+	Tracepoint string
+	// Mountpoint is the path at which tracefs is mounted.
+	Mountpoint string
+	// InstancePath is the path of the tracing instance, which is the mountpoint
+	// itself if the top-level tracefs is used.
+	InstancePath string
+	// BufferSizeKB is the size of the ring buffer of each CPU, in KiB, or zero
+	// if the buffers of the CPUs differ in size.
+	BufferSizeKB uint64
+}
+
+// ParseBufferSizeKB parses the contents of a buffer_size_kb file, which is of
+// the form `1408`, or `7 (expanded: 1408)` if the buffer has not yet been
+// expanded to its configured size, or `X` if the per-CPU sizes differ.
+func parseBufferSizeKB(contents string) (uint64, error) {
+	contents = strings.TrimSpace(contents)
+	if contents == "X" {
+		return 0, nil
+	}
+
+	if idx := strings.Index(contents, "(expanded: "); idx != -1 {
+		contents = strings.TrimSuffix(contents[idx+len("(expanded: "):], ")")
+	}
+
+	if contents == "" {
+		return 0, errors.New("empty buffer size")
+	}
+
+	size, err := strconv.ParseUint(contents, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing buffer size: %w", err)
+	}
+
+	return size, nil
+}
+
+// ReleaseKernelInfo returns the kernel information of an event source which is
+// attached to no tracepoint or tracing instance, which is only the release of
+// the kernel, read from the path.
+func releaseKernelInfo(path string) (*KernelInfo, error) {
+	release, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading kernel release: %w", err)
+	}
+
+	return &KernelInfo{KernelRelease: strings.TrimSpace(string(release))}, nil
+}
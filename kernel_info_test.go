@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestParseBufferSizeKB(t *testing.T) {
+	for contents, expectedSize := range map[string]uint64{
+		"1408\n":               1408,
+		"7 (expanded: 1408)\n": 1408,
+		"X\n":                  0,
+	} {
+		size, err := parseBufferSizeKB(contents)
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %q (of type %T)", contents, err, err)
+		}
+
+		if size != expectedSize {
+			t.Errorf("expected size %d for %q, got %d", expectedSize, contents, size)
+		}
+	}
+}
+
+func TestParseBufferSizeKBError(t *testing.T) {
+	for _, contents := range []string{"", "foo\n", "7 (expanded: foo)\n"} {
+		_, err := parseBufferSizeKB(contents)
+		if err == nil {
+			t.Errorf("expected error for %q, got nil", contents)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"unsafe"
+)
+
+// The dynamic kprobe event provisioned on the tcp_set_state() kernel function,
+// if the kernel exposes neither of the TCP state change tracepoints.
+const (
+	kprobeFunction   = "tcp_set_state"
+	kprobeEventGroup = "tcp_audit"
+	kprobeEventName  = "tcp_audit_set_state" // Distinct from the tcp/tcp_set_state tracepoint
+	kprobeTracepoint = kprobeEventGroup + "/" + kprobeEventName
+)
+
+// KprobeArgRegisters are the registers holding the first two arguments of a
+// function upon entry, by architecture. The $argN fetch syntax cannot be used,
+// as it was added to the kernel after the TCP state change tracepoints, so is
+// absent from any kernel which needs the kprobe.
+var kprobeArgRegisters = map[string][2]string{
+	"amd64":   {"%di", "%si"},
+	"arm64":   {"%x0", "%x1"},
+	"arm":     {"%r0", "%r1"},
+	"ppc64le": {"%r3", "%r4"},
+	"s390x":   {"%r2", "%r3"},
+}
+
+// KprobeStates are the names of the kernel's TCP states, indexed by value, as
+// the kprobe can only fetch the raw values.
+var kprobeStates = []string{
+	1:  "TCP_ESTABLISHED",
+	2:  "TCP_SYN_SENT",
+	3:  "TCP_SYN_RECV",
+	4:  "TCP_FIN_WAIT1",
+	5:  "TCP_FIN_WAIT2",
+	6:  "TCP_TIME_WAIT",
+	7:  "TCP_CLOSE",
+	8:  "TCP_CLOSE_WAIT",
+	9:  "TCP_LAST_ACK",
+	10: "TCP_LISTEN",
+	11: "TCP_CLOSING",
+	12: "TCP_NEW_SYN_RECV",
+	13: "TCP_BOUND_INACTIVE",
+}
+
+// HostByteOrder is the byte order of the running machine, in which the kprobe
+// fetches multi-byte values.
+var hostByteOrder binary.ByteOrder = func() binary.ByteOrder {
+	i := uint16(1)
+	if *(*byte)(unsafe.Pointer(&i)) == 1 {
+		return binary.LittleEndian
+	}
+
+	return binary.BigEndian
+}()
+
+// KprobeDefinition returns the kprobe_events definition of the kprobe for the
+// architecture. The arguments of tcp_set_state() are the struct sock and the
+// new state. The fields fetched from the struct sock are those of its leading
+// struct sock_common, the layout of which has been stable since Linux 3.x, and
+// are named as the equivalent fields of the sock/inet_sock_set_state tracepoint,
+// as is the address of the struct sock itself.
+func kprobeDefinition(arch string) (string, error) {
+	registers, ok := kprobeArgRegisters[arch]
+	if !ok {
+		return "", fmt.Errorf("kprobe not supported on architecture %s", arch)
+	}
+	sk, state := registers[0], registers[1]
+
+	// The socket address is fetched from the register, so is of the native
+	// pointer size
+	skAddrType := "x64"
+	if arch == "arm" {
+		skAddrType = "x32"
+	}
+
+	return fmt.Sprintf("p:%s %s "+
+		"skaddr=%s:%s "+
+		"family=+16(%s):u16 "+
+		"sport=+14(%s):u16 "+
+		"dport=+12(%s):u16 "+
+		"saddr=+4(%s):u32 "+
+		"daddr=+0(%s):u32 "+
+		"oldstate=+18(%s):u8 "+
+		"newstate=%s:s32\n",
+		kprobeTracepoint,
+		kprobeFunction,
+		sk, skAddrType,
+		sk, sk, sk, sk, sk, sk,
+		state), nil
+}
+
+// NormaliseKprobeTags converts the raw values fetched by the kprobe to the form
+// in which the equivalent tracepoint fields are output, so that the remainder
+// of the parser can treat them the same.
+func normaliseKprobeTags(tags *taggedFields) error {
+	value, _ := tags.get("family")
+	family, err := parseUintBytes(value, math.MaxUint16, false)
+	if err != nil {
+		return fmt.Errorf("converting family to integer: %w", err)
+	}
+
+	switch family {
+	case 2:
+		tags.set("family", []byte(familyInet))
+	case 10:
+		tags.set("family", []byte("AF_INET6"))
+	}
+
+	// The remaining fields are irrelevant to other families
+	if value, _ := tags.get("family"); string(value) != familyInet {
+		return nil
+	}
+
+	// The destination port is fetched in network byte order
+	value, _ = tags.get("dport")
+	dPort, err := parseUintBytes(value, math.MaxUint16, false)
+	if err != nil {
+		return fmt.Errorf("converting destination port to integer: %w", err)
+	}
+	dPortBytes := make([]byte, 2)
+	hostByteOrder.PutUint16(dPortBytes, uint16(dPort))
+	tags.set("dport", strconv.AppendUint(nil, uint64(binary.BigEndian.Uint16(dPortBytes)), 10))
+
+	// Addresses are fetched in network byte order
+	for _, tag := range []string{"saddr", "daddr"} {
+		value, _ := tags.get(tag)
+		addr, err := parseUintBytes(value, math.MaxUint32, false)
+		if err != nil {
+			return fmt.Errorf("converting %s to integer: %w", tag, err)
+		}
+		ip := make(net.IP, net.IPv4len)
+		hostByteOrder.PutUint32(ip, uint32(addr))
+		tags.set(tag, []byte(ip.String()))
+	}
+
+	for _, tag := range []string{"oldstate", "newstate"} {
+		value, _ := tags.get(tag)
+		state, err := parseUintBytes(value, math.MaxInt32, false)
+		if err != nil {
+			return fmt.Errorf("converting %s to integer: %w", tag, err)
+		}
+
+		if state == 0 || state >= uint64(len(kprobeStates)) {
+			return fmt.Errorf("unknown %s %d", tag, state)
+		}
+		tags.set(tag, []byte(kprobeStates[state]))
+	}
+
+	return nil
+}
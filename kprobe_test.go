@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// mockKprobeFields returns the raw values the kprobe would fetch for the given
+// ports and addresses, which the kernel holds in network byte order.
+func mockKprobeFields(dport uint16, saddr, daddr [4]byte) (string, string, string) {
+	dportBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(dportBytes, dport)
+
+	return strconv.FormatUint(uint64(hostByteOrder.Uint16(dportBytes)), 10),
+		strconv.FormatUint(uint64(hostByteOrder.Uint32(saddr[:])), 10),
+		strconv.FormatUint(uint64(hostByteOrder.Uint32(daddr[:])), 10)
+}
+
+func TestParseKprobe(t *testing.T) {
+	dport, saddr, daddr := mockKprobeFields(80, [4]byte{192, 168, 122, 38}, [4]byte{172, 217, 169, 4})
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: tcp_audit_set_state: (tcp_set_state+0x0/0x240) " +
+		"skaddr=0xffff8880a1b2c3d4 family=2 sport=44406 dport=" + dport + " saddr=" + saddr + " daddr=" + daddr + " oldstate=2 newstate=1")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if event.Socket == nil || event.Socket.Address != 0xffff8880a1b2c3d4 {
+		t.Errorf("expected socket address 0xffff8880a1b2c3d4, got %+v", event.Socket)
+	}
+
+	if event.SourcePort != 44406 || event.DestPort != 80 {
+		t.Errorf("expected ports 44406 and 80, got %d and %d", event.SourcePort, event.DestPort)
+	}
+
+	if event.SourceIP.String() != "192.168.122.38" || event.DestIP.String() != "172.217.169.4" {
+		t.Errorf("expected addresses 192.168.122.38 and 172.217.169.4, got %v and %v",
+			event.SourceIP,
+			event.DestIP)
+	}
+
+	if event.OldState != tcpstate.StateSynSent || event.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected states %v and %v, got %v and %v",
+			tcpstate.StateSynSent,
+			tcpstate.StateEstablished,
+			event.OldState,
+			event.NewState)
+	}
+}
+
+func TestParseKprobeIrrelevantEventErrorOnNonInetAddressFamily(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: tcp_audit_set_state: (tcp_set_state+0x0/0x240) " +
+		"family=10 sport=44406 dport=20480 saddr=0 daddr=0 oldstate=2 newstate=1")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	_, err := eventParser.toEvent(mockEventTrace)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if err != errNonInetEvent {
+		t.Errorf("expected error to be %q, but was %q", errNonInetEvent, err)
+	}
+
+	if !errors.Is(err, ErrIrrelevantEvent) {
+		t.Errorf("expected error chain to include %q, but did not", ErrIrrelevantEvent)
+	}
+}
+
+func TestNormaliseKprobeTagsUnknownStateError(t *testing.T) {
+	tags := newMockTaggedFields("family=2 sport=44406 dport=20480 saddr=0 daddr=0 oldstate=2 newstate=99")
+
+	err := normaliseKprobeTags(&tags)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestKprobeDefinition(t *testing.T) {
+	definition, err := kprobeDefinition("amd64")
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !strings.HasPrefix(definition, "p:"+kprobeTracepoint+" tcp_set_state ") {
+		t.Errorf("expected definition of kprobe on tcp_set_state, got %q", definition)
+	}
+
+	if !strings.Contains(definition, "newstate=%si:s32") {
+		t.Errorf("expected new state fetched from second argument register, got %q", definition)
+	}
+
+	if !strings.Contains(definition, "skaddr=%di:x64") {
+		t.Errorf("expected socket address fetched from first argument register, got %q", definition)
+	}
+}
+
+func TestKprobeDefinitionUnsupportedArchitectureError(t *testing.T) {
+	_, err := kprobeDefinition("mock-arch")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
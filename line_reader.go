@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync/atomic"
+)
+
+// The line readers with which the lines of a tracing instance can be read.
+const (
+	lineReaderBlock   = "block"   // A blockLineReader
+	lineReaderScanner = "scanner" // A bufio.Scanner
+)
+
+const (
+	// LineReaderBlockSize is the default size of the blocks read by a block
+	// line reader, unless its lines may be longer.
+	lineReaderBlockSize = 64 * 1024
+
+	// LineReaderMaxEmptyReads is the number of consecutive reads returning
+	// neither bytes nor an error after which a reader is deemed to make no
+	// progress, as by bufio.Scanner.
+	lineReaderMaxEmptyReads = 100
+)
+
+// LineReader reads the lines of a stream, with the methods of bufio.Scanner,
+// which is one.
+type lineReader interface {
+	// Scan advances to the next line, returning false once the stream is
+	// exhausted or fails.
+	Scan() bool
+
+	// Bytes returns the line, without its line ending, which is only valid
+	// until the next call to Scan.
+	Bytes() []byte
+
+	// Err returns the error with which the stream failed, or nil if it was
+	// exhausted.
+	Err() error
+}
+
+// NewLineReader returns a reader of the lines of the reader, of the kind, which
+// skips, and counts in oversize, lines of more than maxLineLength bytes,
+// including the line ending, and reads up to bufferSize bytes at a time. If the
+// kind is empty, a block line reader is returned. If maxLineLength is zero,
+// bufio.MaxScanTokenSize is used, and if bufferSize is zero, the default of the
+// kind.
+func newLineReader(reader io.Reader, kind string, maxLineLength, bufferSize int, oversize *uint64) lineReader {
+	if kind == lineReaderScanner {
+		return newLineScanner(reader, maxLineLength, bufferSize, oversize)
+	}
+
+	return newBlockLineReader(reader, maxLineLength, bufferSize, oversize)
+}
+
+// BlockLineReader reads a stream in large blocks, such as those which a read of
+// trace_pipe fills with as many whole lines as are available, and returns its
+// lines as slices of its buffer, so that neither lines nor tokens are copied or
+// allocated. Only a partial line at the end of a block is moved, to the start
+// of the buffer, before the next block is read after it. Lines longer than
+// the maximum line length are skipped and counted, as by newLineScanner. Once
+// reading fails, the lines already read are returned, then the failure.
+type blockLineReader struct {
+	reader        io.Reader
+	maxLineLength int
+	oversize      *uint64 // Counted atomically, as it may be shared
+
+	buf        []byte
+	start, end int  // The bytes of buf read but not yet returned
+	discarding bool // Whether the remainder of an oversize line is being skipped
+	line       []byte
+	err        error // Sticky, once reading fails
+}
+
+// NewBlockLineReader returns a block line reader of the lines of the reader of
+// at most maxLineLength bytes, or, if it is zero, bufio.MaxScanTokenSize, which
+// reads blocks of bufferSize bytes, or, if it is zero, lineReaderBlockSize,
+// unless its lines may be longer.
+func newBlockLineReader(reader io.Reader, maxLineLength, bufferSize int, oversize *uint64) *blockLineReader {
+	if maxLineLength <= 0 {
+		maxLineLength = bufio.MaxScanTokenSize
+	}
+
+	size := lineReaderBlockSize
+	if bufferSize > 0 {
+		size = bufferSize
+	}
+
+	if maxLineLength > size {
+		size = maxLineLength
+	}
+
+	return &blockLineReader{
+		reader:        reader,
+		maxLineLength: maxLineLength,
+		oversize:      oversize,
+		buf:           make([]byte, size),
+	}
+}
+
+func (r *blockLineReader) Scan() bool {
+	emptyReads := 0
+	for {
+		if line, ok := r.nextLine(); ok {
+			r.line = line
+			return true
+		}
+
+		if r.err != nil {
+			// The last line may not be terminated, as by bufio.ScanLines
+			r.line = nil
+			if r.start == r.end || r.discarding {
+				return false
+			}
+			r.line = dropCR(r.buf[r.start:r.end])
+			r.start = r.end
+
+			return true
+		}
+
+		// A partial line is moved to the start of the buffer, which, as it is
+		// shorter than the maximum line length, leaves room to read more
+		if r.start > 0 {
+			r.end = copy(r.buf, r.buf[r.start:r.end])
+			r.start = 0
+		}
+
+		n, err := r.reader.Read(r.buf[r.end:])
+		r.end += n
+		switch {
+		case err != nil:
+			r.err = err
+		case n > 0:
+			emptyReads = 0
+		default:
+			if emptyReads++; emptyReads >= lineReaderMaxEmptyReads {
+				r.err = io.ErrNoProgress
+			}
+		}
+	}
+}
+
+// NextLine returns the next whole line in the buffer, if any, skipping those
+// oversize.
+func (r *blockLineReader) nextLine() ([]byte, bool) {
+	for r.start < r.end {
+		data := r.buf[r.start:r.end]
+		idx := bytes.IndexByte(data, '\n')
+
+		if r.discarding {
+			if idx == -1 {
+				r.start = r.end
+				return nil, false
+			}
+			r.start += idx + 1
+			r.discarding = false
+			continue
+		}
+
+		if idx == -1 {
+			// The partial line can no longer fit, so the line is oversize
+			if len(data) >= r.maxLineLength {
+				atomic.AddUint64(r.oversize, 1)
+				r.start = r.end
+				r.discarding = true
+			}
+
+			return nil, false
+		}
+		r.start += idx + 1
+
+		// A line as long would not fit in the buffer of a bufio.Scanner
+		if idx >= r.maxLineLength {
+			atomic.AddUint64(r.oversize, 1)
+			continue
+		}
+
+		return dropCR(data[:idx]), true
+	}
+
+	return nil, false
+}
+
+func (r *blockLineReader) Bytes() []byte {
+	return r.line
+}
+
+func (r *blockLineReader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+
+	return r.err
+}
+
+// DropCR drops a terminal \r from the line, as bufio.ScanLines.
+func dropCR(line []byte) []byte {
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		return line[:len(line)-1]
+	}
+
+	return line
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBlockLineReaderSkipsOversizeLines(t *testing.T) {
+	input := "first\n" + strings.Repeat("x", 100) + "\nsecond\r\n" + strings.Repeat("y", 16) + "\nthird"
+	var oversize uint64
+	reader := newBlockLineReader(strings.NewReader(input), 16, 0, &oversize)
+
+	var lines []string
+	for reader.Scan() {
+		lines = append(lines, string(reader.Bytes()))
+	}
+
+	if err := reader.Err(); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedLines := []string{"first", "second", "third"}
+	if strings.Join(lines, ",") != strings.Join(expectedLines, ",") {
+		t.Errorf("expected lines %q, got %q", expectedLines, lines)
+	}
+
+	if oversize != 2 {
+		t.Errorf("expected 2 oversize lines, got %d", oversize)
+	}
+}
+
+func TestBlockLineReaderMatchesScanner(t *testing.T) {
+	// Lines straddle the blocks read, of single bytes, and the buffer, which
+	// must be compacted to read the longest line
+	input := strings.Repeat("a\n"+strings.Repeat("b", 15)+"\n"+strings.Repeat("c", 16)+"\n\n", 3) + "d"
+	for _, maxLineLength := range []int{16, lineReaderBlockSize + 1} {
+		var scannerOversize, readerOversize uint64
+		scanner := newLineScanner(strings.NewReader(input), maxLineLength, 0, &scannerOversize)
+		reader := newBlockLineReader(iotest.OneByteReader(strings.NewReader(input)), maxLineLength, 0, &readerOversize)
+
+		for scanner.Scan() {
+			if !reader.Scan() {
+				t.Fatalf("max %d: expected line %q, got none, with error %v", maxLineLength, scanner.Text(), reader.Err())
+			}
+
+			if string(reader.Bytes()) != scanner.Text() {
+				t.Errorf("max %d: expected line %q, got %q", maxLineLength, scanner.Text(), reader.Bytes())
+			}
+		}
+
+		if reader.Scan() {
+			t.Errorf("max %d: expected no more lines, got %q", maxLineLength, reader.Bytes())
+		}
+
+		if readerOversize != scannerOversize {
+			t.Errorf("max %d: expected %d oversize lines, got %d", maxLineLength, scannerOversize, readerOversize)
+		}
+	}
+}
+
+func TestBlockLineReaderError(t *testing.T) {
+	mockErr := errors.New("mock read error")
+	reader := newBlockLineReader(io.MultiReader(strings.NewReader("first\nsecond"), newMockReader(mockErr, nil)),
+		0,
+		0,
+		new(uint64))
+
+	var lines []string
+	for reader.Scan() {
+		lines = append(lines, string(reader.Bytes()))
+	}
+
+	// The lines read before the failure are returned
+	if strings.Join(lines, ",") != "first,second" {
+		t.Errorf("expected lines %q, got %q", []string{"first", "second"}, lines)
+	}
+
+	if err := reader.Err(); !errors.Is(err, mockErr) {
+		t.Errorf("expected mock error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestNewLineReaderScanner(t *testing.T) {
+	reader := newLineReader(strings.NewReader("first\n"), lineReaderScanner, 0, 0, new(uint64))
+	if _, ok := reader.(*blockLineReader); ok {
+		t.Errorf("expected bufio.Scanner, got %T", reader)
+	}
+
+	reader = newLineReader(strings.NewReader("first\n"), "", 0, 0, new(uint64))
+	if _, ok := reader.(*blockLineReader); !ok {
+		t.Errorf("expected *blockLineReader, got %T", reader)
+	}
+}
+
+// MockSizedReader records the size of the largest buffer read into.
+type mockSizedReader struct {
+	io.Reader
+	largest int
+}
+
+func (r *mockSizedReader) Read(p []byte) (int, error) {
+	if len(p) > r.largest {
+		r.largest = len(p)
+	}
+
+	return r.Reader.Read(p)
+}
+
+func TestNewLineReaderBufferSize(t *testing.T) {
+	const bufferSize = 1024 * 1024
+	for _, kind := range []string{lineReaderBlock, lineReaderScanner} {
+		sizedReader := &mockSizedReader{Reader: strings.NewReader("first\nsecond\n")}
+		reader := newLineReader(sizedReader, kind, 0, bufferSize, new(uint64))
+		for reader.Scan() {
+		}
+
+		if sizedReader.largest != bufferSize {
+			t.Errorf("expected %s reads of %d bytes, got %d", kind, bufferSize, sizedReader.largest)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync/atomic"
+)
+
+// LineSplitter splits a stream into lines, as bufio.ScanLines, but skips lines
+// longer than the maximum line length, which would otherwise fail the scanner,
+// so that a single oversize line does not end the stream.
+type lineSplitter struct {
+	maxLineLength int
+	oversize      *uint64 // Counted atomically, as it may be shared
+	discarding    bool    // Whether the remainder of an oversize line is being skipped
+}
+
+// NewLineScanner returns a scanner of the lines of the reader which skips, and
+// counts in oversize, lines of more than maxLineLength bytes, including the
+// line ending. If maxLineLength is zero, bufio.MaxScanTokenSize is used. The
+// scanner reads into a buffer of bufferSize bytes, or, if it is zero, one which
+// starts small and grows with the lines.
+func newLineScanner(reader io.Reader, maxLineLength, bufferSize int, oversize *uint64) *bufio.Scanner {
+	if maxLineLength <= 0 {
+		maxLineLength = bufio.MaxScanTokenSize
+	}
+
+	initialSize := 4096
+	if maxLineLength < initialSize {
+		initialSize = maxLineLength
+	}
+
+	// Lines are skipped by the splitter once they reach the maximum line
+	// length, so the buffer may be larger
+	maxSize := maxLineLength
+	if bufferSize > 0 {
+		initialSize = bufferSize
+		if bufferSize > maxSize {
+			maxSize = bufferSize
+		}
+	}
+
+	splitter := &lineSplitter{maxLineLength: maxLineLength, oversize: oversize}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, initialSize), maxSize)
+	scanner.Split(splitter.split)
+
+	return scanner
+}
+
+func (ls *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if ls.discarding {
+		if idx := bytes.IndexByte(data, '\n'); idx != -1 {
+			ls.discarding = false
+			return idx + 1, nil, nil
+		}
+
+		return len(data), nil, nil
+	}
+
+	// The buffer is full without a complete line, so the line is oversize
+	if len(data) >= ls.maxLineLength && bytes.IndexByte(data, '\n') == -1 {
+		atomic.AddUint64(ls.oversize, 1)
+		ls.discarding = true
+		return len(data), nil, nil
+	}
+
+	return bufio.ScanLines(data, atEOF)
+}
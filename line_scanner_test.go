@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLineScannerSkipsOversizeLines(t *testing.T) {
+	input := "first\n" + strings.Repeat("x", 100) + "\nsecond\n" + strings.Repeat("y", 64) + "\nthird"
+	var oversize uint64
+	scanner := newLineScanner(strings.NewReader(input), 16, 0, &oversize)
+
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedLines := []string{"first", "second", "third"}
+	if strings.Join(lines, ",") != strings.Join(expectedLines, ",") {
+		t.Errorf("expected lines %q, got %q", expectedLines, lines)
+	}
+
+	if oversize != 2 {
+		t.Errorf("expected 2 oversize lines, got %d", oversize)
+	}
+}
+
+func TestLineScannerDefaultMaxLineLength(t *testing.T) {
+	input := strings.Repeat("x", 32*1024) + "\n"
+	var oversize uint64
+	scanner := newLineScanner(strings.NewReader(input), 0, 0, &oversize)
+
+	if !scanner.Scan() {
+		t.Fatalf("expected line, got none, with error %v", scanner.Err())
+	}
+
+	if len(scanner.Bytes()) != 32*1024 {
+		t.Errorf("expected line of %d bytes, got %d", 32*1024, len(scanner.Bytes()))
+	}
+
+	if oversize != 0 {
+		t.Errorf("expected no oversize lines, got %d", oversize)
+	}
+}
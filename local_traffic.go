@@ -0,0 +1,24 @@
+package main
+
+import "net"
+
+// LocalTraffic returns whether either address of the event is loopback,
+// link-local or unspecified, such as those of connections to local services,
+// of link-local services such as cloud metadata endpoints, and of listening
+// sockets, which are the bulk of the noise on many hosts. Markers of lost
+// events have no addresses, so are not local traffic.
+func localTraffic(event *ContextEvent) bool {
+	if event.Kind == KindLostEvents {
+		return false
+	}
+
+	return localAddress(event.SourceIP) || localAddress(event.DestIP)
+}
+
+func localAddress(ip net.IP) bool {
+	return ip != nil &&
+		(ip.IsLoopback() ||
+			ip.IsLinkLocalUnicast() ||
+			ip.IsLinkLocalMulticast() ||
+			ip.IsUnspecified())
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+func TestLocalTraffic(t *testing.T) {
+	tests := []struct {
+		sourceIP, destIP string
+		kind             EventKind
+		local            bool
+	}{
+		{"192.168.122.38", "172.217.169.4", KindStateChange, false},
+		{"127.0.0.1", "127.0.0.1", KindStateChange, true},
+		{"::1", "::1", KindStateChange, true},
+		{"192.168.122.38", "169.254.169.254", KindStateChange, true},
+		{"fe80::1", "fe80::2", KindStateChange, true},
+		{"0.0.0.0", "0.0.0.0", KindStateChange, true},
+		{"::ffff:127.0.0.1", "::ffff:127.0.0.1", KindStateChange, true},
+		{"", "", KindLostEvents, false},
+	}
+
+	for _, test := range tests {
+		contextEvent := &ContextEvent{
+			Event: &event.Event{SourceIP: net.ParseIP(test.sourceIP), DestIP: net.ParseIP(test.destIP)},
+			Kind:  test.kind,
+		}
+
+		if local := localTraffic(contextEvent); local != test.local {
+			t.Errorf("expected %s to %s to be local traffic %t, got %t",
+				test.sourceIP,
+				test.destIP,
+				test.local,
+				local)
+		}
+	}
+}
+
+func TestReplayEventerEventExcludesLocalTraffic(t *testing.T) {
+	capture := "" +
+		"            curl-1234    [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=127.0.0.1 daddr=127.0.0.1 saddrv6=::ffff:127.0.0.1 daddrv6=::ffff:127.0.0.1 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n" +
+		"            curl-1234    [000] ..s.   995.368985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44408 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n"
+
+	eventer, err := newReplayEventer(newReplaySource(strings.NewReader(capture), "", false),
+		&config{excludeLocalTraffic: true})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.SourcePort != 44408 {
+		t.Errorf("expected event of port 44408, got %d", event.SourcePort)
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if stats.Skipped.LocalTraffic != 1 {
+		t.Errorf("expected 1 event of local traffic excluded, got %d", stats.Skipped.LocalTraffic)
+	}
+}
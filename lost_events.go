@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+var (
+	lostEventsMarkerPrefix = []byte("CPU:")
+	lostEventsMarkerInfix  = []byte(" [LOST ")
+	lostEventsMarkerSuffix = []byte(" EVENTS]")
+)
+
+// LostEventsError is an error returned if the kernel reports that events were
+// lost, for example due to the ring buffer being overrun. Receiving this error
+// does not prevent further events being read, but indicates that the stream of
+// events is incomplete.
+type LostEventsError struct {
+	// CPU is the CPU whose ring buffer lost the events.
+	CPU int
+	// Lost is the number of events lost.
+	Lost uint64
+}
+
+func (e *LostEventsError) Error() string {
+	return fmt.Sprintf("%d events lost on CPU %d", e.Lost, e.CPU)
+}
+
+// ToEvent returns a synthetic event of the KindLostEvents kind, marking the gap
+// in the stream of events.
+func (e *LostEventsError) toEvent() *ContextEvent {
+	return &ContextEvent{
+		Event:      &event.Event{Time: time.Now().UTC()},
+		Kind:       KindLostEvents,
+		Context:    &TraceContext{CPU: e.CPU},
+		LostEvents: e.Lost,
+	}
+}
+
+// ParseLostEventsMarker parses the marker the kernel inserts into the
+// trace_pipe stream after events are lost, which is of the form
+// `CPU:N [LOST n EVENTS]`. If the line is not such a marker, ok is false.
+func parseLostEventsMarker(line []byte) (lostEventsErr *LostEventsError, ok bool) {
+	line = trimLinePadding(line)
+	if len(line) < len(lostEventsMarkerPrefix)+len(lostEventsMarkerSuffix) ||
+		!bytes.HasPrefix(line, lostEventsMarkerPrefix) ||
+		!bytes.HasSuffix(line, lostEventsMarkerSuffix) {
+		return nil, false
+	}
+
+	line = line[len(lostEventsMarkerPrefix) : len(line)-len(lostEventsMarkerSuffix)]
+	idx := bytes.Index(line, lostEventsMarkerInfix)
+	if idx == -1 {
+		return nil, false
+	}
+
+	cpu, err := strconv.Atoi(string(line[:idx]))
+	if err != nil {
+		return nil, false
+	}
+
+	lost, err := strconv.ParseUint(string(line[idx+len(lostEventsMarkerInfix):]), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	return &LostEventsError{CPU: cpu, Lost: lost}, true
+}
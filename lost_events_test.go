@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestParseLostEventsMarker(t *testing.T) {
+	lostEventsErr, ok := parseLostEventsMarker([]byte("CPU:3 [LOST 1234 EVENTS]"))
+	if !ok {
+		t.Fatal("expected line to be parsed as lost events marker, but was not")
+	}
+
+	if lostEventsErr.CPU != 3 {
+		t.Errorf("expected CPU %d, got %d", 3, lostEventsErr.CPU)
+	}
+
+	if lostEventsErr.Lost != 1234 {
+		t.Errorf("expected %d lost events, got %d", 1234, lostEventsErr.Lost)
+	}
+}
+
+func TestParseLostEventsMarkerNotMarker(t *testing.T) {
+	for _, mockLine := range []string{
+		"<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET",
+		"CPU:3 [LOST foo EVENTS]",
+		"CPU:foo [LOST 1234 EVENTS]",
+		"CPU:3 [LOST 1234 EVENTS",
+		"CPU:3 [FOUND 1234 EVENTS]",
+	} {
+		if _, ok := parseLostEventsMarker([]byte(mockLine)); ok {
+			t.Errorf("expected line %q not to be parsed as lost events marker, but was", mockLine)
+		}
+	}
+}
+
+func TestParseLostEventsMarkerTrailingPadding(t *testing.T) {
+	lostEventsErr, ok := parseLostEventsMarker([]byte("CPU:3 [LOST 1234 EVENTS] \t\r"))
+	if !ok {
+		t.Fatal("expected line to be parsed as lost events marker, but was not")
+	}
+
+	if lostEventsErr.Lost != 1234 {
+		t.Errorf("expected %d lost events, got %d", 1234, lostEventsErr.Lost)
+	}
+}
@@ -1,114 +1,1274 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
 )
 
 var ErrEventerClosed = errors.New("read from closed eventer")
 
+// ErrEventsSummarised is returned by Event() if events are summarised, as only
+// EventWithContext() returns summaries.
+var ErrEventsSummarised = errors.New("events are summarised, so are read only with EventWithContext()")
+
 type Eventer struct {
+	lostEvents uint64 // Accessed atomically, so first to guarantee 64-bit alignment
+	lastRead   int64  // Accessed atomically, the time in Unix nanoseconds a line was last read
+	recovering int32  // Accessed atomically, non-zero if the tracing instance must be recovered
+	reloading  int32  // Accessed atomically, non-zero if a reload awaits the reader of events
+	closed     int32  // Accessed atomically, non-zero once closed
+
 	tracingInstance tracingInstance
-	scanner         *bufio.Scanner
+	source          eventSource // If not reading a tracing instance, replaces it
+	lines           lineSource  // If not reading a tracing instance, replaces it
+	traceRingBuf    io.Reader
+	scanner         lineReader
+	shards          *shardedReader // If reading per-CPU, replaces the scanner
+	parsers         *parserPool    // If parsing in a pool of workers, parses the lines scanned
 	eventParser     eventParser
+	config          *config
+	skipped         *skipCounters
+	failures        *failureCounters
+	deduplicator    *deduplicator        // Nil if duplicates are not suppressed
+	processFilter   *processFilter       // Nil if no commands or PIDs are filtered
+	netNSTagger     *netNSTagger         // Nil if network namespaces are not tagged
+	reverseDNS      *reverseDNSResolver  // Nil if hostnames are not looked up
+	geoIP           *geoIPEnricher       // Nil if remote addresses are not enriched
+	hostTags        map[string]string    // Nil if events are not tagged
+	reconciler      *existingReconciler  // Nil if no connections were listed when attached
+	classifier      *directionClassifier // Nil if directions are not classified
+	mptcpTagger     *mptcpTagger         // Nil if MPTCP connections are not tagged
+	mptcpConn       *sockDiagConn        // Nil if MPTCP connections are not tagged
+	debouncer       *debouncer           // Nil if state changes are not debounced
+	flowTracker     *flowTracker         // Nil if flows are not tracked
+	summariser      *summariser          // Nil if events are not summarised
+
+	filterExpression *filterExpression // Less any conjuncts offloaded, or nil if none
+	filterOffload    *atomic.Value     // The FilterOffloadStats of the filter expression
+
+	readDeadline     time.Time // The deadline for Event() when reading per-CPU, or in a parser pool
+	userReadDeadline time.Time // The deadline set by SetReadDeadline, guarded by the instance mutex
 
-	closedMutex *sync.Mutex
-	closed      bool
+	getenv      func(string) string // The source of the options reloaded
+	loaded      *config             // The options last loaded, guarded by the reload mutex
+	reload      *reload             // Awaiting the reader of events, guarded by the instance mutex
+	reloadMutex *sync.Mutex         // Serialises reloads
+
+	existing        []*ContextEvent // The connections when attached, returned first
+	backfill        lineReader      // The trace file contents, read before trace_pipe
+	backfilledUntil traceTimestamp  // The timestamp of the last backfilled event
+
+	instanceMutex *sync.Mutex // Serialises changes to the state of the tracing instance
+	done          chan struct{}
+	doneOnce      *sync.Once
 }
 
 func New() (e event.Eventer, err error) {
+	getenv, err := configFileGetenv(os.Getenv)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+
+	config, err := loadConfig(getenv)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+
 	fieldParser := new(slicingFieldParser)
-	virtualDeviceMountsParser := newProcMountsMountsParser(fieldParser)
-	mountpointRetriever := newProcFSMountpointRetriever(virtualDeviceMountsParser)
-	tracepointDeducer := newTraceFSTracepointDeducer(mountpointRetriever)
-	uidProvider := new(uuidProvider)
-	tracingInstance := newTraceFSTracingInstance(mountpointRetriever,
-		tracepointDeducer,
-		uidProvider)
-	eventParser := newTraceFSEventParser(fieldParser)
+	mountsParser := newProcMountinfoMountsParser(fieldParser)
+	mountpointRetriever := newProcFSMountpointRetriever(mountsParser, "/proc/self/mountinfo")
+	tracepointDeducer := newTraceFSTracepointDeducer(mountpointRetriever, defaultTracepointCandidates)
+	eventParser := newTraceFSEventParser(fieldParser, parserTracepointCandidates())
+	eventParser.bestEffort = bestEffortParsing(config)
+	eventParser.partial = config.parseMode == parseModePartial
+	eventParser.lenientNumbers = config.numberParsing == numberParsingLenient
+	eventParser.mptcp = config.mptcp
+	eventParser.pooled = config.eventPooling
 
-	return newEventer(tracingInstance, eventParser)
+	var tracingInstance tracingInstance
+	switch config.backend {
+	case backendPerf:
+		return newSourceEventer(newPerfSource(mountpointRetriever, tracepointDeducer, config), eventParser, config)
+	case backendSockDiag:
+		return newSourceEventer(newSockDiagSource(config), eventParser, config)
+	case backendConntrack:
+		return newSourceEventer(newConntrackSource(config), eventParser, config)
+	case backendGenerator:
+		return newSourceEventer(newGeneratorSource(config), eventParser, config)
+	case backendRelay:
+		return newLineSourceEventer(newRelaySource(config.relayAddress), eventParser, config)
+	case backendPacket:
+		return newSourceEventer(newPacketSource(config), eventParser, config)
+	case backendModule:
+		return newSourceEventer(newModuleSource(config.moduleChannel, config), eventParser, config)
+	case backendReplay:
+		return newReplayEventer(newReplaySource(nil, config.replayFile, config.replayPaced), config)
+	default:
+		tracingInstance = newTraceFSTracingInstance(mountpointRetriever,
+			tracepointDeducer,
+			newInstanceUIDProvider(config),
+			config)
+	}
+
+	return newEventer(tracingInstance, eventParser, config)
 }
 
 func newEventer(tracingInstance tracingInstance,
-	eventParser eventParser) (*Eventer, error) {
+	eventParser eventParser,
+	config *config) (*Eventer, error) {
 	if err := tracingInstance.enable(); err != nil {
 		return nil, fmt.Errorf("enabling tracing instance: %w", err)
 	}
 
+	if err := configureEventParser(tracingInstance, eventParser); err != nil {
+		tracingInstance.disable()
+		return nil, err
+	}
+
 	// Open the tracing instance for reading
-	traceRingBuf, err := tracingInstance.open()
+	var traceRingBuf io.Reader
+	var perCPUTraceRingBufs []io.Reader
+	var err error
+	if config.perCPUReaders {
+		perCPUTraceRingBufs, err = tracingInstance.openPerCPU()
+	} else {
+		traceRingBuf, err = tracingInstance.open()
+	}
 	if err != nil {
 		tracingInstance.disable()
 		return nil, fmt.Errorf("opening tracing instance: %w", err)
 	}
 
+	eventer := newBaseEventer(eventParser, config)
+	eventer.tracingInstance = tracingInstance
+	eventer.traceRingBuf = traceRingBuf
+	eventer.useFilterExpression()
+
+	// A copy, as reloads change the config shared with the tracing instance
+	loaded := *config
+	eventer.loaded = &loaded
+
+	if config.backfill {
+		backfill, err := tracingInstance.backfill()
+		if err != nil {
+			tracingInstance.close()
+			tracingInstance.disable()
+			return nil, fmt.Errorf("backfilling from tracing instance: %w", err)
+		}
+		eventer.backfill = eventer.newLineReader(backfill)
+	}
+
+	// Set up once the tracing instance is open, so that no transition after
+	// the listing of the existing connections is missed
+	if err := eventer.setUp(); err != nil {
+		tracingInstance.close()
+		tracingInstance.disable()
+		return nil, err
+	}
+
+	if config.perCPUReaders {
+		eventer.shards = newShardedReader(perCPUTraceRingBufs,
+			eventParser,
+			eventer.skipped,
+			eventer.failures,
+			config.lineReader,
+			config.maxLineLength,
+			config.readBufferSize,
+			shardReorderWindow,
+			eventer.done)
+	} else {
+		eventer.scanner = eventer.newLineReader(traceRingBuf)
+	}
+
+	if config.parserWorkers > 0 {
+		eventer.parsers = newParserPool(config.parserWorkers,
+			config.parserOrdering != parserOrderingUnordered,
+			eventer.parseLine,
+			eventer.done)
+	}
+
+	if config.watchInterval > 0 {
+		go eventer.watchTracingInstance(config.watchInterval)
+	}
+
+	if config.stallTimeout > 0 {
+		atomic.StoreInt64(&eventer.lastRead, time.Now().UnixNano())
+		go eventer.watchForStall(config.stallTimeout)
+	}
+
+	if config.reloadOnSIGHUP {
+		go eventer.watchForSIGHUP()
+	}
+
+	return eventer, nil
+}
+
+// NewSourceEventer returns an Eventer of the events of the event source, which
+// is opened.
+func newSourceEventer(source eventSource,
+	eventParser eventParser,
+	config *config) (*Eventer, error) {
+	if err := source.open(); err != nil {
+		return nil, fmt.Errorf("opening event source: %w", err)
+	}
+
+	eventer := newBaseEventer(eventParser, config)
+	eventer.source = source
+	eventer.useFilterExpression()
+
+	// A copy, as reloads change the config shared with the event source
+	loaded := *config
+	eventer.loaded = &loaded
+
+	if err := eventer.setUp(); err != nil {
+		source.close()
+		return nil, err
+	}
+
+	if config.reloadOnSIGHUP {
+		go eventer.watchForSIGHUP()
+	}
+
+	return eventer, nil
+}
+
+// NewLineSourceEventer returns an Eventer which parses the lines of the line
+// source, which is opened.
+func newLineSourceEventer(source lineSource,
+	eventParser eventParser,
+	config *config) (*Eventer, error) {
+	lines, err := source.open()
+	if err != nil {
+		return nil, fmt.Errorf("opening line source: %w", err)
+	}
+
+	eventer := newBaseEventer(eventParser, config)
+	eventer.lines = source
+	eventer.traceRingBuf = lines
+	eventer.useFilterExpression()
+
+	// A copy, as reloads change the config shared with the line source
+	loaded := *config
+	eventer.loaded = &loaded
+
+	if err := eventer.setUp(); err != nil {
+		source.close()
+		return nil, err
+	}
+	eventer.scanner = eventer.newLineReader(lines)
+
+	if config.parserWorkers > 0 {
+		eventer.parsers = newParserPool(config.parserWorkers,
+			config.parserOrdering != parserOrderingUnordered,
+			eventer.parseLine,
+			eventer.done)
+	}
+
+	if config.reloadOnSIGHUP {
+		go eventer.watchForSIGHUP()
+	}
+
+	return eventer, nil
+}
+
+// NewBaseEventer returns an Eventer of the event parser and configuration,
+// which is yet to be given its tracing instance or event source.
+func newBaseEventer(eventParser eventParser, config *config) *Eventer {
 	return &Eventer{
-		tracingInstance: tracingInstance,
-		scanner:         bufio.NewScanner(traceRingBuf),
-		eventParser:     eventParser,
-		closedMutex:     new(sync.Mutex),
-		closed:          false,
-	}, nil
+		eventParser:   eventParser,
+		config:        config,
+		skipped:       new(skipCounters),
+		failures:      new(failureCounters),
+		instanceMutex: new(sync.Mutex),
+		done:          make(chan struct{}),
+		doneOnce:      new(sync.Once),
+		filterOffload: new(atomic.Value),
+		getenv:        os.Getenv,
+		reloadMutex:   new(sync.Mutex),
+	}
+}
+
+// SetUp lists the existing connections, and sets up the filters, enrichment
+// and processing of the events read, as configured.
+func (e *Eventer) setUp() error {
+	config := e.config
+	if config.existingConnections {
+		existing, err := readExistingConnections("/proc")
+		if err != nil {
+			return fmt.Errorf("reading existing connections: %w", err)
+		}
+		e.existing = existing
+		e.reconciler = newExistingReconciler(existing, config.existingOverlapWindow)
+	}
+
+	if config.netNSTagging {
+		netNSTagger, err := newNetNSTagger("/proc", config.netNSFilter)
+		if err != nil {
+			return fmt.Errorf("filtering network namespaces: %w", err)
+		}
+		e.netNSTagger = netNSTagger
+	}
+
+	if len(config.geoIPDatabases) > 0 {
+		geoIP, err := newGeoIPEnricher(config.geoIPDatabases)
+		if err != nil {
+			return fmt.Errorf("loading GeoIP databases: %w", err)
+		}
+		e.geoIP = geoIP
+	}
+
+	if config.hostTags != nil || config.hostTagHostname || config.cloudMetadata != "" {
+		hostTags, err := newHostTags(config.hostTags,
+			config.hostTagHostname,
+			config.cloudMetadata,
+			cloudMetadataBaseURLs[config.cloudMetadata],
+			&http.Client{Timeout: cloudMetadataTimeout})
+		if err != nil {
+			return fmt.Errorf("looking up host tags: %w", err)
+		}
+		e.hostTags = hostTags
+	}
+
+	// The tokens of a capture cannot be looked up, as it was traced elsewhere
+	if config.mptcp && config.backend != backendReplay {
+		conn, err := newSockDiagConn()
+		if err != nil {
+			return fmt.Errorf("opening sock_diag connection for MPTCP tokens: %w", err)
+		}
+		e.mptcpConn = conn
+		e.mptcpTagger = newMPTCPTagger(conn.mptcpToken)
+	}
+
+	// Nothing below can fail, so the resolver is never left running
+	if config.reverseDNS {
+		e.reverseDNS = newReverseDNSResolver(net.DefaultResolver.LookupAddr,
+			config.reverseDNSTTL,
+			config.reverseDNSRate)
+	}
+
+	if config.dedupeWindow > 0 {
+		e.deduplicator = newDeduplicator(config.dedupeWindow)
+	}
+
+	if config.debounceWindow > 0 {
+		e.debouncer = newDebouncer(config.debounceWindow, &e.skipped.debounced)
+	}
+
+	if config.direction {
+		e.classifier = newDirectionClassifier("/proc",
+			config.backend == backendConntrack,
+			net.InterfaceAddrs)
+	}
+
+	if config.flows {
+		e.flowTracker = newFlowTracker(config.flowTimeout,
+			config.flowSummaries,
+			config.minFlowDuration,
+			&e.skipped.shortFlows)
+	}
+
+	if config.summaryInterval > 0 {
+		e.summariser = newSummariser(config.summaryInterval)
+	}
+
+	e.processFilter = e.newProcessFilter(config)
+
+	return nil
+}
+
+// ConfigureEventParser configures the event parser for the format of the
+// events of the tracepoint enabled in the tracing instance.
+func configureEventParser(tracingInstance tracingInstance, eventParser eventParser) error {
+	format, err := tracingInstance.eventFormat()
+	if err != nil {
+		return fmt.Errorf("getting event format: %w", err)
+	}
+
+	if err := eventParser.configure(format); err != nil {
+		return fmt.Errorf("configuring event parser: %w", err)
+	}
+
+	// Event times are taken from the trace timestamps, if they can be converted
+	clock := newTraceClock(tracingInstance.traceClock())
+	if clock == nil {
+		log.Printf("Trace clock %q cannot be converted to wall-clock time: "+
+			"events are timed when parsed", tracingInstance.traceClock())
+	}
+	eventParser.useClock(clock)
+
+	return nil
 }
 
 func (e *Eventer) Event() (*event.Event, error) {
-	e.closedMutex.Lock()
-	if e.closed {
-		return nil, ErrEventerClosed
+	// Summaries are not state changes, and are returned in place of them
+	if e.summariser != nil {
+		return nil, ErrEventsSummarised
 	}
-	e.closedMutex.Unlock()
 
 	for {
-		if !e.scanner.Scan() {
-			if err := e.scanner.Err(); err != nil {
-				e.closedMutex.Lock()
-				if e.closed {
-					return nil, fmt.Errorf("closed while scanning: %w", ErrEventerClosed)
+		contextEvent, err := e.contextEvent()
+		if err != nil {
+			return nil, err
+		}
+
+		// Other kinds of event, such as resets, are not state changes. Pooled
+		// events are copied, as they cannot be released by the caller
+		switch contextEvent.Kind {
+		case KindStateChange:
+			if !e.config.eventPooling {
+				return contextEvent.Event, nil
+			}
+			// The addresses of a pooled event are also reused once released
+			event := *contextEvent.Event
+			event.SourceIP = append(net.IP(nil), event.SourceIP...)
+			event.DestIP = append(net.IP(nil), event.DestIP...)
+			e.Release(contextEvent)
+
+			return &event, nil
+		case KindExisting:
+			// Connections which existed when attached are returned as though
+			// opened from CLOSED to their state when listed
+			event := *contextEvent.Event
+			event.OldState = tcpstate.StateClosed
+			e.Release(contextEvent)
+
+			return &event, nil
+		case KindLostEvents:
+			err := &LostEventsError{CPU: contextEvent.Context.CPU, Lost: contextEvent.LostEvents}
+			e.Release(contextEvent)
+
+			return nil, err
+		}
+		e.Release(contextEvent)
+	}
+}
+
+// Release returns the event, returned by EventWithContext, to the pool of
+// events, if they are pooled, for reuse by those read later, so that events
+// are not allocated once the pool is warm. Neither the event, nor its Event,
+// Context or addresses, may be used once released, so any which are needed must first
+// be copied, and each may be released only once. Events not from the pool,
+// such as summaries, are not released. Events which are never released are
+// collected as usual.
+func (e *Eventer) Release(event *ContextEvent) {
+	if e.config.eventPooling {
+		releaseContextEvent(event)
+	}
+}
+
+// EventWithContext is as Event, but also returns the context in which the
+// kernel emitted the event, such as the CPU and whether in interrupt context.
+// Events of all kinds are returned, not only state changes, each tagged with
+// the tags of the host, if configured.
+func (e *Eventer) EventWithContext() (*ContextEvent, error) {
+	event, err := e.contextEvent()
+	if err != nil {
+		return nil, err
+	}
+	event.HostTags = e.hostTags
+
+	return event, nil
+}
+
+// ContextEvent returns the next event, suppressing duplicate transitions, if
+// configured, and those reflected by the connections listed when attached,
+// once the oscillations of the states of flows are debounced, if configured.
+// Events of loopback, link-local or unspecified addresses are skipped, if
+// configured, then those of tasks not of the commands or PIDs filtered, or,
+// once tagged with their network namespace, of the namespaces filtered. The
+// direction of those returned is classified, and those of MPTCP connections
+// tagged with their tokens, if configured, their addresses are annotated with
+// their hostnames, if known, and their remote address enriched with its
+// geography, if configured. Those of which the filter
+// expression, if any, is false are then skipped. Those returned are tagged
+// with their flow, if tracked, and the summaries of the flows they end, if
+// any, returned after them, unless held until their flows are known not to be
+// short-lived. If summarised, events are then absorbed into the summaries of
+// their intervals, which are returned in their place.
+func (e *Eventer) contextEvent() (*ContextEvent, error) {
+	for {
+		if atomic.LoadInt32(&e.reloading) != 0 {
+			e.applyReload()
+		}
+
+		if e.summariser != nil {
+			if summary, ok := e.summariser.next(); ok {
+				return summary, nil
+			}
+		}
+
+		if e.flowTracker != nil {
+			if event, ok := e.flowTracker.next(); ok {
+				if e.summariser != nil && e.summariser.aggregate(event) {
+					continue
 				}
-				e.closedMutex.Unlock()
 
-				return nil, fmt.Errorf("scanning for event: %w", err)
+				return event, nil
 			}
+		}
+
+		// Reads are bounded by the end of the interval, so that its summaries
+		// are returned even if no later event is read
+		var bound time.Time
+		if e.summariser != nil {
+			bound, _ = e.summariser.expiry()
+		}
+
+		event, err := e.debouncedContextEvent(bound)
+		if err != nil {
+			// The events held and the summaries of the last interval are
+			// returned once events are exhausted, before the error is
+			// returned again
+			if errors.Is(err, io.EOF) &&
+				((e.flowTracker != nil && e.flowTracker.flush()) ||
+					(e.summariser != nil && e.summariser.flush())) {
+				continue
+			}
+
+			// Unless the deadline passed was that set by SetReadDeadline
+			if errors.Is(err, os.ErrDeadlineExceeded) && !bound.IsZero() &&
+				(e.summariser.expire(time.Now()) || !e.userReadDeadlinePassed()) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		// Local traffic is excluded before the filters configured
+		if e.config.excludeLocalTraffic && localTraffic(event) {
+			atomic.AddUint64(&e.skipped.localTraffic, 1)
+			e.Release(event)
+			continue
+		}
+
+		if (e.processFilter != nil && !e.processFilter.passes(event)) ||
+			(e.netNSTagger != nil && !e.netNSTagger.tag(event)) {
+			atomic.AddUint64(&e.skipped.filtered, 1)
+			e.Release(event)
+			continue
+		}
+
+		if (e.reconciler != nil && e.reconciler.reflected(event)) ||
+			(e.deduplicator != nil && e.deduplicator.duplicate(event)) {
+			atomic.AddUint64(&e.skipped.duplicates, 1)
+			e.Release(event)
+			continue
+		}
+
+		if e.classifier != nil {
+			e.classifier.classify(event)
+		}
+
+		if e.mptcpTagger != nil {
+			e.mptcpTagger.tag(event)
+		}
+
+		if e.reverseDNS != nil {
+			e.reverseDNS.annotate(event)
+		}
 
-			// No error is still an error - a ring buffer should never return EOF,
-			// instead, reads should block until something is written
-			return nil, io.ErrUnexpectedEOF
+		if e.geoIP != nil {
+			e.geoIP.enrich(event)
 		}
 
-		str := e.scanner.Bytes()
-		if len(str) == 0 {
+		// The expression may refer to the fields classified and enriched
+		if e.filterExpression != nil && !e.filterExpression.passes(event) {
+			atomic.AddUint64(&e.skipped.filtered, 1)
+			e.Release(event)
 			continue
 		}
 
-		event, err := e.eventParser.toEvent(str)
+		if e.flowTracker != nil && e.flowTracker.track(event) {
+			continue
+		}
+
+		if e.summariser != nil && e.summariser.aggregate(event) {
+			continue
+		}
+
+		return event, nil
+	}
+}
+
+// DebouncedContextEvent reads the next event, once debounced, if configured,
+// failing with an error with os.ErrDeadlineExceeded in its chain once the
+// bound, if any, passes. While state changes are held, reads are also bounded
+// by the expiry of the window of the earliest, so that it is released even if
+// no later event is read. The events held are also released once events are
+// exhausted, or the eventer is closed.
+func (e *Eventer) debouncedContextEvent(bound time.Time) (*ContextEvent, error) {
+	if e.debouncer == nil {
+		return e.readContextEventBefore(bound)
+	}
+
+	for {
+		if event, ok := e.debouncer.next(); ok {
+			return event, nil
+		}
+
+		readBound := bound
+		if expiry, ok := e.debouncer.expiry(); ok && (readBound.IsZero() || expiry.Before(readBound)) {
+			readBound = expiry
+		}
+
+		event, err := e.readContextEventBefore(readBound)
 		if err != nil {
-			if err == errIrrelevantEvent {
+			if (errors.Is(err, io.EOF) || errors.Is(err, ErrEventerClosed)) && e.debouncer.flush() {
+				continue
+			}
+
+			// Unless the deadline passed was the bound, or that set by
+			// SetReadDeadline
+			if errors.Is(err, os.ErrDeadlineExceeded) &&
+				(e.debouncer.expire(time.Now()) || (!readBound.Equal(bound) && !e.userReadDeadlinePassed())) {
 				continue
 			}
 
-			return nil, fmt.Errorf("parsing event: %w", err)
+			return nil, err
+		}
+
+		if !e.debouncer.debounce(event) {
+			return event, nil
+		}
+	}
+}
+
+// ReadContextEventBefore reads the next event, failing with an error with
+// os.ErrDeadlineExceeded in its chain once the bound, if any, passes, unless
+// the deadline set by SetReadDeadline is sooner. The deadline is then
+// restored. If deadlines are not supported, the read is not bounded.
+func (e *Eventer) readContextEventBefore(bound time.Time) (*ContextEvent, error) {
+	if bound.IsZero() {
+		return e.readContextEvent()
+	}
+
+	if err := e.boundReadDeadline(bound); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+		return nil, err
+	}
+
+	event, err := e.readContextEvent()
+	if err := e.boundReadDeadline(time.Time{}); err != nil && !errors.Is(err, os.ErrNoDeadline) {
+		if event != nil {
+			e.Release(event)
+		}
+
+		return nil, err
+	}
+
+	return event, err
+}
+
+// BoundReadDeadline applies the deadline set by SetReadDeadline, unless the
+// bound is sooner, in which case the bound is applied. A zero bound applies the
+// deadline set by SetReadDeadline.
+func (e *Eventer) boundReadDeadline(bound time.Time) error {
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+	if e.isClosed() {
+		return ErrEventerClosed
+	}
+
+	deadline := e.userReadDeadline
+	if !bound.IsZero() && (deadline.IsZero() || bound.Before(deadline)) {
+		deadline = bound
+	}
+
+	return e.setReadDeadline(deadline)
+}
+
+// UserReadDeadlinePassed returns whether the deadline set by SetReadDeadline,
+// if any, has passed.
+func (e *Eventer) userReadDeadlinePassed() bool {
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+
+	return !e.userReadDeadline.IsZero() && !time.Now().Before(e.userReadDeadline)
+}
+
+func (e *Eventer) readContextEvent() (*ContextEvent, error) {
+	if e.isClosed() {
+		return nil, ErrEventerClosed
+	}
+
+	if len(e.existing) > 0 {
+		existing := e.existing[0]
+		e.existing = e.existing[1:]
+		return existing, nil
+	}
+
+	if e.source != nil {
+		return e.sourceEvent()
+	}
+
+	if e.shards != nil {
+		return e.shardedEvent()
+	}
+
+	if e.parsers != nil {
+		return e.parsedEvent()
+	}
+
+	for {
+		str, ok := e.nextLine()
+		if !ok {
+			if err := e.scanFailed(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if event, err := e.parseLine(str); event != nil || err != nil {
+			return event, err
+		}
+	}
+}
+
+// NextLine returns the next line, backfilled or read from the line reader, or
+// false once the line reader is exhausted or fails.
+func (e *Eventer) nextLine() ([]byte, bool) {
+	for {
+		if str, backfilled := e.nextBackfillLine(); backfilled {
+			return str, true
+		}
+
+		if !e.scanner.Scan() {
+			return nil, false
+		}
+
+		atomic.StoreInt64(&e.lastRead, time.Now().UnixNano())
+		if str := e.scanner.Bytes(); !e.alreadyBackfilled(str) {
+			return str, true
+		}
+	}
+}
+
+// ScanFailed handles the line reader being exhausted or failing, recovering
+// the tracing instance if it was lost, and returns the error with which to
+// fail the read, or nil if reading can resume.
+func (e *Eventer) scanFailed() error {
+	err := e.scanner.Err()
+	if err != nil && e.isClosed() {
+		return fmt.Errorf("closed while scanning: %w", ErrEventerClosed)
+	}
+
+	// The tracing instance was lost and closed, so recover it and resume
+	if atomic.LoadInt32(&e.recovering) != 0 {
+		if err := e.recoverTracingInstance(); err != nil {
+			return fmt.Errorf("recovering tracing instance: %w", err)
+		}
+
+		return nil
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// A line reader cannot be resumed after an error, so replace it. Reads
+		// from trace_pipe return only whole lines, so nothing is lost.
+		e.scanner = e.newLineReader(e.traceRingBuf)
+		return fmt.Errorf("scanning for event: %w", err)
+	}
+
+	if err != nil {
+		return fmt.Errorf("scanning for event: %w", err)
+	}
+
+	if e.lines != nil {
+		return e.lines.end()
+	}
+
+	// No error is still an error - a ring buffer should never return EOF,
+	// instead, reads should block until something is written
+	return io.ErrUnexpectedEOF
+}
+
+// ParseLine parses a line into an event, or returns neither an event nor an
+// error if the line is skipped, such as if empty, of an irrelevant event, or a
+// lost events marker which is not reported. It is safe for concurrent use by
+// the workers of a parser pool.
+func (e *Eventer) parseLine(str []byte) (*ContextEvent, error) {
+	if len(trimLinePadding(str)) == 0 {
+		atomic.AddUint64(&e.skipped.empty, 1)
+		return nil, nil
+	}
+
+	if lostEventsErr, ok := parseLostEventsMarker(str); ok {
+		return e.lostEventsEvent(lostEventsErr), nil
+	}
+
+	event, err := e.eventParser.toEvent(str)
+	if err != nil {
+		if errors.Is(err, ErrIrrelevantEvent) {
+			e.skipped.countIrrelevant(err)
+			return nil, nil
+		}
+		e.failures.count(err)
+
+		return nil, fmt.Errorf("parsing event: %w", err)
+	}
+
+	return event, nil
+}
+
+// ParsedEvent returns the next event parsed by the parser pool, handling the
+// end of the lines read once all those before it are parsed, after which
+// reading resumes.
+func (e *Eventer) parsedEvent() (*ContextEvent, error) {
+	timer := e.readDeadlineTimer()
+	var deadline <-chan time.Time
+	if timer != nil {
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		e.parsers.read(e.nextLine)
+		parsed, err := e.parsers.next(deadline)
+		if err != nil {
+			if errors.Is(err, ErrEventerClosed) {
+				return nil, fmt.Errorf("closed while scanning: %w", err)
+			}
+
+			return nil, fmt.Errorf("scanning for event: %w", err)
+		}
+
+		if parsed.end {
+			if err := e.scanFailed(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		event, err := parsed.event, parsed.err
+		e.parsers.release(parsed)
+		if event != nil || err != nil {
+			return event, err
+		}
+	}
+}
+
+// NewLineReader returns a reader of the lines of the reader, of the configured
+// kind, which skips and counts those longer than the maximum line length.
+func (e *Eventer) newLineReader(reader io.Reader) lineReader {
+	return newLineReader(reader,
+		e.config.lineReader,
+		e.config.maxLineLength,
+		e.config.readBufferSize,
+		&e.skipped.oversize)
+}
+
+// NextBackfillLine returns the next event line of the backfilled trace file,
+// if any remain, recording its timestamp.
+func (e *Eventer) nextBackfillLine() ([]byte, bool) {
+	if e.backfill == nil {
+		return nil, false
+	}
+
+	for e.backfill.Scan() {
+		line := e.backfill.Bytes()
+		if len(trimLinePadding(line)) == 0 || line[0] == '#' { // Skip the header comments
+			continue
+		}
+
+		if timestamp, err := lineTraceTimestamp(line); err == nil {
+			e.backfilledUntil = timestamp
+		}
+
+		return line, true
+	}
+
+	if err := e.backfill.Err(); err != nil {
+		log.Printf("Scanning backfilled trace: %v", err)
+	}
+	e.backfill = nil
+
+	return nil, false
+}
+
+// AlreadyBackfilled returns whether the line read from trace_pipe was already
+// read from the trace file, as reading the trace file does not consume events.
+// Once a newer line is read, no more are checked.
+func (e *Eventer) alreadyBackfilled(line []byte) bool {
+	if e.backfilledUntil == (traceTimestamp{}) {
+		return false
+	}
+
+	timestamp, err := lineTraceTimestamp(line)
+	if err != nil { // For example, a lost events marker
+		return false
+	}
+
+	if !e.backfilledUntil.before(timestamp) {
+		return true
+	}
+	e.backfilledUntil = traceTimestamp{}
+
+	return false
+}
+
+// ReadDeadlineTimer returns a timer which fires at the deadline for Event(),
+// if any, when it is applied by the reader of events, rather than the tracing
+// instance, or nil if there is none.
+func (e *Eventer) readDeadlineTimer() *time.Timer {
+	e.instanceMutex.Lock()
+	readDeadline := e.readDeadline
+	e.instanceMutex.Unlock()
+
+	if readDeadline.IsZero() {
+		return nil
+	}
+
+	return time.NewTimer(time.Until(readDeadline))
+}
+
+// ShardedEvent returns the next event merged from the per-CPU readers.
+func (e *Eventer) shardedEvent() (*ContextEvent, error) {
+	timer := e.readDeadlineTimer()
+	var deadline <-chan time.Time
+	if timer != nil {
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		result, err := e.shards.next(deadline)
+		if err == nil {
+			atomic.StoreInt64(&e.lastRead, time.Now().UnixNano())
+		}
+
+		if err != nil {
+			if errors.Is(err, ErrEventerClosed) {
+				return nil, fmt.Errorf("closed while scanning: %w", err)
+			}
+
+			return nil, fmt.Errorf("scanning for event: %w", err)
+		}
+
+		if lostEventsErr, ok := result.err.(*LostEventsError); ok {
+			if event := e.lostEventsEvent(lostEventsErr); event != nil {
+				return event, nil
+			}
+
+			continue
+		}
+
+		if result.err != nil {
+			if e.isClosed() {
+				return nil, fmt.Errorf("closed while scanning: %w", ErrEventerClosed)
+			}
+
+			return nil, result.err
+		}
+
+		return result.event, nil
+	}
+}
+
+// SourceEvent returns the next event of the event source, counting the events
+// lost and those of no interest.
+func (e *Eventer) sourceEvent() (*ContextEvent, error) {
+	for {
+		event, err := e.source.event()
+		if lostEventsErr, ok := err.(*LostEventsError); ok {
+			if event := e.lostEventsEvent(lostEventsErr); event != nil {
+				return event, nil
+			}
+
+			continue
+		}
+
+		if errors.Is(err, ErrIrrelevantEvent) {
+			e.skipped.countIrrelevant(err)
+			continue
+		}
+
+		if err != nil {
+			if e.isClosed() {
+				return nil, fmt.Errorf("closed while reading: %w", ErrEventerClosed)
+			}
+
+			return nil, err
 		}
 
 		return event, nil
 	}
 }
 
+// LostEventsEvent counts the events lost, and returns the event marking them,
+// if lost events are reported, or nil, if the marker is skipped.
+func (e *Eventer) lostEventsEvent(lostEventsErr *LostEventsError) *ContextEvent {
+	atomic.AddUint64(&e.lostEvents, lostEventsErr.Lost)
+	if e.config.reportLostEvents {
+		return lostEventsErr.toEvent()
+	}
+	atomic.AddUint64(&e.skipped.lostEventsMarkers, 1)
+
+	return nil
+}
+
+// AddTrigger installs an ftrace event trigger command (e.g. "stacktrace" or
+// "hist:keys=dport") on the tracepoint, so that advanced users can capture
+// additional kernel context (such as stacks) for state transitions.
+// The output of the trigger is written to the tracing instance alongside
+// the event stream, or to the histogram file for hist triggers.
+func (e *Eventer) AddTrigger(trigger string) error {
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+	if e.isClosed() {
+		return ErrEventerClosed
+	}
+
+	if e.tracingInstance == nil {
+		return fmt.Errorf("adding trigger: %w", e.unsupported())
+	}
+
+	if err := e.tracingInstance.addTrigger(trigger); err != nil {
+		return fmt.Errorf("adding trigger: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveTrigger removes a trigger previously installed with AddTrigger.
+func (e *Eventer) RemoveTrigger(trigger string) error {
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+	if e.isClosed() {
+		return ErrEventerClosed
+	}
+
+	if e.tracingInstance == nil {
+		return fmt.Errorf("removing trigger: %w", e.unsupported())
+	}
+
+	if err := e.tracingInstance.removeTrigger(trigger); err != nil {
+		return fmt.Errorf("removing trigger: %w", err)
+	}
+
+	return nil
+}
+
+// Stats returns statistics describing the operation of the eventer, including
+// the kernel-side ring buffer statistics, so that events lost before reaching
+// the eventer can be observed.
+func (e *Eventer) Stats() (*Stats, error) {
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+	if e.isClosed() {
+		return nil, ErrEventerClosed
+	}
+
+	var bufferStats *BufferStats
+	var degradedBufferSizeKB uint64
+	var err error
+	if source := e.sourceControl(); source != nil {
+		bufferStats, err = source.bufferStats()
+	} else {
+		bufferStats, err = e.tracingInstance.bufferStats()
+		degradedBufferSizeKB = e.tracingInstance.degradedBufferSizeKB()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting buffer statistics: %w", err)
+	}
+
+	return &Stats{
+		Buffer:               *bufferStats,
+		LostEvents:           atomic.LoadUint64(&e.lostEvents),
+		DegradedBufferSizeKB: degradedBufferSizeKB,
+		Skipped:              e.skipped.stats(),
+		ParseFailures:        e.failures.stats(),
+		FilterOffload:        e.filterOffload.Load().(FilterOffloadStats),
+	}, nil
+}
+
+// UseFilterExpression filters events by the configured filter expression, if
+// any, less the conjuncts the tracing instance, or event source, offloaded to
+// the kernel.
+func (e *Eventer) useFilterExpression() {
+	var stats FilterOffloadStats
+	e.filterExpression = e.config.filterExpression
+	if e.filterExpression != nil {
+		stats.Conjuncts = len(e.filterExpression.conjuncts)
+
+		if offloader, ok := e.filterOffloader(); ok && offloader.filterOffloaded() {
+			stats.KernelFilter, e.filterExpression = e.filterExpression.offload()
+			stats.Offloaded = stats.Conjuncts - len(e.filterExpression.residual)
+		}
+	}
+
+	e.filterOffload.Store(stats)
+}
+
+// FilterOffloader returns the tracing instance, or event source, if it can
+// offload the filter expression to the kernel.
+func (e *Eventer) filterOffloader() (filterOffloader, bool) {
+	if e.source != nil {
+		offloader, ok := e.source.(filterOffloader)
+		return offloader, ok
+	}
+
+	offloader, ok := e.tracingInstance.(filterOffloader)
+	return offloader, ok
+}
+
+// KernelInfo describes the kernel, and the tracepoint and tracing instance
+// which the eventer is attached to, so that these can be logged or reported.
+func (e *Eventer) KernelInfo() (*KernelInfo, error) {
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+	if e.isClosed() {
+		return nil, ErrEventerClosed
+	}
+
+	var kernelInfo *KernelInfo
+	var err error
+	if source := e.sourceControl(); source != nil {
+		kernelInfo, err = source.kernelInfo()
+	} else {
+		kernelInfo, err = e.tracingInstance.kernelInfo()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting kernel information: %w", err)
+	}
+
+	return kernelInfo, nil
+}
+
+// Snapshot copies a snapshot of the contents of the kernel ring buffer to w,
+// without interrupting the stream of events. This is intended to aid in the
+// investigation of events which cannot be parsed.
+func (e *Eventer) Snapshot(w io.Writer) error {
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+	if e.isClosed() {
+		return ErrEventerClosed
+	}
+
+	if e.tracingInstance == nil {
+		return fmt.Errorf("snapshotting tracing instance: %w", e.unsupported())
+	}
+
+	if err := e.tracingInstance.snapshot(w); err != nil {
+		return fmt.Errorf("snapshotting tracing instance: %w", err)
+	}
+
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Event() to read an event, after which
+// it returns an error with os.ErrDeadlineExceeded in its chain. Subsequent
+// calls to Event() may be made once the deadline is extended. A zero value for
+// t means Event() will not time out. Deadlines are not supported when polling,
+// unless lines are parsed by parser workers, in which case os.ErrNoDeadline is
+// returned.
+func (e *Eventer) SetReadDeadline(t time.Time) error {
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+	if e.isClosed() {
+		return ErrEventerClosed
+	}
+	e.userReadDeadline = t
+
+	return e.setReadDeadline(t)
+}
+
+// SetReadDeadline applies the deadline to whatever events are read from. It
+// must be called with the instance mutex held.
+func (e *Eventer) setReadDeadline(t time.Time) error {
+	// The per-CPU readers, and the reader of a parser pool, must not fail, so
+	// the deadline is instead applied by the merge of their events, or the
+	// results of the parser pool, from the next call to Event()
+	if e.shards != nil || e.parsers != nil {
+		e.readDeadline = t
+		return nil
+	}
+
+	if source := e.sourceControl(); source != nil {
+		if err := source.setReadDeadline(t); err != nil {
+			return fmt.Errorf("setting source read deadline: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := e.tracingInstance.setReadDeadline(t); err != nil {
+		return fmt.Errorf("setting tracing instance read deadline: %w", err)
+	}
+
+	return nil
+}
+
+// SourceControl returns the event source or line source, or nil if reading a
+// tracing instance.
+func (e *Eventer) sourceControl() sourceControl {
+	if e.source != nil {
+		return e.source
+	}
+
+	if e.lines != nil {
+		return e.lines
+	}
+
+	return nil
+}
+
+// Unsupported returns the error of a call which acts on a tracefs instance, of
+// which the backend has none.
+func (e *Eventer) unsupported() error {
+	return fmt.Errorf("not supported by the %s backend", e.config.backend)
+}
+
+// IsClosed returns whether Close has been called, without locking, so that it
+// can be checked by the reader of events for each event.
+func (e *Eventer) isClosed() bool {
+	return atomic.LoadInt32(&e.closed) != 0
+}
+
 func (e *Eventer) Close() error {
-	e.closedMutex.Lock()
 	// Setting this flag will cause Event() to no longer attempt to read from
 	// the trace buffer and suppress any errors reported from a closed tracing
-	// instance
-	e.closed = true
-	e.closedMutex.Unlock()
+	// instance. Calls which act on the tracing instance check it with the
+	// instance mutex held, so none act on it once it is closed below
+	atomic.StoreInt32(&e.closed, 1)
+	e.doneOnce.Do(func() { close(e.done) })
+
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+
+	// Unless replaced by a reload, which is applied with the instance mutex held
+	if e.reverseDNS != nil {
+		e.reverseDNS.close()
+	}
+
+	if e.mptcpConn != nil {
+		e.mptcpConn.close()
+	}
+
+	if source := e.sourceControl(); source != nil {
+		if err := source.close(); err != nil {
+			return fmt.Errorf("closing source: %w", err)
+		}
+
+		return nil
+	}
 
-	if err := e.tracingInstance.close(); err != nil {
-		return fmt.Errorf("closing tracing instance: %w", err)
+	// A tracing instance awaiting recovery has already been closed
+	if atomic.LoadInt32(&e.recovering) == 0 {
+		if err := e.tracingInstance.close(); err != nil {
+			return fmt.Errorf("closing tracing instance: %w", err)
+		}
 	}
 
 	// TODO: Attempt disable if close fails
@@ -119,3 +1279,147 @@ func (e *Eventer) Close() error {
 
 	return nil
 }
+
+// WatchTracingInstance periodically checks that the tracing instance is still
+// present, as tracefs may be unmounted or the instance deleted from under the
+// eventer. If it is not, the instance is closed, unblocking Event(), which then
+// recovers the instance.
+func (e *Eventer) watchTracingInstance(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+
+		e.instanceMutex.Lock()
+		if atomic.LoadInt32(&e.recovering) == 0 && !e.tracingInstance.present() {
+			log.Printf("Tracing instance no longer present, closing for recovery")
+			atomic.StoreInt32(&e.recovering, 1)
+			if err := e.tracingInstance.close(); err != nil {
+				log.Printf("Closing lost tracing instance: %v", err)
+			}
+		}
+		e.instanceMutex.Unlock()
+	}
+}
+
+// WatchForStall periodically checks whether no lines have been read for the
+// timeout, in which case tracing may have been disabled by another tracefs
+// user, so is re-enabled. If tracing was not disabled, a diagnostic is logged,
+// as events may instead be suppressed.
+func (e *Eventer) watchForStall(timeout time.Duration) {
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+
+		lastRead := time.Unix(0, atomic.LoadInt64(&e.lastRead))
+		if time.Since(lastRead) < timeout {
+			continue
+		}
+
+		e.instanceMutex.Lock()
+		if atomic.LoadInt32(&e.recovering) == 0 {
+			e.checkStalledTracingInstance(time.Since(lastRead))
+		}
+		e.instanceMutex.Unlock()
+
+		// Check again only after a further timeout
+		atomic.StoreInt64(&e.lastRead, time.Now().UnixNano())
+	}
+}
+
+func (e *Eventer) checkStalledTracingInstance(stalledFor time.Duration) {
+	reset, err := e.tracingInstance.reassertTracing()
+	if len(reset) > 0 {
+		log.Printf("WARNING: No events read for %v: tracing had been disabled (%s), "+
+			"possibly by another tracefs user, so was re-enabled",
+			stalledFor.Round(time.Second),
+			strings.Join(reset, ", "))
+	}
+
+	if err != nil {
+		log.Printf("Re-enabling stalled tracing instance: %v", err)
+		return
+	}
+
+	if len(reset) > 0 {
+		return
+	}
+
+	suppressors := make([]string, 0, 3)
+	if e.config.filter != "" {
+		suppressors = append(suppressors, fmt.Sprintf("the filter %q", e.config.filter))
+	}
+
+	if len(e.config.eventPIDs) > 0 || e.config.eventPIDCgroup != "" {
+		suppressors = append(suppressors, "PID filtering")
+	}
+
+	if e.config.cpuMask != "" {
+		suppressors = append(suppressors, fmt.Sprintf("the CPU mask %s", e.config.cpuMask))
+	}
+
+	if len(suppressors) == 0 {
+		log.Printf("No events read for %v, although tracing is enabled",
+			stalledFor.Round(time.Second))
+		return
+	}
+
+	log.Printf("No events read for %v, although tracing is enabled: events may be suppressed by %s",
+		stalledFor.Round(time.Second),
+		strings.Join(suppressors, ", "))
+}
+
+// RecoverTracingInstance re-runs mount discovery and re-enables and re-opens
+// the tracing instance, after it was lost. If recovery fails, it is retried
+// upon the next call to Event().
+func (e *Eventer) recoverTracingInstance() error {
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+
+	// The tracing instance must not be re-enabled once disabled by Close
+	if e.isClosed() {
+		return ErrEventerClosed
+	}
+
+	log.Printf("Recovering tracing instance")
+
+	// Clean up what remains of the lost instance, if anything
+	if err := e.tracingInstance.disable(); err != nil {
+		log.Printf("Disabling lost tracing instance: %v", err)
+	}
+
+	if err := e.tracingInstance.enable(); err != nil {
+		return fmt.Errorf("enabling tracing instance: %w", err)
+	}
+
+	// The tracepoint may differ from that previously in use
+	if err := configureEventParser(e.tracingInstance, e.eventParser); err != nil {
+		e.tracingInstance.disable()
+		return err
+	}
+	e.useFilterExpression()
+
+	traceRingBuf, err := e.tracingInstance.open()
+	if err != nil {
+		e.tracingInstance.disable()
+		return fmt.Errorf("opening tracing instance: %w", err)
+	}
+
+	e.traceRingBuf = traceRingBuf
+	e.scanner = e.newLineReader(traceRingBuf)
+	atomic.StoreInt32(&e.recovering, 0)
+
+	log.Printf("Tracing instance recovered")
+	return nil
+}
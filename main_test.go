@@ -4,21 +4,58 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
 )
 
 type mockTraceInstance struct {
-	openReaderToReturn io.Reader
+	openReaderToReturn        io.Reader
+	openPerCPUReadersToReturn []io.Reader
+
+	backfillToReturn      string
+	backfillErrorToReturn error
+
+	kernelInfoToReturn      *KernelInfo
+	kernelInfoErrorToReturn error
+
+	degradedBufferSizeKBToReturn uint64
+
+	traceClockToReturn string
+
+	reassertedToReturn    []string
+	reassertErrorToReturn error
+	reassertTracingCalls  int32 // Accessed atomically
 
 	openErrorToReturn    error
 	enableErrorToReturn  error
 	closeErrorToReturn   error
 	disableErrorToReturn error
+	triggerErrorToReturn error
+
+	bufferStatsToReturn      *BufferStats
+	bufferStatsErrorToReturn error
+
+	snapshotToReturn      string
+	snapshotErrorToReturn error
+
+	absent bool
+
+	readDeadlineErrorToReturn error
+	readDeadline              time.Time
+
+	eventFormatToReturn      *eventFormat
+	eventFormatErrorToReturn error
+
+	triggersAdded   []string
+	triggersRemoved []string
 
 	openCalled    bool
 	enableCalled  bool
@@ -50,6 +87,50 @@ func (mti *mockTraceInstance) open() (io.Reader, error) {
 	return mti.openReaderToReturn, nil
 }
 
+func (mti *mockTraceInstance) openPerCPU() ([]io.Reader, error) {
+	mti.openCalled = true
+
+	if mti.openErrorToReturn != nil {
+		return nil, mti.openErrorToReturn
+	}
+
+	return mti.openPerCPUReadersToReturn, nil
+}
+
+func (mti *mockTraceInstance) backfill() (io.Reader, error) {
+	if mti.backfillErrorToReturn != nil {
+		return nil, mti.backfillErrorToReturn
+	}
+
+	return strings.NewReader(mti.backfillToReturn), nil
+}
+
+func (mti *mockTraceInstance) kernelInfo() (*KernelInfo, error) {
+	if mti.kernelInfoErrorToReturn != nil {
+		return nil, mti.kernelInfoErrorToReturn
+	}
+
+	return mti.kernelInfoToReturn, nil
+}
+
+func (mti *mockTraceInstance) degradedBufferSizeKB() uint64 {
+	return mti.degradedBufferSizeKBToReturn
+}
+
+func (mti *mockTraceInstance) reassertTracing() ([]string, error) {
+	atomic.AddInt32(&mti.reassertTracingCalls, 1)
+
+	if mti.reassertErrorToReturn != nil {
+		return nil, mti.reassertErrorToReturn
+	}
+
+	return mti.reassertedToReturn, nil
+}
+
+func (mti *mockTraceInstance) traceClock() string {
+	return mti.traceClockToReturn
+}
+
 func (mti *mockTraceInstance) enable() error {
 	mti.enableCalled = true
 
@@ -80,12 +161,73 @@ func (mti *mockTraceInstance) close() error {
 	return nil
 }
 
+func (mti *mockTraceInstance) addTrigger(trigger string) error {
+	if mti.triggerErrorToReturn != nil {
+		return mti.triggerErrorToReturn
+	}
+
+	mti.triggersAdded = append(mti.triggersAdded, trigger)
+	return nil
+}
+
+func (mti *mockTraceInstance) removeTrigger(trigger string) error {
+	if mti.triggerErrorToReturn != nil {
+		return mti.triggerErrorToReturn
+	}
+
+	mti.triggersRemoved = append(mti.triggersRemoved, trigger)
+	return nil
+}
+
+func (mti *mockTraceInstance) bufferStats() (*BufferStats, error) {
+	if mti.bufferStatsErrorToReturn != nil {
+		return nil, mti.bufferStatsErrorToReturn
+	}
+
+	return mti.bufferStatsToReturn, nil
+}
+
+func (mti *mockTraceInstance) snapshot(w io.Writer) error {
+	if mti.snapshotErrorToReturn != nil {
+		return mti.snapshotErrorToReturn
+	}
+
+	_, err := io.WriteString(w, mti.snapshotToReturn)
+	return err
+}
+
+func (mti *mockTraceInstance) present() bool {
+	return !mti.absent
+}
+
+func (mti *mockTraceInstance) eventFormat() (*eventFormat, error) {
+	if mti.eventFormatErrorToReturn != nil {
+		return nil, mti.eventFormatErrorToReturn
+	}
+
+	return mti.eventFormatToReturn, nil
+}
+
+func (mti *mockTraceInstance) setReadDeadline(t time.Time) error {
+	if mti.readDeadlineErrorToReturn != nil {
+		return mti.readDeadlineErrorToReturn
+	}
+
+	mti.readDeadline = t
+	return nil
+}
+
 type mockEventParser struct {
 	eventToReturn          *event.Event
 	errorToReturn          error
 	noOfTimesToReturnError int
 
-	toEventCalled bool
+	configureErrorToReturn error
+
+	clock *traceClock
+
+	toEventCalled   bool
+	configureCalled bool
 
 	errorsReturnedCount int
 }
@@ -100,7 +242,21 @@ func newMockEventParser(eventToReturn *event.Event,
 	}
 }
 
-func (mep *mockEventParser) toEvent(str []byte) (*event.Event, error) {
+func (mep *mockEventParser) configure(format *eventFormat) error {
+	mep.configureCalled = true
+
+	if mep.configureErrorToReturn != nil {
+		return mep.configureErrorToReturn
+	}
+
+	return nil
+}
+
+func (mep *mockEventParser) useClock(clock *traceClock) {
+	mep.clock = clock
+}
+
+func (mep *mockEventParser) toEvent(str []byte) (*ContextEvent, error) {
 	mep.toEventCalled = true
 
 	if mep.errorToReturn != nil && mep.errorsReturnedCount < mep.noOfTimesToReturnError {
@@ -108,7 +264,81 @@ func (mep *mockEventParser) toEvent(str []byte) (*event.Event, error) {
 		return nil, mep.errorToReturn
 	}
 
-	return mep.eventToReturn, nil
+	return &ContextEvent{Event: mep.eventToReturn, Context: parseTraceContext(str)}, nil
+}
+
+type mockEventSource struct {
+	eventsToReturn []*ContextEvent
+	errorsToReturn []error // Returned in place of the event of the same index
+
+	openErrorToReturn error
+
+	closed   chan struct{}
+	deadline sourceDeadline
+
+	openCalled  bool
+	closeCalled bool
+}
+
+func newMockEventSource(eventsToReturn []*ContextEvent, errorsToReturn []error) *mockEventSource {
+	return &mockEventSource{
+		eventsToReturn: eventsToReturn,
+		errorsToReturn: errorsToReturn,
+		closed:         make(chan struct{}),
+	}
+}
+
+func (mes *mockEventSource) open() error {
+	mes.openCalled = true
+	return mes.openErrorToReturn
+}
+
+// Event returns the events, then blocks until closed, or the read deadline
+// passes.
+func (mes *mockEventSource) event() (*ContextEvent, error) {
+	for len(mes.eventsToReturn) == 0 {
+		wait, err := mes.deadline.wait(time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-mes.closed:
+			return nil, os.ErrClosed
+		case <-time.After(wait):
+		}
+	}
+
+	event := mes.eventsToReturn[0]
+	mes.eventsToReturn = mes.eventsToReturn[1:]
+	if len(mes.errorsToReturn) > 0 {
+		err := mes.errorsToReturn[0]
+		mes.errorsToReturn = mes.errorsToReturn[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return event, nil
+}
+
+func (mes *mockEventSource) setReadDeadline(t time.Time) error {
+	mes.deadline.set(t)
+	return nil
+}
+
+func (mes *mockEventSource) kernelInfo() (*KernelInfo, error) {
+	return new(KernelInfo), nil
+}
+
+func (mes *mockEventSource) bufferStats() (*BufferStats, error) {
+	return &BufferStats{ReadEvents: 1}, nil
+}
+
+func (mes *mockEventSource) close() error {
+	mes.closeCalled = true
+	close(mes.closed)
+	return nil
 }
 
 func TestEventerConstructorEnablesAndOpensTraceInstance(t *testing.T) {
@@ -116,7 +346,7 @@ func TestEventerConstructorEnablesAndOpensTraceInstance(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	_, err := newEventer(mockTraceInstance, mockEventParser)
+	_, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil error, got %q (of type %T)", err, err)
 	}
@@ -136,7 +366,7 @@ func TestEventerConstructorTraceInstanceEnableError(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, mockError, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	_, err := newEventer(mockTraceInstance, mockEventParser)
+	_, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err == nil {
 		t.Error("expected error, got nil")
 	}
@@ -153,7 +383,7 @@ func TestEventerConstructorTraceInstanceOpenError(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(nil, mockError, nil, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	_, err := newEventer(mockTraceInstance, mockEventParser)
+	_, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err == nil {
 		t.Error("expected error, got nil")
 	}
@@ -174,7 +404,7 @@ func TestEventerCloseClosesAndDisablesTraceInstance(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -198,7 +428,7 @@ func TestEventerCloseTraceInstanceCloseError(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, mockError, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -221,7 +451,7 @@ func TestEventerCloseTraceInstanceDisableError(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, mockError)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -243,7 +473,7 @@ func TestEventerEvent(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -260,9 +490,9 @@ mockNextEvent
 ` // The scanner expects newline delimited events
 	mockReader := strings.NewReader(mockEventStream)
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
-	mockEventParser := newMockEventParser(nil, errIrrelevantEvent, 1)
+	mockEventParser := newMockEventParser(nil, ErrIrrelevantEvent, 1)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -279,7 +509,7 @@ func TestEventerEventSkipSpuriousEmptyEvent(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -295,7 +525,7 @@ func TestEventerEventUnexpectedEOFError(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -318,7 +548,7 @@ func TestEventerEventEventParserError(t *testing.T) {
 	mockError := errors.New("mock event parser error")
 	mockEventParser := newMockEventParser(nil, mockError, 1)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -341,7 +571,7 @@ func TestEventerEventScannerError(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -363,7 +593,7 @@ func TestEventerEventAfterCloseError(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -391,7 +621,7 @@ func TestEventerEventAfterCloseWhileScanningError(t *testing.T) {
 	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
 	mockEventParser := newMockEventParser(nil, nil, 0)
 
-	eventer, err := newEventer(mockTraceInstance, mockEventParser)
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
 	if err != nil {
 		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
 	}
@@ -422,3 +652,1198 @@ func TestEventerEventAfterCloseWhileScanningError(t *testing.T) {
 		t.Errorf("expected error chain to include %q, but did not", ErrEventerClosed)
 	}
 }
+
+func TestEventerEventAfterCloseReleasesEventer(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	if err := eventer.Close(); err != nil {
+		t.Errorf("expected nil close error, got %q (of type %T)", err, err)
+	}
+
+	// Calls following a read of the closed eventer must not block
+	errChan := make(chan error, 3)
+	go func() {
+		_, err := eventer.Event()
+		errChan <- err
+		_, err = eventer.Event()
+		errChan <- err
+		_, err = eventer.Stats()
+		errChan <- err
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errChan:
+			t.Logf("got error %q (of type %T)", err, err)
+
+			if !errors.Is(err, ErrEventerClosed) {
+				t.Errorf("expected error chain to include %q, but did not", ErrEventerClosed)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected calls after close to return, but they blocked")
+		}
+	}
+}
+
+func TestEventerRecoverAfterCloseError(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	atomic.StoreInt32(&eventer.recovering, 1)
+	if err := eventer.Close(); err != nil {
+		t.Errorf("expected nil close error, got %q (of type %T)", err, err)
+	}
+
+	mockTraceInstance.enableCalled = false
+	err = eventer.recoverTracingInstance()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, ErrEventerClosed) {
+		t.Errorf("expected error chain to include %q, but did not", ErrEventerClosed)
+	}
+
+	if mockTraceInstance.enableCalled {
+		t.Error("expected closed tracing instance not to be re-enabled, but was")
+	}
+}
+
+func TestEventerAddAndRemoveTrigger(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	mockTrigger := "stacktrace"
+	if err := eventer.AddTrigger(mockTrigger); err != nil {
+		t.Errorf("expected nil add trigger error, got %q (of type %T)", err, err)
+	}
+
+	if err := eventer.RemoveTrigger(mockTrigger); err != nil {
+		t.Errorf("expected nil remove trigger error, got %q (of type %T)", err, err)
+	}
+
+	if len(mockTraceInstance.triggersAdded) != 1 || mockTraceInstance.triggersAdded[0] != mockTrigger {
+		t.Errorf("expected trigger %q to be added, but added triggers were %q",
+			mockTrigger,
+			mockTraceInstance.triggersAdded)
+	}
+
+	if len(mockTraceInstance.triggersRemoved) != 1 || mockTraceInstance.triggersRemoved[0] != mockTrigger {
+		t.Errorf("expected trigger %q to be removed, but removed triggers were %q",
+			mockTrigger,
+			mockTraceInstance.triggersRemoved)
+	}
+}
+
+func TestEventerAddTriggerTraceInstanceError(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockError := errors.New("mock trace instance trigger error")
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.triggerErrorToReturn = mockError
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	err = eventer.AddTrigger("stacktrace")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestEventerAddTriggerAfterCloseError(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	if err := eventer.Close(); err != nil {
+		t.Errorf("expected nil close error, got %q (of type %T)", err, err)
+	}
+
+	err = eventer.AddTrigger("stacktrace")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, ErrEventerClosed) {
+		t.Errorf("expected error chain to include %q, but did not", ErrEventerClosed)
+	}
+}
+
+func TestEventerStats(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockBufferStats := &BufferStats{Entries: 1, Overrun: 2, CommitOverrun: 3, DroppedEvents: 4, ReadEvents: 5}
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.bufferStatsToReturn = mockBufferStats
+	mockTraceInstance.degradedBufferSizeKBToReturn = 704
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if stats.Buffer != *mockBufferStats {
+		t.Errorf("expected buffer stats %+v, got %+v", *mockBufferStats, stats.Buffer)
+	}
+
+	if stats.DegradedBufferSizeKB != mockTraceInstance.degradedBufferSizeKBToReturn {
+		t.Errorf("expected degraded buffer size %d, got %d",
+			mockTraceInstance.degradedBufferSizeKBToReturn,
+			stats.DegradedBufferSizeKB)
+	}
+}
+
+func TestEventerStatsTraceInstanceError(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockError := errors.New("mock trace instance buffer stats error")
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.bufferStatsErrorToReturn = mockError
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	_, err = eventer.Stats()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestEventerEventCountsLostEvents(t *testing.T) {
+	mockEvent := new(event.Event)
+	mockReader := strings.NewReader("CPU:0 [LOST 10 EVENTS]\nCPU:1 [LOST 5 EVENTS]\nmock event\n")
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.bufferStatsToReturn = new(BufferStats)
+	mockEventParser := newMockEventParser(mockEvent, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event != mockEvent {
+		t.Errorf("expected event %v, got %v", mockEvent, event)
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Errorf("expected nil stats error, got %q (of type %T)", err, err)
+	}
+
+	if stats.LostEvents != 15 {
+		t.Errorf("expected %d lost events, got %d", 15, stats.LostEvents)
+	}
+}
+
+func TestEventerEventReportsLostEvents(t *testing.T) {
+	mockEvent := new(event.Event)
+	mockReader := strings.NewReader("CPU:2 [LOST 10 EVENTS]\nmock event\n")
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(mockEvent, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, &config{reportLostEvents: true})
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	_, err = eventer.Event()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	lostEventsErr := new(LostEventsError)
+	if !errors.As(err, &lostEventsErr) {
+		t.Fatalf("expected error chain to include %T, but did not", lostEventsErr)
+	}
+
+	if lostEventsErr.CPU != 2 || lostEventsErr.Lost != 10 {
+		t.Errorf("expected %d lost events on CPU %d, got %d on CPU %d", 10, 2, lostEventsErr.Lost, lostEventsErr.CPU)
+	}
+
+	// The stream continues after the lost events are reported
+	event, err := eventer.Event()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event != mockEvent {
+		t.Errorf("expected event %v, got %v", mockEvent, event)
+	}
+}
+
+func TestEventerEventWithContextReportsLostEventsAsGap(t *testing.T) {
+	mockEvent := new(event.Event)
+	mockReader := strings.NewReader("CPU:2 [LOST 10 EVENTS]\nmock event\n")
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(mockEvent, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, &config{reportLostEvents: true})
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	contextEvent, err := eventer.EventWithContext()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if contextEvent.Kind != KindLostEvents {
+		t.Errorf("expected event of kind %v, got %v", KindLostEvents, contextEvent.Kind)
+	}
+
+	if contextEvent.Context == nil || contextEvent.Context.CPU != 2 || contextEvent.LostEvents != 10 {
+		t.Errorf("expected %d lost events on CPU %d, got %d in context %+v",
+			10,
+			2,
+			contextEvent.LostEvents,
+			contextEvent.Context)
+	}
+
+	if contextEvent.Time.IsZero() {
+		t.Error("expected gap event to be timed, but was not")
+	}
+
+	// The stream continues after the gap
+	contextEvent, err = eventer.EventWithContext()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if contextEvent.Event != mockEvent {
+		t.Errorf("expected event %v, got %v", mockEvent, contextEvent.Event)
+	}
+}
+
+func TestEventerSnapshot(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockSnapshot := "mock snapshot"
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.snapshotToReturn = mockSnapshot
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	snapshot := new(strings.Builder)
+	if err := eventer.Snapshot(snapshot); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if snapshot.String() != mockSnapshot {
+		t.Errorf("expected snapshot %q, got %q", mockSnapshot, snapshot.String())
+	}
+}
+
+func TestEventerSnapshotTraceInstanceError(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockError := errors.New("mock trace instance snapshot error")
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.snapshotErrorToReturn = mockError
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	err = eventer.Snapshot(new(strings.Builder))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestEventerEventRecoversLostTracingInstance(t *testing.T) {
+	mockEvent := new(event.Event)
+	mockReader := new(bytes.Buffer)
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(mockEvent, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	// Simulate the instance being lost and closed, and the recovered instance
+	// then providing an event
+	eventer.recovering = 1
+	mockTraceInstance.enableCalled, mockTraceInstance.openCalled = false, false
+	mockTraceInstance.openReaderToReturn = strings.NewReader("mock event\n")
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event != mockEvent {
+		t.Errorf("expected event %v, got %v", mockEvent, event)
+	}
+
+	if !mockTraceInstance.disableCalled || !mockTraceInstance.enableCalled || !mockTraceInstance.openCalled {
+		t.Error("expected trace instance to be disabled, enabled and opened, but was not")
+	}
+
+	if eventer.recovering != 0 {
+		t.Error("expected recovery to be complete, but was not")
+	}
+}
+
+func TestEventerEventRecoverTracingInstanceError(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockError := errors.New("mock trace instance enable error")
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	eventer.recovering = 1
+	mockTraceInstance.enableErrorToReturn = mockError
+
+	_, err = eventer.Event()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+
+	if eventer.recovering == 0 {
+		t.Error("expected recovery to be pending, but was not")
+	}
+}
+
+func TestEventerWatchClosesLostTracingInstance(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.absent = true
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, &config{watchInterval: time.Millisecond})
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&eventer.recovering) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected watcher to detect lost tracing instance, but did not")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := eventer.Close(); err != nil {
+		t.Errorf("expected nil close error, got %q (of type %T)", err, err)
+	}
+
+	if !mockTraceInstance.closeCalled {
+		t.Error("expected trace instance to be closed, but was not")
+	}
+}
+
+type mockDeadlineReader struct {
+	deadlineErrorsToReturn int
+	reader                 io.Reader
+}
+
+func (mdr *mockDeadlineReader) Read(p []byte) (int, error) {
+	if mdr.deadlineErrorsToReturn > 0 {
+		mdr.deadlineErrorsToReturn--
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	return mdr.reader.Read(p)
+}
+
+func TestEventerSetReadDeadline(t *testing.T) {
+	mockTraceInstance := newMockTraceInstance(new(bytes.Buffer), nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	mockDeadline := time.Now().Add(time.Minute)
+	if err := eventer.SetReadDeadline(mockDeadline); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !mockTraceInstance.readDeadline.Equal(mockDeadline) {
+		t.Errorf("expected read deadline %v, got %v", mockDeadline, mockTraceInstance.readDeadline)
+	}
+}
+
+func TestEventerSetReadDeadlineError(t *testing.T) {
+	mockTraceInstance := newMockTraceInstance(new(bytes.Buffer), nil, nil, nil, nil)
+	mockTraceInstance.readDeadlineErrorToReturn = os.ErrNoDeadline
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	err = eventer.SetReadDeadline(time.Now())
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, os.ErrNoDeadline) {
+		t.Errorf("expected error chain to include %q, but did not", os.ErrNoDeadline)
+	}
+}
+
+func TestEventerEventDeadlineExceededResumes(t *testing.T) {
+	mockEvent := new(event.Event)
+	mockReader := &mockDeadlineReader{
+		deadlineErrorsToReturn: 1,
+		reader:                 strings.NewReader("mock event\n"),
+	}
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(mockEvent, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	_, err = eventer.Event()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected error chain to include %q, but did not", os.ErrDeadlineExceeded)
+	}
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event != mockEvent {
+		t.Errorf("expected event %v, got %v", mockEvent, event)
+	}
+}
+
+func TestEventerConfigureEventParserError(t *testing.T) {
+	mockError := errors.New("mock event parser configure error")
+	mockTraceInstance := newMockTraceInstance(new(bytes.Buffer), nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(nil, nil, 0)
+	mockEventParser.configureErrorToReturn = mockError
+
+	_, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+
+	if !mockTraceInstance.disableCalled {
+		t.Error("expected trace instance to be disabled, but was not")
+	}
+}
+
+func TestEventerEventPerCPU(t *testing.T) {
+	cpu0Reader, cpu0Writer := io.Pipe()
+	defer cpu0Writer.Close()
+	go io.WriteString(cpu0Writer, mockEarlierShardEvent)
+
+	var err error
+	mockTraceInstance := newMockTraceInstance(nil, nil, nil, nil, nil)
+	mockTraceInstance.openPerCPUReadersToReturn = []io.Reader{cpu0Reader}
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), nil)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, &config{perCPUReaders: true})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.SourcePort != 44406 {
+		t.Errorf("expected event with source port %d, got %d", 44406, event.SourcePort)
+	}
+}
+
+func TestEventerEventPerCPUDeadlineExceeded(t *testing.T) {
+	cpu0Reader, cpu0Writer := io.Pipe()
+	defer cpu0Writer.Close()
+
+	var err error
+	mockTraceInstance := newMockTraceInstance(nil, nil, nil, nil, nil)
+	mockTraceInstance.openPerCPUReadersToReturn = []io.Reader{cpu0Reader}
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), nil)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, &config{perCPUReaders: true})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	if err := eventer.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	_, err = eventer.Event()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected error chain to include %q, but did not", os.ErrDeadlineExceeded)
+	}
+}
+
+func TestEventerEventBackfillsSkippingDuplicates(t *testing.T) {
+	// The trace_pipe also returns the backfilled event, as it was not consumed
+	mockReader := strings.NewReader(mockEarlierShardEvent + mockLaterShardEvent)
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.backfillToReturn = "# tracer: nop\n#\n" + mockEarlierShardEvent
+
+	var err error
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), nil)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, &config{backfill: true})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	for _, expectedNewState := range []string{"ESTABLISHED", "FIN-WAIT-1"} {
+		event, err := eventer.Event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.NewState.String() != expectedNewState {
+			t.Errorf("expected event with new state %s, got %s", expectedNewState, event.NewState)
+		}
+	}
+
+	_, err = eventer.Event()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected error %q, got %q (of type %T)", io.ErrUnexpectedEOF, err, err)
+	}
+}
+
+func TestEventerConstructorBackfillError(t *testing.T) {
+	mockError := errors.New("mock backfill error")
+	mockTraceInstance := newMockTraceInstance(strings.NewReader(""), nil, nil, nil, nil)
+	mockTraceInstance.backfillErrorToReturn = mockError
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	_, err := newEventer(mockTraceInstance, mockEventParser, &config{backfill: true})
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+
+	if !mockTraceInstance.closeCalled || !mockTraceInstance.disableCalled {
+		t.Error("expected tracing instance to be closed and disabled, but was not")
+	}
+}
+
+func TestEventerKernelInfo(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockKernelInfo := &KernelInfo{
+		KernelRelease: "5.15.0-91-generic",
+		Tracepoint:    "sock/inet_sock_set_state",
+		Mountpoint:    "/sys/kernel/tracing",
+		InstancePath:  "/sys/kernel/tracing/instances/tcp-audit",
+		BufferSizeKB:  1408,
+	}
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.kernelInfoToReturn = mockKernelInfo
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	kernelInfo, err := eventer.KernelInfo()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if *kernelInfo != *mockKernelInfo {
+		t.Errorf("expected kernel info %+v, got %+v", *mockKernelInfo, *kernelInfo)
+	}
+}
+
+func TestEventerKernelInfoTraceInstanceError(t *testing.T) {
+	mockReader := new(bytes.Buffer)
+	mockError := errors.New("mock trace instance kernel info error")
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.kernelInfoErrorToReturn = mockError
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	_, err = eventer.KernelInfo()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestEventerWatchReassertsStalledTracingInstance(t *testing.T) {
+	mockReader, mockWriter := io.Pipe()
+	defer mockWriter.Close()
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.reassertedToReturn = []string{"tracing_on"}
+	mockEventParser := newMockEventParser(nil, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, &config{stallTimeout: time.Millisecond})
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&mockTraceInstance.reassertTracingCalls) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected watcher to reassert stalled tracing instance, but did not")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEventerEventWithContext(t *testing.T) {
+	mockEvent := new(event.Event)
+	mockReader := strings.NewReader("<idle>-0       [003] ..s.   995.318985: inet_sock_set_state: family=AF_INET\n")
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockEventParser := newMockEventParser(mockEvent, nil, 0)
+
+	eventer, err := newEventer(mockTraceInstance, mockEventParser, new(config))
+	if err != nil {
+		t.Errorf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	contextEvent, err := eventer.EventWithContext()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if contextEvent.Event != mockEvent {
+		t.Errorf("expected event %v, got %v", mockEvent, contextEvent.Event)
+	}
+
+	if contextEvent.Context == nil || contextEvent.Context.CPU != 3 || !contextEvent.Context.SoftIRQ {
+		t.Errorf("expected context on CPU 3 in softirq, got %+v", contextEvent.Context)
+	}
+}
+
+func TestEventerEventSkipsResets(t *testing.T) {
+	mockReader := strings.NewReader(
+		"<idle>-0       [003] ..s.   995.318980: tcp_send_reset: family=AF_INET sport=80 dport=44406 saddr=172.217.169.4 daddr=192.168.122.38 saddrv6=::ffff:172.217.169.4 daddrv6=::ffff:192.168.122.38 state=TCP_ESTABLISHED\n" +
+			"<idle>-0       [003] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n")
+
+	var err error
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), resetTracepoints)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.SourcePort != 44406 {
+		t.Errorf("expected state change event with source port %d, got %d", 44406, event.SourcePort)
+	}
+}
+
+func TestEventerEventWithContextReturnsResets(t *testing.T) {
+	mockReader := strings.NewReader(
+		"<idle>-0       [003] ..s.   995.318980: tcp_send_reset: family=AF_INET sport=80 dport=44406 saddr=172.217.169.4 daddr=192.168.122.38 saddrv6=::ffff:172.217.169.4 daddrv6=::ffff:192.168.122.38 state=TCP_ESTABLISHED\n")
+
+	var err error
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), resetTracepoints)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	contextEvent, err := eventer.EventWithContext()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if contextEvent.Kind != KindSendReset {
+		t.Errorf("expected event of kind %v, got %v", KindSendReset, contextEvent.Kind)
+	}
+}
+
+func TestEventerStatsCountsSkippedLines(t *testing.T) {
+	mockReader := strings.NewReader("\n" +
+		"CPU:3 [LOST 42 EVENTS]\n" +
+		"<idle>-0       [003] ..s.   995.318975: inet_sock_set_state: family=AF_INET6 protocol=IPPROTO_TCP sport=44406 dport=80\n" +
+		"<idle>-0       [003] ..s.   995.318980: inet_sock_set_state: family=AF_INET protocol=IPPROTO_MPTCP sport=44406 dport=80\n" +
+		"<idle>-0       [003] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n")
+
+	var err error
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.bufferStatsToReturn = new(BufferStats)
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), nil)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	if _, err := eventer.Event(); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedSkipped := SkippedStats{NonInet: 1, NonTCP: 1, Empty: 1, LostEventsMarkers: 1}
+	if stats.Skipped != expectedSkipped {
+		t.Errorf("expected skipped stats %+v, got %+v", expectedSkipped, stats.Skipped)
+	}
+}
+
+func TestEventerSkipsOversizeLines(t *testing.T) {
+	mockReader := strings.NewReader("<idle>-0       [003] ..s.   995.318980: inet_sock_set_state: " + strings.Repeat("x", 512) + "\n" +
+		"<idle>-0       [003] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n")
+
+	var err error
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.bufferStatsToReturn = new(BufferStats)
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), nil)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, &config{maxLineLength: 512})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.SourcePort != 44406 {
+		t.Errorf("expected event following oversize line, got %+v", event)
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if stats.Skipped.Oversize != 1 {
+		t.Errorf("expected 1 oversize line skipped, got %d", stats.Skipped.Oversize)
+	}
+}
+
+func TestEventerStatsCountsParseFailures(t *testing.T) {
+	mockReader := strings.NewReader("<idle>-0       [003] ..s.   995.318975: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=foo dport=80\n" +
+		"<idle>-0       [003] ..s.   995.318980: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_FOO newstate=TCP_ESTABLISHED\n")
+
+	var err error
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.bufferStatsToReturn = new(BufferStats)
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), nil)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := eventer.Event(); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedFailures := ParseFailureStats{BadInteger: 1, BadState: 1}
+	if stats.ParseFailures != expectedFailures {
+		t.Errorf("expected parse failure stats %+v, got %+v", expectedFailures, stats.ParseFailures)
+	}
+}
+
+func TestEventerSuppressesDuplicateTransitions(t *testing.T) {
+	mockLine := "<idle>-0       [003] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n"
+	mockReader := strings.NewReader(mockLine + mockLine +
+		"<idle>-0       [003] ..s.   995.318990: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_ESTABLISHED newstate=TCP_FIN_WAIT1\n")
+
+	var err error
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.bufferStatsToReturn = new(BufferStats)
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), nil)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, &config{dedupeWindow: time.Second})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	for _, expectedState := range []tcpstate.State{tcpstate.StateEstablished, tcpstate.StateFinWait1} {
+		event, err := eventer.Event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.NewState != expectedState {
+			t.Errorf("expected new state %v, got %v", expectedState, event.NewState)
+		}
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if stats.Skipped.Duplicates != 1 {
+		t.Errorf("expected 1 duplicate skipped, got %d", stats.Skipped.Duplicates)
+	}
+}
+
+func TestEventerSummarisesFlows(t *testing.T) {
+	mockReader := strings.NewReader(
+		"<idle>-0       [003] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n" +
+			"<idle>-0       [003] ..s.   996.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_LAST_ACK newstate=TCP_CLOSE\n")
+
+	var err error
+	mockTraceInstance := newMockTraceInstance(mockReader, nil, nil, nil, nil)
+	mockTraceInstance.eventFormatToReturn, err = parseEventFormat(strings.NewReader(mockEventFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), nil)
+
+	eventer, err := newEventer(mockTraceInstance, eventParser, &config{flows: true, flowSummaries: true})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	var flowID string
+	for _, expectedKind := range []EventKind{KindStateChange, KindStateChange, KindFlowClosed} {
+		event, err := eventer.EventWithContext()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.Kind != expectedKind {
+			t.Errorf("expected kind %v, got %v", expectedKind, event.Kind)
+		}
+
+		if event.Flow == nil || (flowID != "" && event.Flow.ID != flowID) {
+			t.Fatalf("expected event of flow %q, got %+v", flowID, event.Flow)
+		}
+		flowID = event.Flow.ID
+	}
+}
+
+func TestSourceEventerEvent(t *testing.T) {
+	mockEvent := &ContextEvent{Event: new(event.Event), Kind: KindStateChange}
+	mockEventSource := newMockEventSource([]*ContextEvent{nil, nil, mockEvent},
+		[]error{&LostEventsError{CPU: 1, Lost: 10}, errNonInetEvent})
+
+	eventer, err := newSourceEventer(mockEventSource, newMockEventParser(nil, nil, 0), new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	if !mockEventSource.openCalled {
+		t.Error("expected event source to be opened, but was not")
+	}
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event != mockEvent.Event {
+		t.Errorf("expected event %v, got %v", mockEvent.Event, event)
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Fatalf("expected nil stats error, got %q (of type %T)", err, err)
+	}
+
+	if stats.LostEvents != 10 || stats.Skipped.LostEventsMarkers != 1 || stats.Skipped.NonInet != 1 {
+		t.Errorf("expected 10 lost events and a non-INET event skipped, got %+v", stats)
+	}
+
+	if stats.Buffer.ReadEvents != 1 {
+		t.Errorf("expected the buffer stats of the event source, got %+v", stats.Buffer)
+	}
+}
+
+func TestSourceEventerEventExisting(t *testing.T) {
+	mockExisting := newMockTransition(time.Now(), nil, tcpstate.StateEstablished)
+	mockExisting.OldState, mockExisting.Kind = tcpstate.StateEstablished, KindExisting
+	eventer, err := newSourceEventer(newMockEventSource(nil, nil), newMockEventParser(nil, nil, 0), new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+	eventer.existing = []*ContextEvent{mockExisting}
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.OldState != tcpstate.StateClosed || event.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected state change from CLOSED to ESTABLISHED, got from %v to %v", event.OldState, event.NewState)
+	}
+
+	if mockExisting.OldState != tcpstate.StateEstablished {
+		t.Errorf("expected existing connection to be unmodified, got old state %v", mockExisting.OldState)
+	}
+}
+
+func TestSourceEventerEventAfterCloseError(t *testing.T) {
+	mockEventSource := newMockEventSource(nil, nil)
+	eventer, err := newSourceEventer(mockEventSource, newMockEventParser(nil, nil, 0), new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	go eventer.Close()
+	if _, err := eventer.Event(); !errors.Is(err, ErrEventerClosed) {
+		t.Errorf("expected error chain to include %q, got %q (of type %T)", ErrEventerClosed, err, err)
+	}
+
+	if !mockEventSource.closeCalled {
+		t.Error("expected event source to be closed, but was not")
+	}
+}
+
+func TestSourceEventerDebounceWindowExpires(t *testing.T) {
+	mockEvent := newMockTransition(time.Now(), &SocketID{Cookie: 1}, tcpstate.StateEstablished)
+	mockEventSource := newMockEventSource([]*ContextEvent{mockEvent}, nil)
+	eventer, err := newSourceEventer(mockEventSource,
+		newMockEventParser(nil, nil, 0),
+		&config{debounceWindow: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	// The state change held is released once its window expires, though no
+	// later event is read
+	event, err := eventer.Event()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event != mockEvent.Event {
+		t.Errorf("expected event %v, got %v", mockEvent.Event, event)
+	}
+
+	// The deadline set by SetReadDeadline is still applied
+	if err := eventer.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatalf("expected nil read deadline error, got %q (of type %T)", err, err)
+	}
+
+	if _, err := eventer.Event(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected error chain to include %q, got %q (of type %T)", os.ErrDeadlineExceeded, err, err)
+	}
+}
+
+func TestSourceEventerDebounceFlushedOnClose(t *testing.T) {
+	mockEvent := newMockTransition(time.Now(), &SocketID{Cookie: 1}, tcpstate.StateEstablished)
+	mockEventSource := newMockEventSource([]*ContextEvent{mockEvent}, nil)
+	eventer, err := newSourceEventer(mockEventSource,
+		newMockEventParser(nil, nil, 0),
+		&config{debounceWindow: time.Hour})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		eventer.Close()
+	}()
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event != mockEvent.Event {
+		t.Errorf("expected event %v, got %v", mockEvent.Event, event)
+	}
+
+	if _, err := eventer.Event(); !errors.Is(err, ErrEventerClosed) {
+		t.Errorf("expected error chain to include %q, got %q (of type %T)", ErrEventerClosed, err, err)
+	}
+}
+
+func TestSourceEventerUnsupportedError(t *testing.T) {
+	eventer, err := newSourceEventer(newMockEventSource(nil, nil),
+		newMockEventParser(nil, nil, 0),
+		&config{backend: backendSockDiag})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	if err := eventer.AddTrigger("stacktrace"); err == nil {
+		t.Error("expected trigger error, got nil")
+	}
+
+	if err := eventer.Snapshot(new(bytes.Buffer)); err == nil {
+		t.Error("expected snapshot error, got nil")
+	}
+}
+
+func TestSourceEventerOpenError(t *testing.T) {
+	mockEventSource := newMockEventSource(nil, nil)
+	mockEventSource.openErrorToReturn = errors.New("mock open error")
+
+	if _, err := newSourceEventer(mockEventSource, newMockEventParser(nil, nil, 0), new(config)); err == nil {
+		t.Error("expected constructor error, got nil")
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// ModuleReadSize is the size of each read of a relay file.
+const moduleReadSize = 64 * 1024
+
+// The layout of the fixed-size records of state changes which a companion
+// module writes to its relay files. Integers are in the byte order of the host,
+// and addresses in network byte order, as the kernel stores them.
+const (
+	moduleRecordTimestamp = 0  // u64, the time of the state change by the boot clock, in nanoseconds
+	moduleRecordPID       = 8  // u32, the PID of the task on CPU
+	moduleRecordSport     = 12 // u16
+	moduleRecordDport     = 14 // u16
+	moduleRecordSaddr     = 16 // [4]u8
+	moduleRecordDaddr     = 20 // [4]u8
+	moduleRecordOldState  = 24 // u8, a TCP state of the kernel
+	moduleRecordNewState  = 25 // u8, a TCP state of the kernel, followed by 6 bytes of padding
+	moduleRecordComm      = 32 // [16]char, the NUL-padded command of the task on CPU
+
+	moduleRecordSize = 48
+)
+
+// ModuleSource reads the state changes written by a companion kernel module to
+// a relay channel, for locked-down kernels where tracefs is not permitted but
+// a vendor module is. The channel has a relay file per CPU, named by its base
+// path followed by the number of the CPU, such as
+// `/sys/kernel/debug/tcp_audit/events0`, each of which the module must write
+// whole records of state changes to, which are decoded into events.
+type moduleSource struct {
+	read     uint64 // Accessed atomically, the number of records read
+	closed   int32  // Accessed atomically, non-zero once closed
+	deadline sourceDeadline
+
+	channel string
+	config  *config
+
+	files    []*moduleRelayFile
+	epollFD  int
+	readLock *sync.Mutex // Serialises reads of the relay files with their closing
+	clock    *traceClock
+	buf      []byte         // Scratch, into which the relay files are read
+	pending  []moduleRecord // The records read not yet returned, ordered by time
+
+	osReleasePath string
+}
+
+// ModuleRelayFile is the relay file of the channel of a CPU.
+type moduleRelayFile struct {
+	fd      int
+	cpu     int
+	partial []byte // The start of a record not yet wholly read
+}
+
+// ModuleRecord is the event of a record read from a relay file, or the error
+// decoding it, at the boot clock time of the record.
+type moduleRecord struct {
+	time  uint64
+	event *ContextEvent
+	err   error
+}
+
+func newModuleSource(channel string, config *config) *moduleSource {
+	return &moduleSource{
+		channel:       channel,
+		config:        config,
+		epollFD:       -1,
+		readLock:      new(sync.Mutex),
+		clock:         newTraceClock("boot"),
+		osReleasePath: osReleasePath,
+	}
+}
+
+// Open opens the relay file of each CPU of the channel. A relay file reads as
+// empty, rather than blocking, until the module writes to it, so the files
+// are waited on with epoll.
+func (ms *moduleSource) open() error {
+	paths, err := filepath.Glob(ms.channel + "[0-9]*")
+	if err != nil {
+		return fmt.Errorf("listing relay files of %s: %w", ms.channel, err)
+	}
+
+	for _, path := range paths {
+		cpu, err := strconv.Atoi(strings.TrimPrefix(path, ms.channel))
+		if err != nil {
+			continue // Not a relay file of the channel, such as events0.old
+		}
+
+		fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			ms.close()
+			return fmt.Errorf("opening relay file %s: %w", path, os.NewSyscallError("open", err))
+		}
+		ms.files = append(ms.files, &moduleRelayFile{fd: fd, cpu: cpu})
+	}
+
+	if len(ms.files) == 0 {
+		return fmt.Errorf("no relay files found for %s", ms.channel)
+	}
+
+	sort.Slice(ms.files, func(i, j int) bool {
+		return ms.files[i].cpu < ms.files[j].cpu
+	})
+
+	epollFD, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		ms.close()
+		return os.NewSyscallError("epoll_create1", err)
+	}
+	ms.epollFD = epollFD
+
+	for _, file := range ms.files {
+		event := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(file.fd)}
+		if err := syscall.EpollCtl(ms.epollFD, syscall.EPOLL_CTL_ADD, file.fd, event); err != nil {
+			ms.close()
+			return os.NewSyscallError("epoll_ctl", err)
+		}
+	}
+	ms.buf = make([]byte, moduleReadSize)
+
+	return nil
+}
+
+// Event returns the next state change, waiting for the module to write one.
+// A wait is for at most perfPollInterval, so that closure is noticed.
+func (ms *moduleSource) event() (*ContextEvent, error) {
+	for len(ms.pending) == 0 {
+		if atomic.LoadInt32(&ms.closed) != 0 {
+			return nil, os.ErrClosed
+		}
+
+		if err := ms.readFiles(); err != nil {
+			return nil, err
+		}
+
+		if len(ms.pending) != 0 {
+			break
+		}
+
+		timeout, err := ms.deadline.wait(perfPollInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ms.wait(timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	record := ms.pending[0]
+	ms.pending = ms.pending[1:]
+
+	return record.event, record.err
+}
+
+// Wait waits for the module to write to a relay file, or for the timeout to
+// elapse.
+func (ms *moduleSource) wait(timeout time.Duration) error {
+	ms.readLock.Lock()
+	defer ms.readLock.Unlock()
+	if atomic.LoadInt32(&ms.closed) != 0 {
+		return os.ErrClosed // The epoll instance may be closed
+	}
+
+	events := make([]syscall.EpollEvent, len(ms.files))
+	for {
+		_, err := syscall.EpollWait(ms.epollFD, events, int(timeout/time.Millisecond)+1)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return os.NewSyscallError("epoll_wait", err)
+		}
+
+		return nil
+	}
+}
+
+// ReadFiles reads what has been written to the relay files, decoding their
+// whole records into the pending records, ordered by time.
+func (ms *moduleSource) readFiles() error {
+	ms.readLock.Lock()
+	defer ms.readLock.Unlock()
+	if atomic.LoadInt32(&ms.closed) != 0 {
+		return os.ErrClosed // The relay files may be closed
+	}
+
+	read := len(ms.pending)
+	for _, file := range ms.files {
+		for {
+			n, err := syscall.Read(file.fd, ms.buf)
+			if err == syscall.EINTR {
+				continue
+			}
+
+			if err == syscall.EAGAIN || (err == nil && n == 0) {
+				break
+			}
+
+			if err != nil {
+				return fmt.Errorf("reading relay file of CPU %d: %w", file.cpu, os.NewSyscallError("read", err))
+			}
+
+			file.partial = append(file.partial, ms.buf[:n]...)
+		}
+
+		whole := len(file.partial) - len(file.partial)%moduleRecordSize
+		for offset := 0; offset < whole; offset += moduleRecordSize {
+			ms.pending = append(ms.pending, ms.decodeRecord(file.partial[offset:offset+moduleRecordSize], file.cpu))
+		}
+		file.partial = append([]byte(nil), file.partial[whole:]...)
+	}
+
+	if len(ms.files) > 1 {
+		records := ms.pending[read:]
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].time < records[j].time
+		})
+	}
+	atomic.AddUint64(&ms.read, uint64(len(ms.pending)-read))
+
+	return nil
+}
+
+// DecodeRecord decodes the record of the state change, written to the relay
+// file of the CPU, into an event, of the task on CPU, at its time.
+func (ms *moduleSource) decodeRecord(record []byte, cpu int) moduleRecord {
+	timestamp := hostByteOrder.Uint64(record[moduleRecordTimestamp:])
+	decoded := moduleRecord{time: timestamp}
+
+	var unknownStates []string
+	bestEffort := bestEffortParsing(ms.config)
+	oldState, err := decodeState(record[moduleRecordOldState], bestEffort, &unknownStates)
+	if err != nil {
+		decoded.err = fmt.Errorf("decoding module record of CPU %d: decoding old state: %w", cpu, err)
+		return decoded
+	}
+
+	newState, err := decodeState(record[moduleRecordNewState], bestEffort, &unknownStates)
+	if err != nil {
+		decoded.err = fmt.Errorf("decoding module record of CPU %d: decoding new state: %w", cpu, err)
+		return decoded
+	}
+
+	eventTime, err := ms.clock.toTime(traceTimestamp{
+		sec:  timestamp / uint64(time.Second),
+		nsec: timestamp % uint64(time.Second),
+	})
+	if err != nil {
+		decoded.err = fmt.Errorf("converting time to wall-clock time: %w", err)
+		return decoded
+	}
+
+	pid := int(hostByteOrder.Uint32(record[moduleRecordPID:]))
+	comm := string(bytes.TrimRight(record[moduleRecordComm:moduleRecordSize], "\x00"))
+	switch {
+	case pid == idlePID:
+		comm = "<idle>"
+	case comm == "":
+		comm = "<...>"
+	}
+
+	saddr, daddr := record[moduleRecordSaddr:], record[moduleRecordDaddr:]
+	decoded.event = &ContextEvent{
+		Event: &event.Event{
+			Time:         eventTime.UTC(),
+			CommandOnCPU: comm,
+			PIDOnCPU:     pid,
+			SourceIP:     net.IPv4(saddr[0], saddr[1], saddr[2], saddr[3]),
+			DestIP:       net.IPv4(daddr[0], daddr[1], daddr[2], daddr[3]),
+			SourcePort:   hostByteOrder.Uint16(record[moduleRecordSport:]),
+			DestPort:     hostByteOrder.Uint16(record[moduleRecordDport:]),
+			OldState:     oldState,
+			NewState:     newState,
+		},
+		Kind:          KindStateChange,
+		Idle:          pid == idlePID,
+		Context:       &TraceContext{CPU: cpu},
+		UnknownStates: unknownStates,
+	}
+
+	return decoded
+}
+
+func (ms *moduleSource) setReadDeadline(t time.Time) error {
+	ms.deadline.set(t)
+	return nil
+}
+
+func (ms *moduleSource) kernelInfo() (*KernelInfo, error) {
+	return releaseKernelInfo(ms.osReleasePath)
+}
+
+// BufferStats returns the number of records read as the events read. Records
+// dropped by the module when its sub-buffers are full are not known.
+func (ms *moduleSource) bufferStats() (*BufferStats, error) {
+	return &BufferStats{ReadEvents: atomic.LoadUint64(&ms.read)}, nil
+}
+
+// Close stops reading, and closes the epoll instance and the relay files, if
+// they were opened, once any read or wait in progress is done.
+func (ms *moduleSource) close() error {
+	log.Printf("Closing relay files of %s", ms.channel)
+	atomic.StoreInt32(&ms.closed, 1)
+
+	ms.readLock.Lock()
+	defer ms.readLock.Unlock()
+
+	var firstErr error
+	if ms.epollFD != -1 {
+		if err := syscall.Close(ms.epollFD); err != nil {
+			firstErr = os.NewSyscallError("close", err)
+		}
+		ms.epollFD = -1
+	}
+
+	for _, file := range ms.files {
+		if err := syscall.Close(file.fd); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("closing relay file of CPU %d: %w", file.cpu, os.NewSyscallError("close", err))
+		}
+	}
+	ms.files = nil
+
+	return firstErr
+}
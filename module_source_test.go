@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// NewMockRelayChannel returns the base path of a channel whose relay file of
+// each CPU is a FIFO, which, opened non-blocking, reads as empty until written
+// to, as relay files do.
+func newMockRelayChannel(t *testing.T, cpus int) string {
+	dir, err := ioutil.TempDir("", "tracefs-eventer-test-")
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	channel := dir + "/events"
+	for cpu := 0; cpu < cpus; cpu++ {
+		if err := syscall.Mkfifo(channel+string(rune('0'+cpu)), 0600); err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+	}
+
+	return channel
+}
+
+// NewMockModuleRecord returns a record of a state change of the task, at the
+// boot clock timestamp, from the source port.
+func newMockModuleRecord(timestamp uint64, pid uint32, comm string, sport uint16) []byte {
+	record := make([]byte, moduleRecordSize)
+	hostByteOrder.PutUint64(record[moduleRecordTimestamp:], timestamp)
+	hostByteOrder.PutUint32(record[moduleRecordPID:], pid)
+	hostByteOrder.PutUint16(record[moduleRecordSport:], sport)
+	hostByteOrder.PutUint16(record[moduleRecordDport:], 80)
+	copy(record[moduleRecordSaddr:], []byte{192, 168, 122, 38})
+	copy(record[moduleRecordDaddr:], []byte{172, 217, 169, 4})
+	record[moduleRecordOldState] = 2 // TCP_SYN_SENT
+	record[moduleRecordNewState] = 1 // TCP_ESTABLISHED
+	copy(record[moduleRecordComm:], comm)
+
+	return record
+}
+
+func TestModuleSourceEventOrdered(t *testing.T) {
+	channel := newMockRelayChannel(t, 2)
+	source := newModuleSource(channel, new(config))
+	if err := source.open(); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer source.close()
+
+	// The record of the later CPU is the earlier
+	for cpu, record := range [][]byte{
+		newMockModuleRecord(995318985321, 1234, "curl", 44406),
+		newMockModuleRecord(995318985000, 0, "", 44407),
+	} {
+		writer, err := os.OpenFile(channel+string(rune('0'+cpu)), os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+		defer writer.Close()
+		writer.Write(record)
+	}
+
+	for _, expected := range []struct {
+		command string
+		pid     int
+		port    uint16
+		cpu     int
+	}{
+		{"<idle>", 0, 44407, 1},
+		{"curl", 1234, 44406, 0},
+	} {
+		event, err := source.event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.CommandOnCPU != expected.command ||
+			event.PIDOnCPU != expected.pid ||
+			event.SourcePort != expected.port ||
+			event.Context.CPU != expected.cpu {
+			t.Errorf("expected event of %s-%d from port %d on CPU %d, got %+v",
+				expected.command,
+				expected.pid,
+				expected.port,
+				expected.cpu,
+				event)
+		}
+
+		if event.OldState != tcpstate.StateSynSent || event.NewState != tcpstate.StateEstablished {
+			t.Errorf("expected state change from SYN-SENT to ESTABLISHED, got from %v to %v", event.OldState, event.NewState)
+		}
+	}
+
+	if stats, _ := source.bufferStats(); stats.ReadEvents != 2 {
+		t.Errorf("expected 2 events read, got %d", stats.ReadEvents)
+	}
+}
+
+func TestModuleSourceDeadlineExceededMidRecord(t *testing.T) {
+	channel := newMockRelayChannel(t, 1)
+	source := newModuleSource(channel, new(config))
+	if err := source.open(); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer source.close()
+
+	writer, err := os.OpenFile(channel+"0", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer writer.Close()
+	record := newMockModuleRecord(995318985321, 1234, "curl", 44406)
+	writer.Write(record[:20])
+
+	source.setReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := source.event(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %q (of type %T)", err, err)
+	}
+
+	// The start of the record is not lost
+	source.setReadDeadline(time.Time{})
+	writer.Write(record[20:])
+	event, err := source.event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.CommandOnCPU != "curl" || event.SourcePort != 44406 {
+		t.Errorf("expected event of curl from port 44406, got %+v", event)
+	}
+}
+
+func TestModuleSourceNoRelayFilesError(t *testing.T) {
+	channel := newMockRelayChannel(t, 0)
+
+	err := newModuleSource(channel, new(config)).open()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
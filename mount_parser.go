@@ -4,12 +4,15 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 )
 
-// MountsParser is an interface which describes objects which retrieve the first
-// mountpoint of a given filesystem type.
+// MountsParser is an interface which describes objects which retrieve the
+// mountpoints of a given filesystem type.
 type mountsParser interface {
 	getFirstMountpoint(reader io.Reader, fsType string) (string, error)
+	getMountpoints(reader io.Reader, fsType string) ([]string, error)
 }
 
 // ProcMountsMountsParser retrieves the first mountpoint of a given virtual filesystem type.
@@ -27,31 +30,169 @@ func newProcMountsMountsParser(fieldParser fieldParser) *procMountsMountsParser
 // This implementation relies upon the fact that in /proc/mounts, the device name is the
 // same as the virtual filesystem name.
 func (mp *procMountsMountsParser) getFirstMountpoint(reader io.Reader, fsType string) (string, error) {
+	mountpoints, err := mp.getMountpoints(reader, fsType)
+	if err != nil {
+		return "", err
+	}
+
+	return mountpoints[0], nil
+}
+
+// GetMountpoints retrieves all the mountpoints of a given virtual filesystem type, in
+// the order in which they are listed.
+// It expects the input to be in the same format as the /proc/mounts virtual file.
+func (mp *procMountsMountsParser) getMountpoints(reader io.Reader, fsType string) ([]string, error) {
+	var mountpoints []string
 	scanner := bufio.NewScanner(reader)
 	for {
 		if !scanner.Scan() {
 			if err := scanner.Err(); err != nil {
-				return "", fmt.Errorf("scanning mounts for %s mountpoint: %w", fsType, err)
+				return nil, fmt.Errorf("scanning mounts for %s mountpoint: %w", fsType, err)
+			}
+
+			if len(mountpoints) == 0 {
+				// EOF reached but no mountpoint found
+				return nil, fmt.Errorf("%s not mounted", fsType)
 			}
 
-			// EOF reached but no mountpoint found
-			return "", fmt.Errorf("%s not mounted", fsType)
+			return mountpoints, nil
 		}
 
 		mount := scanner.Bytes()
 		device, err := mp.fieldParser.nextField(&mount, spaceBytes, true) // Get device from mount
 		if err != nil {
-			return "", fmt.Errorf("getting device from mount: %w", err)
+			return nil, fmt.Errorf("getting device from mount: %w", err)
 		}
 
 		if string(device) == fsType {
 			mountpoint, err := mp.fieldParser.nextField(&mount, spaceBytes, true) // Get mountpoint from mount
 			if err != nil {
-				return "", fmt.Errorf("getting mountpoint from mount: %w", err)
+				return nil, fmt.Errorf("getting mountpoint from mount: %w", err)
+			}
+
+			mountpoints = append(mountpoints, string(mountpoint))
+		}
+	}
+}
+
+// ProcMountinfoMountsParser retrieves the first mountpoint of a given filesystem type.
+// It expects the input to be in the same format as the /proc/<pid>/mountinfo virtual
+// file, which, unlike /proc/mounts, explicitly states the filesystem type of each
+// mount and the root of the filesystem visible at the mountpoint.
+type procMountinfoMountsParser struct {
+	fieldParser fieldParser
+}
+
+func newProcMountinfoMountsParser(fieldParser fieldParser) *procMountinfoMountsParser {
+	return &procMountinfoMountsParser{fieldParser}
+}
+
+// GetFirstMountpoint retrieves the first mountpoint of a given filesystem type.
+// It expects the input to be in the same format as the /proc/<pid>/mountinfo virtual
+// file.
+func (mp *procMountinfoMountsParser) getFirstMountpoint(reader io.Reader, fsType string) (string, error) {
+	mountpoints, err := mp.getMountpoints(reader, fsType)
+	if err != nil {
+		return "", err
+	}
+
+	return mountpoints[0], nil
+}
+
+// GetMountpoints retrieves all the mountpoints of a given filesystem type, in the order
+// in which they are listed.
+// It expects the input to be in the same format as the /proc/<pid>/mountinfo virtual
+// file. Bind mounts of a subdirectory of the filesystem are ignored, as only a
+// mount of the filesystem root exposes the whole filesystem.
+func (mp *procMountinfoMountsParser) getMountpoints(reader io.Reader, fsType string) ([]string, error) {
+	var mountpoints []string
+	scanner := bufio.NewScanner(reader)
+	for {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return nil, fmt.Errorf("scanning mountinfo for %s mountpoint: %w", fsType, err)
 			}
 
-			// Mountpoint successfully located
-			return mountpoint, nil
+			if len(mountpoints) == 0 {
+				// EOF reached but no mountpoint found
+				return nil, fmt.Errorf("%s not mounted", fsType)
+			}
+
+			return mountpoints, nil
+		}
+
+		mount := scanner.Bytes()
+		root, mountpoint, mountFSType, err := mp.parseMount(mount)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mount: %w", err)
+		}
+
+		if mountFSType == fsType && root == "/" {
+			mountpoints = append(mountpoints, mountpoint)
+		}
+	}
+}
+
+// ParseMount returns the root, mountpoint and filesystem type fields of a
+// mountinfo line, which is of the form:
+// `36 35 98:0 /root /mountpoint rw,noatime master:1 - fstype source rw,errors=continue`
+// The number of optional fields (`master:1` in the above) before the `-`
+// separator varies.
+func (mp *procMountinfoMountsParser) parseMount(mount []byte) (root, mountpoint, fsType string, err error) {
+	for i, name := range []string{"mount ID", "parent ID", "major:minor"} {
+		if err := mp.fieldParser.skipField(&mount, spaceBytes); err != nil {
+			return "", "", "", fmt.Errorf("skipping %s (field %d) from mount: %w", name, i, err)
+		}
+	}
+
+	rootField, err := mp.fieldParser.nextField(&mount, spaceBytes, true)
+	if err != nil {
+		return "", "", "", fmt.Errorf("getting root from mount: %w", err)
+	}
+
+	mountpointField, err := mp.fieldParser.nextField(&mount, spaceBytes, true)
+	if err != nil {
+		return "", "", "", fmt.Errorf("getting mountpoint from mount: %w", err)
+	}
+
+	// Skip the mount options and the optional fields, up to the separator
+	for {
+		field, err := mp.fieldParser.nextField(&mount, spaceBytes, true)
+		if err != nil {
+			return "", "", "", fmt.Errorf("finding optional fields separator in mount: %w", err)
+		}
+
+		if string(field) == "-" {
+			break
 		}
 	}
+
+	fsTypeField, err := mp.fieldParser.nextField(&mount, spaceBytes, true)
+	if err != nil {
+		return "", "", "", fmt.Errorf("getting filesystem type from mount: %w", err)
+	}
+
+	return unescapeMountField(string(rootField)), unescapeMountField(string(mountpointField)), string(fsTypeField), nil
+}
+
+// UnescapeMountField replaces the octal escape sequences (e.g. `\040` for
+// a space) which the kernel uses for whitespace and backslashes in paths.
+func unescapeMountField(field string) string {
+	if !strings.ContainsRune(field, '\\') {
+		return field
+	}
+
+	unescaped := new(strings.Builder)
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if b, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(field[i])
+	}
+
+	return unescaped.String()
 }
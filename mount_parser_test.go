@@ -23,18 +23,22 @@ func newMockFieldParser(nextFieldErrorToReturn error,
 	}
 }
 
-func (mfp *mockFieldParser) nextField(str *[]byte, sep []byte, expectMoreFields bool) (string, error) {
-	return "", mfp.nextFieldErrorToReturn
+func (mfp *mockFieldParser) nextField(str *[]byte, sep []byte, expectMoreFields bool) ([]byte, error) {
+	return nil, mfp.nextFieldErrorToReturn
 }
 
 func (mfp *mockFieldParser) skipField(str *[]byte, sep []byte) error {
 	return mfp.skipFieldErrorToReturn
 }
 
-func (mfp *mockFieldParser) getTaggedFields(str *[]byte) (map[string]string, error) {
+func (mfp *mockFieldParser) getTaggedFields(str *[]byte) (taggedFields, error) {
 	return nil, mfp.getTaggedFieldsErrorToReturn
 }
 
+func (mfp *mockFieldParser) fillTaggedFields(str *[]byte, fields *taggedFields) error {
+	return mfp.getTaggedFieldsErrorToReturn
+}
+
 type mockReader struct {
 	errorToReturn       error
 	waitBeforeReturning *sync.WaitGroup
@@ -134,3 +138,198 @@ func TestMountsParserNoMountpointError(t *testing.T) {
 
 	t.Logf("got error %q (of type %T)", err, err)
 }
+
+func TestMountinfoParser(t *testing.T) {
+	mockMountinfoFile := "22 26 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw\n" +
+		"30 23 0:12 / /sys/kernel/tracing rw,nosuid,nodev,noexec,relatime shared:8 - tracefs tracefs rw\n"
+
+	fieldParser := new(slicingFieldParser)
+	mountsParser := newProcMountinfoMountsParser(fieldParser)
+
+	mountpoint, err := mountsParser.getFirstMountpoint(strings.NewReader(mockMountinfoFile), "tracefs")
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mountpoint != "/sys/kernel/tracing" {
+		t.Errorf("expected mountpoint %s, got %s", "/sys/kernel/tracing", mountpoint)
+	}
+}
+
+func TestMountinfoParserMatchesFilesystemTypeNotDevice(t *testing.T) {
+	// In a container, tracefs may be mounted with an arbitrary device name,
+	// and another filesystem may be mounted with the device name "tracefs"
+	mockMountinfoFile := "100 90 0:50 / /tracefs rw - tmpfs tracefs rw\n" +
+		"101 90 0:12 / /host/tracing rw - tracefs none rw\n"
+
+	fieldParser := new(slicingFieldParser)
+	mountsParser := newProcMountinfoMountsParser(fieldParser)
+
+	mountpoint, err := mountsParser.getFirstMountpoint(strings.NewReader(mockMountinfoFile), "tracefs")
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mountpoint != "/host/tracing" {
+		t.Errorf("expected mountpoint %s, got %s", "/host/tracing", mountpoint)
+	}
+}
+
+func TestMountinfoParserSkipsSubdirectoryBindMounts(t *testing.T) {
+	mockMountinfoFile := "100 90 0:12 /instances/foo /foo rw master:8 - tracefs tracefs rw\n" +
+		"101 90 0:12 / /sys/kernel/debug/tracing rw master:8 - tracefs tracefs rw\n"
+
+	fieldParser := new(slicingFieldParser)
+	mountsParser := newProcMountinfoMountsParser(fieldParser)
+
+	mountpoint, err := mountsParser.getFirstMountpoint(strings.NewReader(mockMountinfoFile), "tracefs")
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mountpoint != "/sys/kernel/debug/tracing" {
+		t.Errorf("expected mountpoint %s, got %s", "/sys/kernel/debug/tracing", mountpoint)
+	}
+}
+
+func TestMountinfoParserUnescapesMountpoint(t *testing.T) {
+	mockMountinfoFile := "101 90 0:12 / /mnt/trace\\040fs rw - tracefs tracefs rw\n"
+
+	fieldParser := new(slicingFieldParser)
+	mountsParser := newProcMountinfoMountsParser(fieldParser)
+
+	mountpoint, err := mountsParser.getFirstMountpoint(strings.NewReader(mockMountinfoFile), "tracefs")
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if mountpoint != "/mnt/trace fs" {
+		t.Errorf("expected mountpoint %q, got %q", "/mnt/trace fs", mountpoint)
+	}
+}
+
+func TestMountinfoParserNoMatchingFilesystemError(t *testing.T) {
+	mockMountinfoFile := "22 26 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw\n"
+
+	fieldParser := new(slicingFieldParser)
+	mountsParser := newProcMountinfoMountsParser(fieldParser)
+
+	_, err := mountsParser.getFirstMountpoint(strings.NewReader(mockMountinfoFile), "tracefs")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestMountinfoParserNoSeparatorError(t *testing.T) {
+	mockMountinfoFile := "30 23 0:12 / /sys/kernel/tracing rw,nosuid shared:8 tracefs tracefs rw\n"
+
+	fieldParser := new(slicingFieldParser)
+	mountsParser := newProcMountinfoMountsParser(fieldParser)
+
+	_, err := mountsParser.getFirstMountpoint(strings.NewReader(mockMountinfoFile), "tracefs")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestMountinfoParserFieldParserError(t *testing.T) {
+	mockMountinfoFile := " "
+	mockError := errors.New("mock field parser error")
+	mockFieldParser := newMockFieldParser(mockError, nil, nil)
+	mountsParser := newProcMountinfoMountsParser(mockFieldParser)
+
+	_, err := mountsParser.getFirstMountpoint(strings.NewReader(mockMountinfoFile), "tracefs")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestMountinfoParserFieldParserSkipError(t *testing.T) {
+	mockMountinfoFile := " "
+	mockError := errors.New("mock field parser skip error")
+	mockFieldParser := newMockFieldParser(nil, mockError, nil)
+	mountsParser := newProcMountinfoMountsParser(mockFieldParser)
+
+	_, err := mountsParser.getFirstMountpoint(strings.NewReader(mockMountinfoFile), "tracefs")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestMountinfoParserReaderError(t *testing.T) {
+	mockFieldParser := newMockFieldParser(nil, nil, nil)
+	mockError := errors.New("mock reader error")
+	mockReader := newMockReader(mockError, nil)
+	mountsParser := newProcMountinfoMountsParser(mockFieldParser)
+
+	_, err := mountsParser.getFirstMountpoint(mockReader, "tracefs")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestMountsParserGetMountpoints(t *testing.T) {
+	mockProcMountsFile := "tracefs /sys/kernel/tracing tracefs rw,nosuid,nodev,noexec,relatime 0 0\n" +
+		"proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0\n" +
+		"tracefs /sys/kernel/debug/tracing tracefs rw,nosuid,nodev,noexec,relatime 0 0\n"
+
+	fieldParser := new(slicingFieldParser)
+	mountsParser := newProcMountsMountsParser(fieldParser)
+
+	mountpoints, err := mountsParser.getMountpoints(strings.NewReader(mockProcMountsFile), "tracefs")
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mountpoints) != 2 ||
+		mountpoints[0] != "/sys/kernel/tracing" ||
+		mountpoints[1] != "/sys/kernel/debug/tracing" {
+		t.Errorf("expected mountpoints %q, got %q",
+			[]string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"},
+			mountpoints)
+	}
+}
+
+func TestMountinfoParserGetMountpoints(t *testing.T) {
+	mockMountinfoFile := "30 23 0:12 / /sys/kernel/tracing rw shared:8 - tracefs tracefs rw\n" +
+		"22 26 0:21 / /proc rw shared:12 - proc proc rw\n" +
+		"40 35 0:12 / /sys/kernel/debug/tracing rw shared:8 - tracefs tracefs rw\n"
+
+	fieldParser := new(slicingFieldParser)
+	mountsParser := newProcMountinfoMountsParser(fieldParser)
+
+	mountpoints, err := mountsParser.getMountpoints(strings.NewReader(mockMountinfoFile), "tracefs")
+	if err != nil {
+		t.Errorf("expected nil error, got %v (of type %T)", err, err)
+	}
+
+	if len(mountpoints) != 2 ||
+		mountpoints[0] != "/sys/kernel/tracing" ||
+		mountpoints[1] != "/sys/kernel/debug/tracing" {
+		t.Errorf("expected mountpoints %q, got %q",
+			[]string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"},
+			mountpoints)
+	}
+}
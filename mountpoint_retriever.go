@@ -2,25 +2,35 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
+	"syscall"
 )
 
+const accessWriteOK = 0x2 // W_OK, as defined in unistd.h
+
 // MountpointRetriever is an interface which describes objects which retrieve the tracefs
 // mountpoint.
 type mountpointRetriever interface {
 	retrieveMountpoint() (string, error)
 }
 
-// ProcFSMountpointRetriever retrieves the tracefs mountpoint using the /proc/mounts
-// virtual file.
+// ProcFSMountpointRetriever retrieves the tracefs mountpoint using a procfs
+// mounts virtual file, such as /proc/self/mountinfo.
 type procFSMountpointRetriever struct {
-	mountsParser mountsParser
+	mountsParser      mountsParser
+	mountsPath        string
+	instancesWritable func(mountpoint string) bool
 
 	mountpoint string
 }
 
-func newProcFSMountpointRetriever(mountsParser mountsParser) *procFSMountpointRetriever {
-	return &procFSMountpointRetriever{mountsParser: mountsParser}
+func newProcFSMountpointRetriever(mountsParser mountsParser, mountsPath string) *procFSMountpointRetriever {
+	return &procFSMountpointRetriever{
+		mountsParser:      mountsParser,
+		mountsPath:        mountsPath,
+		instancesWritable: instancesWritable,
+	}
 }
 
 // RetrieveMountpoint retrieves the tracefs filesystem mountpoint.
@@ -38,16 +48,34 @@ func (mr *procFSMountpointRetriever) retrieveMountpoint() (string, error) {
 		dir.Close()
 	}
 
-	mounts, err := os.Open("/proc/mounts")
+	mounts, err := os.Open(mr.mountsPath)
 	if err != nil {
 		return "", fmt.Errorf("opening mounts: %w", err)
 	}
 	defer mounts.Close()
 
-	mountpoint, err := mr.mountsParser.getFirstMountpoint(mounts, "tracefs")
+	mountpoints, err := mr.mountsParser.getMountpoints(mounts, "tracefs")
 	if err != nil {
 		return "", fmt.Errorf("reading virtual device mounts: %w", err)
 	}
 
-	return mountpoint, nil
+	// Tracefs may be mounted multiple times (e.g. at both /sys/kernel/tracing
+	// and /sys/kernel/debug/tracing), not all of which may be usable, for
+	// example if mounted read-only
+	for _, mountpoint := range mountpoints {
+		if mr.instancesWritable(mountpoint) {
+			return mountpoint, nil
+		}
+	}
+
+	// Return the first mountpoint regardless, so that the reason it is unusable
+	// is reported when it is used
+	log.Printf("No tracefs mountpoint with writable instances found, using %s", mountpoints[0])
+	return mountpoints[0], nil
+}
+
+// InstancesWritable returns whether the instances directory of the tracefs
+// mounted at mountpoint is writable.
+func instancesWritable(mountpoint string) bool {
+	return syscall.Access(mountpoint+"/instances", accessWriteOK) == nil
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type mockMountsParser struct {
+	mountpointsToReturn []string
+	errorToReturn       error
+}
+
+func newMockMountsParser(mountpointsToReturn []string, errorToReturn error) *mockMountsParser {
+	return &mockMountsParser{
+		mountpointsToReturn: mountpointsToReturn,
+		errorToReturn:       errorToReturn,
+	}
+}
+
+func (mmp *mockMountsParser) getFirstMountpoint(reader io.Reader, fsType string) (string, error) {
+	if mmp.errorToReturn != nil {
+		return "", mmp.errorToReturn
+	}
+
+	return mmp.mountpointsToReturn[0], nil
+}
+
+func (mmp *mockMountsParser) getMountpoints(reader io.Reader, fsType string) ([]string, error) {
+	if mmp.errorToReturn != nil {
+		return nil, mmp.errorToReturn
+	}
+
+	return mmp.mountpointsToReturn, nil
+}
+
+func TestMountpointRetrieverPrefersWritableMountpoint(t *testing.T) {
+	mockMountsFile, undoFunc, err := bootstrapMockMountsFile()
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockMountsParser := newMockMountsParser([]string{"/read-only", "/writable", "/also-writable"}, nil)
+	mountpointRetriever := newProcFSMountpointRetriever(mockMountsParser, mockMountsFile)
+	mountpointRetriever.instancesWritable = func(mountpoint string) bool {
+		return mountpoint != "/read-only"
+	}
+
+	mountpoint, err := mountpointRetriever.retrieveMountpoint()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if mountpoint != "/writable" {
+		t.Errorf("expected mountpoint %q, got %q", "/writable", mountpoint)
+	}
+}
+
+func TestMountpointRetrieverNoWritableMountpoint(t *testing.T) {
+	mockMountsFile, undoFunc, err := bootstrapMockMountsFile()
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockMountsParser := newMockMountsParser([]string{"/read-only", "/also-read-only"}, nil)
+	mountpointRetriever := newProcFSMountpointRetriever(mockMountsParser, mockMountsFile)
+	mountpointRetriever.instancesWritable = func(mountpoint string) bool {
+		return false
+	}
+
+	mountpoint, err := mountpointRetriever.retrieveMountpoint()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if mountpoint != "/read-only" {
+		t.Errorf("expected mountpoint %q, got %q", "/read-only", mountpoint)
+	}
+}
+
+func TestMountpointRetrieverMountsParserError(t *testing.T) {
+	mockMountsFile, undoFunc, err := bootstrapMockMountsFile()
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockError := errors.New("mock mounts parser error")
+	mockMountsParser := newMockMountsParser(nil, mockError)
+	mountpointRetriever := newProcFSMountpointRetriever(mockMountsParser, mockMountsFile)
+
+	_, err = mountpointRetriever.retrieveMountpoint()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
+
+func TestMountpointRetrieverMountsFileError(t *testing.T) {
+	mockMountsParser := newMockMountsParser([]string{"/writable"}, nil)
+	mountpointRetriever := newProcFSMountpointRetriever(mockMountsParser, os.TempDir()+"/does-not-exist")
+
+	_, err := mountpointRetriever.retrieveMountpoint()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestInstancesWritable(t *testing.T) {
+	mockMountpoint, undoFunc, err := bootstrapMockTraceFS("", false)
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	if instancesWritable(mockMountpoint) {
+		t.Error("expected missing instances directory not to be writable, but was")
+	}
+
+	if err := os.Mkdir(mockMountpoint+"/instances", 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock instances directory: %v", err)
+	}
+
+	if !instancesWritable(mockMountpoint) {
+		t.Error("expected instances directory to be writable, but was not")
+	}
+}
+
+func bootstrapMockMountsFile() (string, func(), error) {
+	undoFunc := func() {}
+
+	mockMountsFile, err := ioutil.TempFile("", "tracefs-eventer-test-")
+	if err != nil {
+		return "", undoFunc, err
+	}
+	mockMountsFile.Close()
+
+	undoFunc = func() {
+		os.Remove(mockMountsFile.Name())
+	}
+
+	return mockMountsFile.Name(), undoFunc, nil
+}
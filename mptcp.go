@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// The parts of the sock_diag(7) netlink ABI needed to look up the MPTCP
+// connection of a TCP socket, which the kernel reports as the info of its
+// upper layer protocol (ULP) if it is an MPTCP subflow.
+const (
+	inetDiagULPInfo          = 19 // INET_DIAG_ULP_INFO
+	inetULPInfoName          = 1  // INET_ULP_INFO_NAME
+	inetULPInfoMPTCP         = 3  // INET_ULP_INFO_MPTCP
+	mptcpSubflowAttrTokenLoc = 2  // MPTCP_SUBFLOW_ATTR_TOKEN_LOC
+
+	// InetDiagNoCookie is the cookie of a lookup by 4-tuple alone.
+	inetDiagNoCookie = ^uint32(0)
+
+	ulpNameMPTCP = "mptcp"
+)
+
+// MPTCPMaxConnections is the most connections whose MPTCP tokens are
+// remembered, beyond which they are forgotten.
+const mptcpMaxConnections = 65536
+
+// MPTCPTokenLookup returns the local token of the MPTCP connection of which
+// the socket of the 4-tuple is a subflow, or zero if it is not a subflow.
+type mptcpTokenLookup func(local net.IP, localPort uint16, remote net.IP, remotePort uint16) (uint32, error)
+
+// MPTCPTagger tags the events of the subflows of MPTCP connections with the
+// local token of their connection, which all of its subflows share, as does
+// the MPTCP socket of the connection, whose 4-tuple is that of its first
+// subflow. The kernel's mptcp tracepoints do not identify the connection, so
+// the token of each socket is looked up when first seen, and remembered until
+// it closes, or, for a subflow, until the MPTCP socket of its 4-tuple, if any,
+// closes after it. Listening sockets are not looked up. A socket which cannot
+// be looked up, such as one already destroyed, has no token, and is looked up
+// again with its next event. It is only accessed by the reader of events, so
+// is not safe for concurrent use.
+type mptcpTagger struct {
+	lookup         mptcpTokenLookup
+	tokens         map[connectionKey]uint32 // Zero for sockets which are not subflows
+	closedSubflows map[connectionKey]uint32 // Of the MPTCP sockets which may close later
+}
+
+func newMPTCPTagger(lookup mptcpTokenLookup) *mptcpTagger {
+	return &mptcpTagger{
+		lookup:         lookup,
+		tokens:         make(map[connectionKey]uint32),
+		closedSubflows: make(map[connectionKey]uint32),
+	}
+}
+
+// Tag sets the MPTCP token of the event, if any. Markers of lost events have
+// none.
+func (t *mptcpTagger) tag(event *ContextEvent) {
+	if event.Kind == KindLostEvents ||
+		event.OldState == tcpstate.StateListen ||
+		event.NewState == tcpstate.StateListen {
+		return
+	}
+
+	key := newConnectionKey(event)
+	token, ok := t.tokens[key]
+	if !ok && event.MPTCP {
+		token, ok = t.closedSubflows[key]
+	}
+
+	if !ok {
+		var err error
+		if token, err = t.lookup(event.SourceIP, event.SourcePort, event.DestIP, event.DestPort); err == nil {
+			if len(t.tokens) >= mptcpMaxConnections {
+				t.tokens = make(map[connectionKey]uint32, len(t.tokens))
+			}
+			t.tokens[key] = token
+		}
+	}
+	event.MPTCPToken = token
+
+	closed := (event.Kind == KindStateChange && event.NewState == tcpstate.StateClosed) ||
+		event.Kind == KindDestroySock
+	switch {
+	case closed && event.MPTCP:
+		delete(t.tokens, key)
+		delete(t.closedSubflows, key)
+	case closed:
+		delete(t.tokens, key)
+		if token != 0 {
+			if len(t.closedSubflows) >= mptcpMaxConnections {
+				t.closedSubflows = make(map[connectionKey]uint32, len(t.closedSubflows))
+			}
+			t.closedSubflows[key] = token
+		}
+	case !event.MPTCP:
+		delete(t.closedSubflows, key) // The 4-tuple is reused
+	}
+}
+
+// MPTCPToken returns the local token of the MPTCP connection of which the
+// TCPv4 socket of the 4-tuple is a subflow, or zero if it is not a subflow.
+func (c *sockDiagConn) mptcpToken(local net.IP, localPort uint16, remote net.IP, remotePort uint16) (uint32, error) {
+	localIPv4, remoteIPv4 := local.To4(), remote.To4()
+	if localIPv4 == nil || remoteIPv4 == nil {
+		return 0, errors.New("not a TCPv4 socket")
+	}
+
+	c.seq++
+	if err := syscall.Sendto(c.fd,
+		newInetDiagLookupRequest(c.seq, localIPv4, localPort, remoteIPv4, remotePort),
+		0,
+		&syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return 0, os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return 0, os.NewSyscallError("recvfrom", err)
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return 0, fmt.Errorf("parsing netlink messages: %w", err)
+		}
+
+		for _, message := range messages {
+			if message.Header.Seq != c.seq {
+				continue // A response to an abandoned lookup
+			}
+
+			switch message.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(message.Data) < 4 {
+					return 0, fmt.Errorf("netlink error of %d bytes too short", len(message.Data))
+				}
+				errno := syscall.Errno(-int32(hostByteOrder.Uint32(message.Data)))
+				return 0, os.NewSyscallError("sock_diag", errno)
+			case sockDiagByFamily:
+				return decodeMPTCPToken(message.Data)
+			}
+		}
+	}
+}
+
+// NewInetDiagLookupRequest returns the netlink message requesting the TCPv4
+// socket of the 4-tuple.
+func newInetDiagLookupRequest(seq uint32,
+	local net.IP,
+	localPort uint16,
+	remote net.IP,
+	remotePort uint16) []byte {
+	request := make([]byte, syscall.NLMSG_HDRLEN+inetDiagReqV2Size)
+	hostByteOrder.PutUint32(request[0:], uint32(len(request)))
+	hostByteOrder.PutUint16(request[4:], sockDiagByFamily)
+	hostByteOrder.PutUint16(request[6:], syscall.NLM_F_REQUEST)
+	hostByteOrder.PutUint32(request[8:], seq)
+
+	// The struct inet_diag_req_v2, with the socket ID of the 4-tuple
+	body := request[syscall.NLMSG_HDRLEN:]
+	body[0] = syscall.AF_INET
+	body[1] = syscall.IPPROTO_TCP
+	hostByteOrder.PutUint32(body[4:], inetDiagAllStates)
+	binary.BigEndian.PutUint16(body[8:], localPort)
+	binary.BigEndian.PutUint16(body[10:], remotePort)
+	copy(body[12:], local)
+	copy(body[28:], remote)
+	hostByteOrder.PutUint32(body[48:], inetDiagNoCookie)
+	hostByteOrder.PutUint32(body[52:], inetDiagNoCookie)
+
+	return request
+}
+
+// DecodeMPTCPToken decodes the local token of the MPTCP connection from the
+// ULP info attribute following the struct inet_diag_msg of a socket, or
+// returns zero if the socket has no MPTCP ULP info.
+func decodeMPTCPToken(msg []byte) (uint32, error) {
+	if len(msg) < inetDiagMsgSize {
+		return 0, fmt.Errorf("inet_diag_msg of %d bytes too short", len(msg))
+	}
+
+	var name string
+	var token uint32
+	err := walkNetlinkAttrs(msg[inetDiagMsgSize:], func(attrType uint16, value []byte) error {
+		if attrType != inetDiagULPInfo {
+			return nil
+		}
+
+		return walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+			switch attrType {
+			case inetULPInfoName:
+				name = strings.TrimRight(string(value), "\x00")
+			case inetULPInfoMPTCP:
+				return walkNetlinkAttrs(value, func(attrType uint16, value []byte) error {
+					if attrType == mptcpSubflowAttrTokenLoc && len(value) == 4 {
+						token = hostByteOrder.Uint32(value)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("decoding sock_diag attributes: %w", err)
+	}
+
+	if name != ulpNameMPTCP {
+		return 0, nil
+	}
+
+	return token, nil
+}
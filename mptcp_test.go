@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func newMockInetDiagMsgWithULP(name string, token uint32) []byte {
+	tokenPayload := make([]byte, 4)
+	hostByteOrder.PutUint32(tokenPayload, token)
+
+	var subflow []byte
+	subflow = append(subflow, newMockNetlinkAttr(1, []byte{0xde, 0xad, 0xbe, 0xef})...) // Remote token
+	subflow = append(subflow, newMockNetlinkAttr(mptcpSubflowAttrTokenLoc, tokenPayload)...)
+
+	var ulpInfo []byte
+	ulpInfo = append(ulpInfo, newMockNetlinkAttr(inetULPInfoName, append([]byte(name), 0))...)
+	ulpInfo = append(ulpInfo, newMockNetlinkAttr(inetULPInfoMPTCP|0x8000, subflow)...)
+
+	msg := make([]byte, inetDiagMsgSize)
+	msg = append(msg, newMockNetlinkAttr(4, []byte("cubic\x00"))...) // INET_DIAG_CONG
+	msg = append(msg, newMockNetlinkAttr(inetDiagULPInfo|0x8000, ulpInfo)...)
+
+	return msg
+}
+
+func TestDecodeMPTCPToken(t *testing.T) {
+	token, err := decodeMPTCPToken(newMockInetDiagMsgWithULP("mptcp", 0x12345678))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if token != 0x12345678 {
+		t.Errorf("expected token %#x, got %#x", 0x12345678, token)
+	}
+}
+
+func TestDecodeMPTCPTokenNotSubflow(t *testing.T) {
+	for _, msg := range [][]byte{
+		make([]byte, inetDiagMsgSize),
+		newMockInetDiagMsgWithULP("tls", 0x12345678),
+	} {
+		token, err := decodeMPTCPToken(msg)
+		if err != nil {
+			t.Errorf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if token != 0 {
+			t.Errorf("expected no token, got %#x", token)
+		}
+	}
+}
+
+func TestDecodeMPTCPTokenError(t *testing.T) {
+	msg := append(make([]byte, inetDiagMsgSize), 0xff, 0x00, byte(inetDiagULPInfo), 0x00)
+	_, err := decodeMPTCPToken(msg)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestMPTCPTaggerTag(t *testing.T) {
+	lookups := 0
+	subflowsClosed := false
+	tagger := newMPTCPTagger(func(local net.IP, localPort uint16, remote net.IP, remotePort uint16) (uint32, error) {
+		lookups++
+		if subflowsClosed {
+			return 0, errors.New("mock socket not found")
+		}
+
+		if localPort == 44406 {
+			return 0x12345678, nil
+		}
+
+		return 0, nil
+	})
+
+	subflow := newMockTransition(time.Now(), nil, tcpstate.StateEstablished)
+	tagger.tag(subflow)
+	if subflow.MPTCPToken != 0x12345678 {
+		t.Errorf("expected token %#x, got %#x", 0x12345678, subflow.MPTCPToken)
+	}
+
+	other := newMockTransition(time.Now(), nil, tcpstate.StateEstablished)
+	other.SourcePort = 44408
+	tagger.tag(other)
+	if other.MPTCPToken != 0 {
+		t.Errorf("expected no token, got %#x", other.MPTCPToken)
+	}
+
+	// The MPTCP socket of the connection outlives its first subflow
+	closed := newMockTransition(time.Now(), nil, tcpstate.StateClosed)
+	tagger.tag(closed)
+	subflowsClosed = true
+
+	mptcpClosed := newMockTransition(time.Now(), nil, tcpstate.StateClosed)
+	mptcpClosed.MPTCP = true
+	tagger.tag(mptcpClosed)
+	if closed.MPTCPToken != 0x12345678 || mptcpClosed.MPTCPToken != 0x12345678 {
+		t.Errorf("expected closes tagged with token %#x, got %#x and %#x",
+			0x12345678,
+			closed.MPTCPToken,
+			mptcpClosed.MPTCPToken)
+	}
+
+	if lookups != 2 {
+		t.Errorf("expected 2 lookups, got %d", lookups)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// NetNSCacheLifetime is the lifetime of the cache of the network namespaces of
+// tasks, which bounds how long a namespace is used after its PID is reused.
+const netNSCacheLifetime = time.Second
+
+// NetNSTagger tags events with the network namespace of their task on CPU, by
+// the inode of its /proc/<pid>/ns/net, and, if filtering, passes only events
+// of the namespaces filtered. Events of the idle task, or of tasks which have
+// exited, are of no known namespace. It is only accessed by the reader of
+// events, so is not safe for concurrent use.
+type netNSTagger struct {
+	procPath string
+	filter   map[uint64]bool // Nil if namespaces are not filtered
+
+	namespaces        map[int]uint64 // The namespaces of tasks, by PID
+	namespacesExpired time.Time
+}
+
+// NewNetNSTagger returns a tagger of the namespaces of tasks in the proc
+// filesystem, filtering the namespaces, if any. Each is either the inode of a
+// namespace, or the path of a file of one, such as /run/netns/blue, whose
+// inode is resolved now.
+func newNetNSTagger(procPath string, filters []string) (*netNSTagger, error) {
+	tagger := &netNSTagger{procPath: procPath, namespaces: make(map[int]uint64)}
+	if len(filters) == 0 {
+		return tagger, nil
+	}
+
+	tagger.filter = make(map[uint64]bool, len(filters))
+	for _, filter := range filters {
+		inode, err := strconv.ParseUint(filter, 10, 64)
+		if err != nil {
+			if inode, err = netNSInode(filter); err != nil {
+				return nil, fmt.Errorf("resolving network namespace %s: %w", filter, err)
+			}
+		}
+		tagger.filter[inode] = true
+	}
+
+	return tagger, nil
+}
+
+// Tag sets the network namespace of the event, returning whether it passes
+// the filter, if any. Markers of lost events always pass.
+func (t *netNSTagger) tag(event *ContextEvent) bool {
+	if event.Kind == KindLostEvents {
+		return true
+	}
+
+	if event.PIDOnCPU != idlePID {
+		event.NetNS = t.namespace(event.PIDOnCPU)
+	}
+
+	return t.filter == nil || t.filter[event.NetNS]
+}
+
+// Namespace returns the inode of the network namespace of the task of the
+// PID, or zero if it is not known.
+func (t *netNSTagger) namespace(pid int) uint64 {
+	if now := time.Now(); now.After(t.namespacesExpired) {
+		t.namespaces = make(map[int]uint64, len(t.namespaces))
+		t.namespacesExpired = now.Add(netNSCacheLifetime)
+	}
+
+	if inode, ok := t.namespaces[pid]; ok {
+		return inode
+	}
+
+	inode, _ := netNSInode(t.procPath + "/" + strconv.Itoa(pid) + "/ns/net")
+	t.namespaces[pid] = inode
+
+	return inode
+}
+
+// NetNSInode returns the inode of the network namespace of the file, such as
+// /proc/<pid>/ns/net, or a bind mount of one.
+func netNSInode(path string) (uint64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("no inode of %s", path)
+	}
+
+	return stat.Ino, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// NewMockNetNSProc returns a mock proc filesystem in which the task of the PID
+// has a network namespace file, whose inode is returned.
+func newMockNetNSProc(t *testing.T, pid string) (string, uint64) {
+	procPath := t.TempDir()
+	nsPath := filepath.Join(procPath, pid, "ns")
+	if err := os.MkdirAll(nsPath, 0755); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock proc: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(nsPath, "net"), nil, 0644); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock proc: %v", err)
+	}
+
+	inode, err := netNSInode(filepath.Join(nsPath, "net"))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to stat mock namespace: %v", err)
+	}
+
+	return procPath, inode
+}
+
+func TestNetNSTaggerTag(t *testing.T) {
+	procPath, inode := newMockNetNSProc(t, "1234")
+	tagger, err := newNetNSTagger(procPath, nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	contextEvent := &ContextEvent{Event: &event.Event{PIDOnCPU: 1234}}
+	if !tagger.tag(contextEvent) {
+		t.Error("expected event to pass, but did not")
+	}
+
+	if contextEvent.NetNS != inode {
+		t.Errorf("expected network namespace %d, got %d", inode, contextEvent.NetNS)
+	}
+
+	// The namespace of a task which has exited is not known
+	contextEvent = &ContextEvent{Event: &event.Event{PIDOnCPU: 4321}}
+	if !tagger.tag(contextEvent) || contextEvent.NetNS != 0 {
+		t.Errorf("expected event to pass with no network namespace, got %d", contextEvent.NetNS)
+	}
+}
+
+func TestNetNSTaggerTagFiltered(t *testing.T) {
+	procPath, _ := newMockNetNSProc(t, "1234")
+	tagger, err := newNetNSTagger(procPath, []string{filepath.Join(procPath, "1234", "ns", "net")})
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	tests := []struct {
+		pid    int
+		kind   EventKind
+		passes bool
+	}{
+		{1234, KindStateChange, true},
+		{4321, KindStateChange, false},
+		{idlePID, KindStateChange, false},
+		{idlePID, KindLostEvents, true},
+	}
+
+	for _, test := range tests {
+		contextEvent := &ContextEvent{Event: &event.Event{PIDOnCPU: test.pid}, Kind: test.kind}
+		if passes := tagger.tag(contextEvent); passes != test.passes {
+			t.Errorf("expected event of PID %d to pass %t, got %t", test.pid, test.passes, passes)
+		}
+	}
+}
+
+func TestNewNetNSTaggerUnresolvableError(t *testing.T) {
+	_, err := newNetNSTagger(t.TempDir(), []string{"/run/netns/nonexistent"})
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Definitions from linux/openat2.h, which are not provided by the syscall
+// package. The openat2 syscall number is common to all architectures.
+const (
+	sysOpenat2        = 437
+	resolveNoSymlinks = 0x04 // Fail if any component of the path is a symlink
+	resolveBeneath    = 0x08 // Fail if the path escapes the directory
+
+	atRemoveDir = 0x200    // From linux/fcntl.h, to unlinkat a directory
+	oPath       = 0x200000 // From asm-generic/fcntl.h, to open a file only to stat it
+)
+
+// OpenHow is the struct open_how argument to openat2.
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+var (
+	openat2Unsupported     int32 // Accessed atomically, non-zero if openat2 is unavailable
+	openat2UnsupportedOnce = new(sync.Once)
+)
+
+// OpenBeneath opens the file at path, which must be within the root directory,
+// refusing to follow any symlinks on the way. As the tracefs tree is shared,
+// this prevents a symlink planted within it from redirecting a write elsewhere.
+// The file is always opened close-on-exec, so that it is not leaked to child
+// processes. If the kernel does not support openat2 (which was added in Linux
+// 5.6), the file is opened normally. Any other error, such as EPERM from a
+// seccomp policy or LSM, is returned, rather than the protection being given up.
+func openBeneath(root, path string, flag int, perm uint32) (*os.File, error) {
+	if atomic.LoadInt32(&openat2Unsupported) != 0 {
+		return os.OpenFile(path, flag, os.FileMode(perm))
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, &os.PathError{Op: "openat2", Path: path, Err: syscall.EXDEV}
+	}
+
+	rootDir, err := os.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	defer rootDir.Close()
+
+	how := &openHow{
+		flags:   uint64(flag | syscall.O_CLOEXEC),
+		resolve: resolveNoSymlinks | resolveBeneath,
+	}
+	if flag&os.O_CREATE != 0 {
+		how.mode = uint64(perm)
+	}
+
+	fd, err := openat2(int(rootDir.Fd()), rel, how)
+	if err != nil {
+		if err == syscall.ENOSYS {
+			openat2UnsupportedOnce.Do(func() {
+				log.Printf("WARNING: openat2 unavailable (%v): "+
+					"tracefs paths will be resolved without protection against symlinks",
+					err)
+			})
+			atomic.StoreInt32(&openat2Unsupported, 1)
+			return os.OpenFile(path, flag, os.FileMode(perm))
+		}
+
+		return nil, &os.PathError{Op: "openat2", Path: path, Err: err}
+	}
+
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// MkdirBeneath makes the directory at path, which must be within the root
+// directory, refusing to follow any symlinks to its parent.
+func mkdirBeneath(root, path string, perm uint32) error {
+	parent, err := openBeneath(root, filepath.Dir(path), os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	if err := syscall.Mkdirat(int(parent.Fd()), filepath.Base(path), perm); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// RmdirBeneath removes the directory at path, which must be within the root
+// directory, refusing to follow any symlinks to its parent.
+func rmdirBeneath(root, path string) error {
+	parent, err := openBeneath(root, filepath.Dir(path), os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	if err := unlinkat(int(parent.Fd()), filepath.Base(path), atRemoveDir); err != nil {
+		return &os.PathError{Op: "rmdir", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// LstatBeneath returns the status of the file at path, which must be within the
+// root directory, or be the root directory itself, refusing to follow any
+// symlinks, including the file itself.
+func lstatBeneath(root, path string) (*syscall.Stat_t, error) {
+	file, err := openBeneath(root, path, oPath|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat := new(syscall.Stat_t)
+	if err := syscall.Fstat(int(file.Fd()), stat); err != nil {
+		return nil, &os.PathError{Op: "fstat", Path: path, Err: err}
+	}
+
+	return stat, nil
+}
+
+// IsDirBeneath returns whether the file at path, which must be within the root
+// directory, is a directory, rather than a symlink to one.
+func isDirBeneath(root, path string) bool {
+	stat, err := lstatBeneath(root, path)
+	return err == nil && stat.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// ReadDirBeneath returns the names of the subdirectories of the directory at
+// path, which must be within the root directory, refusing to follow any
+// symlinks to it or among its entries.
+func readDirBeneath(root, path string) ([]string, error) {
+	dir, err := openBeneath(root, path, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	// Only the names are read, as Readdir would lstat each entry by its path
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	subdirs := make([]string, 0, len(names))
+	for _, name := range names {
+		fd, err := syscall.Openat(int(dir.Fd()), name, oPath|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			continue // Removed since listed
+		}
+
+		var stat syscall.Stat_t
+		err = syscall.Fstat(fd, &stat)
+		syscall.Close(fd)
+		if err == nil && stat.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			subdirs = append(subdirs, name)
+		}
+	}
+	sort.Strings(subdirs)
+
+	return subdirs, nil
+}
+
+func unlinkat(dirfd int, path string, flags int) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT,
+		uintptr(dirfd),
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(flags))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func openat2(dirfd int, path string, how *openHow) (int, error) {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+
+	for {
+		fd, _, errno := syscall.Syscall6(sysOpenat2,
+			uintptr(dirfd),
+			uintptr(unsafe.Pointer(pathPtr)),
+			uintptr(unsafe.Pointer(how)),
+			unsafe.Sizeof(*how),
+			0,
+			0)
+		if errno == syscall.EINTR {
+			continue
+		}
+
+		if errno != 0 {
+			return -1, errno
+		}
+
+		return int(fd), nil
+	}
+}
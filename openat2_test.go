@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+func skipIfOpenat2Unsupported(t *testing.T) {
+	if atomic.LoadInt32(&openat2Unsupported) != 0 {
+		t.Skip("openat2 not supported by kernel")
+	}
+}
+
+func TestOpenBeneath(t *testing.T) {
+	mockRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock root: %v", err)
+	}
+	defer os.RemoveAll(mockRoot)
+
+	if err := ioutil.WriteFile(mockRoot+"/mock-file", []byte("mock contents"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock file: %v", err)
+	}
+
+	file, err := openBeneath(mockRoot, mockRoot+"/mock-file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer file.Close()
+
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatalf("running test: unable to read file: %v", err)
+	}
+
+	if string(contents) != "mock contents" {
+		t.Errorf("expected contents %q, got %q", "mock contents", contents)
+	}
+}
+
+func TestOpenBeneathSymlinkError(t *testing.T) {
+	mockRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock root: %v", err)
+	}
+	defer os.RemoveAll(mockRoot)
+
+	mockTarget, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock symlink target: %v", err)
+	}
+	mockTarget.Close()
+	defer os.Remove(mockTarget.Name())
+
+	if err := os.Symlink(mockTarget.Name(), mockRoot+"/mock-file"); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock symlink: %v", err)
+	}
+
+	_, err = openBeneath(mockRoot, mockRoot+"/mock-file", os.O_WRONLY|os.O_APPEND, 0)
+	skipIfOpenat2Unsupported(t)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("expected error chain to include %q, but did not", syscall.ELOOP)
+	}
+}
+
+func TestOpenBeneathEscapeError(t *testing.T) {
+	mockRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock root: %v", err)
+	}
+	defer os.RemoveAll(mockRoot)
+
+	if err := os.Mkdir(mockRoot+"/mock-dir", 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock directory: %v", err)
+	}
+
+	_, err = openBeneath(mockRoot+"/mock-dir", mockRoot+"/mock-dir/../mock-file", os.O_RDONLY, 0)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestMkdirBeneath(t *testing.T) {
+	mockRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock root: %v", err)
+	}
+	defer os.RemoveAll(mockRoot)
+
+	if err := os.Mkdir(mockRoot+"/instances", 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock instances directory: %v", err)
+	}
+
+	if err := mkdirBeneath(mockRoot, mockRoot+"/instances/mock-instance", 0700); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !isDirBeneath(mockRoot, mockRoot+"/instances/mock-instance") {
+		t.Error("expected directory to be made, but was not")
+	}
+
+	err = mkdirBeneath(mockRoot, mockRoot+"/instances/mock-instance", 0700)
+	if !os.IsExist(err) {
+		t.Errorf("expected exists error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestMkdirBeneathSymlinkedParentError(t *testing.T) {
+	mockRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock root: %v", err)
+	}
+	defer os.RemoveAll(mockRoot)
+
+	mockTarget, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock symlink target: %v", err)
+	}
+	defer os.RemoveAll(mockTarget)
+
+	if err := os.Symlink(mockTarget, mockRoot+"/instances"); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock symlink: %v", err)
+	}
+
+	err = mkdirBeneath(mockRoot, mockRoot+"/instances/mock-instance", 0700)
+	skipIfOpenat2Unsupported(t)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if _, err := os.Stat(mockTarget + "/mock-instance"); err == nil {
+		t.Error("expected directory not to be made via symlink, but was")
+	}
+}
+
+func TestRmdirBeneath(t *testing.T) {
+	mockRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock root: %v", err)
+	}
+	defer os.RemoveAll(mockRoot)
+
+	if err := os.MkdirAll(mockRoot+"/instances/mock-instance", 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock instance directory: %v", err)
+	}
+
+	if err := rmdirBeneath(mockRoot, mockRoot+"/instances/mock-instance"); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if _, err := lstatBeneath(mockRoot, mockRoot+"/instances/mock-instance"); !os.IsNotExist(err) {
+		t.Errorf("expected not exists error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestRmdirBeneathSymlinkedParentError(t *testing.T) {
+	mockRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock root: %v", err)
+	}
+	defer os.RemoveAll(mockRoot)
+
+	mockTarget, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock symlink target: %v", err)
+	}
+	defer os.RemoveAll(mockTarget)
+
+	if err := os.Mkdir(mockTarget+"/mock-instance", 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock target directory: %v", err)
+	}
+
+	if err := os.Symlink(mockTarget, mockRoot+"/instances"); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock symlink: %v", err)
+	}
+
+	err = rmdirBeneath(mockRoot, mockRoot+"/instances/mock-instance")
+	skipIfOpenat2Unsupported(t)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if _, err := os.Stat(mockTarget + "/mock-instance"); err != nil {
+		t.Error("expected directory not to be removed via symlink, but was")
+	}
+}
+
+func TestIsDirBeneathSymlink(t *testing.T) {
+	mockRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock root: %v", err)
+	}
+	defer os.RemoveAll(mockRoot)
+
+	if err := os.Mkdir(mockRoot+"/mock-dir", 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock directory: %v", err)
+	}
+
+	if err := os.Symlink(mockRoot+"/mock-dir", mockRoot+"/mock-symlink"); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock symlink: %v", err)
+	}
+
+	if !isDirBeneath(mockRoot, mockRoot) || !isDirBeneath(mockRoot, mockRoot+"/mock-dir") {
+		t.Error("expected root and mock directory to be directories, but were not")
+	}
+
+	if isDirBeneath(mockRoot, mockRoot+"/mock-symlink") {
+		t.Error("expected symlink to a directory not to be a directory, but was")
+	}
+}
+
+func TestReadDirBeneath(t *testing.T) {
+	mockRoot, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock root: %v", err)
+	}
+	defer os.RemoveAll(mockRoot)
+
+	for _, dir := range []string{"/per_cpu/cpu1", "/per_cpu/cpu0", "/elsewhere"} {
+		if err := os.MkdirAll(mockRoot+dir, 0700); err != nil {
+			t.Fatalf("test bootstrapping: unable to create mock directory: %v", err)
+		}
+	}
+
+	if err := ioutil.WriteFile(mockRoot+"/per_cpu/mock-file", nil, 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock file: %v", err)
+	}
+
+	if err := os.Symlink(mockRoot+"/elsewhere", mockRoot+"/per_cpu/cpu2"); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock symlink: %v", err)
+	}
+
+	subdirs, err := readDirBeneath(mockRoot, mockRoot+"/per_cpu")
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(subdirs) != 2 || subdirs[0] != "cpu0" || subdirs[1] != "cpu1" {
+		t.Errorf("expected subdirectories [cpu0 cpu1], got %v", subdirs)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// The parts of the ABI of AF_PACKET sockets, and of the IPv4 and TCP headers,
+// needed to capture the headers of TCPv4 segments.
+const (
+	// Outgoing packets are passed only to sockets of all protocols.
+	ethPAll = 0x0003
+	ethPIP  = 0x0800
+
+	skfAdProtocol = -0x1000 // The BPF ancillary load of the protocol of a packet
+
+	// The types of packet of a link-layer address, by their direction.
+	packetHost     = 0 // Addressed to the host
+	packetOutgoing = 4 // Sent by the host
+
+	// PacketSnapLength is the most of each packet captured, which covers the
+	// longest IPv4 header, and the TCP header up to its flags.
+	packetSnapLength = 60 + 14
+
+	ipv4MinHeaderLength = 20
+	tcpMinHeaderLength  = 14 // Up to and including the flags
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// PacketTCPFilter is a classic BPF program which accepts only unfragmented
+// TCPv4 segments, or the first fragments of them, truncated to the snap
+// length. Packets of an AF_PACKET socket of type SOCK_DGRAM begin at the
+// network header.
+var packetTCPFilter = []syscall.SockFilter{
+	*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_ABS, skfAdProtocol),              // Load the protocol of the packet
+	*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, ethPIP, 0, 5),              // If not IPv4, drop
+	*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_B|syscall.BPF_ABS, 9),                          // Load the protocol of the datagram
+	*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, syscall.IPPROTO_TCP, 0, 3), // If not TCP, drop
+	*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_ABS, 6),                          // Load the fragment offset
+	*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JSET|syscall.BPF_K, 0x1fff, 1, 0),             // If a later fragment, drop
+	*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, packetSnapLength),
+	*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 0),
+}
+
+// TCPSegment is the headers of a TCPv4 segment sent or received by the host,
+// from the perspective of the local end of its connection.
+type tcpSegment struct {
+	outgoing   bool
+	local      [4]byte
+	remote     [4]byte
+	localPort  uint16
+	remotePort uint16
+	flags      uint8
+	seq, ack   uint32
+	payloadLen uint32 // The length of the segment's data, excluding its headers
+}
+
+// PacketConn is an AF_PACKET socket capturing the headers of the TCPv4
+// segments sent and received by the host.
+type packetConn struct {
+	fd int
+}
+
+// NewPacketConn opens a socket capturing the TCPv4 segments of the interface,
+// or of all interfaces if empty, with a receive buffer of the size in bytes,
+// or the default if zero. Requires CAP_NET_RAW.
+func newPacketConn(iface string, rcvbuf int) (*packetConn, error) {
+	protocol := htons(ethPAll)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, int(protocol))
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := syscall.AttachLsf(fd, packetTCPFilter); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	if rcvbuf > 0 {
+		// Beyond rmem_max only if privileged
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, rcvbuf); err != nil {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf); err != nil {
+				syscall.Close(fd)
+				return nil, os.NewSyscallError("setsockopt", err)
+			}
+		}
+	}
+
+	if iface != "" {
+		netInterface, err := net.InterfaceByName(iface)
+		if err != nil {
+			syscall.Close(fd)
+			return nil, fmt.Errorf("looking up interface: %w", err)
+		}
+
+		if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: protocol, Ifindex: netInterface.Index}); err != nil {
+			syscall.Close(fd)
+			return nil, os.NewSyscallError("bind", err)
+		}
+	}
+
+	return &packetConn{fd: fd}, nil
+}
+
+// SetReceiveTimeout sets the longest a receive blocks.
+func (c *packetConn) setReceiveTimeout(timeout int64) error {
+	tv := syscall.NsecToTimeval(timeout)
+	if err := syscall.SetsockoptTimeval(c.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+
+	return nil
+}
+
+// Receive reads the next captured packet into buf, returning its length, and
+// the type of packet of its link-layer address.
+func (c *packetConn) receive(buf []byte) (int, uint8, error) {
+	n, from, err := syscall.Recvfrom(c.fd, buf, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	linkLayer, ok := from.(*syscall.SockaddrLinklayer)
+	if !ok {
+		return 0, 0, errors.New("packet not from a link-layer address")
+	}
+
+	return n, linkLayer.Pkttype, nil
+}
+
+func (c *packetConn) close() error {
+	if err := syscall.Close(c.fd); err != nil {
+		return os.NewSyscallError("close", err)
+	}
+
+	return nil
+}
+
+// DecodeTCPSegment decodes the headers of a captured TCPv4 segment of the
+// type of packet. Packets neither sent by nor addressed to the host, such as
+// broadcasts, are not decoded, and ok is false.
+func decodeTCPSegment(packet []byte, packetType uint8) (segment *tcpSegment, ok bool, err error) {
+	if packetType != packetHost && packetType != packetOutgoing {
+		return nil, false, nil
+	}
+
+	if len(packet) < ipv4MinHeaderLength || packet[0]>>4 != 4 {
+		return nil, false, errors.New("not an IPv4 packet")
+	}
+
+	if packet[9] != syscall.IPPROTO_TCP {
+		return nil, false, nil
+	}
+
+	ipHeaderLen := int(packet[0]&0x0f) * 4
+	if ipHeaderLen < ipv4MinHeaderLength || len(packet) < ipHeaderLen+tcpMinHeaderLength {
+		return nil, false, fmt.Errorf("truncated TCP segment of %d bytes", len(packet))
+	}
+
+	tcp := packet[ipHeaderLen:]
+	tcpHeaderLen := int(tcp[12]>>4) * 4
+	totalLen := int(binary.BigEndian.Uint16(packet[2:]))
+	payloadLen := totalLen - ipHeaderLen - tcpHeaderLen
+	if payloadLen < 0 {
+		payloadLen = 0
+	}
+
+	segment = &tcpSegment{
+		outgoing:   packetType == packetOutgoing,
+		flags:      tcp[13],
+		seq:        binary.BigEndian.Uint32(tcp[4:]),
+		ack:        binary.BigEndian.Uint32(tcp[8:]),
+		payloadLen: uint32(payloadLen),
+	}
+
+	var src, dst [4]byte
+	copy(src[:], packet[12:16])
+	copy(dst[:], packet[16:20])
+	sport, dport := binary.BigEndian.Uint16(tcp[0:]), binary.BigEndian.Uint16(tcp[2:])
+	if segment.outgoing {
+		segment.local, segment.localPort, segment.remote, segment.remotePort = src, sport, dst, dport
+	} else {
+		segment.local, segment.localPort, segment.remote, segment.remotePort = dst, dport, src, sport
+	}
+
+	return segment, true, nil
+}
+
+// Htons converts a 16-bit value from host to network byte order.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return hostByteOrder.Uint16(b[:])
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The TCP states through which the packet backend infers connections pass,
+// other than those of sock_diag.go.
+const (
+	tcpStateEstablished = 1
+	tcpStateSynSent     = 2
+	tcpStateSynRecv     = 3
+	tcpStateFinWait1    = 4
+	tcpStateFinWait2    = 5
+	tcpStateTimeWait    = 6
+	tcpStateCloseWait   = 8
+	tcpStateLastAck     = 9
+	tcpStateClosing     = 11
+)
+
+const (
+	// PacketTimeWaitLength is the time for which a connection is held in
+	// TIME_WAIT before it is closed, as TCP_TIMEWAIT_LEN of Linux.
+	packetTimeWaitLength = 60 * time.Second
+
+	// PacketHandshakeTimeout is the time after which a connection whose
+	// handshake is incomplete is given up, as after the SYN retries of Linux.
+	packetHandshakeTimeout = 2 * time.Minute
+
+	// PacketSweepInterval is the interval at which connections are checked for
+	// expiry.
+	packetSweepInterval = time.Second
+
+	// PacketInferredComm is the command of the events of the packet backend,
+	// so that they are labelled as inferred even through Event().
+	packetInferredComm = "<inferred>"
+)
+
+// PacketSource infers the state changes of TCPv4 connections from the SYN,
+// FIN, RST and ACK flags of the segments sent and received by the host,
+// captured with an AF_PACKET socket. It needs no kernel tracing at all, so is a
+// last resort where none is permitted, but its state changes are those of a
+// model of TCP, rather than of the kernel, so may be wrong: for example,
+// connections whose handshake was not captured are not tracked, and segments
+// dropped after capture are taken as delivered.
+type packetSource struct {
+	read     uint64 // Accessed atomically, the number of state changes inferred
+	closed   int32  // Accessed atomically, non-zero once closed
+	deadline sourceDeadline
+
+	config *config
+
+	conn        *packetConn
+	receiveLock *sync.Mutex // Serialises receives with the closing of the capture
+	tracker     *packetTracker
+	buf         []byte          // The packet received
+	pending     []*ContextEvent // The state changes inferred not yet read
+
+	osReleasePath string
+}
+
+func newPacketSource(config *config) *packetSource {
+	return &packetSource{
+		config:        config,
+		receiveLock:   new(sync.Mutex),
+		tracker:       newPacketTracker(),
+		osReleasePath: osReleasePath,
+	}
+}
+
+// Open opens the capture, of the packet interface, if configured, with a
+// receive buffer of the buffer size, if configured.
+func (ps *packetSource) open() error {
+	conn, err := newPacketConn(ps.config.packetInterface, int(ps.config.bufferSizeKB*1024))
+	if err != nil {
+		return fmt.Errorf("opening packet capture: %w", err)
+	}
+
+	if err := conn.setReceiveTimeout(int64(perfPollInterval)); err != nil {
+		conn.close()
+		return fmt.Errorf("setting packet capture receive timeout: %w", err)
+	}
+	ps.conn = conn
+	ps.buf = make([]byte, packetSnapLength)
+
+	return nil
+}
+
+// Event returns the next state change, receiving segments until one is
+// inferred. A receive blocks for at most perfPollInterval, so that closure,
+// deadlines and expiry are noticed.
+func (ps *packetSource) event() (*ContextEvent, error) {
+	for len(ps.pending) == 0 {
+		if atomic.LoadInt32(&ps.closed) != 0 {
+			return nil, os.ErrClosed
+		}
+
+		if _, err := ps.deadline.wait(perfPollInterval); err != nil {
+			return nil, err
+		}
+
+		if err := ps.infer(ps.tracker.expire(time.Now())); err != nil {
+			return nil, err
+		}
+
+		n, packetType, err := ps.receive()
+		switch err {
+		case nil:
+		case syscall.EAGAIN, syscall.EINTR:
+			continue
+		case os.ErrClosed:
+			return nil, err
+		default:
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+
+		segment, ok, err := decodeTCPSegment(ps.buf[:n], packetType)
+		if err != nil || !ok {
+			continue // Not a segment of the host, or mangled
+		}
+
+		if err := ps.infer(ps.tracker.track(segment, time.Now())); err != nil {
+			return nil, err
+		}
+	}
+
+	event := ps.pending[0]
+	ps.pending = ps.pending[1:]
+
+	return event, nil
+}
+
+// Receive receives a packet, unless the capture has been closed.
+func (ps *packetSource) receive() (int, uint8, error) {
+	ps.receiveLock.Lock()
+	defer ps.receiveLock.Unlock()
+	if ps.conn == nil {
+		return 0, 0, os.ErrClosed
+	}
+
+	return ps.conn.receive(ps.buf)
+}
+
+// Infer queues the events of the state changes, labelled as inferred, both by
+// their command, so that they are distinguished even through Event(), and
+// explicitly.
+func (ps *packetSource) infer(transitions []*sockDiagTransition) error {
+	owner := &sockDiagOwner{comm: packetInferredComm, pid: idlePID}
+	for _, transition := range transitions {
+		event, err := newTransitionEvent(transition, owner, bestEffortParsing(ps.config))
+		if err != nil {
+			return err
+		}
+		event.Inferred = true
+		ps.pending = append(ps.pending, event)
+		atomic.AddUint64(&ps.read, 1)
+	}
+
+	return nil
+}
+
+func (ps *packetSource) setReadDeadline(t time.Time) error {
+	ps.deadline.set(t)
+	return nil
+}
+
+func (ps *packetSource) kernelInfo() (*KernelInfo, error) {
+	return releaseKernelInfo(ps.osReleasePath)
+}
+
+// BufferStats returns the number of state changes inferred as the events read.
+func (ps *packetSource) bufferStats() (*BufferStats, error) {
+	return &BufferStats{ReadEvents: atomic.LoadUint64(&ps.read)}, nil
+}
+
+// Close stops receiving, and closes the capture, if it was opened, once any
+// receive in progress is done.
+func (ps *packetSource) close() error {
+	log.Printf("Closing packet capture")
+	atomic.StoreInt32(&ps.closed, 1)
+
+	ps.receiveLock.Lock()
+	defer ps.receiveLock.Unlock()
+	if ps.conn == nil {
+		return nil
+	}
+
+	err := ps.conn.close()
+	ps.conn = nil
+	if err != nil {
+		return fmt.Errorf("closing packet capture: %w", err)
+	}
+
+	return nil
+}
+
+// PacketConnection is the state of a connection inferred from its segments.
+type packetConnection struct {
+	state    uint8
+	finSent  bool
+	finAcked uint32    // The acknowledgment number which acknowledges the FIN sent
+	lastSeen time.Time // The time of the last segment, or of entering TIME_WAIT
+}
+
+// PacketTracker infers the state changes of connections from their segments,
+// by their local and remote addresses and ports. Only connections whose
+// handshake is captured are tracked. It is only accessed by its source, so is
+// not safe for concurrent use.
+type packetTracker struct {
+	connections map[sockDiagKey]*packetConnection
+	lastSwept   time.Time
+}
+
+func newPacketTracker() *packetTracker {
+	return &packetTracker{connections: make(map[sockDiagKey]*packetConnection)}
+}
+
+// Track returns the state changes inferred from the segment, received at the
+// time, in the order in which they were made.
+func (t *packetTracker) track(segment *tcpSegment, now time.Time) []*sockDiagTransition {
+	key := sockDiagKey{
+		saddr: segment.local,
+		daddr: segment.remote,
+		sport: segment.localPort,
+		dport: segment.remotePort,
+	}
+	socket := &inetDiagSocket{saddr: key.saddr, daddr: key.daddr, sport: key.sport, dport: key.dport}
+	syn, ack := segment.flags&tcpFlagSYN != 0, segment.flags&tcpFlagACK != 0
+	fin, rst := segment.flags&tcpFlagFIN != 0, segment.flags&tcpFlagRST != 0
+
+	var transitions []*sockDiagTransition
+	changeState := func(conn *packetConnection, newState uint8) {
+		// Connections accepted are reported only once established, as for the
+		// sockets of the kernel
+		if conn.state != tcpStateSynRecv || newState != tcpStateClose {
+			transitions = append(transitions, &sockDiagTransition{socket, conn.state, newState})
+		}
+		conn.state = newState
+	}
+
+	conn, known := t.connections[key]
+	if known {
+		conn.lastSeen = now
+	}
+
+	switch {
+	case rst:
+		if known {
+			changeState(conn, tcpStateClose)
+			delete(t.connections, key)
+		}
+	case syn && !ack:
+		newState := uint8(tcpStateSynRecv)
+		if segment.outgoing {
+			newState = tcpStateSynSent
+		}
+
+		if known && conn.state == newState {
+			break // Retransmitted
+		}
+
+		// The 4-tuple is reused, as from TIME_WAIT
+		if known {
+			changeState(conn, tcpStateClose)
+		}
+
+		conn = &packetConnection{state: tcpStateClose, lastSeen: now}
+		t.connections[key] = conn
+		if segment.outgoing {
+			changeState(conn, tcpStateSynSent)
+		} else {
+			conn.state = tcpStateSynRecv
+		}
+	case syn && ack:
+		if known && !segment.outgoing && conn.state == tcpStateSynSent {
+			changeState(conn, tcpStateEstablished)
+		}
+	case known && segment.outgoing:
+		if !fin || conn.finSent {
+			break
+		}
+
+		conn.finSent = true
+		conn.finAcked = segment.seq + segment.payloadLen + 1 // The FIN takes a sequence number
+		switch conn.state {
+		case tcpStateEstablished:
+			changeState(conn, tcpStateFinWait1)
+		case tcpStateCloseWait:
+			changeState(conn, tcpStateLastAck)
+		}
+	case known:
+		finAcked := ack && conn.finSent && int32(segment.ack-conn.finAcked) >= 0
+		switch {
+		case ack && conn.state == tcpStateSynRecv:
+			changeState(conn, tcpStateEstablished)
+		case finAcked && conn.state == tcpStateFinWait1:
+			changeState(conn, tcpStateFinWait2)
+		case finAcked && conn.state == tcpStateClosing:
+			changeState(conn, tcpStateTimeWait)
+		case finAcked && conn.state == tcpStateLastAck:
+			changeState(conn, tcpStateClose)
+			delete(t.connections, key)
+		}
+
+		if !fin {
+			break
+		}
+
+		switch conn.state {
+		case tcpStateEstablished:
+			changeState(conn, tcpStateCloseWait)
+		case tcpStateFinWait1:
+			changeState(conn, tcpStateClosing)
+		case tcpStateFinWait2:
+			changeState(conn, tcpStateTimeWait)
+		}
+	}
+
+	return transitions
+}
+
+// Expire closes the connections which have been in TIME_WAIT for its length,
+// and gives up those whose handshakes timed out, at most once per sweep
+// interval, returning the state changes.
+func (t *packetTracker) expire(now time.Time) []*sockDiagTransition {
+	if now.Sub(t.lastSwept) < packetSweepInterval {
+		return nil
+	}
+	t.lastSwept = now
+
+	var transitions []*sockDiagTransition
+	for key, conn := range t.connections {
+		idle := now.Sub(conn.lastSeen)
+		switch {
+		case conn.state == tcpStateTimeWait && idle >= packetTimeWaitLength,
+			conn.state == tcpStateSynSent && idle >= packetHandshakeTimeout:
+			socket := &inetDiagSocket{saddr: key.saddr, daddr: key.daddr, sport: key.sport, dport: key.dport}
+			transitions = append(transitions, &sockDiagTransition{socket, conn.state, tcpStateClose})
+		case conn.state == tcpStateSynRecv && idle >= packetHandshakeTimeout:
+		default:
+			continue
+		}
+
+		delete(t.connections, key)
+	}
+
+	return transitions
+}
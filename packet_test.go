@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// NewMockTCPPacket returns an IPv4 packet of a TCP segment with the flags and
+// numbers, and payload length, with no options.
+func newMockTCPPacket(src, dst [4]byte, sport, dport uint16, flags uint8, seq, ack uint32, payloadLen int) []byte {
+	packet := make([]byte, ipv4MinHeaderLength+20+payloadLen)
+	packet[0] = 4<<4 | ipv4MinHeaderLength/4
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[9] = syscall.IPPROTO_TCP
+	copy(packet[12:], src[:])
+	copy(packet[16:], dst[:])
+
+	tcp := packet[ipv4MinHeaderLength:]
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+
+	return packet
+}
+
+var (
+	mockPacketLocal  = [4]byte{192, 168, 122, 38}
+	mockPacketRemote = [4]byte{172, 217, 169, 4}
+)
+
+func TestDecodeTCPSegment(t *testing.T) {
+	packet := newMockTCPPacket(mockPacketRemote, mockPacketLocal, 80, 44406, tcpFlagFIN|tcpFlagACK, 100, 200, 10)
+
+	segment, ok, err := decodeTCPSegment(packet, packetHost)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !ok {
+		t.Fatal("expected segment to be decoded, but was not")
+	}
+
+	if segment.outgoing || segment.local != mockPacketLocal || segment.localPort != 44406 ||
+		segment.remote != mockPacketRemote || segment.remotePort != 80 {
+		t.Errorf("expected incoming segment of 192.168.122.38:44406 from 172.217.169.4:80, got %+v", segment)
+	}
+
+	if segment.flags != tcpFlagFIN|tcpFlagACK || segment.seq != 100 || segment.ack != 200 || segment.payloadLen != 10 {
+		t.Errorf("expected FIN-ACK of seq 100, ack 200 and 10 bytes, got %+v", segment)
+	}
+}
+
+func TestDecodeTCPSegmentOtherHost(t *testing.T) {
+	const packetOtherHost = 3
+	packet := newMockTCPPacket(mockPacketRemote, mockPacketLocal, 80, 44406, tcpFlagSYN, 0, 0, 0)
+
+	if _, ok, err := decodeTCPSegment(packet, packetOtherHost); ok || err != nil {
+		t.Errorf("expected segment of other host to be skipped, got %t and %v", ok, err)
+	}
+}
+
+func TestDecodeTCPSegmentTruncatedError(t *testing.T) {
+	packet := newMockTCPPacket(mockPacketRemote, mockPacketLocal, 80, 44406, tcpFlagSYN, 0, 0, 0)
+
+	_, _, err := decodeTCPSegment(packet[:ipv4MinHeaderLength+8], packetHost)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+// MockSegmentStep is a segment of a connection, from the local end, and the
+// state changes expected to be inferred from it.
+type mockSegmentStep struct {
+	outgoing    bool
+	flags       uint8
+	seq, ack    uint32
+	transitions [][2]uint8
+}
+
+func trackMockSegments(t *testing.T, tracker *packetTracker, now time.Time, steps []mockSegmentStep) {
+	for i, step := range steps {
+		segment := &tcpSegment{
+			outgoing:   step.outgoing,
+			local:      mockPacketLocal,
+			remote:     mockPacketRemote,
+			localPort:  44406,
+			remotePort: 80,
+			flags:      step.flags,
+			seq:        step.seq,
+			ack:        step.ack,
+		}
+
+		transitions := tracker.track(segment, now)
+		if len(transitions) != len(step.transitions) {
+			t.Fatalf("expected %d state changes of segment %d, got %d", len(step.transitions), i, len(transitions))
+		}
+
+		for j, transition := range transitions {
+			if transition.oldState != step.transitions[j][0] || transition.newState != step.transitions[j][1] {
+				t.Errorf("expected state change of segment %d from %d to %d, got from %d to %d",
+					i,
+					step.transitions[j][0],
+					step.transitions[j][1],
+					transition.oldState,
+					transition.newState)
+			}
+		}
+	}
+}
+
+func TestPacketTrackerActiveOpenAndClose(t *testing.T) {
+	tracker := newPacketTracker()
+	now := time.Now()
+
+	trackMockSegments(t, tracker, now, []mockSegmentStep{
+		{true, tcpFlagSYN, 1000, 0, [][2]uint8{{tcpStateClose, tcpStateSynSent}}},
+		{true, tcpFlagSYN, 1000, 0, nil}, // Retransmitted
+		{false, tcpFlagSYN | tcpFlagACK, 5000, 1001, [][2]uint8{{tcpStateSynSent, tcpStateEstablished}}},
+		{true, tcpFlagACK, 1001, 5001, nil},
+		{true, tcpFlagFIN | tcpFlagACK, 1001, 5001, [][2]uint8{{tcpStateEstablished, tcpStateFinWait1}}},
+		{false, tcpFlagACK, 5001, 1001, nil}, // Not of the FIN
+		{false, tcpFlagACK, 5001, 1002, [][2]uint8{{tcpStateFinWait1, tcpStateFinWait2}}},
+		{false, tcpFlagFIN | tcpFlagACK, 5001, 1002, [][2]uint8{{tcpStateFinWait2, tcpStateTimeWait}}},
+	})
+
+	if transitions := tracker.expire(now.Add(packetTimeWaitLength)); len(transitions) != 1 ||
+		transitions[0].oldState != tcpStateTimeWait || transitions[0].newState != tcpStateClose {
+		t.Errorf("expected TIME_WAIT to expire to CLOSE, got %+v", transitions)
+	}
+
+	if len(tracker.connections) != 0 {
+		t.Errorf("expected no connections once closed, got %d", len(tracker.connections))
+	}
+}
+
+func TestPacketTrackerPassiveOpenAndClose(t *testing.T) {
+	tracker := newPacketTracker()
+
+	trackMockSegments(t, tracker, time.Now(), []mockSegmentStep{
+		{false, tcpFlagSYN, 5000, 0, nil},
+		{true, tcpFlagSYN | tcpFlagACK, 1000, 5001, nil},
+		{false, tcpFlagACK, 5001, 1001, [][2]uint8{{tcpStateSynRecv, tcpStateEstablished}}},
+		{false, tcpFlagFIN | tcpFlagACK, 5001, 1001, [][2]uint8{{tcpStateEstablished, tcpStateCloseWait}}},
+		{true, tcpFlagFIN | tcpFlagACK, 1001, 5002, [][2]uint8{{tcpStateCloseWait, tcpStateLastAck}}},
+		{false, tcpFlagACK, 5002, 1002, [][2]uint8{{tcpStateLastAck, tcpStateClose}}},
+	})
+
+	if len(tracker.connections) != 0 {
+		t.Errorf("expected no connections once closed, got %d", len(tracker.connections))
+	}
+}
+
+func TestPacketTrackerSimultaneousClose(t *testing.T) {
+	tracker := newPacketTracker()
+
+	trackMockSegments(t, tracker, time.Now(), []mockSegmentStep{
+		{true, tcpFlagSYN, 1000, 0, [][2]uint8{{tcpStateClose, tcpStateSynSent}}},
+		{false, tcpFlagSYN | tcpFlagACK, 5000, 1001, [][2]uint8{{tcpStateSynSent, tcpStateEstablished}}},
+		{true, tcpFlagFIN | tcpFlagACK, 1001, 5001, [][2]uint8{{tcpStateEstablished, tcpStateFinWait1}}},
+		{false, tcpFlagFIN | tcpFlagACK, 5001, 1001, [][2]uint8{{tcpStateFinWait1, tcpStateClosing}}},
+		{false, tcpFlagACK, 5002, 1002, [][2]uint8{{tcpStateClosing, tcpStateTimeWait}}},
+	})
+}
+
+func TestPacketTrackerReset(t *testing.T) {
+	tracker := newPacketTracker()
+
+	trackMockSegments(t, tracker, time.Now(), []mockSegmentStep{
+		{false, tcpFlagRST, 0, 0, nil}, // Not tracked
+		{true, tcpFlagSYN, 1000, 0, [][2]uint8{{tcpStateClose, tcpStateSynSent}}},
+		{false, tcpFlagRST | tcpFlagACK, 0, 1001, [][2]uint8{{tcpStateSynSent, tcpStateClose}}},
+		{false, tcpFlagSYN, 5000, 0, nil},
+		{false, tcpFlagRST, 5001, 0, nil}, // Never reported, as never established
+	})
+
+	if len(tracker.connections) != 0 {
+		t.Errorf("expected no connections once reset, got %d", len(tracker.connections))
+	}
+}
+
+func TestPacketTrackerExpireHandshakes(t *testing.T) {
+	tracker := newPacketTracker()
+	now := time.Now()
+
+	trackMockSegments(t, tracker, now, []mockSegmentStep{
+		{true, tcpFlagSYN, 1000, 0, [][2]uint8{{tcpStateClose, tcpStateSynSent}}},
+	})
+
+	if transitions := tracker.expire(now.Add(packetHandshakeTimeout / 2)); len(transitions) != 0 {
+		t.Errorf("expected no expiry within the handshake timeout, got %+v", transitions)
+	}
+
+	if transitions := tracker.expire(now.Add(packetHandshakeTimeout)); len(transitions) != 1 ||
+		transitions[0].oldState != tcpStateSynSent || transitions[0].newState != tcpStateClose {
+		t.Errorf("expected SYN_SENT to expire to CLOSE, got %+v", transitions)
+	}
+}
+
+func TestPacketSourceInfer(t *testing.T) {
+	source := newPacketSource(new(config))
+
+	err := source.infer([]*sockDiagTransition{{mockInetDiagSocket, tcpStateSynSent, tcpStateEstablished}})
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(source.pending) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(source.pending))
+	}
+
+	event := source.pending[0]
+	if !event.Inferred || event.CommandOnCPU != packetInferredComm {
+		t.Errorf("expected event labelled as inferred, got %s-%d with inferred %t",
+			event.CommandOnCPU,
+			event.PIDOnCPU,
+			event.Inferred)
+	}
+
+	if event.SourcePort != 44406 || event.DestPort != 80 {
+		t.Errorf("expected ports 44406 and 80, got %d and %d", event.SourcePort, event.DestPort)
+	}
+}
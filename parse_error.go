@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrFieldNotPresent is wrapped by the errors of ParseErrors of fields which
+// are absent from the line.
+var errFieldNotPresent = errors.New("not present in event")
+
+// ParseFailure is the class of a failure to parse a line, so that a spike in
+// one class, for example following a kernel upgrade, can be diagnosed from the
+// counts of failures by class alone.
+type ParseFailure int
+
+const (
+	// FailureOther is a failure of no other class.
+	FailureOther ParseFailure = iota
+	// FailureMissingField is a field absent from the line.
+	FailureMissingField
+	// FailureBadInteger is an integer field, such as a PID or port, which could
+	// not be parsed.
+	FailureBadInteger
+	// FailureBadAddress is an address field which could not be parsed.
+	FailureBadAddress
+	// FailureBadState is a TCP state which could not be canonicalised.
+	FailureBadState
+	// FailureTruncated is a line which ended before all its fields.
+	FailureTruncated
+
+	numParseFailures = iota
+)
+
+func (f ParseFailure) String() string {
+	switch f {
+	case FailureMissingField:
+		return "missing-field"
+	case FailureBadInteger:
+		return "bad-integer"
+	case FailureBadAddress:
+		return "bad-address"
+	case FailureBadState:
+		return "bad-state"
+	case FailureTruncated:
+		return "truncated"
+	default:
+		return "other"
+	}
+}
+
+// ParseError is an error returned if a trace line could not be parsed as an
+// event, so that operators can see exactly which line could not be handled.
+type ParseError struct {
+	// Line is the trace line which could not be parsed.
+	Line []byte
+	// Field is the field of the line which could not be parsed, e.g. "pid" or
+	// "sport".
+	Field string
+	// Failure is the class of the failure.
+	Failure ParseFailure
+	// Err is the error encountered parsing the field.
+	Err error
+}
+
+// NewParseError returns a ParseError for the line, which is copied, as lines
+// are usually read into a buffer which is then reused.
+func newParseError(line []byte, field string, err error) *ParseError {
+	return &ParseError{
+		Line:    append([]byte(nil), line...),
+		Field:   field,
+		Failure: classifyParseFailure(field, err),
+		Err:     err,
+	}
+}
+
+// ClassifyParseFailure returns the class of the failure to parse the field.
+func classifyParseFailure(field string, err error) ParseFailure {
+	switch {
+	case errors.Is(err, errFieldNotPresent):
+		return FailureMissingField
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, errEmptyField):
+		return FailureTruncated
+	}
+
+	switch field {
+	case "pid", "sport", "dport":
+		return FailureBadInteger
+	case "saddr", "daddr":
+		return FailureBadAddress
+	case "oldstate", "newstate", "state":
+		return FailureBadState
+	default:
+		return FailureOther
+	}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v, in line %q", e.Err, e.Line)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// ErrNonStateChangeEvent is returned by ParseTraceLine for events of the
+// tracepoints which are not state changes, such as resets.
+var errNonStateChangeEvent = fmt.Errorf("%w: not a state change", ErrIrrelevantEvent)
+
+// StandaloneEventParser is the parser used by ParseTraceLine. As it is never
+// configured with a tracepoint format, it makes no assumptions about the
+// tagged fields the events declare.
+var standaloneEventParser = newTraceFSEventParser(new(slicingFieldParser), parserTracepointCandidates())
+
+// ParserTracepointCandidates returns the tracepoints the events of which the
+// parser can parse: any which may be deduced, and the auxiliary tracepoints.
+func parserTracepointCandidates() []*tracepointCandidate {
+	candidates := append([]*tracepointCandidate(nil), defaultTracepointCandidates...)
+	candidates = append(candidates, resetTracepoints...)
+	return append(candidates, destroySockTracepoint, retransmitTracepoint)
+}
+
+// ParseTraceLine parses a line of a trace_pipe capture into a TCP state change
+// event, with the same semantics as the Eventer, so that archived captures can
+// be processed offline. Events which are not TCPv4 state changes return an
+// error wrapping ErrIrrelevantEvent, and lost events markers return a
+// *LostEventsError. As the clock of the traced machine is unknown, the time of
+// the event is the time at which it is parsed.
+func ParseTraceLine(line []byte) (*event.Event, error) {
+	if lostEventsErr, ok := parseLostEventsMarker(line); ok {
+		return nil, lostEventsErr
+	}
+
+	contextEvent, err := standaloneEventParser.toEvent(line)
+	if err != nil {
+		if errors.Is(err, ErrIrrelevantEvent) {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("parsing event: %w", err)
+	}
+
+	if contextEvent.Kind != KindStateChange {
+		return nil, errNonStateChangeEvent
+	}
+
+	return contextEvent.Event, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func TestParseTraceLine(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED")
+	event, err := ParseTraceLine(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.SourcePort != 44406 || event.DestPort != 80 {
+		t.Errorf("expected ports 44406 and 80, got %d and %d", event.SourcePort, event.DestPort)
+	}
+
+	if event.OldState != tcpstate.StateSynSent || event.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected states %v and %v, got %v and %v",
+			tcpstate.StateSynSent,
+			tcpstate.StateEstablished,
+			event.OldState,
+			event.NewState)
+	}
+}
+
+func TestParseTraceLineIrrelevantEventError(t *testing.T) {
+	mockEventTraces := map[string][]byte{
+		"non-TCP": []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_UDP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED"),
+		"reset":   []byte("<idle>-0       [000] ..s.   995.318985: tcp_send_reset: family=AF_INET sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4"),
+	}
+
+	for name, mockEventTrace := range mockEventTraces {
+		_, err := ParseTraceLine(mockEventTrace)
+		if err == nil {
+			t.Errorf("expected error for %s event, got nil", name)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+
+		if !errors.Is(err, ErrIrrelevantEvent) {
+			t.Errorf("expected error chain for %s event to include %q, but did not", name, ErrIrrelevantEvent)
+		}
+	}
+}
+
+func TestParseTraceLineLostEventsError(t *testing.T) {
+	_, err := ParseTraceLine([]byte("CPU:2 [LOST 17 EVENTS]"))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	lostEventsErr := new(LostEventsError)
+	if !errors.As(err, &lostEventsErr) {
+		t.Fatalf("expected error chain to include a %T, but did not", lostEventsErr)
+	}
+
+	if lostEventsErr.CPU != 2 || lostEventsErr.Lost != 17 {
+		t.Errorf("expected 17 events lost on CPU 2, got %d on CPU %d", lostEventsErr.Lost, lostEventsErr.CPU)
+	}
+}
+
+func TestParseTraceLineParseError(t *testing.T) {
+	_, err := ParseTraceLine([]byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=FOO dport=80"))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	parseErr := new(ParseError)
+	if !errors.As(err, &parseErr) {
+		t.Errorf("expected error chain to include a %T, but did not", parseErr)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"container/heap"
+	"os"
+	"sync"
+	"time"
+)
+
+// ParserPoolQueueLength is the number of lines queued for, and results queued
+// from, each parser worker.
+const parserPoolQueueLength = 64
+
+// ParsedLine is a line read, stamped with its sequence number, and the outcome
+// of parsing it. The end of the lines read is marked by a parsed line with no
+// line, stamped with the sequence number which would follow the last line.
+type parsedLine struct {
+	seq   uint64
+	line  []byte // A copy, as the line reader reuses its buffer
+	event *ContextEvent
+	err   error
+	end   bool
+}
+
+// ParsedLineHeap is a min-heap of parsed lines, ordered by sequence number.
+type parsedLineHeap []*parsedLine
+
+func (h parsedLineHeap) Len() int           { return len(h) }
+func (h parsedLineHeap) Less(i, j int) bool { return h[i].seq < h[j].seq }
+func (h parsedLineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *parsedLineHeap) Push(x interface{}) {
+	*h = append(*h, x.(*parsedLine))
+}
+
+func (h *parsedLineHeap) Pop() interface{} {
+	old := *h
+	parsed := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return parsed
+}
+
+// ParserPool decouples the reading of lines from their parsing, so that busy
+// hosts can parse on multiple cores. A single goroutine reads lines into a
+// queue, from which a pool of workers parses them. If ordered, each line is
+// stamped with its sequence number, and the results are returned in sequence,
+// otherwise they are returned as soon as each is parsed. Once the lines are
+// exhausted, or reading fails, the reader stops, and the end is returned once
+// all lines before it are parsed, so that the failure can be handled, such as
+// by recovering the tracing instance, while no lines are being parsed.
+type parserPool struct {
+	parse   func(line []byte) (*ContextEvent, error)
+	ordered bool
+	lines   chan *parsedLine
+	results chan *parsedLine
+	done    <-chan struct{}
+	free    *sync.Pool // Of parsed lines returned, whose line buffers are reused
+
+	// Only accessed by the caller of next
+	reading bool
+	nextSeq uint64 // Of the next result to return
+	pending parsedLineHeap
+	end     *parsedLine // Held until the results before it are returned
+}
+
+// NewParserPool returns a pool of the number of workers, which must be
+// positive, parsing lines with parse, which must be safe for concurrent use,
+// until done.
+func newParserPool(workers int,
+	ordered bool,
+	parse func(line []byte) (*ContextEvent, error),
+	done <-chan struct{}) *parserPool {
+	pp := &parserPool{
+		parse:   parse,
+		ordered: ordered,
+		lines:   make(chan *parsedLine, parserPoolQueueLength*workers),
+		results: make(chan *parsedLine, parserPoolQueueLength*workers),
+		done:    done,
+		free: &sync.Pool{
+			New: func() interface{} {
+				return new(parsedLine)
+			},
+		},
+	}
+
+	for i := 0; i < workers; i++ {
+		go pp.work()
+	}
+
+	return pp
+}
+
+// Read starts reading the lines returned by nextLine, until it returns false,
+// if not already reading. NextLine is only called by the reader, so, like the
+// line readers it reads, need not be safe for concurrent use, but must not be
+// used by the caller until the end of the lines is returned.
+func (pp *parserPool) read(nextLine func() ([]byte, bool)) {
+	if pp.reading {
+		return
+	}
+	pp.reading = true
+
+	go func(seq uint64) {
+		for {
+			line, ok := nextLine()
+			if !ok {
+				pp.send(pp.results, &parsedLine{seq: seq, end: true})
+				return
+			}
+
+			parsed := pp.free.Get().(*parsedLine)
+			parsed.seq = seq
+			parsed.line = append(parsed.line[:0], line...)
+			if !pp.send(pp.lines, parsed) {
+				return
+			}
+			seq++
+		}
+	}(pp.nextSeq)
+}
+
+// Work parses the lines queued until done.
+func (pp *parserPool) work() {
+	for {
+		select {
+		case parsed := <-pp.lines:
+			parsed.event, parsed.err = pp.parse(parsed.line)
+			if !pp.send(pp.results, parsed) {
+				return
+			}
+		case <-pp.done:
+			return
+		}
+	}
+}
+
+func (pp *parserPool) send(queue chan<- *parsedLine, parsed *parsedLine) bool {
+	select {
+	case queue <- parsed:
+		return true
+	case <-pp.done:
+		return false
+	}
+}
+
+// Next returns the next line parsed, or the end of the lines read, after which
+// reading must be started again. If the deadline channel fires first,
+// os.ErrDeadlineExceeded is returned, or if the pool is done, ErrEventerClosed
+// is returned. Lines returned should be released once their result is used.
+func (pp *parserPool) next(deadline <-chan time.Time) (*parsedLine, error) {
+	for {
+		if pp.ordered && len(pp.pending) > 0 && pp.pending[0].seq == pp.nextSeq {
+			pp.nextSeq++
+			return heap.Pop(&pp.pending).(*parsedLine), nil
+		}
+
+		if pp.end != nil && pp.end.seq == pp.nextSeq {
+			end := pp.end
+			pp.end = nil
+			pp.reading = false
+
+			return end, nil
+		}
+
+		select {
+		case parsed := <-pp.results:
+			switch {
+			case parsed.end:
+				pp.end = parsed
+			case pp.ordered:
+				heap.Push(&pp.pending, parsed)
+			default:
+				pp.nextSeq++
+				return parsed, nil
+			}
+		case <-deadline:
+			return nil, os.ErrDeadlineExceeded
+		case <-pp.done:
+			return nil, ErrEventerClosed
+		}
+	}
+}
+
+// Release returns the line parsed for reuse, once its result is used.
+func (pp *parserPool) release(parsed *parsedLine) {
+	if parsed.end {
+		return
+	}
+
+	parsed.event, parsed.err = nil, nil
+	pp.free.Put(parsed)
+}
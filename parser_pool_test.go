@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// NewMockLines returns a source of the lines, as read by a parser pool.
+func newMockLines(lines []string) func() ([]byte, bool) {
+	return func() ([]byte, bool) {
+		if len(lines) == 0 {
+			return nil, false
+		}
+
+		line := []byte(lines[0])
+		lines = lines[1:]
+		return line, true
+	}
+}
+
+// MockParse parses a line of a port, taking longer to parse lower ports, so
+// that lines read earlier are parsed later.
+func mockParse(line []byte) (*ContextEvent, error) {
+	port, err := strconv.Atoi(string(line))
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(time.Duration(100-port) * 10 * time.Microsecond)
+
+	return newMockDirectionEvent(uint16(port), 80, "", ""), nil
+}
+
+func TestParserPoolOrdered(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	var lines []string
+	for port := 0; port < 100; port++ {
+		lines = append(lines, strconv.Itoa(port))
+	}
+
+	pool := newParserPool(8, true, mockParse, done)
+	pool.read(newMockLines(lines))
+	for port := 0; port < 100; port++ {
+		parsed, err := pool.next(nil)
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if parsed.end {
+			t.Fatalf("expected line %d, got end", port)
+		}
+
+		if parsed.event.SourcePort != uint16(port) {
+			t.Errorf("expected source port %d, got %d", port, parsed.event.SourcePort)
+		}
+		pool.release(parsed)
+	}
+
+	parsed, err := pool.next(nil)
+	if err != nil || !parsed.end {
+		t.Errorf("expected end, got %+v and error %v", parsed, err)
+	}
+}
+
+func TestParserPoolUnordered(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	pool := newParserPool(4, false, mockParse, done)
+	pool.read(newMockLines([]string{"1", "2", "foo", "3"}))
+
+	// The end is only returned once all lines before it are parsed
+	ports, failures := 0, 0
+	for {
+		parsed, err := pool.next(nil)
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if parsed.end {
+			break
+		}
+
+		if parsed.err != nil {
+			failures++
+		} else {
+			ports++
+		}
+		pool.release(parsed)
+	}
+
+	if ports != 3 || failures != 1 {
+		t.Errorf("expected 3 events and 1 failure, got %d events and %d failures", ports, failures)
+	}
+
+	// Reading resumes once started again
+	pool.read(newMockLines([]string{"4"}))
+	parsed, err := pool.next(nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if parsed.end || parsed.event.SourcePort != 4 {
+		t.Errorf("expected source port 4, got %+v", parsed)
+	}
+}
+
+func TestParserPoolDeadlineExceeded(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	pool := newParserPool(1, true, mockParse, done)
+	pool.read(func() ([]byte, bool) {
+		<-done
+		return nil, false
+	})
+
+	_, err := pool.next(time.After(10 * time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected os.ErrDeadlineExceeded, got %q (of type %T)", err, err)
+	}
+}
+
+func TestReplayEventerParserWorkers(t *testing.T) {
+	source := newReplaySource(strings.NewReader(mockReplayCapture), "", false)
+	eventer, err := newReplayEventer(source, &config{parserWorkers: 4})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	for _, newState := range []tcpstate.State{tcpstate.StateEstablished, tcpstate.StateFinWait1} {
+		event, err := eventer.Event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.NewState != newState {
+			t.Errorf("expected new state %q, got %q", newState, event.NewState)
+		}
+	}
+
+	// The end of the capture is returned, and again once reading resumes
+	for i := 0; i < 2; i++ {
+		if _, err := eventer.Event(); err != io.EOF {
+			t.Errorf("expected io.EOF, got %q (of type %T)", err, err)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// The parts of the perf_event_open(2) ABI needed to sample tracepoints.
+const (
+	perfTypeTracepoint = 2
+
+	perfSampleTID  = 1 << 1
+	perfSampleTime = 1 << 2
+	perfSampleCPU  = 1 << 7
+	perfSampleRaw  = 1 << 10
+
+	perfAttrFlagDisabled   = 1 << 0
+	perfAttrFlagUseClockID = 1 << 25
+
+	perfFlagFDCloexec = 1 << 3
+
+	perfEventIOCEnable  = 0x2400
+	perfEventIOCDisable = 0x2401
+
+	perfRecordLost   = 2
+	perfRecordSample = 9
+
+	// The offsets of the data_head and data_tail fields of the
+	// struct perf_event_mmap_page which begins the mapping of the ring buffer.
+	perfMmapDataHeadOffset = 1024
+	perfMmapDataTailOffset = 1032
+
+	clockBoottime = 7
+)
+
+// PerfEventAttr is the struct perf_event_attr of the PERF_ATTR_SIZE_VER5 ABI.
+type perfEventAttr struct {
+	typ              uint32
+	size             uint32
+	config           uint64
+	samplePeriod     uint64
+	sampleType       uint64
+	readFormat       uint64
+	flags            uint64
+	wakeupEvents     uint32
+	bpType           uint32
+	config1          uint64
+	config2          uint64
+	branchSampleType uint64
+	sampleRegsUser   uint64
+	sampleStackUser  uint32
+	clockID          int32
+	sampleRegsIntr   uint64
+	auxWatermark     uint32
+	sampleMaxStack   uint16
+	reserved         uint16
+}
+
+// NewTracepointPerfEventAttr returns the attributes with which to sample every
+// event of the tracepoint of the ID, with its raw record, and timestamped by
+// the boot clock, as are the events of tracefs instances created by the eventer.
+func newTracepointPerfEventAttr(tracepointID uint64) *perfEventAttr {
+	return &perfEventAttr{
+		typ:          perfTypeTracepoint,
+		size:         uint32(unsafe.Sizeof(perfEventAttr{})),
+		config:       tracepointID,
+		samplePeriod: 1,
+		sampleType:   perfSampleTID | perfSampleTime | perfSampleCPU | perfSampleRaw,
+		flags:        perfAttrFlagDisabled | perfAttrFlagUseClockID,
+		wakeupEvents: 1,
+		clockID:      clockBoottime,
+	}
+}
+
+// PerfEventOpen opens a perf event of the attributes on the CPU, for all
+// tasks, returning its file descriptor.
+func perfEventOpen(attr *perfEventAttr, cpu int) (int, error) {
+	pid, groupFD := -1, -1
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN,
+		uintptr(unsafe.Pointer(attr)),
+		uintptr(pid),
+		uintptr(cpu),
+		uintptr(groupFD),
+		perfFlagFDCloexec,
+		0)
+	if errno != 0 {
+		return -1, os.NewSyscallError("perf_event_open", errno)
+	}
+
+	return int(fd), nil
+}
+
+// PerfEventIOCSetFilter returns the PERF_EVENT_IOC_SET_FILTER request, the
+// encoding of which, as an _IOW request of a pointer, varies by architecture.
+func perfEventIOCSetFilter() uintptr {
+	const request = '$'<<8 | 6
+	size := unsafe.Sizeof(uintptr(0)) << 16
+
+	switch runtime.GOARCH {
+	case "ppc64", "ppc64le", "mips", "mipsle", "mips64", "mips64le":
+		return 4<<29 | size | request
+	default:
+		return 1<<30 | size | request
+	}
+}
+
+func perfEventIoctl(fd int, request, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, arg); errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+
+	return nil
+}
+
+// SetPerfEventFilter installs an ftrace filter expression on the perf event of
+// a tracepoint, so that events which do not match are discarded by the kernel.
+func setPerfEventFilter(fd int, filter string) error {
+	filterBytes := append([]byte(filter), 0)
+	err := perfEventIoctl(fd, perfEventIOCSetFilter(), uintptr(unsafe.Pointer(&filterBytes[0])))
+	runtime.KeepAlive(filterBytes)
+
+	return err
+}
+
+// PerfRing is the ring buffer, mapped into memory, to which the kernel writes
+// the records of a perf event on a CPU.
+type perfRing struct {
+	fd  int
+	cpu int
+
+	mapping []byte // The metadata page, followed by the data pages
+	data    []byte
+	scratch []byte // Holds records which wrap around the end of the data pages
+
+	// Mutex serialises reading the ring buffer with unmapping it.
+	mutex *sync.Mutex
+}
+
+// NewPerfRing maps the ring buffer of the perf event of the file descriptor,
+// of the number of data pages, which must be a power of two.
+func newPerfRing(fd, cpu, pages int) (*perfRing, error) {
+	pageSize := os.Getpagesize()
+	mapping, err := syscall.Mmap(fd,
+		0,
+		(1+pages)*pageSize,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+
+	return &perfRing{
+		fd:      fd,
+		cpu:     cpu,
+		mapping: mapping,
+		data:    mapping[pageSize:],
+		mutex:   new(sync.Mutex),
+	}, nil
+}
+
+var errPerfRingUnmapped = errors.New("perf ring buffer unmapped")
+
+// ReadRecords calls fn with the type and body of each record written to the
+// ring buffer since it was last read, then releases them to the kernel. The
+// body is only valid until fn returns.
+func (r *perfRing) readRecords(fn func(recordType uint32, body []byte)) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.mapping == nil {
+		return errPerfRingUnmapped
+	}
+
+	dataHead := (*uint64)(unsafe.Pointer(&r.mapping[perfMmapDataHeadOffset]))
+	dataTail := (*uint64)(unsafe.Pointer(&r.mapping[perfMmapDataTailOffset]))
+	head := atomic.LoadUint64(dataHead) // Orders the reads of the records after that of the head
+	tail := atomic.LoadUint64(dataTail)
+	size := uint64(len(r.data))
+
+	for tail < head {
+		// Records are 8-byte aligned, so the header does not wrap
+		offset := tail % size
+		recordType := hostByteOrder.Uint32(r.data[offset:])
+		recordSize := uint64(hostByteOrder.Uint16(r.data[offset+6:]))
+		if recordSize < 8 || recordSize > head-tail {
+			atomic.StoreUint64(dataTail, head) // Corrupt, so discard what remains
+			return fmt.Errorf("invalid record size %d", recordSize)
+		}
+
+		record := r.data[offset:]
+		if offset+recordSize > size {
+			r.scratch = append(append(r.scratch[:0], r.data[offset:]...), r.data[:offset+recordSize-size]...)
+			record = r.scratch
+		}
+
+		fn(recordType, record[8:recordSize])
+		tail += recordSize
+	}
+
+	atomic.StoreUint64(dataTail, tail) // Orders the release after the reads of the records
+	return nil
+}
+
+// Enable starts the perf event writing records to the ring buffer.
+func (r *perfRing) enable() error {
+	return perfEventIoctl(r.fd, perfEventIOCEnable, 0)
+}
+
+// Close stops the perf event, unmaps its ring buffer and closes it.
+func (r *perfRing) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	perfEventIoctl(r.fd, perfEventIOCDisable, 0)
+
+	var firstErr error
+	if r.mapping != nil {
+		if err := syscall.Munmap(r.mapping); err != nil {
+			firstErr = os.NewSyscallError("munmap", err)
+		}
+		r.mapping, r.data = nil, nil
+	}
+
+	if err := syscall.Close(r.fd); err != nil && firstErr == nil {
+		firstErr = os.NewSyscallError("close", err)
+	}
+
+	return firstErr
+}
+
+// PerfSample is a sample record of a tracepoint perf event, of the sample type
+// requested by newTracepointPerfEventAttr.
+type perfSample struct {
+	pid, tid uint32
+	time     uint64 // In nanoseconds of the boot clock
+	cpu      uint32
+	raw      []byte // The raw record of the tracepoint event
+}
+
+// DecodePerfSample decodes the body of a sample record. The raw record refers
+// to the body, so is valid only as long as it.
+func decodePerfSample(body []byte) (*perfSample, error) {
+	const fixedSize = 4 + 4 + 8 + 4 + 4 + 4 // The TID, time, CPU and raw size
+	if len(body) < fixedSize {
+		return nil, fmt.Errorf("sample of %d bytes too short", len(body))
+	}
+
+	sample := &perfSample{
+		pid:  hostByteOrder.Uint32(body[0:]),
+		tid:  hostByteOrder.Uint32(body[4:]),
+		time: hostByteOrder.Uint64(body[8:]),
+		cpu:  hostByteOrder.Uint32(body[16:]),
+	}
+
+	rawSize := int(hostByteOrder.Uint32(body[24:]))
+	if rawSize > len(body)-fixedSize {
+		return nil, fmt.Errorf("raw record of %d bytes exceeds sample of %d bytes", rawSize, len(body))
+	}
+	sample.raw = body[fixedSize : fixedSize+rawSize]
+
+	return sample, nil
+}
+
+// DecodePerfLost returns the number of records lost reported by a lost record.
+func decodePerfLost(body []byte) (uint64, error) {
+	if len(body) < 16 {
+		return 0, fmt.Errorf("lost record of %d bytes too short", len(body))
+	}
+
+	return hostByteOrder.Uint64(body[8:]), nil
+}
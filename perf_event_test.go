@@ -0,0 +1,170 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"unsafe"
+)
+
+func TestPerfEventAttrSize(t *testing.T) {
+	// PERF_ATTR_SIZE_VER5
+	if size := unsafe.Sizeof(perfEventAttr{}); size != 112 {
+		t.Errorf("expected perf_event_attr of 112 bytes, got %d", size)
+	}
+}
+
+// NewMockPerfRing returns a ring buffer, not backed by a perf event, of the
+// data, the records of which are between the head and tail.
+func newMockPerfRing(data []byte, head, tail uint64) *perfRing {
+	mapping := make([]byte, perfMmapDataTailOffset+8)
+	hostByteOrder.PutUint64(mapping[perfMmapDataHeadOffset:], head)
+	hostByteOrder.PutUint64(mapping[perfMmapDataTailOffset:], tail)
+
+	return &perfRing{
+		mapping: mapping,
+		data:    data,
+		mutex:   new(sync.Mutex),
+	}
+}
+
+func putMockPerfRecord(data []byte, offset int, recordType uint32, body []byte) {
+	record := make([]byte, 8+len(body))
+	hostByteOrder.PutUint32(record[0:], recordType)
+	hostByteOrder.PutUint16(record[6:], uint16(len(record)))
+	copy(record[8:], body)
+
+	for i, b := range record {
+		data[(offset+i)%len(data)] = b
+	}
+}
+
+func TestPerfRingReadRecords(t *testing.T) {
+	data := make([]byte, 64)
+	// The first record ends at the end of the data, the second wraps around it
+	putMockPerfRecord(data, 24, perfRecordSample, []byte("01234567abcdefghABCDEFGH"))
+	putMockPerfRecord(data, 56, perfRecordLost, []byte("ijklmnopIJKLMNOP"))
+	ring := newMockPerfRing(data, 24+32+24, 24)
+
+	var types []uint32
+	var bodies []string
+	err := ring.readRecords(func(recordType uint32, body []byte) {
+		types = append(types, recordType)
+		bodies = append(bodies, string(body))
+	})
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedTypes := []uint32{perfRecordSample, perfRecordLost}
+	if !reflect.DeepEqual(types, expectedTypes) {
+		t.Errorf("expected record types %v, got %v", expectedTypes, types)
+	}
+
+	expectedBodies := []string{"01234567abcdefghABCDEFGH", "ijklmnopIJKLMNOP"}
+	if !reflect.DeepEqual(bodies, expectedBodies) {
+		t.Errorf("expected record bodies %q, got %q", expectedBodies, bodies)
+	}
+
+	if tail := hostByteOrder.Uint64(ring.mapping[perfMmapDataTailOffset:]); tail != 80 {
+		t.Errorf("expected tail of 80, got %d", tail)
+	}
+}
+
+func TestPerfRingReadRecordsInvalidSizeError(t *testing.T) {
+	data := make([]byte, 64)
+	putMockPerfRecord(data, 0, perfRecordSample, make([]byte, 8))
+	ring := newMockPerfRing(data, 8, 0) // The head is within the record
+
+	err := ring.readRecords(func(uint32, []byte) {
+		t.Error("expected no records")
+	})
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if tail := hostByteOrder.Uint64(ring.mapping[perfMmapDataTailOffset:]); tail != 8 {
+		t.Errorf("expected corrupt records to be discarded, got tail of %d", tail)
+	}
+}
+
+func TestPerfRingReadRecordsUnmappedError(t *testing.T) {
+	ring := &perfRing{mutex: new(sync.Mutex)}
+
+	err := ring.readRecords(func(uint32, []byte) {})
+	if err != errPerfRingUnmapped {
+		t.Errorf("expected error %q, got %q (of type %T)", errPerfRingUnmapped, err, err)
+	}
+}
+
+// NewMockPerfSampleBody returns the body of a sample record of the raw record.
+func newMockPerfSampleBody(pid uint32, time uint64, cpu uint32, raw []byte) []byte {
+	body := make([]byte, 28+len(raw))
+	hostByteOrder.PutUint32(body[0:], pid)
+	hostByteOrder.PutUint32(body[4:], pid)
+	hostByteOrder.PutUint64(body[8:], time)
+	hostByteOrder.PutUint32(body[16:], cpu)
+	hostByteOrder.PutUint32(body[24:], uint32(len(raw)))
+	copy(body[28:], raw)
+
+	return body
+}
+
+func TestDecodePerfSample(t *testing.T) {
+	sample, err := decodePerfSample(newMockPerfSampleBody(1234, 995318985321, 3, []byte("raw")))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if sample.pid != 1234 || sample.tid != 1234 {
+		t.Errorf("expected PID and TID 1234, got %d and %d", sample.pid, sample.tid)
+	}
+
+	if sample.time != 995318985321 {
+		t.Errorf("expected time 995318985321, got %d", sample.time)
+	}
+
+	if sample.cpu != 3 {
+		t.Errorf("expected CPU 3, got %d", sample.cpu)
+	}
+
+	if string(sample.raw) != "raw" {
+		t.Errorf("expected raw record %q, got %q", "raw", sample.raw)
+	}
+}
+
+func TestDecodePerfSampleError(t *testing.T) {
+	body := newMockPerfSampleBody(1234, 0, 0, []byte("raw"))
+	for name, mockBody := range map[string][]byte{
+		"too short":          body[:20],
+		"raw size too large": body[:len(body)-1],
+	} {
+		_, err := decodePerfSample(mockBody)
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+			continue
+		}
+
+		t.Logf("%s: got error %q (of type %T)", name, err, err)
+	}
+}
+
+func TestDecodePerfLost(t *testing.T) {
+	body := make([]byte, 16)
+	hostByteOrder.PutUint64(body[8:], 42)
+
+	lost, err := decodePerfLost(body)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if lost != 42 {
+		t.Errorf("expected 42 lost records, got %d", lost)
+	}
+
+	if _, err := decodePerfLost(body[:8]); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	onlineCPUsPath = "/sys/devices/system/cpu/online"
+
+	defaultPerfRingPages = 64
+
+	// PerfPollInterval is the longest a reader waits for records before
+	// checking whether it is closed, or its deadline has passed.
+	perfPollInterval = 100 * time.Millisecond
+
+	// PerfCommCacheLifetime is the lifetime of the cache of the commands of
+	// tasks, which bounds how long a command is used after its PID is reused.
+	perfCommCacheLifetime = time.Second
+
+	// PerfPassAllFilter replaces the filter of a perf event to clear it, as a
+	// filter set with PERF_EVENT_IOC_SET_FILTER cannot be removed.
+	perfPassAllFilter = "common_pid >= 0"
+)
+
+// PerfSource samples the tracepoint with perf_event_open(2), rather than
+// enabling it in a tracefs instance, so needs only permission to use perf
+// events (e.g. CAP_PERFMON, or a permissive perf_event_paranoid) and read
+// access to the events directory of tracefs, for the ID and format of the
+// tracepoint. The raw records sampled are decoded into events by the offsets
+// of the fields declared by the format.
+type perfSource struct {
+	lost     uint64 // Accessed atomically, the number of records lost by the kernel
+	read     uint64 // Accessed atomically, the number of samples read
+	closed   int32  // Accessed atomically, non-zero once closed
+	deadline sourceDeadline
+
+	mountpointRetriever mountpointRetriever
+	tracepointDeducer   tracepointDeducer
+	config              *config
+
+	mountpoint string
+	tracepoint string
+	decoder    *tracepointRecordDecoder
+	clock      *traceClock
+	rings      []*perfRing
+	pages      int
+	epollFD    int
+
+	pending []perfRecord // Records not yet read, ordered by time
+
+	comms        map[uint32]string // The commands of tasks, by PID
+	commsExpired time.Time
+
+	offloaded bool // Whether the filter expression was offloaded to the kernel
+	filtered  bool // Whether a filter was set on the perf events
+
+	onlineCPUsPath string
+	osReleasePath  string
+	procPath       string
+}
+
+// PerfRecord is the event decoded from a record, or the error of the record,
+// along with the time of the record, by which records are ordered.
+type perfRecord struct {
+	time  uint64
+	event *ContextEvent
+	err   error
+}
+
+func newPerfSource(mountpointRetriever mountpointRetriever,
+	tracepointDeducer tracepointDeducer,
+	config *config) *perfSource {
+	return &perfSource{
+		mountpointRetriever: mountpointRetriever,
+		tracepointDeducer:   tracepointDeducer,
+		config:              config,
+		clock:               newTraceClock("boot"),
+		epollFD:             -1,
+		comms:               make(map[uint32]string),
+		onlineCPUsPath:      onlineCPUsPath,
+		osReleasePath:       osReleasePath,
+		procPath:            "/proc",
+	}
+}
+
+// Open opens a perf event of the tracepoint on each online CPU, maps its ring
+// buffer, and waits for the records of all of them together.
+func (ps *perfSource) open() error {
+	mountpoint, err := ps.mountpointRetriever.retrieveMountpoint()
+	if err != nil {
+		return fmt.Errorf("obtaining tracefs mountpoint: %w", err)
+	}
+	ps.mountpoint = mountpoint
+
+	tracepoint, err := ps.tracepointDeducer.deduceTracepoint()
+	if err != nil {
+		return fmt.Errorf("deducing tracepoint: %w", err)
+	}
+	ps.tracepoint = tracepoint
+
+	if err := ps.openTracepoint(); err != nil {
+		ps.release()
+		return err
+	}
+
+	return nil
+}
+
+func (ps *perfSource) openTracepoint() error {
+	eventPath := ps.mountpoint + "/events/" + ps.tracepoint
+	formatFile, err := os.Open(eventPath + "/format")
+	if err != nil {
+		return fmt.Errorf("opening %s format: %w", ps.tracepoint, err)
+	}
+	defer formatFile.Close()
+
+	format, err := parseEventFormat(formatFile)
+	if err != nil {
+		return fmt.Errorf("parsing %s format: %w", ps.tracepoint, err)
+	}
+
+	if ps.decoder, err = newTracepointRecordDecoder(format, ps.config); err != nil {
+		return fmt.Errorf("decoding %s records: %w", ps.tracepoint, err)
+	}
+
+	id, err := ioutil.ReadFile(eventPath + "/id")
+	if err != nil {
+		return fmt.Errorf("reading %s ID: %w", ps.tracepoint, err)
+	}
+
+	tracepointID, err := strconv.ParseUint(strings.TrimSpace(string(id)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("parsing %s ID: %w", ps.tracepoint, err)
+	}
+
+	cpus, err := readCPUList(ps.onlineCPUsPath)
+	if err != nil {
+		return fmt.Errorf("reading online CPUs: %w", err)
+	}
+
+	ps.pages = perfRingPages(ps.config.bufferSizeKB)
+	attr := newTracepointPerfEventAttr(tracepointID)
+	for _, cpu := range cpus {
+		fd, err := perfEventOpen(attr, cpu)
+		if err != nil {
+			return fmt.Errorf("opening perf event on CPU %d: %w", cpu, err)
+		}
+
+		ring, err := newPerfRing(fd, cpu, ps.pages)
+		if err != nil {
+			syscall.Close(fd)
+			return fmt.Errorf("mapping perf ring buffer of CPU %d: %w", cpu, err)
+		}
+		ps.rings = append(ps.rings, ring)
+
+		if err := ps.setFilter(fd, cpu == cpus[0]); err != nil {
+			return err
+		}
+	}
+	ps.filtered = ps.config.filter != "" || ps.offloaded
+
+	epollFD, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("epoll_create1", err)
+	}
+	ps.epollFD = epollFD
+
+	for _, ring := range ps.rings {
+		event := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(ring.fd)}
+		if err := syscall.EpollCtl(ps.epollFD, syscall.EPOLL_CTL_ADD, ring.fd, event); err != nil {
+			return os.NewSyscallError("epoll_ctl", err)
+		}
+	}
+
+	for _, ring := range ps.rings {
+		if err := ring.enable(); err != nil {
+			return fmt.Errorf("enabling perf event on CPU %d: %w", ring.cpu, err)
+		}
+	}
+
+	return nil
+}
+
+// SetFilter sets the filter of the perf event, offloading the filter
+// expression, if the kernel accepts it on the event of the first CPU, and
+// otherwise only the configured filter, if any.
+func (ps *perfSource) setFilter(fd int, first bool) error {
+	if first {
+		ps.offloaded = false
+		if filter := offloadingFilter(ps.config); filter != "" {
+			err := setPerfEventFilter(fd, filter)
+			if err == nil {
+				ps.offloaded = true
+				return nil
+			}
+
+			log.Printf("WARNING: Unable to offload filter expression to kernel (%v): "+
+				"filtering when read", err)
+		}
+	}
+
+	filter := ps.config.filter
+	if ps.offloaded {
+		filter = offloadingFilter(ps.config)
+	}
+
+	if filter == "" && ps.filtered {
+		filter = perfPassAllFilter
+	}
+
+	if filter != "" {
+		if err := setPerfEventFilter(fd, filter); err != nil {
+			return fmt.Errorf("setting filter on perf event: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (ps *perfSource) filterOffloaded() bool {
+	return ps.offloaded
+}
+
+// Refilter replaces the filter of the perf event of each CPU with that of the
+// configuration.
+func (ps *perfSource) refilter() error {
+	for i, ring := range ps.rings {
+		if err := ps.setFilter(ring.fd, i == 0); err != nil {
+			ps.filtered = true // The events of other CPUs may be filtered
+			return fmt.Errorf("on CPU %d: %w", ring.cpu, err)
+		}
+	}
+	ps.filtered = ps.config.filter != "" || ps.offloaded
+
+	return nil
+}
+
+// PerfRingPages returns the number of data pages of each ring buffer, which
+// must be a power of two, to hold at least the size in KiB, if set.
+func perfRingPages(sizeKB uint64) int {
+	if sizeKB == 0 {
+		return defaultPerfRingPages
+	}
+
+	pageSize := uint64(os.Getpagesize())
+	pages := 1
+	for uint64(pages)*pageSize < sizeKB*1024 {
+		pages *= 2
+	}
+
+	return pages
+}
+
+// ReadCPUList reads a list of CPUs in the kernel's cpulist format, e.g.
+// `0-3,6`, such as that of the online CPUs.
+func readCPUList(path string) ([]int, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCPUList(strings.TrimSpace(string(contents)))
+}
+
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, cpuRange := range strings.Split(list, ",") {
+		bounds := strings.SplitN(cpuRange, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU %q in list %q", bounds[0], list)
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU range %q in list %q", cpuRange, list)
+			}
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
+
+// Event returns the event of the next record of the ring buffers. The records
+// read together from the ring buffers are ordered by time.
+func (ps *perfSource) event() (*ContextEvent, error) {
+	for len(ps.pending) == 0 {
+		if atomic.LoadInt32(&ps.closed) != 0 {
+			return nil, os.ErrClosed
+		}
+
+		if err := ps.readRings(); err != nil {
+			return nil, err
+		}
+
+		if len(ps.pending) != 0 {
+			break
+		}
+
+		timeout, err := ps.deadline.wait(perfPollInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := ps.wait(timeout); err != nil {
+			if atomic.LoadInt32(&ps.closed) != 0 {
+				return nil, os.ErrClosed
+			}
+
+			return nil, err
+		}
+	}
+
+	record := ps.pending[0]
+	ps.pending[0] = perfRecord{}
+	ps.pending = ps.pending[1:]
+
+	return record.event, record.err
+}
+
+// Wait waits for the kernel to signal that records are available, or for the
+// timeout to elapse.
+func (ps *perfSource) wait(timeout time.Duration) error {
+	events := make([]syscall.EpollEvent, len(ps.rings))
+	for {
+		_, err := syscall.EpollWait(ps.epollFD, events, int(timeout/time.Millisecond)+1)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return os.NewSyscallError("epoll_wait", err)
+		}
+
+		return nil
+	}
+}
+
+// ReadRings decodes the records of the ring buffers into the pending records,
+// ordered by time. Records of lost events have no time, so are ordered first.
+func (ps *perfSource) readRings() error {
+	for _, ring := range ps.rings {
+		cpu := ring.cpu
+		err := ring.readRecords(func(recordType uint32, body []byte) {
+			switch recordType {
+			case perfRecordSample:
+				atomic.AddUint64(&ps.read, 1)
+				sample, err := decodePerfSample(body)
+				if err != nil {
+					ps.pending = append(ps.pending, perfRecord{
+						err: fmt.Errorf("decoding perf sample on CPU %d: %w", cpu, err),
+					})
+					return
+				}
+
+				event, err := ps.decodeSample(sample)
+				if err != nil {
+					err = fmt.Errorf("decoding perf sample on CPU %d: %w", cpu, err)
+				}
+				ps.pending = append(ps.pending, perfRecord{time: sample.time, event: event, err: err})
+			case perfRecordLost:
+				lost, err := decodePerfLost(body)
+				if err != nil {
+					return
+				}
+				atomic.AddUint64(&ps.lost, lost)
+
+				ps.pending = append(ps.pending, perfRecord{err: &LostEventsError{CPU: cpu, Lost: lost}})
+			}
+		})
+		if err != nil {
+			if err == errPerfRingUnmapped && atomic.LoadInt32(&ps.closed) != 0 {
+				return os.ErrClosed
+			}
+
+			return fmt.Errorf("reading perf ring buffer of CPU %d: %w", cpu, err)
+		}
+	}
+
+	sort.SliceStable(ps.pending, func(i, j int) bool {
+		return ps.pending[i].time < ps.pending[j].time
+	})
+
+	return nil
+}
+
+// DecodeSample decodes the raw record of the sample into an event, of the task
+// on CPU when it was sampled, at its time.
+func (ps *perfSource) decodeSample(sample *perfSample) (*ContextEvent, error) {
+	contextEvent, err := ps.decoder.decode(sample.raw)
+	if err != nil {
+		return nil, err
+	}
+
+	eventTime, err := ps.clock.toTime(traceTimestamp{
+		sec:  sample.time / uint64(time.Second),
+		nsec: sample.time % uint64(time.Second),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("converting time to wall-clock time: %w", err)
+	}
+
+	contextEvent.Time = eventTime.UTC()
+	contextEvent.CommandOnCPU = ps.comm(sample.tid)
+	contextEvent.PIDOnCPU = int(sample.tid)
+	contextEvent.Idle = sample.tid == idlePID
+	contextEvent.Context = ps.decoder.traceContext(sample.raw, int(sample.cpu))
+	contextEvent.Context.TGID = int(sample.pid)
+
+	return contextEvent, nil
+}
+
+// Comm returns the command of the task of the PID, as shown in trace_pipe:
+// `<idle>` for the idle task, and `<...>` if not known, for example if the
+// task has since exited.
+func (ps *perfSource) comm(pid uint32) string {
+	if pid == idlePID {
+		return "<idle>"
+	}
+
+	if now := time.Now(); now.After(ps.commsExpired) {
+		ps.comms = make(map[uint32]string, len(ps.comms))
+		ps.commsExpired = now.Add(perfCommCacheLifetime)
+	}
+
+	if comm, ok := ps.comms[pid]; ok {
+		return comm
+	}
+
+	comm := "<...>"
+	if contents, err := ioutil.ReadFile(ps.procPath + "/" + strconv.FormatUint(uint64(pid), 10) + "/comm"); err == nil {
+		comm = strings.TrimSuffix(string(contents), "\n")
+	}
+	ps.comms[pid] = comm
+
+	return comm
+}
+
+func (ps *perfSource) setReadDeadline(t time.Time) error {
+	ps.deadline.set(t)
+	return nil
+}
+
+func (ps *perfSource) kernelInfo() (*KernelInfo, error) {
+	kernelInfo, err := releaseKernelInfo(ps.osReleasePath)
+	if err != nil {
+		return nil, err
+	}
+	kernelInfo.Tracepoint = ps.tracepoint
+	kernelInfo.Mountpoint = ps.mountpoint
+	kernelInfo.BufferSizeKB = uint64(ps.pages*os.Getpagesize()) / 1024
+
+	return kernelInfo, nil
+}
+
+// BufferStats returns the number of samples read and the number lost as the
+// ring buffers were full.
+func (ps *perfSource) bufferStats() (*BufferStats, error) {
+	return &BufferStats{
+		DroppedEvents: atomic.LoadUint64(&ps.lost),
+		ReadEvents:    atomic.LoadUint64(&ps.read),
+	}, nil
+}
+
+// Close stops waiting for records, closes the perf events, and releases the
+// tracepoint, if it was provisioned. A reader waiting for records notices it
+// is closed within the poll interval, as closing the epoll instance does not
+// interrupt the wait.
+func (ps *perfSource) close() error {
+	if !atomic.CompareAndSwapInt32(&ps.closed, 0, 1) {
+		return nil
+	}
+	log.Printf("Closing perf events of %s", ps.tracepoint)
+
+	return ps.release()
+}
+
+// Release closes the epoll instance and the perf events, and releases the
+// tracepoint, if it was provisioned.
+func (ps *perfSource) release() error {
+	var firstErr error
+	if ps.epollFD != -1 {
+		if err := syscall.Close(ps.epollFD); err != nil {
+			firstErr = os.NewSyscallError("close", err)
+		}
+	}
+
+	for _, ring := range ps.rings {
+		if err := ring.close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("closing perf event on CPU %d: %w", ring.cpu, err)
+		}
+	}
+	ps.filtered = false
+
+	if err := ps.tracepointDeducer.releaseTracepoint(); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("releasing tracepoint: %w", err)
+	}
+
+	return firstErr
+}
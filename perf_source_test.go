@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCPUList(t *testing.T) {
+	for list, expected := range map[string][]int{
+		"0":         {0},
+		"0-3":       {0, 1, 2, 3},
+		"0-1,4,6-7": {0, 1, 4, 6, 7},
+	} {
+		cpus, err := parseCPUList(list)
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %q (of type %T)", list, err, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(cpus, expected) {
+			t.Errorf("expected CPUs %v for %q, got %v", expected, list, cpus)
+		}
+	}
+}
+
+func TestParseCPUListError(t *testing.T) {
+	for _, list := range []string{"", "a", "3-1", "0-b"} {
+		_, err := parseCPUList(list)
+		if err == nil {
+			t.Errorf("expected error for %q, got nil", list)
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestPerfRingPages(t *testing.T) {
+	if pages := perfRingPages(0); pages != defaultPerfRingPages {
+		t.Errorf("expected default of %d pages, got %d", defaultPerfRingPages, pages)
+	}
+
+	pageSizeKB := uint64(os.Getpagesize() / 1024)
+	if pages := perfRingPages(3 * pageSizeKB); pages != 4 {
+		t.Errorf("expected 4 pages, got %d", pages)
+	}
+}
+
+// NewMockPerfSource returns a source of the rings, which decodes records of the
+// mockEventFormat, with the commands of tasks read from the mock proc.
+func newMockPerfSource(t *testing.T, rings ...*perfRing) *perfSource {
+	procPath := t.TempDir()
+	if err := os.Mkdir(filepath.Join(procPath, "1234"), 0755); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock proc: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(procPath, "1234", "comm"), []byte("curl\n"), 0644); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock proc: %v", err)
+	}
+
+	source := newPerfSource(nil, nil, new(config))
+	source.decoder = newMockTracepointRecordDecoder(t, mockEventFormat, new(config))
+	source.rings = rings
+	source.procPath = procPath
+
+	return source
+}
+
+func TestPerfSourceDecodeSample(t *testing.T) {
+	source := newMockPerfSource(t)
+
+	raw := newMockInetSockSetStateRecord(1, 1)
+	raw[3] = 1 // common_preempt_count
+	bootTime, err := clockNow(traceClockIDs["boot"])
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to read boot clock: %v", err)
+	}
+	sample := &perfSample{pid: 1230, tid: 1234, time: uint64(bootTime - time.Minute), cpu: 3, raw: raw}
+
+	event, err := source.decodeSample(sample)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.CommandOnCPU != "curl" || event.PIDOnCPU != 1234 || event.Idle {
+		t.Errorf("expected curl-1234, got %s-%d", event.CommandOnCPU, event.PIDOnCPU)
+	}
+
+	if event.SourcePort != 44406 || event.DestPort != 80 {
+		t.Errorf("expected ports 44406 and 80, got %d and %d", event.SourcePort, event.DestPort)
+	}
+
+	if age := time.Since(event.Time); age < 59*time.Second || age > 61*time.Second {
+		t.Errorf("expected event a minute old, got %v old", age)
+	}
+
+	if event.Context == nil {
+		t.Fatal("expected trace context, got nil")
+	}
+
+	if event.Context.CPU != 3 || event.Context.TGID != 1230 || !event.Context.SoftIRQ || event.Context.PreemptDepth != 1 {
+		t.Errorf("expected CPU 3, TGID 1230, soft interrupt context and preempt depth 1, got %+v", event.Context)
+	}
+}
+
+func TestPerfSourceCommUnknownTask(t *testing.T) {
+	source := newMockPerfSource(t)
+
+	if comm := source.comm(idlePID); comm != "<idle>" {
+		t.Errorf("expected %q, got %q", "<idle>", comm)
+	}
+
+	if comm := source.comm(4321); comm != "<...>" {
+		t.Errorf("expected %q, got %q", "<...>", comm)
+	}
+}
+
+func TestPerfSourceReadRingsOrdersByTime(t *testing.T) {
+	raw := newMockInetSockSetStateRecord(1, 1)
+
+	data0 := make([]byte, 512)
+	putMockPerfRecord(data0, 0, perfRecordSample, newMockPerfSampleBody(1234, 2000, 0, raw))
+	ring0 := newMockPerfRing(data0, uint64(8+28+len(raw)), 0)
+
+	lost := make([]byte, 16)
+	hostByteOrder.PutUint64(lost[8:], 5)
+	data1 := make([]byte, 512)
+	putMockPerfRecord(data1, 0, perfRecordSample, newMockPerfSampleBody(1234, 1000, 1, raw))
+	putMockPerfRecord(data1, 8+28+len(raw), perfRecordLost, lost)
+	ring1 := newMockPerfRing(data1, uint64(8+28+len(raw)+8+16), 0)
+	ring1.cpu = 1
+
+	source := newMockPerfSource(t, ring0, ring1)
+	if err := source.readRings(); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(source.pending) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(source.pending))
+	}
+
+	// The record of lost events has no time, so is ordered first
+	_, err := source.event()
+	if lostEventsErr, ok := err.(*LostEventsError); !ok || lostEventsErr.CPU != 1 || lostEventsErr.Lost != 5 {
+		t.Errorf("expected 5 events lost on CPU 1, got %q (of type %T)", err, err)
+	}
+
+	for _, expectedCPU := range []int{1, 0} {
+		event, err := source.event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.Context.CPU != expectedCPU {
+			t.Errorf("expected event of CPU %d, got %d", expectedCPU, event.Context.CPU)
+		}
+	}
+
+	if source.lost != 5 || source.read != 2 {
+		t.Errorf("expected 5 lost and 2 read, got %d and %d", source.lost, source.read)
+	}
+}
+
+func TestPerfSourceReadDeadline(t *testing.T) {
+	source := newMockPerfSource(t)
+	source.setReadDeadline(time.Now().Add(-time.Second))
+
+	_, err := source.event()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected error wrapping %q, got %q (of type %T)", os.ErrDeadlineExceeded, err, err)
+	}
+}
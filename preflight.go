@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Linux capability numbers, as defined in linux/capability.h.
+const (
+	capDACOverride = 1
+	capSysAdmin    = 21
+	capPerfmon     = 38
+)
+
+// ErrPreflightFailed is an error returned if any preflight check fails.
+var ErrPreflightFailed = errors.New("preflight checks failed")
+
+// PreflightReport describes the outcome of the preflight checks.
+type PreflightReport struct {
+	// Mountpoint is the tracefs mountpoint found, if any.
+	Mountpoint string
+	// Tracepoint is the tracepoint which would be used, if any.
+	Tracepoint string
+	// TopLevel is whether the top-level tracefs would be used, as tracing
+	// instances cannot be created.
+	TopLevel bool
+	// Problems lists the checks which failed. It is empty if all checks passed.
+	Problems []PreflightProblem
+}
+
+// PreflightProblem describes a single failed preflight check.
+type PreflightProblem struct {
+	// Check is the name of the check which failed.
+	Check string
+	// Path is the tracefs path the check was performed against, if any.
+	Path string
+	// Err is the error encountered performing the check.
+	Err error
+	// Hints lists likely causes of the failure, such as missing capabilities or
+	// mandatory access control denials.
+	Hints []string
+}
+
+func (p *PreflightProblem) String() string {
+	str := p.Check + ": " + p.Err.Error()
+	if len(p.Hints) > 0 {
+		str += " (" + strings.Join(p.Hints, "; ") + ")"
+	}
+
+	return str
+}
+
+func (r *PreflightReport) String() string {
+	if len(r.Problems) == 0 {
+		return "all preflight checks passed"
+	}
+
+	problems := make([]string, 0, len(r.Problems))
+	for i := range r.Problems {
+		problems = append(problems, r.Problems[i].String())
+	}
+
+	return strings.Join(problems, ", ")
+}
+
+// Preflight verifies that the environment permits the eventer to run, with
+// the options New() would load, without leaving any trace of having done so.
+// It checks that tracefs is mounted and visible, that the tracing instance can
+// be created, or adopted or attached to, as New() would, and that the
+// tracepoint enable file and trace_pipe within it are accessible. Backends
+// which do not read tracefs have nothing to check.
+// The report is always returned. If any check fails, the error returned has
+// ErrPreflightFailed in its chain.
+func Preflight() (*PreflightReport, error) {
+	getenv, err := configFileGetenv(os.Getenv)
+	if err != nil {
+		return configProblemReport(err)
+	}
+
+	config, err := loadConfig(getenv)
+	if err != nil {
+		return configProblemReport(err)
+	}
+
+	fieldParser := new(slicingFieldParser)
+	mountsParser := newProcMountinfoMountsParser(fieldParser)
+	mountpointRetriever := newProcFSMountpointRetriever(mountsParser, "/proc/self/mountinfo")
+	tracepointDeducer := newTraceFSTracepointDeducer(mountpointRetriever, defaultTracepointCandidates)
+	tracingInstance := newTraceFSTracingInstance(mountpointRetriever,
+		tracepointDeducer,
+		newInstanceUIDProvider(config),
+		config)
+
+	checker := newPreflightChecker(tracingInstance, probeSecurityEnvironment())
+
+	return checker.check()
+}
+
+// ConfigProblemReport returns the report of options which cannot be loaded.
+func configProblemReport(err error) (*PreflightReport, error) {
+	report := &PreflightReport{
+		Problems: []PreflightProblem{{Check: "configuration", Err: fmt.Errorf("loading config: %w", err)}},
+	}
+
+	return report, fmt.Errorf("%w: %s", ErrPreflightFailed, report)
+}
+
+// SecurityEnvironment describes the security attributes of the running
+// process and system which commonly cause tracefs access to be denied.
+type securityEnvironment struct {
+	euid             int
+	capEff           uint64 // Effective capability set bitmask
+	capEffKnown      bool
+	selinuxEnforcing bool
+}
+
+func (se *securityEnvironment) hasCapability(capability uint) bool {
+	return se.capEffKnown && se.capEff&(1<<capability) != 0
+}
+
+// ProbeSecurityEnvironment inspects the running process and system. Anything
+// which cannot be determined is left as the zero value.
+func probeSecurityEnvironment() *securityEnvironment {
+	env := &securityEnvironment{euid: os.Geteuid()}
+
+	if status, err := os.Open("/proc/self/status"); err == nil {
+		if capEff, err := parseEffectiveCapabilities(status); err == nil {
+			env.capEff = capEff
+			env.capEffKnown = true
+		}
+		status.Close()
+	}
+
+	if enforce, err := ioutil.ReadFile("/sys/fs/selinux/enforce"); err == nil {
+		env.selinuxEnforcing = strings.TrimSpace(string(enforce)) == "1"
+	}
+
+	return env
+}
+
+// ParseEffectiveCapabilities returns the effective capability set bitmask
+// from the CapEff line of a /proc/<pid>/status-formatted reader.
+func parseEffectiveCapabilities(reader io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+
+		capEff, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing effective capabilities: %w", err)
+		}
+
+		return capEff, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("scanning status for effective capabilities: %w", err)
+	}
+
+	return 0, errors.New("effective capabilities not present in status")
+}
+
+// PreflightChecker performs the preflight checks against the tracing instance,
+// with its config, mountpoint retriever, tracepoint deducer and UID provider,
+// and the helpers with which it accesses tracefs, without enabling it.
+type preflightChecker struct {
+	instance    *traceFSTracingInstance
+	environment *securityEnvironment
+}
+
+func newPreflightChecker(instance *traceFSTracingInstance, environment *securityEnvironment) *preflightChecker {
+	return &preflightChecker{
+		instance:    instance,
+		environment: environment,
+	}
+}
+
+func (pc *preflightChecker) check() (*PreflightReport, error) {
+	report := new(PreflightReport)
+	ti := pc.instance
+
+	switch ti.config.backend {
+	case "", backendInstance, backendPerf:
+	default:
+		// Other backends do not read tracefs, so have nothing to check
+		return report, nil
+	}
+
+	mountpoint, err := ti.mountpointRetriever.retrieveMountpoint()
+	if err != nil {
+		pc.addProblem(report, "tracefs mount visibility", "", err)
+		return report, fmt.Errorf("%w: %s", ErrPreflightFailed, report)
+	}
+	report.Mountpoint = mountpoint
+	ti.mountpoint = mountpoint
+
+	tracepoint, err := ti.tracepointDeducer.deduceTracepoint()
+	defer ti.tracepointDeducer.releaseTracepoint() // Remove any kprobe provisioned
+	if err != nil {
+		pc.addProblem(report, "tracepoint availability", mountpoint+"/events", err)
+	} else {
+		report.Tracepoint = tracepoint
+	}
+
+	switch {
+	case ti.config.backend == backendPerf:
+		// The tracepoint is sampled with perf_event_open(2) by its ID, so no
+		// instance is created
+		if tracepoint != "" {
+			idPath := mountpoint + "/events/" + tracepoint + "/id"
+			if err := pc.checkOpen(idPath, os.O_RDONLY); err != nil {
+				pc.addProblem(report, "tracepoint ID read access", idPath, err)
+			}
+		}
+	case ti.config.instancePath != "":
+		pc.checkAttach(report, tracepoint)
+	default:
+		pc.checkPrepare(report, tracepoint)
+	}
+
+	if len(report.Problems) > 0 {
+		return report, fmt.Errorf("%w: %s", ErrPreflightFailed, report)
+	}
+
+	return report, nil
+}
+
+// CheckPrepare checks that the instance can be created, as when it is
+// prepared, or adopted, or else that the top-level tracefs can be used, and
+// that the files to be accessed within it are accessible. An instance created
+// is removed immediately.
+func (pc *preflightChecker) checkPrepare(report *PreflightReport, tracepoint string) {
+	ti := pc.instance
+	ti.path = ti.mountpoint + "/instances/" + ti.uidProvider.uid()
+	created := false
+	err := ti.mkdir(ti.mountpoint, ti.path, 0700)
+	switch {
+	case err == nil:
+		created = true
+	case os.IsExist(err):
+		if err := ti.verifyInstanceOwner(); err != nil {
+			pc.addProblem(report, "instance ownership", ti.path, err)
+			return
+		}
+	case (os.IsNotExist(err) || os.IsPermission(err)) && isDirBeneath(ti.mountpoint, ti.mountpoint):
+		ti.path = ti.mountpoint
+		report.TopLevel = true
+	default:
+		pc.addProblem(report, "instance creation", ti.mountpoint+"/instances", err)
+		return
+	}
+
+	// Opening for writing checks access without modifying the file
+	if tracepoint != "" {
+		enablePath := ti.path + "/events/" + tracepoint + "/enable"
+		if err := pc.checkOpen(enablePath, os.O_WRONLY); err != nil {
+			pc.addProblem(report, "tracepoint enable file write access", enablePath, err)
+		}
+	}
+
+	pc.checkReader(report)
+
+	if created {
+		if err := ti.rmdir(ti.mountpoint, ti.path); err != nil {
+			pc.addProblem(report, "instance removal", ti.path, err)
+		}
+	}
+}
+
+// CheckAttach checks that the prepared instance of the instance path is
+// present, and that the files read from it are accessible.
+func (pc *preflightChecker) checkAttach(report *PreflightReport, tracepoint string) {
+	ti := pc.instance
+	ti.path = ti.config.instancePath
+	if _, err := os.Stat(ti.path); err != nil {
+		pc.addProblem(report, "instance attachment", ti.path, err)
+		return
+	}
+
+	if tracepoint != "" {
+		formatPath := ti.path + "/events/" + tracepoint + "/format"
+		if err := pc.checkOpen(formatPath, os.O_RDONLY); err != nil {
+			pc.addProblem(report, "tracepoint format read access", formatPath, err)
+		}
+	}
+
+	pc.checkReader(report)
+}
+
+// CheckReader checks that the file from which events are read, the trace_pipe
+// file, or the trace file if polled, is readable.
+func (pc *preflightChecker) checkReader(report *PreflightReport) {
+	ti := pc.instance
+	readerPath := ti.path + "/trace_pipe"
+	if ti.config.readMode == readModePoll {
+		readerPath = ti.path + "/trace"
+	}
+
+	if err := pc.checkOpen(readerPath, os.O_RDONLY|syscall.O_NONBLOCK); err != nil {
+		pc.addProblem(report, filepath.Base(readerPath)+" read access", readerPath, err)
+	}
+}
+
+func (pc *preflightChecker) addProblem(report *PreflightReport, check, path string, err error) {
+	report.Problems = append(report.Problems, PreflightProblem{
+		Check: check,
+		Path:  path,
+		Err:   err,
+		Hints: pc.diagnose(err),
+	})
+}
+
+// Diagnose returns the likely causes of the error, based upon the security
+// environment. Only permission errors are diagnosed.
+func (pc *preflightChecker) diagnose(err error) []string {
+	if !os.IsPermission(err) {
+		return nil
+	}
+
+	env := pc.environment
+	hints := make([]string, 0, 4)
+
+	if env.euid != 0 {
+		hints = append(hints, "not running as UID 0 (root), the owner of the tracefs files")
+	}
+
+	if env.capEffKnown {
+		if !env.hasCapability(capSysAdmin) {
+			hints = append(hints, "missing CAP_SYS_ADMIN")
+		}
+
+		if env.euid == 0 && !env.hasCapability(capDACOverride) {
+			hints = append(hints, "missing CAP_DAC_OVERRIDE")
+		}
+
+		if !env.hasCapability(capPerfmon) {
+			hints = append(hints, "missing CAP_PERFMON")
+		}
+	}
+
+	if env.selinuxEnforcing {
+		hints = append(hints, "SELinux is enforcing and may be denying access (check the audit log for AVC denials)")
+	}
+
+	return hints
+}
+
+// CheckOpen checks that the file can be opened with the flag, as the tracing
+// instance opens it, beneath the mountpoint.
+func (pc *preflightChecker) checkOpen(path string, flag int) error {
+	file, err := pc.instance.openFile(path, flag, 0)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
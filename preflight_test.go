@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	if err := bootstrapMockTraceFSTopLevelFiles(mockMountpoint, mockTracepoint); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		new(config))
+	tracingInstance.mkdir = newMockTraceFSMkdir(mockTracepoint)
+	tracingInstance.rmdir = mockTraceFSRmdir
+	checker := newPreflightChecker(tracingInstance, new(securityEnvironment))
+
+	report, err := checker.check()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(report.Problems) != 0 {
+		t.Errorf("expected no problems, got %s", report)
+	}
+
+	if report.Mountpoint != mockMountpoint {
+		t.Errorf("expected mountpoint %q, got %q", mockMountpoint, report.Mountpoint)
+	}
+
+	if report.Tracepoint != mockTracepoint {
+		t.Errorf("expected tracepoint %q, got %q", mockTracepoint, report.Tracepoint)
+	}
+
+	if report.TopLevel {
+		t.Error("expected instance to be used, but top-level tracefs was")
+	}
+
+	// Check the instance created to test access was cleaned up
+	exists, err := instanceExists(mockMountpoint, mockInstanceName)
+	if err != nil {
+		t.Fatalf("running test: unable to check if instance exists: %v", err)
+	}
+
+	if exists {
+		t.Error("expected preflight instance to be removed, but was not")
+	}
+}
+
+func TestPreflightMountpointRetrieverError(t *testing.T) {
+	mockError := errors.New("mock mountpoint retriever error")
+	mockMountpointRetriever := newMockMountpointRetriever("", mockError)
+	mockTracepointDeducer := newMockTracepointDeducer("", nil)
+	mockUIDProvider := newMockUIDProvider("")
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		new(config))
+	checker := newPreflightChecker(tracingInstance, new(securityEnvironment))
+
+	report, err := checker.check()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, ErrPreflightFailed) {
+		t.Errorf("expected error chain to include %q, but did not", ErrPreflightFailed)
+	}
+
+	if len(report.Problems) != 1 || !errors.Is(report.Problems[0].Err, mockError) {
+		t.Errorf("expected single problem with error %q, got %s", mockError, report)
+	}
+}
+
+func TestPreflightReportsAllProblems(t *testing.T) {
+	// Create a fake tracefs-like directory structure with no instances
+	// directory, so that the top-level tracefs is used, no tracepoint and no
+	// trace_pipe
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS("", false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer("", errors.New("mock tracepoint deducer error"))
+	mockUIDProvider := newMockUIDProvider("mock-instance")
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		new(config))
+	checker := newPreflightChecker(tracingInstance, new(securityEnvironment))
+
+	report, err := checker.check()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if len(report.Problems) != 2 {
+		t.Errorf("expected 2 problems, got %d: %s", len(report.Problems), report)
+	}
+
+	if !report.TopLevel {
+		t.Error("expected top-level tracefs to be used, but was not")
+	}
+}
+
+func TestPreflightAttachedInstance(t *testing.T) {
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-prepared-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider("mock-instance")
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{instancePath: mockMountpoint + "/instances/" + mockInstanceName})
+	tracingInstance.mkdir = func(root, path string, perm uint32) error {
+		t.Errorf("expected no instance to be created, but %s was", path)
+		return nil
+	}
+	checker := newPreflightChecker(tracingInstance, new(securityEnvironment))
+
+	report, err := checker.check()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(report.Problems) != 0 {
+		t.Errorf("expected no problems, got %s", report)
+	}
+}
+
+func TestPreflightNonTraceFSBackend(t *testing.T) {
+	mockMountpointRetriever := newMockMountpointRetriever("", errors.New("mock mountpoint retriever error"))
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		newMockTracepointDeducer("", nil),
+		newMockUIDProvider(""),
+		&config{backend: backendSockDiag})
+	checker := newPreflightChecker(tracingInstance, new(securityEnvironment))
+
+	report, err := checker.check()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(report.Problems) != 0 {
+		t.Errorf("expected no problems, got %s", report)
+	}
+
+	if mockMountpointRetriever.retrieveMountpointCalled {
+		t.Error("expected mountpoint retriever not to be called, but was")
+	}
+}
+
+func TestPreflightDiagnosePermissionError(t *testing.T) {
+	checker := newPreflightChecker(nil, &securityEnvironment{
+		euid:             1000,
+		capEff:           0,
+		capEffKnown:      true,
+		selinuxEnforcing: true,
+	})
+
+	hints := checker.diagnose(os.ErrPermission)
+	hintsStr := strings.Join(hints, "; ")
+	for _, expected := range []string{"UID 0", "CAP_SYS_ADMIN", "CAP_PERFMON", "SELinux"} {
+		if !strings.Contains(hintsStr, expected) {
+			t.Errorf("expected hints to mention %q, but were %q", expected, hintsStr)
+		}
+	}
+}
+
+func TestPreflightDiagnoseNonPermissionError(t *testing.T) {
+	checker := newPreflightChecker(nil, &securityEnvironment{euid: 1000})
+
+	if hints := checker.diagnose(os.ErrNotExist); len(hints) != 0 {
+		t.Errorf("expected no hints, got %q", hints)
+	}
+}
+
+func TestParseEffectiveCapabilities(t *testing.T) {
+	mockStatus := "Name:\tcat\nCapInh:\t0000000000000000\nCapPrm:\t000001ffffffffff\nCapEff:\t000001ffffffffff\n"
+
+	capEff, err := parseEffectiveCapabilities(strings.NewReader(mockStatus))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if capEff != 0x000001ffffffffff {
+		t.Errorf("expected effective capabilities %x, got %x", 0x000001ffffffffff, capEff)
+	}
+}
+
+func TestParseEffectiveCapabilitiesMissingError(t *testing.T) {
+	mockStatus := "Name:\tcat\nCapInh:\t0000000000000000\n"
+
+	_, err := parseEffectiveCapabilities(strings.NewReader(mockStatus))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func bootstrapMockTraceFSTopLevelFiles(mountpoint, tracepoint string) error {
+	if err := os.Mkdir(mountpoint+"/instances", 0700); err != nil {
+		return err
+	}
+
+	for _, file := range []string{"events/" + tracepoint + "/enable", "trace_pipe"} {
+		if err := ioutil.WriteFile(mountpoint+"/"+file, []byte{}, 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
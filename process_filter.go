@@ -0,0 +1,57 @@
+package main
+
+import "path"
+
+// ProcessFilter passes only the events in the context of the tasks of the
+// commands, and of the PIDs, if configured, so that auditing can target
+// specific services. Commands are matched by shell patterns, such as `nginx*`,
+// against the command on CPU, which the kernel truncates to 15 bytes. PIDs
+// are matched against the PID on CPU, where they cannot be filtered by the
+// set_event_pid file of a tracefs instance. Markers of lost events are always
+// passed. It is not modified once created, so is safe for concurrent use.
+type processFilter struct {
+	commands []string
+	pids     map[int]bool // Nil if PIDs are not filtered
+}
+
+// NewProcessFilter returns a filter of the command patterns, which must be
+// valid, and the PIDs, or nil if neither are given.
+func newProcessFilter(commands []string, pids []int) *processFilter {
+	if len(commands) == 0 && len(pids) == 0 {
+		return nil
+	}
+
+	filter := &processFilter{commands: commands}
+	if len(pids) > 0 {
+		filter.pids = make(map[int]bool, len(pids))
+		for _, pid := range pids {
+			filter.pids[pid] = true
+		}
+	}
+
+	return filter
+}
+
+// Passes returns whether the event is of a task of one of the commands, if
+// filtered, and of one of the PIDs, if filtered.
+func (f *processFilter) passes(event *ContextEvent) bool {
+	if event.Kind == KindLostEvents {
+		return true
+	}
+
+	if f.pids != nil && !f.pids[event.PIDOnCPU] {
+		return false
+	}
+
+	if len(f.commands) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.commands {
+		if matched, _ := path.Match(pattern, event.CommandOnCPU); matched {
+			return true
+		}
+	}
+
+	return false
+}
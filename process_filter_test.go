@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+func TestProcessFilterPasses(t *testing.T) {
+	filter := newProcessFilter([]string{"nginx*", "curl"}, []int{1234, 5678})
+
+	tests := []struct {
+		comm   string
+		pid    int
+		kind   EventKind
+		passes bool
+	}{
+		{"nginx: worker", 1234, KindStateChange, true},
+		{"curl", 5678, KindStateChange, true},
+		{"curl", 4321, KindStateChange, false},
+		{"wget", 1234, KindStateChange, false},
+		{"<idle>", 0, KindLostEvents, true},
+	}
+
+	for _, test := range tests {
+		contextEvent := &ContextEvent{
+			Event: &event.Event{CommandOnCPU: test.comm, PIDOnCPU: test.pid},
+			Kind:  test.kind,
+		}
+
+		if passes := filter.passes(contextEvent); passes != test.passes {
+			t.Errorf("expected %s-%d to pass %t, got %t", test.comm, test.pid, test.passes, passes)
+		}
+	}
+}
+
+func TestNewProcessFilterNone(t *testing.T) {
+	if filter := newProcessFilter(nil, nil); filter != nil {
+		t.Errorf("expected nil filter, got %+v", filter)
+	}
+}
+
+func TestReplayEventerEventFilteredByCommand(t *testing.T) {
+	capture := "" +
+		"            curl-1234    [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n" +
+		"           nginx-5678    [000] ..s.   995.368985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=443 dport=51234 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_RECV newstate=TCP_ESTABLISHED\n"
+
+	eventer, err := newReplayEventer(newReplaySource(strings.NewReader(capture), "", false),
+		&config{commands: []string{"ngin?"}})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.CommandOnCPU != "nginx" {
+		t.Errorf("expected event of nginx, got %q", event.CommandOnCPU)
+	}
+
+	stats, err := eventer.Stats()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if stats.Skipped.Filtered != 1 {
+		t.Errorf("expected 1 event filtered, got %d", stats.Skipped.Filtered)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// NewMockRelay returns a relay listening on loopback, which passes each
+// connection accepted to the returned channel.
+func newMockRelay(t *testing.T) (net.Listener, <-chan net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conns <- conn
+		}
+	}()
+
+	return listener, conns
+}
+
+func TestRelayEventerEvent(t *testing.T) {
+	listener, conns := newMockRelay(t)
+	defer listener.Close()
+
+	cfg := &config{backend: backendRelay, relayAddress: listener.Addr().String()}
+	eventer, err := newLineSourceEventer(newRelaySource(cfg.relayAddress), newTraceFSEventParser(new(slicingFieldParser), parserTracepointCandidates()), cfg)
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	conn := <-conns
+	io.WriteString(conn, mockReplayCapture)
+
+	for i := 0; i < 2; i++ {
+		if _, err := eventer.Event(); err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+	}
+
+	// The relay disconnecting is unexpected
+	conn.Close()
+	if _, err := eventer.Event(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %q (of type %T)", err, err)
+	}
+}
+
+func TestRelayReaderDeadlineExceededMidLine(t *testing.T) {
+	listener, conns := newMockRelay(t)
+	defer listener.Close()
+
+	source := newRelaySource(listener.Addr().String())
+	reader, err := source.open()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer source.close()
+
+	conn := <-conns
+	defer conn.Close()
+	line := strings.SplitAfter(mockReplayCapture, "\n")[0]
+	io.WriteString(conn, line[:20])
+
+	buf := make([]byte, len(line))
+	source.setReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := reader.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %q (of type %T)", err, err)
+	}
+
+	// The start of the line is not lost
+	source.setReadDeadline(time.Time{})
+	io.WriteString(conn, line[20:])
+	n, err := reader.Read(buf)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if string(buf[:n]) != line {
+		t.Errorf("expected whole line %q, got %q", line, buf[:n])
+	}
+}
+
+func TestRelaySourceConnectError(t *testing.T) {
+	listener, _ := newMockRelay(t)
+	address := listener.Addr().String()
+	listener.Close()
+
+	_, err := newRelaySource(address).open()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
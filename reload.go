@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+)
+
+// Reload is the options of filters and enrichment reloaded, and the enrichment
+// loaded from them, awaiting the reader of events.
+type reload struct {
+	config            *config
+	netNSTagger       *netNSTagger
+	geoIP             *geoIPEnricher
+	hostTags          map[string]string
+	reverseDNSChanged bool // Whether the reverse DNS resolver is replaced
+}
+
+// Reload reloads the options of filters and enrichment from the environment,
+// overridden by the config file of the CONFIG_FILE variable, if any, without
+// disabling the tracing instance, so that no events are missed while policies
+// change. These are the FILTER, FILTER_EXPRESSION, COMMANDS,
+// EXCLUDE_LOCAL_TRAFFIC, NETNS_TAGGING, NETNS, REVERSE_DNS, REVERSE_DNS_TTL,
+// REVERSE_DNS_RATE, GEOIP_DATABASES, HOST_TAGS, HOST_TAG_HOSTNAME,
+// CLOUD_METADATA and DIRECTION options, and PIDS, unless filtered by the
+// set_event_pid file of a tracefs instance. Other options take effect only
+// once the Eventer is recreated, and a warning is logged if they changed. The
+// kernel filter of the tracing instance, if any, is replaced at once, and the
+// other options take effect from the next event read, so events read during
+// the reload may be filtered by either. If the options are invalid, or cannot
+// be applied, an error is returned and those in effect are kept.
+func (e *Eventer) Reload() error {
+	e.reloadMutex.Lock()
+	defer e.reloadMutex.Unlock()
+
+	getenv, err := configFileGetenv(e.getenv)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	cfg, err := loadConfig(getenv)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	_, pidsFiltered := e.tracingInstance.(*traceFSTracingInstance)
+	loaded := *e.loaded
+	copyReloadableConfig(&loaded, cfg, !pidsFiltered)
+	if !reflect.DeepEqual(&loaded, cfg) {
+		log.Printf("WARNING: Options other than those of filters and enrichment were changed, " +
+			"which take effect only once the eventer is recreated")
+	}
+
+	reload := &reload{
+		config: &loaded,
+		reverseDNSChanged: loaded.reverseDNS != e.loaded.reverseDNS ||
+			loaded.reverseDNSTTL != e.loaded.reverseDNSTTL ||
+			loaded.reverseDNSRate != e.loaded.reverseDNSRate,
+	}
+
+	if loaded.netNSTagging {
+		if reload.netNSTagger, err = newNetNSTagger("/proc", loaded.netNSFilter); err != nil {
+			return fmt.Errorf("filtering network namespaces: %w", err)
+		}
+	}
+
+	if len(loaded.geoIPDatabases) > 0 {
+		if reload.geoIP, err = newGeoIPEnricher(loaded.geoIPDatabases); err != nil {
+			return fmt.Errorf("loading GeoIP databases: %w", err)
+		}
+	}
+
+	if loaded.hostTags != nil || loaded.hostTagHostname || loaded.cloudMetadata != "" {
+		if reload.hostTags, err = newHostTags(loaded.hostTags,
+			loaded.hostTagHostname,
+			loaded.cloudMetadata,
+			cloudMetadataBaseURLs[loaded.cloudMetadata],
+			&http.Client{Timeout: cloudMetadataTimeout}); err != nil {
+			return fmt.Errorf("looking up host tags: %w", err)
+		}
+	}
+
+	e.instanceMutex.Lock()
+	defer e.instanceMutex.Unlock()
+	if e.isClosed() {
+		return ErrEventerClosed
+	}
+
+	if err := e.refilter(&loaded); err != nil {
+		return err
+	}
+
+	// A reload not yet applied is superseded, but its resolver must still be
+	// replaced
+	if e.reload != nil && e.reload.reverseDNSChanged {
+		reload.reverseDNSChanged = true
+	}
+	e.reload = reload
+	atomic.StoreInt32(&e.reloading, 1)
+	e.loaded = &loaded
+
+	log.Printf("Reloaded options of filters and enrichment")
+	return nil
+}
+
+// CopyReloadableConfig copies the options of filters and enrichment, which can
+// be reloaded, from src to dst, including the PIDs, if they are filtered when
+// read.
+func copyReloadableConfig(dst, src *config, pids bool) {
+	dst.filter = src.filter
+	dst.filterExpression = src.filterExpression
+	dst.commands = src.commands
+	if pids {
+		dst.eventPIDs = src.eventPIDs
+	}
+	dst.excludeLocalTraffic = src.excludeLocalTraffic
+	dst.netNSTagging = src.netNSTagging
+	dst.netNSFilter = src.netNSFilter
+	dst.reverseDNS = src.reverseDNS
+	dst.reverseDNSTTL = src.reverseDNSTTL
+	dst.reverseDNSRate = src.reverseDNSRate
+	dst.geoIPDatabases = src.geoIPDatabases
+	dst.hostTags = src.hostTags
+	dst.hostTagHostname = src.hostTagHostname
+	dst.cloudMetadata = src.cloudMetadata
+	dst.direction = src.direction
+}
+
+// Refilter replaces the filter and filter expression of the config shared
+// with the tracing instance with those of cfg, and its kernel filter, if any,
+// restoring them if the kernel rejects the filter. The instance mutex must be
+// held.
+func (e *Eventer) refilter(cfg *config) error {
+	filter, filterExpression := e.config.filter, e.config.filterExpression
+	e.config.filter, e.config.filterExpression = cfg.filter, cfg.filterExpression
+
+	// A tracing instance awaiting recovery is filtered once re-enabled
+	offloader, ok := e.filterOffloader()
+	if !ok || atomic.LoadInt32(&e.recovering) != 0 {
+		return nil
+	}
+
+	if err := offloader.refilter(); err != nil {
+		e.config.filter, e.config.filterExpression = filter, filterExpression
+		if restoreErr := offloader.refilter(); restoreErr != nil {
+			log.Printf("Restoring kernel filter: %v", restoreErr)
+		}
+
+		return fmt.Errorf("replacing kernel filter: %w", err)
+	}
+
+	return nil
+}
+
+// ApplyReload replaces the filters and enrichment of the reader of events with
+// those reloaded.
+func (e *Eventer) applyReload() {
+	e.instanceMutex.Lock()
+	reload := e.reload
+	e.reload = nil
+	atomic.StoreInt32(&e.reloading, 0)
+
+	// The resolver is closed by Close, so is replaced under the instance mutex
+	var replaced *reverseDNSResolver
+	if reload.reverseDNSChanged {
+		replaced, e.reverseDNS = e.reverseDNS, nil
+		if reload.config.reverseDNS && !e.isClosed() {
+			e.reverseDNS = newReverseDNSResolver(net.DefaultResolver.LookupAddr,
+				reload.config.reverseDNSTTL,
+				reload.config.reverseDNSRate)
+		}
+	}
+	e.instanceMutex.Unlock()
+
+	if replaced != nil {
+		replaced.close()
+	}
+
+	// Only the reader of events reads these options of the config
+	e.config.excludeLocalTraffic = reload.config.excludeLocalTraffic
+	e.processFilter = e.newProcessFilter(reload.config)
+	e.netNSTagger = reload.netNSTagger
+	e.geoIP = reload.geoIP
+	e.hostTags = reload.hostTags
+
+	// The sockets already classified are remembered, unless no longer classified
+	switch {
+	case !reload.config.direction:
+		e.classifier = nil
+	case e.classifier == nil:
+		e.classifier = newDirectionClassifier("/proc",
+			e.config.backend == backendConntrack,
+			net.InterfaceAddrs)
+	}
+
+	e.instanceMutex.Lock()
+	e.useFilterExpression()
+	e.instanceMutex.Unlock()
+}
+
+// NewProcessFilter returns the filter of the commands and PIDs of cfg, if any.
+// PIDs are filtered by the set_event_pid file of a tracefs instance, so are
+// otherwise filtered when read.
+func (e *Eventer) newProcessFilter(cfg *config) *processFilter {
+	pids := cfg.eventPIDs
+	if _, ok := e.tracingInstance.(*traceFSTracingInstance); ok {
+		pids = nil
+	}
+
+	return newProcessFilter(cfg.commands, pids)
+}
+
+// WatchForSIGHUP reloads the options of filters and enrichment whenever the
+// process receives SIGHUP, keeping those in effect if they cannot be reloaded.
+func (e *Eventer) watchForSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-signals:
+		}
+
+		log.Printf("Received SIGHUP, reloading options of filters and enrichment")
+		if err := e.Reload(); err != nil {
+			log.Printf("Reloading options: %v", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const mockReloadCapture = "" +
+	"            curl-1234    [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n" +
+	"            curl-1234    [000] ..s.   995.368985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44408 dport=443 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n" +
+	"            curl-1234    [000] ..s.   995.418985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44410 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n" +
+	"            curl-1234    [000] ..s.   995.468985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44412 dport=443 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n"
+
+func newReloadTestEventer(t *testing.T, env map[string]string) *Eventer {
+	expression, err := compileFilterExpression(`dest_port == 443`)
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to compile expression: %v", err)
+	}
+
+	eventer, err := newReplayEventer(newReplaySource(strings.NewReader(mockReloadCapture), "", false),
+		&config{filterExpression: expression})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	eventer.getenv = newMockGetenv(env)
+
+	return eventer
+}
+
+func TestEventerReload(t *testing.T) {
+	eventer := newReloadTestEventer(t, map[string]string{
+		"TCP_AUDIT_TRACEFS_FILTER_EXPRESSION": "dest_port == 80",
+		"TCP_AUDIT_TRACEFS_HOST_TAGS":         "env=prod",
+	})
+	defer eventer.Close()
+
+	event, err := eventer.EventWithContext()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.DestPort != 443 || event.HostTags != nil {
+		t.Errorf("expected untagged event of port 443 before reload, got port %d tagged %v",
+			event.DestPort,
+			event.HostTags)
+	}
+
+	if err := eventer.Reload(); err != nil {
+		t.Fatalf("expected nil reload error, got %q (of type %T)", err, err)
+	}
+
+	event, err = eventer.EventWithContext()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.DestPort != 80 || event.SourcePort != 44410 || event.HostTags["env"] != "prod" {
+		t.Errorf("expected tagged event of port 80 from 44410 after reload, got port %d from %d tagged %v",
+			event.DestPort,
+			event.SourcePort,
+			event.HostTags)
+	}
+}
+
+func TestEventerReloadError(t *testing.T) {
+	eventer := newReloadTestEventer(t, map[string]string{
+		"TCP_AUDIT_TRACEFS_FILTER_EXPRESSION": "dest_port ==",
+	})
+	defer eventer.Close()
+
+	err := eventer.Reload()
+	if err == nil {
+		t.Fatal("expected reload error, got nil")
+	}
+	t.Logf("got error %q (of type %T)", err, err)
+
+	// The options in effect are kept
+	for _, sourcePort := range []uint16{44408, 44412} {
+		event, err := eventer.Event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.SourcePort != sourcePort {
+			t.Errorf("expected event from port %d, got %d", sourcePort, event.SourcePort)
+		}
+	}
+}
+
+func TestEventerReloadClosed(t *testing.T) {
+	eventer := newReloadTestEventer(t, nil)
+	eventer.Close()
+
+	if err := eventer.Reload(); !errors.Is(err, ErrEventerClosed) {
+		t.Errorf("expected ErrEventerClosed, got %q (of type %T)", err, err)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// NewFromReader returns an Eventer which replays a capture of trace_pipe, such
+// as one previously recorded with `cat trace_pipe`, for offline analysis,
+// demonstrations, or the testing of downstream consumers of events. A
+// trace-cmd recording is also replayed, but is buffered in memory unless the
+// reader is an io.ReaderAt. Once the capture is exhausted, Event() returns
+// io.EOF. The eventer is otherwise
+// configured from the environment, as by New(), other than the options of
+// backends, which are ignored. As the clock of the traced machine is unknown,
+// the time of each event is the time at which it is read, but if
+// TCP_AUDIT_TRACEFS_REPLAY_PACED is true, events are read at the pace at which
+// they were traced, according to their trace timestamps.
+func NewFromReader(reader io.Reader) (event.Eventer, error) {
+	config, err := loadConfig(os.Getenv)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+
+	return newReplayEventer(newReplaySource(reader, "", config.replayPaced), config)
+}
+
+// NewReplayEventer returns an Eventer which replays the capture of the replay
+// source, with only the options of cfg which apply to replays.
+func newReplayEventer(replaySource *replaySource, cfg *config) (*Eventer, error) {
+	replayConfig := &config{
+		reportLostEvents:    cfg.reportLostEvents,
+		parseMode:           cfg.parseMode,
+		backend:             backendReplay,
+		numberParsing:       cfg.numberParsing,
+		dedupeWindow:        cfg.dedupeWindow,
+		debounceWindow:      cfg.debounceWindow,
+		maxLineLength:       cfg.maxLineLength,
+		lineReader:          cfg.lineReader,
+		readBufferSize:      cfg.readBufferSize,
+		parserWorkers:       cfg.parserWorkers,
+		parserOrdering:      cfg.parserOrdering,
+		replayPaced:         replaySource.paced,
+		eventPIDs:           cfg.eventPIDs,
+		commands:            cfg.commands,
+		reverseDNS:          cfg.reverseDNS,
+		reverseDNSTTL:       cfg.reverseDNSTTL,
+		reverseDNSRate:      cfg.reverseDNSRate,
+		geoIPDatabases:      cfg.geoIPDatabases,
+		hostTags:            cfg.hostTags,
+		hostTagHostname:     cfg.hostTagHostname,
+		cloudMetadata:       cfg.cloudMetadata,
+		direction:           cfg.direction,
+		mptcp:               cfg.mptcp,
+		filterExpression:    cfg.filterExpression,
+		excludeLocalTraffic: cfg.excludeLocalTraffic,
+		flows:               cfg.flows,
+		flowSummaries:       cfg.flowSummaries,
+		flowTimeout:         cfg.flowTimeout,
+		minFlowDuration:     cfg.minFlowDuration,
+		summaryInterval:     cfg.summaryInterval,
+		eventPooling:        cfg.eventPooling,
+		reloadOnSIGHUP:      cfg.reloadOnSIGHUP,
+	}
+
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), parserTracepointCandidates())
+	eventParser.bestEffort = bestEffortParsing(cfg)
+	eventParser.partial = cfg.parseMode == parseModePartial
+	eventParser.lenientNumbers = cfg.numberParsing == numberParsingLenient
+	eventParser.mptcp = cfg.mptcp
+	eventParser.pooled = cfg.eventPooling
+
+	recording, err := replaySource.openCapture(replayConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var eventer *Eventer
+	if recording != nil {
+		eventer, err = newSourceEventer(recording, eventParser, replayConfig)
+	} else {
+		eventer, err = newLineSourceEventer(replaySource, eventParser, replayConfig)
+	}
+	if err != nil {
+		replaySource.close()
+		return nil, err
+	}
+
+	// The options of a reload are compared with all of those loaded
+	loaded := *cfg
+	eventer.loaded = &loaded
+
+	return eventer, nil
+}
+
+// ReplaySource replays a capture of trace_pipe, rather than reading that of
+// the kernel, as the lines of the capture. The capture is either a reader, or
+// a file which is opened with the capture. If the capture is a trace-cmd
+// recording, its events are replayed by a traceCmdSource instead.
+type replaySource struct {
+	source io.Reader
+	path   string
+	paced  bool
+
+	file     *os.File // The capture file, if opened from its path
+	buffered *bufio.Reader
+	reader   *replayReader
+	pacer    *replayPacer
+	read     uint64 // Accessed atomically, the number of events replayed
+}
+
+// NewReplaySource returns a replay of the capture of the reader, or, if it is
+// nil, of the file of the path.
+func newReplaySource(source io.Reader, path string, paced bool) *replaySource {
+	return &replaySource{
+		source: source,
+		path:   path,
+		paced:  paced,
+		pacer:  newReplayPacer(),
+	}
+}
+
+// OpenCapture opens the capture file, if replaying a file, returning a source
+// of the events of the capture, if it is a trace-cmd recording, which are
+// decoded as configured, or nil if it is a capture of trace_pipe, the lines of
+// which the replay source reads.
+func (rs *replaySource) openCapture(cfg *config) (*traceCmdSource, error) {
+	source := rs.source
+	if source == nil {
+		file, err := os.Open(rs.path)
+		if err != nil {
+			return nil, fmt.Errorf("opening capture: %w", err)
+		}
+		rs.file = file
+		source = file
+	}
+
+	rs.buffered = bufio.NewReader(source)
+	if start, _ := rs.buffered.Peek(len(traceCmdMagic)); !isTraceCmdRecording(start) {
+		return nil, nil
+	}
+
+	recording, ok := source.(io.ReaderAt)
+	if !ok {
+		// The pages of the CPUs are read at once, so are buffered entirely
+		contents, err := ioutil.ReadAll(rs.buffered)
+		if err != nil {
+			rs.closeFile()
+			return nil, fmt.Errorf("reading trace-cmd recording: %w", err)
+		}
+		recording = bytes.NewReader(contents)
+	}
+
+	reader, err := newTraceCmdReader(recording, parserTracepointCandidates(), cfg)
+	if err != nil {
+		rs.closeFile()
+		return nil, fmt.Errorf("decoding trace-cmd recording: %w", err)
+	}
+
+	return &traceCmdSource{replay: rs, reader: reader}, nil
+}
+
+// Open returns a reader of the lines of the capture, which can be opened only
+// once, as the capture is consumed.
+func (rs *replaySource) open() (io.Reader, error) {
+	if rs.buffered == nil {
+		return nil, errors.New("capture not opened")
+	}
+
+	if rs.reader != nil {
+		return nil, errors.New("capture already replayed")
+	}
+	rs.reader = &replayReader{replay: rs, source: rs.buffered}
+
+	return rs.reader, nil
+}
+
+// End returns io.EOF, as the capture is exhausted.
+func (rs *replaySource) end() error {
+	return io.EOF
+}
+
+// Close stops the replay, other than of a read from the capture in progress,
+// and closes the capture file, if it was opened.
+func (rs *replaySource) close() error {
+	log.Printf("Closing capture replay")
+	rs.pacer.close()
+
+	return rs.closeFile()
+}
+
+func (rs *replaySource) closeFile() error {
+	if rs.file == nil {
+		return nil
+	}
+
+	err := rs.file.Close()
+	rs.file = nil
+	if err != nil {
+		return fmt.Errorf("closing capture: %w", err)
+	}
+
+	return nil
+}
+
+// KernelInfo returns only the path of the capture, if replaying a file, as
+// nothing is known of the kernel which traced it.
+func (rs *replaySource) kernelInfo() (*KernelInfo, error) {
+	return &KernelInfo{InstancePath: rs.path}, nil
+}
+
+// BufferStats returns the number of lines or events of the capture replayed as
+// the events read.
+func (rs *replaySource) bufferStats() (*BufferStats, error) {
+	return &BufferStats{ReadEvents: atomic.LoadUint64(&rs.read)}, nil
+}
+
+// SetReadDeadline sets the deadline for the pacing of the replay. A read from
+// the capture itself, such as from a pipe, is not interrupted.
+func (rs *replaySource) setReadDeadline(t time.Time) error {
+	rs.pacer.deadline.set(t)
+	return nil
+}
+
+// ReplayReader reads the lines of a capture, if paced, at the pace at which
+// they were traced.
+type replayReader struct {
+	replay  *replaySource
+	source  *bufio.Reader
+	pending bytes.Buffer // The line not yet read
+	unpaced []byte       // The line the pacing of which was interrupted
+	err     error        // The error of reading the capture, once exhausted
+}
+
+// Read returns the lines of the capture, each once its time has come, if paced.
+// Lines without a timestamp, such as markers of lost events, are not delayed.
+func (r *replayReader) Read(p []byte) (int, error) {
+	for r.pending.Len() == 0 {
+		if r.replay.pacer.closed() {
+			return 0, os.ErrClosed
+		}
+
+		line := r.unpaced
+		r.unpaced = nil
+		if line == nil {
+			if r.err != nil {
+				return 0, r.err
+			}
+
+			var err error
+			if line, err = r.source.ReadBytes('\n'); err != nil {
+				r.err = err
+			}
+
+			if len(line) == 0 {
+				continue
+			}
+		}
+
+		if timestamp, err := lineTraceTimestamp(line); err == nil && r.replay.paced {
+			if err := r.replay.pacer.pace(timestamp); err != nil {
+				r.unpaced = line // Paced again once the deadline is extended
+				return 0, err
+			}
+		}
+		r.pending.Write(line)
+		atomic.AddUint64(&r.replay.read, 1)
+	}
+
+	return r.pending.Read(p)
+}
+
+// TraceCmdSource replays the events of a trace-cmd recording, decoded from its
+// records, if paced, at the pace at which they were traced. As the clock of
+// the traced machine is unknown, the time of each event is the time at which
+// it is read.
+type traceCmdSource struct {
+	replay *replaySource
+	reader *traceCmdReader
+
+	unpaced          *ContextEvent // The event the pacing of which was interrupted
+	unpacedTimestamp traceTimestamp
+}
+
+// Open does nothing, as the recording was opened with the capture.
+func (ts *traceCmdSource) open() error {
+	return nil
+}
+
+// Event returns the next event of the recording, once its time has come, if
+// paced, or io.EOF once the recording is exhausted.
+func (ts *traceCmdSource) event() (*ContextEvent, error) {
+	if ts.replay.pacer.closed() {
+		return nil, os.ErrClosed
+	}
+
+	event, timestamp := ts.unpaced, ts.unpacedTimestamp
+	ts.unpaced = nil
+	if event == nil {
+		var err error
+		if event, timestamp, err = ts.reader.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if ts.replay.paced {
+		if err := ts.replay.pacer.pace(timestamp); err != nil {
+			ts.unpaced, ts.unpacedTimestamp = event, timestamp // Paced again once the deadline is extended
+			return nil, err
+		}
+	}
+	atomic.AddUint64(&ts.replay.read, 1)
+	event.Time = time.Now().UTC()
+
+	return event, nil
+}
+
+func (ts *traceCmdSource) setReadDeadline(t time.Time) error {
+	return ts.replay.setReadDeadline(t)
+}
+
+func (ts *traceCmdSource) kernelInfo() (*KernelInfo, error) {
+	return ts.replay.kernelInfo()
+}
+
+func (ts *traceCmdSource) bufferStats() (*BufferStats, error) {
+	return ts.replay.bufferStats()
+}
+
+func (ts *traceCmdSource) close() error {
+	return ts.replay.close()
+}
+
+// ReplayPacer paces a replay at the pace at which it was traced, so that each
+// event is replayed offset from the first event paced by the difference
+// between their trace timestamps.
+type replayPacer struct {
+	deadline sourceDeadline
+
+	// The trace timestamp of the first event paced, and the time at which it
+	// was replayed, from which the time at which each later event is replayed
+	// is offset
+	paceFrom   traceTimestamp
+	pacedSince time.Time
+
+	done     chan struct{}
+	doneOnce *sync.Once
+}
+
+func newReplayPacer() *replayPacer {
+	return &replayPacer{done: make(chan struct{}), doneOnce: new(sync.Once)}
+}
+
+// Pace waits until the time at which the event of the timestamp is to be
+// replayed, the deadline, or the pacer is closed.
+func (p *replayPacer) pace(timestamp traceTimestamp) error {
+	if p.pacedSince.IsZero() {
+		p.paceFrom, p.pacedSince = timestamp, time.Now()
+		return nil
+	}
+
+	if timestamp.before(p.paceFrom) {
+		return nil // Out of order, as across CPUs, so due already
+	}
+
+	offset := time.Duration(timestamp.sec-p.paceFrom.sec)*time.Second +
+		time.Duration(timestamp.nsec) - time.Duration(p.paceFrom.nsec)
+	due := time.Until(p.pacedSince.Add(offset))
+	if due <= 0 {
+		return nil
+	}
+
+	wait, err := p.deadline.wait(due)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-p.done:
+		return os.ErrClosed
+	case <-timer.C:
+	}
+
+	if wait < due {
+		return os.ErrDeadlineExceeded
+	}
+
+	return nil
+}
+
+func (p *replayPacer) closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *replayPacer) close() {
+	p.doneOnce.Do(func() { close(p.done) })
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mockReplayCapture = "" +
+	"<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n" +
+	"<idle>-0       [000] ..s.   995.368985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_ESTABLISHED newstate=TCP_FIN_WAIT1\n"
+
+func TestReplayEventerEvent(t *testing.T) {
+	source := newReplaySource(strings.NewReader(mockReplayCapture), "", false)
+	eventer, err := newReplayEventer(source, new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	for _, port := range []uint16{44406, 44406} {
+		event, err := eventer.Event()
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if event.SourcePort != port {
+			t.Errorf("expected source port %d, got %d", port, event.SourcePort)
+		}
+	}
+
+	if _, err := eventer.Event(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %q (of type %T)", err, err)
+	}
+
+	if stats, _ := source.bufferStats(); stats.ReadEvents != 2 {
+		t.Errorf("expected 2 read events, got %d", stats.ReadEvents)
+	}
+}
+
+func TestReplayEventerEventFromFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "capture")
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(mockReplayCapture); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	file.Close()
+
+	eventer, err := newReplayEventer(newReplaySource(nil, file.Name(), false), new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	if _, err := eventer.Event(); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestReplaySourceMissingFileError(t *testing.T) {
+	_, err := newReplayEventer(newReplaySource(nil, "/non/existent/capture", false), new(config))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestReplayReaderPaced(t *testing.T) {
+	source := newReplaySource(strings.NewReader(mockReplayCapture), "", true)
+	if _, err := source.openCapture(new(config)); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	reader, err := source.open()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	start := time.Now()
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	// The second line was traced 50ms after the first
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected replay paced over at least 50ms, took %v", elapsed)
+	}
+}
+
+func TestReplayReaderPacedDeadlineExceeded(t *testing.T) {
+	source := newReplaySource(strings.NewReader(mockReplayCapture), "", true)
+	if _, err := source.openCapture(new(config)); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	reader, err := source.open()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	buf := make([]byte, len(mockReplayCapture))
+	if _, err := reader.Read(buf); err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	source.setReadDeadline(time.Now().Add(time.Millisecond))
+	if _, err := reader.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded error, got %q (of type %T)", err, err)
+	}
+
+	// The interrupted line is paced again, rather than lost
+	source.setReadDeadline(time.Time{})
+	n, err := reader.Read(buf)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if line := string(buf[:n]); !strings.Contains(line, "newstate=TCP_FIN_WAIT1") {
+		t.Errorf("expected second line, got %q", line)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	lockdownPath          = "/sys/kernel/security/lockdown"
+	perfEventParanoidPath = "/proc/sys/kernel/perf_event_paranoid"
+
+	// PerfEventParanoidRestricted is the level above which some distributions
+	// (e.g. Debian) restrict all unprivileged perf and tracing use.
+	perfEventParanoidRestricted = 2
+)
+
+// RestrictedTracingError is an error returned if enabling tracing was denied
+// despite running as root, and the kernel is found to be restricting tracing.
+type RestrictedTracingError struct {
+	// Lockdown is the active kernel lockdown mode (e.g. "integrity" or
+	// "confidentiality"), or empty if lockdown is not active or unknown.
+	Lockdown string
+	// PerfEventParanoid is the perf_event_paranoid level, if it is known and
+	// restrictive, otherwise nil.
+	PerfEventParanoid *int
+	// Err is the permission error encountered.
+	Err error
+}
+
+func (e *RestrictedTracingError) Error() string {
+	reasons := make([]string, 0, 2)
+	if e.Lockdown != "" {
+		reasons = append(reasons, fmt.Sprintf("kernel lockdown is in %s mode, "+
+			"which restricts tracefs and kprobes even for root", e.Lockdown))
+	}
+
+	if e.PerfEventParanoid != nil {
+		reasons = append(reasons, fmt.Sprintf("perf_event_paranoid is %d, "+
+			"which restricts tracing", *e.PerfEventParanoid))
+	}
+
+	return "tracing restricted by kernel (" + strings.Join(reasons, "; ") + "): " + e.Err.Error()
+}
+
+func (e *RestrictedTracingError) Unwrap() error {
+	return e.Err
+}
+
+// ProbeTracingRestrictions reads the kernel lockdown and perf_event_paranoid
+// settings. If neither restricts tracing, nil is returned, otherwise an error
+// wrapping err and describing the restrictions.
+func probeTracingRestrictions(lockdownPath, perfEventParanoidPath string, err error) *RestrictedTracingError {
+	restrictedErr := &RestrictedTracingError{Err: err}
+
+	if lockdown, err := ioutil.ReadFile(lockdownPath); err == nil {
+		restrictedErr.Lockdown = parseLockdown(string(lockdown))
+	}
+
+	if paranoid, err := ioutil.ReadFile(perfEventParanoidPath); err == nil {
+		if level, err := strconv.Atoi(strings.TrimSpace(string(paranoid))); err == nil &&
+			level > perfEventParanoidRestricted {
+			restrictedErr.PerfEventParanoid = &level
+		}
+	}
+
+	if restrictedErr.Lockdown == "" && restrictedErr.PerfEventParanoid == nil {
+		return nil
+	}
+
+	return restrictedErr
+}
+
+// ParseLockdown returns the active mode from the contents of the lockdown file,
+// which lists all modes with the active one in brackets, e.g.
+// "none [integrity] confidentiality". If the active mode is none, or cannot be
+// determined, empty is returned.
+func parseLockdown(lockdown string) string {
+	for _, mode := range strings.Fields(lockdown) {
+		if strings.HasPrefix(mode, "[") && strings.HasSuffix(mode, "]") {
+			mode = strings.Trim(mode, "[]")
+			if mode == "none" {
+				return ""
+			}
+
+			return mode
+		}
+	}
+
+	return ""
+}
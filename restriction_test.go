@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func createMockRestrictionFiles(t *testing.T, lockdown, perfEventParanoid string) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create temp directory: %v", err)
+	}
+
+	if err := ioutil.WriteFile(dir+"/lockdown", []byte(lockdown), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock lockdown file: %v", err)
+	}
+
+	if err := ioutil.WriteFile(dir+"/perf_event_paranoid", []byte(perfEventParanoid), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock perf_event_paranoid file: %v", err)
+	}
+
+	return dir + "/lockdown", dir + "/perf_event_paranoid", func() { os.RemoveAll(dir) }
+}
+
+func TestParseLockdown(t *testing.T) {
+	for lockdown, expected := range map[string]string{
+		"[none] integrity confidentiality\n": "",
+		"none [integrity] confidentiality\n": "integrity",
+		"none integrity [confidentiality]\n": "confidentiality",
+		"":                                   "",
+	} {
+		if mode := parseLockdown(lockdown); mode != expected {
+			t.Errorf("expected lockdown mode %q from %q, got %q", expected, lockdown, mode)
+		}
+	}
+}
+
+func TestProbeTracingRestrictions(t *testing.T) {
+	mockLockdownPath, mockPerfEventParanoidPath, undoFunc := createMockRestrictionFiles(t,
+		"none integrity [confidentiality]\n",
+		"3\n")
+	defer undoFunc()
+
+	mockError := &os.PathError{Op: "open", Path: "/mock/path", Err: syscall.EPERM}
+	restrictedErr := probeTracingRestrictions(mockLockdownPath, mockPerfEventParanoidPath, mockError)
+	if restrictedErr == nil {
+		t.Fatal("expected restricted tracing error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", restrictedErr, restrictedErr)
+
+	if restrictedErr.Lockdown != "confidentiality" {
+		t.Errorf("expected lockdown %q, got %q", "confidentiality", restrictedErr.Lockdown)
+	}
+
+	if restrictedErr.PerfEventParanoid == nil || *restrictedErr.PerfEventParanoid != 3 {
+		t.Errorf("expected perf_event_paranoid 3, got %v", restrictedErr.PerfEventParanoid)
+	}
+
+	if !errors.Is(restrictedErr, syscall.EPERM) {
+		t.Errorf("expected error chain to include %q, but did not", syscall.EPERM)
+	}
+}
+
+func TestProbeTracingRestrictionsUnrestricted(t *testing.T) {
+	mockLockdownPath, mockPerfEventParanoidPath, undoFunc := createMockRestrictionFiles(t,
+		"[none] integrity confidentiality\n",
+		"2\n")
+	defer undoFunc()
+
+	restrictedErr := probeTracingRestrictions(mockLockdownPath, mockPerfEventParanoidPath, syscall.EPERM)
+	if restrictedErr != nil {
+		t.Errorf("expected nil restricted tracing error, got %q", restrictedErr)
+	}
+}
+
+func TestTracingInstanceEnableRestrictedTracingError(t *testing.T) {
+	mockLockdownPath, mockPerfEventParanoidPath, undoFunc := createMockRestrictionFiles(t,
+		"none [integrity] confidentiality\n",
+		"2\n")
+	defer undoFunc()
+
+	mockError := &os.PathError{Op: "open", Path: "/mock/path", Err: syscall.EPERM}
+	mockMountpointRetriever := newMockMountpointRetriever("", mockError)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever, nil, nil, new(config))
+	tracingInstance.geteuid = func() int { return 0 }
+	tracingInstance.lockdownPath = mockLockdownPath
+	tracingInstance.perfEventParanoidPath = mockPerfEventParanoidPath
+
+	err := tracingInstance.enable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	restrictedErr := new(RestrictedTracingError)
+	if !errors.As(err, &restrictedErr) {
+		t.Fatalf("expected error chain to include %T, but did not", restrictedErr)
+	}
+
+	if restrictedErr.Lockdown != "integrity" {
+		t.Errorf("expected lockdown %q, got %q", "integrity", restrictedErr.Lockdown)
+	}
+}
+
+func TestTracingInstanceEnablePermissionErrorNotRoot(t *testing.T) {
+	mockLockdownPath, mockPerfEventParanoidPath, undoFunc := createMockRestrictionFiles(t,
+		"none [integrity] confidentiality\n",
+		"3\n")
+	defer undoFunc()
+
+	mockError := &os.PathError{Op: "open", Path: "/mock/path", Err: syscall.EPERM}
+	mockMountpointRetriever := newMockMountpointRetriever("", mockError)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever, nil, nil, new(config))
+	tracingInstance.geteuid = func() int { return 1000 }
+	tracingInstance.lockdownPath = mockLockdownPath
+	tracingInstance.perfEventParanoidPath = mockPerfEventParanoidPath
+
+	err := tracingInstance.enable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	restrictedErr := new(RestrictedTracingError)
+	if errors.As(err, &restrictedErr) {
+		t.Errorf("expected error chain not to include %T, but did", restrictedErr)
+	}
+}
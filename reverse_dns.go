@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ReverseDNSTimeout is the longest a lookup of an address may take.
+	reverseDNSTimeout = 5 * time.Second
+
+	// ReverseDNSQueueLength is the most addresses awaiting lookup, beyond which
+	// further misses are not looked up until they are missed again.
+	reverseDNSQueueLength = 1024
+
+	// ReverseDNSMaxEntries is the most addresses cached, beyond which those
+	// missed are not queued until the entry soonest to expire has expired.
+	reverseDNSMaxEntries = 65536
+)
+
+// ReverseDNSEntry is the hostname of an address, or empty if it has none or
+// its lookup failed, which is cached until it expires. An entry which is
+// pending has been queued for lookup, so is not queued again, and is not in
+// the list of expiries, so has no element.
+type reverseDNSEntry struct {
+	host    string
+	expires time.Time
+	pending bool
+	element *list.Element // Of the list of expiries, holding the address
+}
+
+// ReverseDNSResolver annotates addresses with their hostnames, as resolved by
+// reverse DNS, without blocking the reader of events. An address not cached
+// has no hostname until it is looked up in the background, at most at the
+// rate, and is cached, as are failures, for the TTL. It is safe for concurrent
+// use.
+type reverseDNSResolver struct {
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	ttl        time.Duration
+	interval   time.Duration // Between lookups, of the rate
+
+	mutex    *sync.Mutex
+	entries  map[string]*reverseDNSEntry // By address
+	expiries *list.List                  // Of the addresses resolved, soonest first
+	queue    chan string
+
+	done      chan struct{}
+	closeOnce *sync.Once
+	wg        *sync.WaitGroup
+}
+
+// NewReverseDNSResolver returns a resolver of addresses by the lookup, which
+// caches them for the TTL, and looks them up at most at the rate per second.
+// It must be closed once no longer needed.
+func newReverseDNSResolver(lookupAddr func(ctx context.Context, addr string) ([]string, error),
+	ttl time.Duration,
+	rate float64) *reverseDNSResolver {
+	resolver := &reverseDNSResolver{
+		lookupAddr: lookupAddr,
+		ttl:        ttl,
+		interval:   time.Duration(float64(time.Second) / rate),
+		mutex:      new(sync.Mutex),
+		entries:    make(map[string]*reverseDNSEntry),
+		expiries:   list.New(),
+		queue:      make(chan string, reverseDNSQueueLength),
+		done:       make(chan struct{}),
+		closeOnce:  new(sync.Once),
+		wg:         new(sync.WaitGroup),
+	}
+
+	resolver.wg.Add(1)
+	go resolver.run()
+
+	return resolver
+}
+
+// Annotate sets the hostnames of the addresses of the event which are cached.
+// Markers of lost events have no addresses.
+func (r *reverseDNSResolver) annotate(event *ContextEvent) {
+	if event.Kind == KindLostEvents {
+		return
+	}
+
+	event.SourceHost = r.hostname(event.SourceIP)
+	event.DestHost = r.hostname(event.DestIP)
+}
+
+// Hostname returns the cached hostname of the address, if any, otherwise
+// queueing it for lookup, if not already queued.
+func (r *reverseDNSResolver) hostname(ip net.IP) string {
+	if ip == nil || ip.IsUnspecified() {
+		return ""
+	}
+	addr := ip.String()
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.entries[addr]
+	if ok && (entry.pending || now.Before(entry.expires)) {
+		return entry.host
+	}
+
+	// An expired hostname is returned while it is looked up again
+	select {
+	case r.queue <- addr:
+		if !ok {
+			if !r.makeRoom(now) {
+				return ""
+			}
+			entry = new(reverseDNSEntry)
+			r.entries[addr] = entry
+		} else {
+			r.expiries.Remove(entry.element)
+			entry.element = nil
+		}
+		entry.pending = true
+	default:
+	}
+
+	if entry == nil {
+		return ""
+	}
+
+	return entry.host
+}
+
+// MakeRoom prunes the entry soonest to expire if the cache is full and it has
+// expired, returning whether there is room for another. As every entry is
+// cached for the same TTL, the list of expiries is ordered by when they were
+// resolved, so the entry soonest to expire is at its front.
+func (r *reverseDNSResolver) makeRoom(now time.Time) bool {
+	if len(r.entries) < reverseDNSMaxEntries {
+		return true
+	}
+
+	front := r.expiries.Front()
+	if front == nil {
+		return false
+	}
+	addr := front.Value.(string)
+	if now.Before(r.entries[addr].expires) {
+		return false
+	}
+	r.expiries.Remove(front)
+	delete(r.entries, addr)
+
+	return true
+}
+
+// Run looks up the addresses queued, at most at the rate, until closed.
+func (r *reverseDNSResolver) run() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.done
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case addr := <-r.queue:
+			r.resolve(ctx, addr)
+		}
+
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Resolve looks up the address, caching its hostname, or none if the lookup
+// failed, for the TTL.
+func (r *reverseDNSResolver) resolve(ctx context.Context, addr string) {
+	ctx, cancel := context.WithTimeout(ctx, reverseDNSTimeout)
+	defer cancel()
+
+	var host string
+	if names, err := r.lookupAddr(ctx, addr); err == nil && len(names) > 0 {
+		host = strings.TrimSuffix(names[0], ".")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.entries[addr]
+	if !ok {
+		return
+	}
+	// An address may have been queued twice if it was not cached the first time
+	if entry.element != nil {
+		r.expiries.Remove(entry.element)
+	}
+	entry.host, entry.pending, entry.expires = host, false, time.Now().Add(r.ttl)
+	entry.element = r.expiries.PushBack(addr)
+}
+
+// Close stops the lookups, waiting for any in progress to be cancelled.
+func (r *reverseDNSResolver) close() {
+	r.closeOnce.Do(func() { close(r.done) })
+	r.wg.Wait()
+}
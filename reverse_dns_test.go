@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// NewMockLookupAddr returns a lookup which resolves only 172.217.169.4,
+// counting the lookups made.
+func newMockLookupAddr(lookups *int32) func(ctx context.Context, addr string) ([]string, error) {
+	return func(ctx context.Context, addr string) ([]string, error) {
+		atomic.AddInt32(lookups, 1)
+		if addr == "172.217.169.4" {
+			return []string{"lhr48s08-in-f4.1e100.net."}, nil
+		}
+
+		return nil, errors.New("mock lookup error")
+	}
+}
+
+// AwaitHostname returns the hostname of the address once it is resolved, or
+// empty if it is not within a second.
+func awaitHostname(resolver *reverseDNSResolver, ip net.IP) string {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		resolver.mutex.Lock()
+		entry, ok := resolver.entries[ip.String()]
+		resolved := ok && !entry.pending
+		resolver.mutex.Unlock()
+
+		if resolved {
+			return resolver.hostname(ip)
+		}
+	}
+
+	return ""
+}
+
+func TestReverseDNSResolverHostname(t *testing.T) {
+	var lookups int32
+	resolver := newReverseDNSResolver(newMockLookupAddr(&lookups), time.Minute, 1000)
+	defer resolver.close()
+
+	ip := net.IPv4(172, 217, 169, 4)
+
+	// The first miss is not blocked by the lookup
+	if host := resolver.hostname(ip); host != "" {
+		t.Errorf("expected no hostname before lookup, got %q", host)
+	}
+
+	if host := awaitHostname(resolver, ip); host != "lhr48s08-in-f4.1e100.net" {
+		t.Errorf("expected hostname %q, got %q", "lhr48s08-in-f4.1e100.net", host)
+	}
+
+	// Hits are cached
+	resolver.hostname(ip)
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("expected 1 lookup, got %d", n)
+	}
+}
+
+func TestReverseDNSResolverHostnameFailureCached(t *testing.T) {
+	var lookups int32
+	resolver := newReverseDNSResolver(newMockLookupAddr(&lookups), time.Minute, 1000)
+	defer resolver.close()
+
+	ip := net.IPv4(192, 168, 122, 38)
+	resolver.hostname(ip)
+	if host := awaitHostname(resolver, ip); host != "" {
+		t.Errorf("expected no hostname, got %q", host)
+	}
+
+	resolver.hostname(ip)
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("expected 1 lookup, got %d", n)
+	}
+}
+
+func TestReverseDNSResolverAnnotateLostEvents(t *testing.T) {
+	var lookups int32
+	resolver := newReverseDNSResolver(newMockLookupAddr(&lookups), time.Minute, 1000)
+	defer resolver.close()
+
+	resolver.annotate(&ContextEvent{Event: new(event.Event), Kind: KindLostEvents})
+
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	if len(resolver.entries) != 0 {
+		t.Errorf("expected no addresses queued, got %d", len(resolver.entries))
+	}
+}
+
+func TestReverseDNSResolverMakeRoom(t *testing.T) {
+	var lookups int32
+	resolver := newReverseDNSResolver(newMockLookupAddr(&lookups), time.Minute, 1000)
+	defer resolver.close()
+
+	now := time.Now()
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	for i := 0; i < reverseDNSMaxEntries; i++ {
+		addr := net.IPv4(10, 0, byte(i>>8), byte(i)).String()
+		entry := &reverseDNSEntry{expires: now.Add(time.Duration(i) * time.Second)}
+		entry.element = resolver.expiries.PushBack(addr)
+		resolver.entries[addr] = entry
+	}
+
+	// Only the entry soonest to expire is pruned, once expired
+	if resolver.makeRoom(now.Add(-time.Second)) {
+		t.Error("expected no room before expiry")
+	}
+	if !resolver.makeRoom(now) {
+		t.Error("expected room after expiry")
+	}
+	if _, ok := resolver.entries["10.0.0.0"]; ok {
+		t.Error("expected entry soonest to expire to be pruned")
+	}
+	if n := len(resolver.entries); n != reverseDNSMaxEntries-1 {
+		t.Errorf("expected %d entries, got %d", reverseDNSMaxEntries-1, n)
+	}
+	if n := resolver.expiries.Len(); n != reverseDNSMaxEntries-1 {
+		t.Errorf("expected %d expiries, got %d", reverseDNSMaxEntries-1, n)
+	}
+}
+
+func TestReverseDNSResolverExpiredRequeued(t *testing.T) {
+	var lookups int32
+	resolver := newReverseDNSResolver(newMockLookupAddr(&lookups), time.Minute, 1000)
+	defer resolver.close()
+
+	ip := net.IPv4(172, 217, 169, 4)
+	resolver.hostname(ip)
+	awaitHostname(resolver, ip)
+
+	resolver.mutex.Lock()
+	resolver.entries[ip.String()].expires = time.Now()
+	resolver.mutex.Unlock()
+
+	// The expired entry is looked up again, and is listed only once resolved
+	resolver.hostname(ip)
+	awaitHostname(resolver, ip)
+
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Errorf("expected 2 lookups, got %d", n)
+	}
+	if n := resolver.expiries.Len(); n != 1 {
+		t.Errorf("expected 1 expiry, got %d", n)
+	}
+}
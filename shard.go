@@ -0,0 +1,201 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ShardReorderWindow is the time for which parsed events are held before they
+// are released, so that events of different CPUs which arrive within this time
+// of each other are released in the order in which they occurred.
+const shardReorderWindow = 10 * time.Millisecond
+
+// ShardResult is the outcome of reading and parsing a line from the trace_pipe
+// of a CPU.
+type shardResult struct {
+	timestamp traceTimestamp
+	arrived   time.Time
+	event     *ContextEvent
+	err       error
+}
+
+// ShardResultHeap is a min-heap of shard results, ordered by trace timestamp.
+type shardResultHeap []*shardResult
+
+func (h shardResultHeap) Len() int           { return len(h) }
+func (h shardResultHeap) Less(i, j int) bool { return h[i].timestamp.before(h[j].timestamp) }
+func (h shardResultHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *shardResultHeap) Push(x interface{}) {
+	*h = append(*h, x.(*shardResult))
+}
+
+func (h *shardResultHeap) Pop() interface{} {
+	old := *h
+	result := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return result
+}
+
+// ShardedReader reads and parses the events of each CPU in its own goroutine,
+// and merges them into a single stream ordered by trace timestamp. As a CPU may
+// be idle indefinitely, the merge cannot wait for an event from every CPU, so
+// instead holds each event for the reorder window.
+type shardedReader struct {
+	eventParser    eventParser
+	skipped        *skipCounters
+	failures       *failureCounters
+	lineReader     string
+	maxLineLength  int
+	readBufferSize int
+	window         time.Duration
+	results        chan *shardResult
+	done           <-chan struct{}
+	pending        shardResultHeap // Only accessed by the caller of next
+}
+
+func newShardedReader(readers []io.Reader,
+	eventParser eventParser,
+	skipped *skipCounters,
+	failures *failureCounters,
+	lineReader string,
+	maxLineLength int,
+	readBufferSize int,
+	window time.Duration,
+	done <-chan struct{}) *shardedReader {
+	sr := &shardedReader{
+		eventParser:    eventParser,
+		skipped:        skipped,
+		failures:       failures,
+		lineReader:     lineReader,
+		maxLineLength:  maxLineLength,
+		readBufferSize: readBufferSize,
+		window:         window,
+		results:        make(chan *shardResult, 64*len(readers)),
+		done:           done,
+	}
+
+	for _, reader := range readers {
+		go sr.readShard(reader)
+	}
+
+	return sr
+}
+
+// ReadShard reads and parses lines from the reader until reading fails, which
+// for a trace_pipe is only once it is closed, then sends the failure.
+func (sr *shardedReader) readShard(reader io.Reader) {
+	var last traceTimestamp
+	scanner := newLineReader(reader, sr.lineReader, sr.maxLineLength, sr.readBufferSize, &sr.skipped.oversize)
+	for scanner.Scan() {
+		result := sr.parseLine(scanner.Bytes(), last)
+		if result == nil {
+			continue
+		}
+		last = result.timestamp
+
+		if !sr.send(result) {
+			return
+		}
+	}
+
+	// No error is still an error - a ring buffer should never return EOF,
+	// instead, reads should block until something is written
+	err := io.ErrUnexpectedEOF
+	if scanErr := scanner.Err(); scanErr != nil {
+		err = fmt.Errorf("scanning for event: %w", scanErr)
+	}
+	sr.send(&shardResult{timestamp: last, arrived: time.Now(), err: err})
+}
+
+// ParseLine parses a line into a result, or returns nil if the line is to be
+// skipped. Results without a timestamp of their own, such as lost events
+// markers, are given that of the last line of the CPU, so stay in sequence.
+func (sr *shardedReader) parseLine(line []byte, last traceTimestamp) *shardResult {
+	if len(trimLinePadding(line)) == 0 {
+		atomic.AddUint64(&sr.skipped.empty, 1)
+		return nil
+	}
+
+	result := &shardResult{timestamp: last, arrived: time.Now()}
+	if lostEventsErr, ok := parseLostEventsMarker(line); ok {
+		result.err = lostEventsErr
+		return result
+	}
+
+	timestamp, err := lineTraceTimestamp(line)
+	if err != nil {
+		result.err = fmt.Errorf("parsing event timestamp: %w", err)
+		return result
+	}
+	result.timestamp = timestamp
+
+	event, err := sr.eventParser.toEvent(line)
+	if err != nil {
+		if errors.Is(err, ErrIrrelevantEvent) {
+			sr.skipped.countIrrelevant(err)
+			return nil
+		}
+		sr.failures.count(err)
+
+		result.err = fmt.Errorf("parsing event: %w", err)
+		return result
+	}
+	result.event = event
+
+	return result
+}
+
+func (sr *shardedReader) send(result *shardResult) bool {
+	select {
+	case sr.results <- result:
+		return true
+	case <-sr.done:
+		return false
+	}
+}
+
+// Next returns the earliest pending result, once it has been held for the
+// reorder window. If the deadline channel fires first, os.ErrDeadlineExceeded
+// is returned, or if the reader is done, ErrEventerClosed is returned.
+func (sr *shardedReader) next(deadline <-chan time.Time) (*shardResult, error) {
+	for {
+		var timer *time.Timer
+		var release <-chan time.Time
+		if len(sr.pending) > 0 {
+			wait := time.Until(sr.pending[0].arrived.Add(sr.window))
+			if wait <= 0 {
+				return heap.Pop(&sr.pending).(*shardResult), nil
+			}
+
+			timer = time.NewTimer(wait)
+			release = timer.C
+		}
+
+		var err error
+		select {
+		case result := <-sr.results:
+			heap.Push(&sr.pending, result)
+		case <-release:
+		case <-deadline:
+			err = os.ErrDeadlineExceeded
+		case <-sr.done:
+			err = ErrEventerClosed
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
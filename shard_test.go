@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	mockEarlierShardEvent = "<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n"
+	mockLaterShardEvent   = "<idle>-0       [001] ..s.   995.318986: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_ESTABLISHED newstate=TCP_FIN_WAIT1\n"
+)
+
+func TestShardedReaderOrdersEventsAcrossShards(t *testing.T) {
+	cpu0Reader, cpu0Writer := io.Pipe()
+	defer cpu0Writer.Close()
+	cpu1Reader, cpu1Writer := io.Pipe()
+	defer cpu1Writer.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), defaultTracepointCandidates)
+	shardedReader := newShardedReader([]io.Reader{cpu0Reader, cpu1Reader},
+		eventParser,
+		new(skipCounters),
+		new(failureCounters),
+		"",
+		0,
+		0,
+		200*time.Millisecond,
+		done)
+
+	// The later event arrives first, from another CPU
+	go func() {
+		io.WriteString(cpu1Writer, mockLaterShardEvent)
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(cpu0Writer, mockEarlierShardEvent)
+	}()
+
+	for _, expectedNewState := range []string{"ESTABLISHED", "FIN-WAIT-1"} {
+		result, err := shardedReader.next(nil)
+		if err != nil {
+			t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+		}
+
+		if result.err != nil {
+			t.Fatalf("expected nil result error, got %q (of type %T)", result.err, result.err)
+		}
+
+		if result.event.NewState.String() != expectedNewState {
+			t.Errorf("expected event with new state %s, got %s",
+				expectedNewState,
+				result.event.NewState)
+		}
+	}
+}
+
+func TestShardedReaderDeadlineExceededError(t *testing.T) {
+	cpu0Reader, cpu0Writer := io.Pipe()
+	defer cpu0Writer.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), defaultTracepointCandidates)
+	shardedReader := newShardedReader([]io.Reader{cpu0Reader},
+		eventParser,
+		new(skipCounters),
+		new(failureCounters),
+		"",
+		0,
+		0,
+		shardReorderWindow,
+		done)
+
+	_, err := shardedReader.next(time.After(10 * time.Millisecond))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected error chain to include %q, but did not", os.ErrDeadlineExceeded)
+	}
+}
+
+func TestShardedReaderDoneError(t *testing.T) {
+	cpu0Reader, cpu0Writer := io.Pipe()
+	defer cpu0Writer.Close()
+
+	done := make(chan struct{})
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), defaultTracepointCandidates)
+	shardedReader := newShardedReader([]io.Reader{cpu0Reader},
+		eventParser,
+		new(skipCounters),
+		new(failureCounters),
+		"",
+		0,
+		0,
+		shardReorderWindow,
+		done)
+	close(done)
+
+	_, err := shardedReader.next(nil)
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, ErrEventerClosed) {
+		t.Errorf("expected error chain to include %q, but did not", ErrEventerClosed)
+	}
+}
+
+func TestShardedReaderReadError(t *testing.T) {
+	cpu0Reader, cpu0Writer := io.Pipe()
+	mockError := errors.New("mock read error")
+	cpu0Writer.CloseWithError(mockError)
+
+	done := make(chan struct{})
+	defer close(done)
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), defaultTracepointCandidates)
+	shardedReader := newShardedReader([]io.Reader{cpu0Reader},
+		eventParser,
+		new(skipCounters),
+		new(failureCounters),
+		"",
+		0,
+		0,
+		shardReorderWindow,
+		done)
+
+	result, err := shardedReader.next(nil)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	t.Logf("got result error %q (of type %T)", result.err, result.err)
+
+	if !errors.Is(result.err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+}
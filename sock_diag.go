@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// The parts of the sock_diag(7) netlink ABI needed to dump TCP sockets.
+const (
+	sockDiagByFamily = 20
+
+	// InetDiagReqV2Size is the size of the struct inet_diag_req_v2 of a dump
+	// request, and inetDiagMsgSize that of the struct inet_diag_msg of each
+	// socket dumped.
+	inetDiagReqV2Size = 56
+	inetDiagMsgSize   = 72
+
+	// InetDiagAllStates is the mask of the states of the sockets dumped.
+	inetDiagAllStates = ^uint32(0)
+
+	tcpStateClose  = 7
+	tcpStateListen = 10
+)
+
+// KernelTCPStates are the kernel names of TCP states, by their value, as
+// printed by the tracepoints.
+var kernelTCPStates = map[uint8]string{
+	1:  "TCP_ESTABLISHED",
+	2:  "TCP_SYN_SENT",
+	3:  "TCP_SYN_RECV",
+	4:  "TCP_FIN_WAIT1",
+	5:  "TCP_FIN_WAIT2",
+	6:  "TCP_TIME_WAIT",
+	7:  "TCP_CLOSE",
+	8:  "TCP_CLOSE_WAIT",
+	9:  "TCP_LAST_ACK",
+	10: "TCP_LISTEN",
+	11: "TCP_CLOSING",
+	12: "TCP_NEW_SYN_RECV",
+	13: "TCP_BOUND_INACTIVE",
+}
+
+// InetDiagSocket is a TCPv4 socket dumped by sock_diag.
+type inetDiagSocket struct {
+	state        uint8
+	sport, dport uint16
+	saddr, daddr [4]byte
+	cookie       uint64
+	inode        uint32
+}
+
+// SockDiagKey identifies a socket across dumps. Sockets are identified by
+// their 4-tuple, rather than their cookie, so that a connection keeps its
+// identity as the kernel replaces its socket, such as by a request socket
+// while in SYN-RECEIVED, or by a timewait socket in TIME-WAIT. Listening
+// sockets, which may share their address, are also identified by cookie.
+type sockDiagKey struct {
+	saddr, daddr [4]byte
+	sport, dport uint16
+	cookie       uint64
+}
+
+func (s *inetDiagSocket) key() sockDiagKey {
+	key := sockDiagKey{saddr: s.saddr, daddr: s.daddr, sport: s.sport, dport: s.dport}
+	if s.state == tcpStateListen {
+		key.cookie = s.cookie
+	}
+
+	return key
+}
+
+// SockDiagConn is a netlink socket of the sock_diag family.
+type sockDiagConn struct {
+	fd  int
+	seq uint32
+}
+
+func newSockDiagConn() (*sockDiagConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC,
+		syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	return &sockDiagConn{fd: fd}, nil
+}
+
+// Dump returns the TCPv4 sockets of all states of the network namespace of the
+// eventer.
+func (c *sockDiagConn) dump() ([]*inetDiagSocket, error) {
+	c.seq++
+	if err := syscall.Sendto(c.fd,
+		newInetDiagDumpRequest(c.seq),
+		0,
+		&syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	var sockets []*inetDiagSocket
+	buf := make([]byte, os.Getpagesize()*8)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+
+		done, err := decodeInetDiagResponse(buf[:n], c.seq, &sockets)
+		if err != nil {
+			return nil, err
+		}
+
+		if done {
+			return sockets, nil
+		}
+	}
+}
+
+func (c *sockDiagConn) close() error {
+	if err := syscall.Close(c.fd); err != nil {
+		return os.NewSyscallError("close", err)
+	}
+
+	return nil
+}
+
+// NewInetDiagDumpRequest returns the netlink message requesting a dump of the
+// TCPv4 sockets of all states.
+func newInetDiagDumpRequest(seq uint32) []byte {
+	request := make([]byte, syscall.NLMSG_HDRLEN+inetDiagReqV2Size)
+	hostByteOrder.PutUint32(request[0:], uint32(len(request)))
+	hostByteOrder.PutUint16(request[4:], sockDiagByFamily)
+	hostByteOrder.PutUint16(request[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	hostByteOrder.PutUint32(request[8:], seq)
+
+	// The struct inet_diag_req_v2, with a zero socket ID, which matches all
+	body := request[syscall.NLMSG_HDRLEN:]
+	body[0] = syscall.AF_INET
+	body[1] = syscall.IPPROTO_TCP
+	hostByteOrder.PutUint32(body[4:], inetDiagAllStates)
+
+	return request
+}
+
+// DecodeInetDiagResponse appends the sockets of the netlink messages received
+// in response to the dump request of the sequence number, returning whether the
+// dump is done.
+func decodeInetDiagResponse(response []byte, seq uint32, sockets *[]*inetDiagSocket) (bool, error) {
+	messages, err := syscall.ParseNetlinkMessage(response)
+	if err != nil {
+		return false, fmt.Errorf("parsing netlink messages: %w", err)
+	}
+
+	for _, message := range messages {
+		if message.Header.Seq != seq {
+			continue // A response to an abandoned dump
+		}
+
+		switch message.Header.Type {
+		case syscall.NLMSG_DONE:
+			return true, nil
+		case syscall.NLMSG_ERROR:
+			if len(message.Data) < 4 {
+				return false, fmt.Errorf("netlink error of %d bytes too short", len(message.Data))
+			}
+			errno := syscall.Errno(-int32(hostByteOrder.Uint32(message.Data)))
+			return false, os.NewSyscallError("sock_diag", errno)
+		case sockDiagByFamily:
+			socket, err := decodeInetDiagMsg(message.Data)
+			if err != nil {
+				return false, err
+			}
+			*sockets = append(*sockets, socket)
+		}
+	}
+
+	return false, nil
+}
+
+// DecodeInetDiagMsg decodes the struct inet_diag_msg of a socket. The ports
+// and addresses of its socket ID are in network byte order.
+func decodeInetDiagMsg(msg []byte) (*inetDiagSocket, error) {
+	if len(msg) < inetDiagMsgSize {
+		return nil, fmt.Errorf("inet_diag_msg of %d bytes too short", len(msg))
+	}
+
+	socket := &inetDiagSocket{
+		state:  msg[1],
+		sport:  binary.BigEndian.Uint16(msg[4:]),
+		dport:  binary.BigEndian.Uint16(msg[6:]),
+		cookie: uint64(hostByteOrder.Uint32(msg[44:])) | uint64(hostByteOrder.Uint32(msg[48:]))<<32,
+		inode:  hostByteOrder.Uint32(msg[68:]),
+	}
+	copy(socket.saddr[:], msg[8:8+net.IPv4len])
+	copy(socket.daddr[:], msg[24:24+net.IPv4len])
+
+	return socket, nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// SockDiagSource periodically dumps the TCPv4 sockets of the kernel with
+// sock_diag(7), and synthesizes the state changes between successive dumps. It
+// needs no tracing facility, so is a last resort where none is available to
+// the eventer. Transitions through which a socket passed between dumps are
+// not seen, and the task of each transition is that which owns the socket
+// when it is dumped, if any.
+type sockDiagSource struct {
+	read     uint64 // Accessed atomically, the number of state changes synthesized
+	deadline sourceDeadline
+
+	config *config
+
+	conn     *sockDiagConn
+	sockets  map[sockDiagKey]*inetDiagSocket // The sockets of the last dump
+	dump     func() ([]*inetDiagSocket, error)
+	dumpLock *sync.Mutex // Serialises dumps with the closing of the netlink socket
+
+	pending  []sockDiagEvent // The state changes of the last dump not yet read
+	nextPoll time.Time
+
+	done     chan struct{}
+	doneOnce *sync.Once
+
+	osReleasePath string
+	procPath      string
+}
+
+// SockDiagEvent is a state change synthesized by a poll, or the error
+// synthesizing it, which is returned in its place.
+type sockDiagEvent struct {
+	event *ContextEvent
+	err   error
+}
+
+func newSockDiagSource(config *config) *sockDiagSource {
+	return &sockDiagSource{
+		config:        config,
+		dumpLock:      new(sync.Mutex),
+		done:          make(chan struct{}),
+		doneOnce:      new(sync.Once),
+		osReleasePath: osReleasePath,
+		procPath:      "/proc",
+	}
+}
+
+// Open opens a sock_diag netlink socket and dumps the sockets, against which
+// those of the first poll are compared. No state changes are synthesized for
+// the sockets of the first dump.
+func (ss *sockDiagSource) open() error {
+	conn, err := newSockDiagConn()
+	if err != nil {
+		return fmt.Errorf("opening sock_diag netlink socket: %w", err)
+	}
+	ss.conn = conn
+	ss.dump = conn.dump
+
+	sockets, err := ss.dump()
+	if err != nil {
+		ss.close()
+		return fmt.Errorf("dumping sockets: %w", err)
+	}
+	ss.sockets = indexInetDiagSockets(sockets)
+	ss.nextPoll = time.Now().Add(ss.config.pollInterval)
+
+	return nil
+}
+
+// Event returns the next state change, polling at the poll interval until any
+// are found. A poll which fails is retried only at the next interval, and the
+// error of a state change which cannot be synthesized is returned in its
+// place, after which the state changes of its poll are read on.
+func (ss *sockDiagSource) event() (*ContextEvent, error) {
+	for len(ss.pending) == 0 {
+		wait, err := ss.deadline.wait(time.Until(ss.nextPoll))
+		if err != nil {
+			return nil, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ss.done:
+			timer.Stop()
+			return nil, os.ErrClosed
+		case <-timer.C:
+		}
+
+		if time.Now().Before(ss.nextPoll) {
+			continue // Woken for the deadline
+		}
+
+		ss.nextPoll = time.Now().Add(ss.config.pollInterval)
+		if err := ss.poll(); err != nil {
+			return nil, err
+		}
+	}
+
+	pending := ss.pending[0]
+	ss.pending[0] = sockDiagEvent{}
+	ss.pending = ss.pending[1:]
+
+	return pending.event, pending.err
+}
+
+func (ss *sockDiagSource) setReadDeadline(t time.Time) error {
+	ss.deadline.set(t)
+	return nil
+}
+
+func (ss *sockDiagSource) kernelInfo() (*KernelInfo, error) {
+	return releaseKernelInfo(ss.osReleasePath)
+}
+
+// BufferStats returns the number of state changes synthesized as the events
+// read. None are ever dropped, although transitions between polls are not seen.
+func (ss *sockDiagSource) bufferStats() (*BufferStats, error) {
+	return &BufferStats{ReadEvents: atomic.LoadUint64(&ss.read)}, nil
+}
+
+// Close stops polling, and closes the netlink socket, if it was opened, once
+// any dump in progress is done.
+func (ss *sockDiagSource) close() error {
+	ss.doneOnce.Do(func() { close(ss.done) })
+
+	ss.dumpLock.Lock()
+	defer ss.dumpLock.Unlock()
+	if ss.conn == nil {
+		return nil
+	}
+
+	err := ss.conn.close()
+	ss.conn = nil
+	if err != nil {
+		return fmt.Errorf("closing sock_diag netlink socket: %w", err)
+	}
+
+	return nil
+}
+
+// Poll dumps the sockets, and queues the state changes since the last dump,
+// against which those of the next poll are then compared.
+func (ss *sockDiagSource) poll() error {
+	ss.dumpLock.Lock()
+	defer ss.dumpLock.Unlock()
+	if ss.isClosed() {
+		return os.ErrClosed // The netlink socket may be closed
+	}
+
+	dumped, err := ss.dump()
+	if err != nil {
+		return fmt.Errorf("dumping sockets: %w", err)
+	}
+
+	sockets := indexInetDiagSockets(dumped)
+	transitions := diffInetDiagSockets(ss.sockets, sockets)
+	ss.sockets = sockets
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	owners := ss.socketOwners(transitions)
+	for _, transition := range transitions {
+		event, err := newTransitionEvent(transition, owners[transition.socket.inode], bestEffortParsing(ss.config))
+		ss.pending = append(ss.pending, sockDiagEvent{event: event, err: err})
+	}
+	atomic.AddUint64(&ss.read, uint64(len(transitions)))
+
+	return nil
+}
+
+func (ss *sockDiagSource) isClosed() bool {
+	select {
+	case <-ss.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SockDiagTransition is a state change of a socket synthesized by comparing
+// dumps.
+type sockDiagTransition struct {
+	socket             *inetDiagSocket
+	oldState, newState uint8
+}
+
+// SockDiagOwner is the task which owns a socket.
+type sockDiagOwner struct {
+	comm string
+	pid  int
+}
+
+// IndexInetDiagSockets indexes the dumped sockets by their key.
+func indexInetDiagSockets(sockets []*inetDiagSocket) map[sockDiagKey]*inetDiagSocket {
+	index := make(map[sockDiagKey]*inetDiagSocket, len(sockets))
+	for _, socket := range sockets {
+		index[socket.key()] = socket
+	}
+
+	return index
+}
+
+// DiffInetDiagSockets returns the state changes of the sockets between two
+// dumps. Sockets which appeared were created in TCP_CLOSE, and those which
+// disappeared were closed.
+func diffInetDiagSockets(previous, current map[sockDiagKey]*inetDiagSocket) []*sockDiagTransition {
+	var transitions []*sockDiagTransition
+	for key, socket := range current {
+		oldState := uint8(tcpStateClose)
+		if previousSocket, ok := previous[key]; ok {
+			oldState = previousSocket.state
+		}
+
+		if oldState != socket.state {
+			transitions = append(transitions, &sockDiagTransition{socket, oldState, socket.state})
+		}
+	}
+
+	for key, socket := range previous {
+		if _, ok := current[key]; !ok && socket.state != tcpStateClose {
+			transitions = append(transitions, &sockDiagTransition{socket, socket.state, tcpStateClose})
+		}
+	}
+
+	return transitions
+}
+
+// SocketOwners returns the tasks which own the sockets of the transitions, by
+// inode.
+func (ss *sockDiagSource) socketOwners(transitions []*sockDiagTransition) map[uint32]*sockDiagOwner {
+	inodes := make([]uint32, 0, len(transitions))
+	for _, transition := range transitions {
+		inodes = append(inodes, transition.socket.inode)
+	}
+
+	return findSocketOwners(ss.procPath, inodes)
+}
+
+// FindSocketOwners returns the tasks which own the sockets of the inodes, found
+// among the file descriptors of the tasks in proc. Sockets which have been
+// closed, or are owned by no task, such as timewait sockets, are not found.
+func findSocketOwners(procPath string, socketInodes []uint32) map[uint32]*sockDiagOwner {
+	inodes := make(map[string]uint32, len(socketInodes))
+	for _, inode := range socketInodes {
+		if inode != 0 {
+			inodes["socket:["+strconv.FormatUint(uint64(inode), 10)+"]"] = inode
+		}
+	}
+
+	owners := make(map[uint32]*sockDiagOwner, len(inodes))
+	if len(inodes) == 0 {
+		return owners
+	}
+
+	tasks, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return owners
+	}
+
+	for _, task := range tasks {
+		pid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue // Not a task
+		}
+
+		fdPath := procPath + "/" + task.Name() + "/fd"
+		fds, err := ioutil.ReadDir(fdPath)
+		if err != nil {
+			continue // Exited, or not permitted
+		}
+
+		for _, fd := range fds {
+			target, err := os.Readlink(fdPath + "/" + fd.Name())
+			if err != nil {
+				continue
+			}
+
+			inode, ok := inodes[target]
+			if !ok || owners[inode] != nil {
+				continue
+			}
+
+			comm := "<...>"
+			if contents, err := ioutil.ReadFile(procPath + "/" + task.Name() + "/comm"); err == nil {
+				comm = strings.TrimSuffix(string(contents), "\n")
+			}
+			owners[inode] = &sockDiagOwner{comm: comm, pid: pid}
+		}
+
+		if len(owners) == len(inodes) {
+			break
+		}
+	}
+
+	return owners
+}
+
+// NewTransitionEvent returns the event of a state change, as observed by the
+// sock-diag, conntrack, generator and packet backends, timed when observed. If
+// the task owning the socket is not known, the event is of the command `<...>`
+// and PID 0.
+func newTransitionEvent(transition *sockDiagTransition,
+	owner *sockDiagOwner,
+	bestEffort bool) (*ContextEvent, error) {
+	if owner == nil {
+		owner = &sockDiagOwner{comm: "<...>", pid: idlePID}
+	}
+
+	var unknownStates []string
+	oldState, err := decodeState(transition.oldState, bestEffort, &unknownStates)
+	if err != nil {
+		return nil, fmt.Errorf("decoding old state: %w", err)
+	}
+
+	newState, err := decodeState(transition.newState, bestEffort, &unknownStates)
+	if err != nil {
+		return nil, fmt.Errorf("decoding new state: %w", err)
+	}
+
+	socket := transition.socket
+	return &ContextEvent{
+		Event: &event.Event{
+			Time:         time.Now().UTC(),
+			CommandOnCPU: owner.comm,
+			PIDOnCPU:     owner.pid,
+			SourceIP:     net.IPv4(socket.saddr[0], socket.saddr[1], socket.saddr[2], socket.saddr[3]),
+			DestIP:       net.IPv4(socket.daddr[0], socket.daddr[1], socket.daddr[2], socket.daddr[3]),
+			SourcePort:   socket.sport,
+			DestPort:     socket.dport,
+			OldState:     oldState,
+			NewState:     newState,
+		},
+		Kind:          KindStateChange,
+		Idle:          owner.pid == idlePID,
+		UnknownStates: unknownStates,
+	}, nil
+}
+
+// KernelTCPState returns the kernel name of a TCP state, which for unknown
+// states is that printed by __print_symbolic.
+func kernelTCPState(state uint8) string {
+	if name, ok := kernelTCPStates[state]; ok {
+		return name
+	}
+
+	return "0x" + strconv.FormatUint(uint64(state), 16)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// NewMockInetDiagMsg returns a netlink message of the sequence number carrying
+// the struct inet_diag_msg of a socket.
+func newMockInetDiagMsg(seq uint32, socket *inetDiagSocket) []byte {
+	msg := make([]byte, syscall.NLMSG_HDRLEN+inetDiagMsgSize)
+	hostByteOrder.PutUint32(msg[0:], uint32(len(msg)))
+	hostByteOrder.PutUint16(msg[4:], sockDiagByFamily)
+	hostByteOrder.PutUint32(msg[8:], seq)
+
+	body := msg[syscall.NLMSG_HDRLEN:]
+	body[0] = syscall.AF_INET
+	body[1] = socket.state
+	binary.BigEndian.PutUint16(body[4:], socket.sport)
+	binary.BigEndian.PutUint16(body[6:], socket.dport)
+	copy(body[8:], socket.saddr[:])
+	copy(body[24:], socket.daddr[:])
+	hostByteOrder.PutUint32(body[44:], uint32(socket.cookie))
+	hostByteOrder.PutUint32(body[48:], uint32(socket.cookie>>32))
+	hostByteOrder.PutUint32(body[68:], socket.inode)
+
+	return msg
+}
+
+func newMockNetlinkDone(seq uint32) []byte {
+	msg := make([]byte, syscall.NLMSG_HDRLEN+4)
+	hostByteOrder.PutUint32(msg[0:], uint32(len(msg)))
+	hostByteOrder.PutUint16(msg[4:], syscall.NLMSG_DONE)
+	hostByteOrder.PutUint32(msg[8:], seq)
+
+	return msg
+}
+
+var mockInetDiagSocket = &inetDiagSocket{
+	state:  1,
+	sport:  44406,
+	dport:  80,
+	saddr:  [4]byte{192, 168, 122, 38},
+	daddr:  [4]byte{172, 217, 169, 4},
+	cookie: 0x100000002,
+	inode:  31337,
+}
+
+func TestDecodeInetDiagResponse(t *testing.T) {
+	var response []byte
+	response = append(response, newMockInetDiagMsg(7, mockInetDiagSocket)...)
+	response = append(response, newMockInetDiagMsg(6, mockInetDiagSocket)...) // Abandoned
+	response = append(response, newMockNetlinkDone(7)...)
+
+	var sockets []*inetDiagSocket
+	done, err := decodeInetDiagResponse(response, 7, &sockets)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if !done {
+		t.Error("expected dump done")
+	}
+
+	if len(sockets) != 1 {
+		t.Fatalf("expected 1 socket, got %d", len(sockets))
+	}
+
+	if *sockets[0] != *mockInetDiagSocket {
+		t.Errorf("expected socket %+v, got %+v", mockInetDiagSocket, sockets[0])
+	}
+}
+
+func TestDecodeInetDiagResponseError(t *testing.T) {
+	msg := make([]byte, syscall.NLMSG_HDRLEN+4)
+	hostByteOrder.PutUint32(msg[0:], uint32(len(msg)))
+	hostByteOrder.PutUint16(msg[4:], syscall.NLMSG_ERROR)
+	hostByteOrder.PutUint32(msg[8:], 1)
+	errno := int32(syscall.EPERM)
+	hostByteOrder.PutUint32(msg[syscall.NLMSG_HDRLEN:], uint32(-errno))
+
+	var sockets []*inetDiagSocket
+	_, err := decodeInetDiagResponse(msg, 1, &sockets)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestDiffInetDiagSockets(t *testing.T) {
+	established := *mockInetDiagSocket
+	finWait := established
+	finWait.state = 4
+	listening := inetDiagSocket{state: tcpStateListen, sport: 80, cookie: 1}
+	reusedListening := listening
+	reusedListening.cookie = 2
+	synSent := inetDiagSocket{state: 2, sport: 40000, dport: 443, daddr: [4]byte{1, 1, 1, 1}}
+
+	previous := indexInetDiagSockets([]*inetDiagSocket{&established, &listening, &synSent})
+	current := indexInetDiagSockets([]*inetDiagSocket{&finWait, &listening, &reusedListening})
+
+	transitions := make(map[[3]uint16]bool)
+	for _, transition := range diffInetDiagSockets(previous, current) {
+		transitions[[3]uint16{transition.socket.sport, uint16(transition.oldState), uint16(transition.newState)}] = true
+	}
+
+	for _, expected := range [][3]uint16{
+		{44406, 1, 4},                       // Changed
+		{80, tcpStateClose, tcpStateListen}, // Appeared
+		{40000, 2, tcpStateClose},           // Disappeared
+	} {
+		if !transitions[expected] {
+			t.Errorf("expected transition %v, got %v", expected, transitions)
+		}
+	}
+
+	if len(transitions) != 3 {
+		t.Errorf("expected 3 transitions, got %v", transitions)
+	}
+}
+
+func TestNewTransitionEvent(t *testing.T) {
+	event, err := newTransitionEvent(&sockDiagTransition{mockInetDiagSocket, 2, 1},
+		&sockDiagOwner{comm: "curl", pid: 1234},
+		false)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.CommandOnCPU != "curl" || event.PIDOnCPU != 1234 || event.Idle {
+		t.Errorf("expected curl-1234, got %s-%d", event.CommandOnCPU, event.PIDOnCPU)
+	}
+
+	if event.SourcePort != 44406 || event.DestPort != 80 {
+		t.Errorf("expected ports 44406 and 80, got %d and %d", event.SourcePort, event.DestPort)
+	}
+
+	if event.SourceIP.String() != "192.168.122.38" || event.DestIP.String() != "172.217.169.4" {
+		t.Errorf("expected addresses 192.168.122.38 and 172.217.169.4, got %v and %v", event.SourceIP, event.DestIP)
+	}
+
+	if event.OldState != tcpstate.StateSynSent || event.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected SYN-SENT to ESTABLISHED, got %v to %v", event.OldState, event.NewState)
+	}
+}
+
+func TestNewTransitionEventUnknownState(t *testing.T) {
+	transition := &sockDiagTransition{mockInetDiagSocket, 1, 0x20}
+	if _, err := newTransitionEvent(transition, nil, false); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	event, err := newTransitionEvent(transition, nil, true)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.NewState != StateUnknown || len(event.UnknownStates) != 1 || event.UnknownStates[0] != "0x20" {
+		t.Errorf("expected unknown state 0x20, got %v (%v)", event.NewState, event.UnknownStates)
+	}
+
+	if event.CommandOnCPU != "<...>" || !event.Idle {
+		t.Errorf("expected unowned event, got %s-%d", event.CommandOnCPU, event.PIDOnCPU)
+	}
+}
+
+func TestSockDiagSourcePoll(t *testing.T) {
+	dumps := [][]*inetDiagSocket{{}, {mockInetDiagSocket}}
+	source := newSockDiagSource(&config{pollInterval: time.Millisecond})
+	source.procPath = t.TempDir()
+	source.dump = func() ([]*inetDiagSocket, error) {
+		dumped := dumps[0]
+		if len(dumps) > 1 {
+			dumps = dumps[1:]
+		}
+		return dumped, nil
+	}
+	source.sockets = indexInetDiagSockets(nil)
+
+	event, err := source.event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.CommandOnCPU != "<...>" || event.PIDOnCPU != 0 {
+		t.Errorf("expected unowned socket, got %s-%d", event.CommandOnCPU, event.PIDOnCPU)
+	}
+
+	if event.OldState != tcpstate.StateClosed || event.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected socket created established, got %v to %v", event.OldState, event.NewState)
+	}
+
+	if stats, _ := source.bufferStats(); stats.ReadEvents != 1 {
+		t.Errorf("expected 1 read event, got %d", stats.ReadEvents)
+	}
+}
+
+func TestSockDiagSourcePollUnknownStateQueued(t *testing.T) {
+	unknown := *mockInetDiagSocket
+	unknown.sport, unknown.state = 44408, 0x20
+	dumps := [][]*inetDiagSocket{{mockInetDiagSocket, &unknown}}
+	source := newSockDiagSource(&config{pollInterval: time.Millisecond})
+	source.procPath = t.TempDir()
+	source.dump = func() ([]*inetDiagSocket, error) {
+		return dumps[0], nil
+	}
+	source.sockets = indexInetDiagSockets(nil)
+
+	// The error of the unknown state is returned in place of its state change,
+	// and that of the other socket is still returned
+	var events, errs int
+	for i := 0; i < 2; i++ {
+		event, err := source.event()
+		switch {
+		case err != nil:
+			errs++
+		case event.SourcePort == 44406:
+			events++
+		}
+	}
+
+	if events != 1 || errs != 1 {
+		t.Errorf("expected 1 event and 1 error, got %d events and %d errors", events, errs)
+	}
+
+	// The dump was taken as the last, so its state changes are not repeated
+	source.setReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := source.event(); err != os.ErrDeadlineExceeded {
+		t.Errorf("expected %q, got %q (of type %T)", os.ErrDeadlineExceeded, err, err)
+	}
+}
+
+func TestSockDiagSourcePollErrorRetriedAtInterval(t *testing.T) {
+	mockError := errors.New("mock dump error")
+	source := newSockDiagSource(&config{pollInterval: time.Hour})
+	source.dump = func() ([]*inetDiagSocket, error) {
+		return nil, mockError
+	}
+
+	if _, err := source.event(); !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, got %q (of type %T)", mockError, err, err)
+	}
+
+	if time.Until(source.nextPoll) <= 0 {
+		t.Error("expected next poll to be advanced after failed poll, but was not")
+	}
+}
+
+func TestSockDiagSourceReadDeadline(t *testing.T) {
+	source := newSockDiagSource(&config{pollInterval: time.Hour})
+	source.nextPoll = time.Now().Add(time.Hour)
+	source.setReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := source.event(); err != os.ErrDeadlineExceeded {
+		t.Errorf("expected %q, got %q (of type %T)", os.ErrDeadlineExceeded, err, err)
+	}
+}
+
+func TestSockDiagSourceClose(t *testing.T) {
+	source := newSockDiagSource(&config{pollInterval: time.Hour})
+	source.nextPoll = time.Now().Add(time.Hour)
+	go source.close()
+	if _, err := source.event(); err != os.ErrClosed {
+		t.Errorf("expected %q, got %q (of type %T)", os.ErrClosed, err, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// HashedPointerPlaceholder is printed in place of hashed pointers, such as the
+// socket address, before the kernel can hash them.
+const hashedPointerPlaceholder = "(____ptrval____)"
+
+// HexPrefixBytes prefixes the hexadecimal fields fetched by a kprobe.
+var hexPrefixBytes = []byte("0x")
+
+// SocketID identifies the kernel socket of an event, so that the transitions
+// of the same socket can be correlated, even if its 4-tuple is later reused.
+type SocketID struct {
+	// Address is the kernel address of the socket, from the skaddr field, or
+	// zero if not present. Unless the kernel is booted with no_hash_pointers,
+	// it is hashed, but consistently so. It may be reused once the socket is
+	// freed.
+	Address uint64
+	// Cookie is the socket cookie, from the sock_cookie field of tracepoints
+	// of newer kernels, or zero if not present. Unlike the address, it is
+	// never reused.
+	Cookie uint64
+}
+
+// ParseSocketID returns the socket identity carried by the tagged fields of an
+// event, or nil if the tracepoint does not identify the socket.
+func parseSocketID(tags taggedFields) (*SocketID, error) {
+	skAddr, hasAddress := tags.get("skaddr")
+	sockCookie, hasCookie := tags.get("sock_cookie")
+	if !hasAddress && !hasCookie {
+		return nil, nil
+	}
+
+	socketID := new(SocketID)
+
+	// Early in boot, before the pointer hashing key is available, the kernel
+	// prints a placeholder in place of the address
+	if hasAddress && string(skAddr) != hashedPointerPlaceholder {
+		address, err := parseHex(skAddr)
+		if err != nil {
+			return nil, fmt.Errorf("converting socket address to integer: %w", err)
+		}
+		socketID.Address = address
+	}
+
+	if hasCookie {
+		cookie, err := parseHex(sockCookie)
+		if err != nil {
+			return nil, fmt.Errorf("converting socket cookie to integer: %w", err)
+		}
+		socketID.Cookie = cookie
+	}
+
+	return socketID, nil
+}
+
+// ParseHex parses a hexadecimal field, which is prefixed with 0x if fetched
+// by a kprobe, but not if printed by a tracepoint, without allocating.
+func parseHex(field []byte) (uint64, error) {
+	digits := bytes.TrimPrefix(field, hexPrefixBytes)
+	if len(digits) == 0 {
+		return 0, errors.New("no digits")
+	}
+
+	var value uint64
+	for _, digit := range digits {
+		var digitValue uint64
+		switch {
+		case digit >= '0' && digit <= '9':
+			digitValue = uint64(digit - '0')
+		case digit >= 'a' && digit <= 'f':
+			digitValue = uint64(digit-'a') + 10
+		case digit >= 'A' && digit <= 'F':
+			digitValue = uint64(digit-'A') + 10
+		default:
+			return 0, fmt.Errorf("invalid digit %q", digit)
+		}
+
+		if value>>60 != 0 {
+			return 0, errors.New("out of range")
+		}
+		value = value<<4 | digitValue
+	}
+
+	return value, nil
+}
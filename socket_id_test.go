@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSocketID(t *testing.T) {
+	for _, test := range []struct {
+		tags     string
+		expected SocketID
+	}{
+		{
+			tags:     "skaddr=000000009a7e2b8d",
+			expected: SocketID{Address: 0x9a7e2b8d},
+		},
+		{
+			tags:     "skaddr=0xffff8880a1b2c3d4",
+			expected: SocketID{Address: 0xffff8880a1b2c3d4},
+		},
+		{
+			tags:     "skaddr=000000009a7e2b8d sock_cookie=1f4",
+			expected: SocketID{Address: 0x9a7e2b8d, Cookie: 500},
+		},
+		{
+			tags:     "skaddr=" + hashedPointerPlaceholder,
+			expected: SocketID{},
+		},
+	} {
+		socketID, err := parseSocketID(newMockTaggedFields(test.tags))
+		if err != nil {
+			t.Errorf("expected nil error, got %q (of type %T)", err, err)
+			continue
+		}
+
+		if socketID == nil {
+			t.Errorf("expected socket identity for %v, got nil", test.tags)
+			continue
+		}
+
+		if *socketID != test.expected {
+			t.Errorf("expected socket identity %+v for %v, got %+v", test.expected, test.tags, *socketID)
+		}
+	}
+}
+
+func TestParseSocketIDNotPresent(t *testing.T) {
+	socketID, err := parseSocketID(newMockTaggedFields("sport=44406"))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if socketID != nil {
+		t.Errorf("expected nil socket identity, got %+v", *socketID)
+	}
+}
+
+func TestParseSocketIDErrorNonHexAddress(t *testing.T) {
+	_, err := parseSocketID(newMockTaggedFields("skaddr=ffffzzzz"))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+// NewMockTaggedFields returns the tagged fields of the string, which must be
+// well-formed.
+func newMockTaggedFields(tags string) taggedFields {
+	str := []byte(tags)
+	fields, err := new(slicingFieldParser).getTaggedFields(&str)
+	if err != nil {
+		panic(err)
+	}
+
+	return fields
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// StateUnknown is the state of events whose kernel state has no mapping, if
+// unknown states are tolerated, rather than failing the event.
+const StateUnknown tcpstate.State = "UNKNOWN"
+
+// StateMappings maps the kernel names of TCP states, as output by the
+// tracepoints, to the states reported in events. As the states are shared by
+// all parsers, which may run concurrently, they are guarded by a mutex.
+var stateMappings = struct {
+	sync.RWMutex
+	states   map[string]tcpstate.State
+	fallback tcpstate.State
+}{
+	states: map[string]tcpstate.State{
+		"TCP_ESTABLISHED": tcpstate.StateEstablished,
+		"TCP_SYN_SENT":    tcpstate.StateSynSent,
+		"TCP_SYN_RECV":    tcpstate.StateSynReceived,
+		"TCP_FIN_WAIT1":   tcpstate.StateFinWait1,
+		"TCP_FIN_WAIT2":   tcpstate.StateFinWait2,
+		"TCP_TIME_WAIT":   tcpstate.StateTimeWait,
+		"TCP_CLOSE":       tcpstate.StateClosed,
+		"TCP_CLOSE_WAIT":  tcpstate.StateCloseWait,
+		"TCP_LAST_ACK":    tcpstate.StateLastAck,
+		"TCP_LISTEN":      tcpstate.StateListen,
+		"TCP_CLOSING":     tcpstate.StateClosing,
+		// A request socket, which the kernel uses for a connection in SYN-RECEIVED
+		// until the handshake completes
+		"TCP_NEW_SYN_RECV": tcpstate.StateSynReceived,
+		// A socket bound to a port, but neither listening nor connected, since
+		// Linux 6.8
+		"TCP_BOUND_INACTIVE": tcpstate.StateClosed,
+	},
+}
+
+// RegisterStateMapping maps the kernel name of a TCP state, e.g.
+// "TCP_NEW_SYN_RECV", to the state reported in events, replacing any existing
+// mapping. This allows states added by future or vendor-patched kernels to be
+// supported without changes to the Eventer.
+func RegisterStateMapping(kernelState string, state tcpstate.State) {
+	stateMappings.Lock()
+	defer stateMappings.Unlock()
+
+	stateMappings.states[kernelState] = state
+}
+
+// SetUnknownStateFallback sets the state reported for kernel states which have
+// no mapping, for example StateUnknown, rather than failing the event. Such
+// events carry the kernel names of the states in the UnknownStates of the
+// event returned by EventWithContext. An empty state restores failing them.
+func SetUnknownStateFallback(state tcpstate.State) {
+	stateMappings.Lock()
+	defer stateMappings.Unlock()
+
+	stateMappings.fallback = state
+}
+
+// CanonicaliseState returns the state mapped from the kernel name of a TCP
+// state. States which have no mapping are converted from the kernel naming
+// convention, e.g. "TCP_FIN_WAIT1" to "FIN-WAIT-1", and, failing that, are
+// either given the fallback state, if any, or otherwise are an error. Whether
+// the fallback was used is returned in unknown.
+func canonicaliseState(state string) (canonicalState tcpstate.State, unknown bool, err error) {
+	stateMappings.RLock()
+	mapped, ok := stateMappings.states[state]
+	fallback := stateMappings.fallback
+	stateMappings.RUnlock()
+	if ok {
+		return mapped, false, nil
+	}
+
+	converted := strings.ReplaceAll(strings.TrimPrefix(state, "TCP_"), "_", "-")
+	canonicalState, err = tcpstate.FromString(converted)
+	if err == nil {
+		return canonicalState, false, nil
+	}
+
+	if fallback != "" {
+		return fallback, true, nil
+	}
+
+	return "", false, fmt.Errorf("unknown state %q: %w", state, err)
+}
+
+// CanonicaliseStateBytes is as canonicaliseState, but for the kernel name of a
+// state sliced from a line, which is only converted to a string, and so
+// allocated, if it has no mapping.
+func canonicaliseStateBytes(state []byte) (canonicalState tcpstate.State, unknown bool, err error) {
+	stateMappings.RLock()
+	mapped, ok := stateMappings.states[string(state)]
+	stateMappings.RUnlock()
+	if ok {
+		return mapped, false, nil
+	}
+
+	return canonicaliseState(string(state))
+}
+
+// DecodeState returns the state of the kernel value of a TCP state, as observed
+// by an event source, as parseState does for the state of a line. A state which
+// has no mapping is StateUnknown if decoded best-effort, unless a fallback is
+// set, and its kernel name is appended to unknown.
+func decodeState(value uint8, bestEffort bool, unknown *[]string) (tcpstate.State, error) {
+	kernelState := kernelTCPState(value)
+	state, isUnknown, err := canonicaliseState(kernelState)
+	if err != nil {
+		if !bestEffort {
+			return "", err
+		}
+		state, isUnknown = StateUnknown, true
+	}
+
+	if isUnknown {
+		*unknown = append(*unknown, kernelState)
+	}
+
+	return state, nil
+}
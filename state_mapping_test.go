@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func TestCanonicaliseState(t *testing.T) {
+	states := map[string]tcpstate.State{
+		"TCP_ESTABLISHED":    tcpstate.StateEstablished,
+		"TCP_FIN_WAIT1":      tcpstate.StateFinWait1,
+		"TCP_CLOSE":          tcpstate.StateClosed,
+		"TCP_NEW_SYN_RECV":   tcpstate.StateSynReceived,
+		"TCP_BOUND_INACTIVE": tcpstate.StateClosed,
+	}
+
+	for kernelState, expectedState := range states {
+		state, unknown, err := canonicaliseState(kernelState)
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %q (of type %T)", kernelState, err, err)
+		}
+
+		if unknown {
+			t.Errorf("expected %q to be known, but was not", kernelState)
+		}
+
+		if state != expectedState {
+			t.Errorf("expected %q to be %v, got %v", kernelState, expectedState, state)
+		}
+	}
+}
+
+func TestCanonicaliseStateUnknownStateError(t *testing.T) {
+	_, _, err := canonicaliseState("TCP_MOCK_STATE")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestRegisterStateMapping(t *testing.T) {
+	RegisterStateMapping("TCP_MOCK_STATE", tcpstate.StateListen)
+	defer func() {
+		stateMappings.Lock()
+		delete(stateMappings.states, "TCP_MOCK_STATE")
+		stateMappings.Unlock()
+	}()
+
+	state, unknown, err := canonicaliseState("TCP_MOCK_STATE")
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if unknown {
+		t.Error("expected registered state to be known, but was not")
+	}
+
+	if state != tcpstate.StateListen {
+		t.Errorf("expected state %v, got %v", tcpstate.StateListen, state)
+	}
+}
+
+func TestSetUnknownStateFallback(t *testing.T) {
+	SetUnknownStateFallback(StateUnknown)
+	defer SetUnknownStateFallback("")
+
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_ESTABLISHED newstate=TCP_MOCK_STATE")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.OldState != tcpstate.StateEstablished || event.NewState != StateUnknown {
+		t.Errorf("expected states %v and %v, got %v and %v",
+			tcpstate.StateEstablished,
+			StateUnknown,
+			event.OldState,
+			event.NewState)
+	}
+
+	if len(event.UnknownStates) != 1 || event.UnknownStates[0] != "TCP_MOCK_STATE" {
+		t.Errorf("expected unknown states %q, got %q", []string{"TCP_MOCK_STATE"}, event.UnknownStates)
+	}
+}
+
+func TestParseBestEffortUnknownState(t *testing.T) {
+	mockEventTrace := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_MOCK_STATE newstate=TCP_ESTABLISHED")
+	fieldParser := new(slicingFieldParser)
+	eventParser := newTraceFSEventParser(fieldParser, defaultTracepointCandidates)
+	eventParser.bestEffort = true
+
+	event, err := eventParser.toEvent(mockEventTrace)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.OldState != StateUnknown {
+		t.Errorf("expected old state %v, got %v", StateUnknown, event.OldState)
+	}
+
+	if len(event.UnknownStates) != 1 || event.UnknownStates[0] != "TCP_MOCK_STATE" {
+		t.Errorf("expected unknown states %q, got %q", []string{"TCP_MOCK_STATE"}, event.UnknownStates)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Stats holds statistics describing the operation of an Eventer.
+type Stats struct {
+	// Buffer holds the kernel-side ring buffer statistics, totalled across all CPUs.
+	Buffer BufferStats
+	// LostEvents is the number of events reported lost by the kernel via
+	// markers in the trace_pipe stream, following ring buffer overruns.
+	LostEvents uint64
+	// DegradedBufferSizeKB is the size, in KiB, to which the ring buffer of each
+	// CPU was reduced as memory for a larger buffer could not be allocated, for
+	// example due to memory pressure. It is zero if the buffer was not reduced.
+	DegradedBufferSizeKB uint64
+	// Skipped is the number of lines read which were skipped, rather than
+	// returned as events, by reason.
+	Skipped SkippedStats
+	// ParseFailures is the number of lines which could not be parsed, and were
+	// returned as a *ParseError, by class of failure.
+	ParseFailures ParseFailureStats
+	// FilterOffload describes how much of the filter expression, if any, the
+	// kernel evaluates.
+	FilterOffload FilterOffloadStats
+}
+
+// FilterOffloadStats describes the offloading of the top-level conjuncts of
+// the filter expression to the kernel filter of the tracepoint of state
+// changes, so that the kernel discards the events which do not satisfy them.
+type FilterOffloadStats struct {
+	// Conjuncts is the number of top-level conjuncts of the filter expression,
+	// or zero if there is none.
+	Conjuncts int
+	// Offloaded is the number of conjuncts offloaded, so that only the others
+	// are evaluated for state changes when read.
+	Offloaded int
+	// KernelFilter is the ftrace filter of the conjuncts offloaded, or empty if
+	// none are.
+	KernelFilter string
+}
+
+// ParseFailureStats holds the number of lines which could not be parsed, by
+// class of failure.
+type ParseFailureStats struct {
+	// MissingField is the number of lines missing a field.
+	MissingField uint64
+	// BadInteger is the number of lines with an integer field, such as a PID or
+	// port, which could not be parsed.
+	BadInteger uint64
+	// BadAddress is the number of lines with an address which could not be
+	// parsed.
+	BadAddress uint64
+	// BadState is the number of lines with a TCP state which could not be
+	// canonicalised.
+	BadState uint64
+	// Truncated is the number of lines which ended before all their fields.
+	Truncated uint64
+	// Other is the number of lines which could not be parsed for other reasons.
+	Other uint64
+}
+
+// FailureCounters counts the lines which could not be parsed, by class of
+// failure. As with skipCounters, it is shared with the goroutines reading
+// per-CPU, so its counts are accessed atomically.
+type failureCounters struct {
+	counts [numParseFailures]uint64
+}
+
+// Count counts the failure, if the error is a *ParseError.
+func (fc *failureCounters) count(err error) {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		atomic.AddUint64(&fc.counts[parseErr.Failure], 1)
+	}
+}
+
+func (fc *failureCounters) stats() ParseFailureStats {
+	return ParseFailureStats{
+		MissingField: atomic.LoadUint64(&fc.counts[FailureMissingField]),
+		BadInteger:   atomic.LoadUint64(&fc.counts[FailureBadInteger]),
+		BadAddress:   atomic.LoadUint64(&fc.counts[FailureBadAddress]),
+		BadState:     atomic.LoadUint64(&fc.counts[FailureBadState]),
+		Truncated:    atomic.LoadUint64(&fc.counts[FailureTruncated]),
+		Other:        atomic.LoadUint64(&fc.counts[FailureOther]),
+	}
+}
+
+// SkippedStats holds the number of lines skipped by the Eventer, by reason.
+type SkippedStats struct {
+	// NonInet is the number of events not of the INET family, e.g. of IPv6.
+	NonInet uint64
+	// NonTCP is the number of events not of the TCP protocol.
+	NonTCP uint64
+	// Empty is the number of empty lines.
+	Empty uint64
+	// LostEventsMarkers is the number of markers of lost events, which are
+	// skipped unless lost events are reported.
+	LostEventsMarkers uint64
+	// UnknownTracepoint is the number of events of tracepoints the parser does
+	// not know.
+	UnknownTracepoint uint64
+	// Duplicates is the number of state transitions suppressed as duplicates of
+	// one already returned.
+	Duplicates uint64
+	// Oversize is the number of lines longer than the maximum line length.
+	Oversize uint64
+	// Filtered is the number of events of tasks not of the commands, PIDs or
+	// network namespaces filtered, or of which the filter expression is false.
+	Filtered uint64
+	// LocalTraffic is the number of events of loopback, link-local or
+	// unspecified addresses excluded.
+	LocalTraffic uint64
+	// ShortFlows is the number of events of flows shorter than the minimum
+	// flow duration suppressed.
+	ShortFlows uint64
+	// Debounced is the number of state changes collapsed into an earlier state
+	// change of their flow within the debounce window.
+	Debounced uint64
+}
+
+// SkipCounters counts the lines skipped by the Eventer, by reason. It is
+// shared with the goroutines reading per-CPU, so its fields are accessed
+// atomically.
+type skipCounters struct {
+	nonInet           uint64
+	nonTCP            uint64
+	empty             uint64
+	lostEventsMarkers uint64
+	oversize          uint64
+	unknownTracepoint uint64
+	duplicates        uint64
+	filtered          uint64
+	localTraffic      uint64
+	shortFlows        uint64
+	debounced         uint64
+}
+
+// CountIrrelevant counts an event skipped as irrelevant by the parser.
+func (sc *skipCounters) countIrrelevant(err error) {
+	switch {
+	case errors.Is(err, errNonInetEvent):
+		atomic.AddUint64(&sc.nonInet, 1)
+	case errors.Is(err, errNonTCPEvent):
+		atomic.AddUint64(&sc.nonTCP, 1)
+	case errors.Is(err, errUnknownTracepointEvent):
+		atomic.AddUint64(&sc.unknownTracepoint, 1)
+	}
+}
+
+func (sc *skipCounters) stats() SkippedStats {
+	return SkippedStats{
+		NonInet:           atomic.LoadUint64(&sc.nonInet),
+		NonTCP:            atomic.LoadUint64(&sc.nonTCP),
+		Empty:             atomic.LoadUint64(&sc.empty),
+		LostEventsMarkers: atomic.LoadUint64(&sc.lostEventsMarkers),
+		Oversize:          atomic.LoadUint64(&sc.oversize),
+		UnknownTracepoint: atomic.LoadUint64(&sc.unknownTracepoint),
+		Duplicates:        atomic.LoadUint64(&sc.duplicates),
+		Filtered:          atomic.LoadUint64(&sc.filtered),
+		LocalTraffic:      atomic.LoadUint64(&sc.localTraffic),
+		ShortFlows:        atomic.LoadUint64(&sc.shortFlows),
+		Debounced:         atomic.LoadUint64(&sc.debounced),
+	}
+}
+
+// BufferStats holds the statistics of a tracefs ring buffer, as reported by
+// the per_cpu/cpu*/stats files.
+type BufferStats struct {
+	// Entries is the number of events still in the buffer.
+	Entries uint64
+	// Overrun is the number of events lost due to the buffer being overwritten
+	// when full.
+	Overrun uint64
+	// CommitOverrun is the number of events lost due to the buffer filling
+	// during a nested write.
+	CommitOverrun uint64
+	// DroppedEvents is the number of events lost due to the buffer being full,
+	// when overwrite mode is disabled.
+	DroppedEvents uint64
+	// ReadEvents is the number of events read from the buffer.
+	ReadEvents uint64
+}
+
+func (bs *BufferStats) add(stats *BufferStats) {
+	bs.Entries += stats.Entries
+	bs.Overrun += stats.Overrun
+	bs.CommitOverrun += stats.CommitOverrun
+	bs.DroppedEvents += stats.DroppedEvents
+	bs.ReadEvents += stats.ReadEvents
+}
+
+// ParseBufferStats parses the contents of a per_cpu/cpu*/stats file, which
+// consists of `key: value` lines. Keys which are not of interest, or which are
+// not present in the running kernel, are ignored.
+func parseBufferStats(reader io.Reader) (*BufferStats, error) {
+	stats := new(BufferStats)
+	fields := map[string]*uint64{
+		"entries":        &stats.Entries,
+		"overrun":        &stats.Overrun,
+		"commit overrun": &stats.CommitOverrun,
+		"dropped events": &stats.DroppedEvents,
+		"read events":    &stats.ReadEvents,
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		idx := strings.Index(line, ":")
+		if idx == -1 {
+			continue
+		}
+
+		field, ok := fields[line[:idx]]
+		if !ok {
+			continue
+		}
+
+		value, err := strconv.ParseUint(strings.TrimSpace(line[idx+1:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q buffer statistic: %w", line[:idx], err)
+		}
+		*field = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanning buffer statistics: %w", err)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBufferStats(t *testing.T) {
+	mockStats := "entries: 10\n" +
+		"overrun: 20\n" +
+		"commit overrun: 30\n" +
+		"bytes: 4096\n" +
+		"oldest event ts:  2086.154201\n" +
+		"now ts:  2167.431412\n" +
+		"dropped events: 40\n" +
+		"read events: 50\n"
+
+	stats, err := parseBufferStats(strings.NewReader(mockStats))
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedStats := BufferStats{Entries: 10, Overrun: 20, CommitOverrun: 30, DroppedEvents: 40, ReadEvents: 50}
+	if *stats != expectedStats {
+		t.Errorf("expected stats %+v, got %+v", expectedStats, *stats)
+	}
+}
+
+func TestParseBufferStatsNonIntegerError(t *testing.T) {
+	mockStats := "entries: foo\n"
+
+	_, err := parseBufferStats(strings.NewReader(mockStats))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// Summary is the activity of the connections between a host address and a
+// peer address on a port over an interval, in place of their events.
+type Summary struct {
+	// Start and End are the times of the start and end of the interval.
+	Start, End time.Time
+	// Opened is the number of connections established.
+	Opened int
+	// Closed is the number of established connections closed.
+	Closed int
+	// Failed is the number of connections closed before they were
+	// established, such as those refused.
+	Failed int
+	// Resets is the number of RSTs sent and received.
+	Resets int
+	// Retransmits is the number of segments retransmitted.
+	Retransmits int
+}
+
+// Summariser aggregates events into summaries of each interval, by the host
+// (source) address, peer (destination) address and the port of the service
+// of their connections, which is the source port of a server socket, the
+// destination port of a client socket, or, if the role of the socket is not
+// known, the lower of the two. The other port, usually ephemeral, is zero. An
+// interval ends with the first event read after it, once as long as remained
+// of it when it began has passed, even if no event is read, or once events are
+// exhausted, when its summaries are returned, in the order in which each was
+// first seen. It is only accessed by the reader of events, so is not safe for
+// concurrent use.
+type summariser struct {
+	interval time.Duration
+
+	start, end time.Time // Of the current interval, or zero before the first event
+	expires    time.Time // When the current interval ends, if no later event is read
+	summaries  map[connectionKey]*summaryEvent
+	order      []connectionKey // Those of the summaries, in the order first seen
+	ended      []*ContextEvent // The summaries of ended intervals, awaiting return
+}
+
+// SummaryEvent is the summary of a key in the current interval, and the last
+// of its events, which carries its enrichment.
+type summaryEvent struct {
+	summary *Summary
+	last    *ContextEvent
+}
+
+// NewSummariser returns a summariser of events over the interval, which must
+// be positive.
+func newSummariser(interval time.Duration) *summariser {
+	return &summariser{
+		interval:  interval,
+		summaries: make(map[connectionKey]*summaryEvent),
+	}
+}
+
+// Aggregate counts the event in the summary of its interval, ending the
+// previous interval if the event is after it, and returns whether the event
+// is absorbed by the summary, rather than returned. Markers of lost events are
+// not absorbed. Events which are neither state changes, resets nor
+// retransmits are absorbed, but not counted.
+func (s *summariser) aggregate(event *ContextEvent) bool {
+	if event.Kind == KindLostEvents {
+		return false
+	}
+
+	if s.start.IsZero() || !event.Time.Before(s.end) {
+		s.flush()
+		s.start = event.Time.Truncate(s.interval)
+		s.end = s.start.Add(s.interval)
+		s.expires = time.Now().Add(s.end.Sub(event.Time))
+	}
+
+	switch event.Kind {
+	case KindStateChange, KindSendReset, KindReceiveReset, KindRetransmit:
+	default:
+		return true
+	}
+
+	key := newSummaryKey(event)
+	tracked, ok := s.summaries[key]
+	if !ok {
+		tracked = &summaryEvent{summary: &Summary{Start: s.start, End: s.end}}
+		s.summaries[key] = tracked
+		s.order = append(s.order, key)
+	}
+	tracked.last = event
+
+	summary := tracked.summary
+	switch event.Kind {
+	case KindSendReset, KindReceiveReset:
+		summary.Resets++
+	case KindRetransmit:
+		summary.Retransmits++
+	case KindStateChange:
+		switch {
+		case event.NewState == tcpstate.StateEstablished &&
+			(event.OldState == tcpstate.StateSynSent || event.OldState == tcpstate.StateSynReceived):
+			summary.Opened++
+		case event.NewState == tcpstate.StateClosed &&
+			(event.OldState == tcpstate.StateSynSent || event.OldState == tcpstate.StateSynReceived):
+			summary.Failed++
+		case event.NewState == tcpstate.StateClosed && event.OldState != tcpstate.StateListen:
+			summary.Closed++
+		}
+	}
+
+	return true
+}
+
+// Flush ends the current interval, and returns whether it had any summaries,
+// which are then returned by next.
+func (s *summariser) flush() bool {
+	for _, key := range s.order {
+		s.ended = append(s.ended, newSummaryContextEvent(key, s.summaries[key]))
+	}
+
+	flushed := len(s.order) > 0
+	s.summaries = make(map[connectionKey]*summaryEvent, len(s.summaries))
+	s.order = s.order[:0]
+
+	return flushed
+}
+
+// Expiry returns when the current interval ends, if no later event is read, or
+// false if it has no summaries, so that reads can be bounded by it.
+func (s *summariser) expiry() (time.Time, bool) {
+	if len(s.order) == 0 {
+		return time.Time{}, false
+	}
+
+	return s.expires, true
+}
+
+// Expire ends the current interval if it has ended by now, though no later
+// event was read, and returns whether it had any summaries. Events of the
+// interval read later are summarised again.
+func (s *summariser) expire(now time.Time) bool {
+	if len(s.order) == 0 || now.Before(s.expires) {
+		return false
+	}
+
+	return s.flush()
+}
+
+// Next returns the next summary of an ended interval, if any.
+func (s *summariser) next() (*ContextEvent, bool) {
+	if len(s.ended) == 0 {
+		return nil, false
+	}
+
+	summary := s.ended[0]
+	s.ended[0] = nil
+	s.ended = s.ended[1:]
+
+	return summary, true
+}
+
+// NewSummaryKey returns the 4-tuple of the connection of the event, less its
+// port which is not that of the service.
+func newSummaryKey(event *ContextEvent) connectionKey {
+	key := newConnectionKey(event)
+
+	serverSource := key.sourcePort <= key.destPort
+	switch event.Role {
+	case RoleServer:
+		serverSource = true
+	case RoleClient:
+		serverSource = false
+	}
+
+	if serverSource {
+		key.destPort = 0
+	} else {
+		key.sourcePort = 0
+	}
+
+	return key
+}
+
+// NewSummaryContextEvent returns the KindSummary event of the summary of the
+// key, timed at the end of its interval, with the enrichment of its last
+// event.
+func newSummaryContextEvent(key connectionKey, tracked *summaryEvent) *ContextEvent {
+	last := tracked.last
+	return &ContextEvent{
+		Event: &event.Event{
+			Time:       tracked.summary.End,
+			SourceIP:   net.IP(key.sourceIP),
+			DestIP:     net.IP(key.destIP),
+			SourcePort: key.sourcePort,
+			DestPort:   key.destPort,
+		},
+		Kind:          KindSummary,
+		NetNS:         last.NetNS,
+		SourceHost:    last.SourceHost,
+		DestHost:      last.DestHost,
+		RemoteCountry: last.RemoteCountry,
+		RemoteASN:     last.RemoteASN,
+		RemoteASOrg:   last.RemoteASOrg,
+		Direction:     last.Direction,
+		Role:          last.Role,
+		Summary:       tracked.summary,
+	}
+}
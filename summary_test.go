@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+func TestSummariserAggregate(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	summariser := newSummariser(time.Minute)
+
+	opened := newMockTransition(start.Add(time.Second), nil, tcpstate.StateEstablished)
+	reset := newMockTransition(start.Add(2*time.Second), nil, tcpstate.StateEstablished)
+	reset.Kind = KindSendReset
+
+	// Another connection, of another ephemeral port, to the same peer and port
+	closed := newMockTransition(start.Add(3*time.Second), nil, tcpstate.StateClosed)
+	closed.SourcePort, closed.OldState = 44408, tcpstate.StateLastAck
+
+	lost := &ContextEvent{Event: newMockTransition(start, nil, tcpstate.StateClosed).Event, Kind: KindLostEvents}
+
+	for _, event := range []*ContextEvent{opened, reset, closed} {
+		if !summariser.aggregate(event) {
+			t.Errorf("expected %v event to be absorbed, but was not", event.Kind)
+		}
+	}
+
+	if summariser.aggregate(lost) {
+		t.Error("expected lost events marker not to be absorbed, but was")
+	}
+
+	if _, ok := summariser.next(); ok {
+		t.Fatal("expected no summary before interval ended, got one")
+	}
+
+	// The next interval ends the first
+	failed := newMockTransition(start.Add(time.Minute), nil, tcpstate.StateClosed)
+	summariser.aggregate(failed)
+
+	summary, ok := summariser.next()
+	if !ok {
+		t.Fatal("expected summary, got none")
+	}
+
+	if summary.Kind != KindSummary || !summary.Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected summary at end of interval, got %v at %v", summary.Kind, summary.Time)
+	}
+
+	if !summary.SourceIP.Equal(net.ParseIP("192.168.122.38")) ||
+		!summary.DestIP.Equal(net.ParseIP("172.217.169.4")) ||
+		summary.SourcePort != 0 ||
+		summary.DestPort != 80 {
+		t.Errorf("expected summary of 192.168.122.38 to 172.217.169.4:80, got %v:%d to %v:%d",
+			summary.SourceIP,
+			summary.SourcePort,
+			summary.DestIP,
+			summary.DestPort)
+	}
+
+	expected := Summary{
+		Start:  start,
+		End:    start.Add(time.Minute),
+		Opened: 1,
+		Closed: 1,
+		Resets: 1,
+	}
+	if *summary.Summary != expected {
+		t.Errorf("expected summary %+v, got %+v", expected, *summary.Summary)
+	}
+
+	if _, ok := summariser.next(); ok {
+		t.Error("expected no further summary, got one")
+	}
+
+	if !summariser.flush() {
+		t.Fatal("expected summary of last interval to be flushed, but was not")
+	}
+
+	summary, _ = summariser.next()
+	if summary.Summary.Failed != 1 {
+		t.Errorf("expected summary of 1 failed connection, got %+v", *summary.Summary)
+	}
+}
+
+func TestSummariserAggregateByRole(t *testing.T) {
+	summariser := newSummariser(time.Minute)
+
+	// An inbound connection to a port above the ephemeral port of the client
+	inbound := newMockTransition(time.Now(), nil, tcpstate.StateEstablished)
+	inbound.SourcePort, inbound.DestPort, inbound.Role = 50000, 40000, RoleServer
+	summariser.aggregate(inbound)
+	summariser.flush()
+
+	summary, ok := summariser.next()
+	if !ok {
+		t.Fatal("expected summary, got none")
+	}
+
+	if summary.SourcePort != 50000 || summary.DestPort != 0 {
+		t.Errorf("expected summary of source port 50000, got %d to %d", summary.SourcePort, summary.DestPort)
+	}
+}
+
+func TestReplayEventerSummarises(t *testing.T) {
+	capture := "" +
+		"            curl-1234    [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=443 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n" +
+		"            curl-1234    [000] ..s.   995.368985: inet_sock_set_state: family=AF_INET protocol=IPPROTO_TCP sport=44408 dport=443 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n"
+
+	eventer, err := newReplayEventer(newReplaySource(strings.NewReader(capture), "", false),
+		&config{summaryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+
+	event, err := eventer.EventWithContext()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.Kind != KindSummary || event.Summary.Opened != 2 || event.DestPort != 443 {
+		t.Errorf("expected summary of 2 connections opened to port 443, got %v of %+v to %d",
+			event.Kind,
+			event.Summary,
+			event.DestPort)
+	}
+
+	if _, err := eventer.EventWithContext(); err == nil {
+		t.Error("expected EOF error, got nil")
+	}
+}
+
+func TestSummariserExpires(t *testing.T) {
+	summariser := newSummariser(time.Hour)
+	if _, ok := summariser.expiry(); ok {
+		t.Error("expected no expiry without summaries, got one")
+	}
+
+	summariser.aggregate(newMockTransition(time.Now(), nil, tcpstate.StateEstablished))
+	expiry, ok := summariser.expiry()
+	if !ok {
+		t.Fatal("expected expiry of the interval, got none")
+	}
+
+	if summariser.expire(expiry.Add(-time.Millisecond)) {
+		t.Error("expected interval not to end before expiry, but did")
+	}
+
+	if !summariser.expire(expiry) {
+		t.Fatal("expected interval to end at expiry, but did not")
+	}
+
+	if summary, ok := summariser.next(); !ok || summary.Summary.Opened != 1 {
+		t.Errorf("expected summary of 1 connection opened, got %+v", summary)
+	}
+}
+
+func TestSourceEventerSummaryIntervalExpires(t *testing.T) {
+	mockEvent := newMockTransition(time.Now(), nil, tcpstate.StateEstablished)
+	eventer, err := newSourceEventer(newMockEventSource([]*ContextEvent{mockEvent}, nil),
+		newMockEventParser(nil, nil, 0),
+		&config{summaryInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	// The summary is returned once the interval ends, though no later event
+	// is read
+	event, err := eventer.EventWithContext()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.Kind != KindSummary || event.Summary.Opened != 1 {
+		t.Errorf("expected summary of 1 connection opened, got %v of %+v", event.Kind, event.Summary)
+	}
+}
+
+func TestSourceEventerEventSummarisedError(t *testing.T) {
+	eventer, err := newSourceEventer(newMockEventSource(nil, nil),
+		newMockEventParser(nil, nil, 0),
+		&config{summaryInterval: time.Minute})
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	if _, err := eventer.Event(); !errors.Is(err, ErrEventsSummarised) {
+		t.Errorf("expected error chain to include %q, got %q (of type %T)", ErrEventsSummarised, err, err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"net"
+)
+
+// InetSockSetStateLayout is the order in which the sock/inet_sock_set_state
+// tracepoint prints its tagged fields.
+var inetSockSetStateLayout = []string{
+	"family",
+	"protocol",
+	"sport",
+	"dport",
+	"saddr",
+	"daddr",
+	"saddrv6",
+	"daddrv6",
+	"oldstate",
+	"newstate",
+}
+
+// MaxLayoutTags is the most tagged fields a layout may have.
+const maxLayoutTags = 16
+
+// LayoutValues are the values of tagged fields extracted by their position in
+// a layout. The values are slices of the line, so are not allocated.
+type layoutValues struct {
+	layout []string
+	values [maxLayoutTags][]byte
+}
+
+// Get returns the value of the tag, or nil if it is not in the layout.
+func (lv *layoutValues) get(tag string) []byte {
+	for i, layoutTag := range lv.layout {
+		if layoutTag == tag {
+			return lv.values[i]
+		}
+	}
+
+	return nil
+}
+
+// ExtractLayoutValues extracts the values of the tagged fields of the stream
+// by their position in the layout. If the stream does not consist of exactly
+// the tags of the layout, in order, ok is false.
+func extractLayoutValues(str []byte, layout []string, lv *layoutValues) (ok bool) {
+	if len(layout) == 0 || len(layout) > maxLayoutTags {
+		return false
+	}
+	lv.layout = layout
+
+	for i, tag := range layout {
+		if len(str) <= len(tag) || string(str[:len(tag)]) != tag || str[len(tag)] != '=' {
+			return false
+		}
+		str = str[len(tag)+1:]
+
+		end := bytes.IndexByte(str, ' ')
+		if i == len(layout)-1 {
+			if end != -1 { // Tags follow those of the layout
+				return false
+			}
+			end = len(str)
+		} else if end == -1 {
+			return false
+		}
+
+		if end == 0 {
+			return false
+		}
+		lv.values[i] = str[:end]
+
+		if end < len(str) {
+			str = str[end+1:]
+		}
+	}
+
+	return true
+}
+
+// DecodeLayoutFields decodes the fields of a TCPv4 state change event from its
+// tagged fields by their position in the layout, without building the map of
+// tagged fields. If the fields are not in the layout, or are anything other
+// than those of a TCPv4 state change with known states, ok is false, and they
+// must be decoded by decodeTaggedFields, which reports why.
+func decodeLayoutFields(str []byte, layout []string, addrs *eventAddresses) (fields decodedFields, ok bool) {
+	var lv layoutValues
+	if !extractLayoutValues(str, layout, &lv) {
+		return fields, false
+	}
+
+	if string(lv.get("family")) != familyInet || string(lv.get("protocol")) != protocolTCP {
+		return fields, false
+	}
+
+	if fields.sourcePort, ok = parsePortBytes(lv.get("sport")); !ok {
+		return fields, false
+	}
+
+	if fields.destPort, ok = parsePortBytes(lv.get("dport")); !ok {
+		return fields, false
+	}
+
+	var sourceStorage, destStorage *[net.IPv6len]byte
+	if addrs != nil {
+		sourceStorage, destStorage = &addrs.source, &addrs.dest
+	}
+
+	if fields.sourceIP, ok = parseIPv4BytesInto(lv.get("saddr"), sourceStorage); !ok {
+		return fields, false
+	}
+
+	if fields.destIP, ok = parseIPv4BytesInto(lv.get("daddr"), destStorage); !ok {
+		return fields, false
+	}
+
+	stateMappings.RLock()
+	defer stateMappings.RUnlock()
+
+	if fields.oldState, ok = stateMappings.states[string(lv.get("oldstate"))]; !ok {
+		return fields, false
+	}
+
+	if fields.newState, ok = stateMappings.states[string(lv.get("newstate"))]; !ok {
+		return fields, false
+	}
+
+	return fields, true
+}
+
+// ParsePortBytes parses a decimal port, without allocating.
+func parsePortBytes(port []byte) (uint16, bool) {
+	if len(port) == 0 || len(port) > 5 {
+		return 0, false
+	}
+
+	var value uint32
+	for _, digit := range port {
+		if digit < '0' || digit > '9' {
+			return 0, false
+		}
+		value = value*10 + uint32(digit-'0')
+	}
+
+	if value > 0xffff {
+		return 0, false
+	}
+
+	return uint16(value), true
+}
+
+// ParseIPv4Bytes parses a dotted-decimal IPv4 address, as printed by the %pI4
+// conversion, allocating only the address. As by net.ParseIP, the address is
+// of the 16-byte form, and octets with leading zeros are rejected.
+func parseIPv4Bytes(addr []byte) (net.IP, bool) {
+	return parseIPv4BytesInto(addr, nil)
+}
+
+// ParseIPv4BytesInto is as parseIPv4Bytes, but stores the address in the
+// storage, if any, rather than allocating it.
+func parseIPv4BytesInto(addr []byte, storage *[net.IPv6len]byte) (net.IP, bool) {
+	var octets [net.IPv4len]byte
+	for i := range octets {
+		end := bytes.IndexByte(addr, '.')
+		if i == len(octets)-1 {
+			if end != -1 {
+				return nil, false
+			}
+			end = len(addr)
+		} else if end == -1 {
+			return nil, false
+		}
+
+		octet := addr[:end]
+		if len(octet) == 0 || len(octet) > 3 || len(octet) > 1 && octet[0] == '0' {
+			return nil, false
+		}
+
+		var value int
+		for _, digit := range octet {
+			if digit < '0' || digit > '9' {
+				return nil, false
+			}
+			value = value*10 + int(digit-'0')
+		}
+
+		if value > 0xff {
+			return nil, false
+		}
+		octets[i] = byte(value)
+
+		if end < len(addr) {
+			addr = addr[end+1:]
+		}
+	}
+
+	if storage == nil {
+		return net.IPv4(octets[0], octets[1], octets[2], octets[3]), true
+	}
+	*storage = [net.IPv6len]byte{10: 0xff, 11: 0xff, 12: octets[0], 13: octets[1], 14: octets[2], 15: octets[3]}
+
+	return net.IP(storage[:]), true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const mockLayoutTags = "family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED"
+
+// decodeGenericFields decodes tags as the parser does when they are not in the
+// known layout.
+func decodeGenericFields(t testing.TB, tags string) (decodedFields, error) {
+	eventParser := newTraceFSEventParser(new(slicingFieldParser), defaultTracepointCandidates)
+	pc := eventParser.parseContexts.Get().(*parseContext)
+	defer eventParser.releaseParseContext(pc)
+	pc.str = []byte(tags)
+
+	return eventParser.decodeTaggedFields(pc,
+		[]byte(tags),
+		[]byte("inet_sock_set_state"),
+		&eventProfile{layout: inetSockSetStateLayout})
+}
+
+func TestDecodeLayoutFields(t *testing.T) {
+	fields, ok := decodeLayoutFields([]byte(mockLayoutTags), inetSockSetStateLayout, nil)
+	if !ok {
+		t.Fatal("expected fields to be decoded by layout, but were not")
+	}
+
+	expectedFields, err := decodeGenericFields(t, mockLayoutTags)
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to decode tagged fields: %v", err)
+	}
+
+	if !reflect.DeepEqual(fields, expectedFields) {
+		t.Errorf("expected fields %+v, got %+v", expectedFields, fields)
+	}
+}
+
+func TestDecodeLayoutFieldsNotInLayout(t *testing.T) {
+	for name, tags := range map[string]string{
+		"reordered":       "protocol=IPPROTO_TCP family=AF_INET sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+		"trailing tag":    mockLayoutTags + " sock_cookie=1f4",
+		"missing tag":     "family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+		"empty value":     "family=AF_INET protocol= sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+		"non-INET":        "family=AF_INET6 protocol=IPPROTO_TCP sport=44406 dport=80 saddr=0.0.0.0 daddr=0.0.0.0 saddrv6=::1 daddrv6=::1 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+		"invalid port":    "family=AF_INET protocol=IPPROTO_TCP sport=65536 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+		"invalid address": "family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.256 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED",
+		"unknown state":   "family=AF_INET protocol=IPPROTO_TCP sport=44406 dport=80 saddr=192.168.122.38 daddr=172.217.169.4 saddrv6=::ffff:192.168.122.38 daddrv6=::ffff:172.217.169.4 oldstate=TCP_MOCK_STATE newstate=TCP_ESTABLISHED",
+	} {
+		if _, ok := decodeLayoutFields([]byte(tags), inetSockSetStateLayout, nil); ok {
+			t.Errorf("expected %s fields not to be decoded by layout, but were", name)
+		}
+	}
+}
+
+func TestDecodeLayoutFieldsNoLayout(t *testing.T) {
+	if _, ok := decodeLayoutFields([]byte(mockLayoutTags), nil, nil); ok {
+		t.Error("expected fields not to be decoded without a layout, but were")
+	}
+}
+
+func TestParsePortBytes(t *testing.T) {
+	for port, expected := range map[string]uint16{"0": 0, "80": 80, "65535": 65535} {
+		value, ok := parsePortBytes([]byte(port))
+		if !ok || value != expected {
+			t.Errorf("expected port %q to be parsed as %d, got %d (ok: %t)", port, expected, value, ok)
+		}
+	}
+
+	for _, port := range []string{"", "-1", "65536", "123456", "8O"} {
+		if _, ok := parsePortBytes([]byte(port)); ok {
+			t.Errorf("expected port %q not to be parsed, but was", port)
+		}
+	}
+}
+
+func TestParseIPv4Bytes(t *testing.T) {
+	ip, ok := parseIPv4Bytes([]byte("192.168.122.38"))
+	if !ok || ip.String() != "192.168.122.38" {
+		t.Errorf("expected address 192.168.122.38, got %v (ok: %t)", ip, ok)
+	}
+
+	for _, addr := range []string{"", "192.168.122", "192.168.122.38.1", "192.168.122.256", "192.168.0122.38", "192.168..38", "a.b.c.d"} {
+		if _, ok := parseIPv4Bytes([]byte(addr)); ok {
+			t.Errorf("expected address %q not to be parsed, but was", addr)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// PreferredTraceClock is the trace clock set in instances owned by the eventer.
+// Unlike mono, it includes time spent suspended, so stays in step with the
+// wall clock.
+const preferredTraceClock = "boot"
+
+// TraceClockIDs are the POSIX clock IDs of the trace clocks which can be
+// converted to wall-clock time. The default local clock cannot, as it is not
+// exposed to userspace.
+var traceClockIDs = map[string]uintptr{
+	"mono":     1, // CLOCK_MONOTONIC
+	"mono_raw": 4, // CLOCK_MONOTONIC_RAW
+	"boot":     7, // CLOCK_BOOTTIME
+}
+
+// ParseTraceClock returns the selected clock from the contents of a
+// trace_clock file, which lists the available clocks with the selected clock
+// in brackets, e.g. `local global [boot] mono`.
+func parseTraceClock(contents string) (string, error) {
+	for _, clock := range strings.Fields(contents) {
+		if strings.HasPrefix(clock, "[") && strings.HasSuffix(clock, "]") {
+			return strings.Trim(clock, "[]"), nil
+		}
+	}
+
+	return "", errors.New("no trace clock selected")
+}
+
+// TraceClock converts the trace timestamps of a trace clock to wall-clock time.
+type traceClock struct {
+	clockID uintptr
+}
+
+// NewTraceClock returns a converter for the named trace clock, or nil if its
+// timestamps cannot be converted.
+func newTraceClock(name string) *traceClock {
+	clockID, ok := traceClockIDs[name]
+	if !ok {
+		return nil
+	}
+
+	return &traceClock{clockID: clockID}
+}
+
+// ToTime converts the trace timestamp to wall-clock time, by subtracting its
+// age, according to the trace clock, from the current wall-clock time.
+func (tc *traceClock) toTime(timestamp traceTimestamp) (time.Time, error) {
+	now := time.Now()
+
+	clockTime, err := clockNow(tc.clockID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	age := clockTime -
+		time.Duration(timestamp.sec)*time.Second -
+		time.Duration(timestamp.nsec)
+
+	return now.Add(-age), nil
+}
+
+// ClockNow returns the current time of the POSIX clock of the ID.
+func clockNow(clockID uintptr) (time.Duration, error) {
+	var now syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME,
+		clockID,
+		uintptr(unsafe.Pointer(&now)),
+		0); errno != 0 {
+		return 0, errno
+	}
+
+	return time.Duration(now.Nano()), nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestParseTraceClock(t *testing.T) {
+	clock, err := parseTraceClock("local global counter uptime perf mono mono_raw [boot] tai x86-tsc\n")
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if clock != "boot" {
+		t.Errorf("expected clock %q, got %q", "boot", clock)
+	}
+}
+
+func TestParseTraceClockNoneSelectedError(t *testing.T) {
+	_, err := parseTraceClock("local global boot\n")
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestNewTraceClockUnconvertible(t *testing.T) {
+	for _, clock := range []string{"local", "global", "x86-tsc", ""} {
+		if newTraceClock(clock) != nil {
+			t.Errorf("expected clock %q to be unconvertible, but was not", clock)
+		}
+	}
+}
+
+func TestTraceClockToTime(t *testing.T) {
+	clock := newTraceClock("boot")
+
+	// A timestamp of 2 seconds ago, as the trace would print it
+	timestamp, err := parseTraceTimestamp([]byte(mockBootTimeAgo(t, 2*time.Second)))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock timestamp: %v", err)
+	}
+
+	eventTime, err := clock.toTime(timestamp)
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedTime := time.Now().Add(-2 * time.Second)
+	if difference := expectedTime.Sub(eventTime); difference < -time.Second || difference > time.Second {
+		t.Errorf("expected time of about %v, got %v", expectedTime, eventTime)
+	}
+}
+
+// MockBootTimeAgo returns the CLOCK_BOOTTIME timestamp of the given time ago,
+// formatted as in the timestamp column of a trace line.
+func mockBootTimeAgo(t *testing.T, ago time.Duration) string {
+	var now syscall.Timespec
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME,
+		traceClockIDs["boot"],
+		uintptr(unsafe.Pointer(&now)),
+		0); errno != 0 {
+		t.Fatalf("test bootstrapping: unable to get boot time: %v", errno)
+	}
+
+	then := time.Duration(now.Nano()) - ago
+	return fmt.Sprintf("%d.%06d", then/time.Second, (then%time.Second)/time.Microsecond)
+}
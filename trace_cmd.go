@@ -0,0 +1,721 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The parts of version 6 of the trace-cmd .dat format, and of the pages of the
+// ring buffer it records, needed to decode the events of a flyrecord.
+const (
+	traceCmdVersion = "6"
+
+	traceCmdHeaderPageMarker  = "header_page\x00"
+	traceCmdHeaderEventMarker = "header_event\x00"
+	traceCmdOptionsMarker     = "options  \x00"
+	traceCmdFlyrecordMarker   = "flyrecord\x00"
+
+	// The types of the events of a page, by their type_len, the others being
+	// data of four times the type_len bytes, or, if zero, of a length given
+	ringBufferTypePadding    = 29
+	ringBufferTypeTimeExtend = 30
+	ringBufferTypeTimeStamp  = 31
+
+	ringBufferTypeLenBits = 5
+	ringBufferTSShift     = 27
+
+	// The commit of a page is the length of its data, along with flags of
+	// whether events were lost before it, and whether their number is stored
+	// after its data.
+	ringBufferCommitMask   = 1<<27 - 1
+	ringBufferMissedEvents = 1 << 31
+	ringBufferMissedStored = 1 << 30
+
+	// The largest page, and the most CPUs, of a recording which are decoded,
+	// as a damaged or hostile recording could otherwise claim any number
+	traceCmdMaxPageSize = 1 << 20
+	traceCmdMaxCPUs     = 8192
+)
+
+// TraceCmdMagic begins every trace-cmd .dat file.
+var traceCmdMagic = []byte("\x17\x08\x44tracing")
+
+// TraceCmdIDPattern matches the ID of an event in its format.
+var traceCmdIDPattern = regexp.MustCompile(`(?m)^ID: (\d+)$`)
+
+// TraceCmdEvent is an event recorded by trace-cmd, which is decoded.
+type traceCmdEvent struct {
+	format  *eventFormat
+	decoder *tracepointRecordDecoder
+}
+
+// TraceCmdReader reads a trace-cmd recording, as made by `trace-cmd record`,
+// decoding the events of the tracepoints of the candidates, ordered by time
+// across CPUs. Events of other tracepoints are skipped. Only flyrecords of
+// version 6 of the format, of the byte order of the host, are supported. The
+// timestamps are those of the trace clock of the recording.
+type traceCmdReader struct {
+	events map[uint16]*traceCmdEvent // By ID
+	comms  map[int64]string          // The commands of tasks, by PID
+	cpus   []*traceCmdCPU
+
+	err error // The error of decoding the recording, once exhausted
+}
+
+// TraceCmdCPU is the cursor of the events of a CPU in its pages of a
+// recording.
+type traceCmdCPU struct {
+	cpu  int
+	data *io.SectionReader
+
+	page       []byte
+	next       int64 // The offset in data of the next page
+	dataOffset int   // The offset of the data in a page, after its header
+	commitSize int   // The size of the commit of the header of a page
+	index      int   // The offset in the page of the next event
+	end        int   // The end of the data in the page
+
+	// The current event, or lost events marker if lost is non-zero
+	time   uint64
+	record []byte
+	lost   uint64
+	done   bool
+}
+
+// IsTraceCmdRecording returns whether the start of a file is the magic of a
+// trace-cmd recording.
+func isTraceCmdRecording(start []byte) bool {
+	return bytes.HasPrefix(start, traceCmdMagic)
+}
+
+// NewTraceCmdReader decodes the headers of the trace-cmd recording, returning
+// a reader of its events of the tracepoints of the candidates, which are
+// decoded as configured.
+func newTraceCmdReader(recording io.ReaderAt,
+	candidates []*tracepointCandidate,
+	cfg *config) (*traceCmdReader, error) {
+	tracepoints := make(map[string]bool, len(candidates))
+	for _, candidate := range candidates {
+		tracepoints[candidate.tracepoint] = true
+	}
+
+	header := &traceCmdHeaderReader{
+		reader: bufio.NewReader(io.NewSectionReader(recording, 0, math.MaxInt64)),
+		order:  hostByteOrder,
+	}
+
+	reader := &traceCmdReader{
+		events: make(map[uint16]*traceCmdEvent),
+		comms:  make(map[int64]string),
+	}
+
+	if err := header.expect(string(traceCmdMagic)); err != nil {
+		return nil, errors.New("not a trace-cmd recording")
+	}
+
+	version, err := header.readString()
+	if err != nil {
+		return nil, fmt.Errorf("reading version: %w", err)
+	}
+
+	if version != traceCmdVersion {
+		return nil, fmt.Errorf("unsupported trace-cmd recording version %q", version)
+	}
+
+	bigEndian, err := header.readUint(1)
+	if err != nil {
+		return nil, fmt.Errorf("reading byte order: %w", err)
+	}
+
+	// Records are decoded in the byte order of the host
+	if hostBigEndian := hostByteOrder.Uint16([]byte{0, 1}) == 1; (bigEndian == 1) != hostBigEndian {
+		return nil, errors.New("recording of a host of another byte order")
+	}
+
+	if _, err := header.readUint(1); err != nil {
+		return nil, fmt.Errorf("reading long size: %w", err)
+	}
+
+	pageSize, err := header.readUint(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading page size: %w", err)
+	}
+
+	if pageSize == 0 || pageSize&(pageSize-1) != 0 || pageSize > traceCmdMaxPageSize {
+		return nil, fmt.Errorf("invalid page size of %d bytes", pageSize)
+	}
+
+	if err := header.expect(traceCmdHeaderPageMarker); err != nil {
+		return nil, fmt.Errorf("reading page header: %w", err)
+	}
+
+	headerPage, err := header.readSection(8)
+	if err != nil {
+		return nil, fmt.Errorf("reading page header: %w", err)
+	}
+
+	dataOffset, commitSize, err := parseTraceCmdHeaderPage(headerPage)
+	if err != nil {
+		return nil, fmt.Errorf("parsing page header: %w", err)
+	}
+
+	if uint64(dataOffset) >= pageSize {
+		return nil, fmt.Errorf("page data at %d beyond page of %d bytes", dataOffset, pageSize)
+	}
+
+	if err := header.expect(traceCmdHeaderEventMarker); err != nil {
+		return nil, fmt.Errorf("reading event header: %w", err)
+	}
+
+	if _, err := header.readSection(8); err != nil {
+		return nil, fmt.Errorf("reading event header: %w", err)
+	}
+
+	// The formats of the events of ftrace itself, such as of functions
+	ftraceEvents, err := header.readUint(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading ftrace formats: %w", err)
+	}
+
+	for i := uint64(0); i < ftraceEvents; i++ {
+		if _, err := header.readSection(8); err != nil {
+			return nil, fmt.Errorf("reading ftrace formats: %w", err)
+		}
+	}
+
+	systems, err := header.readUint(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading event formats: %w", err)
+	}
+
+	for i := uint64(0); i < systems; i++ {
+		if err := reader.readSystem(header, tracepoints, cfg); err != nil {
+			return nil, fmt.Errorf("reading event formats: %w", err)
+		}
+	}
+
+	if len(reader.events) == 0 {
+		return nil, errors.New("no events of TCP state changes recorded")
+	}
+
+	if _, err := header.readSection(4); err != nil {
+		return nil, fmt.Errorf("reading kallsyms: %w", err)
+	}
+
+	if _, err := header.readSection(4); err != nil {
+		return nil, fmt.Errorf("reading trace_printk formats: %w", err)
+	}
+
+	cmdlines, err := header.readSection(8)
+	if err != nil {
+		return nil, fmt.Errorf("reading cmdlines: %w", err)
+	}
+	reader.parseCmdlines(cmdlines)
+
+	cpus, err := header.readUint(4)
+	if err != nil {
+		return nil, fmt.Errorf("reading CPUs: %w", err)
+	}
+
+	if cpus > traceCmdMaxCPUs {
+		return nil, fmt.Errorf("recording of %d CPUs, more than %d", cpus, traceCmdMaxCPUs)
+	}
+
+	marker, err := header.readBytes(len(traceCmdFlyrecordMarker))
+	if err != nil {
+		return nil, fmt.Errorf("reading options: %w", err)
+	}
+
+	if string(marker) == traceCmdOptionsMarker {
+		if err := header.skipOptions(); err != nil {
+			return nil, fmt.Errorf("reading options: %w", err)
+		}
+
+		if marker, err = header.readBytes(len(traceCmdFlyrecordMarker)); err != nil {
+			return nil, fmt.Errorf("reading flyrecord: %w", err)
+		}
+	}
+
+	if string(marker) != traceCmdFlyrecordMarker {
+		return nil, fmt.Errorf("unsupported recording of %q, rather than a flyrecord", strings.TrimRight(string(marker), " \x00"))
+	}
+
+	// The data of the CPUs follows their offsets and sizes
+	end := header.offset + cpus*16
+	for cpu := 0; cpu < int(cpus); cpu++ {
+		offset, err := header.readUint(8)
+		if err != nil {
+			return nil, fmt.Errorf("reading flyrecord of CPU %d: %w", cpu, err)
+		}
+
+		size, err := header.readUint(8)
+		if err != nil {
+			return nil, fmt.Errorf("reading flyrecord of CPU %d: %w", cpu, err)
+		}
+
+		if err := checkTraceCmdCPUData(recording, offset, size, end, pageSize); err != nil {
+			return nil, fmt.Errorf("reading flyrecord of CPU %d: %w", cpu, err)
+		}
+		cursor := &traceCmdCPU{
+			cpu:        cpu,
+			data:       io.NewSectionReader(recording, int64(offset), int64(size)),
+			dataOffset: dataOffset,
+			commitSize: commitSize,
+		}
+		if size > 0 {
+			cursor.page = make([]byte, pageSize)
+		}
+		end = offset + size
+
+		if err := cursor.advance(); err != nil {
+			return nil, fmt.Errorf("reading flyrecord of CPU %d: %w", cpu, err)
+		}
+		reader.cpus = append(reader.cpus, cursor)
+	}
+
+	return reader, nil
+}
+
+// CheckTraceCmdCPUData checks that the data of a CPU, at the offset and of the
+// size in the recording, follows the headers, or the data of the previous CPU,
+// which ended at the end, is of whole pages, and is within the recording, so
+// that only the pages of data actually recorded are read, and allocated for.
+func checkTraceCmdCPUData(recording io.ReaderAt, offset, size, end, pageSize uint64) error {
+	if offset < end || size > math.MaxInt64 || offset > math.MaxInt64-size {
+		return fmt.Errorf("data at offset %d of %d bytes overlaps the headers or that of another CPU, or overflows",
+			offset,
+			size)
+	}
+
+	if size == 0 {
+		return nil
+	}
+
+	if size%pageSize != 0 {
+		return fmt.Errorf("data of %d bytes not of whole pages of %d bytes", size, pageSize)
+	}
+
+	var last [1]byte
+	if _, err := recording.ReadAt(last[:], int64(offset+size-1)); err != nil {
+		return fmt.Errorf("data at offset %d of %d bytes beyond end of recording: %w", offset, size, err)
+	}
+
+	return nil
+}
+
+// ReadSystem reads the formats of the events of a system, keeping those of
+// the tracepoints.
+func (r *traceCmdReader) readSystem(header *traceCmdHeaderReader, tracepoints map[string]bool, cfg *config) error {
+	system, err := header.readString()
+	if err != nil {
+		return err
+	}
+
+	events, err := header.readUint(4)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < events; i++ {
+		formatText, err := header.readSection(8)
+		if err != nil {
+			return err
+		}
+
+		format, err := parseEventFormat(bytes.NewReader(formatText))
+		if err != nil || !tracepoints[system+"/"+format.name] {
+			continue // Formats which cannot be parsed are not needed either
+		}
+
+		match := traceCmdIDPattern.FindSubmatch(formatText)
+		if match == nil {
+			return fmt.Errorf("no ID in format of %s/%s", system, format.name)
+		}
+
+		id, err := strconv.ParseUint(string(match[1]), 10, 16)
+		if err != nil {
+			return fmt.Errorf("parsing ID of %s/%s: %w", system, format.name, err)
+		}
+
+		decoder, err := newTracepointRecordDecoder(format, cfg)
+		if err != nil {
+			return fmt.Errorf("decoding records of %s/%s: %w", system, format.name, err)
+		}
+
+		r.events[uint16(id)] = &traceCmdEvent{format: format, decoder: decoder}
+	}
+
+	return nil
+}
+
+// ParseCmdlines parses the commands of tasks, which are of the form
+// `<pid> <comm>`, one per line.
+func (r *traceCmdReader) parseCmdlines(cmdlines []byte) {
+	for _, line := range strings.Split(string(cmdlines), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		if pid, err := strconv.ParseInt(fields[0], 10, 32); err == nil {
+			r.comms[pid] = fields[1]
+		}
+	}
+}
+
+// Next returns the event of the earliest record of any CPU, along with its
+// timestamp, returning io.EOF once the events of all CPUs have been read. The
+// events lost before a page are returned as a *LostEventsError, which has no
+// timestamp.
+func (r *traceCmdReader) next() (*ContextEvent, traceTimestamp, error) {
+	for {
+		if r.err != nil {
+			return nil, traceTimestamp{}, r.err
+		}
+
+		var earliest *traceCmdCPU
+		for _, cpu := range r.cpus {
+			if !cpu.done && (earliest == nil || cpu.time < earliest.time) {
+				earliest = cpu
+			}
+		}
+
+		if earliest == nil {
+			r.err = io.EOF
+			continue
+		}
+
+		timestamp := traceTimestamp{
+			sec:  earliest.time / uint64(time.Second),
+			nsec: earliest.time % uint64(time.Second),
+		}
+		event, err := r.decode(earliest)
+		if err := earliest.advance(); err != nil {
+			r.err = fmt.Errorf("reading flyrecord of CPU %d: %w", earliest.cpu, err)
+		}
+
+		if event != nil || err != nil {
+			return event, timestamp, err
+		}
+	}
+}
+
+// Decode decodes the current event of the CPU, of the task recorded, or returns
+// neither an event nor an error if it is of another tracepoint.
+func (r *traceCmdReader) decode(cpu *traceCmdCPU) (*ContextEvent, error) {
+	if cpu.lost != 0 {
+		return nil, &LostEventsError{CPU: cpu.cpu, Lost: cpu.lost}
+	}
+
+	if len(cpu.record) < 2 {
+		return nil, nil
+	}
+
+	event, ok := r.events[hostByteOrder.Uint16(cpu.record)]
+	if !ok {
+		return nil, nil
+	}
+
+	contextEvent, err := event.decoder.decode(cpu.record)
+	if err != nil {
+		return nil, fmt.Errorf("decoding trace-cmd event on CPU %d: %w", cpu.cpu, err)
+	}
+
+	var pid int64
+	if field, ok := event.format.fields["common_pid"]; ok && field.offset+field.size <= len(cpu.record) {
+		pid, _ = recordInteger(cpu.record[field.offset:field.offset+field.size], field.signed)
+	}
+
+	comm, ok := r.comms[pid]
+	switch {
+	case pid == idlePID:
+		comm = "<idle>"
+	case !ok:
+		comm = "<...>"
+	}
+
+	contextEvent.CommandOnCPU = comm
+	contextEvent.PIDOnCPU = int(pid)
+	contextEvent.Idle = pid == idlePID
+	contextEvent.Context = event.decoder.traceContext(cpu.record, cpu.cpu)
+
+	return contextEvent, nil
+}
+
+// Advance moves the cursor to the next data event of the CPU, or to the
+// marker of the events lost before a page, loading the next page once those
+// of the page are exhausted, or marks it done once all pages are.
+func (c *traceCmdCPU) advance() error {
+	c.record, c.lost = nil, 0
+	for {
+		for c.index < c.end {
+			record, err := c.nextEvent()
+			if err != nil {
+				return err
+			}
+
+			if record != nil {
+				c.record = record
+				return nil
+			}
+		}
+
+		if c.next >= c.data.Size() {
+			c.done = true
+			return nil
+		}
+
+		if err := c.loadPage(); err != nil {
+			return err
+		}
+
+		if c.lost != 0 {
+			return nil
+		}
+	}
+}
+
+// LoadPage reads the next page, whose events begin at the timestamp of its
+// header.
+func (c *traceCmdCPU) loadPage() error {
+	n, err := c.data.ReadAt(c.page, c.next)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if n < c.dataOffset {
+		return fmt.Errorf("truncated page at offset %d", c.next)
+	}
+	page := c.page[:n]
+	c.next += int64(len(c.page))
+
+	commit := traceCmdUint(page[8:], c.commitSize)
+	c.time = hostByteOrder.Uint64(page)
+	c.index = c.dataOffset
+	c.end = c.dataOffset + int(commit&ringBufferCommitMask)
+	if c.end > len(page) {
+		return fmt.Errorf("page at offset %d of %d bytes committed beyond its end", c.next-int64(len(c.page)), commit&ringBufferCommitMask)
+	}
+
+	// The number of events lost is stored after the data, if there is room
+	if commit&ringBufferMissedEvents != 0 && commit&ringBufferMissedStored != 0 && c.end+c.commitSize <= len(page) {
+		c.lost = traceCmdUint(page[c.end:], c.commitSize)
+	}
+
+	return nil
+}
+
+// NextEvent decodes the event at the index of the page, returning its record
+// if it is of data, and accumulating its time delta.
+func (c *traceCmdCPU) nextEvent() ([]byte, error) {
+	if c.end-c.index < 4 {
+		return nil, fmt.Errorf("truncated event at offset %d of page", c.index)
+	}
+
+	// The type_len is the low bits of the header in little endian, and the
+	// high bits in big endian
+	header := hostByteOrder.Uint32(c.page[c.index:])
+	typeLen, delta := header&(1<<ringBufferTypeLenBits-1), uint64(header>>ringBufferTypeLenBits)
+	if hostByteOrder.Uint16([]byte{0, 1}) == 1 {
+		typeLen, delta = header>>ringBufferTSShift, uint64(header&(1<<ringBufferTSShift-1))
+	}
+	body := c.index + 4
+
+	var start, length int
+	switch typeLen {
+	case ringBufferTypePadding:
+		if delta == 0 {
+			c.index = c.end // The rest of the page is padding
+			return nil, nil
+		}
+		if body+4 > c.end {
+			return nil, fmt.Errorf("truncated padding at offset %d of page", c.index)
+		}
+		c.time += delta
+		c.index = body + int(hostByteOrder.Uint32(c.page[body:]))
+		return nil, nil
+	case ringBufferTypeTimeExtend, ringBufferTypeTimeStamp:
+		if body+4 > c.end {
+			return nil, fmt.Errorf("truncated timestamp at offset %d of page", c.index)
+		}
+		extend := uint64(hostByteOrder.Uint32(c.page[body:]))<<ringBufferTSShift + delta
+		if typeLen == ringBufferTypeTimeStamp {
+			c.time = extend
+		} else {
+			c.time += extend
+		}
+		c.index = body + 4
+		return nil, nil
+	case 0:
+		if body+4 > c.end {
+			return nil, fmt.Errorf("truncated event length at offset %d of page", c.index)
+		}
+		// The length includes that of itself
+		start, length = body+4, (int(hostByteOrder.Uint32(c.page[body:]))-4+3)&^3
+	default:
+		start, length = body, int(typeLen)*4
+	}
+
+	if length < 0 || start+length > c.end {
+		return nil, fmt.Errorf("event at offset %d of page overruns its data", c.index)
+	}
+	c.time += delta
+	c.index = start + length
+
+	return c.page[start : start+length], nil
+}
+
+// ParseTraceCmdHeaderPage returns the offset of the data of a page, and the
+// size of the commit of its header, from the format of its header.
+func parseTraceCmdHeaderPage(headerPage []byte) (dataOffset, commitSize int, err error) {
+	for _, line := range strings.Split(string(headerPage), "\n") {
+		match := fieldPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		switch name, field := parseFormatField(match); name {
+		case "commit":
+			commitSize = field.size
+		case "data":
+			dataOffset = field.offset
+		}
+	}
+
+	if (commitSize != 4 && commitSize != 8) || dataOffset < 8+commitSize {
+		return 0, 0, fmt.Errorf("unexpected page layout of commit of %d bytes and data at %d", commitSize, dataOffset)
+	}
+
+	return dataOffset, commitSize, nil
+}
+
+// TraceCmdUint returns the unsigned integer of the size, in the byte order of
+// the host, at the start of b.
+func traceCmdUint(b []byte, size int) uint64 {
+	if size == 4 {
+		return uint64(hostByteOrder.Uint32(b))
+	}
+
+	return hostByteOrder.Uint64(b)
+}
+
+// TraceCmdHeaderReader reads the headers of a trace-cmd recording, which
+// precede the flyrecord.
+type traceCmdHeaderReader struct {
+	reader *bufio.Reader
+	order  binary.ByteOrder
+	offset uint64 // Of the next byte of the headers to be read
+}
+
+func (h *traceCmdHeaderReader) readBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(h.reader, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	h.offset += uint64(n)
+
+	return b, nil
+}
+
+// Expect reads the marker, returning an error if what is read differs.
+func (h *traceCmdHeaderReader) expect(marker string) error {
+	b, err := h.readBytes(len(marker))
+	if err != nil {
+		return err
+	}
+
+	if string(b) != marker {
+		return fmt.Errorf("expected %q, got %q", strings.TrimRight(marker, "\x00"), b)
+	}
+
+	return nil
+}
+
+// ReadString reads a NUL-terminated string.
+func (h *traceCmdHeaderReader) readString() (string, error) {
+	s, err := h.reader.ReadString(0)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	h.offset += uint64(len(s))
+
+	return strings.TrimSuffix(s, "\x00"), nil
+}
+
+// ReadUint reads an unsigned integer of the size, in bytes.
+func (h *traceCmdHeaderReader) readUint(size int) (uint64, error) {
+	b, err := h.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(h.order.Uint16(b)), nil
+	case 4:
+		return uint64(h.order.Uint32(b)), nil
+	default:
+		return h.order.Uint64(b), nil
+	}
+}
+
+// ReadSection reads a section, preceded by its size, of the size in bytes.
+func (h *traceCmdHeaderReader) readSection(sizeSize int) ([]byte, error) {
+	size, err := h.readUint(sizeSize)
+	if err != nil {
+		return nil, err
+	}
+
+	section, err := ioutil.ReadAll(io.LimitReader(h.reader, int64(size)))
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(section)) != size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	h.offset += size
+
+	return section, nil
+}
+
+// SkipOptions skips the options, each of an ID and data preceded by its size,
+// until that of ID zero.
+func (h *traceCmdHeaderReader) skipOptions() error {
+	for {
+		id, err := h.readUint(2)
+		if err != nil {
+			return err
+		}
+
+		if id == 0 {
+			return nil
+		}
+
+		if _, err := h.readSection(4); err != nil {
+			return fmt.Errorf("reading option %d: %w", id, err)
+		}
+	}
+}
+
+// UnexpectedEOF returns io.ErrUnexpectedEOF in place of io.EOF, as the
+// headers end only with the flyrecord.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+const (
+	mockTraceCmdPageSize = 4096
+
+	mockTraceCmdHeaderPage = "\tfield: u64 timestamp;\toffset:0;\tsize:8;\tsigned:0;\n" +
+		"\tfield: local_t commit;\toffset:8;\tsize:8;\tsigned:1;\n" +
+		"\tfield: int overwrite;\toffset:8;\tsize:1;\tsigned:1;\n" +
+		"\tfield: char data;\toffset:16;\tsize:4080;\tsigned:1;\n"
+
+	mockTraceCmdOtherFormat = `name: sched_switch
+ID: 316
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+
+print fmt: "prev_pid=%d", REC->prev_pid
+`
+)
+
+// MockTraceCmdEvent is an event of a page of the mock recording, at the delta
+// from the previous event.
+type mockTraceCmdEvent struct {
+	delta  uint32
+	record []byte
+}
+
+// NewMockTraceCmdPage returns a page of the ring buffer of the events, from
+// the timestamp, with the number of events lost before it, if any.
+func newMockTraceCmdPage(timestamp uint64, lost uint64, events ...mockTraceCmdEvent) []byte {
+	page := make([]byte, mockTraceCmdPageSize)
+	hostByteOrder.PutUint64(page, timestamp)
+
+	data := page[16:16]
+	for _, event := range events {
+		var header [4]byte
+		if len(event.record) <= 28*4 && len(event.record)%4 == 0 {
+			hostByteOrder.PutUint32(header[:], event.delta<<ringBufferTypeLenBits|uint32(len(event.record)/4))
+			data = append(data, header[:]...)
+		} else {
+			var length [4]byte
+			hostByteOrder.PutUint32(header[:], event.delta<<ringBufferTypeLenBits)
+			hostByteOrder.PutUint32(length[:], uint32(len(event.record)+4))
+			data = append(append(data, header[:]...), length[:]...)
+		}
+		data = append(data, event.record...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+
+	commit := uint64(len(data))
+	if lost != 0 {
+		commit |= ringBufferMissedEvents | ringBufferMissedStored
+		hostByteOrder.PutUint64(page[16+len(data):], lost)
+	}
+	hostByteOrder.PutUint64(page[8:], commit)
+
+	return page
+}
+
+// NewMockTraceCmdRecording returns a trace-cmd recording of the pages of each
+// CPU, with the formats of the mockEventFormat and of another tracepoint.
+func newMockTraceCmdRecording(cpuPages ...[][]byte) []byte {
+	var recording bytes.Buffer
+	u16 := func(v uint16) {
+		var b [2]byte
+		hostByteOrder.PutUint16(b[:], v)
+		recording.Write(b[:])
+	}
+	u32 := func(v uint32) {
+		var b [4]byte
+		hostByteOrder.PutUint32(b[:], v)
+		recording.Write(b[:])
+	}
+	u64 := func(v uint64) {
+		var b [8]byte
+		hostByteOrder.PutUint64(b[:], v)
+		recording.Write(b[:])
+	}
+
+	recording.Write(traceCmdMagic)
+	recording.WriteString("6\x00")
+	if hostByteOrder == binary.ByteOrder(binary.BigEndian) {
+		recording.WriteByte(1)
+	} else {
+		recording.WriteByte(0)
+	}
+	recording.WriteByte(8)
+	u32(mockTraceCmdPageSize)
+
+	recording.WriteString(traceCmdHeaderPageMarker)
+	u64(uint64(len(mockTraceCmdHeaderPage)))
+	recording.WriteString(mockTraceCmdHeaderPage)
+	recording.WriteString(traceCmdHeaderEventMarker)
+	u64(0)
+
+	u32(0) // No ftrace formats
+	u32(2)
+	recording.WriteString("sock\x00")
+	u32(1)
+	u64(uint64(len(mockEventFormat)))
+	recording.WriteString(mockEventFormat)
+	recording.WriteString("sched\x00")
+	u32(1)
+	u64(uint64(len(mockTraceCmdOtherFormat)))
+	recording.WriteString(mockTraceCmdOtherFormat)
+
+	u32(0) // No kallsyms
+	u32(0) // No trace_printk formats
+	cmdlines := "1234 curl\n"
+	u64(uint64(len(cmdlines)))
+	recording.WriteString(cmdlines)
+
+	u32(uint32(len(cpuPages)))
+	recording.WriteString(traceCmdOptionsMarker)
+	u16(3) // The option of the trace clock, which is skipped
+	u32(4)
+	recording.WriteString("boot")
+	u16(0)
+	recording.WriteString(traceCmdFlyrecordMarker)
+
+	// The pages are aligned after the offsets of the CPUs
+	offset := uint64(recording.Len() + len(cpuPages)*16)
+	offset += mockTraceCmdPageSize - offset%mockTraceCmdPageSize
+	for _, pages := range cpuPages {
+		u64(offset)
+		u64(uint64(len(pages) * mockTraceCmdPageSize))
+		offset += uint64(len(pages) * mockTraceCmdPageSize)
+	}
+
+	for recording.Len()%mockTraceCmdPageSize != 0 {
+		recording.WriteByte(0)
+	}
+
+	for _, pages := range cpuPages {
+		for _, page := range pages {
+			recording.Write(page)
+		}
+	}
+
+	return recording.Bytes()
+}
+
+// NewMockTraceCmdRecord returns a record of the mockEventFormat, of the task
+// of the PID.
+func newMockTraceCmdRecord(pid uint32, oldState, newState int32) []byte {
+	record := newMockInetSockSetStateRecord(oldState, newState)
+	hostByteOrder.PutUint32(record[4:], pid)
+	return record
+}
+
+func TestTraceCmdReaderRead(t *testing.T) {
+	otherRecord := make([]byte, 8)
+	hostByteOrder.PutUint16(otherRecord, 316)
+
+	recording := newMockTraceCmdRecording(
+		[][]byte{
+			newMockTraceCmdPage(995318985000, 0,
+				mockTraceCmdEvent{delta: 321, record: newMockTraceCmdRecord(1234, 1, 1)},
+				mockTraceCmdEvent{delta: 10, record: otherRecord}),
+			newMockTraceCmdPage(995400000000, 3,
+				mockTraceCmdEvent{delta: 0, record: newMockTraceCmdRecord(0, 1, 1)}),
+		},
+		[][]byte{
+			newMockTraceCmdPage(995318985100, 0,
+				mockTraceCmdEvent{delta: 0, record: newMockTraceCmdRecord(4321, 1, 1)}),
+		},
+	)
+
+	reader, err := newTraceCmdReader(bytes.NewReader(recording), parserTracepointCandidates(), new(config))
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedEvents := []struct {
+		command string
+		pid     int
+		cpu     int
+		lost    int
+	}{
+		{"<...>", 4321, 1, 0},
+		{"curl", 1234, 0, 0},
+		{"", 0, 0, 3},
+		{"<idle>", 0, 0, 0},
+	}
+
+	for i, expected := range expectedEvents {
+		event, _, err := reader.next()
+		if expected.lost != 0 {
+			lostErr := new(LostEventsError)
+			if !errors.As(err, &lostErr) || lostErr.CPU != expected.cpu || lostErr.Lost != uint64(expected.lost) {
+				t.Errorf("expected event %d to be %d lost events on CPU %d, got %q (of type %T)",
+					i,
+					expected.lost,
+					expected.cpu,
+					err,
+					err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("expected nil error reading event %d, got %q (of type %T)", i, err, err)
+		}
+
+		if event.CommandOnCPU != expected.command ||
+			event.PIDOnCPU != expected.pid ||
+			event.Context.CPU != expected.cpu {
+			t.Errorf("expected event %d of %s-%d on CPU %d, got %+v",
+				i,
+				expected.command,
+				expected.pid,
+				expected.cpu,
+				event)
+		}
+
+		if event.SourcePort != 44406 {
+			t.Errorf("expected event %d from port 44406, got %d", i, event.SourcePort)
+		}
+	}
+
+	if _, _, err := reader.next(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %q (of type %T)", err, err)
+	}
+}
+
+func TestTraceCmdReaderUnsupportedVersionError(t *testing.T) {
+	recording := newMockTraceCmdRecording()
+	recording[len(traceCmdMagic)] = '7'
+
+	_, err := newTraceCmdReader(bytes.NewReader(recording), parserTracepointCandidates(), new(config))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestTraceCmdReaderTruncatedError(t *testing.T) {
+	recording := newMockTraceCmdRecording()
+
+	_, err := newTraceCmdReader(bytes.NewReader(recording[:100]), parserTracepointCandidates(), new(config))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestTraceCmdReaderInvalidLayoutError(t *testing.T) {
+	pages := [][]byte{newMockTraceCmdPage(995318985000, 0,
+		mockTraceCmdEvent{delta: 321, record: newMockTraceCmdRecord(1234, 1, 1)})}
+	pageSizeOffset := len(traceCmdMagic) + 4
+
+	// The offsets of the CPUs, and the number of them, are before the options
+	flyrecordOffset := func(recording []byte) int {
+		return bytes.Index(recording, []byte(traceCmdFlyrecordMarker)) + len(traceCmdFlyrecordMarker)
+	}
+	cpusOffset := func(recording []byte) int {
+		return bytes.Index(recording, []byte(traceCmdOptionsMarker)) - 4
+	}
+
+	tests := []struct {
+		name    string
+		corrupt func(recording []byte) []byte
+	}{
+		{"zero page size", func(recording []byte) []byte {
+			hostByteOrder.PutUint32(recording[pageSizeOffset:], 0)
+			return recording
+		}},
+		{"page size not a power of two", func(recording []byte) []byte {
+			hostByteOrder.PutUint32(recording[pageSizeOffset:], 4095)
+			return recording
+		}},
+		{"page size too large", func(recording []byte) []byte {
+			hostByteOrder.PutUint32(recording[pageSizeOffset:], 1<<30)
+			return recording
+		}},
+		{"too many CPUs", func(recording []byte) []byte {
+			hostByteOrder.PutUint32(recording[cpusOffset(recording):], 1<<31)
+			return recording
+		}},
+		{"more CPUs than recorded", func(recording []byte) []byte {
+			hostByteOrder.PutUint32(recording[cpusOffset(recording):], 3)
+			return recording
+		}},
+		{"data beyond recording", func(recording []byte) []byte {
+			hostByteOrder.PutUint64(recording[flyrecordOffset(recording)+8:], 1<<20)
+			return recording
+		}},
+		{"data overflowing", func(recording []byte) []byte {
+			hostByteOrder.PutUint64(recording[flyrecordOffset(recording):], 1<<63)
+			return recording
+		}},
+		{"data of partial page", func(recording []byte) []byte {
+			hostByteOrder.PutUint64(recording[flyrecordOffset(recording)+8:], mockTraceCmdPageSize-1)
+			return recording
+		}},
+		{"overlapping data", func(recording []byte) []byte {
+			offset := flyrecordOffset(recording)
+			copy(recording[offset+16:offset+24], recording[offset:offset+8])
+			return recording
+		}},
+	}
+
+	for _, test := range tests {
+		recording := test.corrupt(newMockTraceCmdRecording(pages, pages))
+		_, err := newTraceCmdReader(bytes.NewReader(recording), parserTracepointCandidates(), new(config))
+		if err == nil {
+			t.Errorf("%s: expected error, got nil", test.name)
+		}
+
+		t.Logf("%s: got error %q (of type %T)", test.name, err, err)
+	}
+}
+
+// TestTraceCmdReaderCorruptHeaders checks that no corruption of a byte of the
+// headers of a recording panics, or reads beyond it.
+func TestTraceCmdReaderCorruptHeaders(t *testing.T) {
+	recording := newMockTraceCmdRecording([][]byte{newMockTraceCmdPage(995318985000, 0,
+		mockTraceCmdEvent{delta: 321, record: newMockTraceCmdRecord(1234, 1, 1)})})
+	headers := bytes.Index(recording, []byte(traceCmdFlyrecordMarker)) + len(traceCmdFlyrecordMarker) + 16
+
+	for i := 0; i < headers; i++ {
+		for _, value := range []byte{0x00, 0x7f, 0xff} {
+			corrupt := append([]byte(nil), recording...)
+			corrupt[i] = value
+
+			reader, err := newTraceCmdReader(bytes.NewReader(corrupt), parserTracepointCandidates(), new(config))
+			if err != nil {
+				continue
+			}
+
+			for {
+				if _, _, err := reader.next(); err == io.EOF {
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestReplayEventerEventTraceCmdRecording(t *testing.T) {
+	recording := newMockTraceCmdRecording([][]byte{
+		newMockTraceCmdPage(995318985000, 0,
+			mockTraceCmdEvent{delta: 321, record: newMockTraceCmdRecord(1234, 1, 1)}),
+	})
+
+	// A reader which is not an io.ReaderAt is buffered
+	source := newReplaySource(io.MultiReader(bytes.NewReader(recording)), "", false)
+	eventer, err := newReplayEventer(source, new(config))
+	if err != nil {
+		t.Fatalf("expected nil constructor error, got %q (of type %T)", err, err)
+	}
+	defer eventer.Close()
+
+	event, err := eventer.Event()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.CommandOnCPU != "curl" || event.SourcePort != 44406 {
+		t.Errorf("expected event of curl from port 44406, got %+v", event)
+	}
+
+	if _, err := eventer.Event(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %q (of type %T)", err, err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+)
+
+// CPUColumnPrefixBytes precede the CPU column of a trace line, e.g. ` [003]`.
+var cpuColumnPrefixBytes = []byte(" [")
+
+// ContextEvent is a TCP state change event, with the context in which the
+// kernel emitted it.
+type ContextEvent struct {
+	*event.Event
+	// Kind is the kind of the event. Events which are not state changes are
+	// only returned by EventWithContext.
+	Kind EventKind
+	// Idle is whether the event was emitted in the context of the idle task
+	// (PID 0), for example in interrupt context on an idle CPU, so is not
+	// attributable to any process.
+	Idle bool
+	// Context is the context in which the event was emitted, or nil if it is
+	// not present in the trace.
+	Context *TraceContext
+	// Socket identifies the kernel socket of the event, or is nil if the
+	// tracepoint does not identify it.
+	Socket *SocketID
+	// MissingFields are the non-critical tagged fields absent from the event,
+	// which are left zero-valued, if parsed best-effort.
+	MissingFields []string
+	// IncompleteFields are the tagged fields of a damaged line which could not be
+	// recovered, and so are left zero-valued, if parsed partially.
+	IncompleteFields []string
+	// UnknownStates are the kernel names of the states of the event which have
+	// no mapping, and so are reported as the fallback state, or StateUnknown.
+	UnknownStates []string
+	// LostEvents is the number of events lost, if the event is of the
+	// KindLostEvents kind.
+	LostEvents uint64
+	// Inferred is whether the event was inferred from the segments captured by
+	// the packet backend, rather than traced, so may not be a state change the
+	// kernel made.
+	Inferred bool
+	// NetNS is the inode of the network namespace of the task on CPU, if
+	// network namespaces are tagged, or zero if it is not known.
+	NetNS uint64
+	// SourceHost and DestHost are the hostnames of the source and destination
+	// addresses, if reverse DNS lookups are enabled, or empty if they are not
+	// yet known, or the addresses have none.
+	SourceHost, DestHost string
+	// RemoteCountry is the ISO 3166-1 code of the country of the remote
+	// (destination) address, if GeoIP databases are configured, or empty if it
+	// is not known.
+	RemoteCountry string
+	// RemoteASN and RemoteASOrg are the number and organisation of the
+	// autonomous system of the remote (destination) address, if GeoIP
+	// databases are configured, or zero and empty if it is not known.
+	RemoteASN   uint32
+	RemoteASOrg string
+	// Direction is the direction of the connection of the event relative to
+	// the host, and Role the role of its local socket, if classified, or
+	// unknown.
+	Direction Direction
+	Role      Role
+	// Flow is the flow of the socket of the event as of the event, if flows
+	// are tracked, or nil if it is of no flow.
+	Flow *Flow
+	// MPTCP is whether the event is of the MPTCP socket of a multipath
+	// connection, rather than of a TCP socket, such as one of its subflows.
+	MPTCP bool
+	// MPTCPToken is the local token of the MPTCP connection of the event, which
+	// the MPTCP socket and all subflows of the connection share, if MPTCP is
+	// enabled, or zero if it is not of an MPTCP connection, or not known.
+	MPTCPToken uint32
+	// Collapsed is the number of later state changes of the flow of the event
+	// which repeated or reversed its transition within the debounce window,
+	// and so were collapsed into it, if debounced. Its new state is then that
+	// of the last.
+	Collapsed int
+	// Summary is the summary of the event, if it is of the KindSummary kind.
+	Summary *Summary
+	// HostTags are the tags of the host, if configured, or nil if not. They
+	// are shared by all events, so must not be modified.
+	HostTags map[string]string
+
+	pooled *pooledContextEvent // The allocation of the event, if from the pool
+}
+
+// TraceContext is the context in which the kernel emitted an event, as shown
+// by the CPU and latency flags columns of the trace.
+type TraceContext struct {
+	// CPU is the CPU on which the event was emitted.
+	CPU int
+	// TGID is the thread group (process) ID of the task on CPU, or zero if it
+	// is unknown, or the print-tgid trace option is disabled.
+	TGID int
+	// Flags is whether the remaining fields are known. They are not if the
+	// irq-info trace option is disabled.
+	Flags bool
+	// IRQsOff is whether interrupts were disabled.
+	IRQsOff bool
+	// NeedResched is whether a reschedule was pending.
+	NeedResched bool
+	// HardIRQ is whether the event was emitted in hard interrupt context.
+	HardIRQ bool
+	// SoftIRQ is whether the event was emitted in soft interrupt context.
+	SoftIRQ bool
+	// NMI is whether the event was emitted in non-maskable interrupt context.
+	NMI bool
+	// PreemptDepth is the preemption disabled depth.
+	PreemptDepth int
+}
+
+// ParseTraceContext parses the CPU and latency flags columns of a trace line,
+// e.g. `[003] d.s1`, which immediately precede the timestamp column, as the
+// command column before them may itself contain spaces. If the columns are not
+// present, nil is returned.
+func parseTraceContext(line []byte) *TraceContext {
+	context := new(TraceContext)
+	if !fillTraceContext(line, context) {
+		return nil
+	}
+
+	return context
+}
+
+// FillTraceContext parses the context of a trace line into the context, as
+// parseTraceContext, returning whether the columns are present.
+func fillTraceContext(line []byte, context *TraceContext) bool {
+	idx := timestampColumnEnd(line)
+	if idx == -1 {
+		return false
+	}
+
+	// The columns are taken from the end, so that none are allocated
+	_, columns := lastColumn(line[:idx]) // Drop the timestamp
+	column, columns := lastColumn(columns)
+	if len(column) == 0 {
+		return false
+	}
+
+	var flags []byte
+	if column[0] != '[' {
+		flags = column
+		column, _ = lastColumn(columns)
+	}
+
+	cpuColumn := column
+	if !bytes.HasPrefix(cpuColumn, []byte{'['}) || !bytes.HasSuffix(cpuColumn, []byte{']'}) {
+		return false
+	}
+
+	cpu, err := strconv.Atoi(string(cpuColumn[1 : len(cpuColumn)-1]))
+	if err != nil {
+		return false
+	}
+
+	*context = TraceContext{CPU: cpu}
+	if start, tgid := findTGIDColumn(line, idx); start != -1 {
+		context.TGID, _ = strconv.Atoi(string(tgid)) // Dashes if unknown
+	}
+
+	if len(flags) < 4 {
+		return true
+	}
+	context.Flags = true
+
+	context.IRQsOff = flags[0] == 'd'
+	context.NeedResched = flags[1] != '.'
+
+	switch flags[2] {
+	case 'Z': // NMI within a hard interrupt
+		context.NMI = true
+		context.HardIRQ = true
+	case 'z':
+		context.NMI = true
+	case 'H': // Hard interrupt within a soft interrupt
+		context.HardIRQ = true
+		context.SoftIRQ = true
+	case 'h':
+		context.HardIRQ = true
+	case 's':
+		context.SoftIRQ = true
+	}
+
+	// The depth is a single hex digit, or '.' if zero
+	switch depth := flags[3]; {
+	case depth >= '0' && depth <= '9':
+		context.PreemptDepth = int(depth - '0')
+	case depth >= 'a' && depth <= 'f':
+		context.PreemptDepth = int(depth-'a') + 10
+	}
+
+	return true
+}
+
+// LastColumn returns the last space-separated column of columns, which is
+// empty if there are none, and the columns preceding it.
+func lastColumn(columns []byte) (column, rest []byte) {
+	columns = bytes.TrimRight(columns, " ")
+	idx := bytes.LastIndexByte(columns, ' ')
+	return columns[idx+1:], columns[:idx+1]
+}
+
+// FindTGIDColumn finds the TGID column, present if the print-tgid trace option
+// is set, within the columns of a trace line which end at the index end. It
+// precedes the CPU column, and is of the form `(   4242)`, or `(-------)` if
+// the TGID is unknown. The index of the start of the column and its contents
+// are returned, or -1 if the column is not present.
+func findTGIDColumn(line []byte, end int) (int, []byte) {
+	cpuIdx := bytes.LastIndex(line[:end], cpuColumnPrefixBytes)
+	if cpuIdx == -1 {
+		return -1, nil
+	}
+
+	columns := bytes.TrimRight(line[:cpuIdx], " ")
+	if !bytes.HasSuffix(columns, []byte{')'}) {
+		return -1, nil
+	}
+
+	start := bytes.LastIndexByte(columns, '(')
+	if start == -1 {
+		return -1, nil
+	}
+
+	return start, bytes.TrimSpace(columns[start+1 : len(columns)-1])
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestParseTraceContext(t *testing.T) {
+	for line, expectedContext := range map[string]TraceContext{
+		"<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET": {
+			CPU:     0,
+			Flags:   true,
+			SoftIRQ: true,
+		},
+		"kworker/3:1 H-123   [003] dNh2   995.318985: inet_sock_set_state: family=AF_INET": {
+			CPU:          3,
+			Flags:        true,
+			IRQsOff:      true,
+			NeedResched:  true,
+			HardIRQ:      true,
+			PreemptDepth: 2,
+		},
+		"curl-4242  (   4200) [012] ..Z.1   995.318985: inet_sock_set_state: family=AF_INET": {
+			CPU:     12,
+			TGID:    4200,
+			Flags:   true,
+			NMI:     true,
+			HardIRQ: true,
+		},
+		"curl-4242     [001]   995.318985: inet_sock_set_state: family=AF_INET": {
+			CPU: 1,
+		},
+		"kworker/0:1-12  (-------) [000] ....   995.318985: inet_sock_set_state: family=AF_INET": {
+			CPU:   0,
+			Flags: true,
+		},
+	} {
+		context := parseTraceContext([]byte(line))
+		if context == nil {
+			t.Errorf("expected context for %q, got nil", line)
+			continue
+		}
+
+		if *context != expectedContext {
+			t.Errorf("expected context %+v for %q, got %+v", expectedContext, line, *context)
+		}
+	}
+}
+
+func TestParseTraceContextNotPresent(t *testing.T) {
+	for _, line := range []string{
+		"CPU:3 [LOST 42 EVENTS]",
+		"curl-4242 995.318985: inet_sock_set_state: family=AF_INET",
+		"curl-4242 [foo] ..s. 995.318985: inet_sock_set_state: family=AF_INET",
+	} {
+		if context := parseTraceContext([]byte(line)); context != nil {
+			t.Errorf("expected nil context for %q, got %+v", line, *context)
+		}
+	}
+}
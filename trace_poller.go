@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// TracePoller is a reader of the events in a tracefs trace file. Unlike
+// trace_pipe, the trace file is not consumed when read, and so can be shared
+// with other tools. The file is instead polled periodically, and only lines
+// with timestamps newer than those already returned are read.
+type tracePoller struct {
+	path     string
+	interval time.Duration
+	open     func(path string) (*os.File, error)
+
+	pending       *bytes.Buffer
+	lastTimestamp traceTimestamp
+	seenAtLast    map[string]struct{} // The lines read with the last timestamp
+	done          chan struct{}
+	closeOnce     *sync.Once
+}
+
+func newTracePoller(path string, interval time.Duration) *tracePoller {
+	return &tracePoller{
+		path:       path,
+		interval:   interval,
+		open:       os.Open,
+		pending:    new(bytes.Buffer),
+		seenAtLast: make(map[string]struct{}),
+		done:       make(chan struct{}),
+		closeOnce:  new(sync.Once),
+	}
+}
+
+// Read reads the lines of the trace file not previously read, blocking until
+// there is at least one, or the poller is closed.
+func (tp *tracePoller) Read(p []byte) (int, error) {
+	for tp.pending.Len() == 0 {
+		select {
+		case <-tp.done:
+			return 0, os.ErrClosed
+		default:
+		}
+
+		if err := tp.poll(); err != nil {
+			return 0, fmt.Errorf("polling %s: %w", tp.path, err)
+		}
+
+		if tp.pending.Len() > 0 {
+			break
+		}
+
+		select {
+		case <-tp.done:
+			return 0, os.ErrClosed
+		case <-time.After(tp.interval):
+		}
+	}
+
+	return tp.pending.Read(p)
+}
+
+// Close stops the poller. Any blocked Read returns os.ErrClosed.
+func (tp *tracePoller) Close() error {
+	tp.closeOnce.Do(func() { close(tp.done) })
+	return nil
+}
+
+func (tp *tracePoller) poll() error {
+	file, err := tp.open(tp.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return tp.readNew(file)
+}
+
+// ReadNew appends to the pending buffer the lines from reader which are newer
+// than those previously read. Comment lines (such as the trace file header)
+// are skipped.
+func (tp *tracePoller) readNew(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		timestamp, err := lineTraceTimestamp(line)
+		if err != nil {
+			// Lines without timestamps cannot be deduplicated, so are skipped
+			continue
+		}
+
+		switch {
+		case timestamp.before(tp.lastTimestamp):
+			continue
+		case timestamp == tp.lastTimestamp:
+			if _, seen := tp.seenAtLast[string(line)]; seen {
+				continue
+			}
+		default:
+			tp.lastTimestamp = timestamp
+			tp.seenAtLast = make(map[string]struct{})
+		}
+
+		tp.seenAtLast[string(line)] = struct{}{}
+		tp.pending.Write(line)
+		tp.pending.WriteByte('\n')
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracePollerReadNewDeduplicates(t *testing.T) {
+	poller := newTracePoller("", time.Millisecond)
+
+	firstPoll := "# tracer: nop\n" +
+		"#\n" +
+		"<idle>-0 [000] ..s. 995.318985: inet_sock_set_state: sport=1\n" +
+		"<idle>-0 [001] ..s. 995.318990: inet_sock_set_state: sport=2\n"
+	if err := poller.readNew(strings.NewReader(firstPoll)); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	// The second poll overlaps the first, and contains a new line with the
+	// same timestamp as the last line previously read
+	secondPoll := "# tracer: nop\n" +
+		"<idle>-0 [001] ..s. 995.318990: inet_sock_set_state: sport=2\n" +
+		"<idle>-0 [002] ..s. 995.318990: inet_sock_set_state: sport=3\n" +
+		"<idle>-0 [000] ..s. 995.319000: inet_sock_set_state: sport=4\n"
+	if err := poller.readNew(strings.NewReader(secondPoll)); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(poller.pending.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %d: %q", len(lines), lines)
+	}
+
+	for i, line := range lines {
+		expectedSuffix := "sport=" + string(rune('1'+i))
+		if !strings.HasSuffix(line, expectedSuffix) {
+			t.Errorf("expected line %d to end with %q, but was %q", i, expectedSuffix, line)
+		}
+	}
+}
+
+func TestTracePollerRead(t *testing.T) {
+	mockTraceFile, err := ioutil.TempFile("", "tracefs-eventer-test-")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock trace file: %v", err)
+	}
+	defer os.Remove(mockTraceFile.Name())
+
+	mockLine := "<idle>-0 [000] ..s. 995.318985: inet_sock_set_state: sport=1\n"
+	if _, err := mockTraceFile.WriteString("# tracer: nop\n" + mockLine); err != nil {
+		t.Fatalf("test bootstrapping: unable to write mock trace file: %v", err)
+	}
+	mockTraceFile.Close()
+
+	poller := newTracePoller(mockTraceFile.Name(), time.Millisecond)
+	buf := make([]byte, 1024)
+	n, err := poller.Read(buf)
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if string(buf[:n]) != mockLine {
+		t.Errorf("expected %q, got %q", mockLine, buf[:n])
+	}
+}
+
+func TestTracePollerReadAfterCloseError(t *testing.T) {
+	mockTraceFile, err := ioutil.TempFile("", "tracefs-eventer-test-")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock trace file: %v", err)
+	}
+	defer os.Remove(mockTraceFile.Name())
+	mockTraceFile.Close()
+
+	poller := newTracePoller(mockTraceFile.Name(), time.Millisecond)
+
+	errChan := make(chan error)
+	go func(errChan chan<- error) {
+		_, err := poller.Read(make([]byte, 1024)) // Will block as there are no lines
+		errChan <- err
+	}(errChan)
+
+	if err := poller.Close(); err != nil {
+		t.Errorf("expected nil close error, got %q (of type %T)", err, err)
+	}
+
+	err = <-errChan
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, os.ErrClosed) {
+		t.Errorf("expected error chain to include %q, but did not", os.ErrClosed)
+	}
+}
+
+func TestTracePollerReadMissingFileError(t *testing.T) {
+	poller := newTracePoller(os.TempDir()+"/does-not-exist", time.Millisecond)
+
+	_, err := poller.Read(make([]byte, 1024))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const nanosecondDigits = 9
+
+// TraceTimestamp is a timestamp from the timestamp column of a trace line,
+// such as `995.318985`. The fractional part is held as nanoseconds so that
+// timestamps of up to nanosecond resolution compare exactly.
+type traceTimestamp struct {
+	sec  uint64
+	nsec uint64
+}
+
+func (ts traceTimestamp) before(other traceTimestamp) bool {
+	return ts.sec < other.sec || (ts.sec == other.sec && ts.nsec < other.nsec)
+}
+
+// ParseTraceTimestamp parses a timestamp of the form `<seconds>.<fraction>`,
+// where the fraction has at most nanosecond resolution.
+func parseTraceTimestamp(str []byte) (traceTimestamp, error) {
+	idx := bytes.IndexByte(str, '.')
+	if idx == -1 {
+		return traceTimestamp{}, errors.New("no fractional part in timestamp")
+	}
+
+	sec, err := strconv.ParseUint(string(str[:idx]), 10, 64)
+	if err != nil {
+		return traceTimestamp{}, fmt.Errorf("parsing timestamp seconds: %w", err)
+	}
+
+	fraction := str[idx+1:]
+	if len(fraction) == 0 || len(fraction) > nanosecondDigits {
+		return traceTimestamp{}, fmt.Errorf("invalid timestamp fraction length %d", len(fraction))
+	}
+
+	nsec, err := strconv.ParseUint(string(fraction), 10, 64)
+	if err != nil {
+		return traceTimestamp{}, fmt.Errorf("parsing timestamp fraction: %w", err)
+	}
+
+	// Scale the fraction up to nanoseconds
+	for i := len(fraction); i < nanosecondDigits; i++ {
+		nsec *= 10
+	}
+
+	return traceTimestamp{sec, nsec}, nil
+}
+
+// LineTraceTimestamp extracts and parses the timestamp from a trace line,
+// this being the last column before the tracepoint name.
+func lineTraceTimestamp(line []byte) (traceTimestamp, error) {
+	idx := timestampColumnEnd(line)
+	if idx == -1 {
+		return traceTimestamp{}, errors.New("no timestamp column in line")
+	}
+
+	columns := line[:idx]
+	return parseTraceTimestamp(columns[bytes.LastIndexByte(columns, ' ')+1:])
+}
+
+// TimestampColumnEnd returns the index of the `: ` which ends the timestamp
+// column of a trace line, and so precedes the tracepoint name, or -1 if there
+// is none. As the number of columns before the timestamp varies with the trace
+// options, and the command column may itself contain `: `, this is the first
+// `: ` which is immediately preceded by a timestamp.
+func timestampColumnEnd(line []byte) int {
+	offset := 0
+	for {
+		idx := bytes.Index(line[offset:], colonSpaceBytes)
+		if idx == -1 {
+			return -1
+		}
+		idx += offset
+
+		columns := line[:idx]
+		if isTraceTimestamp(columns[bytes.LastIndexByte(columns, ' ')+1:]) {
+			return idx
+		}
+		offset = idx + len(colonSpaceBytes)
+	}
+}
+
+// IsTraceTimestamp returns whether the column is of the form of a timestamp,
+// `<seconds>.<fraction>`, without allocating, as it is checked for every line.
+func isTraceTimestamp(column []byte) bool {
+	idx := bytes.IndexByte(column, '.')
+	if idx <= 0 || idx == len(column)-1 || len(column)-idx-1 > nanosecondDigits {
+		return false
+	}
+
+	for i, b := range column {
+		if i != idx && (b < '0' || b > '9') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestParseTraceTimestamp(t *testing.T) {
+	for mockTimestamp, expected := range map[string]traceTimestamp{
+		"995.318985":    {995, 318985000},
+		"995.318985123": {995, 318985123},
+		"0.1":           {0, 100000000},
+	} {
+		timestamp, err := parseTraceTimestamp([]byte(mockTimestamp))
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %q (of type %T)", mockTimestamp, err, err)
+		}
+
+		if timestamp != expected {
+			t.Errorf("expected timestamp %+v for %q, got %+v", expected, mockTimestamp, timestamp)
+		}
+	}
+}
+
+func TestParseTraceTimestampError(t *testing.T) {
+	for _, mockTimestamp := range []string{"995", "995.", "foo.318985", "995.foo", "995.3189851234"} {
+		_, err := parseTraceTimestamp([]byte(mockTimestamp))
+		if err == nil {
+			t.Errorf("expected error for %q, got nil", mockTimestamp)
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestTraceTimestampBefore(t *testing.T) {
+	earlier := traceTimestamp{995, 318985000}
+	later := traceTimestamp{995, 318986000}
+
+	if !earlier.before(later) {
+		t.Errorf("expected %+v to be before %+v, but was not", earlier, later)
+	}
+
+	if later.before(earlier) || earlier.before(earlier) {
+		t.Errorf("expected %+v not to be before %+v, but was", later, earlier)
+	}
+}
+
+func TestLineTraceTimestamp(t *testing.T) {
+	mockLine := []byte("<idle>-0       [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET")
+
+	timestamp, err := lineTraceTimestamp(mockLine)
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expected := traceTimestamp{995, 318985000}
+	if timestamp != expected {
+		t.Errorf("expected timestamp %+v, got %+v", expected, timestamp)
+	}
+}
+
+func TestIsTraceTimestamp(t *testing.T) {
+	for mockColumn, expected := range map[string]bool{
+		"995.318985":     true,
+		"0.1":            true,
+		"995":            false,
+		"995.":           false,
+		".318985":        false,
+		"995.foo":        false,
+		"995.3189851234": false,
+		"kworker/u8:1":   false,
+	} {
+		if isTraceTimestamp([]byte(mockColumn)) != expected {
+			t.Errorf("expected timestamp check of %q to be %t, but was not", mockColumn, expected)
+		}
+	}
+}
+
+func TestLineTraceTimestampVaryingColumns(t *testing.T) {
+	for _, mockLine := range []string{
+		// The irq-info trace option is disabled
+		"<idle>-0       [000]   995.318985: inet_sock_set_state: family=AF_INET",
+		// The print-tgid trace option is enabled
+		"<idle>-0     (-------) [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET",
+		// The command contains `: `
+		"foo: bar-1234  [000] ..s.   995.318985: inet_sock_set_state: family=AF_INET",
+	} {
+		timestamp, err := lineTraceTimestamp([]byte(mockLine))
+		if err != nil {
+			t.Errorf("expected nil error for %q, got %q (of type %T)", mockLine, err, err)
+		}
+
+		expected := traceTimestamp{995, 318985000}
+		if timestamp != expected {
+			t.Errorf("expected timestamp %+v for %q, got %+v", expected, mockLine, timestamp)
+		}
+	}
+}
@@ -1,56 +1,231 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"runtime"
+	"strings"
 )
 
 // TracepointDeducer is an interface which describes objects which deduce
-// which tracepoint to use, based upon what is available in the running kernel.
+// which tracepoint to use, based upon what is available in the running kernel,
+// provisioning a dynamic event in its place if necessary.
 type tracepointDeducer interface {
 	deduceTracepoint() (string, error)
+	releaseTracepoint() error
 }
 
-// TraceFSTracepointDeducer deduces what tracepoint to use, based upon what is
-// available in the tracefs virtual filesystem.
+// TracepointCandidate is a tracepoint which may provide TCP state change events,
+// along with the profile of its events, for the parser.
+type tracepointCandidate struct {
+	tracepoint string // In the form `system/event`
+	profile    *eventProfile
+
+	// Provision creates the tracepoint if it is a dynamic event, returning
+	// whether it was created, and so is owned. It is nil for static tracepoints.
+	provision func(traceFSMountpoint string) (bool, error)
+
+	// Release removes a dynamic event which was created by provision.
+	release func(traceFSMountpoint string) error
+}
+
+// DefaultTracepointCandidates are the tracepoints used, in order of preference.
+var defaultTracepointCandidates = []*tracepointCandidate{
+	{
+		tracepoint: "sock/inet_sock_set_state",
+		profile:    &eventProfile{layout: inetSockSetStateLayout},
+	},
+	{
+		// Older kernel version has same event but with less fields in /events/tcp/tcp_set_state
+		// The missing fields are not a problem, as we dont care about those anyway!
+		tracepoint: "tcp/tcp_set_state",
+		profile:    new(eventProfile),
+	},
+	{
+		// Older still kernel versions have neither, so probe the function
+		tracepoint: kprobeTracepoint,
+		profile: &eventProfile{
+			location:      true,
+			normaliseTags: normaliseKprobeTags,
+		},
+		provision: provisionKprobe,
+		release:   releaseKprobe,
+	},
+}
+
+// TraceFSTracepointDeducer deduces what tracepoint to use, based upon which of
+// the candidate tracepoints is first available in the tracefs virtual
+// filesystem, provisioning dynamic events if required.
 type traceFSTracepointDeducer struct {
 	mountpointRetriever mountpointRetriever
+	candidates          []*tracepointCandidate
+
+	provisioned           *tracepointCandidate // The dynamic event created, if any
+	provisionedMountpoint string
 }
 
-func newTraceFSTracepointDeducer(mountpointRetriever mountpointRetriever) *traceFSTracepointDeducer {
-	return &traceFSTracepointDeducer{mountpointRetriever}
+func newTraceFSTracepointDeducer(mountpointRetriever mountpointRetriever,
+	candidates []*tracepointCandidate) *traceFSTracepointDeducer {
+	return &traceFSTracepointDeducer{
+		mountpointRetriever: mountpointRetriever,
+		candidates:          candidates,
+	}
 }
 
-// DeduceTracepoint returns the tracepoint to use based upon what is
-// available in the running kernel. An error is returned if the kernel
-// exposes no relevant tracepoints.
+// DeduceTracepoint returns the first candidate tracepoint available in the
+// running kernel. A dynamic event candidate is provisioned if it is reached.
+// An error is returned if the kernel exposes no relevant tracepoints.
 func (td *traceFSTracepointDeducer) deduceTracepoint() (string, error) {
 	traceFSMountpoint, err := td.mountpointRetriever.retrieveMountpoint()
 	if err != nil {
 		return "", fmt.Errorf("obtaining tracefs mountpoint: %w", err)
 	}
 
-	// Check the tracepoint is available in the running kernel
-	_, err = os.Stat(traceFSMountpoint + "/events/sock/inet_sock_set_state")
-	if err != nil && !os.IsNotExist(err) {
-		return "", fmt.Errorf("checking if inet_sock_set_state event present: %w", err)
+	availableEvents, err := readAvailableEvents(traceFSMountpoint)
+	if err != nil {
+		return "", fmt.Errorf("reading available events: %w", err)
 	}
 
-	if err != nil && os.IsNotExist(err) {
-		// Older kernel version has same event but with less fields in /events/tcp/tcp_set_state
-		// The missing fields are not a problem, as we dont care about those anyway!
-		_, err := os.Stat(traceFSMountpoint + "/events/tcp/tcp_set_state")
-		if err != nil && !os.IsNotExist(err) {
-			return "", fmt.Errorf("checking if tcp_set_state event present: %w", err)
+	var provisionErr error
+	for _, candidate := range td.candidates {
+		if candidate.provision != nil {
+			owned, err := candidate.provision(traceFSMountpoint)
+			if err != nil {
+				provisionErr = fmt.Errorf("provisioning %s event: %w", candidate.tracepoint, err)
+				continue
+			}
+
+			if owned {
+				td.provisioned = candidate
+				td.provisionedMountpoint = traceFSMountpoint
+			}
+
+			return candidate.tracepoint, nil
 		}
 
-		if err != nil && os.IsNotExist(err) {
-			return "", errors.New("required tracepoint not available")
+		// Check the tracepoint is available in the running kernel
+		if availableEvents != nil {
+			if _, ok := availableEvents[candidate.tracepoint]; ok {
+				return candidate.tracepoint, nil
+			}
+
+			continue
+		}
+
+		_, err := os.Stat(traceFSMountpoint + "/events/" + candidate.tracepoint)
+		if err == nil {
+			return candidate.tracepoint, nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("checking if %s event present: %w", candidate.tracepoint, err)
+		}
+	}
+
+	if provisionErr != nil {
+		return "", fmt.Errorf("required tracepoint not available: %w", provisionErr)
+	}
+
+	return "", errors.New("required tracepoint not available")
+}
+
+// ReleaseTracepoint removes the dynamic event, if one was provisioned. It must
+// not be enabled in any instance, otherwise the kernel refuses to remove it.
+func (td *traceFSTracepointDeducer) releaseTracepoint() error {
+	if td.provisioned == nil {
+		return nil
+	}
+
+	if err := td.provisioned.release(td.provisionedMountpoint); err != nil {
+		return fmt.Errorf("releasing %s event: %w", td.provisioned.tracepoint, err)
+	}
+	td.provisioned = nil
+
+	return nil
+}
+
+// ReadAvailableEvents returns the set of events listed in the tracefs
+// available_events file, in the form `system/event`. This is more reliable than
+// the presence of the event directories, which may exist for events which are
+// compiled out or otherwise unavailable. If the file does not exist, nil is
+// returned, and the presence of the event directories must be relied upon.
+func readAvailableEvents(traceFSMountpoint string) (map[string]struct{}, error) {
+	file, err := os.Open(traceFSMountpoint + "/available_events")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := make(map[string]struct{}, 2048)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Each line is in the form `system:event`
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
 		}
+		events[strings.Replace(line, ":", "/", 1)] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanning available events: %w", err)
+	}
+
+	return events, nil
+}
+
+// ProvisionKprobe creates the kprobe event on the tcp_set_state() function. If
+// it already exists, for example as created by another eventer, it is used, but
+// not owned, and so is not removed upon release.
+func provisionKprobe(traceFSMountpoint string) (bool, error) {
+	if _, err := os.Stat(traceFSMountpoint + "/events/" + kprobeTracepoint); err == nil {
+		return false, nil
+	}
+
+	definition, err := kprobeDefinition(runtime.GOARCH)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Provisioning kprobe event: %s", kprobeTracepoint)
+	if err := writeKprobeEvents(traceFSMountpoint, definition); err != nil {
+		return false, fmt.Errorf("creating kprobe event: %w", err)
+	}
+
+	return true, nil
+}
+
+// ReleaseKprobe removes the kprobe event.
+func releaseKprobe(traceFSMountpoint string) error {
+	log.Printf("Removing kprobe event: %s", kprobeTracepoint)
+	if err := writeKprobeEvents(traceFSMountpoint, "-:"+kprobeTracepoint+"\n"); err != nil {
+		return fmt.Errorf("removing kprobe event: %w", err)
+	}
+
+	return nil
+}
+
+// WriteKprobeEvents appends the command to the kprobe_events file. Truncating
+// the file would remove all other kprobe events on the system.
+func writeKprobeEvents(traceFSMountpoint, command string) error {
+	file, err := openBeneath(traceFSMountpoint,
+		traceFSMountpoint+"/kprobe_events",
+		os.O_WRONLY|os.O_APPEND,
+		0)
+	if err != nil {
+		return err
+	}
 
-		return "tcp/tcp_set_state", nil
+	if _, err := file.WriteString(command); err != nil {
+		file.Close()
+		return err
 	}
 
-	return "sock/inet_sock_set_state", nil
+	return file.Close()
 }
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
 	"testing"
 )
 
@@ -13,7 +14,11 @@ type mockMountpointRetriever struct {
 	mountpoint  string
 	errToReturn error
 
+	// If non-zero, the error is only returned for this many calls
+	noOfTimesToReturnError int
+
 	retrieveMountpointCalled bool
+	errorsReturnedCount      int
 }
 
 func newMockMountpointRetriever(mountpoint string, errToReturn error) *mockMountpointRetriever {
@@ -26,7 +31,9 @@ func newMockMountpointRetriever(mountpoint string, errToReturn error) *mockMount
 func (mmr *mockMountpointRetriever) retrieveMountpoint() (string, error) {
 	mmr.retrieveMountpointCalled = true
 
-	if mmr.errToReturn != nil {
+	if mmr.errToReturn != nil &&
+		(mmr.noOfTimesToReturnError == 0 || mmr.errorsReturnedCount < mmr.noOfTimesToReturnError) {
+		mmr.errorsReturnedCount++
 		return "", mmr.errToReturn
 	}
 
@@ -44,7 +51,7 @@ func TestDeduceTracepointNewKernel(t *testing.T) {
 
 	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
 
-	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever)
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
 
 	tracepoint, err := tracepointDeducer.deduceTracepoint()
 	if err != nil {
@@ -73,7 +80,7 @@ func TestDeduceTracepointOldKernel(t *testing.T) {
 
 	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
 
-	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever)
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
 
 	tracepoint, err := tracepointDeducer.deduceTracepoint()
 	if err != nil {
@@ -99,10 +106,10 @@ func TestDeduceTracepointNoTracepointsAvailableInKernelError(t *testing.T) {
 	if err != nil {
 		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
 	}
-	
+
 	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
 
-	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever)
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
 
 	_, err = tracepointDeducer.deduceTracepoint()
 	if err == nil {
@@ -123,7 +130,7 @@ func TestDeduceTracepointNewKernelReadError(t *testing.T) {
 
 	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
 
-	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever)
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
 
 	tracepoint, err := tracepointDeducer.deduceTracepoint()
 	t.Logf(tracepoint)
@@ -145,7 +152,7 @@ func TestDeduceTracepointOldKernelReadError(t *testing.T) {
 
 	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
 
-	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever)
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
 
 	tracepoint, err := tracepointDeducer.deduceTracepoint()
 	t.Logf(tracepoint)
@@ -160,7 +167,7 @@ func TestDeduceTracepointMountpointRetrieverError(t *testing.T) {
 	mockError := errors.New("mock mountpoint retriever error")
 	mockMountpointRetriever := newMockMountpointRetriever("", mockError)
 
-	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever)
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
 
 	_, err := tracepointDeducer.deduceTracepoint()
 	if err == nil {
@@ -174,6 +181,216 @@ func TestDeduceTracepointMountpointRetrieverError(t *testing.T) {
 	}
 }
 
+func TestDeduceTracepointProvisionsKprobe(t *testing.T) {
+	if _, ok := kprobeArgRegisters[runtime.GOARCH]; !ok {
+		t.Skipf("kprobe not supported on architecture %s", runtime.GOARCH)
+	}
+
+	// Create a fake tracefs-like directory structure to test against,
+	// but with no tracepoint inside
+	mockMountpoint, undoFunc, err := bootstrapMockTraceFS("", false)
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	if err := ioutil.WriteFile(mockMountpoint+"/kprobe_events", []byte{}, 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock kprobe_events: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
+
+	tracepoint, err := tracepointDeducer.deduceTracepoint()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if tracepoint != kprobeTracepoint {
+		t.Errorf("expected tracepoint %q, got %q", kprobeTracepoint, tracepoint)
+	}
+
+	if err := tracepointDeducer.releaseTracepoint(); err != nil {
+		t.Errorf("expected nil release error, got %q (of type %T)", err, err)
+	}
+
+	contents, err := ioutil.ReadFile(mockMountpoint + "/kprobe_events")
+	if err != nil {
+		t.Fatalf("running test: unable to read kprobe_events: %v", err)
+	}
+
+	definition, _ := kprobeDefinition(runtime.GOARCH)
+	expectedContents := definition + "-:" + kprobeTracepoint + "\n"
+	if string(contents) != expectedContents {
+		t.Errorf("expected kprobe_events to contain %q, but contained %q", expectedContents, contents)
+	}
+}
+
+func TestDeduceTracepointUsesExistingKprobe(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against, with the
+	// kprobe event already present, but no kprobe_events file to write to
+	mockMountpoint, undoFunc, err := bootstrapMockTraceFS(kprobeTracepoint, false)
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
+
+	tracepoint, err := tracepointDeducer.deduceTracepoint()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if tracepoint != kprobeTracepoint {
+		t.Errorf("expected tracepoint %q, got %q", kprobeTracepoint, tracepoint)
+	}
+
+	// The kprobe is not owned, so is not removed
+	if err := tracepointDeducer.releaseTracepoint(); err != nil {
+		t.Errorf("expected nil release error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestDeduceTracepointCandidateOrder(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against, with
+	// both candidate tracepoints present
+	mockMountpoint, undoFunc, err := bootstrapMockTraceFS("mock/second", false)
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	if err := os.MkdirAll(mockMountpoint+"/events/mock/first", 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracepoint: %v", err)
+	}
+
+	mockCandidates := []*tracepointCandidate{
+		{tracepoint: "mock/absent", profile: new(eventProfile)},
+		{tracepoint: "mock/first", profile: new(eventProfile)},
+		{tracepoint: "mock/second", profile: new(eventProfile)},
+	}
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, mockCandidates)
+
+	tracepoint, err := tracepointDeducer.deduceTracepoint()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if tracepoint != "mock/first" {
+		t.Errorf("expected tracepoint %q, got %q", "mock/first", tracepoint)
+	}
+}
+
+func TestDeduceTracepointProvisionsAndReleasesDynamicCandidate(t *testing.T) {
+	mockMountpoint, undoFunc, err := bootstrapMockTraceFS("", false)
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockError := errors.New("mock provision error")
+	var releasedMountpoint string
+	mockCandidates := []*tracepointCandidate{
+		{
+			tracepoint: "mock/failing",
+			profile:    new(eventProfile),
+			provision: func(string) (bool, error) {
+				return false, mockError
+			},
+		},
+		{
+			tracepoint: "mock/dynamic",
+			profile:    new(eventProfile),
+			provision: func(string) (bool, error) {
+				return true, nil
+			},
+			release: func(traceFSMountpoint string) error {
+				releasedMountpoint = traceFSMountpoint
+				return nil
+			},
+		},
+	}
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, mockCandidates)
+
+	tracepoint, err := tracepointDeducer.deduceTracepoint()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if tracepoint != "mock/dynamic" {
+		t.Errorf("expected tracepoint %q, got %q", "mock/dynamic", tracepoint)
+	}
+
+	if err := tracepointDeducer.releaseTracepoint(); err != nil {
+		t.Errorf("expected nil release error, got %q (of type %T)", err, err)
+	}
+
+	if releasedMountpoint != mockMountpoint {
+		t.Errorf("expected dynamic event to be released from %q, but was from %q",
+			mockMountpoint,
+			releasedMountpoint)
+	}
+}
+
+func TestDeduceTracepointFromAvailableEvents(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against, in which
+	// the directory of the newer tracepoint exists, but the event is unavailable
+	mockMountpoint, undoFunc, err := bootstrapMockTraceFS("sock/inet_sock_set_state", false)
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockAvailableEvents := "sched:sched_switch\ntcp:tcp_set_state\ntcp:tcp_retransmit_skb\n"
+	if err := ioutil.WriteFile(mockMountpoint+"/available_events", []byte(mockAvailableEvents), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock available_events: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
+
+	tracepoint, err := tracepointDeducer.deduceTracepoint()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if tracepoint != "tcp/tcp_set_state" {
+		t.Errorf("expected tracepoint %q, got %q", "tcp/tcp_set_state", tracepoint)
+	}
+}
+
+func TestDeduceTracepointAvailableEventsReadError(t *testing.T) {
+	mockMountpoint, undoFunc, err := bootstrapMockTraceFS("sock/inet_sock_set_state", false)
+	defer undoFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	if err := ioutil.WriteFile(mockMountpoint+"/available_events", []byte{}, 0200); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock available_events: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+
+	tracepointDeducer := newTraceFSTracepointDeducer(mockMountpointRetriever, defaultTracepointCandidates)
+
+	_, err = tracepointDeducer.deduceTracepoint()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
 func bootstrapMockTraceFS(tracepoint string, inaccessible bool) (string, func(), error) {
 	undoFunc := func() {}
 
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"net"
+	"syscall"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/event"
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// IPProtoMPTCP is the protocol of MPTCP sockets, which the syscall package
+// does not define.
+const ipProtoMPTCP = 262
+
+// The bits of the common_flags field of the records of tracepoint events.
+const (
+	traceFlagIRQsOff     = 0x01
+	traceFlagNeedResched = 0x04
+	traceFlagHardIRQ     = 0x08
+	traceFlagSoftIRQ     = 0x10
+	traceFlagNMI         = 0x40
+)
+
+// PointerHashSeed is the seed with which pointers are hashed when decoded, so
+// that kernel addresses are not disclosed, but are consistent, as when the
+// kernel prints them.
+var pointerHashSeed = maphash.MakeSeed()
+
+// TracepointRecordDecoder decodes the raw records of the TCP state change
+// tracepoint, or of the kprobe which stands in for it, straight into events,
+// by the offsets of their fields declared by its format, rather than rendering
+// them as text to be parsed.
+type tracepointRecordDecoder struct {
+	family, protocol                *formatField // Nil if the tracepoint does not declare them
+	sport, dport                    *formatField
+	saddr, daddr                    *formatField
+	oldState, newState              *formatField
+	skAddr, sockCookie              *formatField // Nil if the tracepoint does not declare them
+	commonFlags, commonPreemptCount *formatField
+
+	// Kprobe is whether the record is of the kprobe, which fetches the
+	// destination port in network byte order.
+	kprobe bool
+
+	mptcp      bool // Whether the events of MPTCP sockets are decoded
+	bestEffort bool // Whether unmapped states are decoded as StateUnknown
+}
+
+// NewTracepointRecordDecoder returns a decoder of the records of the format,
+// which must declare the ports, addresses and states of state changes.
+func newTracepointRecordDecoder(format *eventFormat, cfg *config) (*tracepointRecordDecoder, error) {
+	decoder := &tracepointRecordDecoder{
+		family:             format.fields["family"],
+		protocol:           format.fields["protocol"],
+		skAddr:             format.fields["skaddr"],
+		sockCookie:         format.fields["sock_cookie"],
+		commonFlags:        format.fields["common_flags"],
+		commonPreemptCount: format.fields["common_preempt_count"],
+		kprobe:             format.name == kprobeEventName,
+		mptcp:              cfg.mptcp,
+		bestEffort:         bestEffortParsing(cfg),
+	}
+
+	for name, field := range map[string]**formatField{
+		"sport":    &decoder.sport,
+		"dport":    &decoder.dport,
+		"saddr":    &decoder.saddr,
+		"daddr":    &decoder.daddr,
+		"oldstate": &decoder.oldState,
+		"newstate": &decoder.newState,
+	} {
+		if *field = format.fields[name]; *field == nil {
+			return nil, fmt.Errorf("%s format has no %s field", format.name, name)
+		}
+	}
+
+	if decoder.saddr.size != net.IPv4len || decoder.daddr.size != net.IPv4len {
+		return nil, fmt.Errorf("%s format has addresses of %d and %d bytes",
+			format.name,
+			decoder.saddr.size,
+			decoder.daddr.size)
+	}
+
+	return decoder, nil
+}
+
+// Decode decodes the state change of the record, whose task, time and context
+// are left to the caller. Records of sockets other than TCPv4 return an error
+// wrapping ErrIrrelevantEvent.
+func (d *tracepointRecordDecoder) decode(record []byte) (*ContextEvent, error) {
+	contextEvent := &ContextEvent{Event: new(event.Event), Kind: KindStateChange}
+
+	if d.family != nil {
+		family, err := d.integer(record, d.family, "family")
+		if err != nil {
+			return nil, err
+		}
+
+		if family != syscall.AF_INET {
+			return nil, errNonInetEvent
+		}
+	}
+
+	if d.protocol != nil {
+		protocol, err := d.integer(record, d.protocol, "protocol")
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case protocol == ipProtoMPTCP && d.mptcp:
+			contextEvent.MPTCP = true
+		case protocol != syscall.IPPROTO_TCP:
+			return nil, errNonTCPEvent
+		}
+	}
+
+	sourcePort, err := d.integer(record, d.sport, "sport")
+	if err != nil {
+		return nil, err
+	}
+	contextEvent.SourcePort = uint16(sourcePort)
+
+	destPort, err := d.bytes(record, d.dport, "dport")
+	if err != nil {
+		return nil, err
+	}
+
+	if d.kprobe {
+		contextEvent.DestPort = binary.BigEndian.Uint16(destPort)
+	} else {
+		contextEvent.DestPort = hostByteOrder.Uint16(destPort)
+	}
+
+	// The addresses are in network byte order, as stored by the kernel
+	for _, address := range []struct {
+		ip    *net.IP
+		field *formatField
+		name  string
+	}{
+		{&contextEvent.SourceIP, d.saddr, "saddr"},
+		{&contextEvent.DestIP, d.daddr, "daddr"},
+	} {
+		value, err := d.bytes(record, address.field, address.name)
+		if err != nil {
+			return nil, err
+		}
+		*address.ip = net.IPv4(value[0], value[1], value[2], value[3])
+	}
+
+	for _, state := range []struct {
+		state *tcpstate.State
+		field *formatField
+		name  string
+	}{
+		{&contextEvent.OldState, d.oldState, "oldstate"},
+		{&contextEvent.NewState, d.newState, "newstate"},
+	} {
+		value, err := d.integer(record, state.field, state.name)
+		if err != nil {
+			return nil, err
+		}
+
+		if value < 0 || value > math.MaxUint8 {
+			return nil, fmt.Errorf("decoding %s: state %d out of range", state.name, value)
+		}
+
+		if *state.state, err = decodeState(uint8(value), d.bestEffort, &contextEvent.UnknownStates); err != nil {
+			return nil, fmt.Errorf("decoding %s: %w", state.name, err)
+		}
+	}
+
+	if d.skAddr != nil || d.sockCookie != nil {
+		contextEvent.Socket = new(SocketID)
+		if d.skAddr != nil {
+			address, err := d.integer(record, d.skAddr, "skaddr")
+			if err != nil {
+				return nil, err
+			}
+			contextEvent.Socket.Address = uint64(address)
+			if !d.kprobe { // Hashed, as the kernel prints the address of a tracepoint
+				contextEvent.Socket.Address = hashPointer(contextEvent.Socket.Address)
+			}
+		}
+
+		if d.sockCookie != nil {
+			cookie, err := d.integer(record, d.sockCookie, "sock_cookie")
+			if err != nil {
+				return nil, err
+			}
+			contextEvent.Socket.Cookie = uint64(cookie)
+		}
+	}
+
+	return contextEvent, nil
+}
+
+// TraceContext returns the context of the record, emitted on the CPU, from its
+// common flags and preemption count.
+func (d *tracepointRecordDecoder) traceContext(record []byte, cpu int) *TraceContext {
+	context := &TraceContext{CPU: cpu}
+	if d.commonFlags == nil || d.commonPreemptCount == nil {
+		return context
+	}
+
+	flags, err := d.integer(record, d.commonFlags, "common_flags")
+	if err != nil {
+		return context
+	}
+
+	preemptCount, err := d.integer(record, d.commonPreemptCount, "common_preempt_count")
+	if err != nil {
+		return context
+	}
+
+	context.Flags = true
+	context.IRQsOff = flags&traceFlagIRQsOff != 0
+	context.NeedResched = flags&traceFlagNeedResched != 0
+	context.HardIRQ = flags&traceFlagHardIRQ != 0
+	context.SoftIRQ = flags&traceFlagSoftIRQ != 0
+	context.NMI = flags&traceFlagNMI != 0
+	context.PreemptDepth = int(preemptCount & 0xf)
+
+	return context
+}
+
+// Bytes returns the value of the field of the record, or an error if the record
+// is too short for it.
+func (d *tracepointRecordDecoder) bytes(record []byte, field *formatField, name string) ([]byte, error) {
+	if field.offset+field.size > len(record) {
+		return nil, fmt.Errorf("record of %d bytes too short for %s at offset %d of %d bytes",
+			len(record),
+			name,
+			field.offset,
+			field.size)
+	}
+
+	return record[field.offset : field.offset+field.size], nil
+}
+
+// Integer returns the integer value of the field of the record, or an error if
+// the record is too short for it, or it is not of the size of an integer.
+func (d *tracepointRecordDecoder) integer(record []byte, field *formatField, name string) (int64, error) {
+	value, err := d.bytes(record, field, name)
+	if err != nil {
+		return 0, err
+	}
+
+	integer, ok := recordInteger(value, field.signed)
+	if !ok {
+		return 0, fmt.Errorf("%s of %d bytes is not an integer", name, field.size)
+	}
+
+	return integer, nil
+}
+
+// RecordInteger returns the integer value of a field of a raw record, which is
+// in the byte order of the running machine, sign-extended if signed. If the
+// field is not of the size of an integer, ok is false.
+func recordInteger(value []byte, signed bool) (integer int64, ok bool) {
+	switch len(value) {
+	case 1:
+		if signed {
+			return int64(int8(value[0])), true
+		}
+		return int64(value[0]), true
+	case 2:
+		if signed {
+			return int64(int16(hostByteOrder.Uint16(value))), true
+		}
+		return int64(hostByteOrder.Uint16(value)), true
+	case 4:
+		if signed {
+			return int64(int32(hostByteOrder.Uint32(value))), true
+		}
+		return int64(hostByteOrder.Uint32(value)), true
+	case 8:
+		return int64(hostByteOrder.Uint64(value)), true
+	default:
+		return 0, false
+	}
+}
+
+// HashPointer hashes a kernel address, so that it is not disclosed.
+func hashPointer(address uint64) uint64 {
+	if address == 0 {
+		return 0
+	}
+
+	var hash maphash.Hash
+	hash.SetSeed(pointerHashSeed)
+	var addressBytes [8]byte
+	hostByteOrder.PutUint64(addressBytes[:], address)
+	hash.Write(addressBytes[:])
+
+	return hash.Sum64()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jhwbarlow/tcp-audit-common/pkg/tcpstate"
+)
+
+// NewMockInetSockSetStateRecord returns a raw record of the mockEventFormat.
+func newMockInetSockSetStateRecord(oldState, newState int32) []byte {
+	record := make([]byte, 72)
+	hostByteOrder.PutUint16(record[0:], 1385)
+	record[2] = traceFlagSoftIRQ
+	hostByteOrder.PutUint32(record[16:], uint32(oldState))
+	hostByteOrder.PutUint32(record[20:], uint32(newState))
+	hostByteOrder.PutUint16(record[24:], 44406)
+	hostByteOrder.PutUint16(record[26:], 80)
+	hostByteOrder.PutUint16(record[28:], 2)
+	hostByteOrder.PutUint16(record[30:], 6)
+	copy(record[32:], []byte{192, 168, 122, 38})
+	copy(record[36:], []byte{172, 217, 169, 4})
+	copy(record[40:], []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 168, 122, 38})
+	copy(record[56:], []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 172, 217, 169, 4})
+
+	return record
+}
+
+func newMockTracepointRecordDecoder(t *testing.T, mockFormat string, cfg *config) *tracepointRecordDecoder {
+	format, err := parseEventFormat(strings.NewReader(mockFormat))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+
+	decoder, err := newTracepointRecordDecoder(format, cfg)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	return decoder
+}
+
+func TestTracepointRecordDecoderDecode(t *testing.T) {
+	decoder := newMockTracepointRecordDecoder(t, mockEventFormat, new(config))
+
+	record := newMockInetSockSetStateRecord(1, 1)
+	hostByteOrder.PutUint64(record[8:], 0xffff888003a1c000)
+	event, err := decoder.decode(record)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.Kind != KindStateChange {
+		t.Errorf("expected state change, got %v", event.Kind)
+	}
+
+	if event.SourcePort != 44406 || event.DestPort != 80 {
+		t.Errorf("expected ports 44406 and 80, got %d and %d", event.SourcePort, event.DestPort)
+	}
+
+	if event.SourceIP.String() != "192.168.122.38" || event.DestIP.String() != "172.217.169.4" {
+		t.Errorf("expected addresses 192.168.122.38 and 172.217.169.4, got %v and %v", event.SourceIP, event.DestIP)
+	}
+
+	if event.OldState != tcpstate.StateEstablished || event.NewState != tcpstate.StateEstablished {
+		t.Errorf("expected established states, got %v and %v", event.OldState, event.NewState)
+	}
+
+	if event.Socket == nil || event.Socket.Address != hashPointer(0xffff888003a1c000) {
+		t.Errorf("expected socket address hashed, got %+v", event.Socket)
+	}
+
+	context := decoder.traceContext(record, 3)
+	if context.CPU != 3 || !context.Flags || !context.SoftIRQ || context.IRQsOff {
+		t.Errorf("expected CPU 3 in soft interrupt context, got %+v", context)
+	}
+}
+
+func TestTracepointRecordDecoderDecodeKprobe(t *testing.T) {
+	mockFormat := `name: tcp_audit_set_state
+ID: 2048
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:unsigned long __probe_ip;	offset:8;	size:8;	signed:0;
+	field:u64 skaddr;	offset:16;	size:8;	signed:0;
+	field:u16 family;	offset:24;	size:2;	signed:0;
+	field:u16 sport;	offset:26;	size:2;	signed:0;
+	field:u16 dport;	offset:28;	size:2;	signed:0;
+	field:u32 saddr;	offset:32;	size:4;	signed:0;
+	field:u32 daddr;	offset:36;	size:4;	signed:0;
+	field:u8 oldstate;	offset:40;	size:1;	signed:0;
+	field:s32 newstate;	offset:44;	size:4;	signed:1;
+
+print fmt: "(%lx) skaddr=0x%Lx family=%u sport=%u dport=%u saddr=0x%x daddr=0x%x oldstate=%u newstate=%d", REC->__probe_ip, REC->skaddr, REC->family, REC->sport, REC->dport, REC->saddr, REC->daddr, REC->oldstate, REC->newstate
+`
+	decoder := newMockTracepointRecordDecoder(t, mockFormat, new(config))
+
+	record := make([]byte, 48)
+	hostByteOrder.PutUint64(record[16:], 0xffff888003a1c000)
+	hostByteOrder.PutUint16(record[24:], 2)
+	hostByteOrder.PutUint16(record[26:], 44406)
+	copy(record[28:], []byte{0, 80}) // Network byte order, as stored by the kernel
+	copy(record[32:], []byte{192, 168, 122, 38})
+	copy(record[36:], []byte{172, 217, 169, 4})
+	record[40] = 1
+	hostByteOrder.PutUint32(record[44:], 4)
+
+	event, err := decoder.decode(record)
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if event.SourcePort != 44406 || event.DestPort != 80 {
+		t.Errorf("expected ports 44406 and 80, got %d and %d", event.SourcePort, event.DestPort)
+	}
+
+	if event.SourceIP.String() != "192.168.122.38" || event.DestIP.String() != "172.217.169.4" {
+		t.Errorf("expected addresses 192.168.122.38 and 172.217.169.4, got %v and %v", event.SourceIP, event.DestIP)
+	}
+
+	if event.OldState != tcpstate.StateEstablished || event.NewState != tcpstate.StateFinWait1 {
+		t.Errorf("expected states %v and %v, got %v and %v",
+			tcpstate.StateEstablished,
+			tcpstate.StateFinWait1,
+			event.OldState,
+			event.NewState)
+	}
+
+	// The kprobe fetches the address itself, which the parser does not hash
+	if event.Socket == nil || event.Socket.Address != 0xffff888003a1c000 {
+		t.Errorf("expected socket address unhashed, got %+v", event.Socket)
+	}
+}
+
+func TestTracepointRecordDecoderDecodeIrrelevant(t *testing.T) {
+	decoder := newMockTracepointRecordDecoder(t, mockEventFormat, new(config))
+
+	inet6Record := newMockInetSockSetStateRecord(1, 1)
+	hostByteOrder.PutUint16(inet6Record[28:], 10)
+
+	udpRecord := newMockInetSockSetStateRecord(1, 1)
+	hostByteOrder.PutUint16(udpRecord[30:], 17)
+
+	for _, record := range [][]byte{inet6Record, udpRecord} {
+		_, err := decoder.decode(record)
+		if !errors.Is(err, ErrIrrelevantEvent) {
+			t.Errorf("expected error wrapping %q, got %q (of type %T)", ErrIrrelevantEvent, err, err)
+		}
+	}
+}
+
+func TestTracepointRecordDecoderDecodeError(t *testing.T) {
+	decoder := newMockTracepointRecordDecoder(t, mockEventFormat, new(config))
+
+	for _, record := range [][]byte{
+		newMockInetSockSetStateRecord(1, 1)[:34], // Too short for the addresses
+		newMockInetSockSetStateRecord(1, 256),    // Out of range
+		newMockInetSockSetStateRecord(1, 99),     // Unmapped, and not decoded best-effort
+	} {
+		_, err := decoder.decode(record)
+		if err == nil {
+			t.Error("expected error, got nil")
+			continue
+		}
+
+		t.Logf("got error %q (of type %T)", err, err)
+	}
+}
+
+func TestNewTracepointRecordDecoderMissingFieldError(t *testing.T) {
+	format, err := parseEventFormat(strings.NewReader(strings.Replace(mockEventFormat, "dport", "port", 1)))
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to parse mock event format: %v", err)
+	}
+
+	_, err = newTracepointRecordDecoder(format, new(config))
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
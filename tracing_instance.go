@@ -1,20 +1,102 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const (
+	// Bounds on retrying removal of an instance which the kernel reports as busy
+	instanceRemovalAttempts       = 6
+	instanceRemovalInitialBackoff = 10 * time.Millisecond
+
+	// The smallest size, in KiB, to which the ring buffer of each CPU is reduced
+	// if memory for a larger buffer cannot be allocated
+	minBufferSizeKB = 64
+
+	// Bounds on the backoff between retries of discovery at startup
+	discoveryInitialBackoff = 100 * time.Millisecond
+	discoveryMaxBackoff     = 5 * time.Second
+
+	// Writing this to the filter file of a tracepoint clears its filter
+	clearedFilter = "0"
+)
+
+// BaselineTraceOptions are set in every instance so that the format of the
+// lines read is that expected by the event parser, regardless of the options
+// in effect at the top-level, which new instances inherit.
+var baselineTraceOptions = []string{"context-info", "noraw", "nohex", "nobin"}
+
+// ErrInstanceNotReclaimed is an error returned if the tracing instance could
+// not be removed, and so remains allocated in the kernel.
+var ErrInstanceNotReclaimed = errors.New("tracing instance not reclaimed")
+
+// ErrInstanceNotOwned is an error returned if the tracing instance directory
+// already exists, but is owned by another user, so may be in use by, or under
+// the control of, someone else.
+var ErrInstanceNotOwned = errors.New("tracing instance not owned")
+
 // TracingInstance is an interface which describes objects which expose a ring
 // buffer of TCP state change tracing events from the kernel.
 type tracingInstance interface {
 	open() (io.Reader, error)
+	openPerCPU() ([]io.Reader, error)
+	backfill() (io.Reader, error)
+	kernelInfo() (*KernelInfo, error)
+	degradedBufferSizeKB() uint64
+	reassertTracing() ([]string, error)
+	traceClock() string
 	enable() error
 	disable() error
 	close() error
+	addTrigger(trigger string) error
+	removeTrigger(trigger string) error
+	bufferStats() (*BufferStats, error)
+	snapshot(w io.Writer) error
+	present() bool
+	setReadDeadline(t time.Time) error
+	eventFormat() (*eventFormat, error)
+}
+
+// FilterOffloader is a tracing instance, or event source, which can offload
+// the conjuncts of the filter expression which ftrace can express to the
+// kernel filter of the tracepoint of state changes.
+type filterOffloader interface {
+	// FilterOffloaded returns whether the kernel filter of the instance, once
+	// enabled, includes the offloaded conjuncts.
+	filterOffloaded() bool
+
+	// Refilter replaces the kernel filter of the enabled instance with that of
+	// its configuration, once its filter or filter expression has changed,
+	// without disabling the instance.
+	refilter() error
+}
+
+// OffloadingFilter returns the ftrace filter of the tracepoint of state
+// changes which is both the configured filter, if any, and the conjuncts of
+// the filter expression which ftrace can express, or empty if there are none.
+func offloadingFilter(cfg *config) string {
+	if cfg.filterExpression == nil {
+		return ""
+	}
+
+	offloaded, _ := cfg.filterExpression.offload()
+	if offloaded == "" || cfg.filter == "" {
+		return offloaded
+	}
+
+	return "(" + cfg.filter + ") && " + offloaded
 }
 
 // TraceFSTracingInstance creates a unique tracefs tracing instance and exposes
@@ -23,100 +105,1285 @@ type traceFSTracingInstance struct {
 	mountpointRetriever mountpointRetriever
 	tracepointDeducer   tracepointDeducer
 	uidProvider         uidProvider
+	config              *config
+
+	mountpoint string // The tracefs mountpoint, beneath which all paths are resolved
+	path       string
+	tracepoint string
+	auxiliary  []string // The tracepoints enabled alongside that of state changes
+	format     *eventFormat
+	clock      string        // The trace clock with which events are timestamped, if known
+	adopted    bool          // Whether the instance pre-existed and so must not be removed
+	topLevel   bool          // Whether the top-level tracefs is used as instances are unsupported
+	attached   bool          // Whether the instance was prepared by a third party, so must not be modified
+	reader     io.ReadCloser // The trace_pipe file, or a poller of the trace file
+	readerPath string
+	perCPU     []io.ReadCloser // The trace_pipe file of each CPU, if opened per-CPU
+
+	// The size, in KiB, to which the ring buffer of each CPU was reduced as
+	// memory could not be allocated, or zero if it was not reduced
+	reducedBufferSizeKB uint64
+
+	offloaded bool // Whether the filter expression was offloaded to the kernel
+
+	// The settings of an adopted instance or the top-level tracefs as found
+	// before they were changed, restored in reverse order upon release
+	saved []savedSetting
 
-	path string
-	pipe *os.File
+	mkdir    func(root, path string, perm uint32) error
+	rmdir    func(root, path string) error
+	ownerUID func(path string) (int, error)
+	geteuid  func() int
+
+	osReleasePath string
+
+	// Used to diagnose permission errors
+	lockdownPath          string
+	perfEventParanoidPath string
 }
 
 func newTraceFSTracingInstance(mountpointRetriever mountpointRetriever,
 	tracepointDeducer tracepointDeducer,
-	uidProvider uidProvider) *traceFSTracingInstance {
+	uidProvider uidProvider,
+	config *config) *traceFSTracingInstance {
 
 	return &traceFSTracingInstance{
 		mountpointRetriever: mountpointRetriever,
 		tracepointDeducer:   tracepointDeducer,
 		uidProvider:         uidProvider,
+		config:              config,
+		mkdir:               mkdirBeneath,
+		rmdir:               rmdirBeneath,
+		ownerUID:            ownerUID,
+		geteuid:             os.Geteuid,
+		osReleasePath:       osReleasePath,
+
+		lockdownPath:          lockdownPath,
+		perfEventParanoidPath: perfEventParanoidPath,
 	}
 }
 
 // Enable creates a tracefs instance within the retrieved mountpoint and
 // enables the tracepoint provided by the tracepoint deducer, ready for the
-// open method to be called.
+// open method to be called. If an instance path is configured, the instance is
+// instead assumed to be prepared already, and is only attached to.
+// If permission is denied to root, and the kernel is restricting tracing, a
+// *RestrictedTracingError is returned, explaining why.
 func (ti *traceFSTracingInstance) enable() error {
+	err := ti.enableInstance()
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, syscall.EPERM) && ti.geteuid() == 0 {
+		if restrictedErr := probeTracingRestrictions(ti.lockdownPath,
+			ti.perfEventParanoidPath,
+			err); restrictedErr != nil {
+			return restrictedErr
+		}
+	}
+
+	return err
+}
+
+func (ti *traceFSTracingInstance) enableInstance() error {
+	traceFSMountpoint, tracepoint, err := ti.discoverWithRetry()
+	if err != nil {
+		return err
+	}
+	ti.tracepoint = tracepoint
+
+	ti.mountpoint = traceFSMountpoint
+	ti.adopted, ti.topLevel, ti.attached = false, false, false
+	ti.auxiliary = nil
+
+	if ti.config.instancePath != "" {
+		ti.path = ti.config.instancePath
+		ti.attached = true
+	} else if err := ti.prepare(); err != nil {
+		return err
+	}
+
+	return ti.attach()
+}
+
+// Prepare is the privileged phase of enabling, which creates and configures the
+// instance, and enables the tracepoint within it.
+func (ti *traceFSTracingInstance) prepare() error {
+	ti.path = ti.mountpoint + "/instances/" + ti.uidProvider.uid()
+	err := ti.mkdir(ti.mountpoint, ti.path, 0700)
+	switch {
+	case err == nil:
+	case os.IsExist(err):
+		if err := ti.verifyInstanceOwner(); err != nil {
+			return err
+		}
+
+		// A fixed instance name is used so that an instance prepared by a
+		// third party can be adopted, so it is not ours to remove
+		if ti.config.instanceName != "" {
+			log.Printf("Adopting existing tracing instance: %s", ti.path)
+			ti.adopted = true
+		}
+	case (os.IsNotExist(err) || os.IsPermission(err)) && isDirBeneath(ti.mountpoint, ti.mountpoint):
+		// The kernel does not support, or does not permit, the creation of
+		// instances, so fall back to using the top-level tracefs
+		log.Printf("WARNING: Unable to create tracing instance (%v): "+
+			"falling back to the top-level tracefs at %s. "+
+			"This is shared with all other tracefs users on the system, "+
+			"which may interfere with, or be interfered with by, this eventer",
+			err,
+			ti.mountpoint)
+		ti.path = ti.mountpoint
+		ti.topLevel = true
+	default:
+		return fmt.Errorf("making instance directory: %w", err)
+	}
+
+	ti.auxiliary = ti.availableAuxiliaryTracepoints()
+
+	ti.saved = nil
+	if ti.adopted || ti.topLevel {
+		if err := ti.saveSettings(); err != nil {
+			return fmt.Errorf("saving settings: %w", err)
+		}
+	}
+
+	if err := ti.setTraceOptions(); err != nil {
+		return fmt.Errorf("setting trace options: %w", err)
+	}
+
+	// Changing the clock clears the ring buffer, so is only done when the
+	// instance is owned, and so not yet in use
+	if !ti.adopted && !ti.topLevel {
+		if err := ti.writeFile(ti.path+"/trace_clock", preferredTraceClock+"\n"); err != nil {
+			if !errors.Is(err, syscall.EINVAL) {
+				return fmt.Errorf("setting trace clock: %w", err)
+			}
+
+			log.Printf("Trace clock %q not supported by kernel, skipping", preferredTraceClock)
+		}
+	}
+
+	ti.reducedBufferSizeKB = 0
+	if ti.config.bufferSizeKB != 0 {
+		if err := ti.setBufferSize(ti.config.bufferSizeKB); err != nil {
+			return fmt.Errorf("setting buffer size: %w", err)
+		}
+	}
+
+	if ti.config.cpuMask != "" {
+		if err := ti.setCPUMask(ti.config.cpuMask); err != nil {
+			return fmt.Errorf("setting CPU mask: %w", err)
+		}
+	}
+
+	if err := ti.setTracepointFilter(false); err != nil {
+		return err
+	}
+
+	if ti.filtersPIDs() {
+		if err := ti.setEventPIDs(); err != nil {
+			return fmt.Errorf("setting event PIDs: %w", err)
+		}
+	}
+
+	// Enabling tracing expands the ring buffer to its full size
+	if err := ti.retryWithSmallerBuffer(func() error {
+		return ti.enableTracePoints(ti.tracepoints()...)
+	}); err != nil {
+		return fmt.Errorf("enabling tracepoints: %w", err)
+	}
+
+	if err := ti.retryWithSmallerBuffer(ti.enableTracing); err != nil {
+		return fmt.Errorf("enabling tracing: %w", err)
+	}
+
+	return nil
+}
+
+// Attach is the unprivileged phase of enabling, which reads the format of the
+// tracepoint from the instance, which must already be prepared.
+func (ti *traceFSTracingInstance) attach() error {
+	if ti.attached {
+		if !isDirBeneath(ti.mountpoint, ti.path) {
+			return fmt.Errorf("attaching to instance: %s not found", ti.path)
+		}
+		log.Printf("Attaching to prepared tracing instance: %s", ti.path)
+	}
+
+	format, err := ti.readEventFormat(ti.tracepoint)
+	if err != nil {
+		return fmt.Errorf("reading tracepoint format: %w", err)
+	}
+	ti.format = format
+
+	// Without the trace clock, events can still be timed when parsed
+	clock, err := ti.readTraceClock()
+	if err != nil {
+		log.Printf("Unable to read trace clock: %v", err)
+	}
+	ti.clock = clock
+
+	return nil
+}
+
+// AvailableAuxiliaryTracepoints returns the configured tracepoints to enable
+// alongside that of state changes, skipping any the kernel does not provide.
+func (ti *traceFSTracingInstance) availableAuxiliaryTracepoints() []string {
+	var candidates []*tracepointCandidate
+	if ti.config.resets {
+		candidates = append(candidates, resetTracepoints...)
+	}
+
+	if ti.config.destroySock {
+		candidates = append(candidates, destroySockTracepoint)
+	}
+
+	if ti.config.retransmits {
+		candidates = append(candidates, retransmitTracepoint)
+	}
+
+	available := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !isDirBeneath(ti.mountpoint, ti.path+"/events/"+candidate.tracepoint) {
+			log.Printf("Tracepoint %q not provided by kernel, skipping", candidate.tracepoint)
+			continue
+		}
+		available = append(available, candidate.tracepoint)
+	}
+
+	return available
+}
+
+// Tracepoints returns all the tracepoints enabled in the instance.
+func (ti *traceFSTracingInstance) tracepoints() []string {
+	return append([]string{ti.tracepoint}, ti.auxiliary...)
+}
+
+// ReadTraceClock returns the clock with which events are timestamped, or
+// empty if the kernel does not expose it.
+func (ti *traceFSTracingInstance) readTraceClock() (string, error) {
+	contents := new(bytes.Buffer)
+	if err := ti.copyFile(contents, ti.path+"/trace_clock"); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return parseTraceClock(contents.String())
+}
+
+// TraceClock returns the clock with which events are timestamped, or empty if
+// it is not known.
+func (ti *traceFSTracingInstance) traceClock() string {
+	return ti.clock
+}
+
+// DiscoverWithRetry discovers the tracefs mountpoint and tracepoint, retrying
+// with backoff until the configured startup timeout, so that an eventer started
+// before tracefs is mounted converges rather than failing.
+func (ti *traceFSTracingInstance) discoverWithRetry() (string, string, error) {
+	deadline := time.Now().Add(ti.config.startupTimeout)
+	backoff := discoveryInitialBackoff
+	for {
+		traceFSMountpoint, tracepoint, err := ti.discover()
+		if err == nil {
+			return traceFSMountpoint, tracepoint, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return "", "", err
+		}
+
+		if backoff > remaining {
+			backoff = remaining
+		}
+
+		log.Printf("Discovering tracefs failed (%v), retrying in %v", err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > discoveryMaxBackoff {
+			backoff = discoveryMaxBackoff
+		}
+	}
+}
+
+func (ti *traceFSTracingInstance) discover() (string, string, error) {
 	// Check whether and where tracefs is mounted
 	traceFSMountpoint, err := ti.mountpointRetriever.retrieveMountpoint()
 	if err != nil {
-		return fmt.Errorf("obtaining tracefs mountpoint: %w", err)
+		return "", "", fmt.Errorf("obtaining tracefs mountpoint: %w", err)
 	}
 
 	// Find the tracepoint to use depending on kernel version
 	tracepoint, err := ti.tracepointDeducer.deduceTracepoint()
 	if err != nil {
-		return fmt.Errorf("getting tracepoint: %w", err)
+		return "", "", fmt.Errorf("getting tracepoint: %w", err)
 	}
 
-	ti.path = traceFSMountpoint + "/instances/" + ti.uidProvider.uid()
-	if err := os.Mkdir(ti.path, 0600); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("making instance directory: %w", err)
+	return traceFSMountpoint, tracepoint, nil
+}
+
+// VerifyInstanceOwner checks that a pre-existing instance directory is owned
+// either by the effective user, or by the owner of the instances directory, as
+// tracefs assigns every file it creates the owner given by its mount options,
+// regardless of the creating user.
+func (ti *traceFSTracingInstance) verifyInstanceOwner() error {
+	uid, err := ti.ownerUID(ti.path)
+	if err != nil {
+		return fmt.Errorf("getting owner of instance directory: %w", err)
 	}
 
-	if err := ti.enableTracePoint(tracepoint); err != nil {
-		return fmt.Errorf("enabling tracepoint: %w", err)
+	if uid == ti.geteuid() {
+		return nil
 	}
 
-	if err := ti.enableTracing(); err != nil {
-		return fmt.Errorf("enabling tracing: %w", err)
+	instancesUID, err := ti.ownerUID(filepath.Dir(ti.path))
+	if err != nil {
+		return fmt.Errorf("getting owner of instances directory: %w", err)
+	}
+
+	if uid != instancesUID {
+		return fmt.Errorf("%w: %s is owned by UID %d", ErrInstanceNotOwned, ti.path, uid)
 	}
 
 	return nil
 }
 
 // Disable cleans up the tracefs instance. It should be called once
-// the tracing instance has been closed.
+// the tracing instance has been closed. An adopted instance or the top-level
+// tracefs is not removed, but has tracing and the tracepoint disabled.
+// Any dynamic event provisioned in place of the tracepoint is then removed.
 func (ti *traceFSTracingInstance) disable() error {
+	// The instance is left enabled for the third party which prepared it to
+	// clean up
+	if ti.attached {
+		return nil
+	}
+
+	if ti.adopted || ti.topLevel {
+		if err := ti.release(); err != nil {
+			return err
+		}
+
+		ti.releaseTracepoint()
+		return nil
+	}
+
+	// Return the ring buffer memory to the kernel promptly, in case removal
+	// of the instance is delayed, or fails
+	if err := ti.freeBuffer(); err != nil {
+		log.Printf("Unable to free tracing instance ring buffer: %v", err)
+	}
+
 	log.Printf("Removing tracing instance: %s", ti.path)
-	if err := os.RemoveAll(ti.path); err != nil {
+	if err := ti.removeInstance(); err != nil {
 		return fmt.Errorf("removing tracing instance: %w", err)
 	}
 
+	ti.releaseTracepoint()
 	return nil
 }
 
+// ReleaseTracepoint releases the tracepoint from the tracepoint deducer. As the
+// instance has already been cleaned up, failure is only logged.
+func (ti *traceFSTracingInstance) releaseTracepoint() {
+	if err := ti.tracepointDeducer.releaseTracepoint(); err != nil {
+		log.Printf("Unable to release tracepoint %q: %v", ti.tracepoint, err)
+	}
+}
+
+// FreeBuffer shrinks the instance ring buffer to its minimum size, which the
+// kernel does upon the close of the free_buffer file.
+func (ti *traceFSTracingInstance) freeBuffer() error {
+	if err := ti.appendFile(ti.path+"/free_buffer", "1\n"); err != nil {
+		return fmt.Errorf("writing free_buffer: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveInstance removes the instance directory, retrying with backoff while
+// the kernel reports the instance as busy (e.g. as the trace_pipe file is still
+// referenced), then verifies the instance has actually disappeared.
+func (ti *traceFSTracingInstance) removeInstance() error {
+	backoff := instanceRemovalInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := ti.rmdir(ti.mountpoint, ti.path)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, syscall.EBUSY) {
+			return err
+		}
+
+		if attempt == instanceRemovalAttempts {
+			return fmt.Errorf("%w: %s still busy after %d attempts",
+				ErrInstanceNotReclaimed,
+				ti.path,
+				attempt)
+		}
+
+		log.Printf("Tracing instance %s busy, retrying removal in %v", ti.path, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if _, err := lstatBeneath(ti.mountpoint, ti.path); !os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s still present after removal", ErrInstanceNotReclaimed, ti.path)
+	}
+
+	return nil
+}
+
+// Release stops tracing in an adopted instance or the top-level tracefs,
+// leaving the instance itself in place, then restores the settings saved
+// before they were changed.
+func (ti *traceFSTracingInstance) release() error {
+	log.Printf("Releasing tracing instance: %s", ti.path)
+	if err := ti.writeFile(ti.path+"/tracing_on", "0\n"); err != nil {
+		return fmt.Errorf("clearing tracing_on: %w", err)
+	}
+
+	for _, tracepoint := range ti.tracepoints() {
+		if err := ti.writeFile(ti.path+"/events/"+tracepoint+"/enable", "0\n"); err != nil {
+			return fmt.Errorf("disabling tracepoint %q: %w", tracepoint, err)
+		}
+	}
+
+	// Truncating set_event_pid clears the PIDs
+	if ti.filtersPIDs() {
+		if err := ti.writeFile(ti.path+"/set_event_pid", ""); err != nil {
+			return fmt.Errorf("clearing set_event_pid: %w", err)
+		}
+	}
+
+	if ti.config.eventFork {
+		if err := ti.setTraceOption("noevent-fork"); err != nil {
+			return err
+		}
+	}
+
+	return ti.restoreSettings()
+}
+
+// SavedSetting is a setting of tracefs as found before it was changed, with
+// the means to restore it.
+type savedSetting struct {
+	name    string
+	restore func() error
+}
+
+// SaveSettings saves the settings which preparing the instance changes, so
+// that they can be restored upon release for the owner of an adopted instance,
+// or the other users of the top-level tracefs. These are tracing_on, the
+// enable and filter files of the tracepoints, tracing_cpumask, buffer_size_kb,
+// set_event_pid and the trace options set. Settings the kernel does not
+// provide are not saved.
+func (ti *traceFSTracingInstance) saveSettings() error {
+	if err := ti.saveSetting("tracing_on", restorableFlag); err != nil {
+		return err
+	}
+
+	for _, tracepoint := range ti.tracepoints() {
+		if err := ti.saveSetting("events/"+tracepoint+"/enable", restorableFlag); err != nil {
+			return err
+		}
+	}
+
+	if err := ti.saveSetting("events/"+ti.tracepoint+"/filter", restorableFilter); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"tracing_cpumask", "set_event_pid"} {
+		if err := ti.saveSetting(name, func(contents string) (string, error) {
+			return contents, nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := ti.saveSetting("buffer_size_kb", func(contents string) (string, error) {
+		sizeKB, err := parseBufferSizeKB(contents)
+		if err != nil {
+			return "", err
+		}
+
+		return strconv.FormatUint(sizeKB, 10) + "\n", nil
+	}); err != nil {
+		return err
+	}
+
+	return ti.saveTraceOptions()
+}
+
+// SaveSetting saves the contents of the file of the name within the instance,
+// to be restored by writing them, as converted by restorable, back to it.
+func (ti *traceFSTracingInstance) saveSetting(name string, restorable func(contents string) (string, error)) error {
+	path := ti.path + "/" + name
+	contents := new(bytes.Buffer)
+	if err := ti.copyFile(contents, path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+
+	data, err := restorable(contents.String())
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
+	}
+
+	ti.saved = append(ti.saved, savedSetting{name, func() error {
+		return ti.writeFile(path, data)
+	}})
+
+	return nil
+}
+
+// SaveTraceOptions saves the state of each trace option set, as listed in the
+// trace_options file, as either the option or the option prefixed with "no".
+func (ti *traceFSTracingInstance) saveTraceOptions() error {
+	contents := new(bytes.Buffer)
+	if err := ti.copyFile(contents, ti.path+"/trace_options"); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("reading trace_options: %w", err)
+	}
+	states := strings.Fields(contents.String())
+
+	options := append(append([]string(nil), baselineTraceOptions...), ti.config.traceOptions...)
+	if ti.filtersPIDs() && ti.config.eventFork {
+		options = append(options, "event-fork")
+	}
+
+	saved := make(map[string]bool, len(options))
+	for _, option := range options {
+		for _, state := range states {
+			if state != option && "no"+state != option && state != "no"+option {
+				continue
+			}
+
+			if !saved[state] {
+				saved[state] = true
+				state := state
+				ti.saved = append(ti.saved, savedSetting{"trace option " + state, func() error {
+					return ti.setTraceOption(state)
+				}})
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// RestoreSettings restores the settings saved, in the reverse order of their
+// saving, so that tracing is turned back on, if it was, only once the others
+// are restored. Each is restored even if others cannot be, and the first
+// error is returned.
+func (ti *traceFSTracingInstance) restoreSettings() error {
+	var firstErr error
+	for i := len(ti.saved) - 1; i >= 0; i-- {
+		if err := ti.saved[i].restore(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("restoring %s: %w", ti.saved[i].name, err)
+		}
+	}
+	ti.saved = nil
+
+	return firstErr
+}
+
+// RestorableFlag returns the value of a flag file, such as tracing_on or the
+// enable file of a tracepoint, to write to restore it. A soft-disabled
+// tracepoint is read with an asterisk suffix, e.g. "1*", which is dropped.
+func restorableFlag(contents string) (string, error) {
+	if strings.HasPrefix(contents, "1") {
+		return "1\n", nil
+	}
+
+	return "0\n", nil
+}
+
+// RestorableFilter returns the filter of a tracepoint to write to restore it,
+// which, if there was none, clears that set since.
+func restorableFilter(contents string) (string, error) {
+	filter := strings.TrimSpace(contents)
+	if filter == "" || filter == "none" {
+		return clearedFilter + "\n", nil
+	}
+
+	return filter + "\n", nil
+}
+
 func (ti *traceFSTracingInstance) enableTracing() error {
-	if err := ioutil.WriteFile(ti.path+"/tracing_on", []byte("1\n"), 0); err != nil {
+	if err := ti.writeFile(ti.path+"/tracing_on", "1\n"); err != nil {
 		return fmt.Errorf("setting tracing_on: %w", err)
 	}
 
 	return nil
 }
 
+// SetBufferSize sets the size, in KiB, of the ring buffer of each CPU. If the
+// memory cannot be allocated, the size is halved until it can be, down to the
+// minimum size.
+func (ti *traceFSTracingInstance) setBufferSize(sizeKB uint64) error {
+	requestedSizeKB := sizeKB
+	for {
+		err := ti.writeFile(ti.path+"/buffer_size_kb", strconv.FormatUint(sizeKB, 10)+"\n")
+		if err == nil {
+			break
+		}
+
+		if !isNoMemory(err) || sizeKB/2 < minBufferSizeKB {
+			return err
+		}
+
+		sizeKB /= 2
+		log.Printf("WARNING: Unable to allocate ring buffer (%v): reducing size to %d KiB", err, sizeKB)
+	}
+
+	if sizeKB != requestedSizeKB {
+		ti.reducedBufferSizeKB = sizeKB
+	}
+
+	return nil
+}
+
+// RetryWithSmallerBuffer calls write, and if it fails as memory for the ring
+// buffer cannot be allocated, halves the size of the ring buffer and retries,
+// until the minimum size is reached.
+func (ti *traceFSTracingInstance) retryWithSmallerBuffer(write func() error) error {
+	for {
+		err := write()
+		if err == nil || !isNoMemory(err) {
+			return err
+		}
+
+		sizeKB, sizeErr := ti.readBufferSizeKB()
+		if sizeErr != nil || sizeKB/2 < minBufferSizeKB {
+			return err
+		}
+
+		log.Printf("WARNING: Unable to allocate ring buffer (%v): reducing size to %d KiB", err, sizeKB/2)
+		if err := ti.writeFile(ti.path+"/buffer_size_kb", strconv.FormatUint(sizeKB/2, 10)+"\n"); err != nil {
+			return fmt.Errorf("reducing buffer size: %w", err)
+		}
+		ti.reducedBufferSizeKB = sizeKB / 2
+	}
+}
+
+func (ti *traceFSTracingInstance) readBufferSizeKB() (uint64, error) {
+	contents := new(bytes.Buffer)
+	if err := ti.copyFile(contents, ti.path+"/buffer_size_kb"); err != nil {
+		return 0, fmt.Errorf("reading buffer size: %w", err)
+	}
+
+	return parseBufferSizeKB(contents.String())
+}
+
+// DegradedBufferSizeKB returns the size, in KiB, to which the ring buffer of
+// each CPU was reduced as memory could not be allocated, or zero if it was not.
+func (ti *traceFSTracingInstance) degradedBufferSizeKB() uint64 {
+	return ti.reducedBufferSizeKB
+}
+
+// ReassertTracing checks that tracing_on and the tracepoint enable files are
+// still set, as another tracefs user may have reset them, and sets them again
+// if not. It returns the names of the files which had been reset.
+func (ti *traceFSTracingInstance) reassertTracing() ([]string, error) {
+	type flag struct {
+		name   string
+		path   string
+		enable func() error
+	}
+
+	flags := []flag{{"tracing_on", ti.path + "/tracing_on", ti.enableTracing}}
+	for _, tracepoint := range ti.tracepoints() {
+		tracepoint := tracepoint
+		enable := func() error {
+			return ti.enableTracePoints(tracepoint)
+		}
+		flags = append(flags, flag{tracepoint + "/enable", ti.path + "/events/" + tracepoint + "/enable", enable})
+	}
+
+	reset := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		contents := new(bytes.Buffer)
+		if err := ti.copyFile(contents, flag.path); err != nil {
+			return reset, fmt.Errorf("reading %s: %w", flag.name, err)
+		}
+
+		// A soft-disabled tracepoint is suffixed with an asterisk, e.g. "1*"
+		if strings.HasPrefix(contents.String(), "1") {
+			continue
+		}
+		reset = append(reset, flag.name)
+
+		if err := flag.enable(); err != nil {
+			return reset, fmt.Errorf("re-enabling %s: %w", flag.name, err)
+		}
+	}
+
+	return reset, nil
+}
+
+// SetTraceOptions sets the baseline trace options, followed by the configured
+// trace options, which may override them. Baseline options unknown to the
+// running kernel are skipped, whereas unknown configured options are an error.
+func (ti *traceFSTracingInstance) setTraceOptions() error {
+	for _, option := range baselineTraceOptions {
+		if err := ti.setTraceOption(option); err != nil {
+			if !errors.Is(err, syscall.EINVAL) {
+				return err
+			}
+
+			log.Printf("Trace option %q not supported by kernel, skipping", option)
+		}
+	}
+
+	for _, option := range ti.config.traceOptions {
+		if err := ti.setTraceOption(option); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetTraceOption sets a single trace option, such as "print-tgid" or, to clear
+// it, "noprint-tgid". The kernel only accepts a single option per write.
+func (ti *traceFSTracingInstance) setTraceOption(option string) error {
+	if err := ti.appendFile(ti.path+"/trace_options", option+"\n"); err != nil {
+		return fmt.Errorf("setting trace option %q: %w", option, err)
+	}
+
+	return nil
+}
+
+func (ti *traceFSTracingInstance) setCPUMask(mask string) error {
+	if err := ti.writeFile(ti.path+"/tracing_cpumask", mask+"\n"); err != nil {
+		return fmt.Errorf("setting tracing_cpumask to %q: %w", mask, err)
+	}
+
+	return nil
+}
+
+func (ti *traceFSTracingInstance) filterOffloaded() bool {
+	return ti.offloaded
+}
+
+// Refilter replaces the filter of the tracepoint of state changes with that
+// of the configuration. The filter of an instance prepared by a third party is
+// not ours to set.
+func (ti *traceFSTracingInstance) refilter() error {
+	if ti.attached {
+		return nil
+	}
+
+	return ti.setTracepointFilter(true)
+}
+
+// SetTracepointFilter sets the filter of the tracepoint of state changes to
+// the configured filter, offloading the filter expression, if the kernel
+// accepts it. If replacing the filter, any filter set before is cleared if
+// there is none.
+func (ti *traceFSTracingInstance) setTracepointFilter(replace bool) error {
+	// The kernel may reject the offloaded conjuncts, such as if the fields of
+	// the tracepoint differ, in which case they are only filtered when read
+	ti.offloaded = false
+	if filter := offloadingFilter(ti.config); filter != "" {
+		if err := ti.setFilter(ti.tracepoint, filter); err != nil {
+			log.Printf("WARNING: Unable to offload filter expression to kernel (%v): "+
+				"filtering when read", err)
+		} else {
+			ti.offloaded = true
+			return nil
+		}
+	}
+
+	filter := ti.config.filter
+	if filter == "" {
+		if !replace {
+			return nil
+		}
+		filter = clearedFilter
+	}
+
+	if err := ti.setFilter(ti.tracepoint, filter); err != nil {
+		return fmt.Errorf("setting tracepoint filter: %w", err)
+	}
+
+	return nil
+}
+
+// SetFilter installs the ftrace filter expression on the tracepoint, so that
+// non-matching events are discarded in the kernel and never reach the ring buffer.
+// A syntactically invalid expression is rejected by the kernel with EINVAL.
+func (ti *traceFSTracingInstance) setFilter(tracepoint, filter string) error {
+	if err := ti.writeFile(ti.path+"/events/"+tracepoint+"/filter", filter+"\n"); err != nil {
+		return fmt.Errorf("setting filter %q on tracepoint %q: %w", filter, tracepoint, err)
+	}
+
+	return nil
+}
+
+func (ti *traceFSTracingInstance) filtersPIDs() bool {
+	return len(ti.config.eventPIDs) > 0 || ti.config.eventPIDCgroup != ""
+}
+
+// SetEventPIDs restricts tracing to events in the context of the configured
+// PIDs and the tasks of the configured cgroup, by writing them to the instance
+// set_event_pid file. The cgroup tasks are those at the time of the write. If
+// configured, the event-fork option is set so that their children, forked
+// later, are traced too.
+func (ti *traceFSTracingInstance) setEventPIDs() error {
+	if ti.config.eventFork {
+		if err := ti.setTraceOption("event-fork"); err != nil {
+			return err
+		}
+	}
+
+	pids := ti.config.eventPIDs
+	if ti.config.eventPIDCgroup != "" {
+		cgroupPIDs, err := readCgroupTasks(ti.config.eventPIDCgroup)
+		if err != nil {
+			return fmt.Errorf("reading cgroup %s tasks: %w", ti.config.eventPIDCgroup, err)
+		}
+		pids = append(append([]int(nil), pids...), cgroupPIDs...)
+	}
+
+	if len(pids) == 0 {
+		// An empty set_event_pid disables PID filtering, rather than filtering
+		// out all events
+		return errors.New("no PIDs to filter on")
+	}
+
+	eventPIDs := new(strings.Builder)
+	for _, pid := range pids {
+		eventPIDs.WriteString(strconv.Itoa(pid))
+		eventPIDs.WriteByte(' ')
+	}
+	eventPIDs.WriteByte('\n')
+
+	if err := ti.writeFile(ti.path+"/set_event_pid", eventPIDs.String()); err != nil {
+		return fmt.Errorf("writing set_event_pid: %w", err)
+	}
+
+	return nil
+}
+
+// ReadCgroupTasks returns the IDs of the tasks (threads) in the cgroup. The
+// cgroup.threads file is read on cgroup v2, and the tasks file on cgroup v1.
+func readCgroupTasks(cgroupPath string) ([]int, error) {
+	file, err := os.Open(cgroupPath + "/cgroup.threads")
+	if os.IsNotExist(err) {
+		file, err = os.Open(cgroupPath + "/tasks")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pids := make([]int, 0, 16)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("parsing task ID %q: %w", line, err)
+		}
+		pids = append(pids, pid)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanning tasks: %w", err)
+	}
+
+	return pids, nil
+}
+
+func (ti *traceFSTracingInstance) enableTracePoints(tracepoints ...string) error {
+	if ti.config.enableMethod == enableMethodSetEvent {
+		return ti.enableTracePointsViaSetEvent(tracepoints)
+	}
+
+	for _, tracepoint := range tracepoints {
+		if err := ti.enableTracePoint(tracepoint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (ti *traceFSTracingInstance) enableTracePoint(tracepoint string) error {
-	if err := ioutil.WriteFile(ti.path+"/events/"+tracepoint+"/enable",
-		[]byte("1\n"), 0); err != nil {
+	if err := ti.writeFile(ti.path+"/events/"+tracepoint+"/enable", "1\n"); err != nil {
 		return fmt.Errorf("enabling tracepoint %q: %w", tracepoint, err)
 	}
 
 	return nil
 }
 
+// EnableTracePointsViaSetEvent enables all the tracepoints with a single write
+// to the instance set_event file. The kernel enables the tracepoints of the
+// write in turn, so if one fails, those before it are left enabled, so all are
+// then disabled through their enable files, whether or not they were enabled.
+// The set_event file expects tracepoints in the form `system:event`, rather than
+// the `system/event` path form.
+func (ti *traceFSTracingInstance) enableTracePointsViaSetEvent(tracepoints []string) error {
+	setEvent := new(strings.Builder)
+	for _, tracepoint := range tracepoints {
+		setEvent.WriteString(strings.Replace(tracepoint, "/", ":", 1))
+		setEvent.WriteByte('\n')
+	}
+
+	// Append, as truncating set_event disables all events in the instance
+	if err := ti.appendFile(ti.path+"/set_event", setEvent.String()); err != nil {
+		for _, tracepoint := range tracepoints {
+			if err := ti.writeFile(ti.path+"/events/"+tracepoint+"/enable", "0\n"); err != nil {
+				log.Printf("Unable to disable tracepoint %q: %v", tracepoint, err)
+			}
+		}
+
+		return fmt.Errorf("enabling tracepoints %q via set_event: %w", tracepoints, err)
+	}
+
+	return nil
+}
+
+// AddTrigger installs the trigger command (e.g. "stacktrace" or
+// "hist:keys=dport") on the enabled tracepoint.
+func (ti *traceFSTracingInstance) addTrigger(trigger string) error {
+	// Append, as truncating the trigger file removes all existing triggers
+	if err := ti.appendFile(ti.path+"/events/"+ti.tracepoint+"/trigger", trigger+"\n"); err != nil {
+		return fmt.Errorf("adding trigger %q to tracepoint %q: %w", trigger, ti.tracepoint, err)
+	}
+
+	return nil
+}
+
+// RemoveTrigger removes a trigger command previously installed by addTrigger.
+func (ti *traceFSTracingInstance) removeTrigger(trigger string) error {
+	if err := ti.appendFile(ti.path+"/events/"+ti.tracepoint+"/trigger", "!"+trigger+"\n"); err != nil {
+		return fmt.Errorf("removing trigger %q from tracepoint %q: %w", trigger, ti.tracepoint, err)
+	}
+
+	return nil
+}
+
+// BufferStats returns the statistics of the instance ring buffer, totalled
+// across all CPUs.
+func (ti *traceFSTracingInstance) bufferStats() (*BufferStats, error) {
+	paths, err := filepath.Glob(ti.path + "/per_cpu/cpu*/stats")
+	if err != nil {
+		return nil, fmt.Errorf("listing per-CPU buffer statistics: %w", err)
+	}
+
+	if len(paths) == 0 {
+		return nil, errors.New("no per-CPU buffer statistics present")
+	}
+
+	total := new(BufferStats)
+	for _, path := range paths {
+		stats, err := ti.readBufferStats(path)
+		if err != nil {
+			return nil, err
+		}
+		total.add(stats)
+	}
+
+	return total, nil
+}
+
+func (ti *traceFSTracingInstance) readBufferStats(path string) (*BufferStats, error) {
+	file, err := ti.openFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening buffer statistics: %w", err)
+	}
+	defer file.Close()
+
+	stats, err := parseBufferStats(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading buffer statistics %s: %w", path, err)
+	}
+
+	return stats, nil
+}
+
+// Present returns whether the instance still exists, which it may not if, for
+// example, tracefs has been unmounted.
+func (ti *traceFSTracingInstance) present() bool {
+	file, err := ti.openFile(ti.path+"/tracing_on", os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	file.Close()
+
+	return true
+}
+
+// Snapshot takes a snapshot of the instance ring buffer and copies it to w,
+// then frees the snapshot buffer. As events read from trace_pipe are consumed,
+// the snapshot contains only those events not yet read.
+func (ti *traceFSTracingInstance) snapshot(w io.Writer) error {
+	snapshotPath := ti.path + "/snapshot"
+	if err := ti.writeFile(snapshotPath, "1\n"); err != nil {
+		return fmt.Errorf("taking snapshot: %w", err)
+	}
+
+	if err := ti.copyFile(w, snapshotPath); err != nil {
+		return fmt.Errorf("copying snapshot: %w", err)
+	}
+
+	if err := ti.writeFile(snapshotPath, "0\n"); err != nil {
+		return fmt.Errorf("freeing snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (ti *traceFSTracingInstance) copyFile(w io.Writer, path string) error {
+	file, err := ti.openFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// OpenFile opens the file at path, resolving it beneath the tracefs mountpoint
+// without following symlinks.
+func (ti *traceFSTracingInstance) openFile(path string, flag int, perm uint32) (*os.File, error) {
+	return openBeneath(ti.mountpoint, path, flag, perm)
+}
+
+// WriteFile writes data to the file at path, as ioutil.WriteFile does.
+func (ti *traceFSTracingInstance) writeFile(path, data string) error {
+	file, err := ti.openFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.WriteString(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// AppendFile writes data to the end of the existing file at path. Unlike
+// writeFile, the file is not truncated, which for some tracefs files would
+// reset their state.
+func (ti *traceFSTracingInstance) appendFile(path, data string) error {
+	file, err := ti.openFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.WriteString(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
 // Open opens the tracefs trace_pipe ring buffer from which TCP
-// state change events can be read.
+// state change events can be read. If configured to poll, the trace
+// file is instead polled, which does not consume the ring buffer.
 func (ti *traceFSTracingInstance) open() (io.Reader, error) {
-	tracePipe, err := os.Open(ti.path + "/trace_pipe")
+	if ti.config.readMode == readModePoll {
+		ti.readerPath = ti.path + "/trace"
+		poller := newTracePoller(ti.readerPath, ti.config.pollInterval)
+		poller.open = func(path string) (*os.File, error) {
+			return ti.openFile(path, os.O_RDONLY, 0)
+		}
+		ti.reader = poller
+		return ti.reader, nil
+	}
+
+	ti.readerPath = ti.path + "/trace_pipe"
+	// Opening non-blocking allows the runtime to poll the file, so that reads
+	// honour deadlines and are interrupted by close. Plain reads are used, as
+	// each returns the lines formatted into about a page, whatever the length
+	// of the buffer, so neither readv nor splice saves copies or system calls,
+	// as BenchmarkTracePipeRead shows
+	tracePipe, err := ti.openFile(ti.readerPath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
 	if err != nil {
 		return nil, fmt.Errorf("opening trace_pipe: %w", err)
 	}
 
-	ti.pipe = tracePipe
+	ti.reader = tracePipe
 	return tracePipe, nil
 }
 
+// EventFormat returns the format of the events of the enabled tracepoint.
+func (ti *traceFSTracingInstance) eventFormat() (*eventFormat, error) {
+	if ti.format == nil {
+		return nil, errors.New("tracing instance not enabled")
+	}
+
+	return ti.format, nil
+}
+
+func (ti *traceFSTracingInstance) readEventFormat(tracepoint string) (*eventFormat, error) {
+	file, err := ti.openFile(ti.path+"/events/"+tracepoint+"/format", os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return parseEventFormat(file)
+}
+
+// SetReadDeadline sets the deadline for reads from the trace_pipe file. The
+// trace file poller does not support deadlines.
+func (ti *traceFSTracingInstance) setReadDeadline(t time.Time) error {
+	file, ok := ti.reader.(*os.File)
+	if !ok {
+		return os.ErrNoDeadline
+	}
+
+	return file.SetReadDeadline(t)
+}
+
+// OpenPerCPU opens the trace_pipe file of each CPU within the instance, so
+// that the events of each CPU can be read concurrently.
+func (ti *traceFSTracingInstance) openPerCPU() ([]io.Reader, error) {
+	perCPUPath := ti.path + "/per_cpu"
+	entries, err := readDirBeneath(ti.mountpoint, perCPUPath)
+	if err != nil {
+		return nil, fmt.Errorf("listing per-CPU directories: %w", err)
+	}
+
+	ti.perCPU = make([]io.ReadCloser, 0, len(entries))
+	readers := make([]io.Reader, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry, "cpu") {
+			continue
+		}
+
+		// Opening non-blocking allows the runtime to poll the file, so that
+		// reads are interrupted by close
+		tracePipe, err := ti.openFile(perCPUPath+"/"+entry+"/trace_pipe",
+			os.O_RDONLY|syscall.O_NONBLOCK,
+			0)
+		if err != nil {
+			ti.closePerCPU()
+			return nil, fmt.Errorf("opening %s trace_pipe: %w", entry, err)
+		}
+
+		ti.perCPU = append(ti.perCPU, tracePipe)
+		readers = append(readers, tracePipe)
+	}
+
+	if len(readers) == 0 {
+		return nil, fmt.Errorf("no CPUs found in %s", perCPUPath)
+	}
+
+	ti.readerPath = perCPUPath
+	return readers, nil
+}
+
+// Backfill returns the events currently in the instance trace file. As reading
+// the trace file does not consume them, they are copied in one pass, so that
+// the trace is not reset by further events while it is read.
+func (ti *traceFSTracingInstance) backfill() (io.Reader, error) {
+	trace := new(bytes.Buffer)
+	if err := ti.copyFile(trace, ti.path+"/trace"); err != nil {
+		return nil, fmt.Errorf("copying trace: %w", err)
+	}
+
+	return trace, nil
+}
+
+// KernelInfo describes the kernel, and the tracefs instance which is enabled.
+func (ti *traceFSTracingInstance) kernelInfo() (*KernelInfo, error) {
+	release, err := ioutil.ReadFile(ti.osReleasePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading kernel release: %w", err)
+	}
+
+	bufferSizeKB, err := ti.readBufferSizeKB()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KernelInfo{
+		KernelRelease: strings.TrimSpace(string(release)),
+		Tracepoint:    ti.tracepoint,
+		Mountpoint:    ti.mountpoint,
+		InstancePath:  ti.path,
+		BufferSizeKB:  bufferSizeKB,
+	}, nil
+}
+
 // Close closes the tracefs trace_pipe ring buffer.
 func (ti *traceFSTracingInstance) close() error {
-	log.Printf("Closing trace pipe: %s", ti.pipe.Name())
-	if err := ti.pipe.Close(); err != nil {
+	if ti.perCPU != nil {
+		log.Printf("Closing per-CPU trace pipes: %s", ti.readerPath)
+		if err := ti.closePerCPU(); err != nil {
+			return fmt.Errorf("closing per-CPU trace pipes: %w", err)
+		}
+
+		return nil
+	}
+
+	log.Printf("Closing trace pipe: %s", ti.readerPath)
+	if err := ti.reader.Close(); err != nil {
 		return fmt.Errorf("closing trace pipe: %w", err)
 	}
 
 	return nil
 }
+
+// ClosePerCPU closes the trace_pipe file of each CPU, returning the first
+// error encountered.
+func (ti *traceFSTracingInstance) closePerCPU() error {
+	var firstErr error
+	for _, reader := range ti.perCPU {
+		if err := reader.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	ti.perCPU = nil
+
+	return firstErr
+}
+
+func ownerUID(path string) (int, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return -1, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, fmt.Errorf("unable to get owner of %s", path)
+	}
+
+	return int(stat.Uid), nil
+}
+
+// IsNoMemory returns whether the error is due to the kernel being unable to
+// allocate memory, which tracefs reports as either ENOMEM or ENOSPC.
+func isNoMemory(err error) bool {
+	return errors.Is(err, syscall.ENOMEM) || errors.Is(err, syscall.ENOSPC)
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/google/uuid"
 )
@@ -32,7 +37,8 @@ type mockTracepointDeducer struct {
 	tracepointToReturn string
 	errorToReturn      error
 
-	deduceTracepointCalled bool
+	deduceTracepointCalled  bool
+	releaseTracepointCalled bool
 }
 
 func newMockTracepointDeducer(tracepointToReturn string,
@@ -53,6 +59,11 @@ func (mtd *mockTracepointDeducer) deduceTracepoint() (string, error) {
 	return mtd.tracepointToReturn, nil
 }
 
+func (mtd *mockTracepointDeducer) releaseTracepoint() error {
+	mtd.releaseTracepointCalled = true
+	return nil
+}
+
 func TestTracingInstance(t *testing.T) {
 	// Create a fake tracefs-like directory structure to test against
 	mockTracepoint := "sock/inet_sock_set_state"
@@ -83,7 +94,9 @@ func TestTracingInstance(t *testing.T) {
 	mockUIDProvider := newMockUIDProvider(mockInstanceName)
 	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
 		mockTracepointDeducer,
-		mockUIDProvider)
+		mockUIDProvider,
+		new(config))
+	tracingInstance.rmdir = mockTraceFSRmdir
 
 	if err := tracingInstance.enable(); err != nil {
 		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
@@ -165,7 +178,8 @@ func TestTracingInstanceMountpointRetrieverError(t *testing.T) {
 	mockUIDProvider := newMockUIDProvider("")
 	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
 		mockTracepointDeducer,
-		mockUIDProvider)
+		mockUIDProvider,
+		new(config))
 
 	err := tracingInstance.enable()
 	if err == nil {
@@ -186,7 +200,8 @@ func TestTracingInstanceTracepointDeducerError(t *testing.T) {
 	mockUIDProvider := newMockUIDProvider("")
 	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
 		mockTracepointDeducer,
-		mockUIDProvider)
+		mockUIDProvider,
+		new(config))
 
 	err := tracingInstance.enable()
 	if err == nil {
@@ -207,7 +222,8 @@ func TestTracingInstanceCreateInstanceError(t *testing.T) {
 	mockUIDProvider := newMockUIDProvider("")
 	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
 		mockTracepointDeducer,
-		mockUIDProvider)
+		mockUIDProvider,
+		new(config))
 
 	err := tracingInstance.enable()
 	if err == nil {
@@ -247,7 +263,8 @@ func TestTracingInstanceEnableTracepointError(t *testing.T) {
 	mockUIDProvider := newMockUIDProvider(mockInstanceName)
 	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
 		mockTracepointDeducer,
-		mockUIDProvider)
+		mockUIDProvider,
+		new(config))
 
 	err = tracingInstance.enable()
 	if err == nil {
@@ -287,7 +304,8 @@ func TestTracingInstanceTracingOnError(t *testing.T) {
 	mockUIDProvider := newMockUIDProvider(mockInstanceName)
 	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
 		mockTracepointDeducer,
-		mockUIDProvider)
+		mockUIDProvider,
+		new(config))
 
 	err = tracingInstance.enable()
 	if err == nil {
@@ -327,7 +345,8 @@ func TestTracingInstanceOpenError(t *testing.T) {
 	mockUIDProvider := newMockUIDProvider(mockInstanceName)
 	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
 		mockTracepointDeducer,
-		mockUIDProvider)
+		mockUIDProvider,
+		new(config))
 
 	if err = tracingInstance.enable(); err != nil {
 		t.Errorf("expected nil open error, got %q (of type %T)", err, err)
@@ -341,6 +360,134 @@ func TestTracingInstanceOpenError(t *testing.T) {
 	t.Logf("got error %q (of type %T)", err, err)
 }
 
+// MockEventFormat is the format of the sock/inet_sock_set_state tracepoint.
+const mockEventFormat = `name: inet_sock_set_state
+ID: 1385
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:unsigned char common_flags;	offset:2;	size:1;	signed:0;
+	field:unsigned char common_preempt_count;	offset:3;	size:1;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:const void * skaddr;	offset:8;	size:8;	signed:0;
+	field:int oldstate;	offset:16;	size:4;	signed:1;
+	field:int newstate;	offset:20;	size:4;	signed:1;
+	field:__u16 sport;	offset:24;	size:2;	signed:0;
+	field:__u16 dport;	offset:26;	size:2;	signed:0;
+	field:__u16 family;	offset:28;	size:2;	signed:0;
+	field:__u16 protocol;	offset:30;	size:2;	signed:0;
+	field:__u8 saddr[4];	offset:32;	size:4;	signed:0;
+	field:__u8 daddr[4];	offset:36;	size:4;	signed:0;
+	field:__u8 saddr_v6[16];	offset:40;	size:16;	signed:0;
+	field:__u8 daddr_v6[16];	offset:56;	size:16;	signed:0;
+
+print fmt: "family=%s protocol=%s sport=%hu dport=%hu saddr=%pI4 daddr=%pI4 saddrv6=%pI6c daddrv6=%pI6c oldstate=%s newstate=%s", __print_symbolic(REC->family, { 2, "AF_INET" }, { 10, "AF_INET6" }), __print_symbolic(REC->protocol, { 6, "IPPROTO_TCP" }), REC->sport, REC->dport, REC->saddr, REC->daddr, REC->saddr_v6, REC->daddr_v6, __print_symbolic(REC->oldstate, { 1, "TCP_ESTABLISHED" }), __print_symbolic(REC->newstate, { 1, "TCP_ESTABLISHED" })
+`
+
+// MockSharedSettings is the contents of the files of the settings of a fake
+// tracefs instance, as found before it is prepared.
+var mockSharedSettings = map[string]string{
+	"tracing_on":      "1\n",
+	"tracing_cpumask": "f\n",
+	"buffer_size_kb":  "7 (expanded: 1408)\n",
+	"set_event_pid":   "42\n",
+	"trace_options":   "context-info\nraw\nhex\nnobin\nprint-tgid\nnoevent-fork\n",
+}
+
+// BootstrapMockSharedSettings writes the settings of the fake tracefs instance
+// at path, and of its tracepoint, as found before it is prepared.
+func bootstrapMockSharedSettings(path, tracepoint string) error {
+	files := map[string]string{
+		"events/" + tracepoint + "/enable": "0\n",
+		"events/" + tracepoint + "/filter": "none\n",
+	}
+	for name, contents := range mockSharedSettings {
+		files[name] = contents
+	}
+
+	for name, contents := range files {
+		if err := ioutil.WriteFile(path+"/"+name, []byte(contents), 0600); err != nil {
+			return fmt.Errorf("creating %s file: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// NewMockSharedSettingsConfig returns a config which changes each of the
+// settings of the fake tracefs instance.
+func newMockSharedSettingsConfig() *config {
+	return &config{
+		filter:       "dport == 443",
+		cpuMask:      "3",
+		bufferSizeKB: 4096,
+		eventPIDs:    []int{1},
+		eventFork:    true,
+		traceOptions: []string{"noprint-tgid"},
+	}
+}
+
+// CheckMockSharedSettingsRestored checks that the settings of the fake tracefs
+// instance at path were restored as found before it was prepared. As the fake
+// trace_options file is appended to, the state of each option is the last
+// written.
+func checkMockSharedSettingsRestored(t *testing.T, path, tracepoint string) {
+	expectedContents := map[string]string{
+		"tracing_on":                       "1",
+		"events/" + tracepoint + "/enable": "0",
+		"events/" + tracepoint + "/filter": clearedFilter,
+		"tracing_cpumask":                  "f",
+		"buffer_size_kb":                   "1408",
+		"set_event_pid":                    "42",
+	}
+	for name, expected := range expectedContents {
+		contents, err := ioutil.ReadFile(path + "/" + name)
+		if err != nil {
+			t.Fatalf("running test: unable to read %s file: %v", name, err)
+		}
+
+		if strings.TrimSpace(string(contents)) != expected {
+			t.Errorf("expected %s file to contain %q, but contained %q", name, expected, contents)
+		}
+	}
+
+	contents, err := ioutil.ReadFile(path + "/trace_options")
+	if err != nil {
+		t.Fatalf("running test: unable to read trace_options file: %v", err)
+	}
+
+	options := make(map[string]string)
+	for _, state := range strings.Fields(string(contents)) {
+		options[strings.TrimPrefix(state, "no")] = state
+	}
+
+	for _, expected := range strings.Fields(mockSharedSettings["trace_options"]) {
+		if state := options[strings.TrimPrefix(expected, "no")]; state != expected {
+			t.Errorf("expected trace option %q to be restored, but was %q", expected, state)
+		}
+	}
+}
+
+// MockTraceFSRmdir removes a fake tracefs instance as the kernel removes a real
+// one, along with the files within it, which the rmdir of an ordinary
+// directory would refuse to remove.
+func mockTraceFSRmdir(root, path string) error {
+	return os.RemoveAll(path)
+}
+
+// NewMockTraceFSMkdir returns a function which creates a fake tracefs instance
+// as the kernel creates a real one, populated with the files of the tracepoint.
+func newMockTraceFSMkdir(tracepoint string) func(root, path string, perm uint32) error {
+	return func(root, path string, perm uint32) error {
+		if err := mkdirBeneath(root, path, perm); err != nil {
+			return err
+		}
+
+		_, err := bootstrapMockTraceFSInstance(root, filepath.Base(path), tracepoint, false, false, false)
+		return err
+	}
+}
+
 func bootstrapMockTraceFSInstance(mountpoint,
 	instance,
 	tracepoint string,
@@ -373,11 +520,26 @@ func bootstrapMockTraceFSInstance(mountpoint,
 		}
 	}
 
+	// Create format file for tracepoint
+	if err := ioutil.WriteFile(tracepointPath+"/format", []byte(mockEventFormat), 0600); err != nil {
+		return undoFunc, fmt.Errorf("creating instance tracepoint format file: %w", err)
+	}
+
 	// Create tracing_on file for instance
 	if err := ioutil.WriteFile(instancePath+"/tracing_on", []byte{}, 0600); err != nil {
 		return undoFunc, fmt.Errorf("creating instance tracing_on file: %w", err)
 	}
 
+	// Create trace_options file for instance
+	if err := ioutil.WriteFile(instancePath+"/trace_options", []byte{}, 0600); err != nil {
+		return undoFunc, fmt.Errorf("creating instance trace_options file: %w", err)
+	}
+
+	// Create free_buffer file for instance
+	if err := ioutil.WriteFile(instancePath+"/free_buffer", []byte{}, 0600); err != nil {
+		return undoFunc, fmt.Errorf("creating instance free_buffer file: %w", err)
+	}
+
 	if tracingOnFileInaccessible {
 		os.Chmod(instancePath+"/tracing_on", 0400)
 
@@ -440,3 +602,2013 @@ func instanceExists(mountpoint, instance string) (bool, error) {
 
 	return true, nil
 }
+
+func TestTracingInstanceCPUMask(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, "tracing_cpumask"); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockCPUMask := "c"
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{cpuMask: mockCPUMask})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	contents, err := readInstanceFile(mockMountpoint, mockInstanceName, "tracing_cpumask")
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	if contents != mockCPUMask {
+		t.Errorf("expected instance tracing_cpumask file to contain %q, but contained %q",
+			mockCPUMask,
+			contents)
+	}
+}
+
+func createInstanceFile(mountpoint, instance, file string) error {
+	instancePath := mountpoint + "/instances/" + instance
+
+	if err := os.MkdirAll(path.Dir(instancePath+"/"+file), 0700); err != nil {
+		return fmt.Errorf("creating instance %s parent directory: %w", file, err)
+	}
+
+	if err := ioutil.WriteFile(instancePath+"/"+file, []byte{}, 0600); err != nil {
+		return fmt.Errorf("creating instance %s file: %w", file, err)
+	}
+
+	return nil
+}
+
+func readInstanceFile(mountpoint, instance, file string) (string, error) {
+	instancePath := mountpoint + "/instances/" + instance
+
+	contents, err := ioutil.ReadFile(instancePath + "/" + file)
+	if err != nil {
+		return "", fmt.Errorf("reading instance %s file: %w", file, err)
+	}
+
+	return strings.Trim(string(contents), "\n"), nil
+}
+
+func TestTracingInstanceEnableViaSetEvent(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, "set_event"); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{enableMethod: enableMethodSetEvent})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	setEventFileContents, err := readInstanceFile(mockMountpoint, mockInstanceName, "set_event")
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	expectedSetEventFileContents := "sock:inet_sock_set_state"
+	if setEventFileContents != expectedSetEventFileContents {
+		t.Errorf("expected instance set_event file to contain %q, but contained %q",
+			expectedSetEventFileContents,
+			setEventFileContents)
+	}
+
+	// The tracepoint's own enable file should not have been touched
+	tracepointEnableFileContents, err := readTracepointEnableFile(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint)
+	if err != nil {
+		t.Fatalf("running test: unable to read tracepoint enable file contents: %v", err)
+	}
+
+	if tracepointEnableFileContents != "" {
+		t.Errorf("expected tracepoint enable file to be empty, but contained %q",
+			tracepointEnableFileContents)
+	}
+}
+
+func TestTracingInstanceEnableViaSetEventError(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	// No set_event file is created in the instance
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{enableMethod: enableMethodSetEvent})
+
+	err = tracingInstance.enable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestTracingInstanceEnableViaSetEventPartialError(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	// The tracepoint is enabled by the write to set_event, which then fails,
+	// as would that of a later tracepoint which the kernel fails to enable
+	instancePath := mockMountpoint + "/instances/" + mockInstanceName
+	if err := ioutil.WriteFile(instancePath+"/events/"+mockTracepoint+"/enable", []byte("1\n"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to write tracepoint enable file: %v", err)
+	}
+
+	if err := os.Mkdir(instancePath+"/set_event", 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create unwritable set_event: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{enableMethod: enableMethodSetEvent})
+
+	err = tracingInstance.enable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	tracepointEnableFileContents, err := readTracepointEnableFile(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint)
+	if err != nil {
+		t.Fatalf("running test: unable to read tracepoint enable file contents: %v", err)
+	}
+
+	if tracepointEnableFileContents != "0" {
+		t.Errorf("expected tracepoint to be disabled, but enable file contained %q",
+			tracepointEnableFileContents)
+	}
+}
+
+func TestTracingInstanceFilter(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockFilterFile := "events/" + mockTracepoint + "/filter"
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, mockFilterFile); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockFilter := "dport==443 || dport==80"
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{filter: mockFilter})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	contents, err := readInstanceFile(mockMountpoint, mockInstanceName, mockFilterFile)
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	if contents != mockFilter {
+		t.Errorf("expected tracepoint filter file to contain %q, but contained %q",
+			mockFilter,
+			contents)
+	}
+}
+
+func TestTracingInstanceRefilter(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockFilterFile := "events/" + mockTracepoint + "/filter"
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, mockFilterFile); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockConfig := &config{filter: "dport==443 || dport==80"}
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		mockConfig)
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	for _, test := range []struct {
+		filter   string
+		expected string
+	}{
+		{"dport==22", "dport==22"},
+		{"", clearedFilter},
+	} {
+		mockConfig.filter = test.filter
+		if err := tracingInstance.refilter(); err != nil {
+			t.Errorf("expected nil refilter error, got %q (of type %T)", err, err)
+		}
+
+		contents, err := readInstanceFile(mockMountpoint, mockInstanceName, mockFilterFile)
+		if err != nil {
+			t.Fatalf("running test: %v", err)
+		}
+
+		if contents != test.expected {
+			t.Errorf("expected tracepoint filter file to contain %q, but contained %q",
+				test.expected,
+				contents)
+		}
+	}
+}
+
+func TestTracingInstanceAddAndRemoveTrigger(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockTriggerFile := "events/" + mockTracepoint + "/trigger"
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, mockTriggerFile); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		new(config))
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	mockTrigger := "stacktrace if dport==22"
+	if err := tracingInstance.addTrigger(mockTrigger); err != nil {
+		t.Errorf("expected nil add trigger error, got %q (of type %T)", err, err)
+	}
+
+	if err := tracingInstance.removeTrigger(mockTrigger); err != nil {
+		t.Errorf("expected nil remove trigger error, got %q (of type %T)", err, err)
+	}
+
+	// As the mock trigger file is a regular file, both writes are appended
+	contents, err := readInstanceFile(mockMountpoint, mockInstanceName, mockTriggerFile)
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	expectedContents := mockTrigger + "\n!" + mockTrigger
+	if contents != expectedContents {
+		t.Errorf("expected tracepoint trigger file to contain %q, but contained %q",
+			expectedContents,
+			contents)
+	}
+}
+
+func TestTracingInstanceAdoptsExistingNamedInstance(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	// The instance pre-exists, as if created by an init container
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	uidProvider := newStaticUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		uidProvider,
+		&config{instanceName: mockInstanceName})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	if err := tracingInstance.disable(); err != nil {
+		t.Errorf("expected nil disable error, got %q (of type %T)", err, err)
+	}
+
+	// Check disabling the adopted instance leaves it in place, but turned off
+	exists, err := instanceExists(mockMountpoint, mockInstanceName)
+	if err != nil {
+		t.Fatalf("running test: unable to check if instance exists: %v", err)
+	}
+
+	if !exists {
+		t.Error("expected adopted instance to remain, but was removed")
+	}
+
+	tracepointEnableFileContents, err := readTracepointEnableFile(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint)
+	if err != nil {
+		t.Fatalf("running test: unable to read tracepoint enable file contents: %v", err)
+	}
+
+	instanceTracingOnFileContents, err := readInstanceTracingOnFile(mockMountpoint,
+		mockInstanceName)
+	if err != nil {
+		t.Fatalf("running test: unable to read instance tracing_on file contents: %v", err)
+	}
+
+	if tracepointEnableFileContents != "0" {
+		t.Errorf("expected tracepoint enable file to contain %q, but contained %q", "0",
+			tracepointEnableFileContents)
+	}
+
+	if instanceTracingOnFileContents != "0" {
+		t.Errorf("expected instance tracing_on file to contain %q, but contained %q", "0",
+			instanceTracingOnFileContents)
+	}
+}
+
+func TestTracingInstanceReleaseRestoresAdoptedInstanceSettings(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	// The instance pre-exists, with settings of its owner's choosing
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockInstancePath := mockMountpoint + "/instances/" + mockInstanceName
+	if err := bootstrapMockSharedSettings(mockInstancePath, mockTracepoint); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockConfig := newMockSharedSettingsConfig()
+	mockConfig.instanceName = mockInstanceName
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		newStaticUIDProvider(mockInstanceName),
+		mockConfig)
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	if !tracingInstance.adopted {
+		t.Fatal("expected instance to be adopted, but was not")
+	}
+
+	if err := tracingInstance.disable(); err != nil {
+		t.Errorf("expected nil disable error, got %q (of type %T)", err, err)
+	}
+
+	checkMockSharedSettingsRestored(t, mockInstancePath, mockTracepoint)
+}
+
+func TestTracingInstanceFallsBackToTopLevelWhenInstancesUnsupported(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against, but with
+	// no instances directory, as if the kernel does not support instances
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	for _, file := range []string{"events/" + mockTracepoint + "/enable", "tracing_on", "trace_options", "trace_pipe"} {
+		if err := ioutil.WriteFile(mockMountpoint+"/"+file, []byte{}, 0600); err != nil {
+			t.Fatalf("test bootstrapping: creating top-level %s file: %v", file, err)
+		}
+	}
+
+	if err := ioutil.WriteFile(mockMountpoint+"/events/"+mockTracepoint+"/format",
+		[]byte(mockEventFormat), 0600); err != nil {
+		t.Fatalf("test bootstrapping: creating top-level format file: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider("mock-instance")
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		new(config))
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	tracingOnFileContents, err := ioutil.ReadFile(mockMountpoint + "/tracing_on")
+	if err != nil {
+		t.Fatalf("running test: unable to read top-level tracing_on file: %v", err)
+	}
+
+	if strings.Trim(string(tracingOnFileContents), "\n") != "1" {
+		t.Errorf("expected top-level tracing_on file to contain %q, but contained %q", "1",
+			tracingOnFileContents)
+	}
+
+	reader, err := tracingInstance.open()
+	if err != nil {
+		t.Errorf("expected nil open error, got %q (of type %T)", err, err)
+	}
+
+	tracePipeFile := reader.(*os.File)
+	if tracePipeFile.Name() != mockMountpoint+"/trace_pipe" {
+		t.Errorf("expected top-level trace_pipe file to be opened, but was %s", tracePipeFile.Name())
+	}
+
+	if err := tracingInstance.close(); err != nil {
+		t.Errorf("expected nil close error, got %q (of type %T)", err, err)
+	}
+
+	// Check disabling does not remove the top-level tracefs
+	if err := tracingInstance.disable(); err != nil {
+		t.Errorf("expected nil disable error, got %q (of type %T)", err, err)
+	}
+
+	if !isDirBeneath(mockMountpoint, mockMountpoint) {
+		t.Error("expected top-level tracefs to remain, but was removed")
+	}
+
+	tracingOnFileContents, err = ioutil.ReadFile(mockMountpoint + "/tracing_on")
+	if err != nil {
+		t.Fatalf("running test: unable to read top-level tracing_on file: %v", err)
+	}
+
+	if strings.Trim(string(tracingOnFileContents), "\n") != "0" {
+		t.Errorf("expected top-level tracing_on file to contain %q, but contained %q", "0",
+			tracingOnFileContents)
+	}
+}
+
+func TestTracingInstanceReleaseRestoresTopLevelSettings(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against, with no
+	// instances directory, so that the top-level tracefs is used
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	if err := ioutil.WriteFile(mockMountpoint+"/trace_pipe", []byte{}, 0600); err != nil {
+		t.Fatalf("test bootstrapping: creating top-level trace_pipe file: %v", err)
+	}
+
+	if err := ioutil.WriteFile(mockMountpoint+"/events/"+mockTracepoint+"/format",
+		[]byte(mockEventFormat), 0600); err != nil {
+		t.Fatalf("test bootstrapping: creating top-level format file: %v", err)
+	}
+
+	if err := bootstrapMockSharedSettings(mockMountpoint, mockTracepoint); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider("mock-instance")
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		newMockSharedSettingsConfig())
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	if !tracingInstance.topLevel {
+		t.Fatal("expected top-level tracefs to be used, but was not")
+	}
+
+	if err := tracingInstance.disable(); err != nil {
+		t.Errorf("expected nil disable error, got %q (of type %T)", err, err)
+	}
+
+	checkMockSharedSettingsRestored(t, mockMountpoint, mockTracepoint)
+}
+
+func TestTracingInstanceDisableRetriesBusyInstance(t *testing.T) {
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS("", false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	mockInstancePath := mockMountpoint + "/instances/" + mockInstanceName
+	if err := os.MkdirAll(mockInstancePath, 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock instance: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockInstancePath
+
+	// Report the instance as busy for the first two attempts
+	attempts := 0
+	tracingInstance.rmdir = func(root, path string) error {
+		attempts++
+		if attempts <= 2 {
+			return syscall.EBUSY
+		}
+
+		return rmdirBeneath(root, path)
+	}
+
+	if err := tracingInstance.disable(); err != nil {
+		t.Errorf("expected nil disable error, got %q (of type %T)", err, err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("expected 3 removal attempts, got %d", attempts)
+	}
+
+	exists, err := instanceExists(mockMountpoint, mockInstanceName)
+	if err != nil {
+		t.Fatalf("running test: unable to check if instance exists: %v", err)
+	}
+
+	if exists {
+		t.Error("expected instance to be removed, but was not")
+	}
+}
+
+func TestTracingInstanceDisableBusyInstanceNotReclaimedError(t *testing.T) {
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.path = "/mock/instance"
+
+	attempts := 0
+	tracingInstance.rmdir = func(root, path string) error {
+		attempts++
+		return syscall.EBUSY
+	}
+
+	err := tracingInstance.disable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, ErrInstanceNotReclaimed) {
+		t.Errorf("expected error chain to include %q, but did not", ErrInstanceNotReclaimed)
+	}
+
+	if attempts != instanceRemovalAttempts {
+		t.Errorf("expected %d removal attempts, got %d", instanceRemovalAttempts, attempts)
+	}
+}
+
+func TestTracingInstanceDisableInstanceStillPresentError(t *testing.T) {
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS("", false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint
+
+	// Report success without actually removing the instance
+	tracingInstance.rmdir = func(root, path string) error {
+		return nil
+	}
+
+	err = tracingInstance.disable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, ErrInstanceNotReclaimed) {
+		t.Errorf("expected error chain to include %q, but did not", ErrInstanceNotReclaimed)
+	}
+}
+
+func TestTracingInstanceTraceOptions(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockTraceOptions := []string{"noirq-info", "print-tgid"}
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{traceOptions: mockTraceOptions})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	// The baseline options are written first, so the configured options override them
+	contents, err := readInstanceFile(mockMountpoint, mockInstanceName, "trace_options")
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	expectedContents := strings.Join(append(baselineTraceOptions, mockTraceOptions...), "\n")
+	if contents != expectedContents {
+		t.Errorf("expected instance trace_options file to contain %q, but contained %q",
+			expectedContents,
+			contents)
+	}
+}
+
+func TestTracingInstanceDisableFreesBufferBeforeRemoval(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		new(config))
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	// Capture the free_buffer file contents at the time of removal
+	var freeBufferFileContents string
+	tracingInstance.rmdir = func(root, path string) error {
+		freeBufferFileContents, err = readInstanceFile(mockMountpoint, mockInstanceName, "free_buffer")
+		if err != nil {
+			t.Fatalf("running test: %v", err)
+		}
+
+		return os.RemoveAll(path)
+	}
+
+	if err := tracingInstance.disable(); err != nil {
+		t.Errorf("expected nil disable error, got %q (of type %T)", err, err)
+	}
+
+	if freeBufferFileContents == "" {
+		t.Error("expected instance free_buffer file to be written before removal, but was not")
+	}
+}
+
+func TestTracingInstanceBufferStats(t *testing.T) {
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS("", false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	for _, cpu := range []string{"cpu0", "cpu1"} {
+		statsFile := "per_cpu/" + cpu + "/stats"
+		if err := createInstanceFile(mockMountpoint, mockInstanceName, statsFile); err != nil {
+			t.Fatalf("test bootstrapping: %v", err)
+		}
+
+		if err := ioutil.WriteFile(mockMountpoint+"/instances/"+mockInstanceName+"/"+statsFile,
+			[]byte("entries: 1\noverrun: 2\ncommit overrun: 3\ndropped events: 4\nread events: 5\n"),
+			0600); err != nil {
+			t.Fatalf("test bootstrapping: writing %s: %v", statsFile, err)
+		}
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint + "/instances/" + mockInstanceName
+
+	stats, err := tracingInstance.bufferStats()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedStats := BufferStats{Entries: 2, Overrun: 4, CommitOverrun: 6, DroppedEvents: 8, ReadEvents: 10}
+	if *stats != expectedStats {
+		t.Errorf("expected stats %+v, got %+v", expectedStats, *stats)
+	}
+}
+
+func TestTracingInstanceBufferStatsNotPresentError(t *testing.T) {
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS("", false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint
+
+	_, err = tracingInstance.bufferStats()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestTracingInstanceSnapshot(t *testing.T) {
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS("", false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, "snapshot"); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint + "/instances/" + mockInstanceName
+
+	// As the mock snapshot file is a regular file, the snapshot is the
+	// trigger written to it
+	snapshot := new(strings.Builder)
+	if err := tracingInstance.snapshot(snapshot); err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if snapshot.String() != "1\n" {
+		t.Errorf("expected snapshot %q, got %q", "1\n", snapshot.String())
+	}
+
+	// Check the snapshot was freed afterwards
+	contents, err := readInstanceFile(mockMountpoint, mockInstanceName, "snapshot")
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	if contents != "0" {
+		t.Errorf("expected instance snapshot file to contain %q, but contained %q", "0", contents)
+	}
+}
+
+func TestTracingInstanceSnapshotError(t *testing.T) {
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS("", false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	// No snapshot file exists, as if the kernel does not support snapshots
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint + "/instances/mock-instance"
+
+	err = tracingInstance.snapshot(new(strings.Builder))
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestTracingInstanceOpenPollMode(t *testing.T) {
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil,
+		&config{readMode: readModePoll, pollInterval: time.Millisecond})
+	tracingInstance.path = "/mock/instance"
+
+	reader, err := tracingInstance.open()
+	if err != nil {
+		t.Errorf("expected nil open error, got %q (of type %T)", err, err)
+	}
+
+	poller, ok := reader.(*tracePoller)
+	if !ok {
+		t.Fatalf("expected reader to be a trace poller, but was %T", reader)
+	}
+
+	if poller.path != "/mock/instance/trace" {
+		t.Errorf("expected trace file to be polled, but was %s", poller.path)
+	}
+
+	if err := tracingInstance.close(); err != nil {
+		t.Errorf("expected nil close error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestTracingInstancePresent(t *testing.T) {
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS("", false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint + "/instances/" + mockInstanceName
+
+	if tracingInstance.present() {
+		t.Error("expected instance not to be present, but was")
+	}
+
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, "tracing_on"); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	if !tracingInstance.present() {
+		t.Error("expected instance to be present, but was not")
+	}
+}
+
+func TestTracingInstanceOpenCloseOnExec(t *testing.T) {
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS("", false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, "trace_pipe"); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint + "/instances/" + mockInstanceName
+
+	reader, err := tracingInstance.open()
+	if err != nil {
+		t.Fatalf("expected nil open error, got %q (of type %T)", err, err)
+	}
+	defer tracingInstance.close()
+
+	file, ok := reader.(*os.File)
+	if !ok {
+		t.Fatalf("expected reader to be a file, but was %T", reader)
+	}
+
+	fdFlags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_GETFD, 0)
+	if errno != 0 {
+		t.Fatalf("running test: unable to get file descriptor flags: %v", errno)
+	}
+
+	if fdFlags&syscall.FD_CLOEXEC == 0 {
+		t.Error("expected trace_pipe to be opened close-on-exec, but was not")
+	}
+}
+
+func TestTracingInstanceSetReadDeadlinePollModeError(t *testing.T) {
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil,
+		&config{readMode: readModePoll, pollInterval: time.Millisecond})
+	tracingInstance.path = "/mock/instance"
+
+	if _, err := tracingInstance.open(); err != nil {
+		t.Fatalf("expected nil open error, got %q (of type %T)", err, err)
+	}
+	defer tracingInstance.close()
+
+	err := tracingInstance.setReadDeadline(time.Now())
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, os.ErrNoDeadline) {
+		t.Errorf("expected error chain to include %q, but did not", os.ErrNoDeadline)
+	}
+}
+
+func TestTracingInstanceEventPIDs(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, "set_event_pid"); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	// Create a fake cgroup v2 directory to test against
+	mockCgroup, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock cgroup: %v", err)
+	}
+	defer os.RemoveAll(mockCgroup)
+
+	if err := ioutil.WriteFile(mockCgroup+"/cgroup.threads", []byte("100\n101\n"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock cgroup.threads: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{eventPIDs: []int{1, 42}, eventPIDCgroup: mockCgroup})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	contents, err := readInstanceFile(mockMountpoint, mockInstanceName, "set_event_pid")
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	if contents != "1 42 100 101 " {
+		t.Errorf("expected instance set_event_pid file to contain %q, but contained %q",
+			"1 42 100 101 ",
+			contents)
+	}
+}
+
+func TestTracingInstanceEventPIDsEmptyCgroupError(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	// Create a fake cgroup v1 directory, with no tasks, to test against
+	mockCgroup, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock cgroup: %v", err)
+	}
+	defer os.RemoveAll(mockCgroup)
+
+	if err := ioutil.WriteFile(mockCgroup+"/tasks", []byte{}, 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tasks: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{eventPIDCgroup: mockCgroup})
+
+	err = tracingInstance.enable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestTracingInstanceEventFork(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, "set_event_pid"); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{eventPIDs: []int{42}, eventFork: true})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	contents, err := readInstanceFile(mockMountpoint, mockInstanceName, "trace_options")
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	expectedContents := strings.Join(append(baselineTraceOptions, "event-fork"), "\n")
+	if contents != expectedContents {
+		t.Errorf("expected instance trace_options file to contain %q, but contained %q",
+			expectedContents,
+			contents)
+	}
+}
+
+func TestTracingInstanceRetriesDiscovery(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	// Fail discovery twice, as if tracefs is not yet mounted
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, errors.New("mock not mounted error"))
+	mockMountpointRetriever.noOfTimesToReturnError = 2
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{startupTimeout: time.Minute})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	if mockMountpointRetriever.errorsReturnedCount != 2 {
+		t.Errorf("expected 2 failed discovery attempts, got %d", mockMountpointRetriever.errorsReturnedCount)
+	}
+}
+
+func TestTracingInstanceDiscoveryTimeoutError(t *testing.T) {
+	mockError := errors.New("mock not mounted error")
+	mockMountpointRetriever := newMockMountpointRetriever("", mockError)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		newMockTracepointDeducer("", nil),
+		nil,
+		&config{startupTimeout: 250 * time.Millisecond})
+
+	err := tracingInstance.enable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, mockError) {
+		t.Errorf("expected error chain to include %q, but did not", mockError)
+	}
+
+	if mockMountpointRetriever.errorsReturnedCount < 2 {
+		t.Errorf("expected discovery to be retried, but was attempted %d times",
+			mockMountpointRetriever.errorsReturnedCount)
+	}
+}
+
+func TestTracingInstanceForeignOwnedInstanceError(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	uidProvider := newStaticUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		uidProvider,
+		&config{instanceName: mockInstanceName})
+
+	// The instance is owned by a user other than both the effective user and
+	// the owner of the instances directory
+	mockInstancePath := mockMountpoint + "/instances/" + mockInstanceName
+	tracingInstance.geteuid = func() int { return 1000 }
+	tracingInstance.ownerUID = func(path string) (int, error) {
+		if path == mockInstancePath {
+			return 1001, nil
+		}
+
+		return 0, nil
+	}
+
+	err = tracingInstance.enable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, ErrInstanceNotOwned) {
+		t.Errorf("expected error chain to include %q, but did not", ErrInstanceNotOwned)
+	}
+}
+
+func TestTracingInstanceInstanceOwnedAsInstancesDirectory(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	uidProvider := newStaticUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		uidProvider,
+		&config{instanceName: mockInstanceName})
+
+	// As if tracefs is mounted with the default owner, and used by another user
+	// granted access to it
+	tracingInstance.geteuid = func() int { return 1000 }
+	tracingInstance.ownerUID = func(path string) (int, error) {
+		return 0, nil
+	}
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+}
+
+func TestTracingInstanceAttachesToPreparedInstance(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	// The instance is prepared, as if by an init container
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider("unused-instance")
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{instancePath: mockMountpoint + "/instances/" + mockInstanceName})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	if tracingInstance.format == nil {
+		t.Error("expected tracepoint format to be read, but was not")
+	}
+
+	// Check the prepared instance was not modified
+	tracepointEnableFileContents, err := readTracepointEnableFile(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint)
+	if err != nil {
+		t.Fatalf("running test: unable to read tracepoint enable file contents: %v", err)
+	}
+
+	if tracepointEnableFileContents != "" {
+		t.Errorf("expected tracepoint enable file to be untouched, but contained %q",
+			tracepointEnableFileContents)
+	}
+
+	if err := tracingInstance.disable(); err != nil {
+		t.Errorf("expected nil disable error, got %q (of type %T)", err, err)
+	}
+
+	exists, err := instanceExists(mockMountpoint, mockInstanceName)
+	if err != nil {
+		t.Fatalf("running test: unable to check if instance exists: %v", err)
+	}
+
+	if !exists {
+		t.Error("expected prepared instance to remain, but was removed")
+	}
+
+	exists, err = instanceExists(mockMountpoint, "unused-instance")
+	if err != nil {
+		t.Fatalf("running test: unable to check if instance exists: %v", err)
+	}
+
+	if exists {
+		t.Error("expected no instance to be created, but was")
+	}
+}
+
+func TestTracingInstanceAttachMissingInstanceError(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		nil,
+		&config{instancePath: mockMountpoint + "/instances/mock-instance"})
+
+	err = tracingInstance.enable()
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+}
+
+func TestTracingInstanceOpenPerCPU(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	instancePath := mockMountpoint + "/instances/" + mockInstanceName
+	for _, cpu := range []string{"cpu0", "cpu1"} {
+		if err := os.MkdirAll(instancePath+"/per_cpu/"+cpu, 0700); err != nil {
+			t.Fatalf("test bootstrapping: unable to create per-CPU directory: %v", err)
+		}
+
+		if err := ioutil.WriteFile(instancePath+"/per_cpu/"+cpu+"/trace_pipe", []byte{}, 0600); err != nil {
+			t.Fatalf("test bootstrapping: unable to create per-CPU trace_pipe file: %v", err)
+		}
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = instancePath
+
+	readers, err := tracingInstance.openPerCPU()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(readers) != 2 {
+		t.Errorf("expected 2 per-CPU readers, got %d", len(readers))
+	}
+
+	if err := tracingInstance.close(); err != nil {
+		t.Errorf("expected nil close error, got %q (of type %T)", err, err)
+	}
+
+	for _, reader := range readers {
+		if _, err := reader.Read(make([]byte, 1)); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("expected per-CPU reader to be closed, but read returned %v", err)
+		}
+	}
+}
+
+func TestTracingInstanceBackfill(t *testing.T) {
+	mockMountpoint, err := ioutil.TempDir("", "tcp-audit-tracefs-eventer-test-")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+	defer os.RemoveAll(mockMountpoint)
+
+	mockTrace := "# tracer: nop\n#\n" + mockEarlierShardEvent
+	if err := ioutil.WriteFile(mockMountpoint+"/trace", []byte(mockTrace), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock trace file: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint
+
+	backfill, err := tracingInstance.backfill()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	contents, err := ioutil.ReadAll(backfill)
+	if err != nil {
+		t.Fatalf("running test: unable to read backfill: %v", err)
+	}
+
+	if string(contents) != mockTrace {
+		t.Errorf("expected backfill %q, got %q", mockTrace, contents)
+	}
+}
+
+func TestTracingInstanceKernelInfo(t *testing.T) {
+	mockMountpoint, err := ioutil.TempDir("", "tcp-audit-tracefs-eventer-test-")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+	defer os.RemoveAll(mockMountpoint)
+
+	mockInstancePath := mockMountpoint + "/instances/mock-instance"
+	if err := os.MkdirAll(mockInstancePath, 0700); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock instance: %v", err)
+	}
+
+	if err := ioutil.WriteFile(mockInstancePath+"/buffer_size_kb", []byte("1408\n"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock buffer_size_kb file: %v", err)
+	}
+
+	if err := ioutil.WriteFile(mockMountpoint+"/osrelease", []byte("5.15.0-91-generic\n"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock osrelease file: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.osReleasePath = mockMountpoint + "/osrelease"
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockInstancePath
+	tracingInstance.tracepoint = "sock/inet_sock_set_state"
+
+	kernelInfo, err := tracingInstance.kernelInfo()
+	if err != nil {
+		t.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	expectedKernelInfo := KernelInfo{
+		KernelRelease: "5.15.0-91-generic",
+		Tracepoint:    "sock/inet_sock_set_state",
+		Mountpoint:    mockMountpoint,
+		InstancePath:  mockInstancePath,
+		BufferSizeKB:  1408,
+	}
+	if *kernelInfo != expectedKernelInfo {
+		t.Errorf("expected kernel info %+v, got %+v", expectedKernelInfo, *kernelInfo)
+	}
+}
+
+func TestTracingInstanceRetryWithSmallerBuffer(t *testing.T) {
+	mockMountpoint, err := ioutil.TempDir("", "tcp-audit-tracefs-eventer-test-")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+	defer os.RemoveAll(mockMountpoint)
+
+	if err := ioutil.WriteFile(mockMountpoint+"/buffer_size_kb", []byte("7 (expanded: 1408)\n"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock buffer_size_kb file: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint
+
+	// Fail twice, as if the kernel is under memory pressure
+	writes := 0
+	err = tracingInstance.retryWithSmallerBuffer(func() error {
+		writes++
+		if writes <= 2 {
+			return &os.PathError{Op: "write", Path: "tracing_on", Err: syscall.ENOMEM}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if tracingInstance.degradedBufferSizeKB() != 352 {
+		t.Errorf("expected degraded buffer size %d, got %d", 352, tracingInstance.degradedBufferSizeKB())
+	}
+
+	contents, err := ioutil.ReadFile(mockMountpoint + "/buffer_size_kb")
+	if err != nil {
+		t.Fatalf("running test: unable to read buffer_size_kb file: %v", err)
+	}
+
+	if string(contents) != "352\n" {
+		t.Errorf("expected buffer_size_kb file to contain %q, but contained %q", "352\n", contents)
+	}
+}
+
+func TestTracingInstanceRetryWithSmallerBufferMinimumError(t *testing.T) {
+	mockMountpoint, err := ioutil.TempDir("", "tcp-audit-tracefs-eventer-test-")
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+	defer os.RemoveAll(mockMountpoint)
+
+	if err := ioutil.WriteFile(mockMountpoint+"/buffer_size_kb", []byte("256\n"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock buffer_size_kb file: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = mockMountpoint
+
+	err = tracingInstance.retryWithSmallerBuffer(func() error {
+		return &os.PathError{Op: "write", Path: "tracing_on", Err: syscall.ENOSPC}
+	})
+	if err == nil {
+		t.Error("expected error, got nil")
+	}
+
+	t.Logf("got error %q (of type %T)", err, err)
+
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected error chain to include %q, but did not", syscall.ENOSPC)
+	}
+
+	if tracingInstance.degradedBufferSizeKB() != minBufferSizeKB {
+		t.Errorf("expected degraded buffer size %d, got %d",
+			minBufferSizeKB,
+			tracingInstance.degradedBufferSizeKB())
+	}
+}
+
+func TestTracingInstanceReassertTracing(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	// Tracing has been turned off, but the tracepoint remains enabled
+	instancePath := mockMountpoint + "/instances/" + mockInstanceName
+	if err := ioutil.WriteFile(instancePath+"/tracing_on", []byte("0\n"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to write tracing_on file: %v", err)
+	}
+
+	if err := ioutil.WriteFile(instancePath+"/events/"+mockTracepoint+"/enable", []byte("1\n"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to write tracepoint enable file: %v", err)
+	}
+
+	tracingInstance := newTraceFSTracingInstance(nil, newMockTracepointDeducer("", nil), nil, new(config))
+	tracingInstance.mountpoint = mockMountpoint
+	tracingInstance.path = instancePath
+	tracingInstance.tracepoint = mockTracepoint
+
+	reset, err := tracingInstance.reassertTracing()
+	if err != nil {
+		t.Errorf("expected nil error, got %q (of type %T)", err, err)
+	}
+
+	if len(reset) != 1 || reset[0] != "tracing_on" {
+		t.Errorf("expected only tracing_on to be reset, got %v", reset)
+	}
+
+	contents, err := ioutil.ReadFile(instancePath + "/tracing_on")
+	if err != nil {
+		t.Fatalf("running test: unable to read tracing_on file: %v", err)
+	}
+
+	if string(contents) != "1\n" {
+		t.Errorf("expected tracing_on file to contain %q, but contained %q", "1\n", contents)
+	}
+}
+
+func TestTracingInstanceSetsTraceClock(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	// The kernel selects the local clock by default
+	mockTraceClockPath := mockMountpoint + "/instances/" + mockInstanceName + "/trace_clock"
+	if err := ioutil.WriteFile(mockTraceClockPath, []byte("[local] global boot mono\n"), 0600); err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock trace_clock file: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		new(config))
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	contents, err := readInstanceFile(mockMountpoint, mockInstanceName, "trace_clock")
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	if contents != preferredTraceClock {
+		t.Errorf("expected instance trace_clock file to contain %q, but contained %q",
+			preferredTraceClock,
+			contents)
+	}
+}
+
+func TestTracingInstanceEnablesAvailableResetTracepoints(t *testing.T) {
+	// Create a fake tracefs-like directory structure to test against
+	mockTracepoint := "sock/inet_sock_set_state"
+	mockMountpoint, undoMockTraceFSFunc, err := bootstrapMockTraceFS(mockTracepoint, false)
+	defer undoMockTraceFSFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs: %v", err)
+	}
+
+	mockInstanceName := "mock-instance"
+	undoMockTraceFSInstanceFunc, err := bootstrapMockTraceFSInstance(mockMountpoint,
+		mockInstanceName,
+		mockTracepoint,
+		false,
+		false,
+		false)
+	defer undoMockTraceFSInstanceFunc()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to create mock tracefs instance: %v", err)
+	}
+
+	// Only the send reset tracepoint is provided by the mock kernel
+	mockResetEnableFile := "events/tcp/tcp_send_reset/enable"
+	if err := os.MkdirAll(mockMountpoint+"/instances/"+mockInstanceName+"/events/tcp/tcp_send_reset", 0700); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+	if err := createInstanceFile(mockMountpoint, mockInstanceName, mockResetEnableFile); err != nil {
+		t.Fatalf("test bootstrapping: %v", err)
+	}
+
+	mockMountpointRetriever := newMockMountpointRetriever(mockMountpoint, nil)
+	mockTracepointDeducer := newMockTracepointDeducer(mockTracepoint, nil)
+	mockUIDProvider := newMockUIDProvider(mockInstanceName)
+	tracingInstance := newTraceFSTracingInstance(mockMountpointRetriever,
+		mockTracepointDeducer,
+		mockUIDProvider,
+		&config{resets: true})
+
+	if err := tracingInstance.enable(); err != nil {
+		t.Errorf("expected nil enable error, got %q (of type %T)", err, err)
+	}
+
+	contents, err := readInstanceFile(mockMountpoint, mockInstanceName, mockResetEnableFile)
+	if err != nil {
+		t.Fatalf("running test: %v", err)
+	}
+
+	if contents != "1" {
+		t.Errorf("expected reset tracepoint enable file to contain %q, but contained %q", "1", contents)
+	}
+
+	if len(tracingInstance.auxiliary) != 1 || tracingInstance.auxiliary[0] != "tcp/tcp_send_reset" {
+		t.Errorf("expected only tcp/tcp_send_reset enabled alongside the tracepoint, got %q",
+			tracingInstance.auxiliary)
+	}
+}
+
+// TracePipeReadMethod drains the bytes available from the non-blocking fd into
+// the buffer, returning the number of bytes read and of system calls made.
+type tracePipeReadMethod func(fd int, buf []byte) (n int, syscalls int, err error)
+
+// BenchmarkTracePipeRead compares the ways trace_pipe can be read, on a real
+// tracefs instance to which lines are written through its trace_marker file.
+// It requires a writable tracefs mount, so is otherwise skipped. Each read of
+// trace_pipe returns only the lines formatted into a page or so, whatever its
+// length, and the kernel copies them to the buffer once, so neither readv,
+// which stops at the first short read, nor splice, which then needs a read of
+// the pipe, saves copies. Splicing more than a page at a time also drops the
+// lines of alternate pages on some kernels, which is reported as lost.
+func BenchmarkTracePipeRead(b *testing.B) {
+	const linesPerOp = 1000
+	pageSize := os.Getpagesize()
+
+	instancePath := ""
+	for _, mountpoint := range []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"} {
+		dir := fmt.Sprintf("%s/instances/tcp-audit-benchmark-%d", mountpoint, os.Getpid())
+		if err := os.Mkdir(dir, 0755); err == nil {
+			instancePath = dir
+			break
+		}
+	}
+	if instancePath == "" {
+		b.Skip("no writable tracefs mount")
+	}
+	defer os.Remove(instancePath)
+
+	marker, err := os.OpenFile(instancePath+"/trace_marker", os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer marker.Close()
+
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC); err != nil {
+		b.Fatalf("expected nil error, got %q (of type %T)", err, err)
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	const spliceFNonblock = 0x2 // SPLICE_F_NONBLOCK
+	splice := func(chunk int) tracePipeReadMethod {
+		return func(fd int, buf []byte) (int, int, error) {
+			spliced, err := syscall.Splice(fd, nil, pipe[1], nil, chunk, spliceFNonblock)
+			if err != nil {
+				return 0, 1, err
+			}
+
+			n, syscalls := 0, 1
+			for int64(n) < spliced {
+				read, err := syscall.Read(pipe[0], buf[n:spliced])
+				syscalls++
+				if err != nil {
+					return n, syscalls, err
+				}
+				n += read
+			}
+
+			return n, syscalls, nil
+		}
+	}
+
+	iovecs := make([]syscall.Iovec, 0, lineReaderBlockSize/pageSize)
+	readv := func(fd int, buf []byte) (int, int, error) {
+		iovecs = iovecs[:0]
+		for offset := 0; offset+pageSize <= len(buf) && len(iovecs) < cap(iovecs); offset += pageSize {
+			iovec := syscall.Iovec{Base: &buf[offset]}
+			iovec.SetLen(pageSize)
+			iovecs = append(iovecs, iovec)
+		}
+
+		n, _, errno := syscall.Syscall(syscall.SYS_READV,
+			uintptr(fd),
+			uintptr(unsafe.Pointer(&iovecs[0])),
+			uintptr(len(iovecs)))
+		if errno != 0 {
+			return 0, 1, errno
+		}
+
+		return int(n), 1, nil
+	}
+
+	methods := []struct {
+		name string
+		read tracePipeReadMethod
+	}{
+		{"read", func(fd int, buf []byte) (int, int, error) {
+			n, err := syscall.Read(fd, buf)
+			if err != nil {
+				return 0, 1, err
+			}
+
+			return n, 1, nil
+		}},
+		{"readv", readv},
+		{"splice-page", splice(pageSize)},
+		{"splice-block", splice(lineReaderBlockSize)},
+	}
+
+	line := []byte("sport=44406 dport=443 oldstate=TCP_SYN_SENT newstate=TCP_ESTABLISHED\n")
+	for _, method := range methods {
+		b.Run(method.name, func(b *testing.B) {
+			tracePipe, err := os.OpenFile(instancePath+"/trace_pipe", os.O_RDONLY|syscall.O_NONBLOCK, 0)
+			if err != nil {
+				b.Fatalf("expected nil error, got %q (of type %T)", err, err)
+			}
+			defer tracePipe.Close()
+
+			fd := int(tracePipe.Fd())
+			buf := make([]byte, lineReaderBlockSize)
+			lines, syscalls := 0, 0
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < linesPerOp; j++ {
+					if _, err := marker.Write(line); err != nil {
+						b.Fatalf("expected nil error, got %q (of type %T)", err, err)
+					}
+				}
+				b.StartTimer()
+
+				for {
+					n, calls, err := method.read(fd, buf)
+					syscalls += calls
+					lines += bytes.Count(buf[:n], []byte{'\n'})
+					if err == syscall.EAGAIN || (err == nil && n == 0) {
+						break
+					}
+
+					if err != nil {
+						b.Fatalf("expected nil error, got %q (of type %T)", err, err)
+					}
+				}
+			}
+
+			b.ReportMetric(float64(syscalls)/float64(b.N), "syscalls/op")
+			b.ReportMetric(float64(b.N*linesPerOp-lines)/float64(b.N), "lost-lines/op")
+		})
+	}
+}
@@ -1,9 +1,26 @@
 package main
 
-import "github.com/google/uuid"
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
 
 const (
 	prefix = "tcp-audit-"
+
+	// DefaultUIDFormat is the format used by the uuidProvider if none is given.
+	defaultUIDFormat = prefix + uidFormatUUID
+)
+
+// Placeholders which may appear in a uuidProvider format.
+const (
+	uidFormatUUID      = "{uuid}"
+	uidFormatShortUUID = "{short-uuid}" // The first 8 hex digits of the UUID
+	uidFormatHostname  = "{hostname}"
+	uidFormatPID       = "{pid}"
 )
 
 // UidProvider is an interface which describes objects which provide
@@ -12,10 +29,59 @@ type uidProvider interface {
 	uid() string
 }
 
-// UuidProvider provides a UUID string prefixed with "tcp-audit-"
-type uuidProvider struct{}
+// UuidProvider provides a string containing a UUID, in a given format.
+// By default, this is a UUID string prefixed with "tcp-audit-".
+type uuidProvider struct {
+	format string
+}
+
+// NewUUIDProvider creates a uuidProvider which formats UIDs using the format,
+// in which the {uuid}, {short-uuid}, {hostname} and {pid} placeholders are
+// replaced. If the format is empty, the default is used.
+func newUUIDProvider(format string) *uuidProvider {
+	return &uuidProvider{format}
+}
+
+// Uid returns a string containing a UUID, in the configured format.
+func (up *uuidProvider) uid() string {
+	format := up.format
+	if format == "" {
+		format = defaultUIDFormat
+	}
+
+	uuid := uuid.NewString()
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return strings.NewReplacer(uidFormatUUID, uuid,
+		uidFormatShortUUID, uuid[:8],
+		uidFormatHostname, hostname,
+		uidFormatPID, strconv.Itoa(os.Getpid())).Replace(format)
+}
+
+// StaticUIDProvider provides the same, fixed string every time.
+type staticUIDProvider struct {
+	str string
+}
+
+func newStaticUIDProvider(str string) *staticUIDProvider {
+	return &staticUIDProvider{str}
+}
+
+// Uid returns the fixed string.
+func (up *staticUIDProvider) uid() string {
+	return up.str
+}
+
+// NewInstanceUIDProvider returns the provider of the name of the tracing
+// instance configured: the fixed instance name, if any, or otherwise a UUID in
+// the instance format.
+func newInstanceUIDProvider(config *config) uidProvider {
+	if config.instanceName != "" {
+		return newStaticUIDProvider(config.instanceName)
+	}
 
-// Uid returns a UUID string prefixed with "tcp-audit-"
-func (*uuidProvider) uid() string {
-	return prefix + uuid.NewString()
+	return newUUIDProvider(config.instanceFormat)
 }
@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
 
 func TestUIDProvider(t *testing.T) {
 	uidProvider := new(uuidProvider)
@@ -9,4 +15,43 @@ func TestUIDProvider(t *testing.T) {
 	if uid == "" {
 		t.Errorf("expected UID, got empty string")
 	}
+
+	if !strings.HasPrefix(uid, prefix) {
+		t.Errorf("expected UID to have prefix %q, got %q", prefix, uid)
+	}
+}
+
+func TestUIDProviderFormat(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("test bootstrapping: unable to get hostname: %v", err)
+	}
+
+	uidProvider := newUUIDProvider("tcp-audit-{hostname}-{pid}-{short-uuid}")
+	uid := uidProvider.uid()
+
+	expectedPattern := "^tcp-audit-" + regexp.QuoteMeta(hostname) + "-" +
+		strconv.Itoa(os.Getpid()) + "-[0-9a-f]{8}$"
+	if !regexp.MustCompile(expectedPattern).MatchString(uid) {
+		t.Errorf("expected UID to match %q, got %q", expectedPattern, uid)
+	}
+}
+
+func TestUIDProviderUnique(t *testing.T) {
+	uidProvider := newUUIDProvider("{short-uuid}")
+
+	if uidProvider.uid() == uidProvider.uid() {
+		t.Error("expected UIDs to be unique, but were not")
+	}
+}
+
+func TestStaticUIDProvider(t *testing.T) {
+	mockUID := "mock-instance"
+	uidProvider := newStaticUIDProvider(mockUID)
+
+	for i := 0; i < 2; i++ {
+		if uid := uidProvider.uid(); uid != mockUID {
+			t.Errorf("expected UID %q, got %q", mockUID, uid)
+		}
+	}
 }